@@ -0,0 +1,337 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP access log
+ *
+ * If enabled, every HTTP transaction, served by the HTTPProxy, is
+ * recorded into the per-device access log file, one line per
+ * transaction, either in the Combined Log Format, understood by
+ * the most of web log analyzers, or as JSON. Access log is separate
+ * from the debug logs and is intended for auditing: it tells which
+ * host (and, for local clients, which user) printed or scanned
+ * something and when
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessFormat enumerates possible access log formats
+type AccessFormat int
+
+// AccessFormat constants
+const (
+	AccessFormatNone     AccessFormat = iota // Access log is disabled
+	AccessFormatCombined                     // Combined Log Format
+	AccessFormatJSON                         // One JSON object per line
+)
+
+// String returns AccessFormat name, as used in ipp-usb.conf
+func (format AccessFormat) String() string {
+	switch format {
+	case AccessFormatNone:
+		return "disable"
+	case AccessFormatCombined:
+		return "combined"
+	case AccessFormatJSON:
+		return "json"
+	}
+
+	return fmt.Sprintf("AccessFormat(%d)", int(format))
+}
+
+// AccessLog writes records of HTTP transactions into the
+// per-device access log file
+type AccessLog struct {
+	log    *Logger      // Underlying logger
+	format AccessFormat // Output format
+}
+
+// accessLogRecord represents a single HTTP transaction
+type accessLogRecord struct {
+	Time      time.Time     // Time when request was received
+	Duration  time.Duration // Time spent to serve the request
+	Client    string        // Client address, "unix" for Unix socket
+	UID       int           // Client UID, -1 if unknown
+	Route     string        // Route name
+	Method    string        // HTTP method
+	URI       string        // Request URI, as received
+	Proto     string        // HTTP protocol version
+	Status    int           // Response status
+	Received  int64         // Bytes of request body received
+	Sent      int64         // Bytes of response body sent
+	Referer   string        // Referer: header
+	UserAgent string        // User-Agent: header
+}
+
+// accessLogJSONRecord is the JSON representation of accessLogRecord
+type accessLogJSONRecord struct {
+	Time      string `json:"time"`
+	Client    string `json:"client"`
+	UID       *int   `json:"uid,omitempty"`
+	User      string `json:"user,omitempty"`
+	Route     string `json:"route"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Proto     string `json:"proto"`
+	Status    int    `json:"status"`
+	Received  int64  `json:"bytes_received"`
+	Sent      int64  `json:"bytes_sent"`
+	Duration  int64  `json:"duration_ms"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// NewAccessLog creates a new AccessLog for the device.
+// It returns nil, if access log is disabled by configuration
+func NewAccessLog(info UsbDeviceInfo) *AccessLog {
+	if Conf.AccessLog == AccessFormatNone {
+		return nil
+	}
+
+	al := &AccessLog{
+		log:    NewLogger().ToAccessFile(info),
+		format: Conf.AccessLog,
+	}
+
+	if Conf.LogAsync {
+		al.log.Async()
+	}
+
+	return al
+}
+
+// Close the AccessLog
+func (al *AccessLog) Close() {
+	al.log.Close()
+}
+
+// Record writes the record into the access log
+func (al *AccessLog) Record(rec *accessLogRecord) {
+	al.log.Info(0, "%s", al.Format(rec))
+}
+
+// Format formats the record according to the AccessLog format
+func (al *AccessLog) Format(rec *accessLogRecord) string {
+	if al.format == AccessFormatJSON {
+		return accessLogFormatJSON(rec)
+	}
+	return accessLogFormatCombined(rec)
+}
+
+// accessLogFormatCombined formats the record in the Combined Log Format:
+//
+//	host ident user [time] "request" status bytes "referer" "user-agent"
+func accessLogFormatCombined(rec *accessLogRecord) string {
+	user := accessLogUser(rec.UID)
+	if user == "" {
+		user = "-"
+	}
+
+	sent := "-"
+	if rec.Sent != 0 {
+		sent = strconv.FormatInt(rec.Sent, 10)
+	}
+
+	referer := rec.Referer
+	if referer == "" {
+		referer = "-"
+	}
+
+	agent := rec.UserAgent
+	if agent == "" {
+		agent = "-"
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"",
+		rec.Client, accessLogQuote(user),
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		accessLogQuote(rec.Method), accessLogQuote(rec.URI),
+		accessLogQuote(rec.Proto), rec.Status, sent,
+		accessLogQuote(referer), accessLogQuote(agent))
+}
+
+// accessLogFormatJSON formats the record as JSON
+func accessLogFormatJSON(rec *accessLogRecord) string {
+	jrec := accessLogJSONRecord{
+		Time:      rec.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Client:    rec.Client,
+		Route:     rec.Route,
+		Method:    rec.Method,
+		URI:       rec.URI,
+		Proto:     rec.Proto,
+		Status:    rec.Status,
+		Received:  rec.Received,
+		Sent:      rec.Sent,
+		Duration:  int64(rec.Duration / time.Millisecond),
+		Referer:   rec.Referer,
+		UserAgent: rec.UserAgent,
+	}
+
+	if rec.UID != -1 {
+		uid := rec.UID
+		jrec.UID = &uid
+		jrec.User = accessLogUser(uid)
+	}
+
+	data, _ := json.Marshal(jrec)
+	return string(data)
+}
+
+// accessLogUser returns user name by UID. If name cannot be
+// resolved, numeric UID is returned. If UID is unknown (-1),
+// it returns ""
+func accessLogUser(uid int) string {
+	if uid == -1 {
+		return ""
+	}
+
+	info, err := AuthUIDinfoLookup(uid)
+	if err == nil && len(info.UsrNames) > 1 {
+		return info.UsrNames[1]
+	}
+
+	return strconv.Itoa(uid)
+}
+
+// accessLogQuote escapes characters that may break the
+// Combined Log Format line: quotes, backslashes and control
+// characters
+func accessLogQuote(s string) string {
+	if !strings.ContainsAny(s, "\"\\") &&
+		strings.IndexFunc(s, func(c rune) bool {
+			return c < ' ' || c == 0x7f
+		}) < 0 {
+		return s
+	}
+
+	buf := strings.Builder{}
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&buf, "\\x%2.2x", c)
+		default:
+			buf.WriteRune(c)
+		}
+	}
+
+	return buf.String()
+}
+
+// accessLogClient returns client address of the request,
+// for logging
+func accessLogClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		return "unix"
+	}
+	return host
+}
+
+// accessLogWriter wraps http.ResponseWriter and request body to
+// collect response status and byte counts for the access log
+type accessLogWriter struct {
+	http.ResponseWriter                  // Underlying ResponseWriter
+	rec                 accessLogRecord  // Collected record
+	body                *accessLogReader // Request body wrapper, may be nil
+}
+
+// accessLogReader wraps request body to count received bytes
+type accessLogReader struct {
+	io.ReadCloser       // Underlying body
+	count         int64 // Count of bytes received
+}
+
+// newAccessLogWriter creates a new accessLogWriter for the request.
+// Request body, if any, is replaced with the counting wrapper
+func newAccessLogWriter(w http.ResponseWriter,
+	r *http.Request) *accessLogWriter {
+
+	aw := &accessLogWriter{
+		ResponseWriter: w,
+		rec: accessLogRecord{
+			Time:      time.Now(),
+			Client:    accessLogClient(r),
+			UID:       -1,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		},
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		aw.body = &accessLogReader{ReadCloser: r.Body}
+		r.Body = aw.body
+	}
+
+	return aw
+}
+
+// WriteHeader writes response header
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.rec.Status == 0 {
+		aw.rec.Status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes response body
+func (aw *accessLogWriter) Write(data []byte) (int, error) {
+	if aw.rec.Status == 0 {
+		aw.rec.Status = http.StatusOK
+	}
+
+	n, err := aw.ResponseWriter.Write(data)
+	aw.rec.Sent += int64(n)
+
+	return n, err
+}
+
+// SetClient sets authenticated client's UID to the record
+func (aw *accessLogWriter) SetClient(client AuthClient) {
+	aw.rec.UID = client.UID
+}
+
+// finish completes the record after request is served
+func (aw *accessLogWriter) finish() *accessLogRecord {
+	aw.rec.Duration = time.Since(aw.rec.Time)
+	if aw.rec.Status == 0 {
+		aw.rec.Status = http.StatusOK
+	}
+	if aw.body != nil {
+		aw.rec.Received = aw.body.count
+	}
+
+	return &aw.rec
+}
+
+// Read reads request body
+func (ar *accessLogReader) Read(buf []byte) (int, error) {
+	n, err := ar.ReadCloser.Read(buf)
+	ar.count += int64(n)
+	return n, err
+}
+
+// accessLogSetClient passes authenticated client to the
+// accessLogWriter, if w is the accessLogWriter
+func accessLogSetClient(w http.ResponseWriter, client AuthClient) {
+	if aw, ok := w.(*accessLogWriter); ok {
+		aw.SetClient(client)
+	}
+}
@@ -0,0 +1,122 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP access log
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAccessLogFormat tests formatting of access log records
+func TestAccessLogFormat(t *testing.T) {
+	rec := &accessLogRecord{
+		Time:      time.Date(2020, 10, 10, 13, 55, 36, 0, time.UTC),
+		Duration:  1500 * time.Millisecond,
+		Client:    "192.168.1.10",
+		UID:       -1,
+		Route:     "ipp-print",
+		Method:    "POST",
+		URI:       "/ipp/print",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Received:  12345,
+		Sent:      321,
+		UserAgent: "CUPS/2.4 \"test\"",
+	}
+
+	type testData struct {
+		format AccessFormat
+		expect string
+	}
+
+	tests := []testData{
+		{
+			AccessFormatCombined,
+			`192.168.1.10 - - [10/Oct/2020:13:55:36 +0000] ` +
+				`"POST /ipp/print HTTP/1.1" 200 321 "-" ` +
+				`"CUPS/2.4 \"test\""`,
+		},
+		{
+			AccessFormatJSON,
+			`{"time":"2020-10-10T13:55:36.000Z","client":"192.168.1.10",` +
+				`"route":"ipp-print","method":"POST","uri":"/ipp/print",` +
+				`"proto":"HTTP/1.1","status":200,"bytes_received":12345,` +
+				`"bytes_sent":321,"duration_ms":1500,` +
+				`"user_agent":"CUPS/2.4 \"test\""}`,
+		},
+	}
+
+	for _, test := range tests {
+		al := &AccessLog{format: test.format}
+		s := al.Format(rec)
+		if s != test.expect {
+			t.Errorf("%s:\n"+
+				"expected: %s\n"+
+				"present:  %s",
+				test.format, test.expect, s)
+		}
+	}
+
+	// Empty response body is "-" in the Combined Log Format
+	rec.Sent = 0
+	al := &AccessLog{format: AccessFormatCombined}
+	if s := al.Format(rec); !strings.Contains(s, `" 200 - "`) {
+		t.Errorf("empty body: %s", s)
+	}
+}
+
+// TestAccessLogWriter tests collecting of response status
+// and byte counts by the accessLogWriter
+func TestAccessLogWriter(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("hello, "))
+		w.Write([]byte("world"))
+	}
+
+	r := httptest.NewRequest("POST", "/ipp/print",
+		strings.NewReader("0123456789"))
+	r.Header.Set("User-Agent", "test")
+
+	aw := newAccessLogWriter(httptest.NewRecorder(), r)
+	aw.SetClient(AuthClient{UID: 1000})
+	handler(aw, r)
+	rec := aw.finish()
+
+	if rec.Status != http.StatusAccepted {
+		t.Errorf("status: expected %d, present %d",
+			http.StatusAccepted, rec.Status)
+	}
+
+	if rec.Sent != 12 || rec.Received != 10 {
+		t.Errorf("bytes: expected 12 sent/10 received, "+
+			"present %d/%d", rec.Sent, rec.Received)
+	}
+
+	if rec.Client != "192.0.2.1" || rec.UID != 1000 ||
+		rec.Method != "POST" || rec.URI != "/ipp/print" ||
+		rec.UserAgent != "test" {
+		t.Errorf("request parameters mismatch: %+v", rec)
+	}
+
+	// Implicit status
+	r = httptest.NewRequest("GET", "/", nil)
+	aw = newAccessLogWriter(httptest.NewRecorder(), r)
+	rec = aw.finish()
+
+	if rec.Status != http.StatusOK || rec.UID != -1 {
+		t.Errorf("implicit status: expected 200 and UID -1, "+
+			"present %d and %d", rec.Status, rec.UID)
+	}
+}
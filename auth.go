@@ -233,6 +233,13 @@ func authUIDrequiresUID() bool {
 	return false
 }
 
+// AuthClient describes the authenticated client
+type AuthClient struct {
+	Local   bool    // Client is local
+	UID     int     // Client UID, -1 if unknown
+	Allowed AuthOps // Operations allowed to the client
+}
+
 // AuthHTTPRequest performs authentication for the incoming
 // HTTP request
 //
@@ -241,22 +248,12 @@ func authUIDrequiresUID() bool {
 // and err explains the reason
 func AuthHTTPRequest(log *Logger,
 	client, server *net.TCPAddr,
-	rq *http.Request) (status int, err error) {
+	rq *http.Request) (cl AuthClient, status int, err error) {
 
-	// Guess the operation by URL
-	post := rq.Method == "POST"
-	ops := AuthOpsConfig // The default
-	switch {
-	case post && strings.HasPrefix(rq.URL.Path, "/ipp/print"):
-		ops = AuthOpsPrint
-	case post && strings.HasPrefix(rq.URL.Path, "/ipp/faxout"):
-		ops = AuthOpsFax
-	case strings.HasPrefix(rq.URL.Path, "/eSCL"):
-		ops = AuthOpsScan
-	}
+	cl.UID = -1
 
-	log.Debug(' ', "auth: operation requested: %s (HTTP %s %s)",
-		ops, rq.Method, rq.URL)
+	// Guess the operation by URL
+	ops := authRequestOps(log, rq)
 
 	// Check if client and server addresses are both local
 	addrs, err := net.InterfaceAddrs()
@@ -264,7 +261,7 @@ func AuthHTTPRequest(log *Logger,
 		err = fmt.Errorf("can't get local IP addresses: %s", err)
 		log.Error('!', "auth: %s", err)
 
-		return http.StatusInternalServerError, err
+		return cl, http.StatusInternalServerError, err
 	}
 
 	clientIsLocal := client.IP.IsLoopback()
@@ -302,31 +299,91 @@ func AuthHTTPRequest(log *Logger,
 	case !TCPClientUIDSupported():
 		reason = fmt.Sprintf("UID auth not supported on %s",
 			runtime.GOOS)
-	case !authUIDrequiresUID():
+	case !authUIDrequiresUID() && Conf.AccessLog == AccessFormatNone:
 		reason = "auth rules don't use UID"
 	}
 
 	// Obtain UID, if we really need it
 	if reason == "" {
 		uid, err = TCPClientUID(client, server)
-		if err != nil {
+		switch {
+		case err == nil:
+			log.Debug(' ', "auth: client UID=%d", uid)
+
+		case !authUIDrequiresUID():
+			// UID is only needed for the access log, so
+			// this is not fatal
+			log.Debug(' ', "auth: can't get client UID: %s", err)
+			uid, err = -1, nil
+
+		default:
 			err = fmt.Errorf("can't get client UID: %s",
 				err)
 			log.Error('!', "auth: %s", err)
-			return http.StatusInternalServerError, err
+			return cl, http.StatusInternalServerError, err
 		}
-
-		log.Debug(' ', "auth: client UID=%d", uid)
 	} else {
 		log.Debug(' ', "auth: client UID=%d (%s)", uid, reason)
 	}
 
+	cl.Local = clientIsLocal
+	cl.UID = uid
+	cl.Allowed, status, err = authCheckUID(log, uid, ops)
+
+	return
+}
+
+// AuthUnixRequest performs authentication for the incoming
+// HTTP request, received via the Unix domain socket
+//
+// uid is the client UID, obtained from the socket credentials,
+// or -1, if it is not available
+//
+// Return values are the same as for AuthHTTPRequest
+func AuthUnixRequest(log *Logger, uid int,
+	rq *http.Request) (cl AuthClient, status int, err error) {
+
+	ops := authRequestOps(log, rq)
+	log.Debug(' ', "auth: client UID=%d (unix socket)", uid)
+
+	cl.Local = true
+	cl.UID = uid
+	cl.Allowed, status, err = authCheckUID(log, uid, ops)
+
+	return
+}
+
+// authRequestOps guesses operations, requested by the HTTP request,
+// by its method and URL
+func authRequestOps(log *Logger, rq *http.Request) AuthOps {
+	post := rq.Method == "POST"
+	ops := AuthOpsConfig // The default
+	switch {
+	case post && strings.HasPrefix(rq.URL.Path, "/ipp/print"):
+		ops = AuthOpsPrint
+	case post && strings.HasPrefix(rq.URL.Path, "/ipp/faxout"):
+		ops = AuthOpsFax
+	case strings.HasPrefix(rq.URL.Path, "/eSCL"):
+		ops = AuthOpsScan
+	}
+
+	log.Debug(' ', "auth: operation requested: %s (HTTP %s %s)",
+		ops, rq.Method, rq.URL)
+
+	return ops
+}
+
+// authCheckUID checks if requested operations are allowed for
+// the client with the given UID. All operations, allowed for
+// the client, are returned as well
+func authCheckUID(log *Logger, uid int,
+	ops AuthOps) (allowed AuthOps, status int, err error) {
 	// Lookup UID info
 	info, err := AuthUIDinfoLookup(uid)
 	if err != nil {
 		err = fmt.Errorf("can't resolve UID %d: %s", uid, err)
 		log.Error('!', "auth: %s", err)
-		return 0, err
+		return 0, 0, err
 	}
 
 	log.Debug(' ', "auth: UID %d resolved:", uid)
@@ -334,16 +391,16 @@ func AuthHTTPRequest(log *Logger,
 	log.Debug(' ', "  group names: %s", strings.Join(info.GrpNames, ","))
 
 	// Authenticate
-	allowed := AuthUID(info)
+	allowed = AuthUID(info)
 	log.Debug(' ', "auth: allowed operations: %s", allowed)
 
 	if ops&allowed != AuthOpsNone {
 		log.Debug(' ', "auth: access granted")
-		return http.StatusOK, nil
+		return allowed, http.StatusOK, nil
 	}
 
 	err = errors.New("Operation not allowed. See ipp-usb.conf for details")
 	log.Error('!', "auth: %s", err)
 
-	return http.StatusForbidden, err
+	return allowed, http.StatusForbidden, err
 }
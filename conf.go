@@ -12,50 +12,175 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 )
 
 const (
 	// ConfFileName defines a name of ipp-usb configuration file
 	ConfFileName = "ipp-usb.conf"
+
+	// ConfDropInDirName defines a name of directory with
+	// configuration drop-ins, merged over the main file
+	ConfDropInDirName = "ipp-usb.conf.d"
+)
+
+// ConfOrigin represents origin of the applied configuration
+// parameter, for the `check` mode output
+type ConfOrigin struct {
+	Section, Key, Value string // Parameter section, name and value
+	File                string // Origin file
+	Line                int    // Line in that file
+	Overridden          bool   // Overridden by the later file
+}
+
+var (
+	// ConfFiles contains list of loaded configuration files,
+	// in order of loading
+	ConfFiles []string
+
+	// ConfOrigins contains all applied configuration
+	// parameters, in order of loading
+	ConfOrigins []*ConfOrigin
 )
 
 // Configuration represents a program configuration
 type Configuration struct {
-	HTTPMinPort        int            // Starting port number for HTTP to bind to
-	HTTPMaxPort        int            // Ending port number for HTTP to bind to
-	DNSSdEnable        bool           // Enable DNS-SD advertising
-	LoopbackOnly       bool           // Use only loopback interface
-	IPV6Enable         bool           // Enable IPv6 advertising
-	ConfAuthUID        []*AuthUIDRule // [auth uid], parsed
-	LogDevice          LogLevel       // Per-device LogLevel mask
-	LogMain            LogLevel       // Main log LogLevel mask
-	LogConsole         LogLevel       // Console  LogLevel mask
-	LogMaxFileSize     int64          // Maximum log file size
-	LogMaxBackupFiles  uint           // Count of files preserved during rotation
-	LogAllPrinterAttrs bool           // Get *all* printer attrs, for logging
-	ColorConsole       bool           // Enable ANSI colors on console
-	Quirks             QuirksSet      // Device quirks
+	HTTPMinPort         int            // Starting port number for HTTP to bind to
+	HTTPMaxPort         int            // Ending port number for HTTP to bind to
+	HTTPTCPEnable       bool           // Serve HTTP over TCP
+	HTTPUnixEnable      bool           // Serve HTTP over Unix domain socket
+	HTTPSEnable         bool           // Serve HTTPS on additional port
+	TLSCertFile         string         // TLS certificate file, "" if generated
+	TLSKeyFile          string         // TLS key file, "" if generated
+	DNSSdEnable         bool           // Enable DNS-SD advertising
+	DNSSdWithdrawDelay  time.Duration  // Delay between DNS-SD and HTTP stop
+	DNSSdTxtRefresh     time.Duration  // IPP TXT refresh interval, 0 if none
+	DNSSdNameTmpl       DNSSdNameTmpl  // DNS-SD name template, nil if none
+	DNSSdScanner        bool           // Also advertise _scanner._tcp
+	DNSSdProbe          bool           // Advertise only after probe success
+	DNSSdURLHost        string         // Host for URLs in TXT, "" if FQDN
+	LoopbackOnly        bool           // Use only loopback interface
+	LoopbackAddrEnable  bool           // Per-device loopback addresses
+	Interface           string         // LAN interface to export to, "" if any
+	AllowedSubnets      []*net.IPNet   // Allowed client subnets, nil if any
+	IPV6Enable          bool           // Enable IPv6 advertising
+	FirewallHints       bool           // Report firewall openings
+	PrinterIcons        bool           // Cache and serve printer icons
+	ConfAuthUID         []*AuthUIDRule // [auth uid], parsed
+	IppPolicy           IppPolicy      // [ipp policy], parsed
+	LogDevice           LogLevel       // Per-device LogLevel mask
+	LogMain             LogLevel       // Main log LogLevel mask
+	LogConsole          LogLevel       // Console  LogLevel mask
+	LogJournald         LogLevel       // Journald LogLevel mask, 0 if none
+	LogMaxFileSize      int64          // Maximum log file size
+	LogMaxBackupFiles   uint           // Count of files preserved during rotation
+	LogAllPrinterAttrs  bool           // Get *all* printer attrs, for logging
+	LogConnTrace        bool           // Trace USB connections state
+	LogAsync            bool           // Write log files asynchronously
+	ColorConsole        bool           // Enable ANSI colors on console
+	AllowNonRoot        bool           // Allow to run without root
+	StateOwner          string         // Owner of state and log dirs
+	LogFormat           LogFormat      // Log output format
+	AccessLog           AccessFormat   // HTTP access log format
+	QuirksUpdateURL     string         // Quirks bundle URL, "" if none
+	ICCProfileLookup    bool           // Lookup ICC profiles for devices
+	FaxRecheckInterval  time.Duration  // IPP FaxOut re-validation interval
+	HotplugDebounce     time.Duration  // Delay before first init attempt
+	HotplugRetryMin     time.Duration  // Initial retry interval
+	HotplugRetryMax     time.Duration  // Maximum retry interval
+	HotplugRetryCount   uint           // Max init attempts, 0 if unlimited
+	HotplugDrainTimeout time.Duration  // Drain timeout on exit
+	HotplugNetlink      bool           // Listen to kernel uevents
+	HotplugBlacklist    time.Duration  // Watchdog blacklist time
+	UsbMaxDrainSize     int64          // Max drained response size, 0 if any
+	UsbMaxDrainTime     time.Duration  // Max drain time, 0 if unlimited
+	UsbMaxDrains        uint           // Max concurrent drains, 0 if any
+	UsbShareBufferSize  int64          // Buffer size for shared connection
+	UsbKeepUsblp        bool           // Don't detach usblp from other ifaces
+	UsbTimeoutRetry     bool           // Reset and retry timed out requests
+	UsbIppSanitizeMax   int64          // Max IPP message size to sanitize
+	IppAttrsCacheTTL    time.Duration  // Printer attributes cache TTL
+	EsclStatusInterval  time.Duration  // ScannerStatus poll, 0 if none
+	UsbSpoolMaxMemory   int64          // Max request body spooled in memory
+	UsbSpoolDir         string         // Directory for spooled requests
+	UsbBandwidthLimit   int64          // Total bandwidth, 0 if unlimited
+	StateDir            string         // Program state directory
+	DataDir             string         // Persistent data directory
+	StateReadOnly       bool           // Keep device state in memory only
+	ClaimDir            string         // Shared device claims dir, "" if none
+	Quirks              QuirksSet      // Device quirks
 }
 
 // Conf contains a global instance of program configuration
 var Conf = Configuration{
-	HTTPMinPort:        60000,
-	HTTPMaxPort:        65535,
-	DNSSdEnable:        true,
-	LoopbackOnly:       true,
-	IPV6Enable:         true,
-	ConfAuthUID:        nil,
-	LogDevice:          LogDebug,
-	LogMain:            LogDebug,
-	LogConsole:         LogDebug,
-	LogMaxFileSize:     256 * 1024,
-	LogMaxBackupFiles:  5,
-	LogAllPrinterAttrs: false,
-	ColorConsole:       true,
+	HTTPMinPort:         60000,
+	AllowNonRoot:        false,
+	StateOwner:          "",
+	HTTPMaxPort:         65535,
+	HTTPTCPEnable:       true,
+	HTTPUnixEnable:      false,
+	HTTPSEnable:         false,
+	TLSCertFile:         "",
+	TLSKeyFile:          "",
+	DNSSdEnable:         true,
+	DNSSdWithdrawDelay:  0,
+	DNSSdTxtRefresh:     0,
+	DNSSdNameTmpl:       nil,
+	DNSSdScanner:        false,
+	DNSSdProbe:          false,
+	DNSSdURLHost:        "",
+	LoopbackOnly:        true,
+	LoopbackAddrEnable:  false,
+	Interface:           "",
+	AllowedSubnets:      nil,
+	IPV6Enable:          true,
+	FirewallHints:       false,
+	PrinterIcons:        true,
+	ConfAuthUID:         nil,
+	IppPolicy:           nil,
+	LogDevice:           LogDebug,
+	LogMain:             LogDebug,
+	LogConsole:          LogDebug,
+	LogJournald:         0,
+	LogMaxFileSize:      256 * 1024,
+	LogMaxBackupFiles:   5,
+	LogAllPrinterAttrs:  false,
+	LogConnTrace:        false,
+	LogAsync:            false,
+	ColorConsole:        true,
+	LogFormat:           LogFormatText,
+	AccessLog:           AccessFormatNone,
+	QuirksUpdateURL:     "",
+	ICCProfileLookup:    false,
+	FaxRecheckInterval:  0,
+	HotplugDebounce:     0,
+	HotplugRetryMin:     DevInitRetryInterval,
+	HotplugRetryMax:     DevInitRetryInterval,
+	HotplugRetryCount:   0,
+	HotplugDrainTimeout: 30 * time.Second,
+	HotplugNetlink:      false,
+	HotplugBlacklist:    10 * time.Minute,
+	UsbMaxDrainSize:     128 * 1024 * 1024,
+	UsbMaxDrainTime:     10 * time.Second,
+	UsbMaxDrains:        0,
+	UsbShareBufferSize:  256 * 1024,
+	UsbKeepUsblp:        false,
+	UsbTimeoutRetry:     true,
+	UsbIppSanitizeMax:   4 * 1024 * 1024,
+	IppAttrsCacheTTL:    0,
+	EsclStatusInterval:  0,
+	UsbSpoolMaxMemory:   16 * 1024 * 1024,
+	UsbSpoolDir:         PathProgStateSpool,
+	UsbBandwidthLimit:   0,
+	StateDir:            PathDefaultProgState,
+	DataDir:             PathDefaultStatsDir,
+	StateReadOnly:       false,
+	ClaimDir:            "",
 }
 
 // ConfLoad loads the program configuration
@@ -68,10 +193,20 @@ func ConfLoad() error {
 
 	exepath = filepath.Dir(exepath)
 
-	// Build list of configuration files
-	files := []string{
-		filepath.Join(PathConfDir, ConfFileName),
-		filepath.Join(exepath, ConfFileName),
+	// Build list of configuration files. Drop-ins are merged
+	// over the main file, in lexical order
+	var files []string
+	for _, dir := range []string{PathConfDir, exepath} {
+		files = append(files, filepath.Join(dir, ConfFileName))
+
+		var dropins []string
+		dropins, err = IniListDropIns(
+			filepath.Join(dir, ConfDropInDirName))
+		if err != nil {
+			return fmt.Errorf("conf: %s", err)
+		}
+
+		files = append(files, dropins...)
 	}
 
 	// Load file by file
@@ -82,15 +217,54 @@ func ConfLoad() error {
 		}
 	}
 
+	// Validate merged configuration
+	err = confValidate()
+	if err != nil {
+		return err
+	}
+
+	// Relocate state directories. Spool directory follows
+	// the state directory, unless configured explicitly
+	if Conf.UsbSpoolDir == PathProgStateSpool {
+		Conf.UsbSpoolDir = ""
+	}
+
+	PathSetProgState(Conf.StateDir)
+	PathSetStatsDir(Conf.DataDir)
+
+	if Conf.UsbSpoolDir == "" {
+		Conf.UsbSpoolDir = PathProgStateSpool
+	}
+
 	// Load quirks
+	return ConfLoadQuirks()
+}
+
+// ConfLoadQuirks (re)loads device quirks into the Conf.Quirks
+//
+// On error, previously loaded quirks remain unchanged
+func ConfLoadQuirks() error {
+	// Obtain path to executable directory
+	exepath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("conf: %s", err)
+	}
+
+	exepath = filepath.Dir(exepath)
+
+	// Note, quirks, loaded later, take precedence, so automatically
+	// updated quirks override the quirks from the package, but
+	// not the quirks defined by sysadmin
 	quirksDirs := []string{
 		PathQuirksDir,
+		PathQuirksUpdateDir,
 		PathConfQuirksDir,
 		filepath.Join(exepath, "ipp-usb-quirks"),
 	}
 
+	quirks, err := LoadQuirksSet(quirksDirs...)
 	if err == nil {
-		Conf.Quirks, err = LoadQuirksSet(quirksDirs...)
+		Conf.Quirks = quirks
 	}
 
 	return err
@@ -109,6 +283,8 @@ func confLoadInternal(path string) error {
 
 	defer ini.Close()
 
+	ConfFiles = append(ConfFiles, path)
+
 	// Extract options
 	for err == nil {
 		var rec *IniRecord
@@ -124,17 +300,149 @@ func confLoadInternal(path string) error {
 				err = rec.LoadIPPort(&Conf.HTTPMinPort)
 			case confMatchName(rec.Key, "http-max-port"):
 				err = rec.LoadIPPort(&Conf.HTTPMaxPort)
+			case confMatchName(rec.Key, "http-tcp"):
+				err = rec.LoadNamedBool(&Conf.HTTPTCPEnable, "disable", "enable")
+			case confMatchName(rec.Key, "http-unix-socket"):
+				err = rec.LoadNamedBool(&Conf.HTTPUnixEnable, "disable", "enable")
+			case confMatchName(rec.Key, "https"):
+				err = rec.LoadNamedBool(&Conf.HTTPSEnable, "disable", "enable")
+			case confMatchName(rec.Key, "tls-cert-file"):
+				Conf.TLSCertFile = rec.Value
+			case confMatchName(rec.Key, "tls-key-file"):
+				Conf.TLSKeyFile = rec.Value
 			case confMatchName(rec.Key, "dns-sd"):
 				err = rec.LoadNamedBool(&Conf.DNSSdEnable, "disable", "enable")
+			case confMatchName(rec.Key, "dns-sd-withdraw-delay"):
+				err = rec.LoadDuration(&Conf.DNSSdWithdrawDelay)
+			case confMatchName(rec.Key, "dns-sd-refresh-interval"):
+				err = rec.LoadDuration(&Conf.DNSSdTxtRefresh)
+			case confMatchName(rec.Key, "dns-sd-name-template"):
+				err = rec.LoadDNSSdNameTmpl(&Conf.DNSSdNameTmpl)
+			case confMatchName(rec.Key, "dns-sd-scanner"):
+				err = rec.LoadNamedBool(&Conf.DNSSdScanner,
+					"disable", "enable")
+			case confMatchName(rec.Key, "require-probe-success"):
+				err = rec.LoadBool(&Conf.DNSSdProbe)
+			case confMatchName(rec.Key, "dns-sd-url-host"):
+				err = rec.LoadDNSSdURLHost(&Conf.DNSSdURLHost)
 			case confMatchName(rec.Key, "interface"):
-				err = rec.LoadNamedBool(&Conf.LoopbackOnly, "all", "loopback")
+				switch rec.Value {
+				case "all", "loopback":
+					err = rec.LoadNamedBool(&Conf.LoopbackOnly, "all", "loopback")
+					Conf.Interface = ""
+				default:
+					err = rec.LoadInterface(&Conf.Interface)
+					if err == nil {
+						Conf.LoopbackOnly = false
+					}
+				}
+			case confMatchName(rec.Key, "loopback-addr"):
+				err = rec.LoadNamedBool(&Conf.LoopbackAddrEnable, "disable", "enable")
+			case confMatchName(rec.Key, "allowed-subnets"):
+				err = rec.LoadSubnets(&Conf.AllowedSubnets)
 			case confMatchName(rec.Key, "ipv6"):
 				err = rec.LoadNamedBool(&Conf.IPV6Enable, "disable", "enable")
+			case confMatchName(rec.Key, "firewall-hints"):
+				err = rec.LoadNamedBool(&Conf.FirewallHints, "disable", "enable")
+			case confMatchName(rec.Key, "printer-icons"):
+				err = rec.LoadNamedBool(&Conf.PrinterIcons, "disable", "enable")
 			}
 
 		case confMatchName(rec.Section, "auth uid"):
 			err = rec.LoadAuthUIDRules(&Conf.ConfAuthUID)
 
+		case confMatchName(rec.Section, "ipp policy"):
+			err = rec.LoadIppPolicy(&Conf.IppPolicy)
+
+		case confMatchName(rec.Section, "quirks"):
+			switch {
+			case confMatchName(rec.Key, "update-url"):
+				Conf.QuirksUpdateURL = rec.Value
+			}
+
+		case confMatchName(rec.Section, "color"):
+			switch {
+			case confMatchName(rec.Key, "icc-profile-lookup"):
+				err = rec.LoadNamedBool(&Conf.ICCProfileLookup, "disable", "enable")
+			}
+
+		case confMatchName(rec.Section, "fax"):
+			switch {
+			case confMatchName(rec.Key, "recheck-interval"):
+				err = rec.LoadDuration(&Conf.FaxRecheckInterval)
+			}
+
+		case confMatchName(rec.Section, "privileges"):
+			switch {
+			case confMatchName(rec.Key, "allow-non-root"):
+				err = rec.LoadNamedBool(&Conf.AllowNonRoot,
+					"disable", "enable")
+			case confMatchName(rec.Key, "state-owner"):
+				Conf.StateOwner = rec.Value
+			}
+
+		case confMatchName(rec.Section, "state"):
+			switch {
+			case confMatchName(rec.Key, "state-dir"):
+				err = rec.LoadPath(&Conf.StateDir)
+			case confMatchName(rec.Key, "data-dir"):
+				err = rec.LoadPath(&Conf.DataDir)
+			case confMatchName(rec.Key, "read-only"):
+				err = rec.LoadNamedBool(&Conf.StateReadOnly,
+					"disable", "enable")
+			case confMatchName(rec.Key, "claim-dir"):
+				err = rec.LoadPath(&Conf.ClaimDir)
+			}
+
+		case confMatchName(rec.Section, "hotplug"):
+			switch {
+			case confMatchName(rec.Key, "debounce"):
+				err = rec.LoadDuration(&Conf.HotplugDebounce)
+			case confMatchName(rec.Key, "retry-interval"):
+				err = rec.LoadDuration(&Conf.HotplugRetryMin)
+			case confMatchName(rec.Key, "retry-max-interval"):
+				err = rec.LoadDuration(&Conf.HotplugRetryMax)
+			case confMatchName(rec.Key, "retry-max-attempts"):
+				err = rec.LoadUint(&Conf.HotplugRetryCount)
+			case confMatchName(rec.Key, "drain-timeout"):
+				err = rec.LoadDuration(&Conf.HotplugDrainTimeout)
+			case confMatchName(rec.Key, "netlink"):
+				err = rec.LoadNamedBool(&Conf.HotplugNetlink,
+					"disable", "enable")
+			case confMatchName(rec.Key, "blacklist-time"):
+				err = rec.LoadDuration(&Conf.HotplugBlacklist)
+			}
+
+		case confMatchName(rec.Section, "usb"):
+			switch {
+			case confMatchName(rec.Key, "max-drain-size"):
+				err = rec.LoadSize(&Conf.UsbMaxDrainSize)
+			case confMatchName(rec.Key, "max-drain-time"):
+				err = rec.LoadDuration(&Conf.UsbMaxDrainTime)
+			case confMatchName(rec.Key, "max-drains"):
+				err = rec.LoadUint(&Conf.UsbMaxDrains)
+			case confMatchName(rec.Key, "share-buffer-size"):
+				err = rec.LoadSize(&Conf.UsbShareBufferSize)
+			case confMatchName(rec.Key, "ipp-sanitize-max-size"):
+				err = rec.LoadSize(&Conf.UsbIppSanitizeMax)
+			case confMatchName(rec.Key, "ipp-attrs-cache-ttl"):
+				err = rec.LoadDuration(&Conf.IppAttrsCacheTTL)
+			case confMatchName(rec.Key, "escl-status-interval"):
+				err = rec.LoadDuration(&Conf.EsclStatusInterval)
+			case confMatchName(rec.Key, "spool-max-memory"):
+				err = rec.LoadSize(&Conf.UsbSpoolMaxMemory)
+			case confMatchName(rec.Key, "spool-dir"):
+				Conf.UsbSpoolDir = rec.Value
+			case confMatchName(rec.Key, "bandwidth-limit"):
+				err = rec.LoadSize(&Conf.UsbBandwidthLimit)
+			case confMatchName(rec.Key, "keep-usblp"):
+				err = rec.LoadNamedBool(&Conf.UsbKeepUsblp,
+					"disable", "enable")
+			case confMatchName(rec.Key, "timeout-retry"):
+				err = rec.LoadNamedBool(&Conf.UsbTimeoutRetry,
+					"disable", "enable")
+			}
+
 		case confMatchName(rec.Section, "logging"):
 			switch {
 			case confMatchName(rec.Key, "device-log"):
@@ -143,30 +451,87 @@ func confLoadInternal(path string) error {
 				err = rec.LoadLogLevel(&Conf.LogMain)
 			case confMatchName(rec.Key, "console-log"):
 				err = rec.LoadLogLevel(&Conf.LogConsole)
+			case confMatchName(rec.Key, "journald-log"):
+				err = rec.LoadLogLevel(&Conf.LogJournald)
 			case confMatchName(rec.Key, "console-color"):
 				err = rec.LoadNamedBool(&Conf.ColorConsole, "disable", "enable")
+			case confMatchName(rec.Key, "log-format"):
+				err = rec.LoadLogFormat(&Conf.LogFormat)
+			case confMatchName(rec.Key, "access-log"):
+				err = rec.LoadAccessFormat(&Conf.AccessLog)
 			case confMatchName(rec.Key, "max-file-size"):
 				err = rec.LoadSize(&Conf.LogMaxFileSize)
 			case confMatchName(rec.Key, "max-backup-files"):
 				err = rec.LoadUint(&Conf.LogMaxBackupFiles)
 			case confMatchName(rec.Key, "get-all-printer-attrs"):
 				err = rec.LoadBool(&Conf.LogAllPrinterAttrs)
+			case confMatchName(rec.Key, "conn-trace"):
+				err = rec.LoadBool(&Conf.LogConnTrace)
+			case confMatchName(rec.Key, "async-write"):
+				err = rec.LoadNamedBool(&Conf.LogAsync, "disable", "enable")
 			}
 		}
+
+		if err == nil {
+			confOriginAdd(rec)
+		}
 	}
 
 	if err != nil && err != io.EOF {
 		return err
 	}
 
-	// Validate configuration
+	return nil
+}
+
+// confValidate validates the loaded configuration
+func confValidate() error {
 	if Conf.HTTPMinPort >= Conf.HTTPMaxPort {
 		return errors.New("http-min-port must be less that http-max-port")
 	}
 
+	if Conf.HotplugRetryMin == 0 {
+		return errors.New("retry-interval must not be zero")
+	}
+
+	if Conf.HotplugRetryMin > Conf.HotplugRetryMax {
+		return errors.New("retry-interval must not exceed retry-max-interval")
+	}
+
+	if !Conf.HTTPTCPEnable && !Conf.HTTPUnixEnable {
+		return errors.New("http-tcp and http-unix-socket cannot be both disabled")
+	}
+
+	if (Conf.TLSCertFile == "") != (Conf.TLSKeyFile == "") {
+		return errors.New("tls-cert-file and tls-key-file must be set together")
+	}
+
 	return nil
 }
 
+// confOriginAdd records origin of the applied configuration
+// parameter. Previous occurrences of the same parameter are
+// marked as overridden. The [auth uid] rules are accumulated
+// rather than overridden
+func confOriginAdd(rec *IniRecord) {
+	if !confMatchName(rec.Section, "auth uid") {
+		for _, origin := range ConfOrigins {
+			if confMatchName(origin.Section, rec.Section) &&
+				confMatchName(origin.Key, rec.Key) {
+				origin.Overridden = true
+			}
+		}
+	}
+
+	ConfOrigins = append(ConfOrigins, &ConfOrigin{
+		Section: rec.Section,
+		Key:     rec.Key,
+		Value:   rec.Value,
+		File:    rec.File,
+		Line:    rec.Line,
+	})
+}
+
 // confMatchName tells if section or key name matches
 // the pattern
 //   - match is case-insensitive
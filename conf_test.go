@@ -0,0 +1,238 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for program configuration
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConfDropIns tests merging of configuration drop-ins
+func TestConfDropIns(t *testing.T) {
+	saveConf, saveFiles, saveOrigins := Conf, ConfFiles, ConfOrigins
+	defer func() {
+		Conf, ConfFiles, ConfOrigins = saveConf, saveFiles, saveOrigins
+	}()
+
+	ConfFiles, ConfOrigins = nil, nil
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	dropins := filepath.Join(dir, ConfDropInDirName)
+	os.Mkdir(dropins, 0755)
+
+	files := map[string]string{
+		filepath.Join(dir, ConfFileName): "[network]\n" +
+			"  http-min-port = 61000\n" +
+			"  dns-sd = enable\n",
+		filepath.Join(dropins, "20-second.conf"): "[network]\n" +
+			"  http-min-port = 63000\n",
+		filepath.Join(dropins, "10-first.conf"): "[network]\n" +
+			"  http-min-port = 62000\n" +
+			"  dns-sd = disable\n",
+		filepath.Join(dropins, "30-ignored.txt"): "[network]\n" +
+			"  dns-sd = enable\n",
+	}
+
+	for path, data := range files {
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// Check list of drop-ins
+	list, err := IniListDropIns(dropins)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(list) != 2 ||
+		filepath.Base(list[0]) != "10-first.conf" ||
+		filepath.Base(list[1]) != "20-second.conf" {
+		t.Fatalf("unexpected drop-ins: %v", list)
+	}
+
+	// Load the main file and drop-ins
+	list = append([]string{filepath.Join(dir, ConfFileName)}, list...)
+	for _, path := range list {
+		err = confLoadInternal(path)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if Conf.HTTPMinPort != 63000 {
+		t.Errorf("http-min-port: expected 63000, present %d",
+			Conf.HTTPMinPort)
+	}
+
+	if Conf.DNSSdEnable {
+		t.Errorf("dns-sd: expected disable, present enable")
+	}
+
+	// Check origins
+	if len(ConfFiles) != 3 || len(ConfOrigins) != 5 {
+		t.Fatalf("unexpected origins: %d files, %d parameters",
+			len(ConfFiles), len(ConfOrigins))
+	}
+
+	for _, origin := range ConfOrigins {
+		final := filepath.Base(origin.File) != ConfFileName
+		if origin.Key == "http-min-port" {
+			final = origin.Value == "63000"
+		}
+
+		if origin.Overridden == final {
+			t.Errorf("%s:%d: %s = %s: overridden is %v",
+				origin.File, origin.Line, origin.Key,
+				origin.Value, origin.Overridden)
+		}
+	}
+}
+
+// TestConfInterface tests validation of the interface parameter
+func TestConfInterface(t *testing.T) {
+	saveConf, saveFiles, saveOrigins := Conf, ConfFiles, ConfOrigins
+	defer func() {
+		Conf, ConfFiles, ConfOrigins = saveConf, saveFiles, saveOrigins
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skipf("no network interfaces: %v", err)
+	}
+
+	path := filepath.Join(dir, ConfFileName)
+
+	// Existent interface
+	data := "[network]\n  interface = " + ifaces[0].Name + "\n"
+	ioutil.WriteFile(path, []byte(data), 0644)
+
+	err = confLoadInternal(path)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+
+	if Conf.Interface != ifaces[0].Name || Conf.LoopbackOnly {
+		t.Errorf("interface = %s: not applied", ifaces[0].Name)
+	}
+
+	// Missed interface must be reported with file and line
+	data = "[network]\n  interface = no-such-if0\n"
+	ioutil.WriteFile(path, []byte(data), 0644)
+
+	err = confLoadInternal(path)
+	if err == nil {
+		t.Fatalf("missed interface accepted")
+	}
+
+	if prefix := path + ":2:"; !strings.HasPrefix(err.Error(), prefix) {
+		t.Errorf("expected %q error prefix, present %q",
+			prefix, err.Error())
+	}
+}
+
+// TestConfKeepUsblp tests loading of the keep-usblp parameter
+func TestConfKeepUsblp(t *testing.T) {
+	saveConf, saveFiles, saveOrigins := Conf, ConfFiles, ConfOrigins
+	defer func() {
+		Conf, ConfFiles, ConfOrigins = saveConf, saveFiles, saveOrigins
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ConfFileName)
+
+	tests := []struct {
+		value    string
+		expected bool
+		err      bool
+	}{
+		{"enable", true, false},
+		{"disable", false, false},
+		{"sometimes", false, true},
+	}
+
+	for _, test := range tests {
+		Conf.UsbKeepUsblp = false
+
+		data := "[usb]\n  keep-usblp = " + test.value + "\n"
+		ioutil.WriteFile(path, []byte(data), 0644)
+
+		err = confLoadInternal(path)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("keep-usblp = %s: error not reported",
+				test.value)
+		case !test.err && err != nil:
+			t.Errorf("keep-usblp = %s: %s", test.value, err)
+		case Conf.UsbKeepUsblp != test.expected:
+			t.Errorf("keep-usblp = %s: expected %v, present %v",
+				test.value, test.expected, Conf.UsbKeepUsblp)
+		}
+	}
+}
+
+// TestConfEsclStatusInterval tests loading of the escl-status-interval
+// parameter. ScannerStatus polling must be disabled by default
+func TestConfEsclStatusInterval(t *testing.T) {
+	saveConf, saveFiles, saveOrigins := Conf, ConfFiles, ConfOrigins
+	defer func() {
+		Conf, ConfFiles, ConfOrigins = saveConf, saveFiles, saveOrigins
+	}()
+
+	if Conf.EsclStatusInterval != 0 {
+		t.Errorf("escl-status-interval: enabled by default (%s)",
+			Conf.EsclStatusInterval)
+	}
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ConfFileName)
+	data := "[usb]\n  escl-status-interval = 30000\n"
+	ioutil.WriteFile(path, []byte(data), 0644)
+
+	err = confLoadInternal(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if Conf.EsclStatusInterval != 30*time.Second {
+		t.Errorf("escl-status-interval: expected %s, present %s",
+			30*time.Second, Conf.EsclStatusInterval)
+	}
+}
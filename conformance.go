@@ -0,0 +1,361 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP-over-USB conformance self-test
+ *
+ * Conformance test opens the specified device, as probe does, and runs
+ * the key checks from the IPP-over-USB 1.0 specification against it.
+ * Each check passes, fails or is skipped (if not applicable to the
+ * device). The report helps to categorize buggy firmware and to
+ * choose quirks
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// conformanceEnv is the environment, in which conformance
+// checks are running
+type conformanceEnv struct {
+	desc      UsbDeviceDesc // Device descriptor
+	info      UsbDeviceInfo // Device info
+	transport *UsbTransport // Transport to the device
+	client    *http.Client  // HTTP client over the transport
+	port      int           // HTTP port for URLs
+}
+
+// conformanceResult is the result of the conformance check
+type conformanceResult int
+
+// conformanceResult values:
+const (
+	conformancePass conformanceResult = iota
+	conformanceFail
+	conformanceSkip
+)
+
+// String returns conformanceResult name
+func (r conformanceResult) String() string {
+	switch r {
+	case conformancePass:
+		return "PASS"
+	case conformanceFail:
+		return "FAIL"
+	case conformanceSkip:
+		return "SKIP"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(r))
+}
+
+// conformanceCheck is the single conformance check
+type conformanceCheck struct {
+	name string // Check name, for report
+	spec string // Specification section
+	run  func(env *conformanceEnv) (conformanceResult, string)
+}
+
+// conformanceChecks contains all conformance checks, in the
+// order of execution
+//
+// The zlp check must go last, as it examines behavior of the
+// device during all the preceding checks
+var conformanceChecks = []conformanceCheck{
+	{"interfaces", "4.1", conformanceCheckInterfaces},
+	{"basic-caps-descriptor", "4.3", conformanceCheckBasicCaps},
+	{"ipp-request", "5", conformanceCheckIpp},
+	{"escl-request", "5", conformanceCheckEscl},
+	{"multiple-interfaces", "4.1, 5", conformanceCheckMultiIf},
+	{"chunked-request", "5", conformanceCheckChunked},
+	{"zlp", "5", conformanceCheckZlp},
+}
+
+// Conformance runs the conformance self-test against the device,
+// specified by its USB address, written as "BUS:DEV"
+//
+// The report is printed; if some checks are failed, error is
+// returned
+func Conformance(name string) error {
+	desc, transport, err := probeOpen(name)
+	if err != nil {
+		return err
+	}
+
+	defer transport.Close(false)
+
+	env := &conformanceEnv{
+		desc:      desc,
+		info:      transport.UsbDeviceInfo(),
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+		port:      Conf.HTTPMinPort,
+	}
+
+	// Run init script, if any, as daemon does
+	err = probeInitScript(transport, env.client)
+	if err != nil {
+		return err
+	}
+
+	// Run checks
+	transport.SetTimeout(ConformanceTimeout)
+
+	report := []string{
+		"IPP-over-USB conformance:",
+		fmt.Sprintf("  Device: %s %4.4x:%4.4x %s", desc.UsbAddr,
+			env.info.Vendor, env.info.Product, env.info.ProductName),
+	}
+
+	results, failed := conformanceRun(env)
+	report = append(report, results...)
+
+	for _, line := range report {
+		InitLog.Info(0, "%s", line)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d checks failed",
+			failed, len(conformanceChecks))
+	}
+
+	return nil
+}
+
+// conformanceRun runs all conformance checks and returns the
+// report lines and count of failed checks
+func conformanceRun(env *conformanceEnv) (report []string, failed int) {
+	for _, check := range conformanceChecks {
+		result, details := check.run(env)
+		if result == conformanceFail {
+			failed++
+		}
+
+		report = append(report,
+			fmt.Sprintf("  %s %-22s (section %s): %s",
+				result, check.name, check.spec, details))
+	}
+
+	return
+}
+
+// conformanceCheckInterfaces checks that device has at least
+// two IPP-over-USB interfaces, as required by specification
+func conformanceCheckInterfaces(env *conformanceEnv) (
+	conformanceResult, string) {
+
+	n := len(env.desc.IfAddrs)
+	details := fmt.Sprintf("%d interface(s)", n)
+
+	if n < 2 {
+		return conformanceFail, details + ", at least 2 required"
+	}
+
+	return conformancePass, details
+}
+
+// conformanceCheckBasicCaps checks presence of the class-specific
+// device info descriptor with basic capabilities
+func conformanceCheckBasicCaps(env *conformanceEnv) (
+	conformanceResult, string) {
+
+	if !env.info.HasBasicCaps {
+		return conformanceFail, "descriptor missed or malformed"
+	}
+
+	return conformancePass, env.info.BasicCaps.String()
+}
+
+// conformanceCheckIpp checks that IPP Get-Printer-Attributes works
+func conformanceCheckIpp(env *conformanceEnv) (conformanceResult, string) {
+	if env.info.BasicCaps&UsbIppBasicCapsPrint == 0 {
+		return conformanceSkip, "device can't print"
+	}
+
+	err := conformanceIppRequest(env, false)
+	if err != nil {
+		return conformanceFail, err.Error()
+	}
+
+	return conformancePass, "Get-Printer-Attributes OK"
+}
+
+// conformanceCheckEscl checks that eSCL ScannerCapabilities works
+func conformanceCheckEscl(env *conformanceEnv) (conformanceResult, string) {
+	if env.info.BasicCaps&UsbIppBasicCapsScan == 0 {
+		return conformanceSkip, "device can't scan"
+	}
+
+	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities",
+		env.port)
+
+	err := soakGet(env.client, uri)
+	if err != nil {
+		return conformanceFail, err.Error()
+	}
+
+	return conformancePass, "ScannerCapabilities OK"
+}
+
+// conformanceCheckMultiIf checks that device serves requests on
+// all its interfaces simultaneously
+func conformanceCheckMultiIf(env *conformanceEnv) (
+	conformanceResult, string) {
+
+	n := len(env.desc.IfAddrs)
+	if n < 2 {
+		return conformanceSkip, "device has only one interface"
+	}
+
+	var rq func() error
+	switch {
+	case env.info.BasicCaps&UsbIppBasicCapsPrint != 0:
+		rq = func() error { return conformanceIppRequest(env, false) }
+	case env.info.BasicCaps&UsbIppBasicCapsScan != 0:
+		uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities",
+			env.port)
+		rq = func() error { return soakGet(env.client, uri) }
+	default:
+		return conformanceSkip, "device can neither print nor scan"
+	}
+
+	// Start all requests at once, so they will occupy all
+	// interfaces simultaneously
+	var start, done sync.WaitGroup
+	var lock sync.Mutex
+	var errs []error
+
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			err := rq()
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	start.Done()
+	done.Wait()
+
+	if len(errs) != 0 {
+		return conformanceFail, fmt.Sprintf("%d of %d requests failed: %s",
+			len(errs), n, errs[0])
+	}
+
+	return conformancePass, fmt.Sprintf("%d parallel requests OK", n)
+}
+
+// conformanceCheckChunked checks that device accepts requests with
+// chunked body
+func conformanceCheckChunked(env *conformanceEnv) (
+	conformanceResult, string) {
+
+	if env.info.BasicCaps&UsbIppBasicCapsPrint == 0 {
+		return conformanceSkip, "device can't print"
+	}
+
+	err := conformanceIppRequest(env, true)
+	if err != nil {
+		return conformanceFail, err.Error()
+	}
+
+	return conformancePass, "chunked Get-Printer-Attributes OK"
+}
+
+// conformanceCheckZlp checks that device didn't send unexpected
+// zero-length packets during the preceding checks (see the
+// zlp-recv-hack quirk)
+func conformanceCheckZlp(env *conformanceEnv) (conformanceResult, string) {
+	if env.transport.zlpRecvHackEnabled() {
+		return conformanceSkip,
+			fmt.Sprintf("%q quirk in effect", QuirkNmZlpRecvHack)
+	}
+
+	if hits := atomic.LoadInt32(&env.transport.zlpRecvHits); hits != 0 {
+		return conformanceFail,
+			fmt.Sprintf("%d ZLP(s) followed by timeout", hits)
+	}
+
+	if env.transport.TimeoutExpired() {
+		return conformanceFail, "some requests timed out"
+	}
+
+	return conformancePass, "no unexpected ZLPs"
+}
+
+// conformanceIppRequest sends IPP Get-Printer-Attributes request,
+// optionally with chunked body, and checks the response
+func conformanceIppRequest(env *conformanceEnv, chunked bool) error {
+	uri := fmt.Sprintf("http://localhost:%d/ipp/print", env.port)
+
+	msg := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+
+	data, _ := msg.EncodeBytes()
+
+	var body io.Reader = bytes.NewReader(data)
+	if chunked {
+		// Hide the length, so body will be sent chunked
+		body = struct{ io.Reader }{body}
+	}
+
+	rq, _ := http.NewRequest("POST", uri, body)
+	rq.Header.Set("Content-Type", goipp.ContentType)
+	if chunked {
+		rq.ContentLength = -1
+	}
+
+	resp, err := env.client.Do(rq)
+	if err != nil {
+		return err
+	}
+
+	data, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case err != nil:
+		return err
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	err = msg.DecodeBytes(data)
+	if err != nil {
+		return fmt.Errorf("IPP decode: %s", err)
+	}
+
+	if status := goipp.Status(msg.Code); status >= 0x0100 {
+		return fmt.Errorf("IPP: %s", status)
+	}
+
+	if len(msg.Printer) == 0 {
+		return errors.New("IPP: no printer attributes returned")
+	}
+
+	return nil
+}
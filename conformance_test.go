@@ -0,0 +1,128 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP-over-USB conformance self-test
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestConformanceRun tests conformance checks over the virtual device
+func TestConformanceRun(t *testing.T) {
+	rejectChunked := false
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.URL.Path == "/eSCL/ScannerCapabilities" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte("<scan:ScannerCapabilities/>"))
+			return
+		}
+
+		chunked := len(r.TransferEncoding) != 0
+		if chunked && rejectChunked {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var rq goipp.Message
+		body, _ := ioutil.ReadAll(r.Body)
+		rq.DecodeBytes(body)
+
+		rsp := goipp.NewResponse(goipp.DefaultVersion,
+			goipp.StatusOk, rq.RequestID)
+		rsp.Printer.Add(goipp.MakeAttribute("printer-name",
+			goipp.TagName, goipp.String("test")))
+
+		data, _ := rsp.EncodeBytes()
+		w.Header().Set("Content-Type", goipp.ContentType)
+		w.Write(data)
+	})
+
+	tests := []struct {
+		interfaces    int
+		hasBasicCaps  bool
+		rejectChunked bool
+		expected      []string
+	}{
+		{
+			interfaces:   2,
+			hasBasicCaps: true,
+			expected: []string{
+				"PASS interfaces",
+				"PASS basic-caps-descriptor",
+				"PASS ipp-request",
+				"PASS escl-request",
+				"PASS multiple-interfaces",
+				"PASS chunked-request",
+				"PASS zlp",
+			},
+		},
+
+		{
+			interfaces:    1,
+			hasBasicCaps:  false,
+			rejectChunked: true,
+			expected: []string{
+				"FAIL interfaces",
+				"FAIL basic-caps-descriptor",
+				"PASS ipp-request",
+				"PASS escl-request",
+				"SKIP multiple-interfaces",
+				"FAIL chunked-request",
+				"PASS zlp",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		rejectChunked = test.rejectChunked
+
+		info := testUsbLoopbackInfo
+		info.HasBasicCaps = test.hasBasicCaps
+
+		lb := newUsbLoopback(info, handler)
+		transport, err := newUsbLoopbackTransport(lb, test.interfaces)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		env := &conformanceEnv{
+			info:      info,
+			transport: transport,
+			client:    &http.Client{Transport: transport},
+		}
+
+		for i := 0; i < test.interfaces; i++ {
+			env.desc.IfAddrs.Add(UsbIfAddr{Num: i})
+		}
+
+		report, _ := conformanceRun(env)
+		transport.Close(false)
+
+		if len(report) != len(test.expected) {
+			t.Errorf("%d interfaces: expected %d lines, present %d",
+				test.interfaces, len(test.expected), len(report))
+			continue
+		}
+
+		for i := range report {
+			line := strings.TrimSpace(report[i])
+			if !strings.HasPrefix(line, test.expected[i]+" ") {
+				t.Errorf("%d interfaces: expected %q, present %q",
+					test.interfaces, test.expected[i], line)
+			}
+		}
+	}
+}
@@ -21,11 +21,196 @@ const (
 	// device graceful shutdown
 	DevShutdownTimeout = 5 * time.Second
 
+	// DevFaxOutRecheckInterval specifies how often unavailable
+	// IPP FaxOut service is re-probed, if periodic re-probing is
+	// not configured
+	DevFaxOutRecheckInterval = 60 * time.Second
+
+	// DevLoopbackPort specifies TCP port, used together with
+	// per-device loopback addresses (the standard IPP port)
+	DevLoopbackPort = 631
+
 	// DevInitRetryInterval specifies the retry interval for
 	// failed device initialization
 	DevInitRetryInterval = 2 * time.Second
 
+	// DevReenumerateWait specifies how long to wait for device
+	// re-enumeration after hard reset, taken by the per-device
+	// watchdog, before the next initialization attempt
+	DevReenumerateWait = 30 * time.Second
+
+	// PnPBusyMax specifies how long PnP manager may handle a single
+	// event before it is considered hung, and systemd watchdog pings
+	// are suspended. Legitimate handling (initialization of several
+	// devices with timeouts and retries, waiting for re-enumeration,
+	// draining of requests on shutdown) takes much less
+	PnPBusyMax = 10 * time.Minute
+
+	// DevProbeInterval specifies how often advertised services are
+	// re-probed, if require-probe-success is enabled
+	DevProbeInterval = 60 * time.Second
+
+	// DevProbeRetryInterval specifies how often services are
+	// re-probed, while they are not advertised due to probe failure
+	DevProbeRetryInterval = 5 * time.Second
+
+	// DevProbeFailMax specifies how many consecutive probe failures
+	// cause advertised services to be withdrawn
+	DevProbeFailMax = 3
+
 	// DNSSdRetryInterval specifies the retry interval in a case
 	// of failed DNS-SD operation
 	DNSSdRetryInterval = 2 * time.Second
+
+	// DNSSdRetryMaxInterval specifies the maximum retry interval.
+	// On repeated failures (i.e., while DNS-SD daemon is down), the
+	// retry interval doubles, starting from the DNSSdRetryInterval,
+	// up to this value
+	DNSSdRetryMaxInterval = 60 * time.Second
+
+	// UsbWatchdogInterval specifies how often libusb event loop
+	// progress is checked. If event loop doesn't make any progress
+	// during this interval, it is considered dead and libusb
+	// is reinitialized
+	UsbWatchdogInterval = 15 * time.Second
+
+	// UsbZlpRecvHackThreshold specifies how many times a zero-length
+	// packet, followed by receive timeout, needs to be seen before
+	// zlp-recv-hack is enabled for the device automatically
+	UsbZlpRecvHackThreshold = 2
+
+	// UsbZlpStreamingWindow specifies, for how long after the last
+	// non-empty USB receive the response body is considered actively
+	// streaming, so zero-length packets cause short polling rather
+	// than backoff
+	UsbZlpStreamingWindow = 100 * time.Millisecond
+
+	// UsbRecvAlign specifies the default alignment of USB receive
+	// buffers, used if USB speed is unknown. 1024 bytes is max packet
+	// size of bulk endpoints for USB 3.0, 512 bytes for USB 2.0, so
+	// it is safe for both
+	UsbRecvAlign = 1024
+
+	// UsbMaxBulkRead specifies the maximum size of a single bulk
+	// read. Some versions of Linux kernel don't allow bulk transfers
+	// to be larger that 16kb per URB, and libusb uses some smart-ass
+	// mechanism to avoid this limitation, which seems not to work
+	// very reliable on Raspberry Pi (see #3 for details)
+	UsbMaxBulkRead = 16384
+
+	// UsbMaxBulkReadSuper specifies the maximum size of a single
+	// bulk read for SuperSpeed (USB 3.x) devices
+	UsbMaxBulkReadSuper = 65536
+
+	// UsbSendStallTime specifies, how long USB write needs to take
+	// to be considered stalled by device (device NAKs data, because
+	// its buffer is full). Stalls are used to estimate device drain
+	// rate in the adaptive usb-send-delay mode
+	UsbSendStallTime = 250 * time.Millisecond
+
+	// UsbSendStallMinSize specifies the minimum size of stalled
+	// USB write, used to estimate device drain rate
+	UsbSendStallMinSize = 4096
+
+	// UsbSendStallMaxTime specifies, how long USB write may be
+	// stalled to be used for drain rate estimation. Longer stalls
+	// are caused by device being busy for other reasons (out of
+	// paper, paper jam, warm-up)
+	UsbSendStallMaxTime = 10 * time.Second
+
+	// UsbSendRateMin and UsbSendRateMax specify the range of
+	// learned drain rate, bytes per second. When rate grows above
+	// UsbSendRateMax, delays are disabled
+	UsbSendRateMin = 4096
+	UsbSendRateMax = 64 * 1024 * 1024
+
+	// UsbSendRateRecover specifies, how fast learned drain rate
+	// recovers: each write, not stalled by device, increases rate
+	// by 1/UsbSendRateRecover
+	UsbSendRateRecover = 64
+
+	// UsbSendRateSamples specifies, how many stall samples are
+	// needed to persist the learned drain rate
+	UsbSendRateSamples = 3
+
+	// UsbRecvAlignMax specifies the maximum alignment of USB
+	// receive buffers, learned automatically after overflow
+	UsbRecvAlignMax = 16384
+
+	// UsbConnTraceSize specifies how many USB connections state
+	// transitions are kept in the trace, when conn-trace is enabled
+	UsbConnTraceSize = 1024
+
+	// UsbRetryHTTPStatusMaxRetries specifies how many times request
+	// is retried, if device returns HTTP status, listed in the
+	// retry-http-status quirk
+	UsbRetryHTTPStatusMaxRetries = 3
+
+	// UsbRetryHTTPStatusDelay specifies the initial delay before
+	// retrying request on retryable HTTP status. The delay is
+	// doubled on each subsequent retry
+	UsbRetryHTTPStatusDelay = 500 * time.Millisecond
+
+	// UsbEsclCancelTimeout specifies how long canceling of
+	// the abandoned eSCL scan job may wait for USB connection
+	// and device response
+	UsbEsclCancelTimeout = 30 * time.Second
+
+	// DevStatsSaveInterval specifies how often per-device
+	// statistics is saved to disk
+	DevStatsSaveInterval = 5 * time.Minute
+
+	// QuirksUpdateTimeout specifies timeout for downloading
+	// the quirks bundle
+	QuirksUpdateTimeout = 60 * time.Second
+
+	// QuirksUpdateMaxSize specifies maximum size of the quirks
+	// bundle
+	QuirksUpdateMaxSize = 4 * 1024 * 1024
+
+	// CtrlsockCommandTimeout specifies how long administrative
+	// command, received via the control socket, may wait for
+	// the PnP manager
+	CtrlsockCommandTimeout = 30 * time.Second
+
+	// TLSCertLifetime specifies lifetime of the generated
+	// self-signed TLS certificates
+	TLSCertLifetime = 10 * 365 * 24 * time.Hour
+
+	// HTTPRewriteMaxBody specifies maximum size of the web console
+	// response body, subject to URL rewriting. Larger bodies are
+	// passed as is
+	HTTPRewriteMaxBody = 4 * 1024 * 1024
+
+	// EsclSanitizeMaxBody specifies maximum size of the eSCL
+	// XML response, subject to sanitizing. Larger responses are
+	// passed as is
+	EsclSanitizeMaxBody = 1024 * 1024
+
+	// IconsMaxSize specifies maximum size of the device icon,
+	// downloaded for local caching. Larger icons are ignored
+	IconsMaxSize = 1024 * 1024
+
+	// SoakDefaultTime and SoakDefaultSize specify default
+	// duration of the soak test and default size of the dummy
+	// documents it sends
+	SoakDefaultTime = time.Minute
+	SoakDefaultSize = 1024 * 1024
+
+	// SoakEsclReaders specifies how many parallel eSCL
+	// ScannerCapabilities readers the soak test runs
+	SoakEsclReaders = 2
+
+	// UsbHotPlugDedupTime specifies, within what time the same
+	// USB hotplug event, reported by multiple sources (libusb and
+	// netlink), is considered duplicate
+	UsbHotPlugDedupTime = 2 * time.Second
+
+	// ConformanceTimeout specifies timeout of each request,
+	// sent by the conformance self-test
+	ConformanceTimeout = 10 * time.Second
+
+	// EventLogSize specifies how many last device lifecycle
+	// events are kept for the `ipp-usb status` output
+	EventLogSize = 32
 )
@@ -8,26 +8,34 @@
  * ipp-usb runs a HTTP server on a top of the unix domain control
  * socket.
  *
- * Currently it is only used to obtain a per-device status from the
- * running daemon. Using HTTP here sounds as overkill, but taking
- * in account that it costs us virtually nothing and this mechanism
- * is well-extendable, this is a good choice
+ * Currently it is used to obtain a per-device status (/status) and
+ * firewall hints (/firewall) from the running daemon, and to execute
+ * administrative commands (/ctl/command, root only, see ctrlsockCommands).
+ * Using HTTP here sounds as overkill, but taking in account that it
+ * costs us virtually nothing and this mechanism is well-extendable,
+ * this is a good choice
  */
 
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"syscall"
 )
 
 var (
-	// CtrlsockAddr contains control socket address in
-	// a form of the net.UnixAddr structure
-	CtrlsockAddr = &net.UnixAddr{Name: PathControlSocket, Net: "unix"}
+	// CtrlsockDebug enables debug commands (see ctrlsockCommands).
+	// It is set, when ipp-usb runs in debug mode
+	CtrlsockDebug bool
 
 	// ctrlsockServer is a HTTP server that runs on a top of
 	// the status socket
@@ -50,6 +58,12 @@ func ctrlsockHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// Administrative commands are handled separately
+	if strings.HasPrefix(r.URL.Path, "/ctl/") {
+		ctrlsockAdmin(w, r)
+		return
+	}
+
 	// Check request method
 	if r.Method != "GET" {
 		http.Error(w, r.Method+": method not supported",
@@ -58,34 +72,210 @@ func ctrlsockHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check request path
-	if r.URL.Path != "/status" {
+	var data []byte
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		data = StatusFormat()
+
+	case "/firewall":
+		if !Conf.FirewallHints {
+			http.Error(w, "Firewall hints not enabled",
+				http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		data = FirewallHintsFormat()
+
+	default:
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
 	// Handle the request
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// ctrlsockCommand describes an administrative command
+type ctrlsockCommand struct {
+	nargs   int  // Count of arguments
+	debug   bool // Available only in debug mode
+	handler func(ctx context.Context, args []string) ([]byte, error)
+}
+
+// ctrlsockCommands contains administrative commands, available via
+// the control socket as POST /ctl/command?arg=...&arg=...
+//
+// Device may be specified either by its ident or by its USB address,
+// written as "BUS:DEV"
+var ctrlsockCommands = map[string]ctrlsockCommand{
+	// list - list devices with their idents and status
+	"list": {0, false, func(ctx context.Context, args []string) ([]byte, error) {
+		return StatusListFormat(), nil
+	}},
+
+	// pause device - release device to other drivers
+	"pause": {1, false, func(ctx context.Context, args []string) ([]byte, error) {
+		_, ident, err := ctrlsockFindDevice(args[0])
+		if err == nil {
+			UsbClaimPause(ident)
+		}
+		return nil, err
+	}},
+
+	// resume device - reclaim the paused device
+	"resume": {1, false, func(ctx context.Context, args []string) ([]byte, error) {
+		_, ident, err := ctrlsockFindDevice(args[0])
+		if err == nil && !UsbClaimResume(ident) {
+			err = errors.New("device not paused")
+		}
+		return nil, err
+	}},
+
+	// reset device - reset device and reinitialize it
+	"reset": {1, false, func(ctx context.Context, args []string) ([]byte, error) {
+		addr, _, err := ctrlsockFindDevice(args[0])
+		if err == nil {
+			err = PnPCtlReset(ctx, addr)
+		}
+		return nil, err
+	}},
+
+	// reload-quirks - reload quirks files
+	"reload-quirks": {0, false, func(ctx context.Context, args []string) ([]byte, error) {
+		return nil, PnPCtlReloadQuirks(ctx)
+	}},
+
+	// loglevel device level - change device log level
+	"loglevel": {2, false, func(ctx context.Context, args []string) ([]byte, error) {
+		addr, _, err := ctrlsockFindDevice(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		level, err := LogLevelParse(args[1])
+		if err == nil {
+			err = PnPCtlLogLevel(ctx, addr, level)
+		}
+		return nil, err
+	}},
+
+	// refresh device - re-query printer attributes and update
+	// DNS-SD TXT record
+	"refresh": {1, false, func(ctx context.Context, args []string) ([]byte, error) {
+		addr, _, err := ctrlsockFindDevice(args[0])
+		if err == nil {
+			err = PnPCtlRefresh(ctx, addr)
+		}
+		return nil, err
+	}},
+
+	// quirk device name value - temporarily override device quirk,
+	// "-" as value removes the override. Debug mode only
+	"quirk": {3, true, func(ctx context.Context, args []string) ([]byte, error) {
+		addr, _, err := ctrlsockFindDevice(args[0])
+		if err == nil {
+			err = PnPCtlQuirk(ctx, addr, args[1], args[2])
+		}
+		return nil, err
+	}},
+}
+
+// ctrlsockFindDevice finds device by name, which may be either
+// device ident or its USB address
+func ctrlsockFindDevice(name string) (UsbAddr, string, error) {
+	addr, ident, ok := StatusFindDevice(name)
+	if !ok {
+		return addr, ident, fmt.Errorf("%s: device not found", name)
+	}
+	return addr, ident, nil
+}
+
+// ctrlsockAdmin handles administrative commands
+//
+// Only root (or the user ipp-usb runs as) is allowed to use them
+func ctrlsockAdmin(w http.ResponseWriter, r *http.Request) {
+	// Check request method
+	if r.Method != "POST" {
+		http.Error(w, r.Method+": method not supported",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check client credentials
+	uid := -1
+	if v := r.Context().Value(http.LocalAddrContextKey); v != nil {
+		if addr, ok := v.(*UnixConnAddr); ok {
+			uid = addr.UID
+		}
+	}
+
+	if uid != 0 && uid != os.Getuid() {
+		Log.Error('!', "ctrlsock: %s: access denied for UID %d",
+			r.URL.Path, uid)
+		http.Error(w, ErrAccess.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Lookup the command
+	name := strings.TrimPrefix(r.URL.Path, "/ctl/")
+	cmd, found := ctrlsockCommands[name]
+	if !found {
+		http.Error(w, name+": unknown command", http.StatusNotFound)
+		return
+	}
+
+	if cmd.debug && !CtrlsockDebug {
+		http.Error(w, name+": only available in debug mode",
+			http.StatusForbidden)
+		return
+	}
+
+	args := r.URL.Query()["arg"]
+	if len(args) != cmd.nargs {
+		http.Error(w, fmt.Sprintf("%s: %d arguments expected",
+			name, cmd.nargs), http.StatusBadRequest)
+		return
+	}
+
+	// Execute the command
+	Log.Info(' ', "ctrlsock: %s %s", name, strings.Join(args, " "))
+
+	ctx, cancel := context.WithTimeout(r.Context(), CtrlsockCommandTimeout)
+	defer cancel()
+
+	data, err := cmd.handler(ctx, args)
+	if err != nil {
+		Log.Error('!', "ctrlsock: %s: %s", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if data == nil {
+		data = []byte("OK\n")
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	httpNoCache(w)
 	w.WriteHeader(http.StatusOK)
-	w.Write(StatusFormat())
+	w.Write(data)
 }
 
 // CtrlsockStart starts control socket server
 func CtrlsockStart() error {
 	Log.Debug(' ', "ctrlsock: listening at %q", PathControlSocket)
 
-	// Listen the socket
-	os.Remove(PathControlSocket)
-
-	listener, err := net.ListenUnix("unix", CtrlsockAddr)
+	// Listen the socket. Socket is accessible to everybody,
+	// UnixListener provides client credentials to check access
+	// to the administrative commands
+	listener, err := NewUnixListener(PathControlSocket)
 	if err != nil {
 		return err
 	}
 
-	// Make socket accessible to everybody. Error is ignores,
-	// it's not a reason to abort ipp-usb
-	os.Chmod(PathControlSocket, 0777)
-
 	// Start HTTP server on a top of the listening socket
 	go func() {
 		ctrlsockServer.Serve(listener)
@@ -103,7 +293,8 @@ func CtrlsockStop() {
 // CtrlsockDial connects to the control socket of the running
 // ipp-usb daemon
 func CtrlsockDial() (net.Conn, error) {
-	conn, err := net.DialUnix("unix", nil, CtrlsockAddr)
+	addr := &net.UnixAddr{Name: PathControlSocket, Net: "unix"}
+	conn, err := net.DialUnix("unix", nil, addr)
 
 	if err == nil {
 		return conn, err
@@ -123,3 +314,39 @@ func CtrlsockDial() (net.Conn, error) {
 
 	return conn, err
 }
+
+// CtrlsockCommand sends administrative command with arguments
+// to the running ipp-usb daemon and returns its response
+func CtrlsockCommand(cmd string, args []string) ([]byte, error) {
+	t := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return CtrlsockDial()
+		},
+	}
+
+	c := &http.Client{
+		Transport: t,
+	}
+
+	uri := "http://localhost/ctl/" + url.PathEscape(cmd)
+	if len(args) != 0 {
+		uri += "?" + url.Values{"arg": args}.Encode()
+	}
+
+	rsp, err := c.Post(uri, "text/plain", nil)
+	if err != nil {
+		if urlerr, ok := err.(*url.Error); ok {
+			err = urlerr.Err
+		}
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err == nil && rsp.StatusCode != http.StatusOK {
+		err = errors.New(strings.TrimSpace(string(data)))
+	}
+
+	return data, err
+}
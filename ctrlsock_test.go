@@ -0,0 +1,66 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for control socket handler
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestCtrlsockAdmin tests dispatching of administrative commands
+func TestCtrlsockAdmin(t *testing.T) {
+	Log.ToNowhere()
+
+	run := func(method, uri string, uid int) int {
+		rq := httptest.NewRequest(method, uri, nil)
+		if uid >= 0 {
+			addr := &UnixConnAddr{UID: uid}
+			rq = rq.WithContext(context.WithValue(rq.Context(),
+				http.LocalAddrContextKey, addr))
+		}
+
+		w := httptest.NewRecorder()
+		ctrlsockHandler(w, rq)
+		return w.Code
+	}
+
+	type testData struct {
+		method, uri string
+		uid         int
+		status      int
+	}
+
+	tests := []testData{
+		{"POST", "/ctl/list", os.Getuid(), http.StatusOK},
+		{"GET", "/ctl/list", os.Getuid(), http.StatusMethodNotAllowed},
+		{"POST", "/ctl/list", -1, http.StatusForbidden},
+		{"POST", "/ctl/unknown", os.Getuid(), http.StatusNotFound},
+		{"POST", "/ctl/pause", os.Getuid(), http.StatusBadRequest},
+		{"POST", "/ctl/pause?arg=1:5", os.Getuid(), http.StatusBadRequest},
+		{"POST", "/ctl/resume?arg=1:5&arg=2", os.Getuid(),
+			http.StatusBadRequest},
+	}
+
+	if os.Getuid() != 12345 {
+		tests = append(tests,
+			testData{"POST", "/ctl/list", 12345, http.StatusForbidden})
+	}
+
+	for _, test := range tests {
+		status := run(test.method, test.uri, test.uid)
+		if status != test.status {
+			t.Errorf("%s %s (UID %d): expected %d, present %d",
+				test.method, test.uri, test.uid,
+				test.status, status)
+		}
+	}
+}
@@ -10,9 +10,13 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Device object brings all parts together, namely:
@@ -28,33 +32,58 @@ type Device struct {
 	HTTPProxy      *HTTPProxy      // HTTP proxy
 	UsbTransport   *UsbTransport   // Backing USB transport
 	DNSSdPublisher *DNSSdPublisher // DNS-SD publisher
+	ICCProfile     string          // Matching ICC profile, "" if none
 	Log            *Logger         // Device's logger
+	esclStatusStop chan struct{}   // Closed to stop eSCL status polling
+	faxoutStop     chan struct{}   // Closed to stop FaxOut re-validation
+	faxoutFailed   chan struct{}   // Signalled, if FaxOut request failed
+	prewarmStop    chan struct{}   // Closed to stop connections pre-warming
+	retryStop      chan struct{}   // Closed to stop background init retry
+	refreshStop    chan struct{}   // Closed to stop IPP TXT refresh
+	probeStop      chan struct{}   // Closed to stop services re-probing
+	refresh        chan struct{}   // Requests IPP TXT refresh
+	ippTxt         DNSSdTxtRecord  // IPP TXT, generated from attributes
+	info           UsbDeviceInfo   // USB device info
+	httpsPort      int             // HTTPS port, 0 if HTTPS disabled
+	services       DNSSdServices   // Currently advertised services
+	servicesLock   sync.Mutex      // Protects services and probeOK
+	probeOK        bool            // Services passed end-to-end probe
 }
 
 // NewDevice creates new Device object
 func NewDevice(desc UsbDeviceDesc) (*Device, error) {
+	transport, err := NewUsbTransport(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDevice(desc, transport)
+}
+
+// newDevice creates new Device object on a top of the UsbTransport.
+// On failure, transport is closed
+func newDevice(desc UsbDeviceDesc, transport *UsbTransport) (*Device, error) {
 	dev := &Device{
-		UsbAddr: desc.UsbAddr,
+		UsbAddr:      desc.UsbAddr,
+		UsbTransport: transport,
 	}
 
 	var err error
 	var info UsbDeviceInfo
-	var listener net.Listener
+	var listeners []net.Listener
 	var ippinfo *IppPrinterInfo
 	var dnssdName string
 	var dnssdServices DNSSdServices
 	var log *LogMessage
-	var hwid string
 	var quirks Quirks
 	var httpstatus int
 	var canPrint bool
 	var canScan bool
-
-	// Create USB transport
-	dev.UsbTransport, err = NewUsbTransport(desc)
-	if err != nil {
-		goto ERROR
-	}
+	var esclAdvertised bool
+	var httpsEnabled bool
+	var loopbackAddr net.IP
+	var ippRetry bool
+	var esclRetry bool
 
 	// Obtain quirks
 	quirks = dev.UsbTransport.Quirks()
@@ -64,7 +93,7 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 
 	// Obtain device info and derived information.
 	info = dev.UsbTransport.UsbDeviceInfo()
-	hwid = fmt.Sprintf("%4.4x&%4.4x", info.Vendor, info.Product)
+	dev.info = info
 
 	canPrint = info.BasicCaps&UsbIppBasicCapsPrint != 0
 	canScan = info.BasicCaps&UsbIppBasicCapsScan != 0
@@ -72,54 +101,187 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	// Load persistent state
 	dev.State = LoadDevState(info.Ident(), info.Comment())
 
+	// Apply learned zlp-recv-hack and persist it, when learned
+	if dev.State.ZlpRecvHack {
+		dev.UsbTransport.EnableZlpRecvHack()
+	}
+
+	dev.UsbTransport.OnZlpRecvHackLearned(func() {
+		dev.State.Update(func(state *DevState) {
+			state.ZlpRecvHack = true
+		})
+	})
+
+	// The same for USB receive buffer alignment
+	dev.UsbTransport.SetRecvAlign(dev.State.UsbRecvAlign)
+	dev.UsbTransport.OnRecvAlignLearned(func(align int) {
+		dev.State.Update(func(state *DevState) {
+			state.UsbRecvAlign = align
+		})
+	})
+
+	// And for device drain rate, used by adaptive usb-send-delay
+	dev.UsbTransport.SetSendRate(dev.State.UsbSendRate)
+	dev.UsbTransport.OnSendRateLearned(func(rate int) {
+		dev.State.Update(func(state *DevState) {
+			state.UsbSendRate = rate
+		})
+	})
+
 	// Create HTTP client for local queries
 	dev.HTTPClient = &http.Client{
 		Transport: dev.UsbTransport,
 	}
 
-	// Create net.Listener
-	listener, err = dev.State.HTTPListen()
-	if err != nil {
-		goto ERROR
+	// Create net.Listeners
+	if Conf.HTTPTCPEnable {
+		var listener net.Listener
+		listener, err = dev.State.HTTPListen()
+		if err != nil {
+			goto ERROR
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if Conf.HTTPTCPEnable && Conf.LoopbackAddrEnable {
+		// Failure to allocate per-device loopback address is not
+		// fatal; the device remains available via the HTTP port.
+		// The error is already logged by LoopbackListen
+		var listener net.Listener
+		listener, err = dev.State.LoopbackListen()
+		if err != nil {
+			err = nil
+		} else {
+			listeners = append(listeners, listener)
+			loopbackAddr = dev.State.LoopbackAddr
+			dev.Log.Debug(' ', "HTTP: listening at %s",
+				listener.Addr())
+		}
+	}
+
+	if Conf.HTTPTCPEnable && Conf.HTTPSEnable {
+		var listener net.Listener
+		var cert *tls.Certificate
+
+		// Certificate problems are not fatal; the device
+		// remains available via the plain HTTP
+		cert, err = TLSLoadCertificate(info.Ident())
+		if err != nil {
+			dev.Log.Error('!', "TLS: %s", err)
+			err = nil
+		} else {
+			listener, err = dev.State.HTTPSListen()
+			if err != nil {
+				goto ERROR
+			}
+			listeners = append(listeners, NewTLSListener(listener, cert))
+			httpsEnabled = true
+			dev.Log.Debug(' ', "HTTPS: listening at port %d",
+				dev.State.HTTPSPort)
+		}
+	}
+
+	if Conf.HTTPUnixEnable {
+		var listener net.Listener
+		path := dev.State.UnixSocketPath()
+		listener, err = NewUnixListener(path)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", path, err)
+			goto ERROR
+		}
+		listeners = append(listeners, listener)
+		dev.Log.Debug(' ', "HTTP: listening at %q", path)
+	}
+
+	// Let transport know HTTP port, for http-XXX quirks
+	if Conf.HTTPTCPEnable {
+		dev.UsbTransport.SetHTTPPort(dev.State.HTTPPort)
 	}
 
 	// Configure transport for init
 	dev.UsbTransport.SetTimeout(quirks.GetInitTimeout())
 
+	// Run init script, if any
+	log = dev.Log.Begin()
+	err = InitScriptRun(log, quirks.GetInitScript(), dev.UsbTransport,
+		dev.HTTPClient)
+	log.Commit()
+
+	if err != nil {
+		goto ERROR
+	}
+
 	// Create HTTP server
-	dev.HTTPProxy = NewHTTPProxy(dev.Log, listener, dev.UsbTransport)
+	dev.HTTPProxy = NewHTTPProxy(dev.Log, listeners, dev.UsbTransport)
 
 	// Obtain DNS-SD info for IPP
 	log = dev.Log.Begin()
 	defer log.Commit()
 
-	ippinfo, httpstatus, err = IppService(log, &dnssdServices,
-		dev.State.HTTPPort, info, dev.UsbTransport.Quirks(),
-		dev.HTTPClient)
+	if quirks.GetDisablePrint() {
+		dev.Log.Info(' ', "IPP: disabled by the %q quirk",
+			QuirkNmDisablePrint)
+	} else if !quirks.GetDeviceMode().IPP() {
+		dev.Log.Info(' ', "IPP: disabled by the %q quirk (%s)",
+			QuirkNmDeviceMode, quirks.GetDeviceMode())
+	} else {
+		ippinfo, httpstatus, err = IppService(log, &dnssdServices,
+			dev.State.HTTPPort, info, dev.UsbTransport.Quirks(),
+			dev.HTTPClient)
+	}
+
+	if ippinfo != nil {
+		dev.ippTxt = append(DNSSdTxtRecord(nil),
+			dnssdServices[ippinfo.IppSvcIndex].Txt...)
+	}
 
 	if err != nil {
 		dev.Log.Error('!', "IPP: %s", err)
 
 		if httpstatus != 0 && canPrint && quirks.GetInitRetryPartial() {
-			dev.Log.Begin().
-				Info(' ', "Printer not ready (HTTP status %d)",
-					httpstatus).
-				Info(' ', "Retrying due to the %q quirk",
-					QuirkNmInitRetryPartial).
-				Commit()
+			dev.Log.Info(' ', "Printer not ready (HTTP status %d)",
+				httpstatus)
+			ippRetry = true
+		}
+	}
 
-			err = ErrPartialInit
-			goto ERROR
+	if ippinfo != nil {
+		err2 := IppSaveAttrs(info.Ident(), ippinfo.Attrs)
+		if err2 != nil {
+			dev.Log.Error('!', "IPP: %s", err2)
 		}
 	}
 
 	log.Flush()
 
+	// Quirks may depend on firmware version, reported by device
+	if ippinfo != nil && ippinfo.Firmware != "" {
+		dev.UsbTransport.SetFirmware(ippinfo.Firmware)
+		quirks = dev.UsbTransport.Quirks()
+		info = dev.UsbTransport.UsbDeviceInfo()
+		dev.info = info
+	}
+
 	if dev.UsbTransport.TimeoutExpired() {
 		err = ErrInitTimedOut
 		goto ERROR
 	}
 
+	// Cache printer icons locally
+	if ippinfo != nil && len(ippinfo.IconURLs) != 0 && Conf.PrinterIcons {
+		icons := IconsFetch(log, dev.HTTPClient, info.Ident(),
+			ippinfo.IconURLs)
+		if icons != nil {
+			dev.HTTPProxy.SetIcons(icons)
+			dev.UsbTransport.SetIcons(icons)
+
+			host := fmt.Sprintf("localhost:%d", dev.State.HTTPPort)
+			ippinfo.IconURL = icons.URLs("http", host)[0]
+		}
+
+		log.Flush()
+	}
+
 	// Obtain DNS-SD name
 	if ippinfo != nil {
 		dnssdName = ippinfo.DNSSdName
@@ -127,30 +289,42 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		dnssdName = info.DNSSdName()
 	}
 
+	if Conf.DNSSdNameTmpl != nil {
+		dnssdName = Conf.DNSSdNameTmpl.Expand(
+			DNSSdNameVars(info, ippinfo))
+		log.Debug(' ', "DNS-SD: name from template: %q", dnssdName)
+	}
+
 	// Update device state, if name changed
 	if dnssdName != dev.State.DNSSdName {
-		dev.State.DNSSdName = dnssdName
-		dev.State.DNSSdOverride = dnssdName
-		dev.State.Save()
+		dev.State.Update(func(state *DevState) {
+			state.DNSSdName = dnssdName
+			state.DNSSdOverride = dnssdName
+		})
 	}
 
 	// Obtain DNS-SD info for eSCL
-	httpstatus, err = EsclService(log, &dnssdServices, dev.State.HTTPPort, info,
-		ippinfo, dev.HTTPClient)
+	if quirks.GetDisableScan() {
+		dev.Log.Info(' ', "ESCL: disabled by the %q quirk",
+			QuirkNmDisableScan)
+		err = nil
+	} else if !quirks.GetDeviceMode().Scan() {
+		dev.Log.Info(' ', "ESCL: disabled by the %q quirk (%s)",
+			QuirkNmDeviceMode, quirks.GetDeviceMode())
+		err = nil
+	} else {
+		httpstatus, err = EsclService(log, &dnssdServices,
+			dev.State.HTTPPort, info, ippinfo, quirks, dev.HTTPClient)
+		esclAdvertised = err == nil
+	}
 
 	if err != nil {
 		dev.Log.Error('!', "ESCL: %s", err)
 
 		if httpstatus != 0 && canScan && quirks.GetInitRetryPartial() {
-			dev.Log.Begin().
-				Info(' ', "Scanner not ready (HTTP status %d)",
-					httpstatus).
-				Info(' ', "Retrying due to the %q quirk",
-					QuirkNmInitRetryPartial).
-				Commit()
-
-			err = ErrPartialInit
-			goto ERROR
+			dev.Log.Info(' ', "Scanner not ready (HTTP status %d)",
+				httpstatus)
+			esclRetry = true
 		}
 	}
 
@@ -163,13 +337,30 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 
 	// Update IPP service advertising for scanner presence
 	if ippinfo != nil {
-		if ippSvc := &dnssdServices[ippinfo.IppSvcIndex]; err == nil {
+		if ippSvc := &dnssdServices[ippinfo.IppSvcIndex]; esclAdvertised {
 			ippSvc.Txt.Add("Scan", "T")
 		} else {
 			ippSvc.Txt.Add("Scan", "F")
 		}
 	}
 
+	// If some services are not ready, and init-retry-partial quirk
+	// is set, either retry the whole initialization, if nothing
+	// is ready, or serve the available services and retry the
+	// rest in background
+	if ippRetry || esclRetry {
+		if len(dnssdServices) == 0 {
+			dev.Log.Info(' ', "Retrying due to the %q quirk",
+				QuirkNmInitRetryPartial)
+			err = ErrPartialInit
+			goto ERROR
+		}
+
+		dev.Log.Info(' ', "Serving available services, "+
+			"retrying the rest due to the %q quirk",
+			QuirkNmInitRetryPartial)
+	}
+
 	// Skip the device, if it cannot do something useful
 	//
 	// Some devices (so far, only HP-rebranded Samsung devices
@@ -185,15 +376,13 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		goto ERROR
 	}
 
-	// Add common TXT records:
-	//   - usb_SER=VCF9192281  ; Device USB serial number
-	//   - usb_HWID=0482&069d  ; Its vendor and device ID
-	for i := range dnssdServices {
-		svc := &dnssdServices[i]
-		svc.Txt.Add("usb_SER", info.SerialNumber)
-		svc.Txt.Add("usb_HWID", hwid)
+	// Add common TXT records and TLS variants of services
+	if httpsEnabled {
+		dev.httpsPort = dev.State.HTTPSPort
 	}
 
+	dev.dnssdDecorate(&dnssdServices)
+
 	// Advertise Web service. Assume it always exists
 	dnssdServices.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: dev.State.HTTPPort})
 
@@ -213,11 +402,23 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		Loopback: true,
 	})
 
+	// Lookup ICC profile, if enabled
+	if Conf.ICCProfileLookup && canPrint && quirks.GetDeviceMode().Print() {
+		dev.ICCProfile = ICCProfileLookup(info)
+		if dev.ICCProfile != "" {
+			dev.Log.Debug(' ', "ICC profile: %s", dev.ICCProfile)
+		} else {
+			dev.Log.Debug(' ', "ICC profile: not found")
+		}
+	}
+
 	// Enable handling incoming requests
 	dev.UsbTransport.SetTimeout(0)
 	dev.HTTPProxy.Enable()
 
 	// Start DNS-SD publisher
+	dev.services = dnssdServices
+
 	for _, svc := range dnssdServices {
 		dev.Log.Debug('>', "%s: %s TXT record:", dnssdName, svc.Type)
 		for _, txt := range svc.Txt {
@@ -225,15 +426,101 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		}
 	}
 
-	if Conf.DNSSdEnable {
+	// Note, if device is only exposed via the Unix domain socket,
+	// there is nothing to advertise
+	if Conf.DNSSdEnable && Conf.HTTPTCPEnable {
+		// With require-probe-success, printer and scanner
+		// services are advertised only after successful probe
+		dev.probeOK = true
+		if Conf.DNSSdProbe {
+			err = dev.probe(ippinfo != nil, esclAdvertised)
+			if err != nil {
+				dev.Log.Error('!', "Probe failed: %s", err)
+				dev.Log.Info(' ', "DNS-SD: services not advertised "+
+					"until probe succeeds")
+			}
+			dev.probeOK = err == nil
+		}
+
 		dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State,
-			dnssdServices)
+			dev.dnssdExport(dnssdServices))
+		dev.DNSSdPublisher.Suffix = info.DNSSdSuffix()
+		dev.DNSSdPublisher.LoopbackAddr = loopbackAddr
+		dev.DNSSdPublisher.UUID = dnssdServices.GroupUUID(info.UUID())
+		dev.Log.Debug(' ', "DNS-SD: %s: group UUID: %s", dnssdName,
+			dev.DNSSdPublisher.UUID)
 		err = dev.DNSSdPublisher.Publish()
 		if err != nil {
 			goto ERROR
 		}
+
+		DevEvents.Add(desc.UsbAddr, EventDNSSdRegistered, "")
+	}
+
+	// Start services re-probing
+	if dev.DNSSdPublisher != nil && Conf.DNSSdProbe {
+		dev.probeStop = make(chan struct{})
+		go dev.probeMonitor(dev.probeStop, ippinfo != nil,
+			esclAdvertised)
+	}
+
+	// Start eSCL ScannerStatus polling, if enabled
+	if esclAdvertised && Conf.EsclStatusInterval != 0 {
+		dev.esclStatusStop = make(chan struct{})
+		go dev.esclStatusPoll(dev.esclStatusStop)
+	}
+
+	// Start IPP FaxOut re-validation
+	if ippinfo != nil && ippinfo.FaxCapable {
+		dev.HTTPProxy.SetFaxOutAvailable(ippinfo.FaxOut)
+		dev.faxoutFailed = make(chan struct{}, 1)
+		dev.HTTPProxy.OnFaxOutFailed(func() {
+			select {
+			case dev.faxoutFailed <- struct{}{}:
+			default:
+			}
+		})
+
+		dev.faxoutStop = make(chan struct{})
+		go dev.faxoutRecheck(dev.faxoutStop, dev.HTTPProxy)
+	}
+
+	// Start connections pre-warming
+	if ippinfo != nil && quirks.GetPrewarm() {
+		dev.prewarmStop = make(chan struct{})
+		go dev.prewarming(dev.prewarmStop)
+	}
+
+	// Start IPP TXT refresh. If IPP is not ready yet, refresh
+	// starts working, when partialRetry brings it up
+	if dev.DNSSdPublisher != nil && (ippinfo != nil || ippRetry) {
+		dev.refreshStop = make(chan struct{})
+		dev.refresh = make(chan struct{}, 1)
+		go dev.ippRefresh(dev.refreshStop, dev.refresh)
+	}
+
+	// Start background retry of not ready services
+	if ippRetry || esclRetry {
+		dev.retryStop = make(chan struct{})
+		go dev.partialRetry(dev.retryStop, ippRetry, esclRetry,
+			esclAdvertised, ippinfo)
 	}
 
+	// Report firewall opening, if enabled
+	if Conf.HTTPTCPEnable {
+		FirewallHintAdd(dev.UsbAddr, FirewallHint{
+			Device:  dev.UsbAddr.String(),
+			Ident:   info.Ident(),
+			Model:   info.MfgAndProduct,
+			Port:    dev.State.HTTPPort,
+			Proto:   "tcp",
+			Service: "ipp-usb",
+		})
+	}
+
+	// Return device to the bottom of the reset escalation ladder
+	DevWatchdogs.Success(info.Ident())
+
 	return dev, nil
 
 ERROR:
@@ -242,15 +529,19 @@ ERROR:
 	}
 
 	if dev.UsbTransport != nil {
-		reset := true
 		switch err {
 		case ErrUnusable, ErrPartialInit:
-			reset = false
+			dev.UsbTransport.Close(false)
+		case ErrInitTimedOut:
+			wderr := DevWatchdogs.Escalate(info.Ident())
+			dev.UsbTransport.CloseAndRecover(wderr.Step)
+			err = wderr
+		default:
+			dev.UsbTransport.Close(true)
 		}
-		dev.UsbTransport.Close(reset)
 	}
 
-	if listener != nil {
+	for _, listener := range listeners {
 		listener.Close()
 	}
 
@@ -261,13 +552,16 @@ ERROR:
 // expires before the shutdown is complete, Shutdown returns the
 // context's error
 func (dev *Device) Shutdown(ctx context.Context) error {
-	if dev.DNSSdPublisher != nil {
-		dev.DNSSdPublisher.Unpublish()
-		dev.DNSSdPublisher = nil
-	}
+	dev.partialRetryStop()
+	dev.probeMonitorStop()
+	dev.ippRefreshStop()
+	dev.esclStatusPollStop()
+	dev.faxoutRecheckStop()
+	dev.prewarmingStop()
+	dev.dnssdWithdraw(ctx)
 
 	if dev.HTTPProxy != nil {
-		dev.HTTPProxy.Close()
+		dev.HTTPProxy.Shutdown(ctx)
 		dev.HTTPProxy = nil
 	}
 
@@ -280,10 +574,24 @@ func (dev *Device) Shutdown(ctx context.Context) error {
 
 // Close the Device
 func (dev *Device) Close() {
-	if dev.DNSSdPublisher != nil {
-		dev.DNSSdPublisher.Unpublish()
-		dev.DNSSdPublisher = nil
-	}
+	dev.close(false)
+}
+
+// CloseAndReset closes the Device and resets it at the USB level
+func (dev *Device) CloseAndReset() {
+	dev.close(true)
+}
+
+// close closes the Device and optionally resets it
+func (dev *Device) close(reset bool) {
+	FirewallHintDel(dev.UsbAddr)
+	dev.partialRetryStop()
+	dev.probeMonitorStop()
+	dev.ippRefreshStop()
+	dev.esclStatusPollStop()
+	dev.faxoutRecheckStop()
+	dev.prewarmingStop()
+	dev.dnssdWithdraw(context.Background())
 
 	if dev.HTTPProxy != nil {
 		dev.HTTPProxy.Close()
@@ -291,7 +599,656 @@ func (dev *Device) Close() {
 	}
 
 	if dev.UsbTransport != nil {
-		dev.UsbTransport.Close(false)
+		dev.UsbTransport.Close(reset)
 		dev.UsbTransport = nil
 	}
 }
+
+// dnssdWithdraw withdraws DNS-SD advertising, if device was published,
+// and then waits for the configured dns-sd-withdraw-delay, so clients
+// have a chance to notice that service has gone before the HTTP
+// server stops accepting connections
+func (dev *Device) dnssdWithdraw(ctx context.Context) {
+	if dev.DNSSdPublisher == nil {
+		return
+	}
+
+	dev.DNSSdPublisher.Unpublish()
+	dev.DNSSdPublisher = nil
+
+	if Conf.DNSSdWithdrawDelay == 0 {
+		return
+	}
+
+	dev.Log.Debug(' ', "DNS-SD: withdrawn, waiting %s before HTTP shutdown",
+		Conf.DNSSdWithdrawDelay)
+
+	timer := time.NewTimer(Conf.DNSSdWithdrawDelay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// esclStatusPoll periodically polls eSCL ScannerStatus and updates
+// the device status, until stop channel is closed. Polling interval
+// is set by the escl-status-interval configuration parameter
+func (dev *Device) esclStatusPoll(stop chan struct{}) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	ticker := time.NewTicker(Conf.EsclStatusInterval)
+	defer ticker.Stop()
+
+	prev := ""
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		state, adfState, err := EsclScannerStatus(dev.HTTPClient,
+			dev.State.HTTPPort)
+
+		// Note, request may take a while, so recheck for stop
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		s := state
+		switch {
+		case err != nil:
+			s = "unknown"
+		case adfState != "":
+			s += ", ADF: " + adfState
+		}
+
+		if s != prev {
+			if err != nil {
+				dev.Log.Error('!', "eSCL: ScannerStatus: %s", err)
+			} else {
+				dev.Log.Info(' ', "eSCL: scanner status: %s", s)
+			}
+			prev = s
+		}
+
+		StatusSetScannerState(dev.UsbAddr, s)
+	}
+}
+
+// esclStatusPollStop stops eSCL ScannerStatus polling
+//
+// Note, it doesn't wait for the poller to exit, because request
+// in progress may take a while. Once transport is closed, poller
+// will fail to send request and notice the stop signal.
+func (dev *Device) esclStatusPollStop() {
+	if dev.esclStatusStop != nil {
+		close(dev.esclStatusStop)
+		dev.esclStatusStop = nil
+	}
+}
+
+// faxoutRecheck re-probes the IPP FaxOut service and, if its
+// availability changes, updates the Fax and rfo TXT record items
+// of the IPP service and FaxOut availability in the HTTPProxy,
+// until stop channel is closed
+//
+// Service is re-probed periodically, if configured. While service
+// is unavailable, it is re-probed anyway, so recovery (i.e., after
+// fax is configured at the device) is noticed. Failures, detected
+// by HTTPProxy in responses to FaxOut requests, are signalled via
+// the dev.faxoutFailed channel
+func (dev *Device) faxoutRecheck(stop chan struct{}, proxy *HTTPProxy) {
+
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	advertised := proxy.FaxOutAvailable()
+
+	for {
+		interval := Conf.FaxRecheckInterval
+		if interval == 0 && !advertised {
+			interval = DevFaxOutRecheckInterval
+		}
+
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if interval != 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+
+		probe := false
+		select {
+		case <-stop:
+		case <-dev.faxoutFailed:
+			// HTTPProxy already marked service unavailable
+		case <-tick:
+			probe = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if probe {
+			log := dev.Log.Begin()
+			err := IppFaxOutProbe(log, dev.State.HTTPPort,
+				dev.UsbTransport.Quirks(), dev.HTTPClient)
+			log.Commit()
+
+			// Note, request may take a while, so recheck for stop
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err != nil && advertised {
+				dev.Log.Error('!', "IPP FaxOut probe failed: %s", err)
+			}
+
+			proxy.SetFaxOutAvailable(err == nil)
+		}
+
+		faxout := proxy.FaxOutAvailable()
+		if faxout == advertised {
+			continue
+		}
+
+		advertised = faxout
+		if faxout {
+			dev.Log.Info(' ', "IPP FaxOut service recovered")
+		} else {
+			dev.Log.Info(' ', "IPP FaxOut service withdrawn")
+		}
+
+		dev.dnssdUpdate(func(services *DNSSdServices) {
+			for i := range *services {
+				svc := &(*services)[i]
+				if svc.Type == "_ipp._tcp" ||
+					svc.Type == "_ipps._tcp" {
+					ippSetFaxTxt(&svc.Txt, faxout)
+				}
+			}
+		})
+	}
+}
+
+// faxoutRecheckStop stops IPP FaxOut re-validation
+//
+// As with esclStatusPollStop, it doesn't wait for the poller to exit
+func (dev *Device) faxoutRecheckStop() {
+	if dev.faxoutStop != nil {
+		close(dev.faxoutStop)
+		dev.faxoutStop = nil
+	}
+}
+
+// prewarming sends lightweight IPP request via each USB connection,
+// so firmware's HTTP stack is woken up and inter-request (or initial)
+// delays are absorbed before the first real job comes
+func (dev *Device) prewarming(stop chan struct{}) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	cnt := dev.UsbTransport.ConnCount()
+	for i := 0; i < cnt; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log := dev.Log.Begin()
+		err := IppPrewarm(log, dev.State.HTTPPort, dev.HTTPClient)
+		log.Commit()
+
+		if err != nil {
+			dev.Log.Error('!', "IPP: pre-warming failed: %s", err)
+			return
+		}
+	}
+
+	dev.Log.Debug(' ', "IPP: %d connections pre-warmed", cnt)
+}
+
+// prewarmingStop stops connections pre-warming
+//
+// As with esclStatusPollStop, it doesn't wait for the goroutine to exit
+func (dev *Device) prewarmingStop() {
+	if dev.prewarmStop != nil {
+		close(dev.prewarmStop)
+		dev.prewarmStop = nil
+	}
+}
+
+// Refresh requests immediate re-query of IPP printer attributes
+// and update of the IPP TXT records, if attributes have changed
+func (dev *Device) Refresh() error {
+	if dev.refresh == nil {
+		return errors.New("DNS-SD TXT refresh not active")
+	}
+
+	select {
+	case dev.refresh <- struct{}{}:
+	default:
+		// Refresh already pending
+	}
+
+	return nil
+}
+
+// ippRefresh re-queries IPP printer attributes periodically (every
+// dns-sd-refresh-interval, if configured) and on demand (see Refresh)
+// and, if TXT record, generated from attributes, changes, updates
+// the advertised IPP services in place, until stop channel is closed
+func (dev *Device) ippRefresh(stop, refresh chan struct{}) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	var tick <-chan time.Time
+	if Conf.DNSSdTxtRefresh != 0 {
+		ticker := time.NewTicker(Conf.DNSSdTxtRefresh)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+		case <-refresh:
+		}
+
+		var services DNSSdServices
+
+		log := dev.Log.Begin()
+		ippinfo, _, err := IppService(log, &services,
+			dev.State.HTTPPort, dev.info, dev.UsbTransport.Quirks(),
+			dev.HTTPClient)
+		log.Commit()
+
+		// Note, request may take a while, so recheck for stop
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			dev.Log.Error('!', "IPP: refresh: %s", err)
+			continue
+		}
+
+		IppSaveAttrs(dev.info.Ident(), ippinfo.Attrs)
+		dev.ippTxtUpdate(services[ippinfo.IppSvcIndex].Txt)
+	}
+}
+
+// ippTxtUpdate updates TXT records of the advertised IPP services,
+// if TXT record, generated from printer attributes, has changed
+func (dev *Device) ippTxtUpdate(txt DNSSdTxtRecord) {
+	dev.servicesLock.Lock()
+	prev := dev.ippTxt
+	dev.servicesLock.Unlock()
+
+	// Note, if prev is nil, IPP is not advertised yet
+	if prev == nil || prev.Equal(txt) {
+		return
+	}
+
+	dev.Log.Info(' ', "IPP: printer attributes changed, TXT record updated:")
+	for _, item := range txt {
+		dev.Log.Debug(' ', "  %s=%s", item.Key, item.Value)
+	}
+
+	dev.dnssdUpdate(func(services *DNSSdServices) {
+		dev.ippTxt = txt
+
+		for i := range *services {
+			svc := &(*services)[i]
+			switch svc.Type {
+			case "_ipp._tcp":
+				svc.Txt.Replace(prev, txt)
+			case "_ipps._tcp":
+				svc.Txt.Replace(prev, txt)
+				svc.Txt.Set("TLS", "1.2")
+			}
+		}
+	})
+}
+
+// ippRefreshStop stops IPP TXT refresh
+//
+// As with esclStatusPollStop, it doesn't wait for the refresher to exit
+func (dev *Device) ippRefreshStop() {
+	if dev.refreshStop != nil {
+		close(dev.refreshStop)
+		dev.refreshStop = nil
+	}
+}
+
+// dnssdDecorate adds common TXT records to services, and TLS
+// variants of services, if HTTPS is enabled:
+//   - usb_SER=VCF9192281  ; Device USB serial number
+//   - usb_HWID=0482&069d  ; Its vendor and device ID
+func (dev *Device) dnssdDecorate(services *DNSSdServices) {
+	hwid := fmt.Sprintf("%4.4x&%4.4x", dev.info.Vendor, dev.info.Product)
+
+	for i := range *services {
+		svc := &(*services)[i]
+		svc.Txt.Add("usb_SER", dev.info.SerialNumber)
+		svc.Txt.Add("usb_HWID", hwid)
+	}
+
+	if dev.httpsPort != 0 {
+		TLSAdvertise(services, dev.httpsPort)
+	}
+}
+
+// dnssdUpdate modifies copy of the currently advertised services
+// by the callback, and re-publishes them
+func (dev *Device) dnssdUpdate(modify func(services *DNSSdServices)) {
+	dev.servicesLock.Lock()
+	defer dev.servicesLock.Unlock()
+
+	services := dev.services.Clone()
+	modify(&services)
+	dev.services = services
+
+	if dev.DNSSdPublisher != nil {
+		dev.DNSSdPublisher.Update(dev.dnssdExport(services))
+	}
+}
+
+// dnssdExport returns services, that may be actually advertised
+// at this moment
+//
+// If require-probe-success is enabled and device didn't pass the
+// end-to-end probe, only web console and the loopback-only
+// _ipp-usb._tcp service are advertised
+func (dev *Device) dnssdExport(services DNSSdServices) DNSSdServices {
+	if dev.probeOK {
+		return services
+	}
+
+	var exported DNSSdServices
+	for _, svc := range services {
+		switch svc.Type {
+		case "_http._tcp", "_ipp-usb._tcp":
+			exported = append(exported, svc)
+		}
+	}
+
+	return exported
+}
+
+// probe performs end-to-end probe of the IPP and/or eSCL services
+func (dev *Device) probe(ipp, escl bool) error {
+	if ipp {
+		log := dev.Log.Begin()
+		err := IppProbe(log, dev.State.HTTPPort,
+			dev.UsbTransport.Quirks(), dev.HTTPClient)
+		log.Commit()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if escl {
+		_, _, err := EsclScannerStatus(dev.HTTPClient,
+			dev.State.HTTPPort)
+		if err != nil {
+			return fmt.Errorf("eSCL: ScannerStatus: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// probeMonitor periodically re-probes the IPP and/or eSCL services,
+// if require-probe-success is enabled, until stop channel is closed
+//
+// If device fails DevProbeFailMax probes in a row, printer and
+// scanner services are withdrawn from DNS-SD, and advertised again,
+// when probe succeeds
+func (dev *Device) probeMonitor(stop chan struct{}, ipp, escl bool) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	dev.servicesLock.Lock()
+	advertised := dev.probeOK
+	dev.servicesLock.Unlock()
+
+	failures := 0
+
+	for {
+		interval := DevProbeInterval
+		if !advertised {
+			interval = DevProbeRetryInterval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := dev.probe(ipp, escl)
+
+		// Note, request may take a while, so recheck for stop
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		switch {
+		case err == nil:
+			failures = 0
+			if advertised {
+				continue
+			}
+
+			dev.Log.Info(' ', "Probe succeeded, advertising services")
+
+		case advertised:
+			failures++
+			dev.Log.Error('!', "Probe failed (%d of %d): %s",
+				failures, DevProbeFailMax, err)
+			if failures < DevProbeFailMax {
+				continue
+			}
+
+			dev.Log.Info(' ', "Device keeps failing, withdrawing services")
+
+		default:
+			dev.Log.Debug(' ', "Probe failed: %s", err)
+			continue
+		}
+
+		advertised = !advertised
+		failures = 0
+
+		dev.servicesLock.Lock()
+		dev.probeOK = advertised
+		dev.servicesLock.Unlock()
+
+		dev.dnssdUpdate(func(*DNSSdServices) {})
+	}
+}
+
+// probeMonitorStop stops services re-probing
+//
+// As with esclStatusPollStop, it doesn't wait for the goroutine to exit
+func (dev *Device) probeMonitorStop() {
+	if dev.probeStop != nil {
+		close(dev.probeStop)
+		dev.probeStop = nil
+	}
+}
+
+// partialRetry retries initialization of IPP and/or eSCL services,
+// which were not ready at device initialization, until they come
+// up or stop channel is closed. When service comes up, its DNS-SD
+// records are added to the advertised services
+//
+// Note, DNS-SD name is not changed at this point, even if it would
+// be different, if IPP were ready at initialization
+func (dev *Device) partialRetry(stop chan struct{}, ippRetry, esclRetry,
+	esclAdvertised bool, ippinfo *IppPrinterInfo) {
+
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	delay := Conf.HotplugRetryMin
+	quirks := dev.UsbTransport.Quirks()
+
+	for ippRetry || esclRetry {
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > Conf.HotplugRetryMax {
+			delay = Conf.HotplugRetryMax
+		}
+
+		var services DNSSdServices
+		var err error
+
+		// Retry IPP
+		if ippRetry {
+			var info *IppPrinterInfo
+
+			log := dev.Log.Begin()
+			info, _, err = IppService(log, &services,
+				dev.State.HTTPPort, dev.info, quirks,
+				dev.HTTPClient)
+			log.Commit()
+
+			if err == nil {
+				dev.Log.Info(' ', "IPP: service is ready now")
+
+				ippRetry = false
+				ippinfo = info
+				ippTxt := append(DNSSdTxtRecord(nil),
+					services[ippinfo.IppSvcIndex].Txt...)
+
+				dev.servicesLock.Lock()
+				dev.ippTxt = ippTxt
+				dev.servicesLock.Unlock()
+
+				scan := "F"
+				if esclAdvertised {
+					scan = "T"
+				}
+				services[ippinfo.IppSvcIndex].Txt.Add("Scan", scan)
+			} else {
+				dev.Log.Debug(' ', "IPP: still not ready: %s", err)
+			}
+		}
+
+		// Retry eSCL
+		if esclRetry {
+			log := dev.Log.Begin()
+			_, err = EsclService(log, &services,
+				dev.State.HTTPPort, dev.info, ippinfo, quirks,
+				dev.HTTPClient)
+			log.Commit()
+
+			if err == nil {
+				dev.Log.Info(' ', "ESCL: service is ready now")
+				esclRetry = false
+				esclAdvertised = true
+			} else {
+				dev.Log.Debug(' ', "ESCL: still not ready: %s", err)
+			}
+		}
+
+		// Recheck for stop, as requests may take a while
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if len(services) == 0 {
+			continue
+		}
+
+		dev.dnssdDecorate(&services)
+		dev.dnssdUpdate(func(current *DNSSdServices) {
+			for _, svc := range services {
+				current.Add(svc)
+			}
+
+			if !esclAdvertised {
+				return
+			}
+
+			for i := range *current {
+				svc := &(*current)[i]
+				if svc.Type == "_ipp._tcp" ||
+					svc.Type == "_ipps._tcp" {
+					svc.Txt.Set("Scan", "T")
+				}
+			}
+		})
+	}
+}
+
+// partialRetryStop stops background initialization retry
+//
+// As with esclStatusPollStop, it doesn't wait for the retrier to exit
+func (dev *Device) partialRetryStop() {
+	if dev.retryStop != nil {
+		close(dev.retryStop)
+		dev.retryStop = nil
+	}
+}
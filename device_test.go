@@ -0,0 +1,288 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for Device initialization over the virtual device
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// testDevice is the virtual device, which IPP and eSCL services
+// may be not ready (respond with HTTP 503) or hang
+type testDevice struct {
+	ippReady  int32         // Atomic non-zero, if IPP is ready
+	esclReady int32         // Atomic non-zero, if eSCL is ready
+	hang      int32         // Atomic non-zero, if requests hang
+	release   chan struct{} // Closed to release hanging requests
+}
+
+// ServeHTTP serves requests to the testDevice
+func (td *testDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&td.hang) != 0 {
+		<-td.release
+	}
+
+	if r.URL.Path == "/eSCL/ScannerCapabilities" {
+		if atomic.LoadInt32(&td.esclReady) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(esclTestCaps))
+		return
+	}
+
+	if atomic.LoadInt32(&td.ippReady) == 0 {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var rq goipp.Message
+	body, _ := ioutil.ReadAll(r.Body)
+	rq.DecodeBytes(body)
+
+	rsp := goipp.NewResponse(goipp.DefaultVersion,
+		goipp.StatusOk, rq.RequestID)
+	rsp.Printer.Add(goipp.MakeAttribute("printer-make-and-model",
+		goipp.TagText, goipp.String("Virtual Loopback Device")))
+
+	data, _ := rsp.EncodeBytes()
+	w.Header().Set("Content-Type", goipp.ContentType)
+	w.Write(data)
+}
+
+// newTestDevice creates Device on a top of the virtual device
+func newTestDevice(t *testing.T, lb *usbLoopback) (*Device, error) {
+	transport, err := newUsbLoopbackTransport(lb, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return newDevice(UsbDeviceDesc{}, transport)
+}
+
+// testDeviceSetup prepares configuration for Device tests
+// and returns function that restores it
+//
+// The init-retry-partial quirk is set for the virtual device
+func testDeviceSetup(t *testing.T) func() {
+	saveConf, saveStateDev := Conf, PathProgStateDev
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	quirks := "[" + testUsbLoopbackInfo.MfgAndProduct + "]\n" +
+		"  " + QuirkNmInitRetryPartial + " = true\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "test.conf"),
+		[]byte(quirks), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	Conf.Quirks, err = LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	PathProgStateDev = filepath.Join(dir, "dev")
+	Conf.HTTPTCPEnable = false
+	Conf.HTTPUnixEnable = false
+	Conf.DNSSdEnable = false
+	Conf.ICCProfileLookup = false
+	Conf.HotplugRetryMin = 10 * time.Millisecond
+	Conf.HotplugRetryMax = 50 * time.Millisecond
+
+	return func() {
+		Conf = saveConf
+		PathProgStateDev = saveStateDev
+		os.RemoveAll(dir)
+	}
+}
+
+// testDeviceService returns service of the specified type, or nil
+func testDeviceService(services DNSSdServices, svcType string) *DNSSdSvcInfo {
+	for i := range services {
+		if services[i].Type == svcType {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+// testDeviceScanTxt returns value of the "Scan" TXT item of the IPP
+// service, or "" if there is no such service or item
+func testDeviceScanTxt(services DNSSdServices) string {
+	svc := testDeviceService(services, "_ipp._tcp")
+	if svc != nil {
+		for _, txt := range svc.Txt {
+			if txt.Key == "Scan" {
+				return txt.Value
+			}
+		}
+	}
+	return ""
+}
+
+// TestDevicePartialInit tests initialization of the device, where
+// IPP is ready but eSCL is not, and the later eSCL recovery
+func TestDevicePartialInit(t *testing.T) {
+	defer testDeviceSetup(t)()
+
+	td := &testDevice{ippReady: 1}
+	dev, err := newTestDevice(t, newUsbLoopback(testUsbLoopbackInfo, td))
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+
+	defer func() {
+		dev.servicesLock.Lock()
+		dev.DNSSdPublisher = nil
+		dev.servicesLock.Unlock()
+		dev.Close()
+	}()
+
+	// IPP must be served, eSCL must not
+	dev.servicesLock.Lock()
+	services := dev.services
+	dev.servicesLock.Unlock()
+
+	if testDeviceService(services, "_ipp._tcp") == nil {
+		t.Errorf("IPP service not advertised")
+	}
+
+	if testDeviceService(services, "_uscan._tcp") != nil {
+		t.Errorf("eSCL service advertised before it is ready")
+	}
+
+	if scan := testDeviceScanTxt(services); scan != "F" {
+		t.Errorf("IPP Scan=%q, expected %q", scan, "F")
+	}
+
+	// Intercept services updates, sent to DNS-SD publisher.
+	// DNS-SD is disabled here, so mark device as probed, to
+	// export all services
+	publisher := NewDNSSdPublisher(dev.Log, dev.State, nil)
+	dev.servicesLock.Lock()
+	dev.DNSSdPublisher = publisher
+	dev.probeOK = true
+	dev.servicesLock.Unlock()
+
+	// When eSCL becomes ready, it must be published
+	atomic.StoreInt32(&td.esclReady, 1)
+
+	select {
+	case services = <-publisher.update:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("services not republished")
+	}
+
+	if testDeviceService(services, "_ipp._tcp") == nil {
+		t.Errorf("IPP service lost after update")
+	}
+
+	if testDeviceService(services, "_uscan._tcp") == nil {
+		t.Errorf("eSCL service not republished")
+	}
+
+	if scan := testDeviceScanTxt(services); scan != "T" {
+		t.Errorf("IPP Scan=%q, expected %q", scan, "T")
+	}
+}
+
+// TestDevicePartialInitNothingReady tests initialization of the
+// device, where neither IPP nor eSCL is ready
+func TestDevicePartialInitNothingReady(t *testing.T) {
+	defer testDeviceSetup(t)()
+
+	td := &testDevice{}
+	dev, err := newTestDevice(t, newUsbLoopback(testUsbLoopbackInfo, td))
+	if err != ErrPartialInit {
+		if dev != nil {
+			dev.Close()
+		}
+		t.Fatalf("NewDevice: expected %v, present %v",
+			ErrPartialInit, err)
+	}
+}
+
+// TestDeviceCloseAbandoned tests closing of the device with hanging
+// requests, when libusb context is abandoned by its watchdog
+func TestDeviceCloseAbandoned(t *testing.T) {
+	defer testDeviceSetup(t)()
+
+	td := &testDevice{ippReady: 1, esclReady: 1,
+		release: make(chan struct{})}
+	defer close(td.release)
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, td)
+	dev, err := newTestDevice(t, lb)
+	if err != nil {
+		t.Fatalf("NewDevice: %s", err)
+	}
+
+	// Start request, that will never complete
+	atomic.StoreInt32(&td.hang, 1)
+	transport := dev.UsbTransport
+
+	rq := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	body, _ := rq.EncodeBytes()
+
+	errs := make(chan error, 1)
+	go func() {
+		rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+			bytes.NewReader(body))
+		rq.Header.Set("Content-Type", goipp.ContentType)
+		rsp, err := transport.RoundTrip(rq)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		errs <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for transport.connInUse() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Abandon the context and close the device, like PnP
+	// manager does on UsbResetChan
+	lb.Abandon()
+
+	start := time.Now()
+	pnpCloseDevices(map[UsbAddr]*Device{dev.UsbAddr: dev})
+	if elapsed := time.Since(start); elapsed >= DevShutdownTimeout {
+		t.Errorf("device closed in %s, expected less than %s",
+			elapsed, DevShutdownTimeout)
+	}
+
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Errorf("request succeeded on abandoned device")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("request still hangs")
+	}
+}
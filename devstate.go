@@ -11,11 +11,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 )
 
 // DevState manages a per-device persistent state (such as HTTP
@@ -23,17 +25,37 @@ import (
 type DevState struct {
 	Ident         string // Device identification
 	HTTPPort      int    // Allocated HTTP port
+	HTTPSPort     int    // Allocated HTTPS port, 0 if none
 	DNSSdName     string // DNS-SD name, as reported by device
 	DNSSdOverride string // DNS-SD name after collision resolution
+	ZlpRecvHack   bool   // zlp-recv-hack learned automatically
+	UsbRecvAlign  int    // USB receive alignment learned, 0 if none
+	UsbSendRate   int    // Device drain rate learned, 0 if none
+	LoopbackAddr  net.IP // Per-device loopback address, nil if none
 
 	comment string // Comment in the state file
 	path    string // Path to the disk file
 }
 
+// devStateLock serializes modification and saving of DevState,
+// as it may be updated from different goroutines (i.e., learned
+// USB parameters and DNS-SD name collision resolution)
+var devStateLock sync.Mutex
+
+// devStateMemory keeps DevState of all devices in read-only mode,
+// where state is not saved to disk. Indexed by device ident
+var (
+	devStateMemory     = make(map[string]DevState)
+	devStateMemoryLock sync.Mutex
+)
+
 // LoadDevState loads DevState from a disk file
 //
 // This function always succeeds, even in a case of file i/o errors.
 // In a worst case we loose state persistence, not other functionality.
+//
+// In read-only mode, state, saved in memory, takes precedence over
+// the disk file
 func LoadDevState(ident, comment string) *DevState {
 	state := &DevState{
 		Ident:   ident,
@@ -41,6 +63,16 @@ func LoadDevState(ident, comment string) *DevState {
 	}
 	state.path = state.devStatePath()
 
+	devStateMemoryLock.Lock()
+	saved, found := devStateMemory[ident]
+	devStateMemoryLock.Unlock()
+
+	if found {
+		*state = saved
+		state.comment = comment
+		return state
+	}
+
 	// Read state file
 	ini, err := OpenIniFile(state.path)
 	if err == nil {
@@ -64,6 +96,51 @@ func LoadDevState(ident, comment string) *DevState {
 func LoadUsedPorts() (ports map[int]string) {
 	ports = make(map[int]string)
 
+	err := devStateScan(func(name string, state *DevState) {
+		if state.HTTPPort != 0 {
+			ports[state.HTTPPort] = name
+		}
+		if state.HTTPSPort != 0 {
+			ports[state.HTTPSPort] = name
+		}
+	})
+
+	if err != nil {
+		Log.Error('!', "Can't load existing ports allocation")
+		Log.Error('!', "%s", err)
+	}
+
+	return
+}
+
+// LoadUsedLoopbackAddrs loads per-device loopback addresses used
+// by some of devices.
+//
+// The returned map is indexed by the address string. Value of each
+// entry is a human-readable string, reasonable for logging
+func LoadUsedLoopbackAddrs() (addrs map[string]string) {
+	addrs = make(map[string]string)
+
+	err := devStateScan(func(name string, state *DevState) {
+		if state.LoopbackAddr != nil {
+			addrs[state.LoopbackAddr.String()] = name
+		}
+	})
+
+	if err != nil {
+		Log.Error('!', "Can't load existing loopback addresses allocation")
+		Log.Error('!', "%s", err)
+	}
+
+	return
+}
+
+// devStateScan calls visit for state of each known device, both
+// saved on disk and kept in memory (in read-only mode)
+//
+// Broken state files are logged and skipped. Returned error
+// indicates that state directory cannot be read
+func devStateScan(visit func(name string, state *DevState)) error {
 	// Read the PathProgStateDev (normally "/var/ipp-usb/dev")
 	// directory.
 	var files []os.FileInfo
@@ -75,14 +152,19 @@ func LoadUsedPorts() (ports map[int]string) {
 		dir.Close()
 	}
 
-	if err != nil {
-		Log.Error('!', "Can't load existing ports allocation")
-		Log.Error('!', "%s", err)
-		return
+	// In read-only mode, add devices, kept in memory
+	devStateMemoryLock.Lock()
+	for ident, state := range devStateMemory {
+		state := state
+		visit(ident+".state", &state)
 	}
+	devStateMemoryLock.Unlock()
 
 	if err != nil {
-		return
+		if Conf.StateReadOnly && os.IsNotExist(err) {
+			err = nil
+		}
+		return err
 	}
 
 	// Scan found files
@@ -108,12 +190,10 @@ func LoadUsedPorts() (ports map[int]string) {
 			continue
 		}
 
-		if state.HTTPPort != 0 {
-			ports[state.HTTPPort] = file.Name()
-		}
+		visit(file.Name(), state)
 	}
 
-	return
+	return nil
 }
 
 // load performs an actual work of loading the DevState file
@@ -135,10 +215,26 @@ func (state *DevState) load(ini *IniFile) error {
 			switch rec.Key {
 			case "http-port":
 				err = state.loadTCPPort(&state.HTTPPort, rec)
+			case "https-port":
+				err = state.loadTCPPort(&state.HTTPSPort, rec)
 			case "dns-sd-name":
 				state.DNSSdName = rec.Value
 			case "dns-sd-override":
 				state.DNSSdOverride = rec.Value
+			case "zlp-recv-hack":
+				err = rec.LoadBool(&state.ZlpRecvHack)
+			case "usb-recv-align":
+				state.UsbRecvAlign, err = strconv.Atoi(rec.Value)
+				if err != nil {
+					err = state.error("%s", err)
+				}
+			case "usb-send-rate":
+				state.UsbSendRate, err = strconv.Atoi(rec.Value)
+				if err != nil {
+					err = state.error("%s", err)
+				}
+			case "loopback-addr":
+				err = state.loadLoopbackAddr(rec)
 			}
 		}
 
@@ -170,8 +266,42 @@ func (state *DevState) loadTCPPort(out *int, rec *IniRecord) error {
 	return nil
 }
 
+// Load per-device loopback address
+func (state *DevState) loadLoopbackAddr(rec *IniRecord) error {
+	ip := net.ParseIP(rec.Value)
+	if ip == nil || !devStateLoopbackNet.Contains(ip) {
+		return state.error("%s: invalid address %q", rec.Key, rec.Value)
+	}
+
+	state.LoopbackAddr = ip.To4()
+
+	return nil
+}
+
+// Update modifies DevState by calling the update function and
+// saves it. Use it for modifications, that may happen concurrently
+func (state *DevState) Update(update func(state *DevState)) {
+	devStateLock.Lock()
+	update(state)
+	devStateLock.Unlock()
+
+	state.Save()
+}
+
 // Save updates DevState on disk
+//
+// In read-only mode, DevState is kept in memory instead
 func (state *DevState) Save() {
+	devStateLock.Lock()
+	defer devStateLock.Unlock()
+
+	if Conf.StateReadOnly {
+		devStateMemoryLock.Lock()
+		devStateMemory[state.Ident] = *state
+		devStateMemoryLock.Unlock()
+		return
+	}
+
 	os.MkdirAll(PathProgStateDev, 0755)
 
 	var buf bytes.Buffer
@@ -182,8 +312,23 @@ func (state *DevState) Save() {
 
 	fmt.Fprintf(&buf, "[device]\n")
 	fmt.Fprintf(&buf, "http-port       = %d\n", state.HTTPPort)
+	if state.HTTPSPort != 0 {
+		fmt.Fprintf(&buf, "https-port      = %d\n", state.HTTPSPort)
+	}
 	fmt.Fprintf(&buf, "dns-sd-name     = %q\n", state.DNSSdName)
 	fmt.Fprintf(&buf, "dns-sd-override = %q\n", state.DNSSdOverride)
+	if state.ZlpRecvHack {
+		fmt.Fprintf(&buf, "zlp-recv-hack   = true\n")
+	}
+	if state.UsbRecvAlign != 0 {
+		fmt.Fprintf(&buf, "usb-recv-align  = %d\n", state.UsbRecvAlign)
+	}
+	if state.UsbSendRate != 0 {
+		fmt.Fprintf(&buf, "usb-send-rate   = %d\n", state.UsbSendRate)
+	}
+	if state.LoopbackAddr != nil {
+		fmt.Fprintf(&buf, "loopback-addr   = %s\n", state.LoopbackAddr)
+	}
 
 	err := state.save(buf.Bytes())
 	if err != nil {
@@ -220,7 +365,20 @@ func (state *DevState) save(data []byte) error {
 
 // HTTPListen allocates HTTP port and updates persistent configuration
 func (state *DevState) HTTPListen() (net.Listener, error) {
-	port := state.HTTPPort
+	return state.listen(&state.HTTPPort, "HTTP")
+}
+
+// HTTPSListen allocates HTTPS port and updates persistent configuration
+//
+// Returned listener accepts TCP connections; TLS is up to the caller
+func (state *DevState) HTTPSListen() (net.Listener, error) {
+	return state.listen(&state.HTTPSPort, "HTTPS")
+}
+
+// listen allocates TCP port for the protocol (HTTP or HTTPS)
+// and updates persistent configuration
+func (state *DevState) listen(out *int, proto string) (net.Listener, error) {
+	port := *out
 
 	// Check that preallocated port is within the configured range
 	if !(Conf.HTTPMinPort <= port && port <= Conf.HTTPMaxPort) {
@@ -239,16 +397,31 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	// devices.
 	ports := LoadUsedPorts()
 
+	// In read-only mode, allocation is not persistent. To keep
+	// device port stable between runs, try port, derived from
+	// the device ident, first
+	if Conf.StateReadOnly {
+		port = state.deterministicPort(proto)
+		if ports[port] == "" {
+			listener, err := NewListener(port)
+			if err == nil {
+				*out = port
+				state.Save()
+				return listener, nil
+			}
+		}
+	}
+
 	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
 		used := ports[port]
 		if used != "" {
-			Log.Info(' ', "HTTP port %d used by %s", port, used)
+			Log.Info(' ', "%s port %d used by %s", proto, port, used)
 			continue
 		}
 
 		listener, err := NewListener(port)
 		if err == nil {
-			state.HTTPPort = port
+			*out = port
 			state.Save()
 			return listener, nil
 		}
@@ -259,19 +432,89 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
 		listener, err := NewListener(port)
 		if err == nil {
-			state.HTTPPort = port
+			*out = port
 			state.Save()
 			return listener, nil
 		}
 	}
 
 	// Give up and return an error
-	err := state.error("failed to allocate HTTP port", state.Ident)
+	err := state.error("failed to allocate %s port", proto)
 	Log.Error('!', "STATE PORT: %s", err)
 
 	return nil, err
 }
 
+// LoopbackListen allocates per-device loopback address (127.0.1.N),
+// listens on it at the DevLoopbackPort and updates persistent
+// configuration
+func (state *DevState) LoopbackListen() (net.Listener, error) {
+	// Try to allocate address used before
+	if state.LoopbackAddr != nil {
+		listener, err := NewListenerAddr(state.LoopbackAddr,
+			DevLoopbackPort)
+		if err == nil {
+			return listener, nil
+		}
+	}
+
+	// Allocate an address. Don't reuse addresses allocated by
+	// other devices.
+	addrs := LoadUsedLoopbackAddrs()
+
+	for n := 1; n <= 254; n++ {
+		ip := devStateLoopbackAddr(n)
+		used := addrs[ip.String()]
+		if used != "" {
+			Log.Info(' ', "loopback address %s used by %s", ip, used)
+			continue
+		}
+
+		listener, err := NewListenerAddr(ip, DevLoopbackPort)
+		if err == nil {
+			state.LoopbackAddr = ip
+			state.Save()
+			return listener, nil
+		}
+	}
+
+	// Give up and return an error
+	err := state.error("failed to allocate loopback address")
+	Log.Error('!', "STATE ADDR: %s", err)
+
+	return nil, err
+}
+
+// devStateLoopbackNet is the network, per-device loopback
+// addresses are allocated from
+var devStateLoopbackNet = &net.IPNet{
+	IP:   net.IPv4(127, 0, 1, 0).To4(),
+	Mask: net.CIDRMask(24, 32),
+}
+
+// devStateLoopbackAddr returns n-th per-device loopback address
+func devStateLoopbackAddr(n int) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, devStateLoopbackNet.IP)
+	ip[3] = byte(n)
+	return ip
+}
+
+// deterministicPort returns TCP port for the protocol (HTTP or HTTPS)
+// within the configured range, derived from the device ident
+func (state *DevState) deterministicPort(proto string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(state.Ident + "/" + proto))
+
+	span := uint32(Conf.HTTPMaxPort - Conf.HTTPMinPort + 1)
+	return Conf.HTTPMinPort + int(hash.Sum32()%span)
+}
+
+// UnixSocketPath returns a path to the device's Unix domain socket
+func (state *DevState) UnixSocketPath() string {
+	return filepath.Join(PathUnixSocketDir, state.Ident+".sock")
+}
+
 // devStatePath returns a path to the DevState file
 func (state *DevState) devStatePath() string {
 	return filepath.Join(PathProgStateDev, state.Ident+".state")
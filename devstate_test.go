@@ -0,0 +1,172 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-device persistent state
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestDevStateReadOnly tests DevState in read-only mode
+func TestDevStateReadOnly(t *testing.T) {
+	saveConf, saveState := Conf, PathProgState
+	defer func() {
+		Conf = saveConf
+		PathSetProgState(saveState)
+		devStateMemory = make(map[string]DevState)
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	PathSetProgState(dir)
+	Conf.StateReadOnly = true
+	Conf.HTTPMinPort = 60000
+	Conf.HTTPMaxPort = 65535
+
+	// Save must not touch the disk
+	state := LoadDevState("test-device", "")
+	state.HTTPPort = 60001
+	state.DNSSdName = "Test Device"
+	state.Save()
+
+	path := filepath.Join(PathProgStateDev, "test-device.state")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s: file created in read-only mode", path)
+	}
+
+	// State must be loaded from memory
+	state = LoadDevState("test-device", "")
+	if state.HTTPPort != 60001 || state.DNSSdName != "Test Device" {
+		t.Errorf("state not preserved in memory: %+v", state)
+	}
+
+	// Ports must be reported as used
+	ports := LoadUsedPorts()
+	if ports[60001] == "" {
+		t.Errorf("port 60001 not reported as used")
+	}
+
+	// Deterministic port must be stable and within range
+	port := state.deterministicPort("HTTP")
+	if port != state.deterministicPort("HTTP") {
+		t.Errorf("deterministic port is not stable")
+	}
+
+	if port < Conf.HTTPMinPort || port > Conf.HTTPMaxPort {
+		t.Errorf("deterministic port %d out of range", port)
+	}
+}
+
+// TestDevStateLoopbackAddr tests persistence of the per-device
+// loopback address
+func TestDevStateLoopbackAddr(t *testing.T) {
+	saveConf, saveState := Conf, PathProgState
+	defer func() {
+		Conf = saveConf
+		PathSetProgState(saveState)
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	PathSetProgState(dir)
+	Conf.StateReadOnly = false
+
+	state := LoadDevState("test-device", "")
+	state.HTTPPort = 60001
+	state.LoopbackAddr = devStateLoopbackAddr(7)
+	state.Save()
+
+	state = LoadDevState("test-device", "")
+	if !state.LoopbackAddr.Equal(net.IPv4(127, 0, 1, 7)) {
+		t.Errorf("loopback address not preserved: %s",
+			state.LoopbackAddr)
+	}
+
+	addrs := LoadUsedLoopbackAddrs()
+	if addrs["127.0.1.7"] != "test-device.state" {
+		t.Errorf("127.0.1.7 not reported as used: %v", addrs)
+	}
+
+	// Addresses outside of 127.0.1.0/24 must be rejected
+	path := filepath.Join(PathProgStateDev, "bad-device.state")
+	data := "[device]\nhttp-port = 60002\nloopback-addr = 127.0.0.1\n"
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	state = LoadDevState("bad-device", "")
+	if state.LoopbackAddr != nil {
+		t.Errorf("invalid loopback address accepted: %s",
+			state.LoopbackAddr)
+	}
+}
+
+// TestDevStateUpdate tests concurrent modification of DevState
+func TestDevStateUpdate(t *testing.T) {
+	saveConf, saveState := Conf, PathProgState
+	defer func() {
+		Conf = saveConf
+		PathSetProgState(saveState)
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	PathSetProgState(dir)
+	Conf.StateReadOnly = false
+
+	state := LoadDevState("test-device", "")
+	state.HTTPPort = 60001
+
+	// Learned USB parameters and DNS-SD name are updated
+	// from different goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			state.Update(func(state *DevState) {
+				state.UsbSendRate = 4096 + i
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			state.Update(func(state *DevState) {
+				state.DNSSdOverride = "Test Device (USB)"
+			})
+		}()
+	}
+	wg.Wait()
+
+	saved := LoadDevState("test-device", "")
+	if saved.UsbSendRate != state.UsbSendRate ||
+		saved.DNSSdOverride != "Test Device (USB)" ||
+		saved.HTTPPort != 60001 {
+		t.Errorf("state not saved properly: %+v", saved)
+	}
+}
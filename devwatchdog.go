@@ -0,0 +1,176 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-device watchdog: reset escalation ladder
+ *
+ * When device initialization times out, the device needs to be
+ * recovered before the next attempt. Flaky hardware may time out
+ * again and again, and blindly doing hard reset on each attempt
+ * results in the infinite fast reset loop. So recovery escalates
+ * on repeated timeouts, from the lightest to the heaviest means:
+ *
+ *   clear-halt -> soft-reset -> hard-reset -> re-enumeration wait ->
+ *   temporary blacklist
+ *
+ * Successful initialization returns device to the bottom of
+ * the ladder.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DevResetStep represents a step of the reset escalation ladder
+type DevResetStep int
+
+// DevResetStep values, in order of escalation
+const (
+	DevResetClearHalt   DevResetStep = iota // Clear halt of endpoints
+	DevResetSoft                            // Class-specific soft reset
+	DevResetHard                            // USB port reset
+	DevResetReenumerate                     // Hard reset, then wait
+	DevResetBlacklist                       // Temporary blacklist
+	devResetStepCount                       // Count of steps
+)
+
+// String returns name of the DevResetStep
+func (step DevResetStep) String() string {
+	switch step {
+	case DevResetClearHalt:
+		return "clear-halt"
+	case DevResetSoft:
+		return "soft-reset"
+	case DevResetHard:
+		return "hard-reset"
+	case DevResetReenumerate:
+		return "reenumerate"
+	case DevResetBlacklist:
+		return "blacklist"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(step))
+}
+
+// DevWatchdogError is returned by NewDevice, when initialization
+// timed out. It reports the recovery step, taken by the watchdog
+type DevWatchdogError struct {
+	Step  DevResetStep // Recovery step taken
+	Until time.Time    // Next attempt not before, zero if not limited
+}
+
+// Error returns error message for DevWatchdogError
+func (err DevWatchdogError) Error() string {
+	s := ErrInitTimedOut.Error()
+
+	switch err.Step {
+	case DevResetReenumerate:
+		return s + " (hard-reset, waiting for re-enumeration)"
+	case DevResetBlacklist:
+		return s + " (blacklisted until " +
+			err.Until.Format("15:04:05") + ")"
+	}
+
+	return s + " (" + err.Step.String() + ")"
+}
+
+// devWatchdog is the per-device watchdog state
+type devWatchdog struct {
+	step   DevResetStep           // Next step to be taken
+	counts [devResetStepCount]int // Count of steps taken, per step
+}
+
+// DevWatchdogTable contains per-device watchdogs, indexed by
+// device ident, so the state survives device re-enumeration
+type DevWatchdogTable struct {
+	lock      sync.Mutex              // Access lock
+	watchdogs map[string]*devWatchdog // Watchdogs by ident
+}
+
+// DevWatchdogs is the global table of per-device watchdogs
+var DevWatchdogs = NewDevWatchdogTable()
+
+// NewDevWatchdogTable creates a new DevWatchdogTable
+func NewDevWatchdogTable() *DevWatchdogTable {
+	return &DevWatchdogTable{watchdogs: make(map[string]*devWatchdog)}
+}
+
+// Escalate returns the recovery step to be taken after device
+// initialization timed out, and escalates the ladder for the
+// next time
+//
+// The blacklist step is the top of the ladder, repeated until
+// device initializes successfully. If blacklist-time is 0, the
+// blacklist step is never taken
+func (table *DevWatchdogTable) Escalate(ident string) DevWatchdogError {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	wd := table.watchdogs[ident]
+	if wd == nil {
+		wd = &devWatchdog{}
+		table.watchdogs[ident] = wd
+	}
+
+	top := DevResetBlacklist
+	if Conf.HotplugBlacklist == 0 {
+		top = DevResetReenumerate
+	}
+
+	step := wd.step
+	if step > top {
+		step = top
+	}
+
+	wd.counts[step]++
+	if step < top {
+		wd.step = step + 1
+	}
+
+	err := DevWatchdogError{Step: step}
+	switch step {
+	case DevResetReenumerate:
+		err.Until = time.Now().Add(DevReenumerateWait)
+	case DevResetBlacklist:
+		err.Until = time.Now().Add(Conf.HotplugBlacklist)
+	}
+
+	return err
+}
+
+// Success returns device to the bottom of the ladder after
+// successful initialization. Counters are preserved
+func (table *DevWatchdogTable) Success(ident string) {
+	table.lock.Lock()
+	if wd := table.watchdogs[ident]; wd != nil {
+		wd.step = DevResetClearHalt
+	}
+	table.lock.Unlock()
+}
+
+// Format formats watchdog counters of the device for
+// the status display. If watchdog never triggered for the
+// device, "" is returned
+func (table *DevWatchdogTable) Format(ident string) string {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	wd := table.watchdogs[ident]
+	if wd == nil {
+		return ""
+	}
+
+	s := make([]string, devResetStepCount)
+	for step := range s {
+		s[step] = fmt.Sprintf("%s=%d", DevResetStep(step),
+			wd.counts[step])
+	}
+
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,81 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-device watchdog
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDevWatchdogEscalate tests the reset escalation ladder
+func TestDevWatchdogEscalate(t *testing.T) {
+	saved := Conf.HotplugBlacklist
+	defer func() { Conf.HotplugBlacklist = saved }()
+
+	Conf.HotplugBlacklist = 10 * time.Minute
+	table := NewDevWatchdogTable()
+
+	if s := table.Format("dev"); s != "" {
+		t.Errorf("Format of unknown device: %q", s)
+	}
+
+	expected := []DevResetStep{
+		DevResetClearHalt,
+		DevResetSoft,
+		DevResetHard,
+		DevResetReenumerate,
+		DevResetBlacklist,
+		DevResetBlacklist,
+	}
+
+	for i, exp := range expected {
+		err := table.Escalate("dev")
+		if err.Step != exp {
+			t.Errorf("step %d: expected %s, present %s",
+				i, exp, err.Step)
+		}
+
+		hold := exp == DevResetReenumerate || exp == DevResetBlacklist
+		if hold == err.Until.IsZero() {
+			t.Errorf("step %d: %s: unexpected Until %v",
+				i, exp, err.Until)
+		}
+	}
+
+	s := table.Format("dev")
+	exp := "clear-halt=1 soft-reset=1 hard-reset=1 reenumerate=1 blacklist=2"
+	if s != exp {
+		t.Errorf("Format:\nexpected: %q\npresent:  %q", exp, s)
+	}
+
+	// Success returns to the bottom of the ladder
+	table.Success("dev")
+	if err := table.Escalate("dev"); err.Step != DevResetClearHalt {
+		t.Errorf("after Success: expected %s, present %s",
+			DevResetClearHalt, err.Step)
+	}
+
+	// Other devices are not affected
+	if err := table.Escalate("other"); err.Step != DevResetClearHalt {
+		t.Errorf("other device: expected %s, present %s",
+			DevResetClearHalt, err.Step)
+	}
+
+	// With blacklist-time = 0, re-enumeration wait is the top
+	Conf.HotplugBlacklist = 0
+	for i := 0; i < 10; i++ {
+		table.Escalate("noblacklist")
+	}
+
+	s = table.Format("noblacklist")
+	exp = "clear-halt=1 soft-reset=1 hard-reset=1 reenumerate=7 blacklist=0"
+	if s != exp {
+		t.Errorf("Format:\nexpected: %q\npresent:  %q", exp, s)
+	}
+}
@@ -10,9 +10,12 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // DNSSdTxtItem represents a single TXT record item
@@ -34,6 +37,114 @@ func (txt *DNSSdTxtRecord) AddURL(key, value string) {
 	*txt = append(*txt, DNSSdTxtItem{key, value, true})
 }
 
+// Set sets value of the existing regular (non-URL) item or adds
+// a new item, if key is not found
+func (txt *DNSSdTxtRecord) Set(key, value string) {
+	for i := range *txt {
+		if (*txt)[i].Key == key {
+			(*txt)[i] = DNSSdTxtItem{key, value, false}
+			return
+		}
+	}
+
+	txt.Add(key, value)
+}
+
+// Del deletes item from DNSSdTxtRecord
+func (txt *DNSSdTxtRecord) Del(key string) {
+	out := (*txt)[:0]
+	for _, item := range *txt {
+		if item.Key != key {
+			out = append(out, item)
+		}
+	}
+
+	*txt = out
+}
+
+// Override applies overrides to the TXT record. Keys are matched
+// case-insensitively. Existing items are replaced or, if override
+// value is empty, removed. Missing items are added only if add
+// is true
+func (txt *DNSSdTxtRecord) Override(overrides map[string]string, add bool) {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := overrides[key]
+		found := false
+
+		for i := 0; i < len(*txt); i++ {
+			item := &(*txt)[i]
+			if !strings.EqualFold(item.Key, key) {
+				continue
+			}
+
+			found = true
+			if value == "" {
+				*txt = append((*txt)[:i], (*txt)[i+1:]...)
+				i--
+			} else {
+				*item = DNSSdTxtItem{item.Key, value, false}
+			}
+		}
+
+		if !found && add && value != "" {
+			txt.Add(key, value)
+		}
+	}
+}
+
+// Equal tells if two TXT records are equal
+func (txt DNSSdTxtRecord) Equal(txt2 DNSSdTxtRecord) bool {
+	if len(txt) != len(txt2) {
+		return false
+	}
+
+	for i := range txt {
+		if txt[i] != txt2[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Replace replaces items, taken from the prev record, with items
+// from the next record. Items of prev, missed in next, are deleted,
+// changed items are updated in place and new items are appended.
+// Items, not present in prev (i.e., added by ipp-usb itself), are
+// preserved
+func (txt *DNSSdTxtRecord) Replace(prev, next DNSSdTxtRecord) {
+	for _, item := range prev {
+		found := false
+		for _, item2 := range next {
+			found = found || item2.Key == item.Key
+		}
+
+		if !found {
+			txt.Del(item.Key)
+		}
+	}
+
+	for _, item := range next {
+		found := false
+		for i := range *txt {
+			if (*txt)[i].Key == item.Key {
+				(*txt)[i] = item
+				found = true
+			}
+		}
+
+		if !found {
+			*txt = append(*txt, item)
+		}
+	}
+}
+
 // AddPDL adds PDL list (list of supported Page Description Languages, i.e.,
 // document formats) to the DNSSdTxtRecord.
 //
@@ -108,6 +219,8 @@ type DNSSdSvcInfo struct {
 	Port     int            // TCP port
 	Txt      DNSSdTxtRecord // TXT record
 	Loopback bool           // Advertise only on loopback interface
+	Host     string         // If not "", per-device host name
+	HostAddr net.IP         // Address of Host, published as A record
 }
 
 // DNSSdServices represents a collection of DNS-SD services
@@ -118,16 +231,34 @@ func (services *DNSSdServices) Add(srv DNSSdSvcInfo) {
 	*services = append(*services, srv)
 }
 
+// Clone creates a copy of DNSSdServices, that can be modified
+// without affecting the original
+func (services DNSSdServices) Clone() DNSSdServices {
+	clone := make(DNSSdServices, len(services))
+	for i, svc := range services {
+		svc.SubTypes = append([]string(nil), svc.SubTypes...)
+		svc.Txt = append(DNSSdTxtRecord(nil), svc.Txt...)
+		svc.HostAddr = append(net.IP(nil), svc.HostAddr...)
+		clone[i] = svc
+	}
+
+	return clone
+}
+
 // DNSSdPublisher represents a DNS-SD service publisher
 // One publisher may publish multiple services unser the
 // same Service Instance Name
 type DNSSdPublisher struct {
-	Log      *Logger        // Device's logger
-	DevState *DevState      // Device persistent state
-	Services DNSSdServices  // Registered services
-	fin      chan struct{}  // Closed to terminate publisher goroutine
-	finDone  sync.WaitGroup // To wait for goroutine termination
-	sysdep   *dnssdSysdep   // System-dependent stuff
+	Log          *Logger            // Device's logger
+	DevState     *DevState          // Device persistent state
+	Services     DNSSdServices      // Registered services
+	Suffix       string             // Stable collision suffix, "" if none
+	LoopbackAddr net.IP             // Per-device loopback address, or nil
+	UUID         string             // UUID of the services group, "" if none
+	update       chan DNSSdServices // Services update requests
+	fin          chan struct{}      // Closed to terminate publisher goroutine
+	finDone      sync.WaitGroup     // To wait for goroutine termination
+	sysdep       *dnssdSysdep       // System-dependent stuff
 }
 
 // DNSSdStatus represents DNS-SD publisher status
@@ -145,6 +276,16 @@ const (
 	// other reason that listed before
 	DNSSdFailure
 
+	// DNSSdDisconnected indicates that connection to the
+	// system DNS-SD daemon is lost (i.e., daemon was restarted)
+	// and all published services are gone
+	DNSSdDisconnected
+
+	// DNSSdHostChanged indicates that host name was changed
+	// (i.e., as result of the host name collision), so services
+	// must be re-registered with the updated URLs in TXT records
+	DNSSdHostChanged
+
 	// DNSSdSuccess indicates successful status
 	DNSSdSuccess
 )
@@ -158,6 +299,10 @@ func (status DNSSdStatus) String() string {
 		return "DNSSdCollision"
 	case DNSSdFailure:
 		return "DNSSdFailure"
+	case DNSSdDisconnected:
+		return "DNSSdDisconnected"
+	case DNSSdHostChanged:
+		return "DNSSdHostChanged"
 	case DNSSdSuccess:
 		return "DNSSdSuccess"
 	}
@@ -177,6 +322,7 @@ func NewDNSSdPublisher(log *Logger,
 		Log:      log,
 		DevState: devstate,
 		Services: services,
+		update:   make(chan DNSSdServices),
 		fin:      make(chan struct{}),
 	}
 }
@@ -185,7 +331,7 @@ func NewDNSSdPublisher(log *Logger,
 func (publisher *DNSSdPublisher) Publish() error {
 	instance := publisher.instance(0)
 	publisher.sysdep = newDnssdSysdep(publisher.Log, instance,
-		publisher.Services)
+		publisher.export())
 
 	publisher.Log.Info('+', "DNS-SD: %s: publishing requested", instance)
 
@@ -205,13 +351,164 @@ func (publisher *DNSSdPublisher) Unpublish() {
 	publisher.Log.Info('-', "DNS-SD: %s: removed", publisher.instance(0))
 }
 
+// Update replaces published services with the new set. Services
+// are re-registered under the current instance name
+func (publisher *DNSSdPublisher) Update(services DNSSdServices) {
+	select {
+	case publisher.update <- services:
+	case <-publisher.fin:
+	}
+}
+
+// export returns services, as they are actually published
+//
+// All services of the group get the common UUID (see dnssdgroup.go)
+//
+// In the loopback-only mode, if device has a per-device loopback
+// address, services are moved to the per-device host name and the
+// HTTP port is replaced with the DevLoopbackPort
+func (publisher *DNSSdPublisher) export() DNSSdServices {
+	services := publisher.Services.Group(publisher.UUID)
+
+	addr := publisher.LoopbackAddr.To4()
+	if addr == nil || !Conf.LoopbackOnly {
+		return services
+	}
+
+	services = services.Clone()
+	host := fmt.Sprintf("ipp-usb-%d", addr[3])
+
+	for i := range services {
+		svc := &services[i]
+		svc.Host = host
+		svc.HostAddr = addr
+		if svc.Port == publisher.DevState.HTTPPort {
+			svc.Port = DevLoopbackPort
+		}
+	}
+
+	return services
+}
+
+// DNSSdURLHostParse parses the dns-sd-url-host configuration
+// parameter. "fqdn" (the default) is returned as ""
+func DNSSdURLHostParse(s string) (string, error) {
+	switch s {
+	case "fqdn":
+		return "", nil
+	case "ip":
+		return s, nil
+	}
+
+	if net.ParseIP(s) != nil {
+		return s, nil
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t/:@?#[]") {
+		return "", fmt.Errorf("%q: invalid host name", s)
+	}
+
+	return s, nil
+}
+
+// DNSSdURLHost returns host, placed into URL items of the
+// TXT records instead of the host part of URLs, returned by
+// device, according to the dns-sd-url-host configuration
+// parameter
+//
+// fqdn is the host's fully-qualified domain name, as reported by
+// the system DNS-SD daemon. It is also used as a fallback, if
+// IP address is requested, but cannot be obtained
+func DNSSdURLHost(fqdn string) string {
+	var ip net.IP
+
+	switch Conf.DNSSdURLHost {
+	case "":
+		return fqdn
+	case "ip":
+		ip = dnssdURLHostIP()
+		if ip == nil {
+			return fqdn
+		}
+	default:
+		ip = net.ParseIP(Conf.DNSSdURLHost)
+		if ip == nil {
+			return Conf.DNSSdURLHost
+		}
+	}
+
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+
+	return ip.String()
+}
+
+// dnssdURLHostIP returns IP address to be placed into URL items
+// of the TXT records. Address is taken from the configured LAN
+// interface or, if interface is not set, from the first suitable
+// interface. IPv4 addresses are preferred, link-local addresses
+// are never used. It returns nil, if there is no suitable address
+func dnssdURLHostIP() net.IP {
+	var ifaces []net.Interface
+
+	if Conf.Interface != "" {
+		ifi, err := net.InterfaceByName(Conf.Interface)
+		if err != nil {
+			return nil
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		var err error
+		ifaces, err = net.Interfaces()
+		if err != nil {
+			return nil
+		}
+	}
+
+	var ip6 net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() ||
+				ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			switch {
+			case ipnet.IP.To4() != nil:
+				return ipnet.IP
+			case ip6 == nil && Conf.IPV6Enable:
+				ip6 = ipnet.IP
+			}
+		}
+	}
+
+	return ip6
+}
+
 // Build service instance name with optional collision-resolution suffix
 func (publisher *DNSSdPublisher) instance(suffix int) string {
 	name := publisher.DevState.DNSSdName
 	strSuffix := ""
 
 	switch {
-	// This happens when we try to resolve name conflict
+	// This happens when we try to resolve name conflict. The
+	// first attempt uses stable suffix, if available, so the
+	// same device gets the same name regardless of the order
+	// devices are attached
+	case suffix == 1 && publisher.Suffix != "":
+		strSuffix = fmt.Sprintf(" (USB %s)", publisher.Suffix)
+
 	case suffix != 0:
 		strSuffix = fmt.Sprintf(" (USB %d)", suffix)
 
@@ -227,7 +524,12 @@ func (publisher *DNSSdPublisher) instance(suffix int) string {
 
 	const MaxDNSSDName = 63
 	if len(name)+len(strSuffix) > MaxDNSSDName {
-		name = name[:MaxDNSSDName-len(strSuffix)]
+		// Don't cut UTF-8 sequences in the middle
+		end := MaxDNSSDName - len(strSuffix)
+		for end > 0 && !utf8.RuneStart(name[end]) {
+			end--
+		}
+		name = name[:end]
 	}
 
 	return name + strSuffix
@@ -252,9 +554,13 @@ func (publisher *DNSSdPublisher) goroutine() {
 	var err error
 	var suffix int
 
+	// Retry delay grows on repeated failures and resets on success
+	retryDelay := DNSSdRetryInterval
+
 	instance := publisher.instance(0)
 	for {
 		fail := false
+		backoff := false
 
 		select {
 		case <-publisher.fin:
@@ -264,33 +570,72 @@ func (publisher *DNSSdPublisher) goroutine() {
 			switch status {
 			case DNSSdSuccess:
 				publisher.Log.Info(' ', "DNS-SD: %s: published", instance)
+				retryDelay = DNSSdRetryInterval
 				if instance != publisher.DevState.DNSSdOverride {
-					publisher.DevState.DNSSdOverride = instance
-					publisher.DevState.Save()
+					publisher.DevState.Update(func(state *DevState) {
+						state.DNSSdOverride = instance
+					})
 				}
 
 			case DNSSdCollision:
 				publisher.Log.Error(' ', "DNS-SD: %s: name collision",
 					instance)
+				publisher.Log.Error(' ', "DNS-SD: %s: publishing failed",
+					instance)
 				suffix++
-				fallthrough
+
+				fail = true
+				publisher.sysdep.Halt()
 
 			case DNSSdFailure:
 				publisher.Log.Error(' ', "DNS-SD: %s: publishing failed",
 					instance)
 
 				fail = true
+				backoff = true
 				publisher.sysdep.Halt()
 
+			case DNSSdDisconnected:
+				publisher.Log.Error(' ', "DNS-SD: %s: daemon disconnected, "+
+					"re-publishing", instance)
+
+				fail = true
+				publisher.sysdep.Halt()
+
+			case DNSSdHostChanged:
+				publisher.Log.Info(' ', "DNS-SD: %s: host name changed, "+
+					"re-publishing", instance)
+
+				publisher.sysdep.Halt()
+				publisher.sysdep = newDnssdSysdep(publisher.Log,
+					instance, publisher.export())
+
 			default:
 				publisher.Log.Error(' ', "DNS-SD: %s: unknown event %s",
 					instance, status)
 			}
 
+		case services := <-publisher.update:
+			publisher.Log.Info(' ', "DNS-SD: %s: updating services",
+				instance)
+
+			// Re-registration below cancels pending retry, if any
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			publisher.Services = services
+			publisher.sysdep.Halt()
+			publisher.sysdep = newDnssdSysdep(publisher.Log,
+				instance, publisher.export())
+
 		case <-timer.C:
 			instance = publisher.instance(suffix)
 			publisher.sysdep = newDnssdSysdep(publisher.Log,
-				instance, publisher.Services)
+				instance, publisher.export())
 
 			if err != nil {
 				publisher.Log.Error('!', "DNS-SD: %s: %s", instance, err)
@@ -299,7 +644,16 @@ func (publisher *DNSSdPublisher) goroutine() {
 		}
 
 		if fail {
-			timer.Reset(DNSSdRetryInterval)
+			publisher.Log.Debug(' ', "DNS-SD: %s: retry in %s",
+				instance, retryDelay)
+			timer.Reset(retryDelay)
+
+			if backoff {
+				retryDelay *= 2
+				if retryDelay > DNSSdRetryMaxInterval {
+					retryDelay = DNSSdRetryMaxInterval
+				}
+			}
 		}
 	}
 }
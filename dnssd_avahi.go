@@ -14,6 +14,7 @@ package main
 //
 // #include <stdlib.h>
 // #include <avahi-client/publish.h>
+// #include <avahi-common/address.h>
 // #include <avahi-common/error.h>
 // #include <avahi-common/thread-watch.h>
 // #include <avahi-common/watch.h>
@@ -26,6 +27,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"sync"
 	"unsafe"
@@ -43,8 +45,11 @@ type dnssdSysdep struct {
 	log        *Logger            // Device's logger
 	instance   string             // Service Instance Name
 	fqdn       string             // Host's fully-qualified domain name
+	urlHost    string             // Host for URL items of TXT records
 	client     *C.AvahiClient     // Avahi client
 	egroup     *C.AvahiEntryGroup // Avahi entry group
+	running    bool               // Client was connected to the daemon
+	hostReset  bool               // Host name is being re-registered
 	statusChan chan DNSSdStatus   // Status notifications channel
 }
 
@@ -67,6 +72,8 @@ func newDnssdSysdep(log *Logger, instance string,
 	var poll *C.AvahiPoll
 	var rc C.int
 	var proto, iface int
+	var domain string
+	hosts := make(map[string]bool)
 
 	sysdep := &dnssdSysdep{
 		log:        log,
@@ -108,6 +115,8 @@ func newDnssdSysdep(log *Logger, instance string,
 	sysdep.fqdn = C.GoString(C.avahi_client_get_host_name_fqdn(sysdep.client))
 	sysdep.log.Debug(' ', "DNS-SD: FQDN: %q", sysdep.fqdn)
 
+	domain = C.GoString(C.avahi_client_get_domain_name(sysdep.client))
+
 	// Create entry group
 	sysdep.egroup = C.avahi_entry_group_new(
 		sysdep.client,
@@ -122,13 +131,30 @@ func newDnssdSysdep(log *Logger, instance string,
 
 	avahiEgroupMap[sysdep.egroup] = sysdep
 
-	// Compute iface and proto, adjust fqdn
+	// Compute iface and proto, choose host for URLs
 	iface = C.AVAHI_IF_UNSPEC
-	if Conf.LoopbackOnly {
+	sysdep.urlHost = DNSSdURLHost(sysdep.fqdn)
+
+	switch {
+	case Conf.LoopbackOnly:
 		iface = loopback
-		old := sysdep.fqdn
-		sysdep.fqdn = "localhost"
-		sysdep.log.Debug(' ', "DNS-SD: FQDN: %q->%q", old, sysdep.fqdn)
+		sysdep.urlHost = "localhost"
+
+	case Conf.Interface != "":
+		var ifi *net.Interface
+		ifi, err = net.InterfaceByName(Conf.Interface)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", Conf.Interface, err)
+			goto ERROR
+		}
+
+		iface = ifi.Index
+		sysdep.log.Debug(' ', "DNS-SD: interface: %s (%d)",
+			ifi.Name, ifi.Index)
+	}
+
+	if sysdep.urlHost != sysdep.fqdn {
+		sysdep.log.Debug(' ', "DNS-SD: URL host: %q", sysdep.urlHost)
 	}
 
 	proto = C.AVAHI_PROTO_UNSPEC
@@ -138,10 +164,29 @@ func newDnssdSysdep(log *Logger, instance string,
 
 	// Populate entry group
 	for _, svc := range services {
+		// Publish per-device host name, if any
+		urlHost := sysdep.urlHost
+		var cHost *C.char
+		if svc.Host != "" {
+			host := svc.Host + "." + domain
+			if !hosts[host] {
+				rc = sysdep.avahiAddAddress(loopback, proto,
+					host, svc.HostAddr)
+				if rc != C.AVAHI_OK {
+					goto AVAHI_ERROR
+				}
+				hosts[host] = true
+			}
+
+			urlHost = svc.HostAddr.String()
+			cHost = C.CString(host)
+		}
+
 		// Prepare TXT record
 		var cTxt *C.AvahiStringList
-		cTxt, err = sysdep.avahiTxtRecord(svc.Port, svc.Txt)
+		cTxt, err = sysdep.avahiTxtRecord(urlHost, svc.Port, svc.Txt)
 		if err != nil {
+			C.free(unsafe.Pointer(cHost))
 			goto ERROR
 		}
 
@@ -170,7 +215,7 @@ func newDnssdSysdep(log *Logger, instance string,
 			cInstance,
 			cSvcType,
 			nil, // Domain
-			nil, // Host
+			cHost,
 			C.uint16_t(svc.Port),
 			cTxt,
 		)
@@ -201,6 +246,7 @@ func newDnssdSysdep(log *Logger, instance string,
 		// Release C memory
 		C.free(unsafe.Pointer(cInstance))
 		C.free(unsafe.Pointer(cSvcType))
+		C.free(unsafe.Pointer(cHost))
 		C.avahi_string_list_free(cTxt)
 
 		// Check for Avahi error
@@ -276,14 +322,69 @@ func (sysdep *dnssdSysdep) haltLocked() {
 	}
 }
 
+// disconnected tells if client has lost connection to the
+// avahi-daemon (i.e., daemon was restarted)
+//
+// Must be called under avahiThreadLock
+func (sysdep *dnssdSysdep) disconnected() bool {
+	if !sysdep.running || sysdep.client == nil {
+		return false
+	}
+
+	switch C.avahi_client_get_state(sysdep.client) {
+	case C.AVAHI_CLIENT_CONNECTING:
+		return true
+	case C.AVAHI_CLIENT_FAILURE:
+		return C.avahi_client_errno(sysdep.client) ==
+			C.AVAHI_ERR_DISCONNECTED
+	}
+
+	return false
+}
+
 // Push status change notification
 func (sysdep *dnssdSysdep) notify(status DNSSdStatus) {
 	sysdep.statusChan <- status
 }
 
+// avahiAddAddress publishes A record for the per-device host name
+//
+// As IPv6 has only one loopback address, only IPv4 addresses are
+// expected here, and reverse (PTR) records are not published, as
+// they would collide with the host's own records
+//
+// Must be called under avahiThreadLock
+func (sysdep *dnssdSysdep) avahiAddAddress(iface, proto int,
+	host string, addr net.IP) C.int {
+
+	sysdep.log.Debug(' ', "DNS-SD: +host: %q -> %s", host, addr)
+
+	var avahiAddr C.AvahiAddress
+	cAddr := C.CString(addr.String())
+	defer C.free(unsafe.Pointer(cAddr))
+
+	if C.avahi_address_parse(cAddr, C.AVAHI_PROTO_INET, &avahiAddr) == nil {
+		return C.AVAHI_ERR_INVALID_ADDRESS
+	}
+
+	cHost := C.CString(host)
+	defer C.free(unsafe.Pointer(cHost))
+
+	return C.avahi_entry_group_add_address(
+		sysdep.egroup,
+		C.AvahiIfIndex(iface),
+		C.AvahiProtocol(proto),
+		C.AVAHI_PUBLISH_NO_REVERSE,
+		cHost,
+		&avahiAddr,
+	)
+}
+
 // avahiTxtRecord converts DNSSdTxtRecord to AvahiStringList
-func (sysdep *dnssdSysdep) avahiTxtRecord(port int, txt DNSSdTxtRecord) (
-	*C.AvahiStringList, error) {
+//
+// Host part of URL items is replaced with the host, if not empty
+func (sysdep *dnssdSysdep) avahiTxtRecord(host string, port int,
+	txt DNSSdTxtRecord) (*C.AvahiStringList, error) {
 	var buf bytes.Buffer
 	var list, prev *C.AvahiStringList
 
@@ -292,12 +393,12 @@ func (sysdep *dnssdSysdep) avahiTxtRecord(port int, txt DNSSdTxtRecord) (
 		buf.WriteString(t.Key)
 		buf.WriteByte('=')
 
-		if !t.URL || sysdep.fqdn == "" {
+		if !t.URL || host == "" {
 			buf.WriteString(t.Value)
 		} else {
 			value := t.Value
 			if parsed, err := url.Parse(value); err == nil && parsed.IsAbs() {
-				parsed.Host = sysdep.fqdn
+				parsed.Host = host
 				if port != 0 {
 					parsed.Host += fmt.Sprintf(":%d", port)
 				}
@@ -341,9 +442,23 @@ func avahiClientCallback(client *C.AvahiClient,
 
 	switch state {
 	case C.AVAHI_CLIENT_S_REGISTERING:
+		// Daemon re-registers host name (i.e., host name
+		// was changed). Our entry groups are reset, so
+		// services must be re-registered, when daemon
+		// returns into the running state
 		event = "AVAHI_CLIENT_S_REGISTERING"
+		sysdep.hostReset = true
 	case C.AVAHI_CLIENT_S_RUNNING:
 		event = "AVAHI_CLIENT_S_RUNNING"
+		sysdep.running = true
+		if sysdep.hostReset {
+			sysdep.hostReset = false
+			fqdn := C.GoString(
+				C.avahi_client_get_host_name_fqdn(client))
+			sysdep.log.Debug(' ', "DNS-SD: FQDN: %q->%q",
+				sysdep.fqdn, fqdn)
+			status = DNSSdHostChanged
+		}
 	case C.AVAHI_CLIENT_S_COLLISION:
 		// This is host name collision. We can't recover
 		// it here, so lets consider it as DNSSdFailure
@@ -352,8 +467,17 @@ func avahiClientCallback(client *C.AvahiClient,
 	case C.AVAHI_CLIENT_FAILURE:
 		event = "AVAHI_CLIENT_FAILURE"
 		status = DNSSdFailure
+		if sysdep.disconnected() {
+			status = DNSSdDisconnected
+		}
 	case C.AVAHI_CLIENT_CONNECTING:
+		// With AVAHI_CLIENT_NO_FAIL, client enters this state
+		// when avahi-daemon disconnects. All our entry groups
+		// are gone, so services need to be re-registered
 		event = "AVAHI_CLIENT_CONNECTING"
+		if sysdep.running {
+			status = DNSSdDisconnected
+		}
 	default:
 		event = fmt.Sprintf("Unknown event %d", state)
 	}
@@ -393,6 +517,9 @@ func avahiEntryGroupCallback(egroup *C.AvahiEntryGroup,
 	case C.AVAHI_ENTRY_GROUP_FAILURE:
 		event = "AVAHI_ENTRY_GROUP_FAILURE"
 		status = DNSSdFailure
+		if sysdep.disconnected() {
+			status = DNSSdDisconnected
+		}
 	}
 
 	sysdep.log.Debug(' ', "DNS-SD: %s: %s", sysdep.instance, event)
@@ -0,0 +1,286 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for DNS-SD publisher: system-independent stuff
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestDNSSdFaxTxtUpdate tests updating of Fax and rfo TXT items
+func TestDNSSdFaxTxtUpdate(t *testing.T) {
+	services := DNSSdServices{
+		{Type: "_printer._tcp"},
+		{Type: "_ipp._tcp"},
+	}
+
+	services[1].Txt.Add("ty", "Test Printer")
+	ippSetFaxTxt(&services[1].Txt, true)
+
+	expected := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"Fax", "T", false},
+		{"rfo", "ipp/faxout", false},
+	}
+
+	if !reflect.DeepEqual(services[1].Txt, expected) {
+		t.Fatalf("initial TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, services[1].Txt)
+	}
+
+	// Withdraw fax in the clone. Original must not be affected
+	clone := services.Clone()
+	ippSetFaxTxt(&clone[1].Txt, false)
+
+	if !reflect.DeepEqual(services[1].Txt, expected) {
+		t.Errorf("original TXT modified: %v", services[1].Txt)
+	}
+
+	withdrawn := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"Fax", "F", false},
+	}
+
+	if !reflect.DeepEqual(clone[1].Txt, withdrawn) {
+		t.Errorf("withdrawn TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", withdrawn, clone[1].Txt)
+	}
+
+	// And re-add it back
+	ippSetFaxTxt(&clone[1].Txt, true)
+	if !reflect.DeepEqual(clone[1].Txt, expected) {
+		t.Errorf("restored TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, clone[1].Txt)
+	}
+}
+
+// TestDNSSdTxtGenerate tests the TXT generators registry
+func TestDNSSdTxtGenerate(t *testing.T) {
+	const svcType = "_test._tcp"
+	defer delete(dnssdTxtGenerators, svcType)
+
+	DNSSdTxtGeneratorRegister(svcType,
+		func(txt *DNSSdTxtRecord, src *DNSSdTxtSource) {
+			txt.Add("ty", src.UsbInfo.ProductName)
+		})
+	DNSSdTxtGeneratorRegister(svcType,
+		func(txt *DNSSdTxtRecord, src *DNSSdTxtSource) {
+			txt.Add("txtvers", "1")
+		})
+
+	txt := DNSSdTxtGenerate(svcType, &DNSSdTxtSource{
+		UsbInfo: UsbDeviceInfo{ProductName: "Test Printer"},
+	})
+
+	expected := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"txtvers", "1", false},
+	}
+
+	if !reflect.DeepEqual(txt, expected) {
+		t.Errorf("TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, txt)
+	}
+
+	// Builtin generators must be registered
+	for _, svcType := range []string{"_ipp._tcp", "_uscan._tcp"} {
+		if len(dnssdTxtGenerators[svcType]) == 0 {
+			t.Errorf("%s: TXT generator not registered", svcType)
+		}
+	}
+}
+
+// TestDNSSdTxtReplace tests in-place update of TXT record items,
+// generated from printer attributes
+func TestDNSSdTxtReplace(t *testing.T) {
+	prev := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"note", "Office", false},
+		{"Duplex", "T", false},
+		{"adminurl", "http://localhost/", true},
+	}
+
+	next := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"note", "Room 101", false},
+		{"adminurl", "http://localhost/", true},
+		{"Color", "T", false},
+	}
+
+	txt := append(DNSSdTxtRecord(nil), prev...)
+	txt.Add("Scan", "T")
+	txt.Add("usb_SER", "12345")
+
+	if prev.Equal(next) || !prev.Equal(prev) {
+		t.Errorf("DNSSdTxtRecord.Equal is broken")
+	}
+
+	txt.Replace(prev, next)
+
+	expected := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"note", "Room 101", false},
+		{"adminurl", "http://localhost/", true},
+		{"Scan", "T", false},
+		{"usb_SER", "12345", false},
+		{"Color", "T", false},
+	}
+
+	if !reflect.DeepEqual(txt, expected) {
+		t.Errorf("TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, txt)
+	}
+}
+
+// TestDNSSdTxtOverride tests overriding of TXT record items
+// by the txt-* quirks
+func TestDNSSdTxtOverride(t *testing.T) {
+	overrides := map[string]string{
+		"color":    "T",
+		"URF":      "",
+		"Duplex":   "F",
+		"PaperMax": "legal-A4",
+		"missed":   "",
+	}
+
+	orig := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"URF", "W8,SRGB24", false},
+		{"Color", "F", false},
+		{"Duplex", "T", false},
+	}
+
+	// Adding of missed items is enabled
+	txt := append(DNSSdTxtRecord(nil), orig...)
+	txt.Override(overrides, true)
+
+	expected := DNSSdTxtRecord{
+		{"ty", "Test Printer", false},
+		{"Color", "T", false},
+		{"Duplex", "F", false},
+		{"PaperMax", "legal-A4", false},
+	}
+
+	if !reflect.DeepEqual(txt, expected) {
+		t.Errorf("add=true: TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, txt)
+	}
+
+	// Adding of missed items is disabled
+	txt = append(DNSSdTxtRecord(nil), orig...)
+	txt.Override(overrides, false)
+
+	expected = expected[:3]
+	if !reflect.DeepEqual(txt, expected) {
+		t.Errorf("add=false: TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, txt)
+	}
+}
+
+// TestDNSSdExportLoopbackAddr tests moving services to the
+// per-device loopback address
+func TestDNSSdExportLoopbackAddr(t *testing.T) {
+	saveConf := Conf
+	defer func() { Conf = saveConf }()
+
+	services := DNSSdServices{
+		{Type: "_ipp._tcp", Port: 60000},
+		{Type: "_ipps._tcp", Port: 60001},
+	}
+
+	publisher := NewDNSSdPublisher(nil,
+		&DevState{HTTPPort: 60000}, services)
+
+	// Without address, services are exported as is
+	Conf.LoopbackOnly = true
+	if exported := publisher.export(); !reflect.DeepEqual(exported, services) {
+		t.Errorf("services modified without address: %+v", exported)
+	}
+
+	// With address, services are moved to the per-device host
+	publisher.LoopbackAddr = devStateLoopbackAddr(5)
+	exported := publisher.export()
+
+	for _, svc := range exported {
+		if svc.Host != "ipp-usb-5" || !svc.HostAddr.Equal(publisher.LoopbackAddr) {
+			t.Errorf("%s: host mismatch: %q %s", svc.Type, svc.Host, svc.HostAddr)
+		}
+	}
+
+	if exported[0].Port != DevLoopbackPort || exported[1].Port != 60001 {
+		t.Errorf("ports mismatch: %d %d", exported[0].Port, exported[1].Port)
+	}
+
+	if services[0].Port != 60000 || services[0].Host != "" {
+		t.Errorf("original services modified: %+v", services[0])
+	}
+
+	// When exported to LAN, address is not advertised
+	Conf.LoopbackOnly = false
+	if exported := publisher.export(); !reflect.DeepEqual(exported, services) {
+		t.Errorf("services modified in LAN mode: %+v", exported)
+	}
+}
+
+// TestDNSSdURLHost tests selection of host for URL items of TXT records
+func TestDNSSdURLHost(t *testing.T) {
+	saveConf := Conf
+	defer func() { Conf = saveConf }()
+
+	type testData struct {
+		param  string // dns-sd-url-host value
+		host   string // Expected host, "" if error expected
+		parsed string // Expected parsed value
+	}
+
+	tests := []testData{
+		{"fqdn", "printserver.local", ""},
+		{"printserver.example.com", "printserver.example.com",
+			"printserver.example.com"},
+		{"192.168.1.5", "192.168.1.5", "192.168.1.5"},
+		{"fd00::5", "[fd00::5]", "fd00::5"},
+		{"host:631", "", ""},
+		{"http://host/", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		parsed, err := DNSSdURLHostParse(test.param)
+		if test.host == "" {
+			if err == nil {
+				t.Errorf("%q: error expected", test.param)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %s", test.param, err)
+			continue
+		}
+
+		if parsed != test.parsed {
+			t.Errorf("%q: parsed: expected %q, present %q",
+				test.param, test.parsed, parsed)
+		}
+
+		Conf.DNSSdURLHost = parsed
+		host := DNSSdURLHost("printserver.local")
+		if host != test.host {
+			t.Errorf("%q: host: expected %q, present %q",
+				test.param, test.host, host)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD naming coordinator
+ *
+ * All DNS-SD services of the same physical device (_ipp._tcp,
+ * _uscan._tcp, their TLS variants and so on) make a group. Services
+ * of the group must be advertised under the identical instance name
+ * and carry the identical UUID, otherwise some clients fail to
+ * recognize them as the single device.
+ *
+ * Instance name is managed by the DNSSdPublisher: all services of
+ * the group are registered at once, under the common name, so
+ * name collision of any service renames the whole group. UUID is
+ * managed here: IPP and eSCL report UUIDs independently, and some
+ * devices report different UUIDs for printer and scanner, so the
+ * single UUID is chosen for the group and forced to all services.
+ *
+ * Services with explicit Instance (i.e., _ipp-usb._tcp) are not
+ * members of the group
+ */
+
+package main
+
+// dnssdGroupUUIDKey is the TXT key of the device UUID
+const dnssdGroupUUIDKey = "UUID"
+
+// GroupUUID returns UUID of the group: UUID of the first member
+// of the group that has UUID in its TXT record, or fallback, if
+// there is no such service. As IPP services are added first,
+// printer-uuid is preferred
+func (services DNSSdServices) GroupUUID(fallback string) string {
+	for _, svc := range services {
+		if svc.Instance != "" {
+			continue
+		}
+
+		for _, item := range svc.Txt {
+			if item.Key == dnssdGroupUUIDKey && item.Value != "" {
+				return item.Value
+			}
+		}
+	}
+
+	return fallback
+}
+
+// Group returns services with UUID of all members of the group,
+// that carry UUID in their TXT records, replaced with uuid. If
+// nothing needs to be changed, services are returned as is,
+// otherwise the modified copy is returned
+func (services DNSSdServices) Group(uuid string) DNSSdServices {
+	if uuid == "" || !services.groupNeedsUUID(uuid) {
+		return services
+	}
+
+	services = services.Clone()
+	for i := range services {
+		svc := &services[i]
+		if svc.Instance != "" {
+			continue
+		}
+
+		for j := range svc.Txt {
+			if svc.Txt[j].Key == dnssdGroupUUIDKey {
+				svc.Txt[j].Value = uuid
+			}
+		}
+	}
+
+	return services
+}
+
+// groupNeedsUUID tells if some member of the group carries
+// UUID, different from uuid
+func (services DNSSdServices) groupNeedsUUID(uuid string) bool {
+	for _, svc := range services {
+		if svc.Instance != "" {
+			continue
+		}
+
+		for _, item := range svc.Txt {
+			if item.Key == dnssdGroupUUIDKey && item.Value != uuid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
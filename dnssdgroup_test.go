@@ -0,0 +1,88 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for DNS-SD naming coordinator
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestDNSSdGroup tests forcing of the common UUID to all
+// services of the group
+func TestDNSSdGroup(t *testing.T) {
+	const uuidIpp = "12345678-1234-5678-1234-567812345678"
+	const uuidEscl = "87654321-4321-8765-4321-876543218765"
+	const uuidUsb = "00000000-0000-5000-8000-000000000000"
+
+	mktxt := func(uuid string) DNSSdTxtRecord {
+		txt := DNSSdTxtRecord{}
+		txt.Add("txtvers", "1")
+		txt.Add("UUID", uuid)
+		return txt
+	}
+
+	services := DNSSdServices{
+		{Type: "_ipp._tcp", Txt: mktxt(uuidIpp)},
+		{Type: "_uscan._tcp", Txt: mktxt(uuidEscl)},
+		{Type: "_ipps._tcp", Txt: mktxt(uuidIpp)},
+		{Type: "_uscans._tcp", Txt: mktxt(uuidEscl)},
+		{Type: "_http._tcp"},
+		{Type: "_ipp-usb._tcp", Instance: "0102", Txt: mktxt(uuidUsb)},
+	}
+
+	// IPP UUID is preferred
+	uuid := services.GroupUUID(uuidUsb)
+	if uuid != uuidIpp {
+		t.Errorf("GroupUUID: expected %s, present %s", uuidIpp, uuid)
+	}
+
+	// Without UUIDs, fallback is used
+	if uuid := services[4:5].GroupUUID(uuidUsb); uuid != uuidUsb {
+		t.Errorf("GroupUUID: expected %s, present %s", uuidUsb, uuid)
+	}
+
+	// All members of the group get the same UUID
+	grouped := services.Group(uuid)
+	for _, svc := range grouped {
+		for _, item := range svc.Txt {
+			if item.Key != "UUID" {
+				continue
+			}
+
+			expected := uuidIpp
+			if svc.Instance != "" {
+				expected = uuidUsb
+			}
+
+			if item.Value != expected {
+				t.Errorf("%s: UUID expected %s, present %s",
+					svc.Type, expected, item.Value)
+			}
+		}
+	}
+
+	if len(grouped[4].Txt) != 0 {
+		t.Errorf("%s: UUID must not be added", grouped[4].Type)
+	}
+
+	// Original services must not be affected
+	if services[1].Txt[1].Value != uuidEscl {
+		t.Errorf("original services modified")
+	}
+
+	// Publisher exports grouped services
+	publisher := NewDNSSdPublisher(nil, &DevState{}, services)
+	publisher.UUID = uuidIpp
+
+	for _, svc := range publisher.export()[:4] {
+		if svc.Txt[1].Value != uuidIpp {
+			t.Errorf("export: %s: UUID expected %s, present %s",
+				svc.Type, uuidIpp, svc.Txt[1].Value)
+		}
+	}
+}
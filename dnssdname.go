@@ -0,0 +1,143 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD instance name template
+ *
+ * By default, device is advertised under the name it reports by itself
+ * (printer-dns-sd-name and fallbacks, see ippAttrs.decode). Fleets may
+ * prefer a uniform naming scheme, configured by the dns-sd-name-template
+ * option, i.e., "{make} {model} ({location})"
+ *
+ * Placeholders are resolved from IPP printer attributes, if available,
+ * with fallback to the USB device info. Placeholders, resolved to empty
+ * strings, don't leave empty brackets and duplicate spaces behind
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DNSSdNameTmpl represents a parsed DNS-SD name template
+type DNSSdNameTmpl []dnssdNameChunk
+
+// dnssdNameChunk is either literal text or placeholder
+type dnssdNameChunk struct {
+	text string // Literal text
+	name string // Placeholder name, "" for text
+}
+
+// dnssdNamePlaceholders lists known placeholders with description
+var dnssdNamePlaceholders = map[string]string{
+	"name":     "name, reported by device",
+	"make":     "manufacturer",
+	"model":    "model name",
+	"location": "printer-location",
+	"info":     "printer-info",
+	"serial":   "USB serial number",
+	"port":     "USB port path",
+}
+
+// DNSSdNameTmplParse parses the DNS-SD name template.
+// Empty string yields nil template
+func DNSSdNameTmplParse(s string) (DNSSdNameTmpl, error) {
+	var tmpl DNSSdNameTmpl
+
+	for s != "" {
+		beg := strings.IndexByte(s, '{')
+		if beg < 0 {
+			tmpl = append(tmpl, dnssdNameChunk{text: s})
+			break
+		}
+
+		if beg > 0 {
+			tmpl = append(tmpl, dnssdNameChunk{text: s[:beg]})
+		}
+
+		end := strings.IndexByte(s[beg:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missed '}' after %q", s[beg:])
+		}
+
+		name := strings.ToLower(strings.TrimSpace(s[beg+1 : beg+end]))
+		if _, ok := dnssdNamePlaceholders[name]; !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s}, "+
+				"must be one of: %s", name, dnssdNameKnown())
+		}
+
+		tmpl = append(tmpl, dnssdNameChunk{name: name})
+		s = s[beg+end+1:]
+	}
+
+	return tmpl, nil
+}
+
+// dnssdNameKnown returns comma-separated list of known placeholders
+func dnssdNameKnown() string {
+	names := make([]string, 0, len(dnssdNamePlaceholders))
+	for name := range dnssdNamePlaceholders {
+		names = append(names, "{"+name+"}")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// DNSSdNameVars returns values of the template placeholders for
+// the device. ippinfo may be nil, if device doesn't support IPP
+func DNSSdNameVars(usbinfo UsbDeviceInfo,
+	ippinfo *IppPrinterInfo) map[string]string {
+
+	vars := map[string]string{
+		"name":   usbinfo.DNSSdName(),
+		"make":   usbinfo.Manufacturer,
+		"model":  usbinfo.ProductName,
+		"serial": usbinfo.SerialNumber,
+		"port":   usbinfo.PortPath,
+	}
+
+	if ippinfo != nil {
+		vars["name"] = ippinfo.DNSSdName
+		vars["location"] = ippinfo.Location
+		vars["info"] = ippinfo.Info
+		if ippinfo.Make != "" {
+			vars["make"] = ippinfo.Make
+		}
+		if ippinfo.Model != "" {
+			vars["model"] = ippinfo.Model
+		}
+	}
+
+	return vars
+}
+
+// Expand expands the template. Placeholders, resolved to empty strings,
+// are removed together with surrounding empty brackets, and whitespace
+// is normalized. If the result is empty, the "name" placeholder value
+// is returned instead
+func (tmpl DNSSdNameTmpl) Expand(vars map[string]string) string {
+	buf := strings.Builder{}
+	for _, chunk := range tmpl {
+		if chunk.name == "" {
+			buf.WriteString(chunk.text)
+		} else {
+			buf.WriteString(strings.TrimSpace(vars[chunk.name]))
+		}
+	}
+
+	s := buf.String()
+	for _, empty := range []string{"()", "[]", "<>"} {
+		s = strings.Replace(s, empty, "", -1)
+	}
+
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		s = vars["name"]
+	}
+
+	return s
+}
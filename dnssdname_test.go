@@ -0,0 +1,83 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for DNS-SD instance name template
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestDNSSdNameTmplParse tests DNSSdNameTmplParse
+func TestDNSSdNameTmplParse(t *testing.T) {
+	tests := []struct {
+		in  string
+		err bool
+	}{
+		{"{make} {model} ({location})", false},
+		{"Office {MODEL}", false},
+		{"", false},
+		{"{make} {color}", true},
+		{"{make", true},
+	}
+
+	for _, test := range tests {
+		_, err := DNSSdNameTmplParse(test.in)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error not detected", test.in)
+		case !test.err && err != nil:
+			t.Errorf("%q: %s", test.in, err)
+		}
+	}
+}
+
+// TestDNSSdNameTmplExpand tests DNSSdNameTmpl.Expand
+func TestDNSSdNameTmplExpand(t *testing.T) {
+	usbinfo := UsbDeviceInfo{
+		Manufacturer:  "HP",
+		ProductName:   "OfficeJet Pro 8730",
+		MfgAndProduct: "HP OfficeJet Pro 8730",
+		SerialNumber:  "TH12345",
+	}
+
+	ippinfo := &IppPrinterInfo{
+		DNSSdName: "HP OfficeJet Pro 8730 [A1B2C3]",
+		Make:      "HP",
+		Model:     "OfficeJet Pro 8730",
+		Location:  "Büro 3",
+	}
+
+	tests := []struct {
+		tmpl     string
+		ippinfo  *IppPrinterInfo
+		expected string
+	}{
+		{"{make} {model} ({location})", ippinfo,
+			"HP OfficeJet Pro 8730 (Büro 3)"},
+		{"{make} {model} ({location})", nil,
+			"HP OfficeJet Pro 8730"},
+		{"{name} [{serial}]", nil,
+			"HP OfficeJet Pro 8730 [TH12345]"},
+		{"({location})", nil,
+			"HP OfficeJet Pro 8730"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := DNSSdNameTmplParse(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: %s", test.tmpl, err)
+			continue
+		}
+
+		name := tmpl.Expand(DNSSdNameVars(usbinfo, test.ippinfo))
+		if name != test.expected {
+			t.Errorf("%q: expected %q, present %q",
+				test.tmpl, test.expected, name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD TXT record generators
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DNSSdTxtSource contains device information, collected during
+// device initialization, from which TXT records are generated
+//
+// Each service type uses only part of this information; fields,
+// not available for the particular service, are left empty
+type DNSSdTxtSource struct {
+	UsbInfo  UsbDeviceInfo    // USB device info
+	IppAttrs ippAttrs         // IPP printer attributes
+	IppInfo  *IppPrinterInfo  // Decoded IPP printer info
+	Escl     *esclCapsDecoder // Decoded eSCL scanner capabilities
+	Quirks   Quirks           // Device quirks
+}
+
+// DNSSdTxtGenerator adds TXT record items for the particular
+// service type
+type DNSSdTxtGenerator func(txt *DNSSdTxtRecord, src *DNSSdTxtSource)
+
+// dnssdTxtGenerators contains registered TXT generators,
+// indexed by service type
+var (
+	dnssdTxtGenerators     = make(map[string][]DNSSdTxtGenerator)
+	dnssdTxtGeneratorsLock sync.Mutex
+)
+
+// DNSSdTxtGeneratorRegister registers TXT generator for the service
+// type (i.e., "_ipp._tcp").
+//
+// Multiple generators may be registered for the same service type;
+// they are called in the registration order, so the items they
+// generate appear in the TXT record in that order
+func DNSSdTxtGeneratorRegister(svcType string, gen DNSSdTxtGenerator) {
+	dnssdTxtGeneratorsLock.Lock()
+	dnssdTxtGenerators[svcType] = append(dnssdTxtGenerators[svcType], gen)
+	dnssdTxtGeneratorsLock.Unlock()
+}
+
+// DNSSdTxtGenerate generates TXT record for the service type,
+// using all the generators, registered for this type
+//
+// Then txt-* quirks are applied. They replace or remove items
+// of any service, but add missed items only to the IPP service
+//
+// It panics, if no generators are registered for the service type,
+// as it is always a programming error
+func DNSSdTxtGenerate(svcType string, src *DNSSdTxtSource) DNSSdTxtRecord {
+	dnssdTxtGeneratorsLock.Lock()
+	generators := dnssdTxtGenerators[svcType]
+	dnssdTxtGeneratorsLock.Unlock()
+
+	if len(generators) == 0 {
+		panic(fmt.Sprintf("DNS-SD: no TXT generators for %q", svcType))
+	}
+
+	var txt DNSSdTxtRecord
+	for _, gen := range generators {
+		gen(&txt, src)
+	}
+
+	txt.Override(src.Quirks.DNSSdTxt, svcType == "_ipp._tcp")
+
+	return txt
+}
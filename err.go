@@ -23,4 +23,7 @@ var (
 	ErrNoIppUsb     = errors.New("ipp-usb daemon not running")
 	ErrAccess       = errors.New("Access denied")
 	ErrPartialInit  = errors.New("Some parts of device not ready yet")
+	ErrPaused       = errors.New("Device paused by administrator")
+	ErrNotRunning   = errors.New("Device is not running")
+	ErrClaimed      = errors.New("Device is used by another ipp-usb instance")
 )
@@ -13,7 +13,6 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -27,7 +26,7 @@ import (
 // Discovered services will be added to the services collection
 func EsclService(log *LogMessage, services *DNSSdServices,
 	port int, usbinfo UsbDeviceInfo, ippinfo *IppPrinterInfo,
-	c *http.Client) (httpstatus int, err error) {
+	quirks Quirks, c *http.Client) (httpstatus int, err error) {
 
 	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities", port)
 
@@ -38,7 +37,7 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	}
 
 	var xmlData []byte
-	var list []string
+	var src *DNSSdTxtSource
 
 	// Query ScannerCapabilities
 	resp, err := c.Get(uri)
@@ -64,6 +63,12 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	log.Nl(LogTraceESCL)
 	log.Flush()
 
+	// Repair malformed XML, if enabled by quirk
+	if quirks.GetBuggyEsclRsp() == QuirkBuggyEsclRspSanitize &&
+		esclCheckXML(xmlData) != nil {
+		xmlData = esclSanitizeXML(xmlData)
+	}
+
 	// Decode the XML
 	err = decoder.decode(bytes.NewBuffer(xmlData))
 	if err != nil {
@@ -92,92 +97,113 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	}
 
 	// Build eSCL DNSSdInfo
+	src = &DNSSdTxtSource{
+		UsbInfo: usbinfo,
+		IppInfo: ippinfo,
+		Escl:    decoder,
+		Quirks:  quirks,
+	}
+
+	svc.Txt = DNSSdTxtGenerate(svc.Type, src)
+
+	// Add to services
+	services.Add(svc)
+
+	// Add legacy scanner announcement, if enabled
+	if Conf.DNSSdScanner {
+		services.Add(SaneService(port, src))
+	}
+
+	return
+
+	// Handle a error
+ERROR:
+	err = fmt.Errorf("eSCL: %s", err)
+	return
+}
+
+// init registers TXT generator for the eSCL service
+func init() {
+	DNSSdTxtGeneratorRegister("_uscan._tcp", esclTxtGenerate)
+}
+
+// esclTxtGenerate generates TXT record items for the eSCL service
+func esclTxtGenerate(txt *DNSSdTxtRecord, src *DNSSdTxtSource) {
+	decoder := src.Escl
+	usbinfo := src.UsbInfo
+
 	if decoder.duplex {
-		svc.Txt.Add("duplex", "T")
+		txt.Add("duplex", "T")
 	} else {
-		svc.Txt.Add("duplex", "F")
+		txt.Add("duplex", "F")
 	}
 
 	switch {
 	case decoder.platen && !decoder.adf:
-		svc.Txt.Add("is", "platen")
+		txt.Add("is", "platen")
 	case !decoder.platen && decoder.adf:
-		svc.Txt.Add("is", "adf")
+		txt.Add("is", "adf")
 	case decoder.platen && decoder.adf:
-		svc.Txt.Add("is", "platen,adf")
+		txt.Add("is", "platen,adf")
 	}
 
-	list = []string{}
+	list := []string{}
 	for c := range decoder.cs {
 		list = append(list, c)
 	}
 	sort.Strings(list)
-	svc.Txt.IfNotEmpty("cs", strings.Join(list, ","))
+	txt.IfNotEmpty("cs", strings.Join(list, ","))
 
-	svc.Txt.IfNotEmpty("UUID", decoder.uuid)
-	svc.Txt.URLIfNotEmpty("adminurl", decoder.adminurl)
-	svc.Txt.URLIfNotEmpty("representation", decoder.representation)
+	txt.IfNotEmpty("UUID", decoder.uuid)
+	txt.URLIfNotEmpty("adminurl", decoder.adminurl)
+	txt.URLIfNotEmpty("representation", decoder.representation)
 
 	list = []string{}
 	for p := range decoder.pdl {
 		list = append(list, p)
 	}
 	sort.Strings(list)
-	svc.Txt.AddPDL("pdl", strings.Join(list, ","))
+	txt.AddPDL("pdl", strings.Join(list, ","))
 
-	svc.Txt.Add("ty", usbinfo.ProductName)
-	svc.Txt.Add("rs", "eSCL")
-	svc.Txt.IfNotEmpty("vers", decoder.version)
-	svc.Txt.IfNotEmpty("txtvers", "1")
-
-	// Add to services
-	services.Add(svc)
-
-	return
-
-	// Handle a error
-ERROR:
-	err = fmt.Errorf("eSCL: %s", err)
-	return
+	if decoder.makeAndModel != "" {
+		txt.Add("ty", decoder.makeAndModel)
+	} else {
+		txt.Add("ty", usbinfo.ProductName)
+	}
+	txt.Add("note", decoder.location)
+	txt.Add("rs", "eSCL")
+	txt.IfNotEmpty("vers", decoder.version)
+	txt.IfNotEmpty("txtvers", "1")
 }
 
-// esclCapsDecoder represents eSCL ScannerCapabilities decoder
-type esclCapsDecoder struct {
-	uuid           string              // Device UUID
-	adminurl       string              // Admin URL
-	representation string              // Icon URL
-	version        string              // eSCL Version
-	platen, adf    bool                // Has platen/ADF
-	duplex         bool                // Has duplex
-	pdl, cs        map[string]struct{} // Formats/colors
-}
+// EsclScannerStatus queries eSCL ScannerStatus using provided
+// http.Client and returns scanner State and AdfState. AdfState
+// is empty if device doesn't report it.
+func EsclScannerStatus(c *http.Client, port int) (state, adfState string,
+	err error) {
 
-// newesclCapsDecoder creates new esclCapsDecoder
-func newEsclCapsDecoder(ippinfo *IppPrinterInfo) *esclCapsDecoder {
-	decoder := &esclCapsDecoder{
-		pdl: make(map[string]struct{}),
-		cs:  make(map[string]struct{}),
-	}
+	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerStatus", port)
 
-	if ippinfo != nil {
-		decoder.uuid = ippinfo.UUID
-		decoder.adminurl = ippinfo.AdminURL
-		decoder.representation = ippinfo.IconURL
+	resp, err := c.Get(uri)
+	if err != nil {
+		return
 	}
 
-	return decoder
-}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("HTTP status: %s", resp.Status)
+		return
+	}
 
-// Decode scanner capabilities
-func (decoder *esclCapsDecoder) decode(in io.Reader) error {
-	xmlDecoder := xml.NewDecoder(in)
+	xmlDecoder := xml.NewDecoder(resp.Body)
 
 	var path bytes.Buffer
 	var lenStack []int
 
 	for {
-		token, err := xmlDecoder.RawToken()
-		if err != nil {
+		token, err2 := xmlDecoder.RawToken()
+		if err2 != nil {
 			break
 		}
 
@@ -188,90 +214,47 @@ func (decoder *esclCapsDecoder) decode(in io.Reader) error {
 			path.WriteString(t.Name.Space)
 			path.WriteByte(':')
 			path.WriteString(t.Name.Local)
-			decoder.element(path.String())
 
 		case xml.EndElement:
 			last := len(lenStack) - 1
+			if last < 0 {
+				break
+			}
 			path.Truncate(lenStack[last])
 			lenStack = lenStack[:last]
 
 		case xml.CharData:
-			data := bytes.TrimSpace(t)
-			if len(data) > 0 {
-				decoder.data(path.String(), string(data))
+			data := string(bytes.TrimSpace(t))
+			switch path.String() {
+			case "/scan:ScannerStatus/pwg:State":
+				state = data
+			case "/scan:ScannerStatus/scan:AdfState":
+				adfState = data
 			}
 		}
 	}
 
-	return nil
-}
-
-const (
-	// Relative to root
-	esclPlaten          = "/scan:ScannerCapabilities/scan:Platen"
-	esclAdf             = "/scan:ScannerCapabilities/scan:Adf"
-	esclPlatenInputCaps = esclPlaten + "/scan:PlatenInputCaps"
-	esclAdfSimplexCaps  = esclAdf + "/scan:AdfSimplexInputCaps"
-	esclAdfDuplexCaps   = esclAdf + "/scan:AdfDuplexInputCaps"
-
-	// Relative to esclPlatenInputCaps, esclAdfSimplexCaps or esclAdfDuplexCaps
-	esclSettingProfile    = "/scan:SettingProfiles/scan:SettingProfile"
-	esclColorMode         = esclSettingProfile + "/scan:ColorModes/scan:ColorMode"
-	esclDocumentFormat    = esclSettingProfile + "/scan:DocumentFormats/pwg:DocumentFormat"
-	esclDocumentFormatExt = esclSettingProfile + "/scan:DocumentFormats/scan:DocumentFormatExt"
-)
-
-// handle beginning of XML element
-func (decoder *esclCapsDecoder) element(path string) {
-	switch path {
-	case esclPlaten:
-		decoder.platen = true
-	case esclAdf:
-		decoder.adf = true
-	case esclAdfDuplexCaps:
-		decoder.duplex = true
+	if state == "" {
+		err = errors.New("missed pwg:State")
 	}
-}
-
-// handle XML element data
-func (decoder *esclCapsDecoder) data(path, data string) {
-	switch path {
-	case "/scan:ScannerCapabilities/scan:UUID":
-		uuid := UUIDNormalize(data)
-		if uuid != "" && decoder.uuid == "" {
-			decoder.uuid = data
-		}
-	case "/scan:ScannerCapabilities/scan:AdminURI":
-		decoder.adminurl = data
-	case "/scan:ScannerCapabilities/scan:IconURI":
-		decoder.representation = data
-	case "/scan:ScannerCapabilities/pwg:Version":
-		decoder.version = data
-
-	case esclPlatenInputCaps + esclColorMode,
-		esclAdfSimplexCaps + esclColorMode,
-		esclAdfDuplexCaps + esclColorMode:
-
-		data = strings.ToLower(data)
-		switch {
-		case strings.HasPrefix(data, "rgb"):
-			decoder.cs["color"] = struct{}{}
-		case strings.HasPrefix(data, "grayscale"):
-			decoder.cs["grayscale"] = struct{}{}
-		case strings.HasPrefix(data, "blackandwhite"):
-			decoder.cs["binary"] = struct{}{}
-		}
 
-	case esclPlatenInputCaps + esclDocumentFormat,
-		esclAdfSimplexCaps + esclDocumentFormat,
-		esclAdfDuplexCaps + esclDocumentFormat:
-
-		decoder.pdl[data] = struct{}{}
+	return
+}
 
-	case esclPlatenInputCaps + esclDocumentFormatExt,
-		esclAdfSimplexCaps + esclDocumentFormatExt,
-		esclAdfDuplexCaps + esclDocumentFormatExt:
+// EsclScanJobOfDocument returns URI path of the eSCL scan job, if
+// request fetches the scanned document (GET .../ScanJobs/{id}/NextDocument).
+// Otherwise, "" is returned
+func EsclScanJobOfDocument(rq *http.Request) string {
+	path := rq.URL.Path
+	if rq.Method != "GET" || !strings.HasSuffix(path, "/NextDocument") {
+		return ""
+	}
 
-		decoder.pdl[data] = struct{}{}
+	job := strings.TrimSuffix(path, "/NextDocument")
+	dir := job[:strings.LastIndexByte(job, '/')+1]
+	if !strings.HasSuffix(dir, "/ScanJobs/") || len(job) == len(dir) {
+		return ""
 	}
+
+	return job
 }
@@ -0,0 +1,89 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for ESCL service registration
+ */
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestEsclTxtGenerate tests TXT record, generated for the eSCL service
+func TestEsclTxtGenerate(t *testing.T) {
+	decoder := newEsclCapsDecoder(&IppPrinterInfo{Location: "Office"})
+	err := decoder.decode(strings.NewReader(esclTestCaps))
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	txt := DNSSdTxtGenerate("_uscan._tcp", &DNSSdTxtSource{
+		UsbInfo: UsbDeviceInfo{ProductName: "USB Product"},
+		Escl:    decoder,
+	})
+
+	expected := DNSSdTxtRecord{
+		{"duplex", "T", false},
+		{"is", "platen,adf", false},
+		{"cs", "binary,color,grayscale", false},
+		{"UUID", "564e4333-4230-3838-3737-7c2a25b6a0c1", false},
+		{"adminurl", "http://localhost/#hId-pgScan", true},
+		{"pdl", "application/pdf,image/jpeg,image/png", false},
+		{"ty", "HP LaserJet MFP M28w", false},
+		{"note", "Office", false},
+		{"rs", "eSCL", false},
+		{"vers", "2.63", false},
+		{"txtvers", "1", false},
+	}
+
+	if !reflect.DeepEqual(txt, expected) {
+		t.Errorf("TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, txt)
+	}
+
+	// Without MakeAndModel, USB product name is used
+	decoder.makeAndModel = ""
+	txt = DNSSdTxtGenerate("_uscan._tcp", &DNSSdTxtSource{
+		UsbInfo: UsbDeviceInfo{ProductName: "USB Product"},
+		Escl:    decoder,
+	})
+
+	for _, item := range txt {
+		if item.Key == "ty" && item.Value != "USB Product" {
+			t.Errorf("ty: expected %q, present %q",
+				"USB Product", item.Value)
+		}
+	}
+}
+
+// TestEsclScanJobOfDocument tests EsclScanJobOfDocument
+func TestEsclScanJobOfDocument(t *testing.T) {
+	tests := []struct {
+		method, path, job string
+	}{
+		{"GET", "/eSCL/ScanJobs/42/NextDocument", "/eSCL/ScanJobs/42"},
+		{"GET", "/ScanJobs/abc/NextDocument", "/ScanJobs/abc"},
+		{"DELETE", "/eSCL/ScanJobs/42/NextDocument", ""},
+		{"GET", "/eSCL/ScanJobs/42", ""},
+		{"GET", "/eSCL/ScanJobs//NextDocument", ""},
+		{"GET", "/eSCL/ScanJobs/NextDocument", ""},
+		{"GET", "/eSCL/Jobs/42/NextDocument", ""},
+	}
+
+	for _, test := range tests {
+		rq, _ := http.NewRequest(test.method,
+			"http://localhost"+test.path, nil)
+		job := EsclScanJobOfDocument(rq)
+		if job != test.job {
+			t.Errorf("%s %s: expected %q, present %q",
+				test.method, test.path, test.job, job)
+		}
+	}
+}
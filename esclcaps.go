@@ -0,0 +1,156 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * ESCL ScannerCapabilities decoder
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// esclCapsDecoder represents eSCL ScannerCapabilities decoder
+type esclCapsDecoder struct {
+	uuid           string              // Device UUID
+	adminurl       string              // Admin URL
+	representation string              // Icon URL
+	makeAndModel   string              // Make and model
+	location       string              // Device location, from IPP
+	version        string              // eSCL Version
+	platen, adf    bool                // Has platen/ADF
+	duplex         bool                // Has duplex
+	pdl, cs        map[string]struct{} // Formats/colors
+}
+
+// newesclCapsDecoder creates new esclCapsDecoder
+func newEsclCapsDecoder(ippinfo *IppPrinterInfo) *esclCapsDecoder {
+	decoder := &esclCapsDecoder{
+		pdl: make(map[string]struct{}),
+		cs:  make(map[string]struct{}),
+	}
+
+	if ippinfo != nil {
+		decoder.uuid = ippinfo.UUID
+		decoder.adminurl = ippinfo.AdminURL
+		decoder.representation = ippinfo.IconURL
+		decoder.location = ippinfo.Location
+	}
+
+	return decoder
+}
+
+// Decode scanner capabilities
+func (decoder *esclCapsDecoder) decode(in io.Reader) error {
+	xmlDecoder := xml.NewDecoder(in)
+
+	var path bytes.Buffer
+	var lenStack []int
+
+	for {
+		token, err := xmlDecoder.RawToken()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			lenStack = append(lenStack, path.Len())
+			path.WriteByte('/')
+			path.WriteString(t.Name.Space)
+			path.WriteByte(':')
+			path.WriteString(t.Name.Local)
+			decoder.element(path.String())
+
+		case xml.EndElement:
+			last := len(lenStack) - 1
+			path.Truncate(lenStack[last])
+			lenStack = lenStack[:last]
+
+		case xml.CharData:
+			data := bytes.TrimSpace(t)
+			if len(data) > 0 {
+				decoder.data(path.String(), string(data))
+			}
+		}
+	}
+
+	return nil
+}
+
+const (
+	// Relative to root
+	esclPlaten          = "/scan:ScannerCapabilities/scan:Platen"
+	esclAdf             = "/scan:ScannerCapabilities/scan:Adf"
+	esclPlatenInputCaps = esclPlaten + "/scan:PlatenInputCaps"
+	esclAdfSimplexCaps  = esclAdf + "/scan:AdfSimplexInputCaps"
+	esclAdfDuplexCaps   = esclAdf + "/scan:AdfDuplexInputCaps"
+
+	// Relative to esclPlatenInputCaps, esclAdfSimplexCaps or esclAdfDuplexCaps
+	esclSettingProfile    = "/scan:SettingProfiles/scan:SettingProfile"
+	esclColorMode         = esclSettingProfile + "/scan:ColorModes/scan:ColorMode"
+	esclDocumentFormat    = esclSettingProfile + "/scan:DocumentFormats/pwg:DocumentFormat"
+	esclDocumentFormatExt = esclSettingProfile + "/scan:DocumentFormats/scan:DocumentFormatExt"
+)
+
+// handle beginning of XML element
+func (decoder *esclCapsDecoder) element(path string) {
+	switch path {
+	case esclPlaten:
+		decoder.platen = true
+	case esclAdf:
+		decoder.adf = true
+	case esclAdfDuplexCaps:
+		decoder.duplex = true
+	}
+}
+
+// handle XML element data
+func (decoder *esclCapsDecoder) data(path, data string) {
+	switch path {
+	case "/scan:ScannerCapabilities/scan:UUID":
+		uuid := UUIDNormalize(data)
+		if uuid != "" && decoder.uuid == "" {
+			decoder.uuid = data
+		}
+	case "/scan:ScannerCapabilities/scan:AdminURI":
+		decoder.adminurl = data
+	case "/scan:ScannerCapabilities/scan:IconURI":
+		decoder.representation = data
+	case "/scan:ScannerCapabilities/pwg:Version":
+		decoder.version = data
+	case "/scan:ScannerCapabilities/pwg:MakeAndModel":
+		decoder.makeAndModel = data
+
+	case esclPlatenInputCaps + esclColorMode,
+		esclAdfSimplexCaps + esclColorMode,
+		esclAdfDuplexCaps + esclColorMode:
+
+		data = strings.ToLower(data)
+		switch {
+		case strings.HasPrefix(data, "rgb"):
+			decoder.cs["color"] = struct{}{}
+		case strings.HasPrefix(data, "grayscale"):
+			decoder.cs["grayscale"] = struct{}{}
+		case strings.HasPrefix(data, "blackandwhite"):
+			decoder.cs["binary"] = struct{}{}
+		}
+
+	case esclPlatenInputCaps + esclDocumentFormat,
+		esclAdfSimplexCaps + esclDocumentFormat,
+		esclAdfDuplexCaps + esclDocumentFormat:
+
+		decoder.pdl[data] = struct{}{}
+
+	case esclPlatenInputCaps + esclDocumentFormatExt,
+		esclAdfSimplexCaps + esclDocumentFormatExt,
+		esclAdfDuplexCaps + esclDocumentFormatExt:
+
+		decoder.pdl[data] = struct{}{}
+	}
+}
@@ -0,0 +1,85 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for ESCL ScannerCapabilities decoder
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// esclTestCaps is the ScannerCapabilities sample for testing
+const esclTestCaps = `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm" xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03">
+  <pwg:Version>2.63</pwg:Version>
+  <pwg:MakeAndModel>HP LaserJet MFP M28w</pwg:MakeAndModel>
+  <scan:UUID>564e4333-4230-3838-3737-7c2a25b6a0c1</scan:UUID>
+  <scan:AdminURI>http://localhost/#hId-pgScan</scan:AdminURI>
+  <scan:Platen>
+    <scan:PlatenInputCaps>
+      <scan:SettingProfiles>
+        <scan:SettingProfile>
+          <scan:ColorModes>
+            <scan:ColorMode>BlackAndWhite1</scan:ColorMode>
+            <scan:ColorMode>Grayscale8</scan:ColorMode>
+            <scan:ColorMode>RGB24</scan:ColorMode>
+          </scan:ColorModes>
+          <scan:DocumentFormats>
+            <pwg:DocumentFormat>application/pdf</pwg:DocumentFormat>
+            <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+            <scan:DocumentFormatExt>image/png</scan:DocumentFormatExt>
+          </scan:DocumentFormats>
+        </scan:SettingProfile>
+      </scan:SettingProfiles>
+    </scan:PlatenInputCaps>
+  </scan:Platen>
+  <scan:Adf>
+    <scan:AdfSimplexInputCaps>
+    </scan:AdfSimplexInputCaps>
+    <scan:AdfDuplexInputCaps>
+    </scan:AdfDuplexInputCaps>
+  </scan:Adf>
+</scan:ScannerCapabilities>
+`
+
+// TestEsclCapsDecoder tests esclCapsDecoder
+func TestEsclCapsDecoder(t *testing.T) {
+	decoder := newEsclCapsDecoder(&IppPrinterInfo{Location: "Office"})
+	err := decoder.decode(strings.NewReader(esclTestCaps))
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	type testData struct {
+		name            string
+		present, expect interface{}
+	}
+
+	tests := []testData{
+		{"version", decoder.version, "2.63"},
+		{"makeAndModel", decoder.makeAndModel, "HP LaserJet MFP M28w"},
+		{"uuid", decoder.uuid, "564e4333-4230-3838-3737-7c2a25b6a0c1"},
+		{"adminurl", decoder.adminurl, "http://localhost/#hId-pgScan"},
+		{"location", decoder.location, "Office"},
+		{"platen", decoder.platen, true},
+		{"adf", decoder.adf, true},
+		{"duplex", decoder.duplex, true},
+		{"cs", decoder.cs, map[string]struct{}{
+			"binary": {}, "grayscale": {}, "color": {}}},
+		{"pdl", decoder.pdl, map[string]struct{}{
+			"application/pdf": {}, "image/jpeg": {}, "image/png": {}}},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.present, test.expect) {
+			t.Errorf("%s: expected %v, present %v",
+				test.name, test.expect, test.present)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Sanitizing of eSCL XML responses
+ *
+ * Some scanners return malformed XML in eSCL responses: wrong encoding
+ * declaration, characters not allowed in XML, wrong or undeclared
+ * namespaces. It breaks eSCL clients downstream. When enabled by the
+ * buggy-escl-responses quirk, such responses are either repaired or
+ * rejected
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// esclSanitizeNamespaces contains canonical URIs of the XML
+// namespaces, used by eSCL, indexed by their conventional prefixes
+var esclSanitizeNamespaces = map[string]string{
+	"pwg":  "http://www.pwg.org/schemas/2010/12/sm",
+	"scan": "http://schemas.hp.com/imaging/escl/2011/05/03",
+}
+
+// esclSanitizeEncodingRe matches encoding in the XML declaration
+var esclSanitizeEncodingRe = regexp.MustCompile(
+	`^<\?xml[^>]*?\bencoding\s*=\s*("[^"]*"|'[^']*')`)
+
+// esclSanitizeXmlnsRe matches XML namespace declarations
+var esclSanitizeXmlnsRe = regexp.MustCompile(
+	`\bxmlns(:[\w.-]+)?\s*=\s*("[^"]*"|'[^']*')`)
+
+// esclSanitizeResponse checks eSCL XML response and, depending on
+// the buggy-escl-responses quirk, repairs it or returns an error,
+// if response is malformed. Too large responses are passed as is
+func esclSanitizeResponse(log *Logger, session int, resp *http.Response,
+	mode QuirkBuggyEsclRsp) error {
+
+	if mode == QuirkBuggyEsclRspAllow ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		!esclIsXML(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	// Prefetch the body
+	body := resp.Body
+	data, err := ioutil.ReadAll(io.LimitReader(body, EsclSanitizeMaxBody+1))
+	if err != nil || len(data) == 0 || len(data) > EsclSanitizeMaxBody {
+		log.HTTPDebug(' ', session, "eSCL sanitize: body skipped")
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		return nil
+	}
+
+	err = esclCheckXML(data)
+	switch {
+	case err == nil:
+		log.HTTPDebug(' ', session, "eSCL sanitize: not needed")
+
+	case mode == QuirkBuggyEsclRspReject:
+		return fmt.Errorf("eSCL: malformed response: %s", err)
+
+	default:
+		log.HTTPDebug(' ', session, "eSCL sanitize: %s", err)
+		fixed := esclSanitizeXML(data)
+		if err = esclCheckXML(fixed); err != nil {
+			log.HTTPDebug(' ', session,
+				"eSCL sanitize: not fully repaired: %s", err)
+		}
+
+		log.HTTPDebug(' ', session,
+			"eSCL sanitize: %d bytes replaced with %d",
+			len(data), len(fixed))
+		data = fixed
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(data), body}
+
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	return nil
+}
+
+// esclIsXML tells if Content-Type is XML
+func esclIsXML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/xml" || mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// esclCheckXML checks that XML document is well-formed, uses
+// only supported encodings and correct eSCL namespaces
+func esclCheckXML(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = esclCharsetReader
+
+	root := false
+	for {
+		token, err := decoder.Token()
+		switch {
+		case err == io.EOF && !root:
+			return errors.New("missed root element")
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if elem, ok := token.(xml.StartElement); ok {
+			root = true
+
+			err = esclCheckNamespace(elem.Name)
+			for i := 0; err == nil && i < len(elem.Attr); i++ {
+				if elem.Attr[i].Name.Space != "xmlns" {
+					err = esclCheckNamespace(elem.Attr[i].Name)
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// esclCheckNamespace checks namespace of the element or attribute
+// name. The namespace must be declared, and well-known namespaces
+// must use canonical URIs
+func esclCheckNamespace(name xml.Name) error {
+	ns := name.Space
+
+	// Undeclared prefixes are left by decoder as is
+	if _, found := esclSanitizeNamespaces[ns]; found {
+		return fmt.Errorf("<%s:%s>: undeclared namespace prefix",
+			ns, name.Local)
+	}
+
+	if canonical := esclCanonicalNamespace(ns); canonical != ns {
+		return fmt.Errorf("<%s>: wrong namespace %q", name.Local, ns)
+	}
+
+	return nil
+}
+
+// esclCanonicalNamespace returns canonical URI of the well-known
+// namespace, if uri is its misspelled variant (i.e., uses https
+// scheme, different case or trailing slash). Otherwise, uri is
+// returned as is
+func esclCanonicalNamespace(uri string) string {
+	key := func(s string) string {
+		s = strings.ToLower(strings.TrimSpace(s))
+		s = strings.TrimPrefix(s, "http://")
+		s = strings.TrimPrefix(s, "https://")
+		return strings.TrimRight(s, "/")
+	}
+
+	k := key(uri)
+	for _, canonical := range esclSanitizeNamespaces {
+		if k == key(canonical) {
+			return canonical
+		}
+	}
+
+	return uri
+}
+
+// esclCharsetReader implements xml.Decoder.CharsetReader for the
+// encodings, compatible with UTF-8 or trivially convertible to it
+func esclCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		data, err := ioutil.ReadAll(input)
+		return bytes.NewReader(esclLatin1ToUTF8(data)), err
+	}
+
+	return nil, fmt.Errorf("unsupported encoding %q", charset)
+}
+
+// esclSanitizeXML repairs malformed XML document:
+//   - garbage before the document start is removed
+//   - document is converted into UTF-8, and encoding declaration
+//     is updated accordingly
+//   - characters, not allowed in XML, are removed
+//   - misspelled URIs of eSCL namespaces are replaced with canonical
+//     ones, and missed declarations of pwg: and scan: prefixes are
+//     added to the root element
+func esclSanitizeXML(data []byte) []byte {
+	// Drop everything before the document start, including BOM
+	if i := bytes.IndexByte(data, '<'); i > 0 {
+		data = data[i:]
+	}
+
+	// Convert to UTF-8 and fix the encoding declaration
+	if m := esclSanitizeEncodingRe.FindSubmatchIndex(data); m != nil {
+		charset := string(data[m[2]+1 : m[3]-1])
+		switch strings.ToLower(charset) {
+		case "iso-8859-1", "latin1", "latin-1":
+			if !utf8.Valid(data) {
+				data = esclLatin1ToUTF8(data)
+			}
+		}
+
+		if !strings.EqualFold(charset, "utf-8") {
+			fixed := make([]byte, 0, len(data))
+			fixed = append(fixed, data[:m[2]]...)
+			fixed = append(fixed, `"UTF-8"`...)
+			fixed = append(fixed, data[m[3]:]...)
+			data = fixed
+		}
+	}
+
+	// Remove invalid characters
+	fixed := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		c, sz := utf8.DecodeRune(data)
+		if !(c == utf8.RuneError && sz == 1) && esclIsXMLChar(c) {
+			fixed = append(fixed, data[:sz]...)
+		}
+		data = data[sz:]
+	}
+	data = fixed
+
+	// Fix namespace URIs
+	data = esclSanitizeXmlnsRe.ReplaceAllFunc(data, func(decl []byte) []byte {
+		m := esclSanitizeXmlnsRe.FindSubmatch(decl)
+		uri := string(m[2][1 : len(m[2])-1])
+		canonical := esclCanonicalNamespace(uri)
+		if canonical == uri {
+			return decl
+		}
+		return []byte(fmt.Sprintf("xmlns%s=%q", m[1], canonical))
+	})
+
+	// Add missed namespace declarations
+	var missed []string
+	for prefix := range esclSanitizeNamespaces {
+		if bytes.Contains(data, []byte("<"+prefix+":")) &&
+			!bytes.Contains(data, []byte("xmlns:"+prefix)) {
+			missed = append(missed, prefix)
+		}
+	}
+
+	if len(missed) != 0 {
+		sort.Strings(missed)
+		data = esclAddNamespaces(data, missed)
+	}
+
+	return data
+}
+
+// esclAddNamespaces adds declarations of well-known namespaces
+// with specified prefixes to the root element of XML document
+func esclAddNamespaces(data []byte, prefixes []string) []byte {
+	// Lookup the root element name
+	start := -1
+	for i := 0; i < len(data)-1 && start < 0; i++ {
+		if data[i] == '<' && data[i+1] != '?' && data[i+1] != '!' {
+			start = i + 1
+		}
+	}
+
+	if start < 0 {
+		return data
+	}
+
+	end := start
+	for end < len(data) && !strings.ContainsRune(" \t\r\n/>", rune(data[end])) {
+		end++
+	}
+
+	// Insert declarations
+	decls := ""
+	for _, prefix := range prefixes {
+		decls += fmt.Sprintf(" xmlns:%s=%q",
+			prefix, esclSanitizeNamespaces[prefix])
+	}
+
+	fixed := make([]byte, 0, len(data)+len(decls))
+	fixed = append(fixed, data[:end]...)
+	fixed = append(fixed, decls...)
+	fixed = append(fixed, data[end:]...)
+
+	return fixed
+}
+
+// esclLatin1ToUTF8 converts ISO-8859-1 text into UTF-8
+func esclLatin1ToUTF8(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, c := range data {
+		out = append(out, string(rune(c))...)
+	}
+	return out
+}
+
+// esclIsXMLChar tells if character is allowed in XML 1.0 document
+func esclIsXMLChar(c rune) bool {
+	switch {
+	case c == '\t' || c == '\n' || c == '\r':
+		return true
+	case c < 0x20:
+		return false
+	case c >= 0xd800 && c <= 0xdfff:
+		return false
+	case c == 0xfffe || c == 0xffff:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,122 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for sanitizing of eSCL XML responses
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestEsclSanitizeXML tests repairing of malformed eSCL XML
+func TestEsclSanitizeXML(t *testing.T) {
+	type testData struct {
+		in, out string
+	}
+
+	tests := []testData{
+		// Well-formed document is not changed
+		{
+			in: `<?xml version="1.0" encoding="UTF-8"?>` +
+				`<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03"/>`,
+			out: `<?xml version="1.0" encoding="UTF-8"?>` +
+				`<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03"/>`,
+		},
+
+		// Wrong encoding declaration, BOM and invalid characters
+		{
+			in: "\xef\xbb\xbf<?xml version=\"1.0\" encoding='UTF-16'?>" +
+				"<root>A\x00B\x01C\xffD</root>",
+			out: `<?xml version="1.0" encoding="UTF-8"?>` +
+				`<root>ABCD</root>`,
+		},
+
+		// Latin1 document
+		{
+			in:  "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><root>\xe9</root>",
+			out: "<?xml version=\"1.0\" encoding=\"UTF-8\"?><root>\xc3\xa9</root>",
+		},
+
+		// Misspelled namespace URI
+		{
+			in:  `<pwg:Version xmlns:pwg='https://www.pwg.org/schemas/2010/12/sm/'>2.6</pwg:Version>`,
+			out: `<pwg:Version xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">2.6</pwg:Version>`,
+		},
+
+		// Missed namespace declarations
+		{
+			in: `<scan:ScannerStatus><pwg:State>Idle</pwg:State></scan:ScannerStatus>`,
+			out: `<scan:ScannerStatus` +
+				` xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm"` +
+				` xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03">` +
+				`<pwg:State>Idle</pwg:State></scan:ScannerStatus>`,
+		},
+	}
+
+	for _, test := range tests {
+		out := string(esclSanitizeXML([]byte(test.in)))
+		if out != test.out {
+			t.Errorf("%q:\nexpected: %q\npresent:  %q",
+				test.in, test.out, out)
+			continue
+		}
+
+		if err := esclCheckXML([]byte(out)); err != nil {
+			t.Errorf("%q: %s", out, err)
+		}
+	}
+}
+
+// TestEsclSanitizeResponse tests handling of eSCL responses,
+// depending on the buggy-escl-responses quirk
+func TestEsclSanitizeResponse(t *testing.T) {
+	const bad = `<scan:ScannerStatus><pwg:State>Idle</pwg:State>` +
+		`</scan:ScannerStatus>`
+
+	newResp := func() *http.Response {
+		resp := &http.Response{
+			Header:        make(http.Header),
+			ContentLength: int64(len(bad)),
+			Body:          ioutil.NopCloser(strings.NewReader(bad)),
+		}
+		resp.Header.Set("Content-Type", "text/xml; charset=utf-8")
+		return resp
+	}
+
+	log := NewLogger()
+
+	// Allow: response is passed as is
+	resp := newResp()
+	err := esclSanitizeResponse(log, 0, resp, QuirkBuggyEsclRspAllow)
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err != nil || string(data) != bad {
+		t.Errorf("allow: %v %q", err, data)
+	}
+
+	// Reject: error is returned
+	resp = newResp()
+	err = esclSanitizeResponse(log, 0, resp, QuirkBuggyEsclRspReject)
+	if err == nil {
+		t.Errorf("reject: error expected")
+	}
+
+	// Sanitize: response is repaired
+	resp = newResp()
+	err = esclSanitizeResponse(log, 0, resp, QuirkBuggyEsclRspSanitize)
+	data, _ = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("sanitize: %s", err)
+	} else if esclCheckXML(data) != nil {
+		t.Errorf("sanitize: not repaired: %q", data)
+	} else if resp.ContentLength != int64(len(data)) {
+		t.Errorf("sanitize: ContentLength %d, body %d bytes",
+			resp.ContentLength, len(data))
+	}
+}
@@ -0,0 +1,166 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Event log of devices lifecycle
+ *
+ * Lifecycle events (device discovered, initialized, removed and so on)
+ * are kept in the fixed-size ring buffer and shown by the
+ * `ipp-usb status` command, so the history of device that "keeps
+ * disappearing" can be seen without reading the full debug logs
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind represents kind of the lifecycle event
+type EventKind int
+
+// EventKind values
+const (
+	EventDiscovered EventKind = iota
+	EventInitialized
+	EventInitFailed
+	EventDNSSdRegistered
+	EventReset
+	EventTimeout
+	EventRemoved
+	EventChanged
+)
+
+// String returns name of the EventKind
+func (kind EventKind) String() string {
+	switch kind {
+	case EventDiscovered:
+		return "discovered"
+	case EventInitialized:
+		return "initialized"
+	case EventInitFailed:
+		return "init-failed"
+	case EventDNSSdRegistered:
+		return "dns-sd-registered"
+	case EventReset:
+		return "reset"
+	case EventTimeout:
+		return "timeout"
+	case EventRemoved:
+		return "removed"
+	case EventChanged:
+		return "changed"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(kind))
+}
+
+// Event represents a single lifecycle event
+type Event struct {
+	Time   time.Time // Time of event (of last event, if repeated)
+	Addr   UsbAddr   // Device address
+	Kind   EventKind // Event kind
+	Detail string    // Event details, "" if none
+	Count  int       // Count of identical events in a row
+}
+
+// String formats Event as a text
+func (ev Event) String() string {
+	s := fmt.Sprintf("%s %s %s", ev.Time.Format("2006-01-02 15:04:05"),
+		ev.Addr, ev.Kind)
+
+	if ev.Detail != "" {
+		s += ": " + ev.Detail
+	}
+
+	if ev.Count > 1 {
+		s += fmt.Sprintf(" (x%d)", ev.Count)
+	}
+
+	return s
+}
+
+// EventLog is the fixed-size ring buffer of lifecycle events
+type EventLog struct {
+	lock   sync.Mutex // Access lock
+	events []Event    // Ring buffer
+	next   int        // Index of the next event to be written
+	count  int        // Count of events in the buffer
+}
+
+// DevEvents is the global log of device lifecycle events
+var DevEvents = NewEventLog(EventLogSize)
+
+// NewEventLog creates a new EventLog, capable to keep
+// up to size last events
+func NewEventLog(size int) *EventLog {
+	return &EventLog{events: make([]Event, size)}
+}
+
+// Add adds event to the EventLog
+//
+// Identical events in a row (the same device, kind and details)
+// are merged, to prevent flood of repeated events (i.e., timeouts)
+// from pushing out the useful history
+func (elog *EventLog) Add(addr UsbAddr, kind EventKind, detail string) {
+	elog.lock.Lock()
+	defer elog.lock.Unlock()
+
+	now := time.Now()
+
+	if elog.count > 0 {
+		last := &elog.events[(elog.next+len(elog.events)-1)%
+			len(elog.events)]
+
+		if last.Addr == addr && last.Kind == kind &&
+			last.Detail == detail {
+			last.Time = now
+			last.Count++
+			return
+		}
+	}
+
+	elog.events[elog.next] = Event{
+		Time:   now,
+		Addr:   addr,
+		Kind:   kind,
+		Detail: detail,
+		Count:  1,
+	}
+
+	elog.next = (elog.next + 1) % len(elog.events)
+	if elog.count < len(elog.events) {
+		elog.count++
+	}
+}
+
+// Events returns all events in the EventLog, oldest first
+func (elog *EventLog) Events() []Event {
+	elog.lock.Lock()
+	defer elog.lock.Unlock()
+
+	events := make([]Event, elog.count)
+	start := elog.next - elog.count + len(elog.events)
+
+	for i := range events {
+		events[i] = elog.events[(start+i)%len(elog.events)]
+	}
+
+	return events
+}
+
+// Format formats events as a text, one event per line, with
+// the specified line prefix
+func (elog *EventLog) Format(prefix string) []byte {
+	buf := &bytes.Buffer{}
+	for _, ev := range elog.Events() {
+		buf.WriteString(prefix)
+		buf.WriteString(ev.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,60 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for event log of devices lifecycle
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestEventLog tests EventLog ring buffer
+func TestEventLog(t *testing.T) {
+	elog := NewEventLog(3)
+	addr := UsbAddr{Bus: 1, Address: 5}
+
+	if events := elog.Events(); len(events) != 0 {
+		t.Fatalf("empty log: %d events", len(events))
+	}
+
+	// Repeated events must be merged
+	elog.Add(addr, EventDiscovered, "")
+	elog.Add(addr, EventTimeout, "")
+	elog.Add(addr, EventTimeout, "")
+
+	events := elog.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, present %d", len(events))
+	}
+
+	if events[1].Kind != EventTimeout || events[1].Count != 2 {
+		t.Errorf("timeout events not merged: %s", events[1])
+	}
+
+	// Old events must be pushed out, order must be preserved
+	elog.Add(addr, EventReset, "")
+	elog.Add(addr, EventInitFailed, "error")
+	elog.Add(addr, EventRemoved, "")
+
+	expected := []EventKind{EventReset, EventInitFailed, EventRemoved}
+	events = elog.Events()
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, present %d",
+			len(expected), len(events))
+	}
+
+	for i, kind := range expected {
+		if events[i].Kind != kind {
+			t.Errorf("event %d: expected %s, present %s",
+				i, kind, events[i].Kind)
+		}
+	}
+
+	if events[1].Detail != "error" {
+		t.Errorf("event details lost: %s", events[1])
+	}
+}
@@ -0,0 +1,140 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Firewall hints
+ *
+ * When devices are exported to the network (interface is not
+ * loopback), ipp-usb may report firewall openings, required for
+ * the devices to be reachable, in the machine-readable (JSON) form,
+ * so provisioning tools can program firewalld/nftables without
+ * parsing human-readable text.
+ *
+ * Hints are available via the "/firewall" path of the control socket
+ * and written into the main log as devices come and go.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// FirewallHint describes a single firewall opening
+type FirewallHint struct {
+	Device  string `json:"device,omitempty"` // USB address, "" if global
+	Ident   string `json:"ident,omitempty"`  // Device ident
+	Model   string `json:"model,omitempty"`  // Device model
+	Port    int    `json:"port"`             // Port number
+	Proto   string `json:"proto"`            // "tcp" or "udp"
+	Service string `json:"service"`          // Service name
+}
+
+// firewallHints is the JSON document, returned via control socket
+type firewallHints struct {
+	Exposed        bool           `json:"exposed"`
+	Interface      string         `json:"interface"`
+	AllowedSubnets []string       `json:"allowed-subnets"`
+	Openings       []FirewallHint `json:"openings"`
+}
+
+var (
+	// firewallTable contains per-device firewall hints,
+	// indexed by the UsbAddr
+	firewallTable = make(map[UsbAddr]FirewallHint)
+
+	// firewallLock protects access to the firewallTable
+	firewallLock sync.Mutex
+)
+
+// FirewallHintsActive reports whether firewall hints are
+// enabled and devices are actually exported to the network
+func FirewallHintsActive() bool {
+	return Conf.FirewallHints && !Conf.LoopbackOnly && Conf.HTTPTCPEnable
+}
+
+// FirewallHintAdd adds firewall hint for the device and
+// writes it into the log
+func FirewallHintAdd(addr UsbAddr, hint FirewallHint) {
+	if !FirewallHintsActive() {
+		return
+	}
+
+	firewallLock.Lock()
+	firewallTable[addr] = hint
+	firewallLock.Unlock()
+
+	firewallHintLog("open", hint)
+}
+
+// FirewallHintDel deletes firewall hint for the device and
+// writes it into the log
+func FirewallHintDel(addr UsbAddr) {
+	firewallLock.Lock()
+	hint, found := firewallTable[addr]
+	delete(firewallTable, addr)
+	firewallLock.Unlock()
+
+	if found {
+		firewallHintLog("close", hint)
+	}
+}
+
+// FirewallHintsFormat formats firewall hints as JSON
+func FirewallHintsFormat() []byte {
+	doc := firewallHints{
+		Exposed:        FirewallHintsActive(),
+		Interface:      Conf.Interface,
+		AllowedSubnets: []string{},
+		Openings:       []FirewallHint{},
+	}
+
+	if doc.Interface == "" {
+		doc.Interface = "all"
+		if Conf.LoopbackOnly {
+			doc.Interface = "loopback"
+		}
+	}
+
+	for _, subnet := range Conf.AllowedSubnets {
+		doc.AllowedSubnets = append(doc.AllowedSubnets, subnet.String())
+	}
+
+	if doc.Exposed {
+		if Conf.DNSSdEnable {
+			doc.Openings = append(doc.Openings, FirewallHint{
+				Port:    5353,
+				Proto:   "udp",
+				Service: "mdns",
+			})
+		}
+
+		firewallLock.Lock()
+		addrs := make([]UsbAddr, 0, len(firewallTable))
+		for addr := range firewallTable {
+			addrs = append(addrs, addr)
+		}
+
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i].Less(addrs[j])
+		})
+
+		for _, addr := range addrs {
+			doc.Openings = append(doc.Openings, firewallTable[addr])
+		}
+		firewallLock.Unlock()
+	}
+
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	return append(data, '\n')
+}
+
+// firewallHintLog writes firewall hint into the log as a single
+// line of JSON, prefixed by the event name ("open" or "close")
+func firewallHintLog(event string, hint FirewallHint) {
+	data, _ := json.Marshal(hint)
+	Log.Info(' ', "firewall: %s %s", event, data)
+}
@@ -0,0 +1,70 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for firewall hints
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestFirewallHints tests firewall hints formatting
+func TestFirewallHints(t *testing.T) {
+	save := Conf
+	defer func() { Conf = save }()
+
+	Log.ToNowhere()
+
+	Conf.FirewallHints = true
+	Conf.LoopbackOnly = false
+	Conf.HTTPTCPEnable = true
+	Conf.DNSSdEnable = true
+	Conf.Interface = "eth0"
+
+	addr1 := UsbAddr{Bus: 1, Address: 5}
+	addr2 := UsbAddr{Bus: 1, Address: 2}
+
+	FirewallHintAdd(addr1, FirewallHint{Device: addr1.String(),
+		Port: 60001, Proto: "tcp", Service: "ipp-usb"})
+	FirewallHintAdd(addr2, FirewallHint{Device: addr2.String(),
+		Port: 60000, Proto: "tcp", Service: "ipp-usb"})
+
+	defer FirewallHintDel(addr1)
+	defer FirewallHintDel(addr2)
+
+	var doc firewallHints
+	err := json.Unmarshal(FirewallHintsFormat(), &doc)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !doc.Exposed || doc.Interface != "eth0" {
+		t.Errorf("unexpected document header: %+v", doc)
+	}
+
+	ports := []int{}
+	for _, opening := range doc.Openings {
+		ports = append(ports, opening.Port)
+	}
+
+	if len(ports) != 3 || ports[0] != 5353 ||
+		ports[1] != 60000 || ports[2] != 60001 {
+		t.Errorf("unexpected openings: %v", ports)
+	}
+
+	// Nothing reported, if not exported to the network
+	Conf.LoopbackOnly = true
+	Conf.Interface = ""
+
+	doc = firewallHints{}
+	json.Unmarshal(FirewallHintsFormat(), &doc)
+
+	if doc.Exposed || doc.Interface != "loopback" || len(doc.Openings) != 0 {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+}
@@ -0,0 +1,138 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Histograms of USB transfer sizes and latencies
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// histogramBuckets is the count of Histogram buckets. Bucket i
+// counts values in range [2^(i-1), 2^i), bucket 0 counts zeros,
+// and the last bucket counts everything above
+const histogramBuckets = 24
+
+// Histogram counts values in power-of-two buckets
+type Histogram struct {
+	buckets [histogramBuckets]uint64 // Counters
+	count   uint64                   // Total count of values
+	sum     uint64                   // Sum of all values
+}
+
+// Add adds value to the Histogram
+func (h *Histogram) Add(v uint64) {
+	i := 0
+	for x := v; x != 0 && i < histogramBuckets-1; x >>= 1 {
+		i++
+	}
+
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+}
+
+// Count returns total count of values in the Histogram
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Format formats Histogram as a text. Non-empty buckets are
+// written as "<LIMIT:COUNT", where LIMIT is the upper bound
+// of bucket, formatted by fmtLimit
+func (h *Histogram) Format(fmtLimit func(uint64) string) string {
+	if h.count == 0 {
+		return "none"
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "n=%d avg=%s", h.count, fmtLimit(h.sum/h.count))
+
+	for i, cnt := range h.buckets {
+		if cnt == 0 {
+			continue
+		}
+
+		switch {
+		case i == 0:
+			fmt.Fprintf(buf, " 0:%d", cnt)
+		case i == histogramBuckets-1:
+			fmt.Fprintf(buf, " >=%s:%d", fmtLimit(1<<uint(i-1)), cnt)
+		default:
+			fmt.Fprintf(buf, " <%s:%d", fmtLimit(1<<uint(i)), cnt)
+		}
+	}
+
+	return buf.String()
+}
+
+// histogramFmtSize formats size limit of the Histogram bucket
+func histogramFmtSize(v uint64) string {
+	switch {
+	case v >= 1024*1024 && v%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", v/(1024*1024))
+	case v >= 1024 && v%1024 == 0:
+		return fmt.Sprintf("%dK", v/1024)
+	}
+
+	return fmt.Sprintf("%d", v)
+}
+
+// histogramFmtMicroseconds formats time limit of the Histogram
+// bucket, counted in microseconds
+func histogramFmtMicroseconds(v uint64) string {
+	return (time.Duration(v) * time.Microsecond).String()
+}
+
+// usbXferStats contains per-connection statistics of USB
+// transfers: histograms of transfer sizes and latencies
+type usbXferStats struct {
+	lock     sync.Mutex // Access lock
+	recvSize Histogram  // Recv sizes, bytes
+	recvTime Histogram  // Recv latencies, microseconds
+	sendSize Histogram  // Send sizes, bytes
+	sendTime Histogram  // Send latencies, microseconds
+}
+
+// addRecv accounts completed Recv
+func (xs *usbXferStats) addRecv(n int, latency time.Duration) {
+	xs.lock.Lock()
+	xs.recvSize.Add(uint64(n))
+	xs.recvTime.Add(uint64(latency / time.Microsecond))
+	xs.lock.Unlock()
+}
+
+// addSend accounts completed Send
+func (xs *usbXferStats) addSend(n int, latency time.Duration) {
+	xs.lock.Lock()
+	xs.sendSize.Add(uint64(n))
+	xs.sendTime.Add(uint64(latency / time.Microsecond))
+	xs.lock.Unlock()
+}
+
+// count returns total count of accounted transfers
+func (xs *usbXferStats) count() uint64 {
+	xs.lock.Lock()
+	defer xs.lock.Unlock()
+	return xs.recvSize.Count() + xs.sendSize.Count()
+}
+
+// format formats usbXferStats as a text, one histogram per line
+func (xs *usbXferStats) format() []string {
+	xs.lock.Lock()
+	defer xs.lock.Unlock()
+
+	return []string{
+		"recv size: " + xs.recvSize.Format(histogramFmtSize),
+		"recv time: " + xs.recvTime.Format(histogramFmtMicroseconds),
+		"send size: " + xs.sendSize.Format(histogramFmtSize),
+		"send time: " + xs.sendTime.Format(histogramFmtMicroseconds),
+	}
+}
@@ -0,0 +1,35 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for histograms of USB transfer sizes and latencies
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestHistogram tests Histogram
+func TestHistogram(t *testing.T) {
+	h := &Histogram{}
+
+	if s := h.Format(histogramFmtSize); s != "none" {
+		t.Errorf("empty histogram: %q", s)
+	}
+
+	for _, v := range []uint64{0, 1, 512, 1000, 1024, 16384, 1 << 23} {
+		h.Add(v)
+	}
+
+	expected := "n=7 avg=1201075 0:1 <2:1 <1K:2 <2K:1 <32K:1 >=4M:1"
+	if s := h.Format(histogramFmtSize); s != expected {
+		t.Errorf("expected: %s\npresent:  %s", expected, s)
+	}
+
+	if h.Count() != 7 {
+		t.Errorf("Count: expected 7, present %d", h.Count())
+	}
+}
@@ -9,16 +9,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 var (
@@ -33,12 +40,20 @@ type HTTPProxy struct {
 	server    *http.Server  // HTTP server
 	enable    bool          // Proxy can handle incoming requests
 	transport *UsbTransport // Transport for outgoing requests
+	icons     *Icons        // Locally cached icons, if any
+	ippCache  *IppCache     // Get-Printer-Attributes cache, if enabled
+	accessLog *AccessLog    // HTTP access log, if enabled
+	faxDown   uint32        // Atomic non-zero, if FaxOut unavailable
+	faxFailed func()        // Called, if FaxOut found unavailable
 	closeWait chan struct{} // Closed at server close
 }
 
 // NewHTTPProxy creates new HTTP proxy
+//
+// The proxy serves incoming connections from all the
+// specified listeners
 func NewHTTPProxy(logger *Logger,
-	listener net.Listener, transport *UsbTransport) *HTTPProxy {
+	listeners []net.Listener, transport *UsbTransport) *HTTPProxy {
 
 	proxy := &HTTPProxy{
 		log:       logger,
@@ -46,13 +61,30 @@ func NewHTTPProxy(logger *Logger,
 		closeWait: make(chan struct{}),
 	}
 
+	if Conf.IppAttrsCacheTTL != 0 {
+		proxy.ippCache = NewIppCache(Conf.IppAttrsCacheTTL)
+	}
+
+	if transport != nil {
+		proxy.accessLog = NewAccessLog(transport.info)
+	}
+
 	proxy.server = &http.Server{
 		Handler:  proxy,
 		ErrorLog: log.New(logger.LineWriter(LogError, '!'), "", 0),
 	}
 
+	var done sync.WaitGroup
+	for _, listener := range listeners {
+		done.Add(1)
+		go func(listener net.Listener) {
+			proxy.server.Serve(listener)
+			done.Done()
+		}(listener)
+	}
+
 	go func() {
-		proxy.server.Serve(listener)
+		done.Wait()
 		close(proxy.closeWait)
 	}()
 
@@ -63,6 +95,26 @@ func NewHTTPProxy(logger *Logger,
 func (proxy *HTTPProxy) Close() {
 	proxy.server.Close()
 	<-proxy.closeWait
+	proxy.closeAccessLog()
+}
+
+// Shutdown gracefully shuts down the HTTPProxy. Listeners are
+// closed immediately, but requests in progress are allowed to
+// complete, until provided context expires
+func (proxy *HTTPProxy) Shutdown(ctx context.Context) {
+	err := proxy.server.Shutdown(ctx)
+	if err != nil {
+		proxy.server.Close()
+	}
+	<-proxy.closeWait
+	proxy.closeAccessLog()
+}
+
+// closeAccessLog closes the access log, if enabled
+func (proxy *HTTPProxy) closeAccessLog() {
+	if proxy.accessLog != nil {
+		proxy.accessLog.Close()
+	}
 }
 
 // Enable indicates that initialization is completed and
@@ -71,6 +123,12 @@ func (proxy *HTTPProxy) Enable() {
 	proxy.enable = true
 }
 
+// SetIcons sets locally cached device icons, served by
+// the proxy itself
+func (proxy *HTTPProxy) SetIcons(icons *Icons) {
+	proxy.icons = icons
+}
+
 // Handle HTTP request
 func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Catch panics to log
@@ -83,6 +141,16 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	session := int(atomic.AddInt32(&httpSessionID, 1)-1) % 1000
 
+	// Record transaction into the access log, when done
+	var aw *accessLogWriter
+	if proxy.accessLog != nil {
+		aw = newAccessLogWriter(w, r)
+		w = aw
+		defer func() {
+			proxy.accessLog.Record(aw.finish())
+		}()
+	}
+
 	// Perform sanity checking
 	if !proxy.enable {
 		proxy.httpError(session, w, r, http.StatusServiceUnavailable,
@@ -108,10 +176,31 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	route := httpRouteLookup(r.URL.Path)
+	if aw != nil {
+		aw.rec.Route = route.name
+	}
+
+	err := route.checkDisabled(proxy.transport.Quirks(), r.URL.Path)
+	if err != nil {
+		proxy.httpError(session, w, r, http.StatusServiceUnavailable,
+			err)
+		return
+	}
+
+	// Requests, received via the Unix domain socket, are
+	// handled separately
+	if v := r.Context().Value(http.LocalAddrContextKey); v != nil {
+		if unixAddr, ok := v.(*UnixConnAddr); ok {
+			proxy.serveUnix(session, w, r, route, unixAddr)
+			return
+		}
+	}
+
 	// Obtain request's client and server addresses
 	var clientAddr, serverAddr *net.TCPAddr
 
-	clientAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	clientAddr, err = net.ResolveTCPAddr("tcp", r.RemoteAddr)
 	if err != nil {
 		proxy.httpError(session, w, r, http.StatusInternalServerError,
 			errors.New("Unable to get client address for request"))
@@ -131,8 +220,10 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate
-	if status, err := AuthHTTPRequest(proxy.log,
-		clientAddr, serverAddr, r); err != nil {
+	client, status, err := AuthHTTPRequest(proxy.log,
+		clientAddr, serverAddr, r)
+	accessLogSetClient(w, client)
+	if err != nil {
 		proxy.httpError(session, w, r, status, err)
 		return
 	}
@@ -171,25 +262,307 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			url := *r.URL
 			url.Host = fmt.Sprintf("localhost:%d", serverAddr.Port)
+			if r.TLS != nil {
+				url.Scheme = "https"
+			}
 
 			proxy.httpRedirect(session, w, r, http.StatusFound, &url)
 			return
 		}
 	}
 
-	// Send request and obtain response status and header
-	resp, err := proxy.transport.RoundTripWithSession(session, r)
+	route.serve(proxy, session, w, r, client)
+}
+
+// serveUnix handles HTTP request, received via the Unix domain socket
+func (proxy *HTTPProxy) serveUnix(session int, w http.ResponseWriter,
+	r *http.Request, route *httpRoute, addr *UnixConnAddr) {
+
+	// Authenticate
+	client, status, err := AuthUnixRequest(proxy.log, addr.UID, r)
+	accessLogSetClient(w, client)
 	if err != nil {
+		proxy.httpError(session, w, r, status, err)
+		return
+	}
+
+	// Adjust request headers
+	//
+	// Unix socket has no host and port, so we always use "localhost",
+	// as required by the IPP over USB specification
+	httpRemoveHopByHopHeaders(r.Header)
+
+	r.Host = "localhost"
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+
+	route.serve(proxy, session, w, r, client)
+}
+
+// serveIcons handles requests to the icons route. Locally cached
+// icons are served without device
+func (proxy *HTTPProxy) serveIcons(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient) {
+
+	if proxy.icons == nil {
+		proxy.serveWeb(session, w, r, client)
+		return
+	}
+
+	proxy.log.HTTPDebug(' ', session, "%s %s: local icon",
+		r.Method, r.URL)
+	proxy.icons.Serve(w, r)
+}
+
+// serveIpp handles requests to the IPP routes
+func (proxy *HTTPProxy) serveIpp(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient) {
+	proxy.serveIppCheck(session, w, r, client, nil)
+}
+
+// serveFaxOut handles requests to the IPP FaxOut route
+//
+// While FaxOut service is known to be unavailable, requests are
+// rejected without passing them to device
+func (proxy *HTTPProxy) serveFaxOut(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient) {
+
+	if !proxy.FaxOutAvailable() {
+		err := errors.New("IPP FaxOut service unavailable")
 		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
 		return
 	}
 
+	proxy.serveIppCheck(session, w, r, client, proxy.faxoutCheck)
+}
+
+// serveIppCheck handles IPP requests. If check is not nil, it
+// is called for each response, received from device
+func (proxy *HTTPProxy) serveIppCheck(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient,
+	check func(session int, resp *http.Response)) {
+
+	// Apply IPP operations policy
+	if len(Conf.IppPolicy) != 0 {
+		hdr, ok := ippRequestPeek(r)
+		if ok && !Conf.IppPolicy.Check(hdr.Op, client) {
+			proxy.log.Begin().
+				HTTPRqParams(LogDebug, '>', session, r).
+				HTTPError('!', session, "IPP: %s blocked by policy (%s)",
+					hdr.Op, Conf.IppPolicy[hdr.Op]).
+				Commit()
+			ippPolicyReject(w, hdr)
+			return
+		}
+	}
+
+	// Serve Get-Printer-Attributes from cache, if possible,
+	// and invalidate cache, if request may change printer state
+	cacheKey := ""
+	if proxy.ippCache != nil {
+		hdr, ok := ippRequestPeek(r)
+		switch {
+		case !ok:
+		case hdr.Op == goipp.OpGetPrinterAttributes:
+			key, id, ok := ippCacheKey(r)
+			if !ok {
+				break
+			}
+
+			header, data := proxy.ippCache.Lookup(key, id)
+			if data != nil {
+				proxy.log.Begin().
+					HTTPRqParams(LogDebug, '>', session, r).
+					HTTPDebug(' ', session, "IPP: %s served from cache",
+						hdr.Op).
+					Commit()
+
+				httpCopyHeaders(w.Header(), header)
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data)
+				return
+			}
+
+			cacheKey = key
+
+		case !ippCacheReadOnlyOps[hdr.Op]:
+			proxy.ippCache.Invalidate()
+		}
+	}
+
+	resp := proxy.roundTrip(session, w, r)
+	if resp == nil {
+		return
+	}
+
+	if check != nil {
+		check(session, resp)
+	}
+
+	// Save Get-Printer-Attributes response to cache
+	if cacheKey != "" && resp.StatusCode == http.StatusOK {
+		httpRemoveHopByHopHeaders(resp.Header)
+
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+			ippCacheMaxResponse+1))
+		if err == nil && len(data) <= ippCacheMaxResponse {
+			header := make(http.Header)
+			httpCopyHeaders(header, resp.Header)
+			header.Del("Content-Length")
+			proxy.ippCache.Store(cacheKey, header, data)
+		}
+
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	}
+
+	proxy.sendResponse(session, w, resp)
+}
+
+// SetFaxOutAvailable sets availability of the IPP FaxOut service
+func (proxy *HTTPProxy) SetFaxOutAvailable(available bool) {
+	if available {
+		atomic.StoreUint32(&proxy.faxDown, 0)
+	} else {
+		atomic.StoreUint32(&proxy.faxDown, 1)
+	}
+}
+
+// FaxOutAvailable tells if IPP FaxOut service is available
+func (proxy *HTTPProxy) FaxOutAvailable() bool {
+	return atomic.LoadUint32(&proxy.faxDown) == 0
+}
+
+// OnFaxOutFailed sets callback, called when response to the
+// proxied FaxOut request shows that service became unavailable
+func (proxy *HTTPProxy) OnFaxOutFailed(callback func()) {
+	proxy.faxFailed = callback
+}
+
+// faxoutCheck checks response to the proxied FaxOut request.
+// If device responds with HTTP 404 or 503, or with the IPP
+// server-error-service-unavailable status, FaxOut service is
+// marked unavailable
+func (proxy *HTTPProxy) faxoutCheck(session int, resp *http.Response) {
+	failed := resp.StatusCode == http.StatusNotFound ||
+		resp.StatusCode == http.StatusServiceUnavailable
+
+	// Peek IPP status of the response
+	if resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Content-Type") == goipp.ContentType {
+		hdr := make([]byte, 4)
+		n, _ := io.ReadFull(resp.Body, hdr)
+
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(hdr[:n]), resp.Body), resp.Body}
+
+		if n == len(hdr) {
+			status := goipp.Status(binary.BigEndian.Uint16(hdr[2:]))
+			failed = status == goipp.StatusErrorServiceUnavailable
+		}
+	}
+
+	if failed && proxy.FaxOutAvailable() {
+		proxy.log.HTTPError('!', session, "IPP FaxOut: service unavailable")
+		proxy.SetFaxOutAvailable(false)
+		if proxy.faxFailed != nil {
+			proxy.faxFailed()
+		}
+	}
+}
+
+// serveEscl handles requests to the eSCL route
+func (proxy *HTTPProxy) serveEscl(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient) {
+
+	resp := proxy.roundTrip(session, w, r)
+	if resp == nil {
+		return
+	}
+
+	// Check and repair malformed XML, if needed
+	err := esclSanitizeResponse(proxy.log, session, resp,
+		proxy.transport.Quirks().GetBuggyEsclRsp())
+	if err != nil {
+		resp.Body.Close()
+		proxy.httpError(session, w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	proxy.sendResponse(session, w, resp)
+}
+
+// serveWeb handles requests to the device web console
+func (proxy *HTTPProxy) serveWeb(session int, w http.ResponseWriter,
+	r *http.Request, client AuthClient) {
+
+	// Handle compression of the web console content
+	compression := httpCompressionNeeded(proxy.transport.Quirks(), r)
+	acceptGzip := httpAcceptsGzip(r.Header)
+	if compression && proxy.transport.Quirks().GetWebCompression() ==
+		QuirkWebCompressionDisable {
+		r.Header.Del("Accept-Encoding")
+	}
+
+	resp := proxy.roundTrip(session, w, r)
+	if resp == nil {
+		return
+	}
+
+	decompressed := false
+	if compression && r.Method != "HEAD" &&
+		proxy.transport.Quirks().GetWebCompression() ==
+			QuirkWebCompressionDecompress {
+		decompressed = httpDecompressResponse(proxy.log, session, resp)
+	}
+
+	// Rewrite web console URLs, if needed
+	if httpRewriteNeeded(proxy.transport.Quirks(), r) {
+		base := &url.URL{Scheme: "http", Host: r.Host}
+		if r.TLS != nil {
+			base.Scheme = "https"
+		}
+
+		httpRewriteResponse(proxy.log, session, resp, base)
+	}
+
+	if decompressed && acceptGzip {
+		httpCompressResponse(resp)
+	}
+
+	proxy.sendResponse(session, w, resp)
+}
+
+// roundTrip sends request to the device and obtains response status
+// and header. On error, it responds to the client and returns nil
+func (proxy *HTTPProxy) roundTrip(session int, w http.ResponseWriter,
+	r *http.Request) *http.Response {
+
+	resp, err := proxy.transport.RoundTripWithSession(session, r)
+	if err != nil {
+		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
+		return nil
+	}
+
+	return resp
+}
+
+// sendResponse copies response, received from device, back to
+// the client
+func (proxy *HTTPProxy) sendResponse(session int, w http.ResponseWriter,
+	resp *http.Response) {
+
 	httpRemoveHopByHopHeaders(resp.Header)
 	httpCopyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
 	// Obtain response body, if any
-	_, err = io.Copy(w, resp.Body)
+	_, err := io.Copy(w, resp.Body)
 
 	if err != nil {
 		proxy.log.HTTPError('!', session, "%s", err)
@@ -266,3 +639,14 @@ func httpCopyHeaders(dst, src http.Header) {
 		dst[k] = v
 	}
 }
+
+// Check if URL path is the prefix path itself or any path
+// below it. Comparison is case-insensitive
+func httpPathIn(path, prefix string) bool {
+	if len(path) < len(prefix) ||
+		!strings.EqualFold(path[:len(prefix)], prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
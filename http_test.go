@@ -0,0 +1,92 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP proxy
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestHTTPPathIn tests httpPathIn
+func TestHTTPPathIn(t *testing.T) {
+	type testData struct {
+		path, prefix string
+		expected     bool
+	}
+
+	tests := []testData{
+		{"/ipp", "/ipp", true},
+		{"/ipp/print", "/ipp", true},
+		{"/IPP/faxout", "/ipp", true},
+		{"/ippx", "/ipp", false},
+		{"/ip", "/ipp", false},
+		{"/eSCL/ScannerStatus", "/eSCL", true},
+		{"/escl/ScannerStatus", "/eSCL", true},
+		{"/", "/eSCL", false},
+	}
+
+	for _, test := range tests {
+		present := httpPathIn(test.path, test.prefix)
+		if present != test.expected {
+			t.Errorf("httpPathIn(%q, %q): expected %v, present %v",
+				test.path, test.prefix, test.expected, present)
+		}
+	}
+}
+
+// TestHTTPFaxOutCheck tests detection of the IPP FaxOut service
+// failure by responses to the proxied requests
+func TestHTTPFaxOutCheck(t *testing.T) {
+	type testData struct {
+		status int          // HTTP status
+		ipp    goipp.Status // IPP status
+		failed bool         // Expected result
+	}
+
+	tests := []testData{
+		{http.StatusOK, goipp.StatusOk, false},
+		{http.StatusOK, goipp.StatusErrorServiceUnavailable, true},
+		{http.StatusNotFound, goipp.StatusOk, true},
+		{http.StatusServiceUnavailable, goipp.StatusOk, true},
+		{http.StatusBadRequest, goipp.StatusOk, false},
+	}
+
+	for _, test := range tests {
+		msg := goipp.NewResponse(goipp.DefaultVersion, test.ipp, 1)
+		data, _ := msg.EncodeBytes()
+
+		resp := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{"Content-Type": {goipp.ContentType}},
+			Body:       ioutil.NopCloser(bytes.NewReader(data)),
+		}
+
+		called := false
+		proxy := &HTTPProxy{log: NewLogger()}
+		proxy.OnFaxOutFailed(func() { called = true })
+
+		proxy.faxoutCheck(0, resp)
+
+		if proxy.FaxOutAvailable() == test.failed || called != test.failed {
+			t.Errorf("HTTP %d, IPP %s: failure expected %v, present %v",
+				test.status, test.ipp, test.failed, called)
+		}
+
+		// Response body must be preserved
+		body, _ := ioutil.ReadAll(resp.Body)
+		if !bytes.Equal(body, data) {
+			t.Errorf("HTTP %d, IPP %s: response body corrupted",
+				test.status, test.ipp)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Compression handling for the device web console
+ *
+ * Some devices return compressed (gzip or deflate) web console pages
+ * with broken Content-Length, that confuses clients. Depending on the
+ * web-compression quirk, compressed responses are either decompressed
+ * by proxy and sent to clients with correct framing (re-compressed
+ * with gzip, if client accepts it), or compression is not requested
+ * from device at all
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// httpCompressionNeeded tells if compression handling applies
+// to the request
+//
+// IPP and eSCL are never compressed by devices and not affected
+func httpCompressionNeeded(quirks Quirks, r *http.Request) bool {
+	return quirks.GetWebCompression() != QuirkWebCompressionPass &&
+		!httpPathIn(r.URL.Path, "/ipp") &&
+		!httpPathIn(r.URL.Path, "/eSCL")
+}
+
+// httpAcceptsGzip tells if client accepts gzip-compressed responses
+func httpAcceptsGzip(hdr http.Header) bool {
+	for _, v := range hdr["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			params := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != "gzip" && name != "x-gzip" {
+				continue
+			}
+
+			accepted := true
+			for _, param := range params[1:] {
+				param = strings.Replace(param, " ", "", -1)
+				if strings.HasPrefix(param, "q=0") &&
+					strings.Trim(param[3:], ".0") == "" {
+					accepted = false
+				}
+			}
+
+			if accepted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// httpDecompressResponse decompresses response body, if it is
+// compressed with gzip or deflate. Content-Encoding and Content-Length
+// headers are removed, so response will be sent with correct framing
+//
+// It returns true, if response was decompressed
+func httpDecompressResponse(log *Logger, session int,
+	resp *http.Response) bool {
+
+	enc := strings.ToLower(strings.TrimSpace(
+		resp.Header.Get("Content-Encoding")))
+
+	body := resp.Body
+	in := bufio.NewReader(body)
+	var out io.Reader
+
+	switch enc {
+	case "gzip", "x-gzip":
+		// Check magic first, so if it is not gzip actually,
+		// nothing is consumed from the body
+		hdr, err := in.Peek(2)
+		if err != nil || hdr[0] != 0x1f || hdr[1] != 0x8b {
+			log.HTTPError('!', session, "gzip: invalid header")
+			goto PASS
+		}
+
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			log.HTTPError('!', session, "gzip: %s", err)
+			goto PASS
+		}
+		out = gz
+
+	case "deflate":
+		// Per RFC 7230, this is zlib format, but many servers
+		// send the raw deflate stream instead
+		hdr, err := in.Peek(2)
+		if err == nil && hdr[0]&0x0f == 8 &&
+			(uint(hdr[0])<<8|uint(hdr[1]))%31 == 0 {
+			zr, err := zlib.NewReader(in)
+			if err != nil {
+				log.HTTPError('!', session, "deflate: %s", err)
+				goto PASS
+			}
+			out = zr
+		} else {
+			out = flate.NewReader(in)
+		}
+
+	default:
+		goto PASS
+	}
+
+	log.HTTPDebug(' ', session, "%s: response decompressed", enc)
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{out, body}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	return true
+
+	// Pass response as is, with already consumed bytes
+PASS:
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{in, body}
+
+	return false
+}
+
+// httpCompressResponse compresses response body with gzip. Compression
+// is performed on the fly, so response is sent chunked
+func httpCompressResponse(resp *http.Response) {
+	closer := &httpCompressCloser{
+		body: resp.Body,
+		done: make(chan struct{}),
+	}
+
+	var pw *io.PipeWriter
+	closer.pr, pw = io.Pipe()
+
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, closer.body)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+		close(closer.done)
+	}()
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{closer.pr, closer}
+
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// httpCompressCloser closes both sides of compression pipe:
+// pipe reader, consumed by client, and original response body,
+// read by the compressing goroutine
+type httpCompressCloser struct {
+	pr   *io.PipeReader // Pipe reader
+	body io.ReadCloser  // Original body
+	done chan struct{}  // Closed when compressing goroutine exits
+}
+
+// Close closes httpCompressCloser
+//
+// Original body is closed first, so compressing goroutine, blocked
+// in reading it, is unblocked. Then pipe is closed, so goroutine
+// fails on the next write, and Close waits for goroutine to exit
+func (c *httpCompressCloser) Close() error {
+	err := c.body.Close()
+	c.pr.Close()
+	<-c.done
+	return err
+}
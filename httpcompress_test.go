@@ -0,0 +1,181 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for compression handling for the device web console
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestHTTPAcceptsGzip tests httpAcceptsGzip
+func TestHTTPAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected bool
+	}{
+		{"", false},
+		{"gzip, deflate, br", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000, identity", false},
+		{"br", false},
+	}
+
+	for _, test := range tests {
+		hdr := http.Header{}
+		if test.in != "" {
+			hdr.Set("Accept-Encoding", test.in)
+		}
+
+		if v := httpAcceptsGzip(hdr); v != test.expected {
+			t.Errorf("%q: expected %v, present %v",
+				test.in, test.expected, v)
+		}
+	}
+}
+
+// TestHTTPDecompressResponse tests httpDecompressResponse and
+// httpCompressResponse
+func TestHTTPDecompressResponse(t *testing.T) {
+	const text = "<html><body>Printer status</body></html>"
+
+	compress := func(enc string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+
+		switch enc {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "zlib":
+			w = zlib.NewWriter(&buf)
+		case "raw":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		default:
+			return []byte(text)
+		}
+
+		w.Write([]byte(text))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		compression  string // How body is compressed
+		encoding     string // Content-Encoding
+		decompressed bool   // Expected result
+	}{
+		{"gzip", "gzip", true},
+		{"zlib", "deflate", true},
+		{"raw", "deflate", true},
+		{"none", "", false},
+		{"none", "gzip", false},
+	}
+
+	for _, test := range tests {
+		data := compress(test.compression)
+		resp := &http.Response{
+			Header: http.Header{
+				"Content-Encoding": {test.encoding},
+				"Content-Length":   {"1"},
+			},
+			Body:          ioutil.NopCloser(bytes.NewReader(data)),
+			ContentLength: 1,
+		}
+
+		ok := httpDecompressResponse(NewLogger(), 1, resp)
+		if ok != test.decompressed {
+			t.Errorf("%s/%s: expected %v, present %v",
+				test.compression, test.encoding,
+				test.decompressed, ok)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if ok {
+			if string(body) != text {
+				t.Errorf("%s/%s: body mismatch: %q",
+					test.compression, test.encoding, body)
+			}
+
+			if resp.Header.Get("Content-Encoding") != "" ||
+				resp.Header.Get("Content-Length") != "" ||
+				resp.ContentLength != -1 {
+				t.Errorf("%s/%s: framing headers not removed",
+					test.compression, test.encoding)
+			}
+		} else if !bytes.Equal(body, data) {
+			t.Errorf("%s/%s: body modified",
+				test.compression, test.encoding)
+		}
+	}
+
+	// Check re-compression
+	resp := &http.Response{
+		Header: http.Header{"Content-Length": {"1"}},
+		Body:   ioutil.NopCloser(bytes.NewReader([]byte(text))),
+	}
+
+	httpCompressResponse(resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" ||
+		resp.Header.Get("Content-Length") != "" {
+		t.Errorf("compress: bad headers %v", resp.Header)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(gz)
+	if string(body) != text {
+		t.Errorf("compress: body mismatch: %q", body)
+	}
+
+	resp.Body.Close()
+}
+
+// TestHTTPCompressClose tests that closing of the compressed body
+// doesn't hang, while compressor is blocked reading the original body
+func TestHTTPCompressClose(t *testing.T) {
+	upstream, pw := io.Pipe()
+	defer pw.Close()
+
+	resp := &http.Response{
+		Header: http.Header{},
+		Body:   upstream,
+	}
+
+	// Compressor blocks reading the original body, as nothing
+	// is written into the pipe
+	httpCompressResponse(resp)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- resp.Body.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close hangs")
+	}
+
+	// Original body must be closed
+	_, err := pw.Write([]byte("data"))
+	if err != io.ErrClosedPipe {
+		t.Errorf("original body not closed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * URL rewriting for the device web console
+ *
+ * Embedded web servers often generate absolute URLs and redirects,
+ * pointing to the device's internal host name, that doesn't work
+ * when proxied via localhost:port. When enabled by the web-url-rewrite
+ * quirk, such URLs are rewritten to point to the proxy
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// httpRewriteURLRe matches scheme and host part of absolute URLs
+var httpRewriteURLRe = regexp.MustCompile(`(?i)\bhttps?://[-a-z0-9.:\[\]]+`)
+
+// httpRewriteContentTypes lists types of content, which body
+// is subject to rewriting
+var httpRewriteContentTypes = []string{
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/xhtml+xml",
+}
+
+// httpRewriteNeeded tells if response to the request needs rewriting
+//
+// IPP and eSCL responses are never rewritten
+func httpRewriteNeeded(quirks Quirks, r *http.Request) bool {
+	return quirks.GetWebURLRewrite() &&
+		!httpPathIn(r.URL.Path, "/ipp") &&
+		!httpPathIn(r.URL.Path, "/eSCL")
+}
+
+// httpRewriteResponse rewrites response headers and body, so
+// absolute URLs, that point to the device, point to the proxy
+// base URL instead
+func httpRewriteResponse(log *Logger, session int, resp *http.Response,
+	base *url.URL) {
+
+	// Rewrite headers
+	for _, name := range []string{"Location", "Content-Location", "Refresh"} {
+		if v := resp.Header.Get(name); v != "" {
+			resp.Header.Set(name, httpRewriteURLs(v, base))
+		}
+	}
+
+	if cookies := resp.Header["Set-Cookie"]; len(cookies) != 0 {
+		for i, cookie := range cookies {
+			cookies[i] = httpRewriteCookie(cookie, base)
+		}
+	}
+
+	// Check if body needs rewriting
+	if resp.Header.Get("Content-Encoding") != "" ||
+		!httpRewriteContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	// Prefetch the body. Too large bodies are passed as is
+	body := resp.Body
+	data, err := ioutil.ReadAll(io.LimitReader(body, HTTPRewriteMaxBody+1))
+	if err != nil || len(data) > HTTPRewriteMaxBody {
+		log.HTTPDebug(' ', session, "URL rewrite: body skipped")
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		return
+	}
+
+	rewritten := httpRewriteURLs(string(data), base)
+	if len(rewritten) != len(data) {
+		log.HTTPDebug(' ', session, "URL rewrite: %d bytes replaced with %d",
+			len(data), len(rewritten))
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{strings.NewReader(rewritten), body}
+
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+}
+
+// httpRewriteURLs rewrites absolute URLs in the text
+func httpRewriteURLs(text string, base *url.URL) string {
+	return httpRewriteURLRe.ReplaceAllStringFunc(text, func(s string) string {
+		host := s[strings.Index(s, "://")+3:]
+		if httpRewriteHostInternal(host) {
+			return base.Scheme + "://" + base.Host
+		}
+		return s
+	})
+}
+
+// httpRewriteHostInternal tells if host (with optional port) is the
+// device's internal name: loopback address, "localhost" or the
+// single-label host name, as devices typically use
+func httpRewriteHostInternal(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+
+	return !strings.Contains(host, ".")
+}
+
+// httpRewriteCookie rewrites the Set-Cookie header value: Domain
+// attribute is removed, so cookie applies to the proxy host, and
+// Secure attribute is removed, if proxy is accessed via plain HTTP
+func httpRewriteCookie(cookie string, base *url.URL) string {
+	attrs := strings.Split(cookie, ";")
+	out := attrs[:1]
+
+	for _, attr := range attrs[1:] {
+		name := strings.TrimSpace(attr)
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			continue
+		case strings.EqualFold(name, "Secure") && base.Scheme != "https":
+			continue
+		}
+
+		out = append(out, attr)
+	}
+
+	return strings.Join(out, ";")
+}
+
+// httpRewriteContentType tells if content of the specified
+// Content-Type needs rewriting
+func httpRewriteContentType(ct string) bool {
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	for _, t := range httpRewriteContentTypes {
+		if ct == t {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for URL rewriting of the device web console
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestHTTPRewriteURLs tests rewriting of absolute URLs
+func TestHTTPRewriteURLs(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "localhost:60000"}
+
+	type testData struct {
+		in, out string
+	}
+
+	tests := []testData{
+		{`<a href="http://NPI1A2B3C/status">`,
+			`<a href="http://localhost:60000/status">`},
+		{`<a href="https://localhost/x">`,
+			`<a href="http://localhost:60000/x">`},
+		{`url(http://127.0.0.1:80/a.css)`,
+			`url(http://localhost:60000/a.css)`},
+		{`http://[::1]:631/`, `http://localhost:60000/`},
+		{`<a href="http://www.example.com/support">`,
+			`<a href="http://www.example.com/support">`},
+		{`<a href="/relative">`, `<a href="/relative">`},
+		{`0; url=http://printer/index.html`,
+			`0; url=http://localhost:60000/index.html`},
+	}
+
+	for _, test := range tests {
+		out := httpRewriteURLs(test.in, base)
+		if out != test.out {
+			t.Errorf("%s:\n"+
+				"expected: %s\n"+
+				"present:  %s", test.in, test.out, out)
+		}
+	}
+}
+
+// TestHTTPRewriteCookie tests rewriting of Set-Cookie header
+func TestHTTPRewriteCookie(t *testing.T) {
+	plain := &url.URL{Scheme: "http", Host: "localhost:60000"}
+	secure := &url.URL{Scheme: "https", Host: "localhost:60001"}
+
+	in := "sid=123; Domain=NPI1A2B3C; Path=/; Secure; HttpOnly"
+
+	out := httpRewriteCookie(in, plain)
+	if out != "sid=123; Path=/; HttpOnly" {
+		t.Errorf("plain: %s", out)
+	}
+
+	out = httpRewriteCookie(in, secure)
+	if out != "sid=123; Path=/; Secure; HttpOnly" {
+		t.Errorf("secure: %s", out)
+	}
+}
+
+// TestHTTPRewriteResponse tests rewriting of the whole response
+func TestHTTPRewriteResponse(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "localhost:60000"}
+	body := `<a href="http://printer/index.html">`
+
+	resp := &http.Response{
+		Header: http.Header{
+			"Content-Type": {"text/html; charset=utf-8"},
+			"Location":     {"http://printer/login"},
+		},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+
+	httpRewriteResponse(NewLogger(), 1, resp, base)
+
+	if loc := resp.Header.Get("Location"); loc != "http://localhost:60000/login" {
+		t.Errorf("Location: %s", loc)
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	expected := `<a href="http://localhost:60000/index.html">`
+	if string(data) != expected {
+		t.Errorf("body: %s", data)
+	}
+
+	if resp.ContentLength != int64(len(expected)) {
+		t.Errorf("ContentLength: %d", resp.ContentLength)
+	}
+
+	// Non-HTML content must not be affected
+	resp = &http.Response{
+		Header: http.Header{"Content-Type": {"image/png"}},
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+
+	httpRewriteResponse(NewLogger(), 1, resp, base)
+	data, _ = ioutil.ReadAll(resp.Body)
+	if string(data) != body {
+		t.Errorf("image body modified: %s", data)
+	}
+}
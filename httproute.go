@@ -0,0 +1,141 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP request router
+ *
+ * Requests are dispatched by URL path to routes. Each route has
+ * its own handler and policies: request timeout, quirks that disable
+ * it and so on. Routes are shared between the HTTPProxy, which serves
+ * clients, and the UsbTransport, which applies per-route timeouts also
+ * to the requests, made by ipp-usb itself
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// httpRoute represents a single route
+type httpRoute struct {
+	name     string            // Route name, for logging
+	prefix   string            // URL path prefix, "" matches any path
+	timeout  httpRouteTimeout  // Request timeout
+	disabled httpRouteDisabled // Tells if route disabled, may be nil
+	serve    httpRouteServe    // Request handler
+}
+
+// httpRouteTimeout returns request timeout, 0 if none
+type httpRouteTimeout func(quirks Quirks) time.Duration
+
+// httpRouteDisabled returns error, if route is disabled by the
+// device quirks
+type httpRouteDisabled func(quirks Quirks) error
+
+// httpRouteServe handles HTTP request
+type httpRouteServe func(proxy *HTTPProxy, session int,
+	w http.ResponseWriter, r *http.Request, client AuthClient)
+
+// httpRoutes contains all routes. More specific routes go first,
+// the last route matches any path
+//
+// Note, it is initialized from init(), because route handlers
+// indirectly refer to httpRoutes
+var httpRoutes []*httpRoute
+
+func init() {
+	httpRoutes = []*httpRoute{
+		{
+			name:     "ipp-print",
+			prefix:   "/ipp/print",
+			timeout:  Quirks.GetTimeoutIpp,
+			disabled: httpRouteDisabledPrint,
+			serve:    (*HTTPProxy).serveIpp,
+		},
+		{
+			name:     "ipp-faxout",
+			prefix:   "/ipp/faxout",
+			timeout:  Quirks.GetTimeoutIpp,
+			disabled: httpRouteDisabledPrint,
+			serve:    (*HTTPProxy).serveFaxOut,
+		},
+		{
+			name:     "ipp",
+			prefix:   "/ipp",
+			timeout:  Quirks.GetTimeoutIpp,
+			disabled: httpRouteDisabledPrint,
+			serve:    (*HTTPProxy).serveIpp,
+		},
+		{
+			name:     "escl",
+			prefix:   "/eSCL",
+			timeout:  Quirks.GetTimeoutEscl,
+			disabled: httpRouteDisabledScan,
+			serve:    (*HTTPProxy).serveEscl,
+		},
+		{
+			name:    "icons",
+			prefix:  IconsURLPath,
+			timeout: Quirks.GetTimeoutWeb,
+			serve:   (*HTTPProxy).serveIcons,
+		},
+		{
+			name:    "web",
+			prefix:  "",
+			timeout: Quirks.GetTimeoutWeb,
+			serve:   (*HTTPProxy).serveWeb,
+		},
+	}
+}
+
+// httpRouteLookup returns route for the URL path. As the last
+// route matches any path, it never fails
+func httpRouteLookup(path string) *httpRoute {
+	for _, route := range httpRoutes {
+		if route.prefix == "" || httpPathIn(path, route.prefix) {
+			return route
+		}
+	}
+
+	// Never reached
+	return httpRoutes[len(httpRoutes)-1]
+}
+
+// checkDisabled returns error, if route is disabled by the device
+// quirks, or the URL path is not available in the device mode
+func (route *httpRoute) checkDisabled(quirks Quirks, path string) error {
+	if route.disabled != nil {
+		if err := route.disabled(quirks); err != nil {
+			return err
+		}
+	}
+
+	if !quirks.GetDeviceMode().AllowsPath(path) {
+		return fmt.Errorf("%s: not available in the %q mode",
+			path, quirks.GetDeviceMode())
+	}
+
+	return nil
+}
+
+// httpRouteDisabledPrint implements httpRouteDisabled for IPP routes
+func httpRouteDisabledPrint(quirks Quirks) error {
+	if quirks.GetDisablePrint() {
+		return fmt.Errorf("Printing disabled by the %q quirk",
+			QuirkNmDisablePrint)
+	}
+	return nil
+}
+
+// httpRouteDisabledScan implements httpRouteDisabled for eSCL route
+func httpRouteDisabledScan(quirks Quirks) error {
+	if quirks.GetDisableScan() {
+		return fmt.Errorf("Scanning disabled by the %q quirk",
+			QuirkNmDisableScan)
+	}
+	return nil
+}
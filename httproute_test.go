@@ -0,0 +1,75 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP request router
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestHTTPRouteLookup tests httpRouteLookup
+func TestHTTPRouteLookup(t *testing.T) {
+	tests := []struct {
+		path, route string
+	}{
+		{"/ipp/print", "ipp-print"},
+		{"/ipp/print/job", "ipp-print"},
+		{"/IPP/PRINT", "ipp-print"},
+		{"/ipp/faxout", "ipp-faxout"},
+		{"/ipp/scan", "ipp"},
+		{"/ipp", "ipp"},
+		{"/ipp-usb/icons/icon.png", "icons"},
+		{"/eSCL/ScannerCapabilities", "escl"},
+		{"/eSCLx", "web"},
+		{"/", "web"},
+		{"", "web"},
+	}
+
+	for _, test := range tests {
+		route := httpRouteLookup(test.path)
+		if route.name != test.route {
+			t.Errorf("%q: expected %s, present %s",
+				test.path, test.route, route.name)
+		}
+	}
+}
+
+// TestHTTPRouteDisabled tests disabling of routes by quirks
+func TestHTTPRouteDisabled(t *testing.T) {
+	quirks := func(name string, value interface{}) Quirks {
+		return Quirks{byName: map[string]*Quirk{
+			name: {Name: name, Parsed: value},
+		}}
+	}
+
+	tests := []struct {
+		quirks   Quirks
+		path     string
+		disabled bool
+	}{
+		{Quirks{}, "/ipp/print", false},
+		{Quirks{}, "/eSCL/ScannerStatus", false},
+		{quirks(QuirkNmDisablePrint, true), "/ipp/print", true},
+		{quirks(QuirkNmDisablePrint, true), "/ipp/faxout", true},
+		{quirks(QuirkNmDisablePrint, true), "/eSCL/ScannerStatus", false},
+		{quirks(QuirkNmDisableScan, true), "/eSCL/ScannerStatus", true},
+		{quirks(QuirkNmDisableScan, true), "/ipp/print", false},
+		{quirks(QuirkNmDeviceMode, QuirkDeviceModeScanOnly), "/ipp/print", true},
+		{quirks(QuirkNmDeviceMode, QuirkDeviceModeScanOnly), "/eSCL", false},
+		{quirks(QuirkNmDeviceMode, QuirkDeviceModeScanOnly), "/", false},
+	}
+
+	for _, test := range tests {
+		route := httpRouteLookup(test.path)
+		err := route.checkDisabled(test.quirks, test.path)
+		if (err != nil) != test.disabled {
+			t.Errorf("%q: disabled expected %v, present %v",
+				test.path, test.disabled, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * ICC profiles lookup
+ *
+ * When enabled, ipp-usb looks for locally installed ICC profiles
+ * (the same directories, colord uses), and chooses the best match
+ * for the device by its make and model. The result is exposed via
+ * the control socket, helping desktop color management to associate
+ * profiles with the USB driverless printers.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// iccProfileDirs lists directories, where ICC profiles are searched
+var iccProfileDirs = []string{
+	"/usr/share/color/icc",
+	"/usr/local/share/color/icc",
+	"/var/lib/colord/icc",
+}
+
+// iccMaxFileSize is the maximum size of ICC file we are willing to load
+const iccMaxFileSize = 16 * 1024 * 1024
+
+// ICCProfileInfo represents information, extracted from the ICC profile
+type ICCProfileInfo struct {
+	Path         string // Path to the profile file
+	Class        string // Profile/device class, i.e. "prtr"
+	Description  string // Profile description ('desc' tag)
+	Manufacturer string // Device manufacturer ('dmnd' tag)
+	Model        string // Device model ('dmdd' tag)
+}
+
+// ICCProfileLookup looks for the best matching printer ICC profile
+// for the device. It returns path to the profile or "", if nothing
+// found
+func ICCProfileLookup(info UsbDeviceInfo) string {
+	var profiles []*ICCProfileInfo
+
+	for _, dir := range iccProfileDirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			ext := strings.ToLower(filepath.Ext(path))
+			if ext != ".icc" && ext != ".icm" {
+				return nil
+			}
+
+			if fi.Size() > iccMaxFileSize {
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+
+			prof, err := ICCProfileDecode(data)
+			if err == nil {
+				prof.Path = path
+				profiles = append(profiles, prof)
+			}
+
+			return nil
+		})
+	}
+
+	prof := iccProfileBestMatch(profiles, info.Manufacturer,
+		info.ProductName)
+	if prof == nil {
+		return ""
+	}
+
+	return prof.Path
+}
+
+// ICCProfileDecode decodes ICC profile header and text tags
+func ICCProfileDecode(data []byte) (*ICCProfileInfo, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("ICC: invalid profile header")
+	}
+
+	prof := &ICCProfileInfo{
+		Class: string(data[12:16]),
+	}
+
+	// Parse the tag table
+	cnt := int(binary.BigEndian.Uint32(data[128:]))
+	if cnt > (len(data)-132)/12 {
+		return nil, errors.New("ICC: invalid tag count")
+	}
+
+	for i := 0; i < cnt; i++ {
+		ent := data[132+i*12:]
+		sig := string(ent[0:4])
+		off := int(binary.BigEndian.Uint32(ent[4:]))
+		size := int(binary.BigEndian.Uint32(ent[8:]))
+
+		if off < 0 || size < 0 || off > len(data) || size > len(data)-off {
+			continue
+		}
+
+		var out *string
+		switch sig {
+		case "desc":
+			out = &prof.Description
+		case "dmnd":
+			out = &prof.Manufacturer
+		case "dmdd":
+			out = &prof.Model
+		default:
+			continue
+		}
+
+		*out = iccDecodeText(data[off : off+size])
+	}
+
+	return prof, nil
+}
+
+// iccDecodeText decodes text from the textDescriptionType (ICC v2)
+// or multiLocalizedUnicodeType (ICC v4) tag. For the later, the
+// first record is used
+func iccDecodeText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+
+	switch string(tag[0:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			n = len(tag) - 12
+		}
+
+		s := tag[12 : 12+n]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+
+		return strings.TrimSpace(string(s))
+
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		off := int(binary.BigEndian.Uint32(tag[24:]))
+		if off < 0 || n < 0 || off > len(tag) || n > len(tag)-off {
+			return ""
+		}
+
+		s := tag[off : off+n]
+		u := make([]uint16, len(s)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(s[i*2:])
+		}
+
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+
+	return ""
+}
+
+// iccProfileBestMatch chooses the best matching printer profile
+// for the given manufacturer and model
+//
+// All words of the model name must be present in the profile's
+// model, description or manufacturer text. Matching manufacturer
+// makes profile preferable, then more specific (shorter) text
+// wins
+func iccProfileBestMatch(profiles []*ICCProfileInfo,
+	mfg, model string) *ICCProfileInfo {
+
+	modelWords := iccWords(model)
+	if len(modelWords) == 0 {
+		return nil
+	}
+
+	mfgWords := iccWords(mfg)
+
+	var best *ICCProfileInfo
+	bestScore, bestLen := -1, 0
+
+	for _, prof := range profiles {
+		if prof.Class != "prtr" {
+			continue
+		}
+
+		text := strings.Join([]string{prof.Manufacturer, prof.Model,
+			prof.Description}, " ")
+		words := make(map[string]bool)
+		for _, w := range iccWords(text) {
+			words[w] = true
+		}
+
+		matched := true
+		for _, w := range modelWords {
+			if !words[w] {
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		score := 0
+		for _, w := range mfgWords {
+			if words[w] {
+				score++
+			}
+		}
+
+		if score > bestScore || (score == bestScore && len(text) < bestLen) {
+			best, bestScore, bestLen = prof, score, len(text)
+		}
+	}
+
+	return best
+}
+
+// iccWords splits string into lower-case alphanumeric words
+func iccWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
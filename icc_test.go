@@ -0,0 +1,115 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for ICC profiles lookup
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// iccTestProfile builds a minimal ICC profile with the given
+// class and text tags. Tags are encoded as mluc, if v4 is true,
+// and as desc otherwise
+func iccTestProfile(class string, v4 bool, tags map[string]string) []byte {
+	hdr := make([]byte, 128)
+	copy(hdr[12:], class)
+	copy(hdr[36:], "acsp")
+
+	var table, body bytes.Buffer
+	off := 128 + 4 + 12*len(tags)
+
+	binary.Write(&table, binary.BigEndian, uint32(len(tags)))
+
+	for _, sig := range []string{"desc", "dmnd", "dmdd"} {
+		text, ok := tags[sig]
+		if !ok {
+			continue
+		}
+
+		var tag bytes.Buffer
+		if v4 {
+			u := utf16.Encode([]rune(text))
+			tag.WriteString("mluc")
+			binary.Write(&tag, binary.BigEndian, []uint32{
+				0, 1, 12})
+			tag.WriteString("enUS")
+			binary.Write(&tag, binary.BigEndian, []uint32{
+				uint32(len(u) * 2), 28})
+			binary.Write(&tag, binary.BigEndian, u)
+		} else {
+			tag.WriteString("desc")
+			binary.Write(&tag, binary.BigEndian, []uint32{
+				0, uint32(len(text) + 1)})
+			tag.WriteString(text)
+			tag.WriteByte(0)
+		}
+
+		table.WriteString(sig)
+		binary.Write(&table, binary.BigEndian, []uint32{
+			uint32(off + body.Len()), uint32(tag.Len())})
+		body.Write(tag.Bytes())
+	}
+
+	return append(append(hdr, table.Bytes()...), body.Bytes()...)
+}
+
+// TestICCProfileDecode tests ICCProfileDecode
+func TestICCProfileDecode(t *testing.T) {
+	tags := map[string]string{
+		"desc": "Glossy paper",
+		"dmnd": "Hewlett-Packard",
+		"dmdd": "HP LaserJet MFP M28w",
+	}
+
+	for _, v4 := range []bool{false, true} {
+		prof, err := ICCProfileDecode(iccTestProfile("prtr", v4, tags))
+		if err != nil {
+			t.Errorf("v4=%v: %s", v4, err)
+			continue
+		}
+
+		if prof.Class != "prtr" ||
+			prof.Description != tags["desc"] ||
+			prof.Manufacturer != tags["dmnd"] ||
+			prof.Model != tags["dmdd"] {
+			t.Errorf("v4=%v: decoded %#v", v4, prof)
+		}
+	}
+
+	_, err := ICCProfileDecode([]byte("garbage"))
+	if err == nil {
+		t.Errorf("garbage accepted")
+	}
+}
+
+// TestICCProfileBestMatch tests iccProfileBestMatch
+func TestICCProfileBestMatch(t *testing.T) {
+	profiles := []*ICCProfileInfo{
+		{Path: "monitor", Class: "mntr", Model: "HP LaserJet MFP M28w"},
+		{Path: "other", Class: "prtr", Model: "HP LaserJet Pro M404"},
+		{Path: "generic", Class: "prtr",
+			Description: "HP LaserJet MFP M28w, all papers"},
+		{Path: "exact", Class: "prtr", Manufacturer: "HP",
+			Model: "HP LaserJet MFP M28w"},
+	}
+
+	prof := iccProfileBestMatch(profiles, "HP", "HP LaserJet MFP M28w")
+	if prof == nil || prof.Path != "exact" {
+		t.Errorf("wrong match: %#v", prof)
+	}
+
+	prof = iccProfileBestMatch(profiles, "Canon", "Canon PIXMA G3010")
+	if prof != nil {
+		t.Errorf("unexpected match: %#v", prof)
+	}
+}
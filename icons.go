@@ -0,0 +1,233 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Local caching of printer icons
+ *
+ * The printer-icons URLs, returned by device, point to the device's
+ * internal web server, and often use host names, not resolvable from
+ * the host computer. So icons are downloaded at device initialization,
+ * saved under the PathIconsDir/<ident>/ directory and served by the
+ * ipp-usb HTTP server locally, and printer-icons URLs in the IPP
+ * responses and DNS-SD TXT records are replaced with the local ones
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// IconsURLPath is the URL path of locally cached icons
+const IconsURLPath = "/ipp-usb/icons"
+
+// Icons represents locally cached device icons
+type Icons struct {
+	dir   string   // Cache directory
+	names []string // File names of icons, in order of printer-icons
+}
+
+// IconsFetch downloads device icons, using the provided http.Client,
+// and saves them into the cache directory of the device with the
+// specified ident
+//
+// If icon cannot be downloaded, the copy, cached by the previous
+// run, is used, if available. If no icons available, nil is returned
+//
+// In read-only mode icons are not cached, and nil is returned
+func IconsFetch(log *LogMessage, client *http.Client, ident string,
+	urls []string) *Icons {
+
+	if Conf.StateReadOnly {
+		log.Debug(' ', "icons: not cached in read-only mode")
+		return nil
+	}
+
+	icons := &Icons{dir: filepath.Join(PathIconsDir, ident)}
+	err := os.MkdirAll(icons.dir, 0755)
+	if err != nil {
+		log.Error('!', "icons: %s", err)
+		return nil
+	}
+
+	for i, u := range urls {
+		base := fmt.Sprintf("icon-%d", i)
+		name, err := icons.fetch(client, base, u)
+		if err != nil {
+			log.Debug(' ', "icons: %s: %s", u, err)
+
+			// Try previously cached copy
+			cached, _ := filepath.Glob(filepath.Join(icons.dir,
+				base+".*"))
+			if len(cached) == 0 {
+				continue
+			}
+
+			name = filepath.Base(cached[0])
+			log.Debug(' ', "icons: %s: using cached copy", u)
+		} else {
+			log.Debug(' ', "icons: %s: saved as %s", u, name)
+		}
+
+		icons.names = append(icons.names, name)
+	}
+
+	if len(icons.names) == 0 {
+		return nil
+	}
+
+	return icons
+}
+
+// fetch downloads single icon and saves it under the base name,
+// with extension, chosen by Content-Type. Saved file name returned
+func (icons *Icons) fetch(client *http.Client, base, u string) (
+	string, error) {
+
+	// Device URLs use device's internal host name, but
+	// IPP over USB always talks to "localhost"
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	rqURL := &url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     parsed.Path,
+		RawQuery: parsed.RawQuery,
+	}
+
+	resp, err := client.Get(rqURL.String())
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, IconsMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > IconsMaxSize {
+		return "", fmt.Errorf("icon exceeds %d bytes", IconsMaxSize)
+	}
+
+	// Save the icon. Old copies with different extension,
+	// if any, are removed
+	name := base + iconsExt(resp.Header.Get("Content-Type"), parsed.Path)
+	old, _ := filepath.Glob(filepath.Join(icons.dir, base+".*"))
+	for _, file := range old {
+		os.Remove(file)
+	}
+
+	tmp := filepath.Join(icons.dir, name+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(icons.dir, name))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// URLs returns local URLs of cached icons, for the specified
+// scheme and host
+func (icons *Icons) URLs(scheme, host string) []string {
+	urls := make([]string, len(icons.names))
+	for i, name := range icons.names {
+		urls[i] = scheme + "://" + host + IconsURLPath + "/" + name
+	}
+	return urls
+}
+
+// Serve serves the cached icon
+func (icons *Icons) Serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Only names of cached icons are accepted, so
+	// request can't escape the cache directory
+	name := path.Base(r.URL.Path)
+	for _, n := range icons.names {
+		if n == name {
+			http.ServeFile(w, r, filepath.Join(icons.dir, name))
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// RewriteIpp replaces printer-icons URLs in the IPP message with
+// the local ones. It returns true, if message was modified
+func (icons *Icons) RewriteIpp(msg *goipp.Message, scheme, host string) bool {
+	for _, grp := range msg.Groups {
+		if grp.Tag != goipp.TagPrinterGroup {
+			continue
+		}
+
+		for i := range grp.Attrs {
+			attr := &grp.Attrs[i]
+			if attr.Name != "printer-icons" {
+				continue
+			}
+
+			attr.Values = nil
+			for _, u := range icons.URLs(scheme, host) {
+				attr.Values.Add(goipp.TagURI, goipp.String(u))
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// iconsExt returns file name extension for the icon with the
+// specified Content-Type and URL path
+func iconsExt(contentType, urlPath string) string {
+	switch strings.ToLower(strings.TrimSpace(
+		strings.Split(contentType, ";")[0])) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/svg+xml":
+		return ".svg"
+	}
+
+	switch ext := strings.ToLower(path.Ext(urlPath)); ext {
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg":
+		return ext
+	}
+
+	return ".png"
+}
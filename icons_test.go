@@ -0,0 +1,119 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for local caching of printer icons
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestIconsExt tests choice of icon file extension
+func TestIconsExt(t *testing.T) {
+	type testData struct {
+		contentType, path, ext string
+	}
+
+	tests := []testData{
+		{"image/png", "/icon", ".png"},
+		{"image/jpeg; charset=binary", "/icon", ".jpg"},
+		{"application/octet-stream", "/images/icon.GIF", ".gif"},
+		{"", "/icon.exe", ".png"},
+	}
+
+	for _, test := range tests {
+		ext := iconsExt(test.contentType, test.path)
+		if ext != test.ext {
+			t.Errorf("%q %q: expected %q, present %q",
+				test.contentType, test.path, test.ext, ext)
+		}
+	}
+}
+
+// TestIconsRewriteIpp tests replacing of printer-icons in IPP message
+func TestIconsRewriteIpp(t *testing.T) {
+	icons := &Icons{names: []string{"icon-0.png", "icon-1.png"}}
+
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Groups.Add(goipp.Group{Tag: goipp.TagPrinterGroup})
+	msg.Groups[0].Attrs.Add(goipp.MakeAttribute("printer-icons",
+		goipp.TagURI, goipp.String("http://NPI1A2B3C/icon.png")))
+
+	if !icons.RewriteIpp(msg, "http", "localhost:60000") {
+		t.Fatalf("printer-icons not rewritten")
+	}
+
+	vals := msg.Groups[0].Attrs[0].Values
+	expected := []string{
+		"http://localhost:60000/ipp-usb/icons/icon-0.png",
+		"http://localhost:60000/ipp-usb/icons/icon-1.png",
+	}
+
+	if len(vals) != len(expected) {
+		t.Fatalf("expected %d values, present %d",
+			len(expected), len(vals))
+	}
+
+	for i := range expected {
+		if vals[i].V.String() != expected[i] {
+			t.Errorf("expected %s, present %s",
+				expected[i], vals[i].V)
+		}
+	}
+
+	// Message without printer-icons is not affected
+	msg = goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	if icons.RewriteIpp(msg, "http", "localhost:60000") {
+		t.Errorf("message without printer-icons modified")
+	}
+}
+
+// TestIconsServe tests serving of cached icons
+func TestIconsServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-icons")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "icon-0.png"), []byte("PNG"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+
+	icons := &Icons{dir: dir, names: []string{"icon-0.png"}}
+
+	type testData struct {
+		method, path string
+		status       int
+	}
+
+	tests := []testData{
+		{"GET", IconsURLPath + "/icon-0.png", http.StatusOK},
+		{"GET", IconsURLPath + "/secret", http.StatusNotFound},
+		{"GET", IconsURLPath + "/../secret", http.StatusNotFound},
+		{"POST", IconsURLPath + "/icon-0.png",
+			http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, test.path, nil)
+		icons.Serve(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected status %d, present %d",
+				test.method, test.path, test.status, w.Code)
+		}
+	}
+}
@@ -13,7 +13,10 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -91,6 +94,28 @@ func OpenIniFileWithRecType(path string) (ini *IniFile, err error) {
 	return
 }
 
+// IniListDropIns returns list of the drop-in .INI files (*.conf)
+// in the directory, in lexical order. Missing directory is not
+// an error, it just means no drop-ins
+func IniListDropIns(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	list := files[:0]
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err == nil && fi.Mode().IsRegular() {
+			list = append(list, file)
+		}
+	}
+
+	return list, nil
+}
+
 // Lock manages file lock on underlying disk file
 func (ini *IniFile) Lock(cmd FileLockCmd) error {
 	return FileLock(ini.file, cmd)
@@ -203,7 +228,9 @@ func (ini *IniFile) token(delimiter rune, linecont bool) (byte, string, error) {
 		case prsBody:
 			if c == '"' {
 				state = prsString
-			} else if ini.iscomment(c) {
+			} else if ini.iscomment(c) && delimiter != ']' {
+				// Note, comment characters are allowed within
+				// section names (i.e., [Model; fw>=1.0])
 				state = prsComment
 			} else if c == '\\' && linecont {
 				c2, _ := ini.getc()
@@ -443,37 +470,47 @@ func (rec *IniRecord) LoadNamedBool(out *bool, vFalse, vTrue string) error {
 // LoadLogLevel loads LogLevel value
 // The destination remains untouched in a case of an error
 func (rec *IniRecord) LoadLogLevel(out *LogLevel) error {
-	var mask LogLevel
-
-	for _, s := range strings.Split(rec.Value, ",") {
-		s = strings.TrimSpace(s)
-		switch s {
-		case "":
-		case "error":
-			mask |= LogError
-		case "info":
-			mask |= LogInfo | LogError
-		case "debug":
-			mask |= LogDebug | LogInfo | LogError
-		case "trace-ipp":
-			mask |= LogTraceIPP | LogDebug | LogInfo | LogError
-		case "trace-escl":
-			mask |= LogTraceESCL | LogDebug | LogInfo | LogError
-		case "trace-http":
-			mask |= LogTraceHTTP | LogDebug | LogInfo | LogError
-		case "trace-usb":
-			mask |= LogTraceUSB | LogDebug | LogInfo | LogError
-		case "all", "trace-all":
-			mask |= LogAll & ^LogTraceUSB
-		default:
-			return rec.errBadValue("invalid log level %q", s)
-		}
+	mask, err := LogLevelParse(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
 	}
 
 	*out = mask
 	return nil
 }
 
+// LoadLogFormat loads LogFormat value
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadLogFormat(out *LogFormat) error {
+	switch rec.Value {
+	case "text":
+		*out = LogFormatText
+	case "json":
+		*out = LogFormatJSON
+	default:
+		return rec.errBadValue("must be text or json")
+	}
+
+	return nil
+}
+
+// LoadAccessFormat loads AccessFormat value
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadAccessFormat(out *AccessFormat) error {
+	switch rec.Value {
+	case "disable":
+		*out = AccessFormatNone
+	case "combined":
+		*out = AccessFormatCombined
+	case "json":
+		*out = AccessFormatJSON
+	default:
+		return rec.errBadValue("must be disable, combined or json")
+	}
+
+	return nil
+}
+
 // LoadDuration loads time.Duration value
 // The destination remains untouched in a case of an error
 func (rec *IniRecord) LoadDuration(out *time.Duration) error {
@@ -552,6 +589,46 @@ func (rec *IniRecord) LoadUintRange(out *uint, min, max uint) error {
 	return nil
 }
 
+// LoadSubnets loads comma-separated list of subnets in CIDR notation.
+// Address without prefix length is treated as a single host
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadSubnets(out *[]*net.IPNet) error {
+	var subnets []*net.IPNet
+
+	for _, s := range strings.Split(rec.Value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return rec.errBadValue("%q: invalid address", s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			subnets = append(subnets,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return rec.errBadValue("%q: invalid subnet", s)
+		}
+
+		subnets = append(subnets, subnet)
+	}
+
+	*out = subnets
+	return nil
+}
+
 // LoadAuthUIDRules loads AuthUIDRule-s value and appends them
 // to the destination
 //
@@ -614,6 +691,74 @@ func (rec *IniRecord) LoadAuthUIDRules(out *[]*AuthUIDRule) error {
 	return nil
 }
 
+// LoadIppPolicy loads the [ipp policy] rule. Key is the IPP
+// operation, value is the IppPolicyAction
+func (rec *IniRecord) LoadIppPolicy(out *IppPolicy) error {
+	op, err := IppPolicyParseOp(rec.Key)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	action, err := IppPolicyParseAction(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	if *out == nil {
+		*out = make(IppPolicy)
+	}
+
+	(*out)[op] = action
+	return nil
+}
+
+// LoadDNSSdNameTmpl loads DNS-SD name template
+func (rec *IniRecord) LoadDNSSdNameTmpl(out *DNSSdNameTmpl) error {
+	tmpl, err := DNSSdNameTmplParse(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	*out = tmpl
+	return nil
+}
+
+// LoadDNSSdURLHost loads the dns-sd-url-host parameter
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadDNSSdURLHost(out *string) error {
+	host, err := DNSSdURLHostParse(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%s", err)
+	}
+
+	*out = host
+	return nil
+}
+
+// LoadInterface loads name of the existing network interface
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadInterface(out *string) error {
+	_, err := net.InterfaceByName(rec.Value)
+	if err != nil {
+		return rec.errBadValue("%q: %s", rec.Value, err)
+	}
+
+	*out = rec.Value
+	return nil
+}
+
+// LoadPath loads absolute path to file or directory. The path
+// is cleaned; trailing slash, if any, is removed
+// The destination remains untouched in a case of an error
+func (rec *IniRecord) LoadPath(out *string) error {
+	if !filepath.IsAbs(rec.Value) {
+		return rec.errBadValue("%q: must be absolute path", rec.Value)
+	}
+
+	*out = filepath.Clean(rec.Value)
+	return nil
+}
+
 // errBadValue creates a "bad value" error related to the INI record
 func (rec *IniRecord) errBadValue(format string, args ...interface{}) error {
 	return &IniError{
@@ -0,0 +1,76 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Execution of the declarative device initialization script
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// InitScriptRun executes the device initialization script,
+// configured by the init-script quirk
+func InitScriptRun(log *LogMessage, script QuirkInitScript,
+	transport *UsbTransport, c *http.Client) error {
+
+	if len(script) == 0 {
+		return nil
+	}
+
+	status := 0
+	for _, step := range script {
+		log.Debug(' ', "INIT-SCRIPT: %s", step)
+
+		switch step.Op {
+		case QuirkInitDelay:
+			time.Sleep(step.Delay)
+
+		case QuirkInitSoftReset:
+			ctx, cancel := context.WithTimeout(context.Background(),
+				DevInitTimeout)
+			err := transport.SoftReset(ctx)
+			cancel()
+
+			if err != nil {
+				return fmt.Errorf("init-script: %s: %s", step, err)
+			}
+
+		case QuirkInitProbe:
+			rsp, err := c.Get("http://localhost" + step.Path)
+			if err != nil {
+				return fmt.Errorf("init-script: %s: %s", step, err)
+			}
+
+			io.Copy(ioutil.Discard, rsp.Body)
+			rsp.Body.Close()
+
+			status = rsp.StatusCode
+			log.Debug(' ', "INIT-SCRIPT: HTTP status: %s", rsp.Status)
+
+		case QuirkInitExpect:
+			if status != step.Status {
+				return fmt.Errorf("init-script: %s: got %d",
+					step, status)
+			}
+
+		case QuirkInitControl:
+			err := transport.ControlTransfer(step.RequestType,
+				step.Request, step.Value, step.Index)
+
+			if err != nil {
+				return fmt.Errorf("init-script: %s: %s", step, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -11,8 +11,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/OpenPrinting/goipp"
@@ -22,11 +25,20 @@ import (
 // is not included into DNS-SD TXT record, but still needed for
 // other purposes
 type IppPrinterInfo struct {
-	DNSSdName   string // DNS-SD device name
-	UUID        string // Device UUID
-	AdminURL    string // Admin URL
-	IconURL     string // Device icon URL
-	IppSvcIndex int    // IPP DNSSdSvcInfo index within array of services
+	DNSSdName   string   // DNS-SD device name
+	UUID        string   // Device UUID
+	AdminURL    string   // Admin URL
+	IconURL     string   // Device icon URL
+	IconURLs    []string // All device icon URLs
+	Location    string   // Device location
+	Info        string   // printer-info
+	Make        string   // Manufacturer, from IEEE 1284 device ID
+	Model       string   // Model, from IEEE 1284 device ID
+	IppSvcIndex int      // IPP DNSSdSvcInfo index within array of services
+	FaxCapable  bool     // Device lists Fax in its capabilities
+	FaxOut      bool     // IPP FaxOut service detected
+	Firmware    string   // Firmware version, "" if unknown
+	Attrs       []byte   // Get-Printer-Attributes response, encoded
 }
 
 // IppService performs IPP Get-Printer-Attributes query using provided
@@ -47,12 +59,14 @@ func IppService(log *LogMessage, services *DNSSdServices,
 
 	// Decode IPP service info
 	attrs := newIppDecoder(msg)
-	ippinfo, ippSvc := attrs.decode(usbinfo)
+	ippinfo, ippSvc := attrs.decode(usbinfo, quirks)
+	ippinfo.Attrs, _ = msg.EncodeBytes()
 
 	// Check for fax support
-	canFax := false
-	if usbinfo.BasicCaps&UsbIppBasicCapsFax != 0 &&
-		!quirks.GetDisableFax() {
+	ippinfo.FaxCapable = usbinfo.BasicCaps&UsbIppBasicCapsFax != 0 &&
+		!quirks.GetDisableFax() && quirks.GetDeviceMode().Fax()
+
+	if ippinfo.FaxCapable {
 		// Note, as device lists Fax on its basic capabilities,
 		// this probe most likely is not needed, but as the
 		// ipp-usb version 0.9.19 and earlier used to guess
@@ -60,11 +74,10 @@ func IppService(log *LogMessage, services *DNSSdServices,
 		// not on device capabilities, lets leave it here
 		// for now, just in case. Firmwares in general are
 		// too buggy, I can't trust them :-(
-		uri = fmt.Sprintf("http://localhost:%d/ipp/faxout", port)
-		_, _, err2 := ippGetPrinterAttributes(log, c, quirks, uri)
+		err2 := IppFaxOutProbe(log, port, quirks, c)
 
 		if err2 == nil {
-			canFax = true
+			ippinfo.FaxOut = true
 			log.Debug(' ', "IPP FaxOut service detected")
 		} else {
 			log.Error('!', "IPP FaxOut probe failed: %s", err2)
@@ -73,12 +86,7 @@ func IppService(log *LogMessage, services *DNSSdServices,
 		log.Debug(' ', "IPP FaxOut service not in capabilities")
 	}
 
-	if canFax {
-		ippSvc.Txt.Add("Fax", "T")
-		ippSvc.Txt.Add("rfo", "ipp/faxout")
-	} else {
-		ippSvc.Txt.Add("Fax", "F")
-	}
+	ippSetFaxTxt(&ippSvc.Txt, ippinfo.FaxOut)
 
 	// Construct LPD info. Per Apple spec, we MUST advertise
 	// LPD with zero port, even if we don't support it
@@ -98,6 +106,130 @@ func IppService(log *LogMessage, services *DNSSdServices,
 	return
 }
 
+// IppAttrsPath returns path to the file, where the last
+// Get-Printer-Attributes response of the device is saved
+func IppAttrsPath(ident string) string {
+	return filepath.Join(PathAttrsDir, ident+".ipp")
+}
+
+// IppSaveAttrs saves the Get-Printer-Attributes response of the device,
+// so it can be included into the bug report (see `ipp-usb report`)
+//
+// In read-only mode, nothing is saved
+func IppSaveAttrs(ident string, data []byte) error {
+	if Conf.StateReadOnly {
+		return nil
+	}
+
+	err := os.MkdirAll(PathAttrsDir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(IppAttrsPath(ident), data, 0644)
+	}
+	return err
+}
+
+// ippSetFaxTxt sets Fax and rfo TXT record items, depending
+// on the IPP FaxOut service availability
+func ippSetFaxTxt(txt *DNSSdTxtRecord, canFax bool) {
+	if canFax {
+		txt.Set("Fax", "T")
+		txt.Set("rfo", "ipp/faxout")
+	} else {
+		txt.Set("Fax", "F")
+		txt.Del("rfo")
+	}
+}
+
+// IppFaxOutProbe probes the IPP FaxOut service
+func IppFaxOutProbe(log *LogMessage, port int, quirks Quirks,
+	c *http.Client) error {
+	uri := fmt.Sprintf("http://localhost:%d/ipp/faxout", port)
+	_, _, err := ippGetPrinterAttributes(log, c, quirks, uri)
+	return err
+}
+
+// IppPrewarm sends lightweight Get-Printer-Attributes request,
+// that only queries printer-state, to wake up the device
+func IppPrewarm(log *LogMessage, port int, c *http.Client) error {
+	uri := fmt.Sprintf("http://localhost:%d/ipp/print", port)
+
+	msg := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+	msg.Operation.Add(goipp.MakeAttribute("requested-attributes",
+		goipp.TagKeyword, goipp.String("printer-state")))
+
+	req, _ := msg.EncodeBytes()
+	resp, err := c.Post(uri, goipp.ContentType, bytes.NewBuffer(req))
+	if err != nil {
+		return fmt.Errorf("HTTP: %s", err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err == nil && resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	return err
+}
+
+// IppProbe performs end-to-end probe of the IPP print service: full
+// query of printer attributes, followed by the Validate-Job request,
+// which is no-op for device
+func IppProbe(log *LogMessage, port int, quirks Quirks,
+	c *http.Client) error {
+
+	uri := fmt.Sprintf("http://localhost:%d/ipp/print", port)
+	_, _, err := ippGetPrinterAttributes(log, c, quirks, uri)
+	if err != nil {
+		return err
+	}
+
+	msg := goipp.NewRequest(goipp.DefaultVersion, goipp.OpValidateJob, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+	msg.Operation.Add(goipp.MakeAttribute("requesting-user-name",
+		goipp.TagName, goipp.String("ipp-usb")))
+
+	req, _ := msg.EncodeBytes()
+	resp, err := c.Post(uri, goipp.ContentType, bytes.NewBuffer(req))
+	if err != nil {
+		return fmt.Errorf("HTTP: %s", err)
+	}
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case err != nil:
+		return fmt.Errorf("HTTP: %s", err)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	err = msg.DecodeBytes(respData)
+	if err != nil {
+		return fmt.Errorf("IPP decode: %s", err)
+	}
+
+	if msg.Code >= 0x100 && !quirks.GetIgnoreIppStatus() {
+		return fmt.Errorf("IPP: Validate-Job: %s", goipp.Status(msg.Code))
+	}
+
+	return nil
+}
+
 // ippGetPrinterAttributes performs GetPrinterAttributes query,
 // using the specified http.Client and uri
 //
@@ -125,6 +257,7 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks Quirks,
 		rq.Values.Add(goipp.TagKeyword, goipp.String("all"))
 	} else {
 		rq.Values.Add(goipp.TagKeyword, goipp.String("color-supported"))
+		rq.Values.Add(goipp.TagKeyword, goipp.String("copies-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("document-format-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("media-size-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("mopria-certified"))
@@ -138,6 +271,7 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, quirks Quirks,
 		rq.Values.Add(goipp.TagKeyword, goipp.String("printer-more-info"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("printer-uuid"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("sides-supported"))
+		rq.Values.Add(goipp.TagKeyword, goipp.String("uri-security-supported"))
 		rq.Values.Add(goipp.TagKeyword, goipp.String("urf-supported"))
 	}
 
@@ -246,9 +380,23 @@ func newIppDecoder(msg *goipp.Message) ippAttrs {
 //	  priority:         hardcoded as "50"
 //	  product:          "printer-make-and-model", in round brackets
 //	  pdl:              "document-format-supported"
+//	  Transparent:      "T", if "document-format-supported" contains
+//	                    PostScript, "F" otherwise
+//	  Binary:           the same as Transparent
+//	  PaperCustom:      "T", if "media-size-supported" contains
+//	                    ranges of dimensions
+//	  Copies:           "T", if "copies-supported" allows more than
+//	                    one copy
+//	  TLS:              "1.2", if "uri-security-supported" contains
+//	                    "tls"
+//	  print_wfds:       "T", if "document-format-supported" contains
+//	                    PWG Raster or PCLm, required by Wi-Fi Direct
+//	                    Print Services
 //	  txtvers:          hardcoded as "1"
 //	  adminurl:         "printer-more-info"
-func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
+//
+// Then TXT items are overridden by the txt-* quirks
+func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo, quirks Quirks) (
 	ippinfo *IppPrinterInfo, svc DNSSdSvcInfo) {
 
 	svc = DNSSdSvcInfo{
@@ -260,6 +408,24 @@ func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
 	ippinfo = &IppPrinterInfo{
 		AdminURL: attrs.strSingle("printer-more-info"),
 		IconURL:  attrs.strSingle("printer-icons"),
+		IconURLs: attrs.getStrings("printer-icons"),
+		Location: attrs.strSingle("printer-location"),
+		Info:     attrs.strSingle("printer-info"),
+		Firmware: attrs.getFirmware(),
+	}
+
+	// Obtain make and model
+	devid := attrs.getDeviceID()
+	if len(devid) == 0 {
+		devid = UsbParseDeviceID(usbinfo.DeviceID)
+	}
+	ippinfo.Make = devid["MFG"]
+	if ippinfo.Make == "" {
+		ippinfo.Make = devid["MANUFACTURER"]
+	}
+	ippinfo.Model = devid["MDL"]
+	if ippinfo.Model == "" {
+		ippinfo.Model = devid["MODEL"]
 	}
 
 	// Obtain DNSSdName
@@ -280,39 +446,86 @@ func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
 		ippinfo.UUID = usbinfo.UUID()
 	}
 
-	// Obtain and parse IEEE 1284 device ID
-	devid := make(map[string]string)
-	for _, id := range strings.Split(attrs.strSingle("printer-device-id"), ";") {
-		keyval := strings.SplitN(id, ":", 2)
-		if len(keyval) == 2 {
-			devid[keyval[0]] = keyval[1]
+	// Generate TXT record
+	svc.Txt = DNSSdTxtGenerate(svc.Type, &DNSSdTxtSource{
+		UsbInfo:  usbinfo,
+		IppAttrs: attrs,
+		IppInfo:  ippinfo,
+		Quirks:   quirks,
+	})
+
+	return
+}
+
+// init registers TXT generator for the IPP service
+func init() {
+	DNSSdTxtGeneratorRegister("_ipp._tcp", ippTxtGenerate)
+}
+
+// ippTxtGenerate generates TXT record items for the IPP service.
+// See ippAttrs.decode for the list of generated items
+func ippTxtGenerate(txt *DNSSdTxtRecord, src *DNSSdTxtSource) {
+	attrs := src.IppAttrs
+	ippinfo := src.IppInfo
+
+	// Obtain and parse IEEE 1284 device ID. If device doesn't
+	// report it via IPP, use one, obtained via USB
+	devid := attrs.getDeviceID()
+	if len(devid) == 0 {
+		devid = UsbParseDeviceID(src.UsbInfo.DeviceID)
+	}
+
+	txt.Add("air", "none")
+	txt.IfNotEmpty("mopria-certified", attrs.strSingle("mopria-certified"))
+	txt.Add("rp", "ipp/print")
+	txt.Add("priority", "50")
+	txt.IfNotEmpty("kind", attrs.strJoined("printer-kind"))
+	txt.IfNotEmpty("PaperMax", attrs.getPaperMax())
+	if !txt.IfNotEmpty("URF", attrs.strJoined("urf-supported")) {
+		txt.IfNotEmpty("URF", devid["URF"])
+	}
+	txt.IfNotEmpty("UUID", ippinfo.UUID)
+	txt.IfNotEmpty("Color", attrs.getBool("color-supported"))
+	txt.IfNotEmpty("Duplex", attrs.getDuplex())
+	txt.Add("note", attrs.strSingle("printer-location"))
+	txt.Add("qtotal", "1")
+	txt.IfNotEmpty("usb_MDL", devid["MDL"])
+	txt.IfNotEmpty("usb_MFG", devid["MFG"])
+	txt.IfNotEmpty("usb_CMD", devid["CMD"])
+	txt.IfNotEmpty("ty", attrs.strSingle("printer-make-and-model"))
+	txt.IfNotEmpty("product", attrs.strBrackets("printer-make-and-model"))
+	txt.AddPDL("pdl", attrs.strJoined("document-format-supported"))
+	txt.IfNotEmpty("Transparent", attrs.getPostScript())
+	txt.IfNotEmpty("Binary", attrs.getPostScript())
+	txt.IfNotEmpty("PaperCustom", attrs.getPaperCustom())
+	txt.IfNotEmpty("Copies", attrs.getCopies())
+	txt.IfNotEmpty("TLS", attrs.getTLS())
+	txt.IfNotEmpty("print_wfds", attrs.getWFDS())
+	txt.Add("txtvers", "1")
+	txt.URLIfNotEmpty("adminurl", ippinfo.AdminURL)
+}
+
+// getDeviceID returns IEEE 1284 device ID, parsed into
+// the KEY:VALUE map
+func (attrs ippAttrs) getDeviceID() map[string]string {
+	return UsbParseDeviceID(attrs.strSingle("printer-device-id"))
+}
+
+// getFirmware returns device firmware version, or "", if not
+// available. Version is taken from the printer-firmware-string-version
+// attribute or, if missed, from the IEEE 1284 device ID
+func (attrs ippAttrs) getFirmware() string {
+	fw := attrs.strSingle("printer-firmware-string-version")
+	if fw == "" {
+		devid := attrs.getDeviceID()
+		for _, key := range []string{"FWVER", "FW"} {
+			if fw = devid[key]; fw != "" {
+				break
+			}
 		}
 	}
 
-	svc.Txt.Add("air", "none")
-	svc.Txt.IfNotEmpty("mopria-certified", attrs.strSingle("mopria-certified"))
-	svc.Txt.Add("rp", "ipp/print")
-	svc.Txt.Add("priority", "50")
-	svc.Txt.IfNotEmpty("kind", attrs.strJoined("printer-kind"))
-	svc.Txt.IfNotEmpty("PaperMax", attrs.getPaperMax())
-	if !svc.Txt.IfNotEmpty("URF", attrs.strJoined("urf-supported")) {
-		svc.Txt.IfNotEmpty("URF", devid["URF"])
-	}
-	svc.Txt.IfNotEmpty("UUID", ippinfo.UUID)
-	svc.Txt.IfNotEmpty("Color", attrs.getBool("color-supported"))
-	svc.Txt.IfNotEmpty("Duplex", attrs.getDuplex())
-	svc.Txt.Add("note", attrs.strSingle("printer-location"))
-	svc.Txt.Add("qtotal", "1")
-	svc.Txt.IfNotEmpty("usb_MDL", devid["MDL"])
-	svc.Txt.IfNotEmpty("usb_MFG", devid["MFG"])
-	svc.Txt.IfNotEmpty("usb_CMD", devid["CMD"])
-	svc.Txt.IfNotEmpty("ty", attrs.strSingle("printer-make-and-model"))
-	svc.Txt.IfNotEmpty("product", attrs.strBrackets("printer-make-and-model"))
-	svc.Txt.AddPDL("pdl", attrs.strJoined("document-format-supported"))
-	svc.Txt.Add("txtvers", "1")
-	svc.Txt.URLIfNotEmpty("adminurl", ippinfo.AdminURL)
-
-	return
+	return strings.TrimSpace(fw)
 }
 
 // getUUID returns printer UUID, or "", if UUID not available
@@ -347,6 +560,89 @@ func (attrs ippAttrs) getDuplex() string {
 	return ""
 }
 
+// getPostScript returns "T" if printer supports PostScript,
+// "F" if not and "" if it can't tell
+func (attrs ippAttrs) getPostScript() string {
+	formats := attrs.getStrings("document-format-supported")
+	if len(formats) == 0 {
+		return ""
+	}
+
+	for _, f := range formats {
+		if strings.EqualFold(f, "application/postscript") {
+			return "T"
+		}
+	}
+
+	return "F"
+}
+
+// getPaperCustom returns "T" if printer supports custom paper
+// sizes, "F" if not and "" if it can't tell
+func (attrs ippAttrs) getPaperCustom() string {
+	vals := attrs.getAttr(goipp.TypeCollection, "media-size-supported")
+	if vals == nil {
+		return ""
+	}
+
+	for _, collection := range vals {
+		for _, attr := range collection.(goipp.Collection) {
+			if len(attr.Values) != 0 &&
+				attr.Values[0].V.Type() == goipp.TypeRange {
+				return "T"
+			}
+		}
+	}
+
+	return "F"
+}
+
+// getCopies returns "T" if printer supports multiple copies,
+// "F" if not and "" if it can't tell
+func (attrs ippAttrs) getCopies() string {
+	vals := attrs.getAttr(goipp.TypeRange, "copies-supported")
+	if vals == nil {
+		return ""
+	}
+
+	if vals[0].(goipp.Range).Upper > 1 {
+		return "T"
+	}
+
+	return "F"
+}
+
+// getTLS returns the TLS version, supported by printer,
+// or "" if printer doesn't support TLS or it can't tell
+func (attrs ippAttrs) getTLS() string {
+	for _, s := range attrs.getStrings("uri-security-supported") {
+		if s == "tls" {
+			return "1.2"
+		}
+	}
+
+	return ""
+}
+
+// getWFDS returns "T" if printer supports document formats,
+// required by Wi-Fi Direct Print Services (PWG Raster or PCLm),
+// "F" if not and "" if it can't tell
+func (attrs ippAttrs) getWFDS() string {
+	formats := attrs.getStrings("document-format-supported")
+	if len(formats) == 0 {
+		return ""
+	}
+
+	for _, f := range formats {
+		switch strings.ToLower(f) {
+		case "image/pwg-raster", "application/pclm":
+			return "T"
+		}
+	}
+
+	return "F"
+}
+
 // getPaperMax returns max paper size, supported by printer
 //
 // According to Bonjour Printing Specification, Version 1.2.1,
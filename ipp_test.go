@@ -0,0 +1,131 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP service registration
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// testIppPrinterAttrs returns printer attributes for tests
+func testIppPrinterAttrs() *goipp.Message {
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+
+	msg.Printer.Add(goipp.MakeAttribute("printer-make-and-model",
+		goipp.TagText, goipp.String("Test Printer")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-device-id",
+		goipp.TagText, goipp.String("MFG:Test;MDL:Printer;CMD:PCL,PS;")))
+	msg.Printer.Add(goipp.MakeAttribute("copies-supported",
+		goipp.TagRange, goipp.Range{Lower: 1, Upper: 99}))
+	msg.Printer.Add(goipp.MakeAttribute("uri-security-supported",
+		goipp.TagKeyword, goipp.String("none")))
+
+	formats := goipp.Attribute{Name: "document-format-supported"}
+	for _, f := range []string{"application/pdf",
+		"application/postscript", "image/pwg-raster"} {
+		formats.Values.Add(goipp.TagMimeType, goipp.String(f))
+	}
+	msg.Printer.Add(formats)
+
+	size := goipp.Collection{}
+	size.Add(goipp.MakeAttribute("x-dimension", goipp.TagRange,
+		goipp.Range{Lower: 7620, Upper: 21590}))
+	size.Add(goipp.MakeAttribute("y-dimension", goipp.TagRange,
+		goipp.Range{Lower: 12700, Upper: 35560}))
+	msg.Printer.Add(goipp.MakeAttribute("media-size-supported",
+		goipp.TagBeginCollection, size))
+
+	return msg
+}
+
+// TestIppDecodeTxt tests TXT record, generated from printer attributes
+func TestIppDecodeTxt(t *testing.T) {
+	usbinfo := UsbDeviceInfo{BasicCaps: UsbIppBasicCapsPrint}
+	_, svc := newIppDecoder(testIppPrinterAttrs()).decode(usbinfo, Quirks{})
+
+	txt := make(map[string]string)
+	for _, item := range svc.Txt {
+		txt[item.Key] = item.Value
+	}
+
+	expected := map[string]string{
+		"ty":          "Test Printer",
+		"usb_CMD":     "PCL,PS",
+		"Transparent": "T",
+		"Binary":      "T",
+		"PaperCustom": "T",
+		"Copies":      "T",
+		"print_wfds":  "T",
+		"TLS":         "",
+	}
+
+	for key, value := range expected {
+		if txt[key] != value {
+			t.Errorf("%s: expected %q, present %q",
+				key, value, txt[key])
+		}
+	}
+}
+
+// TestIppProbe tests IppProbe
+func TestIppProbe(t *testing.T) {
+	var validateStatus goipp.Status
+	var ops []goipp.Op
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var rq goipp.Message
+			body, _ := ioutil.ReadAll(r.Body)
+			rq.DecodeBytes(body)
+			ops = append(ops, goipp.Op(rq.Code))
+
+			status := goipp.StatusOk
+			if goipp.Op(rq.Code) == goipp.OpValidateJob {
+				status = validateStatus
+			}
+
+			rsp := goipp.NewResponse(goipp.DefaultVersion,
+				status, rq.RequestID)
+			data, _ := rsp.EncodeBytes()
+			w.Header().Set("Content-Type", goipp.ContentType)
+			w.Write(data)
+		}))
+	defer srv.Close()
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		status goipp.Status
+		ok     bool
+	}{
+		{goipp.StatusOk, true},
+		{goipp.StatusErrorServiceUnavailable, false},
+	}
+
+	for _, test := range tests {
+		validateStatus = test.status
+		ops = nil
+
+		err := IppProbe(NewLogger().Begin(), port, Quirks{},
+			srv.Client())
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result: %v", test.status, err)
+		}
+
+		if len(ops) != 2 || ops[0] != goipp.OpGetPrinterAttributes ||
+			ops[1] != goipp.OpValidateJob {
+			t.Errorf("%s: unexpected requests: %v", test.status, ops)
+		}
+	}
+}
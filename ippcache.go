@@ -0,0 +1,183 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Get-Printer-Attributes responses cache
+ *
+ * Clients (CUPS, desktop printer settings, sane-airscan) tend to query
+ * printer attributes very often, and each query occupies the USB
+ * connection. If enabled by the ipp-attrs-cache-ttl configuration
+ * option, successful Get-Printer-Attributes responses are cached for
+ * a short time and identical requests are answered from memory
+ *
+ * Requests are considered identical, if they have the same URL path,
+ * IPP version, requested-attributes (in any order), document-format
+ * and natural language. Request ID of the cached response is replaced
+ * with the ID of request being answered
+ *
+ * Cache is invalidated by any IPP operation, that may change printer
+ * state (i.e., Print-Job or Cancel-Job)
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+const (
+	// ippCacheMaxRequest is the maximum size of Get-Printer-Attributes
+	// request, considered for caching
+	ippCacheMaxRequest = 64 * 1024
+
+	// ippCacheMaxResponse is the maximum size of cached response
+	ippCacheMaxResponse = 1024 * 1024
+)
+
+// ippCacheReadOnlyOps contains IPP operations that don't invalidate
+// the cache
+var ippCacheReadOnlyOps = map[goipp.Op]bool{
+	goipp.OpGetPrinterAttributes:      true,
+	goipp.OpGetPrinterSupportedValues: true,
+	goipp.OpGetJobAttributes:          true,
+	goipp.OpGetJobs:                   true,
+	goipp.OpGetSubscriptionAttributes: true,
+	goipp.OpGetSubscriptions:          true,
+	goipp.OpGetNotifications:          true,
+	goipp.OpGetDocumentAttributes:     true,
+	goipp.OpGetDocuments:              true,
+	goipp.OpValidateJob:               true,
+	goipp.OpValidateDocument:          true,
+}
+
+// IppCache caches Get-Printer-Attributes responses of the device
+type IppCache struct {
+	ttl     time.Duration             // Entries time to live
+	entries map[string]*ippCacheEntry // Entries by key
+	lock    sync.Mutex                // Access lock
+}
+
+// ippCacheEntry represents a cached response
+type ippCacheEntry struct {
+	header  http.Header // Response header
+	data    []byte      // Response body
+	expires time.Time   // Expiration time
+}
+
+// NewIppCache creates a new IppCache
+func NewIppCache(ttl time.Duration) *IppCache {
+	return &IppCache{
+		ttl:     ttl,
+		entries: make(map[string]*ippCacheEntry),
+	}
+}
+
+// Lookup returns header and body of the cached response for the
+// key, adjusted to the request ID. If there is no valid cached
+// response, nil data is returned
+func (cache *IppCache) Lookup(key string, id uint32) (http.Header, []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry := cache.entries[key]
+	if entry == nil {
+		return nil, nil
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, nil
+	}
+
+	data := append([]byte(nil), entry.data...)
+	binary.BigEndian.PutUint32(data[4:8], id)
+
+	return entry.header, data
+}
+
+// Store saves successful response into the cache. Unsuccessful
+// responses are ignored
+func (cache *IppCache) Store(key string, header http.Header, data []byte) {
+	if len(data) < 8 || binary.BigEndian.Uint16(data[2:4]) >= 0x100 {
+		return
+	}
+
+	cache.lock.Lock()
+	cache.entries[key] = &ippCacheEntry{
+		header:  header,
+		data:    data,
+		expires: time.Now().Add(cache.ttl),
+	}
+	cache.lock.Unlock()
+}
+
+// Invalidate drops all cached responses
+func (cache *IppCache) Invalidate() {
+	cache.lock.Lock()
+	cache.entries = make(map[string]*ippCacheEntry)
+	cache.lock.Unlock()
+}
+
+// ippCacheKey decodes the IPP Get-Printer-Attributes request and
+// returns its cache key and request ID. The request body is restored,
+// so it can be sent to the device unchanged
+//
+// If request can't be decoded, ok is false
+func ippCacheKey(rq *http.Request) (key string, id uint32, ok bool) {
+	data, err := ioutil.ReadAll(io.LimitReader(rq.Body,
+		ippCacheMaxRequest+1))
+
+	rq.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), rq.Body), rq.Body}
+
+	if err != nil || len(data) > ippCacheMaxRequest {
+		return
+	}
+
+	var msg goipp.Message
+	if msg.DecodeBytes(data) != nil ||
+		goipp.Op(msg.Code) != goipp.OpGetPrinterAttributes {
+		return
+	}
+
+	var requested []string
+	var format, lang string
+
+	for _, attr := range msg.Operation {
+		switch attr.Name {
+		case "requested-attributes":
+			for _, v := range attr.Values {
+				requested = append(requested, v.V.String())
+			}
+		case "document-format":
+			format = attr.Values.String()
+		case "attributes-natural-language":
+			lang = attr.Values.String()
+		}
+	}
+
+	sort.Strings(requested)
+
+	key = strings.Join([]string{
+		rq.URL.Path,
+		msg.Version.String(),
+		strings.Join(requested, ","),
+		format,
+		lang,
+	}, "\n")
+
+	return key, msg.RequestID, true
+}
@@ -0,0 +1,135 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for Get-Printer-Attributes responses cache
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// testIppCacheRequest creates Get-Printer-Attributes HTTP request
+func testIppCacheRequest(id uint32, uri string,
+	requested ...string) (*http.Request, []byte) {
+
+	msg := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, id)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+
+	attr := goipp.Attribute{Name: "requested-attributes"}
+	for _, name := range requested {
+		attr.Values.Add(goipp.TagKeyword, goipp.String(name))
+	}
+	msg.Operation.Add(attr)
+
+	body, _ := msg.EncodeBytes()
+	rq := httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(body))
+	rq.Header.Set("Content-Type", goipp.ContentType)
+
+	return rq, body
+}
+
+// TestIppCacheKey tests computation of the cache key
+func TestIppCacheKey(t *testing.T) {
+	rq1, body := testIppCacheRequest(1, "ipp://localhost:60000/ipp/print",
+		"printer-state", "media-supported")
+	rq2, _ := testIppCacheRequest(2, "ipp://192.168.1.1:60000/ipp/print",
+		"media-supported", "printer-state")
+	rq3, _ := testIppCacheRequest(3, "ipp://localhost:60000/ipp/print",
+		"all")
+
+	key1, id1, ok1 := ippCacheKey(rq1)
+	key2, id2, ok2 := ippCacheKey(rq2)
+	key3, _, ok3 := ippCacheKey(rq3)
+
+	if !ok1 || !ok2 || !ok3 {
+		t.Fatalf("request not decoded")
+	}
+
+	if id1 != 1 || id2 != 2 {
+		t.Errorf("request ID: expected 1 and 2, present %d and %d",
+			id1, id2)
+	}
+
+	if key1 != key2 {
+		t.Errorf("identical requests have different keys:\n%q\n%q",
+			key1, key2)
+	}
+
+	if key1 == key3 {
+		t.Errorf("different requests have the same key %q", key1)
+	}
+
+	// Body must be restored
+	data, _ := ioutil.ReadAll(rq1.Body)
+	if !bytes.Equal(data, body) {
+		t.Errorf("request body not restored")
+	}
+}
+
+// TestIppCacheLookup tests storing, lookup and invalidation
+// of cached responses
+func TestIppCacheLookup(t *testing.T) {
+	cache := NewIppCache(time.Hour)
+
+	rsp := goipp.NewResponse(goipp.DefaultVersion,
+		goipp.StatusOk, 1)
+	okData, _ := rsp.EncodeBytes()
+
+	header := http.Header{"Content-Type": {goipp.ContentType}}
+	cache.Store("key", header, okData)
+
+	// Lookup must replace request ID
+	_, cached := cache.Lookup("key", 5)
+	if cached == nil {
+		t.Fatalf("cached response not found")
+	}
+
+	if id := binary.BigEndian.Uint32(cached[4:8]); id != 5 {
+		t.Errorf("request ID: expected 5, present %d", id)
+	}
+
+	if _, cached = cache.Lookup("other", 5); cached != nil {
+		t.Errorf("unexpected response for the unknown key")
+	}
+
+	// Error responses are not cached
+	rsp = goipp.NewResponse(goipp.DefaultVersion,
+		goipp.StatusErrorBusy, 1)
+	data, _ := rsp.EncodeBytes()
+	cache.Store("error", header, data)
+
+	if _, cached = cache.Lookup("error", 1); cached != nil {
+		t.Errorf("error response cached")
+	}
+
+	// Check invalidation
+	cache.Invalidate()
+	if _, cached = cache.Lookup("key", 1); cached != nil {
+		t.Errorf("response found after invalidation")
+	}
+
+	// Check expiration
+	cache = NewIppCache(-time.Second)
+	cache.Store("key", header, okData)
+	if _, cached = cache.Lookup("key", 1); cached != nil {
+		t.Errorf("expired response found")
+	}
+}
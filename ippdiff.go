@@ -0,0 +1,321 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Attribute-level comparison of IPP messages
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippDiffKind defines kind of the attribute change
+type ippDiffKind int
+
+// ippDiffKind values
+const (
+	ippDiffDropped   ippDiffKind = iota // Attribute dropped
+	ippDiffAdded                        // Attribute added
+	ippDiffReencoded                    // Attribute values re-encoded
+)
+
+// String returns textual representation of ippDiffKind
+func (kind ippDiffKind) String() string {
+	switch kind {
+	case ippDiffDropped:
+		return "dropped"
+	case ippDiffAdded:
+		return "added"
+	case ippDiffReencoded:
+		return "re-encoded"
+	}
+
+	return fmt.Sprintf("unknown ippDiffKind %d", int(kind))
+}
+
+// ippDiffChange represents a single attribute change
+type ippDiffChange struct {
+	Kind     ippDiffKind     // Kind of change
+	Group    goipp.Tag       // Attribute group
+	Old, New goipp.Attribute // Old and new attribute (if present)
+}
+
+// String returns textual representation of ippDiffChange,
+// suitable for logging
+func (chg ippDiffChange) String() string {
+	switch chg.Kind {
+	case ippDiffDropped:
+		return fmt.Sprintf("%s: %s: dropped: %s",
+			chg.Group, chg.Old.Name, ippDiffValues(chg.Old.Values))
+	case ippDiffAdded:
+		return fmt.Sprintf("%s: %s: added: %s",
+			chg.Group, chg.New.Name, ippDiffValues(chg.New.Values))
+	}
+
+	return fmt.Sprintf("%s: %s: re-encoded: %s -> %s",
+		chg.Group, chg.Old.Name,
+		ippDiffValues(chg.Old.Values), ippDiffValues(chg.New.Values))
+}
+
+// ippDiffGroup represents a group of attributes, as it appears
+// on a wire
+type ippDiffGroup struct {
+	Tag   goipp.Tag        // Group tag
+	Attrs goipp.Attributes // Group attributes
+}
+
+// ippDiffMessages compares two wire-encoded IPP messages, original
+// and fixed, at the attribute level
+//
+// Messages are not decoded with goipp, as the purpose of this
+// comparison is to reveal differences in encoding between original
+// (probably malformed) message and its sanitized version, and goipp
+// hides these differences (or refuses to decode malformed message
+// at all). Instead, each attribute is represented by all its wire
+// records, up to the next named record at the top level, so
+// collections and their members appear as a flat sequence of values
+func ippDiffMessages(orig, fixed []byte) ([]ippDiffChange, error) {
+	oldGroups, err := ippDiffScan(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	newGroups, err := ippDiffScan(fixed)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ippDiffChange
+
+	// Groups are matched by order and tag
+	for i := 0; i < len(oldGroups) || i < len(newGroups); i++ {
+		var oldGrp, newGrp ippDiffGroup
+		switch {
+		case i >= len(oldGroups):
+			newGrp = newGroups[i]
+			oldGrp.Tag = newGrp.Tag
+		case i >= len(newGroups):
+			oldGrp = oldGroups[i]
+			newGrp.Tag = oldGrp.Tag
+		default:
+			oldGrp, newGrp = oldGroups[i], newGroups[i]
+		}
+
+		if oldGrp.Tag != newGrp.Tag {
+			changes = append(changes,
+				ippDiffAttrs(oldGrp.Tag, oldGrp.Attrs, nil)...)
+			changes = append(changes,
+				ippDiffAttrs(newGrp.Tag, nil, newGrp.Attrs)...)
+		} else {
+			changes = append(changes,
+				ippDiffAttrs(oldGrp.Tag, oldGrp.Attrs, newGrp.Attrs)...)
+		}
+	}
+
+	return changes, nil
+}
+
+// ippDiffAttrs compares two lists of attributes, original and fixed
+//
+// Attributes are matched by name, in order of appearance, so
+// duplicated attributes are matched pairwise. Matched attributes
+// are compared with goipp.Attribute.Equal
+func ippDiffAttrs(group goipp.Tag, orig, fixed goipp.Attributes) []ippDiffChange {
+	var changes []ippDiffChange
+	matched := make([]bool, len(fixed))
+
+	for _, oldAttr := range orig {
+		found := false
+		for i, newAttr := range fixed {
+			if matched[i] || newAttr.Name != oldAttr.Name {
+				continue
+			}
+
+			matched[i] = true
+			found = true
+
+			if !oldAttr.Equal(newAttr) {
+				changes = append(changes, ippDiffChange{
+					Kind:  ippDiffReencoded,
+					Group: group,
+					Old:   oldAttr,
+					New:   newAttr,
+				})
+			}
+			break
+		}
+
+		if !found {
+			changes = append(changes, ippDiffChange{
+				Kind:  ippDiffDropped,
+				Group: group,
+				Old:   oldAttr,
+			})
+		}
+	}
+
+	for i, newAttr := range fixed {
+		if !matched[i] {
+			changes = append(changes, ippDiffChange{
+				Kind:  ippDiffAdded,
+				Group: group,
+				New:   newAttr,
+			})
+		}
+	}
+
+	return changes
+}
+
+// ippDiffScan splits wire-encoded IPP message into groups of
+// flat attributes
+//
+// Named records within collection (which is not allowed by IPP,
+// but happens in practice) are represented as TagZero value with
+// the record name, followed by the record value
+func ippDiffScan(data []byte) ([]ippDiffGroup, error) {
+	var groups []ippDiffGroup
+	var attr *goipp.Attribute
+	depth := 0
+
+	errTruncated := errors.New("IPP message truncated")
+
+	if len(data) < 8 {
+		return nil, errTruncated
+	}
+
+	data = data[8:]
+	for {
+		if len(data) < 1 {
+			return nil, errTruncated
+		}
+
+		tag := goipp.Tag(data[0])
+		data = data[1:]
+
+		// Handle delimiters
+		if tag.IsDelimiter() {
+			if tag == goipp.TagEnd {
+				return groups, nil
+			}
+
+			groups = append(groups, ippDiffGroup{Tag: tag})
+			attr = nil
+			depth = 0
+			continue
+		}
+
+		if tag == goipp.TagExtension {
+			if len(data) < 4 {
+				return nil, errTruncated
+			}
+			tag = goipp.Tag(binary.BigEndian.Uint32(data))
+			data = data[4:]
+		}
+
+		// Fetch name and value
+		if len(data) < 2 {
+			return nil, errTruncated
+		}
+
+		l := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+l+2 {
+			return nil, errTruncated
+		}
+
+		name := string(data[2 : 2+l])
+		data = data[2+l:]
+
+		l = int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+l {
+			return nil, errTruncated
+		}
+
+		value := data[2 : 2+l]
+		data = data[2+l:]
+
+		if len(groups) == 0 {
+			return nil, errors.New("IPP attribute outside of group")
+		}
+
+		// Append to the current attribute or start a new one
+		grp := &groups[len(groups)-1]
+		switch {
+		case name != "" && depth == 0:
+			grp.Attrs.Add(goipp.Attribute{Name: name})
+			attr = &grp.Attrs[len(grp.Attrs)-1]
+
+		case attr == nil:
+			return nil, errors.New("IPP additional value without attribute")
+
+		case name != "":
+			attr.Values.Add(goipp.TagZero, goipp.String(name))
+		}
+
+		attr.Values.Add(tag, ippDiffValue(tag, value))
+
+		switch tag {
+		case goipp.TagBeginCollection:
+			depth++
+		case goipp.TagEndCollection:
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+}
+
+// ippDiffValue converts raw value of the wire record into goipp.Value
+//
+// Values of known fixed size are decoded, strings are kept as is,
+// everything else is represented as goipp.Binary
+func ippDiffValue(tag goipp.Tag, value []byte) goipp.Value {
+	switch tag.Type() {
+	case goipp.TypeVoid:
+		if len(value) == 0 {
+			return goipp.Void{}
+		}
+
+	case goipp.TypeInteger:
+		if len(value) == 4 {
+			return goipp.Integer(int32(binary.BigEndian.Uint32(value)))
+		}
+
+	case goipp.TypeBoolean:
+		if len(value) == 1 {
+			return goipp.Boolean(value[0] != 0)
+		}
+
+	case goipp.TypeString:
+		return goipp.String(value)
+	}
+
+	return goipp.Binary(append([]byte(nil), value...))
+}
+
+// ippDiffValues formats goipp.Values for logging
+func ippDiffValues(values goipp.Values) string {
+	var buf strings.Builder
+
+	for i, v := range values {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+
+		if v.T == goipp.TagZero {
+			fmt.Fprintf(&buf, "(name %q)", v.V)
+		} else {
+			fmt.Fprintf(&buf, "%s:%s", v.T, v.V)
+		}
+	}
+
+	return buf.String()
+}
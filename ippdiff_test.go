@@ -0,0 +1,136 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for attribute-level comparison of IPP messages
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippDiffRecord appends a single wire record to the buffer
+func ippDiffRecord(buf *bytes.Buffer, tag goipp.Tag, name string,
+	value []byte) {
+
+	var l [2]byte
+
+	buf.WriteByte(byte(tag))
+	binary.BigEndian.PutUint16(l[:], uint16(len(name)))
+	buf.Write(l[:])
+	buf.WriteString(name)
+	binary.BigEndian.PutUint16(l[:], uint16(len(value)))
+	buf.Write(l[:])
+	buf.Write(value)
+}
+
+// TestIppDiffSanitized tests comparison of malformed IPP message
+// with its sanitized version
+func TestIppDiffSanitized(t *testing.T) {
+	// Build a response with named attributes within collection,
+	// as sent by Pantum M7300FDW
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{2, 0, 0, 0, 0, 0, 0, 1})
+	buf.WriteByte(byte(goipp.TagOperationGroup))
+	ippDiffRecord(buf, goipp.TagCharset, "attributes-charset",
+		[]byte("utf-8"))
+	buf.WriteByte(byte(goipp.TagPrinterGroup))
+	ippDiffRecord(buf, goipp.TagName, "printer-name", []byte("Pantum"))
+	ippDiffRecord(buf, goipp.TagBeginCollection, "media-col-default", nil)
+	ippDiffRecord(buf, goipp.TagKeyword, "media-source", []byte("auto"))
+	ippDiffRecord(buf, goipp.TagEndCollection, "", nil)
+	buf.WriteByte(byte(goipp.TagEnd))
+
+	orig := buf.Bytes()
+
+	// Sanitize it
+	msg := goipp.Message{}
+	err := msg.DecodeBytesEx(orig,
+		goipp.DecoderOptions{EnableWorkarounds: true})
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	fixed, err := msg.EncodeBytes()
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	changes, err := ippDiffMessages(orig, fixed)
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change, got %d: %v", len(changes), changes)
+	}
+
+	chg := changes[0]
+	if chg.Kind != ippDiffReencoded || chg.Group != goipp.TagPrinterGroup ||
+		chg.Old.Name != "media-col-default" {
+		t.Errorf("unexpected change: %s", chg)
+	}
+
+	// Message, compared to itself, has no changes
+	changes, err = ippDiffMessages(fixed, fixed)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("self-diff: %v %v", changes, err)
+	}
+
+	// Truncated message must be rejected
+	_, err = ippDiffMessages(orig[:len(orig)-3], fixed)
+	if err == nil {
+		t.Errorf("truncated message not rejected")
+	}
+}
+
+// TestIppDiffAttrs tests comparison of attribute lists
+func TestIppDiffAttrs(t *testing.T) {
+	orig := goipp.Attributes{
+		goipp.MakeAttribute("a", goipp.TagKeyword, goipp.String("x")),
+		goipp.MakeAttribute("b", goipp.TagInteger, goipp.Integer(1)),
+		goipp.MakeAttribute("c", goipp.TagKeyword, goipp.String("y")),
+	}
+
+	fixed := goipp.Attributes{
+		goipp.MakeAttribute("a", goipp.TagKeyword, goipp.String("x")),
+		goipp.MakeAttribute("b", goipp.TagEnum, goipp.Integer(1)),
+		goipp.MakeAttribute("d", goipp.TagKeyword, goipp.String("z")),
+	}
+
+	changes := ippDiffAttrs(goipp.TagPrinterGroup, orig, fixed)
+
+	expected := []struct {
+		kind ippDiffKind
+		name string
+	}{
+		{ippDiffReencoded, "b"},
+		{ippDiffDropped, "c"},
+		{ippDiffAdded, "d"},
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d: %v",
+			len(expected), len(changes), changes)
+	}
+
+	for i, exp := range expected {
+		chg := changes[i]
+		name := chg.Old.Name
+		if chg.Kind == ippDiffAdded {
+			name = chg.New.Name
+		}
+
+		if chg.Kind != exp.kind || name != exp.name {
+			t.Errorf("change %d: expected %s %s, present %s",
+				i, exp.kind, exp.name, chg)
+		}
+	}
+}
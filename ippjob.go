@@ -0,0 +1,198 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Per-job summaries of print jobs
+ *
+ * IPP requests, that carry documents (Print-Job and Send-Document),
+ * are sniffed on the way to device, and for each of them a job-level
+ * summary (document format, byte count, duration, throughput and
+ * completion status) is written to the device log, so user gets
+ * actionable information without enabling full trace logs
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippJobSniffMax limits amount of data, buffered by ippJobSniffer
+// while looking for the end of the IPP message attributes
+const ippJobSniffMax = 64 * 1024
+
+// ippJobSniffer recognizes Print-Job and Send-Document requests
+// and collects information for the job summary
+//
+// Data of the request body is fed into the sniffer as it goes
+// to the device. Only the IPP message header and attributes are
+// buffered; the document data is only counted
+type ippJobSniffer struct {
+	start   time.Time    // Request start time
+	buf     bytes.Buffer // IPP message, until attributes decoded
+	decoded bool         // Attributes decoded or gave up
+	job     bool         // Print-Job or Send-Document request
+	op      goipp.Op     // IPP operation
+	format  string       // document-format, "" if unknown
+	name    string       // job-name, "" if unknown
+	jobID   int          // job-id, 0 if unknown
+	hdrSize int          // Size of IPP message attributes
+	count   int          // Total count of bytes seen
+}
+
+// newIppJobSniffer creates a new ippJobSniffer
+func newIppJobSniffer() *ippJobSniffer {
+	return &ippJobSniffer{start: time.Now()}
+}
+
+// feed feeds next portion of the request body into the sniffer
+func (sniffer *ippJobSniffer) feed(data []byte) {
+	sniffer.count += len(data)
+
+	if sniffer.decoded {
+		return
+	}
+
+	sniffer.buf.Write(data)
+
+	// Check operation code, so unrelated requests are
+	// not buffered
+	if sniffer.buf.Len() < 4 {
+		return
+	}
+
+	hdr := sniffer.buf.Bytes()
+	sniffer.op = goipp.Op(binary.BigEndian.Uint16(hdr[2:]))
+	if sniffer.op != goipp.OpPrintJob &&
+		sniffer.op != goipp.OpSendDocument {
+		sniffer.giveUp()
+		return
+	}
+
+	// Try to decode attributes
+	msg := goipp.Message{}
+	rd := bytes.NewReader(sniffer.buf.Bytes())
+	err := msg.Decode(rd)
+
+	switch {
+	case err == nil:
+		sniffer.hdrSize = sniffer.buf.Len() - rd.Len()
+		sniffer.job = true
+		sniffer.decodeAttrs(&msg)
+		sniffer.giveUp()
+
+	case sniffer.buf.Len() >= ippJobSniffMax:
+		sniffer.giveUp()
+	}
+}
+
+// giveUp stops buffering of data
+func (sniffer *ippJobSniffer) giveUp() {
+	sniffer.decoded = true
+	sniffer.buf = bytes.Buffer{}
+}
+
+// decodeAttrs extracts attributes, needed for the job summary
+func (sniffer *ippJobSniffer) decodeAttrs(msg *goipp.Message) {
+	for _, attr := range msg.Operation {
+		if len(attr.Values) == 0 {
+			continue
+		}
+
+		val := attr.Values[0].V
+		switch attr.Name {
+		case "document-format":
+			sniffer.format = val.String()
+		case "job-name":
+			sniffer.name = val.String()
+		case "job-id":
+			if v, ok := val.(goipp.Integer); ok {
+				sniffer.jobID = int(v)
+			}
+		}
+	}
+}
+
+// summary returns the job summary, suitable for logging. status
+// is the IPP status of response, err is the transport error
+//
+// Duration is counted from the request start till the response,
+// so it includes both transmission of the document to device and
+// its processing by device, until it responds
+func (sniffer *ippJobSniffer) summary(status string, err error) string {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "IPP: %s", sniffer.op)
+	if sniffer.jobID != 0 {
+		fmt.Fprintf(buf, " job-id=%d", sniffer.jobID)
+	}
+	if sniffer.name != "" {
+		fmt.Fprintf(buf, " %q", sniffer.name)
+	}
+
+	format := sniffer.format
+	if format == "" {
+		format = "unknown format"
+	}
+
+	size := sniffer.count - sniffer.hdrSize
+	elapsed := time.Since(sniffer.start).Round(time.Millisecond)
+	fmt.Fprintf(buf, ": %s, sent %s in %s", format,
+		ippJobFmtSize(int64(size)), elapsed)
+
+	if secs := elapsed.Seconds(); secs > 0 {
+		fmt.Fprintf(buf, " (%s/s)",
+			ippJobFmtSize(int64(float64(size)/secs)))
+	}
+
+	if err != nil {
+		fmt.Fprintf(buf, ", failed: %s", err)
+	} else {
+		fmt.Fprintf(buf, ", status: %s", status)
+	}
+
+	return buf.String()
+}
+
+// ippJobResponseStatus returns IPP status of the response as
+// a string. The response body is restored, so it can be passed
+// to the client unchanged
+func ippJobResponseStatus(resp *http.Response) string {
+	if resp.Header.Get("Content-Type") != goipp.ContentType {
+		return fmt.Sprintf("HTTP %s", resp.Status)
+	}
+
+	var hdr [4]byte
+	n, _ := io.ReadFull(resp.Body, hdr[:])
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(hdr[:n]), resp.Body), resp.Body}
+
+	if n < len(hdr) {
+		return "truncated IPP response"
+	}
+
+	return goipp.Status(binary.BigEndian.Uint16(hdr[2:])).String()
+}
+
+// ippJobFmtSize formats byte count for the job summary
+func ippJobFmtSize(v int64) string {
+	switch {
+	case v >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(v)/(1024*1024))
+	case v >= 1024:
+		return fmt.Sprintf("%.1fKB", float64(v)/1024)
+	}
+
+	return fmt.Sprintf("%d bytes", v)
+}
@@ -0,0 +1,95 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-job summaries of print jobs
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestIppJobSniffer tests recognition of print jobs
+func TestIppJobSniffer(t *testing.T) {
+	rq := goipp.NewRequest(goipp.DefaultVersion, goipp.OpPrintJob, 1)
+	rq.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rq.Operation.Add(goipp.MakeAttribute("job-name",
+		goipp.TagName, goipp.String("report")))
+	rq.Operation.Add(goipp.MakeAttribute("document-format",
+		goipp.TagMimeType, goipp.String("application/pdf")))
+
+	hdr, _ := rq.EncodeBytes()
+	data := append(hdr, make([]byte, 2048)...)
+
+	// Feed data by small pieces
+	sniffer := newIppJobSniffer()
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		sniffer.feed(data[i:end])
+	}
+
+	switch {
+	case !sniffer.job:
+		t.Fatalf("print job not recognized")
+	case sniffer.format != "application/pdf":
+		t.Errorf("document-format: %q", sniffer.format)
+	case sniffer.name != "report":
+		t.Errorf("job-name: %q", sniffer.name)
+	case sniffer.hdrSize != len(hdr):
+		t.Errorf("attributes size: expected %d, present %d",
+			len(hdr), sniffer.hdrSize)
+	}
+
+	s := sniffer.summary("successful-ok", nil)
+	if !strings.HasPrefix(s, `IPP: Print-Job "report": application/pdf, sent 2.0KB in `) ||
+		!strings.HasSuffix(s, ", status: successful-ok") {
+		t.Errorf("unexpected summary: %s", s)
+	}
+
+	// Other operations are ignored
+	rq = goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	data, _ = rq.EncodeBytes()
+
+	sniffer = newIppJobSniffer()
+	sniffer.feed(data)
+	if sniffer.job || sniffer.buf.Len() != 0 {
+		t.Errorf("Get-Printer-Attributes recognized as print job")
+	}
+}
+
+// TestIppJobResponseStatus tests ippJobResponseStatus
+func TestIppJobResponseStatus(t *testing.T) {
+	rsp := goipp.NewResponse(goipp.DefaultVersion,
+		goipp.StatusErrorDocumentFormatNotSupported, 1)
+	data, _ := rsp.EncodeBytes()
+
+	resp := &http.Response{
+		Status: "200 OK",
+		Header: http.Header{"Content-Type": {"application/ipp"}},
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
+	}
+
+	status := ippJobResponseStatus(resp)
+	if status != goipp.StatusErrorDocumentFormatNotSupported.String() {
+		t.Errorf("unexpected status: %s", status)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(body, data) {
+		t.Errorf("response body is not restored")
+	}
+}
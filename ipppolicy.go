@@ -0,0 +1,184 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP operations policy
+ *
+ * Policy, configured by the [ipp policy] section of ipp-usb.conf,
+ * allows to block particular IPP operations (i.e., Set-Printer-Attributes)
+ * before they reach the device. To apply it, the IPP request header
+ * (version, operation code and request ID) is decoded in the proxy path;
+ * the rest of request is passed to the device as is
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// IppPolicyAction defines, what to do with the IPP operation
+type IppPolicyAction int
+
+// IppPolicyAction values
+const (
+	IppPolicyAllow  IppPolicyAction = iota // Pass to device
+	IppPolicyDeny                          // Always reject
+	IppPolicyLocal                         // Allow only local clients
+	IppPolicyConfig                        // Allow only config-enabled clients
+)
+
+// String returns string representation of IppPolicyAction,
+// as used in the configuration file
+func (action IppPolicyAction) String() string {
+	switch action {
+	case IppPolicyAllow:
+		return "allow"
+	case IppPolicyDeny:
+		return "deny"
+	case IppPolicyLocal:
+		return "local"
+	case IppPolicyConfig:
+		return "config"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(action))
+}
+
+// IppPolicy maps IPP operations to the policy actions. Operations,
+// not listed here, are allowed
+type IppPolicy map[goipp.Op]IppPolicyAction
+
+// ippPolicyOps maps lower-case IPP operation names into codes
+var ippPolicyOps = make(map[string]goipp.Op)
+
+func init() {
+	for code := 0; code <= 0xffff; code++ {
+		op := goipp.Op(code)
+		name := op.String()
+		if !strings.HasPrefix(name, "0x") {
+			ippPolicyOps[strings.ToLower(name)] = op
+		}
+	}
+}
+
+// IppPolicyParseOp parses IPP operation, specified either by name
+// (i.e., Set-Printer-Attributes, case-insensitive) or by hexadecimal
+// code (i.e., 0x0013)
+func IppPolicyParseOp(s string) (goipp.Op, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		code, err := strconv.ParseUint(s[2:], 16, 16)
+		if err == nil {
+			return goipp.Op(code), nil
+		}
+	} else if op, ok := ippPolicyOps[strings.ToLower(s)]; ok {
+		return op, nil
+	}
+
+	return 0, fmt.Errorf("unknown IPP operation: %q", s)
+}
+
+// IppPolicyParseAction parses IppPolicyAction
+func IppPolicyParseAction(s string) (IppPolicyAction, error) {
+	for _, action := range []IppPolicyAction{
+		IppPolicyAllow, IppPolicyDeny, IppPolicyLocal, IppPolicyConfig,
+	} {
+		if strings.EqualFold(strings.TrimSpace(s), action.String()) {
+			return action, nil
+		}
+	}
+
+	return 0, fmt.Errorf("must be allow, deny, local or config")
+}
+
+// Check tells if operation is allowed for the client
+func (policy IppPolicy) Check(op goipp.Op, client AuthClient) bool {
+	switch policy[op] {
+	case IppPolicyDeny:
+		return false
+	case IppPolicyLocal:
+		return client.Local
+	case IppPolicyConfig:
+		return client.Allowed&AuthOpsConfig != 0
+	}
+
+	return true
+}
+
+// ippRequestHeader represents the fixed-size header of IPP request
+type ippRequestHeader struct {
+	Version goipp.Version // IPP version
+	Op      goipp.Op      // Operation code
+	ID      uint32        // Request ID
+}
+
+// ippRequestPeek decodes header of the IPP request. The request body
+// is restored, so it can be sent to the device unchanged
+//
+// If request is not an IPP request, or its header is truncated,
+// ok is false
+func ippRequestPeek(rq *http.Request) (hdr ippRequestHeader, ok bool) {
+	if rq.Method != "POST" || rq.Body == nil {
+		return
+	}
+
+	ct := strings.ToLower(rq.Header.Get("Content-Type"))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+
+	if strings.TrimSpace(ct) != goipp.ContentType {
+		return
+	}
+
+	var buf [8]byte
+	n, err := io.ReadFull(rq.Body, buf[:])
+
+	rq.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf[:n]), rq.Body), rq.Body}
+
+	if err != nil {
+		return
+	}
+
+	hdr.Version = goipp.Version(binary.BigEndian.Uint16(buf[0:2]))
+	hdr.Op = goipp.Op(binary.BigEndian.Uint16(buf[2:4]))
+	hdr.ID = binary.BigEndian.Uint32(buf[4:8])
+
+	return hdr, true
+}
+
+// ippPolicyReject writes IPP response, rejecting the request
+func ippPolicyReject(w http.ResponseWriter, hdr ippRequestHeader) {
+	rsp := goipp.NewResponse(hdr.Version, goipp.StatusErrorForbidden,
+		hdr.ID)
+
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-us")))
+	rsp.Operation.Add(goipp.MakeAttribute("status-message",
+		goipp.TagText, goipp.String(fmt.Sprintf(
+			"%s blocked by ipp-usb policy", hdr.Op))))
+
+	data, _ := rsp.EncodeBytes()
+
+	w.Header().Set("Content-Type", goipp.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
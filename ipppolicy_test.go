@@ -0,0 +1,138 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP operations policy
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestIppPolicyParseOp tests IppPolicyParseOp
+func TestIppPolicyParseOp(t *testing.T) {
+	tests := []struct {
+		in  string
+		op  goipp.Op
+		err bool
+	}{
+		{"Set-Printer-Attributes", goipp.OpSetPrinterAttributes, false},
+		{"set-printer-attributes", goipp.OpSetPrinterAttributes, false},
+		{"0x4001", goipp.OpCupsGetDefault, false},
+		{"0X0013", goipp.OpSetPrinterAttributes, false},
+		{"Format-Hard-Disk", 0, true},
+		{"0x12345", 0, true},
+	}
+
+	for _, test := range tests {
+		op, err := IppPolicyParseOp(test.in)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: error not detected", test.in)
+		case !test.err && err != nil:
+			t.Errorf("%q: %s", test.in, err)
+		case op != test.op:
+			t.Errorf("%q: expected %s, present %s", test.in, test.op, op)
+		}
+	}
+}
+
+// TestIppPolicyCheck tests IppPolicy.Check
+func TestIppPolicyCheck(t *testing.T) {
+	policy := IppPolicy{
+		goipp.OpSetPrinterAttributes: IppPolicyConfig,
+		goipp.OpIdentifyPrinter:      IppPolicyLocal,
+		goipp.OpPausePrinter:         IppPolicyDeny,
+	}
+
+	remote := AuthClient{Local: false, Allowed: AuthOpsPrint}
+	local := AuthClient{Local: true, Allowed: AuthOpsPrint}
+	admin := AuthClient{Local: true, Allowed: AuthOpsAll}
+
+	tests := []struct {
+		op     goipp.Op
+		client AuthClient
+		ok     bool
+	}{
+		{goipp.OpPrintJob, remote, true},
+		{goipp.OpSetPrinterAttributes, local, false},
+		{goipp.OpSetPrinterAttributes, admin, true},
+		{goipp.OpIdentifyPrinter, remote, false},
+		{goipp.OpIdentifyPrinter, local, true},
+		{goipp.OpPausePrinter, admin, false},
+	}
+
+	for _, test := range tests {
+		ok := policy.Check(test.op, test.client)
+		if ok != test.ok {
+			t.Errorf("%s %+v: expected %v, present %v",
+				test.op, test.client, test.ok, ok)
+		}
+	}
+}
+
+// TestIppPolicyPeek tests decoding of IPP request header and
+// rejection of the request
+func TestIppPolicyPeek(t *testing.T) {
+	rq := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpSetPrinterAttributes, 42)
+	rq.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	body, _ := rq.EncodeBytes()
+
+	r := httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/ipp; charset=utf-8")
+
+	hdr, ok := ippRequestPeek(r)
+	if !ok {
+		t.Fatalf("IPP request header not decoded")
+	}
+
+	if hdr.Op != goipp.OpSetPrinterAttributes || hdr.ID != 42 ||
+		hdr.Version != goipp.DefaultVersion {
+		t.Errorf("bad header decoded: %+v", hdr)
+	}
+
+	// Body must be restored
+	data, _ := ioutil.ReadAll(r.Body)
+	if !bytes.Equal(data, body) {
+		t.Errorf("request body not restored")
+	}
+
+	// Non-IPP requests are ignored
+	r = httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	if _, ok = ippRequestPeek(r); ok {
+		t.Errorf("non-IPP request decoded")
+	}
+
+	// Check rejection
+	w := httptest.NewRecorder()
+	ippPolicyReject(w, hdr)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("HTTP status: expected %d, present %d",
+			http.StatusOK, w.Code)
+	}
+
+	var rsp goipp.Message
+	err := rsp.DecodeBytes(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("response decode: %s", err)
+	}
+
+	if goipp.Status(rsp.Code) != goipp.StatusErrorForbidden ||
+		rsp.RequestID != 42 {
+		t.Errorf("bad response: status %s, request ID %d",
+			goipp.Status(rsp.Code), rsp.RequestID)
+	}
+}
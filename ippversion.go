@@ -0,0 +1,61 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP version downgrade
+ *
+ * Some old devices only accept IPP/1.1 and mishandle IPP/2.0 requests,
+ * generated by modern clients. The ipp-version-max quirk limits IPP
+ * version of requests, forwarded to the device. Version of responses
+ * is restored, so clients see the version they have requested
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippVersionLimit limits version of the IPP request. If version
+// is downgraded, the original version is returned, so response
+// can be fixed up accordingly. Otherwise, 0 is returned
+func ippVersionLimit(rq *http.Request, max goipp.Version) goipp.Version {
+	if max == 0 {
+		return 0
+	}
+
+	hdr, ok := ippRequestPeek(rq)
+	if !ok || hdr.Version <= max {
+		return 0
+	}
+
+	rq.Body = ippVersionReplace(rq.Body, max)
+
+	return hdr.Version
+}
+
+// ippVersionReplace replaces version in the IPP message header,
+// read from the body
+//
+// If message is too short to contain version, the body is returned
+// unchanged
+func ippVersionReplace(body io.ReadCloser,
+	version goipp.Version) io.ReadCloser {
+
+	var buf [2]byte
+	n, _ := io.ReadFull(body, buf[:])
+	if n == len(buf) {
+		binary.BigEndian.PutUint16(buf[:], uint16(version))
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf[:n]), body), body}
+}
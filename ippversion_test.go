@@ -0,0 +1,80 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP version downgrade
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestIppVersionLimit tests downgrading of IPP request version
+func TestIppVersionLimit(t *testing.T) {
+	msg := goipp.NewRequest(goipp.MakeVersion(2, 0),
+		goipp.OpGetPrinterAttributes, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+
+	data, _ := msg.EncodeBytes()
+
+	newRequest := func() *http.Request {
+		rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+			bytes.NewReader(data))
+		rq.Header.Set("Content-Type", goipp.ContentType)
+		return rq
+	}
+
+	// No limit: request is not changed
+	rq := newRequest()
+	if v := ippVersionLimit(rq, 0); v != 0 {
+		t.Errorf("no limit: version changed from %s", v)
+	}
+
+	// Version below the limit: request is not changed
+	rq = newRequest()
+	if v := ippVersionLimit(rq, goipp.MakeVersion(2, 0)); v != 0 {
+		t.Errorf("2.0 limit: version changed from %s", v)
+	}
+
+	// Version above the limit: request is downgraded
+	rq = newRequest()
+	v := ippVersionLimit(rq, goipp.MakeVersion(1, 1))
+	if v != goipp.MakeVersion(2, 0) {
+		t.Errorf("1.1 limit: original version %s", v)
+	}
+
+	body, _ := ioutil.ReadAll(rq.Body)
+	if len(body) != len(data) {
+		t.Fatalf("body length changed: %d->%d", len(data), len(body))
+	}
+
+	msg2 := goipp.Message{}
+	err := msg2.DecodeBytes(body)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	if msg2.Version != goipp.MakeVersion(1, 1) {
+		t.Errorf("version not downgraded: %s", msg2.Version)
+	}
+
+	msg2.Version = msg.Version
+	if !msg2.Equal(*msg) {
+		t.Errorf("request modified beyond version")
+	}
+
+	// Non-IPP requests are not touched
+	rq, _ = http.NewRequest("GET", "http://localhost/", nil)
+	if v := ippVersionLimit(rq, goipp.MakeVersion(1, 1)); v != 0 {
+		t.Errorf("GET: version changed from %s", v)
+	}
+}
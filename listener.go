@@ -10,6 +10,8 @@ package main
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -26,18 +28,37 @@ import (
 // that create separate IPv4 and IPv6 listeners and dial with
 // them both
 type Listener struct {
-	net.Listener // Underlying net.Listener
+	net.Listener        // Underlying net.Listener
+	name         string // Name in the systemd file descriptor store
 }
 
 // NewListener creates new listener
 func NewListener(port int) (net.Listener, error) {
+	return NewListenerAddr(nil, port)
+}
+
+// NewListenerAddr creates new listener, bound to the particular
+// IP address. If ip is nil, it works exactly as NewListener
+func NewListenerAddr(ip net.IP, port int) (net.Listener, error) {
 	// Setup network and address
 	network := "tcp4"
-	if Conf.IPV6Enable {
+	if Conf.IPV6Enable && ip.To4() == nil {
 		network = "tcp"
 	}
 
 	addr := ":" + strconv.Itoa(port)
+	name := SdListenerName(port)
+
+	if ip != nil {
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		name = SdListenerAddrName(ip, port)
+	}
+
+	// Reuse socket, inherited from the previous instance, if any
+	if nl := SdInheritedListener(name); nl != nil {
+		Log.Debug(' ', "%s: using inherited socket", addr)
+		return Listener{nl, name}, nil
+	}
 
 	// Create net.Listener
 	nl, err := net.Listen(network, addr)
@@ -45,8 +66,19 @@ func NewListener(port int) (net.Listener, error) {
 		return nil, err
 	}
 
+	// Save it into the systemd file descriptor store, so
+	// it survives the restart
+	SdFdStore(name, nl)
+
 	// Wrap into Listener
-	return Listener{nl}, nil
+	return Listener{nl, name}, nil
+}
+
+// Close closes the Listener and removes it from the systemd
+// file descriptor store, unless ipp-usb is exiting
+func (l Listener) Close() error {
+	SdFdStoreRemove(l.name)
+	return l.Listener.Close()
 }
 
 // Accept new connection
@@ -66,9 +98,10 @@ func (l Listener) Accept() (net.Conn, error) {
 			continue
 		}
 
-		// Reject non-loopback connections, if required
-		if Conf.LoopbackOnly &&
-			!tcpconn.LocalAddr().(*net.TCPAddr).IP.IsLoopback() {
+		// Reject connections, not allowed by configuration
+		local := tcpconn.LocalAddr().(*net.TCPAddr).IP
+		remote := tcpconn.RemoteAddr().(*net.TCPAddr).IP
+		if !listenerAllowed(local, remote) {
 			tcpconn.SetLinger(0)
 			tcpconn.Close()
 			continue
@@ -81,3 +114,135 @@ func (l Listener) Accept() (net.Conn, error) {
 		return tcpconn, nil
 	}
 }
+
+// listenerAllowed tells if TCP connection is allowed, based on
+// its local and remote addresses
+//
+// Loopback connections are always allowed. Other connections
+// are only allowed, if not in the loopback-only mode, they came
+// via the configured LAN interface (if any) and from the allowed
+// subnet (if configured)
+func listenerAllowed(local, remote net.IP) bool {
+	if local.IsLoopback() {
+		return true
+	}
+
+	if Conf.LoopbackOnly {
+		return false
+	}
+
+	if Conf.Interface != "" && !listenerIfaceHasAddr(Conf.Interface, local) {
+		return false
+	}
+
+	if Conf.AllowedSubnets == nil {
+		return true
+	}
+
+	for _, subnet := range Conf.AllowedSubnets {
+		if subnet.Contains(remote) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listenerIfaceHasAddr tells if network interface has the address
+//
+// Interface addresses are looked up on each call, because interface
+// may appear, disappear or change its addresses while we are running
+func listenerIfaceHasAddr(name string, ip net.IP) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnixListener wraps net.UnixListener
+//
+// It attaches client credentials to the accepted connections,
+// so HTTP handler can authenticate clients connected via the
+// Unix domain socket
+type UnixListener struct {
+	*net.UnixListener // Underlying net.UnixListener
+}
+
+// UnixConnAddr is the net.Addr, returned by the LocalAddr method
+// of connections, accepted by the UnixListener
+//
+// HTTP server makes connection's local address available to
+// request handler via http.LocalAddrContextKey, so it is a
+// natural place to pass client UID to the handler
+type UnixConnAddr struct {
+	net.UnixAddr     // Socket address
+	UID          int // Client UID, -1 if unknown
+}
+
+// unixConn wraps net.UnixConn and replaces its LocalAddr
+type unixConn struct {
+	*net.UnixConn               // Underlying connection
+	local         *UnixConnAddr // Local address with client UID
+}
+
+// NewUnixListener creates new listener on the Unix domain socket
+func NewUnixListener(path string) (net.Listener, error) {
+	// Create socket directory and remove stale socket, if any
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.Remove(path)
+
+	// Create net.UnixListener
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	nl, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make socket accessible to everybody. Access is controlled
+	// by the [auth uid] rules. Error is ignored, it's not a reason
+	// to abort ipp-usb
+	os.Chmod(path, 0777)
+
+	// Wrap into UnixListener
+	return UnixListener{nl}, nil
+}
+
+// Accept new connection
+func (l UnixListener) Accept() (net.Conn, error) {
+	conn, err := l.UnixListener.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+
+	uid := -1
+	if UnixClientUIDSupported() {
+		if id, err := UnixClientUID(conn); err == nil {
+			uid = id
+		}
+	}
+
+	local := &UnixConnAddr{UID: uid}
+	if addr, ok := conn.LocalAddr().(*net.UnixAddr); ok {
+		local.UnixAddr = *addr
+	}
+
+	return unixConn{conn, local}, nil
+}
+
+// LocalAddr returns local address of the connection
+func (c unixConn) LocalAddr() net.Addr {
+	return c.local
+}
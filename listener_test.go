@@ -0,0 +1,63 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP listener
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestListenerAllowed tests listenerAllowed
+func TestListenerAllowed(t *testing.T) {
+	saved := Conf
+	defer func() { Conf = saved }()
+
+	rec := &IniRecord{Key: "allowed-subnets",
+		Value: "192.168.1.0/24, 10.0.0.5, fd00::/8"}
+	err := rec.LoadSubnets(&Conf.AllowedSubnets)
+	if err != nil {
+		t.Fatalf("LoadSubnets: %s", err)
+	}
+
+	tests := []struct {
+		loopback bool   // Loopback-only mode
+		local    string // Local address
+		remote   string // Remote address
+		allowed  bool   // Expected result
+	}{
+		{true, "127.0.0.1", "127.0.0.1", true},
+		{true, "192.168.1.2", "192.168.1.3", false},
+		{false, "127.0.0.1", "127.0.0.1", true},
+		{false, "192.168.1.2", "192.168.1.3", true},
+		{false, "192.168.1.2", "192.168.2.3", false},
+		{false, "10.0.0.1", "10.0.0.5", true},
+		{false, "10.0.0.1", "10.0.0.6", false},
+		{false, "fd00::1", "fd00::2", true},
+		{false, "fe80::1", "fe80::2", false},
+	}
+
+	for _, test := range tests {
+		Conf.LoopbackOnly = test.loopback
+		allowed := listenerAllowed(net.ParseIP(test.local),
+			net.ParseIP(test.remote))
+
+		if allowed != test.allowed {
+			t.Errorf("loopback=%v %s->%s: expected %v, present %v",
+				test.loopback, test.remote, test.local,
+				test.allowed, allowed)
+		}
+	}
+
+	// Test invalid input
+	rec.Value = "192.168.1.0/33"
+	err = rec.LoadSubnets(&Conf.AllowedSubnets)
+	if err == nil {
+		t.Errorf("LoadSubnets(%q): error expected", rec.Value)
+	}
+}
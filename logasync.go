@@ -0,0 +1,217 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Asynchronous log output
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logAsyncWriter writes formatted log lines of the Logger from
+// the dedicated goroutine, so slow storage (i.e., SD card) doesn't
+// slow down the code that generates logs
+//
+// Lines are queued in order and written in the same order. The
+// queue size is bounded; under pressure, the oldest trace lines
+// are dropped to make room for the new lines. Other lines are
+// never dropped
+type logAsyncWriter struct {
+	logger  *Logger        // Logger, owning the writer
+	limit   int            // Queue size limit, in bytes
+	lock    sync.Mutex     // Access lock
+	cond    *sync.Cond     // Signalled on any state change
+	queue   []logAsyncLine // Lines, waiting to be written
+	size    int            // Total size of queued lines
+	dropped int            // Count of dropped trace lines
+	busy    bool           // Writer goroutine is writing
+	closed  bool           // Writer is closed
+	done    chan struct{}  // Closed when goroutine finishes
+}
+
+// logAsyncLine represents a single queued line
+type logAsyncLine struct {
+	level LogLevel // Line's log level
+	data  []byte   // Formatted line
+}
+
+// logAsyncWriters contains all running logAsyncWriters
+var (
+	logAsyncWriters     = make(map[*logAsyncWriter]struct{})
+	logAsyncWritersLock sync.Mutex
+)
+
+// newLogAsyncWriter creates a new logAsyncWriter. The writer
+// goroutine must be started by the caller
+func newLogAsyncWriter(l *Logger, limit int) *logAsyncWriter {
+	w := &logAsyncWriter{
+		logger: l,
+		limit:  limit,
+		done:   make(chan struct{}),
+	}
+
+	w.cond = sync.NewCond(&w.lock)
+
+	return w
+}
+
+// LogSync waits until all asynchronous loggers write their
+// queued lines
+//
+// It is called before program exit, so logs are not lost
+func LogSync() {
+	logAsyncWritersLock.Lock()
+	writers := make([]*logAsyncWriter, 0, len(logAsyncWriters))
+	for w := range logAsyncWriters {
+		writers = append(writers, w)
+	}
+	logAsyncWritersLock.Unlock()
+
+	for _, w := range writers {
+		w.sync()
+	}
+}
+
+// start starts the writer goroutine
+func (w *logAsyncWriter) start() {
+	logAsyncWritersLock.Lock()
+	logAsyncWriters[w] = struct{}{}
+	logAsyncWritersLock.Unlock()
+
+	go w.goroutine()
+}
+
+// put queues a line for writing. Data is copied
+func (w *logAsyncWriter) put(level LogLevel, data []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// If writer is closed, write synchronously
+	if w.closed {
+		w.logger.outhook(w.logger.out, level, data)
+		return
+	}
+
+	// Drop oldest trace lines, if queue is full
+	if w.size+len(data) > w.limit {
+		w.dropTrace(w.size + len(data) - w.limit)
+	}
+
+	line := logAsyncLine{level, append([]byte(nil), data...)}
+	w.queue = append(w.queue, line)
+	w.size += len(data)
+
+	w.cond.Broadcast()
+}
+
+// dropTrace drops oldest trace lines from the queue, until
+// at least the required amount of bytes is released or no
+// trace lines left
+//
+// Must be called under the lock
+func (w *logAsyncWriter) dropTrace(need int) {
+	queue := w.queue[:0]
+
+	for _, line := range w.queue {
+		if need > 0 && line.level&LogTraceAll != 0 {
+			need -= len(line.data)
+			w.size -= len(line.data)
+			w.dropped++
+			continue
+		}
+
+		queue = append(queue, line)
+	}
+
+	w.queue = queue
+}
+
+// sync waits until all queued lines are written
+func (w *logAsyncWriter) sync() {
+	w.lock.Lock()
+	for len(w.queue) != 0 || w.busy {
+		w.cond.Wait()
+	}
+	w.lock.Unlock()
+}
+
+// close writes all queued lines and stops the writer goroutine.
+// After that, lines are written synchronously
+func (w *logAsyncWriter) close() {
+	w.lock.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.lock.Unlock()
+
+	<-w.done
+
+	logAsyncWritersLock.Lock()
+	delete(logAsyncWriters, w)
+	logAsyncWritersLock.Unlock()
+}
+
+// goroutine writes queued lines
+func (w *logAsyncWriter) goroutine() {
+	defer close(w.done)
+
+	for {
+		// Fetch the next batch of lines
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+
+		if len(w.queue) == 0 {
+			w.lock.Unlock()
+			return
+		}
+
+		batch, dropped := w.queue, w.dropped
+		w.queue, w.size, w.dropped = nil, 0, 0
+		w.busy = true
+		w.lock.Unlock()
+
+		// Write the batch
+		w.write(batch, dropped)
+
+		w.lock.Lock()
+		w.busy = false
+		w.cond.Broadcast()
+		w.lock.Unlock()
+	}
+}
+
+// write writes a batch of lines. If some trace lines were
+// dropped, it is noted in the log
+func (w *logAsyncWriter) write(batch []logAsyncLine, dropped int) {
+	l := w.logger
+
+	if l.mode == loggerFile {
+		l.rotate()
+	}
+
+	if dropped != 0 {
+		note := logLineBufAlloc(LogDebug, '!')
+		note.ident = l.ident
+		fmt.Fprintf(note, "log: %d trace lines dropped", dropped)
+
+		buf := logLineBufAlloc(0, 0)
+		l.formatter.Format(&buf.Buffer, l, time.Now(), note)
+		if buf.Len() != 0 {
+			l.outhook(l.out, LogDebug, buf.Bytes())
+		}
+
+		buf.free()
+		note.free()
+	}
+
+	for _, line := range batch {
+		l.outhook(l.out, line.level, line.data)
+	}
+}
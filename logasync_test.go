@@ -0,0 +1,63 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for asynchronous log output
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestLogAsync tests asynchronous log output
+func TestLogAsync(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	l := NewLogger()
+	l.mode = loggerConsole
+	l.out = buf
+
+	// Don't start writer goroutine yet, so lines are queued
+	l.async = newLogAsyncWriter(l, 40)
+
+	l.Info(' ', "info 1")
+	l.Add(LogTraceUSB, ' ', "trace 1").Flush()
+	l.Add(LogTraceUSB, ' ', "trace 2").Flush()
+	l.Info(' ', "info 2")
+	l.Add(LogTraceUSB, ' ', "trace 3").Flush()
+	l.Info(' ', "info 3")
+	l.Info(' ', "info 4")
+
+	if buf.Len() != 0 {
+		t.Fatalf("lines written synchronously:\n%s", buf)
+	}
+
+	// Start the writer and wait for completion
+	l.async.start()
+	LogSync()
+
+	expected := "! log: 3 trace lines dropped\n" +
+		"  info 1\n" +
+		"  info 2\n" +
+		"  info 3\n" +
+		"  info 4\n"
+
+	if buf.String() != expected {
+		t.Errorf("output mismatch:\nexpected:\n%s\npresent:\n%s",
+			expected, buf)
+	}
+
+	// After close, lines are written synchronously
+	l.Close()
+	buf.Reset()
+	l.Info(' ', "info 5")
+
+	if strings.TrimSpace(buf.String()) != "info 5" {
+		t.Errorf("line after close: %q", buf)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,6 +33,11 @@ const (
 	// LogMinFileSize specifies a minimum value for the
 	// max-file-size parameter
 	LogMinFileSize = 16 * 1024
+
+	// LogAsyncQueueSize specifies maximum amount of bytes,
+	// queued by the asynchronous logger. When exceeded, the
+	// oldest trace lines are dropped
+	LogAsyncQueueSize = 1024 * 1024
 )
 
 // Standard loggers
@@ -46,6 +52,10 @@ var (
 	// It writes to Stdout or Stderr, depending
 	// on log level
 	InitLog = NewLogger().ToStdOutErr()
+
+	// Journal mirrors main and device logs to systemd-journald,
+	// if enabled by the journald-log configuration option
+	Journal = NewLogger().ToNowhere()
 )
 
 // LogLevel enumerates possible log levels
@@ -78,6 +88,59 @@ func (levels *LogLevel) Adjust() {
 	}
 }
 
+// LogLevelParse parses comma-separated list of log levels
+func LogLevelParse(list string) (LogLevel, error) {
+	var mask LogLevel
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "":
+		case "error":
+			mask |= LogError
+		case "info":
+			mask |= LogInfo | LogError
+		case "debug":
+			mask |= LogDebug | LogInfo | LogError
+		case "trace-ipp":
+			mask |= LogTraceIPP | LogDebug | LogInfo | LogError
+		case "trace-escl":
+			mask |= LogTraceESCL | LogDebug | LogInfo | LogError
+		case "trace-http":
+			mask |= LogTraceHTTP | LogDebug | LogInfo | LogError
+		case "trace-usb":
+			mask |= LogTraceUSB | LogDebug | LogInfo | LogError
+		case "all", "trace-all":
+			mask |= LogAll & ^LogTraceUSB
+		default:
+			return 0, fmt.Errorf("invalid log level %q", s)
+		}
+	}
+
+	return mask, nil
+}
+
+// LogFormat enumerates possible log output formats
+type LogFormat int
+
+// LogFormat constants
+const (
+	LogFormatText LogFormat = iota // Human-readable text
+	LogFormatJSON                  // One JSON object per line
+)
+
+// String returns LogFormat name, as used in ipp-usb.conf
+func (format LogFormat) String() string {
+	switch format {
+	case LogFormatText:
+		return "text"
+	case LogFormatJSON:
+		return "json"
+	}
+
+	return fmt.Sprintf("LogFormat(%d)", int(format))
+}
+
 // loggerMode enumerates possible Logger modes
 type loggerMode int
 
@@ -87,6 +150,7 @@ const (
 	loggerConsole                        // Log goes to console
 	loggerColorConsole                   // Log goes to console and uses ANSI colors
 	loggerFile                           // Log goes to disk file
+	loggerJournald                       // Log goes to systemd-journald
 )
 
 // Logger implements logging facilities
@@ -98,8 +162,11 @@ type Logger struct {
 	mode       loggerMode      // Logger mode
 	lock       sync.Mutex      // Write lock
 	path       string          // Path to log file
+	ident      string          // Device ident, "" for non-device logs
+	formatter  logFormatter    // Output formatter
 	cc         []*Logger       // Loggers to send carbon copy to
 	out        io.Writer       // Output stream, may be *os.File
+	async      *logAsyncWriter // Asynchronous writer, nil if none
 	outhook    func(io.Writer, // Output hook
 		LogLevel, []byte)
 
@@ -112,9 +179,10 @@ type Logger struct {
 // (and direction) is set
 func NewLogger() *Logger {
 	l := &Logger{
-		mode:     loggerNoMode,
-		levels:   LogAll,
-		ccLevels: 0,
+		mode:      loggerNoMode,
+		levels:    LogAll,
+		ccLevels:  0,
+		formatter: logTextFormatter{},
 		outhook: func(w io.Writer, _ LogLevel, line []byte) {
 			w.Write(line)
 		},
@@ -176,7 +244,48 @@ func (l *Logger) ToMainFile() *Logger {
 
 // ToDevFile redirects log to per-device log file
 func (l *Logger) ToDevFile(info UsbDeviceInfo) *Logger {
-	return l.ToFile(filepath.Join(PathLogDir, info.Ident()+".log"))
+	l.ident = info.Ident()
+	return l.ToFile(filepath.Join(PathLogDir, l.ident+".log"))
+}
+
+// ToAccessFile redirects log to per-device access log file.
+// Lines are written as is, without timestamps and prefixes
+func (l *Logger) ToAccessFile(info UsbDeviceInfo) *Logger {
+	l.ident = info.Ident()
+	l.formatter = logRawFormatter{}
+	return l.ToFile(filepath.Join(PathLogDir, l.ident+".access.log"))
+}
+
+// LogDevFiles returns paths of the existing per-device log files,
+// including rotated backups, from the oldest to the newest
+func LogDevFiles(ident string) []string {
+	path := filepath.Join(PathLogDir, ident+".log")
+	files := []string{}
+
+	for i := int(Conf.LogMaxBackupFiles) - 1; i >= 0; i-- {
+		backup := fmt.Sprintf("%s.%d.gz", path, i)
+		if _, err := os.Stat(backup); err == nil {
+			files = append(files, backup)
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+
+	return files
+}
+
+// ToLogger redirects log to another logger. Lines, buffered so far,
+// are flushed immediately. Carbon copies, if any, are replaced with
+// carbon copies made by the destination logger
+func (l *Logger) ToLogger(to *Logger) *Logger {
+	l.mode = loggerDiscard
+	l.out = ioutil.Discard
+	l.cc = []*Logger{to}
+	l.ccLevels = to.levels
+	l.LogMessage.Flush()
+	return l
 }
 
 // Cc adds Logger to send "carbon copy" to.
@@ -189,6 +298,10 @@ func (l *Logger) Cc(to *Logger) *Logger {
 
 // Close the logger
 func (l *Logger) Close() {
+	if l.async != nil {
+		l.async.close()
+	}
+
 	if l.mode == loggerFile && l.out != nil {
 		if file, ok := l.out.(*os.File); ok {
 			file.Close()
@@ -196,6 +309,18 @@ func (l *Logger) Close() {
 	}
 }
 
+// Async enables asynchronous output. Lines are written by the
+// dedicated goroutine; under pressure, the oldest trace lines
+// are dropped. Use LogSync to wait until all lines are written
+func (l *Logger) Async() *Logger {
+	if l.async == nil {
+		l.async = newLogAsyncWriter(l, LogAsyncQueueSize)
+		l.async.start()
+	}
+
+	return l
+}
+
 // SetLevels set logger's log levels
 func (l *Logger) SetLevels(levels LogLevel) *Logger {
 	levels.Adjust()
@@ -203,6 +328,18 @@ func (l *Logger) SetLevels(levels LogLevel) *Logger {
 	return l
 }
 
+// SetFormat sets logger's output format
+func (l *Logger) SetFormat(format LogFormat) *Logger {
+	switch format {
+	case LogFormatJSON:
+		l.formatter = logJSONFormatter{}
+	default:
+		l.formatter = logTextFormatter{}
+	}
+
+	return l
+}
+
 // Pause the logger. All output will be buffered,
 // and flushed to destination when logger is resumed
 func (l *Logger) Pause() *Logger {
@@ -229,25 +366,8 @@ func (l *Logger) Panic(v interface{}) {
 	w.Write(debug.Stack())
 	w.Close()
 
-	os.Exit(1)
-}
-
-// Format a time prefix
-func (l *Logger) fmtTime() *logLineBuf {
-	buf := logLineBufAlloc(0, 0)
-
-	if l.mode == loggerFile {
-		now := time.Now()
-
-		year, month, day := now.Date()
-		hour, min, sec := now.Clock()
-
-		fmt.Fprintf(buf, "%2.2d-%2.2d-%4.4d %2.2d:%2.2d:%2.2d:",
-			day, month, year,
-			hour, min, sec)
-	}
-
-	return buf
+	LogSync()
+	os.Exit(ExitFatal)
 }
 
 // Handle log rotation
@@ -348,9 +468,17 @@ func (msg *LogMessage) Begin() *LogMessage {
 // Add formats a next line of log message, with level and prefix char
 func (msg *LogMessage) Add(level LogLevel, prefix byte,
 	format string, args ...interface{}) *LogMessage {
+	return msg.add(level, prefix, logNoSession, format, args...)
+}
+
+// add formats a next line of log message, with level and prefix
+// char, and attributes it to the HTTP session
+func (msg *LogMessage) add(level LogLevel, prefix byte, session int,
+	format string, args ...interface{}) *LogMessage {
 
 	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
 		buf := logLineBufAlloc(level, prefix)
+		buf.session = session
 		fmt.Fprintf(buf, format, args...)
 
 		msg.appendLineBuf(buf)
@@ -378,6 +506,10 @@ func (msg *LogMessage) addBytes(level LogLevel, prefix byte, line []byte) *LogMe
 
 // appendLineBuf appends line buffer to msg.lines
 func (msg *LogMessage) appendLineBuf(buf *logLineBuf) {
+	if buf.ident == "" {
+		buf.ident = msg.logger.ident
+	}
+
 	if msg.parent == nil {
 		// Note, many threads may write to the root
 		// message simultaneously
@@ -407,7 +539,7 @@ func (msg *LogMessage) Error(prefix byte, format string, args ...interface{}) *L
 }
 
 // Exit appends a LogError line to the message, flushes the message and
-// all its parents and terminates a program by calling os.Exit(1)
+// all its parents and terminates a program with the ExitFatal code
 func (msg *LogMessage) Exit(prefix byte, format string, args ...interface{}) {
 	if msg.logger.mode == loggerNoMode {
 		msg.logger.ToConsole()
@@ -418,7 +550,8 @@ func (msg *LogMessage) Exit(prefix byte, format string, args ...interface{}) {
 		msg.Flush()
 		msg = msg.parent
 	}
-	os.Exit(1)
+	LogSync()
+	os.Exit(ExitFatal)
 }
 
 // Check calls msg.Exit(), if err is not nil
@@ -496,7 +629,8 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 	rq.Body = struct{ io.ReadCloser }{http.NoBody}
 
 	// Write it to the log
-	msg.Add(level, prefix, "HTTP[%3.3d]: HTTP request header:", session)
+	msg.add(level, prefix, session,
+		"HTTP[%3.3d]: HTTP request header:", session)
 
 	buf := &bytes.Buffer{}
 	rq.Write(buf)
@@ -506,7 +640,7 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 			l = l[:sz-1]
 		}
 
-		msg.Add(level, prefix, "  %s", l)
+		msg.add(level, prefix, session, "  %s", l)
 
 		if len(l) == 0 {
 			break
@@ -538,8 +672,9 @@ func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 	}
 
 	// Write it to the log
-	msg.Add(level, prefix, "HTTP[%3.3d]: HTTP response header:", session)
-	msg.Add(level, prefix, "  %s %s", rsp.Proto, rsp.Status)
+	msg.add(level, prefix, session,
+		"HTTP[%3.3d]: HTTP response header:", session)
+	msg.add(level, prefix, session, "  %s %s", rsp.Proto, rsp.Status)
 
 	keys := make([]string, 0, len(hdr))
 
@@ -549,10 +684,10 @@ func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 
 	sort.Strings(keys)
 	for _, k := range keys {
-		msg.Add(level, prefix, "  %s: %s", k, hdr.Get(k))
+		msg.add(level, prefix, session, "  %s: %s", k, hdr.Get(k))
 	}
 
-	msg.Add(level, prefix, "  ")
+	msg.add(level, prefix, session, "  ")
 
 	return msg
 }
@@ -561,7 +696,8 @@ func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPRqParams(level LogLevel, prefix byte,
 	session int, rq *http.Request) *LogMessage {
 
-	msg.Add(level, prefix, "HTTP[%3.3d]: %s %s", session, rq.Method, rq.URL)
+	msg.add(level, prefix, session,
+		"HTTP[%3.3d]: %s %s", session, rq.Method, rq.URL)
 
 	return msg
 }
@@ -570,7 +706,7 @@ func (msg *LogMessage) HTTPRqParams(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPRspStatus(level LogLevel, prefix byte,
 	session int, rq *http.Request, rsp *http.Response) *LogMessage {
 
-	msg.Add(level, prefix, "HTTP[%3.3d]: %s %s - %s",
+	msg.add(level, prefix, session, "HTTP[%3.3d]: %s %s - %s",
 		session, rq.Method, rq.URL, rsp.Status)
 
 	return msg
@@ -580,7 +716,8 @@ func (msg *LogMessage) HTTPRspStatus(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPError(prefix byte,
 	session int, format string, args ...interface{}) *LogMessage {
 
-	msg.Error(prefix, "HTTP[%3.3d]: %s", session, fmt.Sprintf(format, args...))
+	msg.add(LogError, prefix, session,
+		"HTTP[%3.3d]: %s", session, fmt.Sprintf(format, args...))
 
 	return msg
 }
@@ -589,7 +726,8 @@ func (msg *LogMessage) HTTPError(prefix byte,
 func (msg *LogMessage) HTTPDebug(prefix byte,
 	session int, format string, args ...interface{}) *LogMessage {
 
-	msg.Debug(prefix, "HTTP[%3.3d]: %s", session, fmt.Sprintf(format, args...))
+	msg.add(LogDebug, prefix, session,
+		"HTTP[%3.3d]: %s", session, fmt.Sprintf(format, args...))
 
 	return msg
 }
@@ -673,8 +811,9 @@ func (msg *LogMessage) Flush() {
 		return
 	}
 
-	// Rotate now
-	if msg.logger.mode == loggerFile {
+	// Rotate now. In asynchronous mode, rotation is performed
+	// by the writer goroutine
+	if msg.logger.mode == loggerFile && msg.logger.async == nil {
 		msg.logger.rotate()
 	}
 
@@ -692,32 +831,37 @@ func (msg *LogMessage) Flush() {
 	}
 
 	// Send message content to the logger
-	buf := msg.logger.fmtTime()
+	buf := logLineBufAlloc(0, 0)
 	defer buf.free()
 
-	timeLen := buf.Len()
+	now := time.Now()
 	for _, l := range msg.lines {
 		l.trim()
 
 		// Generate own output
-		buf.Truncate(timeLen)
 		if l.level&msg.logger.levels != 0 {
-			if !l.empty() {
-				if timeLen != 0 {
-					buf.WriteByte(' ')
-				}
-
-				buf.Write(l.Bytes())
+			buf.Reset()
+			msg.logger.formatter.Format(&buf.Buffer, msg.logger, now, l)
+			switch {
+			case buf.Len() == 0:
+			case msg.logger.async != nil:
+				msg.logger.async.put(l.level, buf.Bytes())
+			default:
+				msg.logger.outhook(msg.logger.out, l.level,
+					buf.Bytes())
 			}
-
-			buf.WriteByte('\n')
-			msg.logger.outhook(msg.logger.out, l.level, buf.Bytes())
 		}
 
-		// Send carbon copies
+		// Send carbon copies. Device ident and HTTP session
+		// are preserved, so they are not lost in the structured
+		// output
 		for _, cc := range cclist {
 			if (cc.levels & l.level) != 0 {
-				cc.msg.addBytes(l.level, 0, l.Bytes())
+				ccbuf := logLineBufAlloc(l.level, 0)
+				ccbuf.Write(l.Bytes())
+				ccbuf.ident = l.ident
+				ccbuf.session = l.session
+				cc.msg.appendLineBuf(ccbuf)
 			}
 		}
 
@@ -761,8 +905,14 @@ func (msg *LogMessage) free() {
 type logLineBuf struct {
 	bytes.Buffer          // Underlying buffer
 	level        LogLevel // Log level the line was written on
+	ident        string   // Device ident, "" if none
+	session      int      // HTTP session, logNoSession if none
 }
 
+// logNoSession is the logLineBuf.session of lines, that
+// don't belong to any HTTP session
+const logNoSession = -1
+
 // logLinePool manages a pool of reusable logLines
 var logLineBufPool = sync.Pool{New: func() interface{} {
 	return &logLineBuf{
@@ -774,6 +924,7 @@ var logLineBufPool = sync.Pool{New: func() interface{} {
 func logLineBufAlloc(level LogLevel, prefix byte) *logLineBuf {
 	buf := logLineBufPool.Get().(*logLineBuf)
 	buf.level = level
+	buf.session = logNoSession
 	if prefix != 0 {
 		buf.Write([]byte{prefix, ' '})
 	}
@@ -784,6 +935,7 @@ func logLineBufAlloc(level LogLevel, prefix byte) *logLineBuf {
 func (buf *logLineBuf) free() {
 	if buf.Cap() <= 256 {
 		buf.Reset()
+		buf.ident = ""
 		logLineBufPool.Put(buf)
 	}
 }
@@ -809,3 +961,114 @@ loop:
 func (buf *logLineBuf) empty() bool {
 	return buf.Len() == 0
 }
+
+// logFormatter formats log lines for output
+type logFormatter interface {
+	// Format formats a single line into the output buffer,
+	// including the terminating '\n'. If nothing written,
+	// line is not output
+	Format(out *bytes.Buffer, l *Logger, now time.Time, line *logLineBuf)
+}
+
+// logTextFormatter is the logFormatter for the human-readable
+// text output. Lines, written into the disk file, are prefixed
+// with the timestamp
+type logTextFormatter struct{}
+
+// Format formats a single line
+func (logTextFormatter) Format(out *bytes.Buffer, l *Logger,
+	now time.Time, line *logLineBuf) {
+
+	if l.mode == loggerFile {
+		year, month, day := now.Date()
+		hour, min, sec := now.Clock()
+
+		fmt.Fprintf(out, "%2.2d-%2.2d-%4.4d %2.2d:%2.2d:%2.2d:",
+			day, month, year,
+			hour, min, sec)
+
+		if !line.empty() {
+			out.WriteByte(' ')
+		}
+	}
+
+	out.Write(line.Bytes())
+	out.WriteByte('\n')
+}
+
+// logRawFormatter is the logFormatter that writes lines as is,
+// without any decoration. Empty lines are omitted
+type logRawFormatter struct{}
+
+// Format formats a single line
+func (logRawFormatter) Format(out *bytes.Buffer, l *Logger,
+	now time.Time, line *logLineBuf) {
+
+	if !line.empty() {
+		out.Write(line.Bytes())
+		out.WriteByte('\n')
+	}
+}
+
+// logJSONFormatter is the logFormatter for the JSON lines output,
+// suitable for the log collectors. Empty lines are omitted
+type logJSONFormatter struct{}
+
+// logJSONRecord represents a single JSON log record
+type logJSONRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Device  string `json:"device,omitempty"`
+	Session *int   `json:"session,omitempty"`
+	Message string `json:"message"`
+}
+
+// Format formats a single line
+func (logJSONFormatter) Format(out *bytes.Buffer, l *Logger,
+	now time.Time, line *logLineBuf) {
+
+	if line.empty() {
+		return
+	}
+
+	rec := logJSONRecord{
+		Time:    now.Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:   logLevelName(line.level),
+		Device:  line.ident,
+		Message: line.String(),
+	}
+
+	if line.session != logNoSession {
+		session := line.session
+		rec.Session = &session
+	}
+
+	data, err := json.Marshal(rec)
+	if err == nil {
+		out.Write(data)
+		out.WriteByte('\n')
+	}
+}
+
+// logLevelName returns name of the line's log level,
+// as used in ipp-usb.conf
+func logLevelName(level LogLevel) string {
+	switch {
+	case level&LogError != 0:
+		return "error"
+	case level&LogInfo != 0:
+		return "info"
+	case level&LogDebug != 0:
+		return "debug"
+	case level&LogTraceIPP != 0:
+		return "trace-ipp"
+	case level&LogTraceESCL != 0:
+		return "trace-escl"
+	case level&LogTraceHTTP != 0:
+		return "trace-http"
+	case level&LogTraceUSB != 0:
+		return "trace-usb"
+	}
+
+	return "debug"
+}
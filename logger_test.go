@@ -0,0 +1,189 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for logging
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// TestLoggerJSON tests JSON log output
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	l := NewLogger().SetFormat(LogFormatJSON)
+	l.mode = loggerConsole
+	l.out = buf
+	l.ident = "04a9-27e8-SN123-Canon-MF"
+
+	// Session is taken from the HTTP helpers, not from the
+	// message text, so "HTTP[007]" in the last line is not
+	// interpreted as session
+	l.Begin().
+		HTTPDebug(' ', 5, "GET /").
+		Nl(LogDebug).
+		Error('!', "failure HTTP[007]").
+		Commit()
+
+	type record struct {
+		Time    string
+		Level   string
+		Device  string
+		Session *int
+		Message string
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, present %d:\n%s", len(lines), buf)
+	}
+
+	var rec1, rec2 record
+	err := json.Unmarshal(lines[0], &rec1)
+	if err == nil {
+		err = json.Unmarshal(lines[1], &rec2)
+	}
+
+	if err != nil {
+		t.Fatalf("%s:\n%s", err, buf)
+	}
+
+	if rec1.Level != "debug" || rec1.Device != l.ident ||
+		rec1.Session == nil || *rec1.Session != 5 ||
+		rec1.Message != "  HTTP[005]: GET /" || rec1.Time == "" {
+		t.Errorf("line 1 mismatch: %s", lines[0])
+	}
+
+	if rec2.Level != "error" || rec2.Session != nil ||
+		rec2.Message != "! failure HTTP[007]" {
+		t.Errorf("line 2 mismatch: %s", lines[1])
+	}
+}
+
+// TestLoggerJSONSession tests that all lines of the HTTP request
+// dump are attributed to the session, including carbon copies
+func TestLoggerJSONSession(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	cc := NewLogger().SetFormat(LogFormatJSON)
+	cc.mode = loggerConsole
+	cc.out = buf
+
+	l := NewLogger().ToNowhere()
+	l.Cc(cc)
+
+	rq, _ := http.NewRequest("GET", "http://localhost/ipp/print", nil)
+	l.Begin().
+		HTTPRequest(LogDebug, '>', 12, rq).
+		Commit()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) < 2 {
+		t.Fatalf("expected multiple lines, present:\n%s", buf)
+	}
+
+	for _, line := range lines {
+		var rec struct{ Session *int }
+		err := json.Unmarshal(line, &rec)
+		if err != nil || rec.Session == nil || *rec.Session != 12 {
+			t.Errorf("session lost: %s", line)
+		}
+	}
+}
+
+// TestLoggerToLogger tests redirection of buffered log into
+// another logger
+func TestLoggerToLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	dest := NewLogger()
+	dest.mode = loggerConsole
+	dest.out = buf
+
+	l := NewLogger()
+	l.Info(' ', "buffered")
+	if buf.Len() != 0 {
+		t.Fatalf("buffered line written too early: %q", buf)
+	}
+
+	l.ToLogger(dest)
+	l.Info(' ', "direct")
+
+	out := buf.String()
+	if !bytes.Contains(buf.Bytes(), []byte("buffered")) ||
+		!bytes.Contains(buf.Bytes(), []byte("direct")) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+// TestLoggerJournald tests journald native protocol output
+func TestLoggerJournald(t *testing.T) {
+	var records []string
+
+	l := NewLogger()
+	l.mode = loggerJournald
+	l.out = &bytes.Buffer{}
+	l.formatter = logJournaldFormatter{}
+	l.outhook = func(out io.Writer, level LogLevel, line []byte) {
+		records = append(records, string(line))
+	}
+	l.ident = "04a9-27e8-SN123-Canon-MF"
+
+	// Session is taken from the HTTP helpers, not from the
+	// message text, so "HTTP[007]" in the last line is not
+	// interpreted as session
+	l.Begin().
+		HTTPDebug(' ', 5, "GET /").
+		Nl(LogDebug).
+		Error('!', "failure HTTP[007]").
+		Commit()
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, present %d:\n%q",
+			len(records), records)
+	}
+
+	expected := []string{
+		"MESSAGE=  HTTP[005]: GET /\n" +
+			"PRIORITY=7\n" +
+			"SYSLOG_IDENTIFIER=ipp-usb\n" +
+			"DEVICE_IDENT=04a9-27e8-SN123-Canon-MF\n" +
+			"VIDPID=04a9:27e8\n" +
+			"SESSION=5\n",
+		"MESSAGE=! failure HTTP[007]\n" +
+			"PRIORITY=3\n" +
+			"SYSLOG_IDENTIFIER=ipp-usb\n" +
+			"DEVICE_IDENT=04a9-27e8-SN123-Canon-MF\n" +
+			"VIDPID=04a9:27e8\n",
+	}
+
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Errorf("record %d mismatch:\nexpected: %q\npresent:  %q",
+				i, expected[i], records[i])
+		}
+	}
+
+	// Multi-line values use binary encoding
+	buf := &bytes.Buffer{}
+	logJournaldField(buf, "MESSAGE", "a\nb")
+	if buf.String() != "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n" {
+		t.Errorf("binary field mismatch: %q", buf)
+	}
+
+	// Malformed idents have no VIDPID
+	for _, ident := range []string{"", "04a9", "04a9:27e8-x", "04A9-27e8"} {
+		if vidpid := logJournaldVidPid(ident); vidpid != "" {
+			t.Errorf("%q: expected no VIDPID, present %q", ident, vidpid)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Logging to systemd-journald
+ *
+ * If enabled by the journald-log configuration option, main and
+ * per-device logs are mirrored to journald, using its native protocol
+ * (datagrams of KEY=VALUE fields, sent to /run/systemd/journal/socket).
+ * Besides MESSAGE and PRIORITY, records carry structured fields, so
+ * logs can be filtered by device:
+ *
+ *   DEVICE_IDENT - device ident, as used for per-device log file names
+ *   VIDPID       - USB vendor and product IDs, as VVVV:PPPP
+ *   SESSION      - HTTP session number
+ *
+ * I.e., journalctl -t ipp-usb VIDPID=03f0:0853
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logJournaldIdentifier is the SYSLOG_IDENTIFIER of journald records
+const logJournaldIdentifier = "ipp-usb"
+
+// ToJournald redirects log to systemd-journald. Output format is
+// always journald native protocol, regardless of SetFormat
+func (l *Logger) ToJournald() error {
+	addr := &net.UnixAddr{Name: PathJournaldSocket, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	l.mode = loggerJournald
+	l.out = conn
+	l.formatter = logJournaldFormatter{}
+
+	return nil
+}
+
+// IsJournald tells if log goes to systemd-journald
+func (l *Logger) IsJournald() bool {
+	return l.mode == loggerJournald
+}
+
+// logJournaldFormatter is the logFormatter for systemd-journald.
+// Each line is formatted as a single datagram of the journald native
+// protocol. Empty lines are omitted
+type logJournaldFormatter struct{}
+
+// Format formats a single line
+func (logJournaldFormatter) Format(out *bytes.Buffer, l *Logger,
+	now time.Time, line *logLineBuf) {
+
+	if line.empty() {
+		return
+	}
+
+	logJournaldField(out, "MESSAGE", line.String())
+	logJournaldField(out, "PRIORITY", logJournaldPriority(line.level))
+	logJournaldField(out, "SYSLOG_IDENTIFIER", logJournaldIdentifier)
+
+	if line.ident != "" {
+		logJournaldField(out, "DEVICE_IDENT", line.ident)
+		if vidpid := logJournaldVidPid(line.ident); vidpid != "" {
+			logJournaldField(out, "VIDPID", vidpid)
+		}
+	}
+
+	if line.session != logNoSession {
+		logJournaldField(out, "SESSION", strconv.Itoa(line.session))
+	}
+}
+
+// logJournaldField writes a single field of the journald native
+// protocol. Values, containing newlines, use the binary form:
+// KEY, newline, 64-bit little-endian length, value, newline
+func logJournaldField(out *bytes.Buffer, key, value string) {
+	out.WriteString(key)
+
+	if strings.IndexByte(value, '\n') < 0 {
+		out.WriteByte('=')
+		out.WriteString(value)
+	} else {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		out.WriteByte('\n')
+		out.Write(size[:])
+		out.WriteString(value)
+	}
+
+	out.WriteByte('\n')
+}
+
+// logJournaldPriority returns syslog priority of the line's log level
+func logJournaldPriority(level LogLevel) string {
+	switch {
+	case level&LogError != 0:
+		return "3" // LOG_ERR
+	case level&LogInfo != 0:
+		return "6" // LOG_INFO
+	}
+
+	return "7" // LOG_DEBUG
+}
+
+// logJournaldVidPid extracts USB vendor and product IDs from
+// the device ident (see UsbDeviceInfo.Ident), as "VVVV:PPPP".
+// If ident is malformed, "" is returned
+func logJournaldVidPid(ident string) string {
+	if len(ident) < 9 || ident[4] != '-' {
+		return ""
+	}
+
+	for _, c := range ident[0:4] + ident[5:9] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+
+	return ident[0:4] + ":" + ident[5:9]
+}
@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
 const usageText = `Usage:
@@ -27,6 +29,39 @@ Modes are:
                   ignored
     check       - check configuration and exit
     status      - print ipp-usb status and exit
+    ctl command [args]
+                - execute administrative command in the running
+                  daemon. Commands are:
+                    list                  - list devices
+                    pause device          - release device to other
+                                            drivers until resumed
+                    resume device         - reclaim the paused device
+                    reset device          - reset and reinitialize
+                    reload-quirks         - reload quirks files
+                    loglevel device level - change device log level
+                    refresh device        - update DNS-SD TXT record
+                  Device is its ident or USB address as BUS:DEV
+    quirks-update - download and install quirks update
+    replay file [model]
+                - replay captured device response from file
+                  through the response handling pipeline and
+                  print the result. Quirks are chosen by model
+    probe BUS:DEV
+                - initialize the device, as daemon does, print
+                  the diagnostic report and exit
+    report device [-o file] [-redact]
+                - collect device log, quirks, USB descriptors and
+                  the last printer attributes into the .tar.gz
+                  bundle for bug report. Device is its ident or USB
+                  address as BUS:DEV. -redact hides serial number
+    soak BUS:DEV [-time duration] [-size size]
+                - stress the device with concurrent IPP and eSCL
+                  requests for the specified time (default 1m),
+                  print error rates and latencies and exit. -size
+                  sets size of the dummy documents (default 1M)
+    conformance BUS:DEV
+                - run IPP-over-USB conformance checks against
+                  the device, print pass/fail report and exit
 
 Options are
     -bg         - run in background (ignored in debug mode)
@@ -43,6 +78,13 @@ type RunMode int
 //   RunDebug      - logs duplicated on console, -bg option is ignored
 //   RunCheck      - check configuration and exit
 //   RunStatus     - print ipp-usb status and exit
+//   RunCtl        - execute administrative command in the running daemon
+//   RunQuirksUpdate - download and install quirks update
+//   RunReplay     - replay captured device response
+//   RunProbe      - probe the device and print diagnostic report
+//   RunReport     - create bug report bundle
+//   RunSoak       - run soak test against the device
+//   RunConformance - run conformance self-test against the device
 const (
 	RunDefault RunMode = iota
 	RunStandalone
@@ -50,6 +92,13 @@ const (
 	RunDebug
 	RunCheck
 	RunStatus
+	RunCtl
+	RunQuirksUpdate
+	RunReplay
+	RunProbe
+	RunReport
+	RunSoak
+	RunConformance
 )
 
 // String returns RunMode name
@@ -67,15 +116,54 @@ func (m RunMode) String() string {
 		return "check"
 	case RunStatus:
 		return "status"
+	case RunCtl:
+		return "ctl"
+	case RunQuirksUpdate:
+		return "quirks-update"
+	case RunReplay:
+		return "replay"
+	case RunProbe:
+		return "probe"
+	case RunReport:
+		return "report"
+	case RunSoak:
+		return "soak"
+	case RunConformance:
+		return "conformance"
 	}
 
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// Exit codes:
+//   ExitOK        - normal termination
+//   ExitFatal     - fatal error
+//   ExitNoDevices - in udev mode, exited, because there are no
+//                   IPP-over-USB devices to serve
+const (
+	ExitOK        = 0
+	ExitFatal     = 1
+	ExitNoDevices = 2
+)
+
 // RunParameters represents the program run parameters
 type RunParameters struct {
-	Mode       RunMode // Run mode
-	Background bool    // Run in background
+	Mode         RunMode  // Run mode
+	Background   bool     // Run in background
+	ReplayFile   string   // File to replay, for RunReplay
+	ReplayModel  string   // Model name for quirks, for RunReplay
+	CtlCommand   string   // Administrative command, for RunCtl
+	CtlArgs      []string // Command arguments, for RunCtl
+	ProbeAddr    string   // Device address, for RunProbe
+	ReportDev    string   // Device ident or address, for RunReport
+	ReportFile   string   // Output file, for RunReport
+	ReportRedact bool     // Redact serial number, for RunReport
+
+	SoakAddr string        // Device address, for RunSoak
+	SoakTime time.Duration // Test duration, for RunSoak
+	SoakSize int64         // Dummy document size, for RunSoak
+
+	ConformanceAddr string // Device address, for RunConformance
 }
 
 // usage prints detailed usage and exits
@@ -109,7 +197,11 @@ func parseArgv() (params RunParameters) {
 	params.Mode = RunDebug
 
 	modes := 0
-	for _, arg := range os.Args[1:] {
+	args := os.Args[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+
 		switch arg {
 		case "-h", "-help", "--help":
 			usage()
@@ -128,6 +220,108 @@ func parseArgv() (params RunParameters) {
 		case "status":
 			params.Mode = RunStatus
 			modes++
+		case "ctl":
+			params.Mode = RunCtl
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing command for ctl")
+			}
+
+			params.CtlCommand = args[0]
+			params.CtlArgs = args[1:]
+			args = nil
+		case "quirks-update":
+			params.Mode = RunQuirksUpdate
+			modes++
+		case "replay":
+			params.Mode = RunReplay
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing file name for replay")
+			}
+
+			params.ReplayFile = args[0]
+			args = args[1:]
+
+			if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+				params.ReplayModel = args[0]
+				args = args[1:]
+			}
+		case "probe":
+			params.Mode = RunProbe
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing device address for probe")
+			}
+
+			params.ProbeAddr = args[0]
+			args = args[1:]
+		case "report":
+			params.Mode = RunReport
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing device for report")
+			}
+
+			params.ReportDev = args[0]
+			args = args[1:]
+
+			for len(args) > 0 {
+				if args[0] == "-redact" {
+					params.ReportRedact = true
+					args = args[1:]
+				} else if args[0] == "-o" && len(args) > 1 {
+					params.ReportFile = args[1]
+					args = args[2:]
+				} else {
+					break
+				}
+			}
+		case "soak":
+			params.Mode = RunSoak
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing device address for soak")
+			}
+
+			params.SoakAddr = args[0]
+			params.SoakTime = SoakDefaultTime
+			params.SoakSize = SoakDefaultSize
+			args = args[1:]
+
+			for len(args) > 1 {
+				if args[0] == "-time" {
+					t, err := time.ParseDuration(args[1])
+					if err != nil || t <= 0 {
+						usageError("Invalid time %s", args[1])
+					}
+					params.SoakTime = t
+				} else if args[0] == "-size" {
+					rec := IniRecord{Value: args[1]}
+					if rec.LoadSize(&params.SoakSize) != nil {
+						usageError("Invalid size %s", args[1])
+					}
+				} else {
+					break
+				}
+
+				args = args[2:]
+			}
+		case "conformance":
+			params.Mode = RunConformance
+			modes++
+
+			if len(args) == 0 {
+				usageError("Missing device address for conformance")
+			}
+
+			params.ConformanceAddr = args[0]
+			args = args[1:]
 		case "-bg":
 			params.Background = true
 		default:
@@ -185,21 +379,68 @@ func main() {
 	// Setup logging
 	if params.Mode != RunDebug &&
 		params.Mode != RunCheck &&
-		params.Mode != RunStatus {
+		params.Mode != RunStatus &&
+		params.Mode != RunCtl &&
+		params.Mode != RunQuirksUpdate &&
+		params.Mode != RunReplay &&
+		params.Mode != RunProbe &&
+		params.Mode != RunReport &&
+		params.Mode != RunSoak &&
+		params.Mode != RunConformance {
 		Console.ToNowhere()
-	} else if Conf.ColorConsole {
+	} else if Conf.ColorConsole && Conf.LogFormat == LogFormatText {
 		Console.ToColorConsole()
 	}
 
 	Log.SetLevels(Conf.LogMain)
+	Log.SetFormat(Conf.LogFormat)
+	if Conf.LogAsync {
+		Log.Async()
+	}
 	Console.SetLevels(Conf.LogConsole)
+	Console.SetFormat(Conf.LogFormat)
 	Log.Cc(Console)
 
+	// Mirror logs to journald, if enabled. Only for the
+	// modes where ipp-usb runs as a server
+	if Conf.LogJournald != 0 &&
+		(params.Mode == RunDefault ||
+			params.Mode == RunStandalone ||
+			params.Mode == RunUdev ||
+			params.Mode == RunDebug) {
+		err = Journal.ToJournald()
+		if err != nil {
+			InitLog.Error(0, "journald: %s", err)
+		} else {
+			Journal.SetLevels(Conf.LogJournald)
+			Log.Cc(Journal)
+		}
+	}
+
 	// In RunCheck mode, list IPP-over-USB devices
 	if params.Mode == RunCheck {
 		// If we are here, configuration is OK
 		InitLog.Info(0, "Configuration files: OK")
 
+		for _, file := range ConfFiles {
+			InitLog.Info(0, "  %s", file)
+		}
+
+		if len(ConfOrigins) != 0 {
+			InitLog.Info(0, "Configuration parameters:")
+		}
+
+		for _, origin := range ConfOrigins {
+			s := ""
+			if origin.Overridden {
+				s = ", overridden"
+			}
+
+			InitLog.Info(0, "  [%s] %s = %s (%s:%d%s)",
+				origin.Section, origin.Key, origin.Value,
+				origin.File, origin.Line, s)
+		}
+
 		var descs map[UsbAddr]UsbDeviceDesc
 		err = UsbInit(true)
 		if err == nil {
@@ -235,6 +476,9 @@ func main() {
 				InitLog.Info(0, " %s", buf.String())
 			}
 		}
+
+		// Diagnose privileges, needed to run without root
+		PrivReport(descs)
 	}
 
 	// In RunStatus mode, print ipp-usb status, and we are done
@@ -243,9 +487,32 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Check user privileges
-	if os.Geteuid() != 0 {
-		InitLog.Exit(0, "This program requires root privileges")
+	// In RunCtl mode, send command to the running daemon,
+	// and we are done
+	if params.Mode == RunCtl {
+		text, err := CtrlsockCommand(params.CtlCommand, params.CtlArgs)
+		InitLog.Check(err)
+
+		text = bytes.Trim(text, "\n")
+		for _, line := range bytes.Split(text, []byte("\n")) {
+			InitLog.Info(0, "%s", line)
+		}
+		os.Exit(0)
+	}
+
+	// In RunReplay mode, replay captured response, and we are done
+	if params.Mode == RunReplay {
+		err = Replay(params.ReplayFile, params.ReplayModel)
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
+	// In RunReport mode, create bug report, and we are done
+	if params.Mode == RunReport {
+		err = Report(params.ReportDev, params.ReportFile,
+			params.ReportRedact)
+		InitLog.Check(err)
+		os.Exit(0)
 	}
 
 	// If mode is "check", we are done
@@ -253,6 +520,50 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Check user privileges. Running without root is only allowed,
+	// if explicitly enabled, and the user has everything we need
+	if os.Geteuid() != 0 {
+		if !Conf.AllowNonRoot {
+			InitLog.Exit(0, "This program requires root privileges")
+		}
+
+		problems := PrivCheck(PrivCurrentUser(), nil)
+		if len(problems) != 0 {
+			InitLog.Exit(0, "%s (try ipp-usb check)", problems[0])
+		}
+	} else if Conf.StateOwner != "" {
+		err = PrivSetupDirs()
+		InitLog.Check(err)
+	}
+
+	// In RunQuirksUpdate mode, update quirks, and we are done
+	if params.Mode == RunQuirksUpdate {
+		err = QuirksUpdate()
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
+	// In RunProbe mode, probe the device, and we are done
+	if params.Mode == RunProbe {
+		err = Probe(params.ProbeAddr)
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
+	// In RunConformance mode, run self-test, and we are done
+	if params.Mode == RunConformance {
+		err = Conformance(params.ConformanceAddr)
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
+	// In RunSoak mode, run soak test, and we are done
+	if params.Mode == RunSoak {
+		err = Soak(params.SoakAddr, params.SoakTime, params.SoakSize)
+		InitLog.Check(err)
+		os.Exit(0)
+	}
+
 	// If background run is requested, it's time to fork
 	if params.Background {
 		err = Daemon()
@@ -260,6 +571,19 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Exit code is set below. This deferred call is executed
+	// after all other deferred calls, so they have a chance
+	// to complete
+	exitCode := ExitOK
+	defer func() {
+		if exitCode != ExitOK {
+			os.Exit(exitCode)
+		}
+	}()
+
+	// Write pending log lines before exit
+	defer LogSync()
+
 	// Prevent multiple copies of ipp-usb from being running
 	// in a same time
 	os.MkdirAll(PathLockDir, 0755)
@@ -287,14 +611,21 @@ func main() {
 		defer Log.Info(' ', "ipp-usb finished")
 	}
 
+	// Obtain listening sockets, inherited from the previous
+	// instance via systemd, if any
+	SdListenFdsInit()
+
 	// Initialize USB
 	err = UsbInit(false)
 	InitLog.Check(err)
 
-	// Close stdin/stdout/stderr, unless running in debug mode
+	// Close stdin/stdout/stderr, unless running in debug mode.
+	// In debug mode, enable debug commands of the control socket
 	if params.Mode != RunDebug {
 		err = CloseStdInOutErr()
 		InitLog.Check(err)
+	} else {
+		CtrlsockDebug = true
 	}
 
 	// Run PnP manager
@@ -321,8 +652,12 @@ func main() {
 				Log.Info(' ', "New IPP-over-USB device found")
 				continue
 			}
+
+			exitCode = ExitNoDevices
 		}
 
 		break
 	}
+
+	SdNotifyStopping()
 }
@@ -0,0 +1,38 @@
+// +build minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Stubs for the minimal build profile
+ *
+ * The minimal profile is selected by the "minimal" build tag. It
+ * omits optional features, that fetch or load foreign data: ICC
+ * profiles lookup, quirks update and replay of the captured device
+ * responses. Core functionality (IPP, eSCL, DNS-SD) remains the same.
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+// errMinimal returned by features, omitted from the minimal build
+var errMinimal = errors.New("not available in the minimal build")
+
+// ICCProfileLookup is not available in the minimal build
+func ICCProfileLookup(info UsbDeviceInfo) string {
+	return ""
+}
+
+// QuirksUpdate is not available in the minimal build
+func QuirksUpdate() error {
+	return errors.New("quirks update: " + errMinimal.Error())
+}
+
+// Replay is not available in the minimal build
+func Replay(file, model string) error {
+	return errors.New("replay: " + errMinimal.Error())
+}
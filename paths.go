@@ -18,8 +18,52 @@ const (
 	// PathQuirksDir defines path to quirks files
 	PathQuirksDir = "/usr/share/ipp-usb/quirks"
 
+	// PathUnixSocketDir defines path to directory where per-device
+	// Unix domain sockets are created
+	PathUnixSocketDir = "/run/ipp-usb"
+
+	// PathLogDir defines path to log directory
+	PathLogDir = "/var/log/ipp-usb"
+
+	// PathLogFile defines path to the main log file
+	PathLogFile = PathLogDir + "/main.log"
+
+	// PathJournaldSocket defines path to the systemd-journald
+	// native protocol socket
+	PathJournaldSocket = "/run/systemd/journal/socket"
+)
+
+// Default locations of the state directories. They may be
+// overridden by the state-dir and data-dir configuration options
+const (
+	// PathDefaultProgState is the default program state directory
+	PathDefaultProgState = "/var/ipp-usb"
+
+	// PathDefaultStatsDir is the default persistent data directory
+	PathDefaultStatsDir = "/var/lib/ipp-usb"
+)
+
+// Paths within the state directories. Use PathSetProgState and
+// PathSetStatsDir to change them
+var (
+	// PathStatsDir defines path to directory where per-device
+	// statistics files are saved to
+	PathStatsDir = PathDefaultStatsDir
+
+	// PathQuirksUpdateDir defines path to quirks files, installed
+	// by the automatic quirks update
+	PathQuirksUpdateDir = PathStatsDir + "/quirks.d"
+
+	// PathIconsDir defines path to directory where per-device
+	// printer icons are cached
+	PathIconsDir = PathStatsDir + "/icons"
+
+	// PathAttrsDir defines path to directory where the last
+	// Get-Printer-Attributes response of each device is saved
+	PathAttrsDir = PathStatsDir + "/attrs"
+
 	// PathProgState defines path to program state directory
-	PathProgState = "/var/ipp-usb"
+	PathProgState = PathDefaultProgState
 
 	// PathLockDir defines path to directory that contains lock files
 	PathLockDir = PathProgState + "/lock"
@@ -34,9 +78,32 @@ const (
 	// files are saved to
 	PathProgStateDev = PathProgState + "/dev"
 
-	// PathLogDir defines path to log directory
-	PathLogDir = "/var/log/ipp-usb"
+	// PathProgStateTLS defines path to directory where generated
+	// per-device TLS certificates are saved to
+	PathProgStateTLS = PathProgState + "/tls"
 
-	// PathLogFile defines path to the main log file
-	PathLogFile = PathLogDir + "/main.log"
+	// PathProgStateSpool defines default path to directory where
+	// large request bodies are spooled to
+	PathProgStateSpool = PathProgState + "/spool"
 )
+
+// PathSetProgState changes location of the program state directory
+// and all paths within it
+func PathSetProgState(dir string) {
+	PathProgState = dir
+	PathLockDir = PathProgState + "/lock"
+	PathLockFile = PathLockDir + "/ipp-usb.lock"
+	PathControlSocket = PathProgState + "/ctrl"
+	PathProgStateDev = PathProgState + "/dev"
+	PathProgStateTLS = PathProgState + "/tls"
+	PathProgStateSpool = PathProgState + "/spool"
+}
+
+// PathSetStatsDir changes location of the persistent data directory
+// and all paths within it
+func PathSetStatsDir(dir string) {
+	PathStatsDir = dir
+	PathQuirksUpdateDir = PathStatsDir + "/quirks.d"
+	PathIconsDir = PathStatsDir + "/icons"
+	PathAttrsDir = PathStatsDir + "/attrs"
+}
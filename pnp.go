@@ -12,7 +12,9 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -26,15 +28,224 @@ const (
 	PnPTerm                      // Terminating signal received
 )
 
+// pnpCtlOp is the control operation, executed by the PnP manager
+// on behalf of the control socket
+type pnpCtlOp int
+
+// pnpCtlOp values
+const (
+	pnpCtlReset        pnpCtlOp = iota // Reset and reinitialize device
+	pnpCtlReloadQuirks                 // Reload quirks
+	pnpCtlLogLevel                     // Set device log level
+	pnpCtlQuirk                        // Override device quirk
+	pnpCtlRefresh                      // Refresh IPP TXT record
+)
+
+// pnpCtlRequest represents a control request to the PnP manager
+type pnpCtlRequest struct {
+	op    pnpCtlOp   // Requested operation
+	addr  UsbAddr    // Device address, if needed
+	level LogLevel   // Log level, for pnpCtlLogLevel
+	name  string     // Quirk name, for pnpCtlQuirk
+	value string     // Quirk value, for pnpCtlQuirk
+	reply chan error // Operation result
+}
+
+// pnpCtlChan delivers control requests to the PnP manager
+var pnpCtlChan = make(chan *pnpCtlRequest)
+
+// pnpBasicCapsChanged contains running devices, which basic
+// capabilities were found changed by pnpCheckBasicCaps, and
+// pnpBasicCapsChan wakes up PnP manager to reinitialize them
+var (
+	pnpBasicCapsChanged = make(map[UsbAddr]*Device)
+	pnpBasicCapsLock    sync.Mutex
+	pnpBasicCapsChan    = make(chan struct{}, 1)
+)
+
+// PnPCtlReset asks PnP manager to reset the device at the USB level
+// and to reinitialize it
+func PnPCtlReset(ctx context.Context, addr UsbAddr) error {
+	return pnpCtl(ctx, &pnpCtlRequest{op: pnpCtlReset, addr: addr})
+}
+
+// PnPCtlReloadQuirks asks PnP manager to reload quirks. New quirks
+// take effect when device is (re)initialized
+func PnPCtlReloadQuirks(ctx context.Context) error {
+	return pnpCtl(ctx, &pnpCtlRequest{op: pnpCtlReloadQuirks})
+}
+
+// PnPCtlLogLevel asks PnP manager to change log level of the
+// running device
+func PnPCtlLogLevel(ctx context.Context, addr UsbAddr, level LogLevel) error {
+	return pnpCtl(ctx, &pnpCtlRequest{op: pnpCtlLogLevel, addr: addr,
+		level: level})
+}
+
+// PnPCtlQuirk asks PnP manager to temporarily override quirk
+// of the running device
+func PnPCtlQuirk(ctx context.Context, addr UsbAddr, name, value string) error {
+	return pnpCtl(ctx, &pnpCtlRequest{op: pnpCtlQuirk, addr: addr,
+		name: name, value: value})
+}
+
+// PnPCtlRefresh asks PnP manager to re-query IPP printer attributes
+// of the running device and to update its DNS-SD TXT record
+func PnPCtlRefresh(ctx context.Context, addr UsbAddr) error {
+	return pnpCtl(ctx, &pnpCtlRequest{op: pnpCtlRefresh, addr: addr})
+}
+
+// pnpCtl sends control request to the PnP manager and waits for reply
+//
+// PnP manager may be busy for a while (i.e., initializing some device),
+// so waiting is limited by the ctx
+func pnpCtl(ctx context.Context, rq *pnpCtlRequest) error {
+	rq.reply = make(chan error, 1)
+
+	select {
+	case pnpCtlChan <- rq:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-rq.reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pnpCtlExecute executes control request in the context of
+// the PnP manager
+func pnpCtlExecute(rq *pnpCtlRequest, devByAddr map[UsbAddr]*Device,
+	retryByAddr map[UsbAddr]time.Time, attemptsByAddr map[UsbAddr]int) error {
+
+	switch rq.op {
+	case pnpCtlReset:
+		dev := devByAddr[rq.addr]
+		if dev == nil {
+			if _, found := retryByAddr[rq.addr]; !found {
+				return ErrNotRunning
+			}
+
+			// Device is waiting for retry; retry now
+			Log.Info(' ', "PNP %s: retry requested", rq.addr)
+			retryByAddr[rq.addr] = time.Now()
+			delete(attemptsByAddr, rq.addr)
+			return nil
+		}
+
+		Log.Info(' ', "PNP %s: reset requested", rq.addr)
+		DevEvents.Add(rq.addr, EventReset, "requested")
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			DevShutdownTimeout)
+		dev.Shutdown(ctx)
+		cancel()
+
+		dev.CloseAndReset()
+		delete(devByAddr, rq.addr)
+		retryByAddr[rq.addr] = time.Now()
+		delete(attemptsByAddr, rq.addr)
+
+	case pnpCtlReloadQuirks:
+		Log.Info(' ', "PNP: reloading quirks")
+		err := ConfLoadQuirks()
+		if err != nil {
+			Log.Error('!', "PNP: %s", err)
+			return err
+		}
+
+	case pnpCtlLogLevel:
+		dev := devByAddr[rq.addr]
+		if dev == nil {
+			return ErrNotRunning
+		}
+
+		Log.Info(' ', "PNP %s: log level changed", rq.addr)
+		dev.Log.SetLevels(rq.level)
+
+	case pnpCtlQuirk:
+		dev := devByAddr[rq.addr]
+		if dev == nil {
+			return ErrNotRunning
+		}
+
+		err := dev.UsbTransport.OverrideQuirk(rq.name, rq.value)
+		if err != nil {
+			return err
+		}
+
+		Log.Info(' ', "PNP %s: quirk %s overridden", rq.addr, rq.name)
+
+	case pnpCtlRefresh:
+		dev := devByAddr[rq.addr]
+		if dev == nil {
+			return ErrNotRunning
+		}
+
+		Log.Info(' ', "PNP %s: TXT refresh requested", rq.addr)
+		return dev.Refresh()
+	}
+
+	return nil
+}
+
+// pnpBusySince is the time (UnixNano), when PnP manager started
+// to handle the current event, or 0, while it waits for the next
+// event. Accessed atomically; used to detect hangs
+var pnpBusySince int64
+
+// pnpAlive tells if PnP manager is alive: either it waits for
+// events or handles the current event for less than PnPBusyMax
+func pnpAlive() bool {
+	since := atomic.LoadInt64(&pnpBusySince)
+	return since == 0 || time.Since(time.Unix(0, since)) < PnPBusyMax
+}
+
 // pnpRetryTime returns time of next retry of failed device initialization
-func pnpRetryTime(err error) time.Time {
+//
+// attempt is the count of failed initialization attempts so far.
+// Retry interval grows exponentially, starting from the configured
+// retry-interval up to the retry-max-interval. If retry-max-attempts
+// is configured and exhausted, the device is not retried anymore.
+// If initialization timed out, the per-device watchdog may hold
+// off the next attempt (see DevWatchdogError)
+//
+// Transient conditions, not caused by the device itself (device
+// is held by another ipp-usb instance or its services are not
+// ready yet), are retried regardless of retry-max-attempts
+func pnpRetryTime(addr UsbAddr, err error, attempt int) time.Time {
 	if err == ErrBlackListed || err == ErrUnusable {
 		// These errors are unrecoverable.
 		// Forget about device for the next million hours :-)
 		return time.Now().Add(time.Hour * 1e6)
 	}
 
-	return time.Now().Add(DevInitRetryInterval)
+	transient := err == ErrClaimed || err == ErrPartialInit
+	if !transient && Conf.HotplugRetryCount != 0 &&
+		attempt >= int(Conf.HotplugRetryCount) {
+		Log.Error('!', "PNP %s: %d attempts failed, giving up",
+			addr, attempt)
+		return time.Now().Add(time.Hour * 1e6)
+	}
+
+	// Per-device watchdog may hold off the next attempt
+	if wderr, ok := err.(DevWatchdogError); ok && !wderr.Until.IsZero() {
+		return wderr.Until
+	}
+
+	interval := Conf.HotplugRetryMin
+	for i := 1; i < attempt && interval < Conf.HotplugRetryMax; i++ {
+		interval *= 2
+	}
+
+	if interval > Conf.HotplugRetryMax {
+		interval = Conf.HotplugRetryMax
+	}
+
+	return time.Now().Add(interval)
 }
 
 // pnpRetryExpired checks if device initialization retry time expired
@@ -48,8 +259,11 @@ func pnpRetryExpired(tm time.Time) bool {
 // devices to serve
 func PnPStart(exitWhenIdle bool) PnPExitReason {
 	devices := UsbAddrList{}
+	descByAddr := make(map[UsbAddr]UsbDeviceDesc)
 	devByAddr := make(map[UsbAddr]*Device)
 	retryByAddr := make(map[UsbAddr]time.Time)
+	attemptsByAddr := make(map[UsbAddr]int)
+	pausedByAddr := make(map[UsbAddr]string)
 	sigChan := make(chan os.Signal, 1)
 	ticker := time.NewTicker(DevInitRetryInterval / 4)
 	tickerRunning := true
@@ -65,9 +279,27 @@ func PnPStart(exitWhenIdle bool) PnPExitReason {
 		defer CtrlsockStop()
 	}
 
+	// Start secondary source of hotplug events, if enabled
+	// or required by platform in the udev mode
+	if Conf.HotplugNetlink || (exitWhenIdle && UeventSourceUdev) {
+		err = UeventSourceStart()
+		if err != nil {
+			Log.Error('!', "PNP: %s uevents: %s",
+				UeventSourceName, err)
+		}
+	}
+
+	// Setup systemd watchdog, if enabled
+	SdWatchdogStart(pnpAlive)
+	defer SdWatchdogStop()
+
+	SdNotifyReady()
+
 	// Serve PnP events until terminated
 loop:
 	for {
+		atomic.StoreInt64(&pnpBusySince, time.Now().UnixNano())
+
 		devDescs, err := UsbGetIppOverUsbDeviceDescs()
 
 		if err == nil {
@@ -79,9 +311,81 @@ loop:
 			added, removed := devices.Diff(newdevices)
 			devices = newdevices
 
+			// Devices, that changed their descriptors (i.e.,
+			// after firmware update) are reinitialized from
+			// scratch, with fresh descriptors and quirks
+			changed := pnpChanged(descByAddr, devDescs, added, removed)
+
+			// Basic capabilities can only be read from the opened
+			// device, so they are rechecked in background for
+			// running devices, reported by hotplug events
+			for _, addr := range UsbHotPlugAdded() {
+				dev := devByAddr[addr]
+				if dev != nil && devices.Find(addr) >= 0 &&
+					changed.Find(addr) < 0 {
+					go pnpCheckBasicCaps(addr, dev)
+				}
+			}
+
+			for addr, dev := range pnpBasicCapsTake() {
+				if devByAddr[addr] == dev && changed.Find(addr) < 0 {
+					Log.Info(' ', "PNP %s: basic caps changed, "+
+						"reinitializing", addr)
+					DevEvents.Add(addr, EventChanged,
+						"basic caps changed")
+					changed.Add(addr)
+				}
+			}
+
+			for _, addr := range changed {
+				removed = append(removed, addr)
+				added = append(added, addr)
+			}
+
+			descByAddr = devDescs
+
+			// Handle removed devices. Do it first, so re-enumerated
+			// device releases its HTTP port and DNS-SD name before
+			// it will be initialized at the new address
+			for _, addr := range removed {
+				Log.Debug('-', "PNP %s: removed", addr)
+				DevEvents.Add(addr, EventRemoved, "")
+				delete(retryByAddr, addr)
+				delete(attemptsByAddr, addr)
+				delete(pausedByAddr, addr)
+				StatusDel(addr)
+
+				dev, ok := devByAddr[addr]
+				if ok {
+					dev.Close()
+					delete(devByAddr, addr)
+				}
+			}
+
 			// Handle added devices
 			for _, addr := range added {
 				Log.Debug('+', "PNP %s: added", addr)
+				DevEvents.Add(addr, EventDiscovered, "")
+
+				// Debounce, if configured: devices often
+				// disappear and re-enumerate during power-on
+				if Conf.HotplugDebounce != 0 {
+					Log.Debug(' ', "PNP %s: init delayed for %s",
+						addr, Conf.HotplugDebounce)
+					retryByAddr[addr] = time.Now().Add(
+						Conf.HotplugDebounce)
+					continue
+				}
+
+				// Skip paused device
+				ident, paused := pnpPausedIdent(devDescs[addr])
+				if paused {
+					Log.Info(' ', "PNP %s: paused", addr)
+					pausedByAddr[addr] = ident
+					StatusSet(addr, devDescs[addr], 0, ErrPaused)
+					continue
+				}
+
 				dev, err := NewDevice(devDescs[addr])
 				port := 0
 				if dev != nil {
@@ -90,24 +394,50 @@ loop:
 				StatusSet(addr, devDescs[addr], port, err)
 
 				if err == nil {
+					DevEvents.Add(addr, EventInitialized, "")
+					StatusSetICCProfile(addr, dev.ICCProfile)
+					StatusSetFirmware(addr,
+						dev.UsbTransport.UsbDeviceInfo().Firmware)
+					StatusSetStats(addr, dev.UsbTransport.Stats())
+					StatusSetXferStats(addr,
+						dev.UsbTransport.XferStats)
 					devByAddr[addr] = dev
 				} else {
 					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
+					DevEvents.Add(addr, EventInitFailed,
+						err.Error())
+					attemptsByAddr[addr]++
+					retryByAddr[addr] = pnpRetryTime(addr,
+						err, attemptsByAddr[addr])
 				}
 			}
 
-			// Handle removed devices
-			for _, addr := range removed {
-				Log.Debug('-', "PNP %s: removed", addr)
-				delete(retryByAddr, addr)
-				StatusDel(addr)
+			// Pause running devices, if requested by administrator,
+			// releasing them to other drivers
+			for addr, dev := range devByAddr {
+				ident := dev.UsbTransport.UsbDeviceInfo().Ident()
+				if !UsbClaimPaused(ident) {
+					continue
+				}
 
-				dev, ok := devByAddr[addr]
-				if ok {
-					dev.Close()
-					delete(devByAddr, addr)
+				Log.Info(' ', "PNP %s: paused, releasing device", addr)
+				pnpCloseDevices(map[UsbAddr]*Device{addr: dev})
+				delete(devByAddr, addr)
+				pausedByAddr[addr] = ident
+				StatusSet(addr, devDescs[addr], 0, ErrPaused)
+			}
+
+			// Resume paused devices. Resumed device is reclaimed
+			// as soon as possible
+			for addr, ident := range pausedByAddr {
+				if UsbClaimPaused(ident) {
+					continue
 				}
+
+				Log.Info(' ', "PNP %s: resumed", addr)
+				delete(pausedByAddr, addr)
+				delete(attemptsByAddr, addr)
+				retryByAddr[addr] = time.Now()
 			}
 
 			// Handle devices, waiting for retry
@@ -116,6 +446,16 @@ loop:
 					continue
 				}
 
+				ident, paused := pnpPausedIdent(devDescs[addr])
+				if paused {
+					Log.Info(' ', "PNP %s: paused", addr)
+					delete(retryByAddr, addr)
+					delete(attemptsByAddr, addr)
+					pausedByAddr[addr] = ident
+					StatusSet(addr, devDescs[addr], 0, ErrPaused)
+					continue
+				}
+
 				Log.Debug('+', "PNP %s: retry", addr)
 				dev, err := NewDevice(devDescs[addr])
 				port := 0
@@ -125,15 +465,36 @@ loop:
 				StatusSet(addr, devDescs[addr], port, err)
 
 				if err == nil {
+					DevEvents.Add(addr, EventInitialized, "")
+					StatusSetICCProfile(addr, dev.ICCProfile)
+					StatusSetFirmware(addr,
+						dev.UsbTransport.UsbDeviceInfo().Firmware)
+					StatusSetStats(addr, dev.UsbTransport.Stats())
+					StatusSetXferStats(addr,
+						dev.UsbTransport.XferStats)
 					devByAddr[addr] = dev
 					delete(retryByAddr, addr)
+					delete(attemptsByAddr, addr)
 				} else {
 					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
+					DevEvents.Add(addr, EventInitFailed,
+						err.Error())
+					attemptsByAddr[addr]++
+					retryByAddr[addr] = pnpRetryTime(addr,
+						err, attemptsByAddr[addr])
 				}
 			}
 		}
 
+		// Update systemd status
+		SdNotifyStatus(pnpSdStatus(devByAddr))
+
+		// After the first pass, devices, present at startup, have
+		// claimed their inherited sockets. The remaining sockets
+		// belong to devices that are gone, so release them. On
+		// subsequent passes nothing is left to release
+		SdListenFdsRelease()
+
 		// Handle exit when idle
 		if exitWhenIdle && len(devices) == 0 {
 			Log.Info(' ', "No IPP-over-USB devices present, exiting")
@@ -151,18 +512,194 @@ loop:
 		}
 
 		// Wait for the next event
+		atomic.StoreInt64(&pnpBusySince, 0)
 		select {
 		case <-UsbHotPlugChan:
+		case <-pnpBasicCapsChan:
+		case <-UsbResetChan:
+			// libusb was reinitialized, all opened devices
+			// are unusable. Close them and rediscover from
+			// scratch
+			Log.Error('!', "PNP: USB reset, reopening all devices")
+			pnpCloseDevices(devByAddr)
+			for addr := range devByAddr {
+				DevEvents.Add(addr, EventReset, "USB reset")
+				StatusDel(addr)
+			}
+
+			devices = UsbAddrList{}
+			descByAddr = make(map[UsbAddr]UsbDeviceDesc)
+			devByAddr = make(map[UsbAddr]*Device)
+			retryByAddr = make(map[UsbAddr]time.Time)
+			attemptsByAddr = make(map[UsbAddr]int)
+			pausedByAddr = make(map[UsbAddr]string)
+		case <-UsbClaimChan:
+		case rq := <-pnpCtlChan:
+			rq.reply <- pnpCtlExecute(rq, devByAddr,
+				retryByAddr, attemptsByAddr)
 		case <-ticker.C:
 		case sig := <-sigChan:
 			Log.Info(' ', "%s signal received, exiting", sig)
+			SdFdStoreFreeze()
 			break loop
 		}
 	}
 
-	// Close remaining devices
-	ctx, cancel := context.WithTimeout(context.Background(),
-		DevShutdownTimeout)
+	// Close remaining devices. Requests in progress are
+	// allowed to complete within the drain timeout
+	pnpDrainDevices(devByAddr)
+	return PnPTerm
+}
+
+// pnpCheckBasicCaps rechecks basic capabilities of the running
+// device. It runs in background, as it involves I/O with device.
+// If capabilities were changed, PnP manager is woken up to
+// reinitialize the device
+func pnpCheckBasicCaps(addr UsbAddr, dev *Device) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	if !dev.UsbTransport.BasicCapsChanged() {
+		return
+	}
+
+	pnpBasicCapsLock.Lock()
+	pnpBasicCapsChanged[addr] = dev
+	pnpBasicCapsLock.Unlock()
+
+	select {
+	case pnpBasicCapsChan <- struct{}{}:
+	default:
+	}
+}
+
+// pnpBasicCapsTake returns and clears devices, which basic
+// capabilities were found changed by pnpCheckBasicCaps
+func pnpBasicCapsTake() map[UsbAddr]*Device {
+	pnpBasicCapsLock.Lock()
+	defer pnpBasicCapsLock.Unlock()
+
+	changed := pnpBasicCapsChanged
+	pnpBasicCapsChanged = make(map[UsbAddr]*Device)
+	return changed
+}
+
+// pnpSdStatus returns systemd status string, listing devices
+// currently served
+func pnpSdStatus(devByAddr map[UsbAddr]*Device) string {
+	addrs := make([]UsbAddr, 0, len(devByAddr))
+	for addr := range devByAddr {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Less(addrs[j])
+	})
+
+	models := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		info := devByAddr[addr].UsbTransport.UsbDeviceInfo()
+		models = append(models, info.MfgAndProduct)
+	}
+
+	return SdNotifyStatusFormat(models)
+}
+
+// pnpChanged returns addresses of devices, that changed their
+// descriptors since the previous scan, at the same address
+//
+// Devices, re-enumerated at the new address on the same physical
+// port, are detected here as well: they are already present in
+// the added and removed lists and only logged
+func pnpChanged(prev, descs map[UsbAddr]UsbDeviceDesc,
+	added, removed UsbAddrList) UsbAddrList {
+
+	changed := UsbAddrList{}
+	for addr, desc := range descs {
+		old, ok := prev[addr]
+		if ok && desc.Changed(old) {
+			Log.Info(' ', "PNP %s: descriptors changed, reinitializing",
+				addr)
+			DevEvents.Add(addr, EventChanged, "descriptors changed")
+			changed.Add(addr)
+		}
+	}
+
+	for _, addr := range added {
+		path := descs[addr].PortPath
+		if path == "" {
+			continue
+		}
+
+		for _, oldaddr := range removed {
+			if prev[oldaddr].PortPath == path {
+				Log.Info(' ', "PNP %s: re-enumerated at port %s, was %s",
+					addr, path, oldaddr)
+				DevEvents.Add(addr, EventChanged,
+					"re-enumerated, was "+oldaddr.String())
+			}
+		}
+	}
+
+	return changed
+}
+
+// pnpPausedIdent returns device ident and tells, if device is paused
+// by administrator
+//
+// Obtaining ident requires device opening, so it is only done when
+// some devices are actually paused
+func pnpPausedIdent(desc UsbDeviceDesc) (string, bool) {
+	if !UsbClaimAnyPaused() {
+		return "", false
+	}
+
+	info, err := desc.GetUsbDeviceInfo()
+	if err != nil {
+		return "", false
+	}
+
+	ident := info.Ident()
+	return ident, UsbClaimPaused(ident)
+}
+
+// pnpCloseDevices gracefully shuts down and closes devices
+//
+// If libusb event loop is dead, device may never close, so
+// waiting is limited in time and stuck devices are abandoned
+func pnpCloseDevices(devByAddr map[UsbAddr]*Device) {
+	pnpShutdownDevices(devByAddr, DevShutdownTimeout)
+}
+
+// pnpDrainDevices shuts down devices when ipp-usb exits
+//
+// HTTP requests in progress are allowed to complete within the
+// configured drain timeout, so USB transactions are not
+// interrupted in the middle and the next ipp-usb instance takes
+// over the device in a clean state
+func pnpDrainDevices(devByAddr map[UsbAddr]*Device) {
+	timeout := Conf.HotplugDrainTimeout
+	if timeout < DevShutdownTimeout {
+		timeout = DevShutdownTimeout
+	}
+
+	if len(devByAddr) != 0 {
+		Log.Info(' ', "PNP: draining devices, up to %s", timeout)
+	}
+
+	pnpShutdownDevices(devByAddr, timeout)
+}
+
+// pnpShutdownDevices gracefully shuts down and closes devices,
+// waiting up to the specified timeout for the graceful shutdown
+func pnpShutdownDevices(devByAddr map[UsbAddr]*Device,
+	timeout time.Duration) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	var done sync.WaitGroup
@@ -176,6 +713,15 @@ loop:
 		}(dev)
 	}
 
-	done.Wait()
-	return PnPTerm
+	closed := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(timeout + DevShutdownTimeout):
+		Log.Error('!', "PNP: some devices didn't close in time")
+	}
 }
@@ -0,0 +1,110 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for PnP manager
+ */
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPnPRetryTime tests pnpRetryTime
+func TestPnPRetryTime(t *testing.T) {
+	saveConf := Conf
+	defer func() { Conf = saveConf }()
+
+	Conf.HotplugRetryMin = time.Second
+	Conf.HotplugRetryMax = 10 * time.Second
+	Conf.HotplugRetryCount = 5
+
+	errFailed := errors.New("failed")
+	never := time.Hour * 1e6
+
+	type testData struct {
+		err      error
+		attempt  int
+		expected time.Duration
+	}
+
+	tests := []testData{
+		// Exponential growth
+		{errFailed, 1, time.Second},
+		{errFailed, 2, 2 * time.Second},
+		{errFailed, 3, 4 * time.Second},
+		{errFailed, 4, 8 * time.Second},
+
+		// Unrecoverable errors
+		{ErrBlackListed, 1, never},
+		{ErrUnusable, 1, never},
+
+		// Attempts limit
+		{errFailed, 5, never},
+		{errFailed, 6, never},
+
+		// Transient errors are not limited
+		{ErrClaimed, 5, 10 * time.Second},
+		{ErrPartialInit, 7, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		now := time.Now()
+		tm := pnpRetryTime(UsbAddr{Bus: 1, Address: 2},
+			test.err, test.attempt)
+		interval := tm.Sub(now)
+
+		if interval < test.expected ||
+			interval > test.expected+time.Second {
+			t.Errorf("%s, attempt %d: expected %s, present %s",
+				test.err, test.attempt, test.expected, interval)
+		}
+	}
+
+	// Max interval cap
+	Conf.HotplugRetryCount = 0
+	now := time.Now()
+	interval := pnpRetryTime(UsbAddr{}, errFailed, 20).Sub(now)
+	if interval < Conf.HotplugRetryMax ||
+		interval > Conf.HotplugRetryMax+time.Second {
+		t.Errorf("cap: expected %s, present %s",
+			Conf.HotplugRetryMax, interval)
+	}
+
+	// Per-device watchdog holds off the next attempt
+	until := time.Now().Add(time.Minute)
+	tm := pnpRetryTime(UsbAddr{}, DevWatchdogError{Until: until}, 1)
+	if !tm.Equal(until) {
+		t.Errorf("watchdog: expected %s, present %s", until, tm)
+	}
+}
+
+// TestPnPAlive tests detection of PnP manager hangs
+func TestPnPAlive(t *testing.T) {
+	defer atomic.StoreInt64(&pnpBusySince, 0)
+
+	// Waiting for events
+	atomic.StoreInt64(&pnpBusySince, 0)
+	if !pnpAlive() {
+		t.Errorf("idle: must be alive")
+	}
+
+	// Handling an event for a while, i.e., initializing devices
+	busy := time.Now().Add(-PnPBusyMax / 2)
+	atomic.StoreInt64(&pnpBusySince, busy.UnixNano())
+	if !pnpAlive() {
+		t.Errorf("busy: must be alive")
+	}
+
+	// Stuck
+	busy = time.Now().Add(-PnPBusyMax)
+	atomic.StoreInt64(&pnpBusySince, busy.UnixNano())
+	if pnpAlive() {
+		t.Errorf("stuck: must not be alive")
+	}
+}
@@ -0,0 +1,341 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Checking of privileges, needed to run without root
+ *
+ * ipp-usb may run as a dedicated non-root user, if enabled by the
+ * allow-non-root configuration option. This user needs:
+ *   - write access to the state, log and statistics directories
+ *     (see state-owner configuration option)
+ *   - read-write access to the USB device nodes of IPP-over-USB
+ *     devices, granted by udev (checked on Linux only)
+ *   - TCP ports above 1023, as capability to bind low ports is
+ *     not expected
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PrivUdevRule is the udev rule, that grants access to USB device
+// nodes of IPP-over-USB devices to the group GROUP
+const PrivUdevRule = `SUBSYSTEM=="usb", ENV{DEVTYPE}=="usb_device", ` +
+	`ENV{ID_USB_INTERFACES}=="*:070104:*", GROUP="%s", MODE="0660"`
+
+// privCapNetBindService is the CAP_NET_BIND_SERVICE capability bit
+const privCapNetBindService = 10
+
+// PrivUser represents the user, ipp-usb runs as or going to run as
+type PrivUser struct {
+	Name string // User name
+	UID  int    // User ID
+	GID  int    // Primary group ID
+	GIDs []int  // All group IDs, including primary
+}
+
+// PrivCurrentUser returns PrivUser for the current process
+func PrivCurrentUser() PrivUser {
+	u := PrivUser{
+		Name: strconv.Itoa(os.Geteuid()),
+		UID:  os.Geteuid(),
+		GID:  os.Getegid(),
+		GIDs: []int{os.Getegid()},
+	}
+
+	if usr, err := user.LookupId(u.Name); err == nil {
+		u.Name = usr.Username
+	}
+
+	if gids, err := os.Getgroups(); err == nil {
+		u.GIDs = append(u.GIDs, gids...)
+	}
+
+	return u
+}
+
+// PrivLookupUser returns PrivUser for the "user[:group]" spec,
+// as used by the state-owner configuration option. If group is
+// not specified, user's primary group is used
+func PrivLookupUser(spec string) (PrivUser, error) {
+	name := spec
+	group := ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return PrivUser{}, err
+	}
+
+	u := PrivUser{Name: usr.Username}
+	u.UID, _ = strconv.Atoi(usr.Uid)
+	u.GID, _ = strconv.Atoi(usr.Gid)
+
+	if group != "" {
+		grp, err := user.LookupGroup(group)
+		if err != nil {
+			return PrivUser{}, err
+		}
+
+		u.GID, _ = strconv.Atoi(grp.Gid)
+	}
+
+	u.GIDs = []int{u.GID}
+	if gids, err := usr.GroupIds(); err == nil {
+		for _, gid := range gids {
+			n, _ := strconv.Atoi(gid)
+			u.GIDs = append(u.GIDs, n)
+		}
+	}
+
+	return u, nil
+}
+
+// CanAccess tells if user can access the file. If write is true,
+// write access is checked, read access otherwise
+func (u PrivUser) CanAccess(path string, write bool) bool {
+	if u.UID == 0 {
+		return true
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	perm := fi.Mode().Perm()
+	bits := os.FileMode(04)
+	if write {
+		bits = 02
+	}
+
+	switch {
+	case int(st.Uid) == u.UID:
+		return perm&(bits<<6) != 0
+	case u.inGroup(int(st.Gid)):
+		return perm&(bits<<3) != 0
+	}
+
+	return perm&bits != 0
+}
+
+// inGroup tells if user is a member of the group
+func (u PrivUser) inGroup(gid int) bool {
+	for _, g := range u.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// PrivDirs returns list of directories, where ipp-usb needs
+// write access
+func PrivDirs() []string {
+	dirs := []string{
+		PathProgState,
+		PathStatsDir,
+		PathLogDir,
+	}
+
+	if Conf.UsbSpoolDir != PathProgStateSpool {
+		dirs = append(dirs, Conf.UsbSpoolDir)
+	}
+
+	if Conf.HTTPUnixEnable {
+		dirs = append(dirs, PathUnixSocketDir)
+	}
+
+	return dirs
+}
+
+// PrivCheck checks if user has all privileges, needed to run
+// ipp-usb, and returns list of found problems
+//
+// USB device nodes are checked for the specified devices; descs
+// may be nil
+func PrivCheck(u PrivUser, descs map[UsbAddr]UsbDeviceDesc) []string {
+	var problems []string
+
+	if u.UID == 0 {
+		return nil
+	}
+
+	// Check directories. Missed directory is OK, if it can be
+	// created. Files, left by previous runs as root, must be
+	// writable as well
+	for _, dir := range PrivDirs() {
+		path := dir
+		for {
+			if _, err := os.Stat(path); err == nil ||
+				path == "/" || path == "." {
+				break
+			}
+			path = filepath.Dir(path)
+		}
+
+		if path == dir {
+			filepath.Walk(dir, func(p string, fi os.FileInfo,
+				err error) error {
+				if err == nil && !u.CanAccess(p, true) {
+					path = p
+					return errors.New("not writable")
+				}
+				return nil
+			})
+		}
+
+		if !u.CanAccess(path, true) {
+			problems = append(problems,
+				fmt.Sprintf("%s: not writable by %s (see state-owner)",
+					path, u.Name))
+		}
+	}
+
+	// Check TCP ports
+	if Conf.HTTPTCPEnable && Conf.HTTPMinPort < 1024 &&
+		!(u.UID == os.Geteuid() && privHasCap(privCapNetBindService)) {
+		problems = append(problems,
+			fmt.Sprintf("http-min-port = %d: ports below 1024 "+
+				"require root", Conf.HTTPMinPort))
+	}
+
+	// Check USB device nodes
+	for addr := range descs {
+		path := privUsbDevNode(addr)
+		if path != "" && !u.CanAccess(path, true) {
+			problems = append(problems,
+				fmt.Sprintf("%s: not accessible by %s (see udev rule below)",
+					path, u.Name))
+		}
+	}
+
+	return problems
+}
+
+// PrivSetupDirs creates directories, needed to run ipp-usb, and
+// sets their ownership to the user, specified by the state-owner
+// configuration option. It must be called by root
+//
+// Ownership is changed only for directories, created here, and
+// not recursively, so ipp-usb never changes ownership of files,
+// created by others. Existing directories must be already owned
+// by the state-owner user; otherwise, they are refused
+func PrivSetupDirs() error {
+	u, err := PrivLookupUser(Conf.StateOwner)
+	if err != nil {
+		return fmt.Errorf("state-owner: %s", err)
+	}
+
+	for _, dir := range PrivDirs() {
+		err = privSetupDir(dir, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// privSetupDir creates the directory, including missed parents,
+// owned by the user, or checks that existing directory is owned
+// by the user
+func privSetupDir(dir string, u PrivUser) error {
+	fi, err := os.Lstat(dir)
+	switch {
+	case err == nil:
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() || !ok || int(st.Uid) != u.UID {
+			return fmt.Errorf("%s: not a directory, owned by %s, "+
+				"refusing to use it (see state-owner)", dir, u.Name)
+		}
+		return nil
+
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	parent := filepath.Dir(dir)
+	if _, err = os.Lstat(parent); os.IsNotExist(err) {
+		err = privSetupDir(parent, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Mkdir(dir, 0755)
+	if err == nil {
+		err = os.Lchown(dir, u.UID, u.GID)
+	}
+
+	return err
+}
+
+// PrivReport writes diagnostics of privileges, needed to run
+// ipp-usb without root, into the InitLog. It is used by the
+// `ipp-usb check` command
+//
+// If running as root, privileges of the state-owner user are
+// checked, if configured
+func PrivReport(descs map[UsbAddr]UsbDeviceDesc) {
+	u := PrivCurrentUser()
+	if u.UID == 0 {
+		if Conf.StateOwner == "" {
+			return
+		}
+
+		var err error
+		u, err = PrivLookupUser(Conf.StateOwner)
+		if err != nil {
+			InitLog.Info(0, "Privileges: state-owner: %s", err)
+			return
+		}
+	}
+
+	problems := PrivCheck(u, descs)
+	if !Conf.AllowNonRoot {
+		problems = append([]string{"allow-non-root is disabled"},
+			problems...)
+	}
+
+	if len(problems) == 0 {
+		InitLog.Info(0, "Privileges of %q: OK", u.Name)
+		return
+	}
+
+	InitLog.Info(0, "Privileges of %q: not sufficient to run without root",
+		u.Name)
+
+	udev := false
+	for _, problem := range problems {
+		InitLog.Info(0, "  %s", problem)
+		udev = udev || strings.HasPrefix(problem, "/dev/")
+	}
+
+	if udev {
+		group := strconv.Itoa(u.GID)
+		if grp, err := user.LookupGroupId(group); err == nil {
+			group = grp.Name
+		}
+
+		InitLog.Info(0, "To grant access to USB devices, add udev rule:")
+		InitLog.Info(0, "  "+PrivUdevRule, group)
+	}
+}
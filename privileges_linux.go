@@ -0,0 +1,39 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Checking of privileges -- Linux version
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// privUsbDevNode returns path to the USB device node
+func privUsbDevNode(addr UsbAddr) string {
+	return fmt.Sprintf("/dev/bus/usb/%3.3d/%3.3d", addr.Bus, addr.Address)
+}
+
+// privHasCap tells if current process has the effective capability
+func privHasCap(capability uint) bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(
+				strings.TrimSpace(line[7:]), 16, 64)
+			return err == nil && caps&(1<<capability) != 0
+		}
+	}
+
+	return false
+}
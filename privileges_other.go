@@ -0,0 +1,27 @@
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Checking of privileges -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+// privUsbDevNode returns path to the USB device node, or "" if
+// unknown on this platform. Device nodes are not checked then
+func privUsbDevNode(addr UsbAddr) string {
+	return ""
+}
+
+// privHasCap tells if current process has the effective capability.
+// Capabilities are not supported on this platform
+func privHasCap(capability uint) bool {
+	return false
+}
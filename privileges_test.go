@@ -0,0 +1,127 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for privileges checking
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestPrivCanAccess tests PrivUser.CanAccess
+func TestPrivCanAccess(t *testing.T) {
+	file, err := ioutil.TempFile("", "ipp-usb-priv")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	file.Close()
+	defer os.Remove(file.Name())
+
+	fi, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	st := fi.Sys().(*syscall.Stat_t)
+	uid, gid := int(st.Uid), int(st.Gid)
+
+	owner := PrivUser{Name: "owner", UID: uid, GID: gid, GIDs: []int{gid}}
+	member := PrivUser{Name: "member", UID: uid + 1000, GID: gid + 1000,
+		GIDs: []int{gid + 1000, gid}}
+	other := PrivUser{Name: "other", UID: uid + 1000, GID: gid + 1000,
+		GIDs: []int{gid + 1000}}
+
+	type testData struct {
+		mode  os.FileMode
+		user  PrivUser
+		write bool
+		ok    bool
+	}
+
+	tests := []testData{
+		{0600, owner, true, true},
+		{0400, owner, true, uid == 0},
+		{0660, member, true, true},
+		{0640, member, true, false},
+		{0640, member, false, true},
+		{0664, other, true, false},
+		{0664, other, false, true},
+	}
+
+	for _, test := range tests {
+		os.Chmod(file.Name(), test.mode)
+		ok := test.user.CanAccess(file.Name(), test.write)
+		if ok != test.ok {
+			t.Errorf("%s, mode %o, write=%v: expected %v, present %v",
+				test.user.Name, test.mode, test.write, test.ok, ok)
+		}
+	}
+
+	// Root can access anything
+	root := PrivUser{Name: "root"}
+	os.Chmod(file.Name(), 0)
+	if !root.CanAccess(file.Name(), true) {
+		t.Errorf("root can't access file")
+	}
+}
+
+// TestPrivSetupDir tests privSetupDir
+func TestPrivSetupDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-priv")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	u := PrivCurrentUser()
+	other := PrivUser{Name: "other", UID: u.UID + 1000, GID: u.GID}
+
+	// Missed directories are created, including parents
+	path := filepath.Join(dir, "state", "dev")
+	err = privSetupDir(path, u)
+	if err != nil {
+		t.Errorf("%s: %s", path, err)
+	}
+
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		t.Errorf("%s: not created", path)
+	}
+
+	// Existing directory, owned by the user, is accepted
+	err = privSetupDir(path, u)
+	if err != nil {
+		t.Errorf("%s: %s", path, err)
+	}
+
+	// Directory, owned by somebody else, is refused
+	err = privSetupDir(path, other)
+	if err == nil {
+		t.Errorf("%s: not owned by %s, but accepted", path, other.Name)
+	}
+
+	// Symlink is refused, even if it points to good directory
+	link := filepath.Join(dir, "link")
+	os.Symlink(path, link)
+	err = privSetupDir(link, u)
+	if err == nil {
+		t.Errorf("%s: symlink accepted", link)
+	}
+
+	// Files are refused
+	file := filepath.Join(path, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	err = privSetupDir(file, u)
+	if err == nil {
+		t.Errorf("%s: file accepted", file)
+	}
+}
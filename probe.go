@@ -0,0 +1,178 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * One-shot device probing for diagnostics
+ *
+ * Probe opens the specified device, runs the same initialization
+ * steps, as the daemon does (USB device info, basic capabilities,
+ * IPP Get-Printer-Attributes, eSCL ScannerCapabilities), and prints
+ * the structured report, suitable for attaching to bug reports.
+ * HTTP server and DNS-SD publisher are not started
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Probe probes the device, specified by its USB address,
+// written as "BUS:DEV" (i.e., "1:5" or "001:005")
+func Probe(name string) error {
+	desc, transport, err := probeOpen(name)
+	if err != nil {
+		return err
+	}
+
+	defer transport.Close(false)
+
+	addr := desc.UsbAddr
+	info := transport.UsbDeviceInfo()
+	quirks := transport.Quirks()
+	client := &http.Client{Transport: transport}
+	port := Conf.HTTPMinPort
+
+	report := []string{
+		"Device:",
+		fmt.Sprintf("  USB address:   %s", addr),
+		fmt.Sprintf("  Vndr:Prod:     %4.4x:%4.4x", info.Vendor, info.Product),
+		fmt.Sprintf("  Port path:     %s", info.PortPath),
+		fmt.Sprintf("  Ident:         %s", info.Ident()),
+		fmt.Sprintf("  Manufacturer:  %s", info.Manufacturer),
+		fmt.Sprintf("  Product:       %s", info.ProductName),
+		fmt.Sprintf("  SerialNumber:  %s", info.SerialNumber),
+		fmt.Sprintf("  BasicCaps:     %s", info.BasicCaps),
+		fmt.Sprintf("  Interfaces:    %d", len(desc.IfAddrs)),
+	}
+
+	// Run init script, if any, as daemon does
+	err = probeInitScript(transport, client)
+	if err != nil {
+		report = append(report, "Init script:", "  "+err.Error())
+	}
+
+	// Query IPP and eSCL
+	var services DNSSdServices
+
+	transport.SetTimeout(quirks.GetInitTimeout())
+
+	log := transport.Log().Begin()
+	ippinfo, httpstatus, err := IppService(log, &services, port, info,
+		quirks, client)
+	log.Commit()
+
+	report = append(report, "IPP:")
+	report = append(report, probeStatus(httpstatus, err))
+
+	log = transport.Log().Begin()
+	httpstatus, err = EsclService(log, &services, port, info, ippinfo,
+		quirks, client)
+	log.Commit()
+
+	report = append(report, "eSCL:")
+	report = append(report, probeStatus(httpstatus, err))
+
+	if transport.TimeoutExpired() {
+		report = append(report, "Timeout:", "  "+ErrInitTimedOut.Error())
+	}
+
+	// Report DNS-SD services, as they would be advertised
+	report = append(report, "DNS-SD services:")
+	if len(services) == 0 {
+		report = append(report, "  none")
+	}
+
+	for _, svc := range services {
+		report = append(report, "  "+svc.Type)
+		for _, txt := range svc.Txt {
+			report = append(report,
+				fmt.Sprintf("    %s=%s", txt.Key, txt.Value))
+		}
+	}
+
+	for _, line := range report {
+		InitLog.Info(0, "%s", line)
+	}
+
+	return nil
+}
+
+// probeInitScript runs the device init script, if any, as daemon does
+func probeInitScript(transport *UsbTransport, client *http.Client) error {
+	quirks := transport.Quirks()
+	transport.SetTimeout(quirks.GetInitTimeout())
+
+	log := transport.Log().Begin()
+	err := InitScriptRun(log, quirks.GetInitScript(), transport, client)
+	log.Commit()
+
+	transport.SetTimeout(0)
+
+	return err
+}
+
+// probeOpen opens the device, specified by its USB address,
+// written as "BUS:DEV", and returns its UsbTransport
+func probeOpen(name string) (UsbDeviceDesc, *UsbTransport, error) {
+	addr, err := probeParseAddr(name)
+	if err != nil {
+		return UsbDeviceDesc{}, nil, err
+	}
+
+	// Find the device
+	err = UsbInit(true)
+	if err != nil {
+		return UsbDeviceDesc{}, nil, err
+	}
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		return UsbDeviceDesc{}, nil, err
+	}
+
+	desc, found := descs[addr]
+	if !found {
+		err = fmt.Errorf("%s: IPP over USB device not found", addr)
+		return UsbDeviceDesc{}, nil, err
+	}
+
+	// Open the device. Note, it fails, if device is in use
+	// by the running ipp-usb daemon
+	transport, err := NewUsbTransport(desc)
+	if err != nil {
+		return UsbDeviceDesc{}, nil, err
+	}
+
+	return desc, transport, nil
+}
+
+// probeStatus formats status of the IPP or eSCL query
+func probeStatus(httpstatus int, err error) string {
+	switch {
+	case err == nil:
+		return "  OK"
+	case httpstatus != 0:
+		return fmt.Sprintf("  HTTP %d: %s", httpstatus, err)
+	}
+
+	return "  " + err.Error()
+}
+
+// probeParseAddr parses USB address, written as "BUS:DEV"
+func probeParseAddr(name string) (UsbAddr, error) {
+	nums := strings.Split(name, ":")
+	if len(nums) == 2 {
+		bus, err1 := strconv.Atoi(nums[0])
+		dev, err2 := strconv.Atoi(nums[1])
+		if err1 == nil && err2 == nil && bus >= 0 && dev >= 0 {
+			return UsbAddr{Bus: bus, Address: dev}, nil
+		}
+	}
+
+	return UsbAddr{}, fmt.Errorf("%q: invalid USB address", name)
+}
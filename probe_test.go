@@ -0,0 +1,38 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for device probing
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestProbeParseAddr tests probeParseAddr
+func TestProbeParseAddr(t *testing.T) {
+	type testData struct {
+		in  string
+		out UsbAddr
+		ok  bool
+	}
+
+	tests := []testData{
+		{"1:5", UsbAddr{1, 5}, true},
+		{"001:005", UsbAddr{1, 5}, true},
+		{"1", UsbAddr{}, false},
+		{"1:x", UsbAddr{}, false},
+		{"-1:5", UsbAddr{}, false},
+	}
+
+	for _, test := range tests {
+		addr, err := probeParseAddr(test.in)
+		if (err == nil) != test.ok || addr != test.out {
+			t.Errorf("%q: expected %s (ok=%v), present %s (%v)",
+				test.in, test.out, test.ok, addr, err)
+		}
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 // Quirk represents a single quirk
@@ -36,15 +39,40 @@ type Quirk struct {
 // so compiler will catch a mistake:
 const (
 	QuirkNmBlacklist         = "blacklist"
+	QuirkNmBuggyEsclRsp      = "buggy-escl-responses"
 	QuirkNmBuggyIppResponses = "buggy-ipp-responses"
+	QuirkNmDeviceMode        = "device-mode"
 	QuirkNmDisableFax        = "disable-fax"
+	QuirkNmDisablePrint      = "disable-print"
+	QuirkNmDisableScan       = "disable-scan"
 	QuirkNmIgnoreIppStatus   = "ignore-ipp-status"
 	QuirkNmInitDelay         = "init-delay"
 	QuirkNmInitRetryPartial  = "init-retry-partial"
 	QuirkNmInitReset         = "init-reset"
+	QuirkNmInitScript        = "init-script"
 	QuirkNmInitTimeout       = "init-timeout"
+	QuirkNmIppVersionMax     = "ipp-version-max"
+	QuirkNmLogDeviceLevel    = "log-device-level"
+	QuirkNmPrewarm           = "prewarm"
 	QuirkNmRequestDelay      = "request-delay"
+	QuirkNmRequestSpool      = "request-spool"
+	QuirkNmRetryHTTPStatus   = "retry-http-status"
+	QuirkNmSerializeRequests = "serialize-requests"
+	QuirkNmTimeoutEscl       = "timeout-escl"
+	QuirkNmTimeoutIpp        = "timeout-ipp"
+	QuirkNmTimeoutWeb        = "timeout-web"
+	QuirkNmUsbBandwidthLimit = "usb-bandwidth-limit"
+	QuirkNmUsbConfig         = "usb-config"
+	QuirkNmUsbInterfaceMatch = "usb-interface-match"
 	QuirkNmUsbMaxInterfaces  = "usb-max-interfaces"
+	QuirkNmUsbReadAhead      = "usb-read-ahead"
+	QuirkNmUsbRecvRateLimit  = "usb-recv-rate-limit"
+	QuirkNmUsbSendAlign      = "usb-send-align"
+	QuirkNmUsbSendDelay      = "usb-send-delay"
+	QuirkNmUsbSendRateLimit  = "usb-send-rate-limit"
+	QuirkNmWebCompression    = "web-compression"
+	QuirkNmWebURLRewrite     = "web-url-rewrite"
+	QuirkNmZlpBackoff        = "zlp-backoff"
 	QuirkNmZlpRecvHack       = "zlp-recv-hack"
 	QuirkNmZlpSend           = "zlp-send"
 )
@@ -53,15 +81,40 @@ const (
 // which defines value syntax and resulting type.
 var quirkParse = map[string]func(*Quirk) error{
 	QuirkNmBlacklist:         (*Quirk).parseBool,
+	QuirkNmBuggyEsclRsp:      (*Quirk).parseQuirkBuggyEsclRsp,
 	QuirkNmBuggyIppResponses: (*Quirk).parseQuirkBuggyIppRsp,
+	QuirkNmDeviceMode:        (*Quirk).parseQuirkDeviceMode,
 	QuirkNmDisableFax:        (*Quirk).parseBool,
+	QuirkNmDisablePrint:      (*Quirk).parseBool,
+	QuirkNmDisableScan:       (*Quirk).parseBool,
 	QuirkNmIgnoreIppStatus:   (*Quirk).parseBool,
 	QuirkNmInitDelay:         (*Quirk).parseDuration,
 	QuirkNmInitRetryPartial:  (*Quirk).parseBool,
 	QuirkNmInitReset:         (*Quirk).parseQuirkResetMethod,
+	QuirkNmInitScript:        (*Quirk).parseQuirkInitScript,
 	QuirkNmInitTimeout:       (*Quirk).parseDuration,
+	QuirkNmIppVersionMax:     (*Quirk).parseQuirkIppVersion,
+	QuirkNmLogDeviceLevel:    (*Quirk).parseLogLevel,
+	QuirkNmPrewarm:           (*Quirk).parseBool,
 	QuirkNmRequestDelay:      (*Quirk).parseDuration,
+	QuirkNmRequestSpool:      (*Quirk).parseBool,
+	QuirkNmRetryHTTPStatus:   (*Quirk).parseQuirkRetryHTTPStatus,
+	QuirkNmSerializeRequests: (*Quirk).parseBool,
+	QuirkNmTimeoutEscl:       (*Quirk).parseDuration,
+	QuirkNmTimeoutIpp:        (*Quirk).parseDuration,
+	QuirkNmTimeoutWeb:        (*Quirk).parseDuration,
+	QuirkNmUsbBandwidthLimit: (*Quirk).parseUint,
+	QuirkNmUsbConfig:         (*Quirk).parseUint,
+	QuirkNmUsbInterfaceMatch: (*Quirk).parseQuirkUsbIfMatch,
 	QuirkNmUsbMaxInterfaces:  (*Quirk).parseUint,
+	QuirkNmUsbReadAhead:      (*Quirk).parseUint,
+	QuirkNmUsbRecvRateLimit:  (*Quirk).parseUint,
+	QuirkNmUsbSendAlign:      (*Quirk).parseUint,
+	QuirkNmUsbSendDelay:      (*Quirk).parseQuirkUsbSendDelay,
+	QuirkNmUsbSendRateLimit:  (*Quirk).parseUint,
+	QuirkNmWebCompression:    (*Quirk).parseQuirkWebCompression,
+	QuirkNmWebURLRewrite:     (*Quirk).parseBool,
+	QuirkNmZlpBackoff:        (*Quirk).parseQuirkZlpBackoff,
 	QuirkNmZlpRecvHack:       (*Quirk).parseBool,
 	QuirkNmZlpSend:           (*Quirk).parseBool,
 }
@@ -70,15 +123,40 @@ var quirkParse = map[string]func(*Quirk) error{
 // a string form.
 var quirkDefaultStrings = map[string]string{
 	QuirkNmBlacklist:         "false",
+	QuirkNmBuggyEsclRsp:      "allow",
 	QuirkNmBuggyIppResponses: "reject",
+	QuirkNmDeviceMode:        "auto",
 	QuirkNmDisableFax:        "false",
+	QuirkNmDisablePrint:      "false",
+	QuirkNmDisableScan:       "false",
 	QuirkNmIgnoreIppStatus:   "false",
 	QuirkNmInitDelay:         "0",
 	QuirkNmInitRetryPartial:  "false",
 	QuirkNmInitReset:         "none",
+	QuirkNmInitScript:        "",
 	QuirkNmInitTimeout:       DevInitTimeout.String(),
+	QuirkNmIppVersionMax:     "",
+	QuirkNmLogDeviceLevel:    "",
+	QuirkNmPrewarm:           "false",
 	QuirkNmRequestDelay:      "0",
+	QuirkNmRequestSpool:      "false",
+	QuirkNmRetryHTTPStatus:   "",
+	QuirkNmSerializeRequests: "false",
+	QuirkNmTimeoutEscl:       "0",
+	QuirkNmTimeoutIpp:        "0",
+	QuirkNmTimeoutWeb:        "0",
+	QuirkNmUsbBandwidthLimit: "0",
+	QuirkNmUsbConfig:         "0",
+	QuirkNmUsbInterfaceMatch: "",
 	QuirkNmUsbMaxInterfaces:  "0",
+	QuirkNmUsbReadAhead:      "0",
+	QuirkNmUsbRecvRateLimit:  "0",
+	QuirkNmUsbSendAlign:      "0",
+	QuirkNmUsbSendDelay:      "0",
+	QuirkNmUsbSendRateLimit:  "0",
+	QuirkNmWebCompression:    "pass",
+	QuirkNmWebURLRewrite:     "false",
+	QuirkNmZlpBackoff:        "exponential",
 	QuirkNmZlpRecvHack:       "false",
 	QuirkNmZlpSend:           "false",
 }
@@ -160,6 +238,35 @@ func (q *Quirk) parseDuration() error {
 	return fmt.Errorf("%q: invalid duration", q.RawValue)
 }
 
+// parseLogLevel parses a log level (comma-separated list of levels).
+// Empty string is parsed as 0, which means "not set"
+func (q *Quirk) parseLogLevel() error {
+	mask, err := LogLevelParse(q.RawValue)
+	if err != nil {
+		return fmt.Errorf("%q: %s", q.RawValue, err)
+	}
+
+	q.Parsed = mask
+	return nil
+}
+
+// parseQuirkBuggyEsclRsp parses [Quirk.RawValue] as QuirkBuggyEsclRsp.
+func (q *Quirk) parseQuirkBuggyEsclRsp() error {
+	switch q.RawValue {
+	case "allow":
+		q.Parsed = QuirkBuggyEsclRspAllow
+	case "reject":
+		q.Parsed = QuirkBuggyEsclRspReject
+	case "sanitize":
+		q.Parsed = QuirkBuggyEsclRspSanitize
+	default:
+		s := q.RawValue
+		return fmt.Errorf("%q: must be allow, reject or sanitize", s)
+	}
+
+	return nil
+}
+
 // parseQuirkBuggyIppRsp parses [Quirk.RawValue] as QuirkBuggyIppRsp.
 func (q *Quirk) parseQuirkBuggyIppRsp() error {
 	switch q.RawValue {
@@ -193,11 +300,240 @@ func (q *Quirk) parseQuirkResetMethod() error {
 	return nil
 }
 
-// prioritize returns more prioritized Quirk, choosing between q and q2.
-func (q *Quirk) prioritize(q2 *Quirk, model string) *Quirk {
-	matchlen := GlobMatch(model, q.Match)
-	matchlen2 := GlobMatch(model, q2.Match)
+// parseQuirkWebCompression parses [Quirk.RawValue] as QuirkWebCompression.
+func (q *Quirk) parseQuirkWebCompression() error {
+	switch q.RawValue {
+	case "pass":
+		q.Parsed = QuirkWebCompressionPass
+	case "decompress":
+		q.Parsed = QuirkWebCompressionDecompress
+	case "disable":
+		q.Parsed = QuirkWebCompressionDisable
+	default:
+		return fmt.Errorf("%q: must be pass, decompress or disable",
+			q.RawValue)
+	}
+
+	return nil
+}
+
+// parseQuirkDeviceMode parses [Quirk.RawValue] as QuirkDeviceMode.
+func (q *Quirk) parseQuirkDeviceMode() error {
+	switch q.RawValue {
+	case "auto":
+		q.Parsed = QuirkDeviceModeAuto
+	case "print-only":
+		q.Parsed = QuirkDeviceModePrintOnly
+	case "scan-only":
+		q.Parsed = QuirkDeviceModeScanOnly
+	case "fax-only":
+		q.Parsed = QuirkDeviceModeFaxOnly
+	default:
+		return fmt.Errorf("%q: must be auto, print-only, scan-only "+
+			"or fax-only", q.RawValue)
+	}
+
+	return nil
+}
+
+// parseQuirkInitScript parses [Quirk.RawValue] as QuirkInitScript.
+func (q *Quirk) parseQuirkInitScript() error {
+	var script QuirkInitScript
+
+	for _, s := range strings.Split(q.RawValue, ";") {
+		words := strings.Fields(s)
+		if len(words) == 0 {
+			continue
+		}
+
+		var step QuirkInitStep
+		var err error
+
+		switch {
+		case words[0] == "delay" && len(words) == 2:
+			q2 := Quirk{RawValue: words[1]}
+			err = q2.parseDuration()
+			if err == nil {
+				step.Op = QuirkInitDelay
+				step.Delay = q2.Parsed.(time.Duration)
+			}
+
+		case words[0] == "soft-reset" && len(words) == 1:
+			step.Op = QuirkInitSoftReset
+
+		case words[0] == "control" && (len(words) == 4 || len(words) == 5):
+			var v [4]uint64
+			bits := []int{8, 8, 16, 16}
+			for i, w := range words[1:] {
+				v[i], err = strconv.ParseUint(w, 0, bits[i])
+				if err != nil {
+					err = fmt.Errorf("%q: invalid number", w)
+					break
+				}
+			}
+
+			step.Op = QuirkInitControl
+			step.RequestType = uint8(v[0])
+			step.Request = uint8(v[1])
+			step.Value = uint16(v[2])
+			step.Index = uint16(v[3])
+
+		case words[0] == "probe" && len(words) == 2 &&
+			strings.HasPrefix(words[1], "/"):
+			step.Op = QuirkInitProbe
+			step.Path = words[1]
+
+		case words[0] == "expect" && len(words) == 2:
+			step.Op = QuirkInitExpect
+			step.Status, err = strconv.Atoi(words[1])
+			if err != nil || step.Status < 100 || step.Status > 599 {
+				err = fmt.Errorf("%q: invalid HTTP status", words[1])
+			}
+
+		default:
+			err = fmt.Errorf("%q: invalid step", strings.TrimSpace(s))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		script = append(script, step)
+	}
+
+	q.Parsed = script
+	return nil
+}
+
+// parseQuirkUsbSendDelay parses [Quirk.RawValue] as QuirkUsbSendDelay.
+func (q *Quirk) parseQuirkUsbSendDelay() error {
+	if q.RawValue == "adaptive" {
+		q.Parsed = QuirkUsbSendDelay{Adaptive: true}
+		return nil
+	}
+
+	q2 := Quirk{RawValue: q.RawValue}
+	err := q2.parseDuration()
+	if err != nil {
+		s := q.RawValue
+		return fmt.Errorf("%q: must be DELAY or adaptive", s)
+	}
+
+	q.Parsed = QuirkUsbSendDelay{Delay: q2.Parsed.(time.Duration)}
+	return nil
+}
+
+// parseQuirkIppVersion parses [Quirk.RawValue] as goipp.Version.
+// Empty string means no version
+func (q *Quirk) parseQuirkIppVersion() error {
+	if q.RawValue == "" {
+		q.Parsed = goipp.Version(0)
+		return nil
+	}
+
+	var major, minor uint64
+	var err error
+
+	fields := strings.Split(q.RawValue, ".")
+	if len(fields) == 2 {
+		major, err = strconv.ParseUint(fields[0], 10, 8)
+		if err == nil {
+			minor, err = strconv.ParseUint(fields[1], 10, 8)
+		}
+	}
+
+	if len(fields) != 2 || err != nil || major == 0 {
+		return fmt.Errorf("%q: invalid IPP version", q.RawValue)
+	}
+
+	q.Parsed = goipp.MakeVersion(uint8(major), uint8(minor))
+	return nil
+}
+
+// parseQuirkZlpBackoff parses [Quirk.RawValue] as QuirkZlpBackoff.
+func (q *Quirk) parseQuirkZlpBackoff() error {
+	switch {
+	case q.RawValue == "none":
+		q.Parsed = QuirkZlpBackoff{Mode: QuirkZlpBackoffNone}
+	case q.RawValue == "exponential":
+		q.Parsed = QuirkZlpBackoff{Mode: QuirkZlpBackoffExponential}
+	case strings.HasPrefix(q.RawValue, "fixed:"):
+		q2 := Quirk{RawValue: q.RawValue[len("fixed:"):]}
+		err := q2.parseDuration()
+		if err != nil {
+			return err
+		}
+
+		q.Parsed = QuirkZlpBackoff{
+			Mode:     QuirkZlpBackoffFixed,
+			Interval: q2.Parsed.(time.Duration),
+		}
+	default:
+		s := q.RawValue
+		return fmt.Errorf("%q: must be none, fixed:DELAY or exponential", s)
+	}
+
+	return nil
+}
+
+// parseQuirkRetryHTTPStatus parses [Quirk.RawValue] as
+// QuirkRetryHTTPStatus.
+func (q *Quirk) parseQuirkRetryHTTPStatus() error {
+	var list QuirkRetryHTTPStatus
+
+	for _, s := range strings.Split(q.RawValue, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 100 || status > 599 {
+			return fmt.Errorf("%q: invalid HTTP status", s)
+		}
+
+		list = append(list, status)
+	}
+
+	q.Parsed = list
+	return nil
+}
+
+// parseQuirkUsbIfMatch parses [Quirk.RawValue] as QuirkUsbIfMatch.
+func (q *Quirk) parseQuirkUsbIfMatch() error {
+	var list QuirkUsbIfMatch
+
+	fields := strings.FieldsFunc(q.RawValue, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t'
+	})
+
+	for _, s := range fields {
+		var v [3]int
+		nums := strings.Split(s, "/")
+		if len(nums) != 3 {
+			return fmt.Errorf("%q: must be CLASS/SUBCLASS/PROTO", s)
+		}
+
+		for i, n := range nums {
+			var err error
+			v[i], err = strconv.Atoi(n)
+			if err != nil || v[i] < 0 || v[i] > 255 {
+				return fmt.Errorf("%q: invalid number", n)
+			}
+		}
 
+		list = append(list, UsbIfClass{
+			Class: v[0], SubClass: v[1], Proto: v[2]})
+	}
+
+	q.Parsed = list
+	return nil
+}
+
+// prioritize returns more prioritized Quirk, choosing between q and q2.
+// matchlen and matchlen2 are match lengths of q and q2, as returned
+// by QuirkMatch.
+func (q *Quirk) prioritize(matchlen int, q2 *Quirk, matchlen2 int) *Quirk {
 	switch {
 	// Choose by match length (more specific match wins)
 	case matchlen > matchlen2:
@@ -213,6 +549,11 @@ func (q *Quirk) prioritize(q2 *Quirk, model string) *Quirk {
 	return q
 }
 
+// QuirkUsbIfMatch is the list of USB interface Class/SubClass/Protocol
+// combinations, recognized as IPP over USB in addition to the
+// standard 7/1/4
+type QuirkUsbIfMatch []UsbIfClass
+
 // QuirkResetMethod represents how to reset a device
 // during initialization
 type QuirkResetMethod int
@@ -241,6 +582,99 @@ func (m QuirkResetMethod) String() string {
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// QuirkDeviceMode defines, which device functions are used
+type QuirkDeviceMode int
+
+// QuirkDeviceModeAuto      - use all functions, device supports
+// QuirkDeviceModePrintOnly - use only printer
+// QuirkDeviceModeScanOnly  - use only scanner
+// QuirkDeviceModeFaxOnly   - use only fax
+const (
+	QuirkDeviceModeAuto QuirkDeviceMode = iota
+	QuirkDeviceModePrintOnly
+	QuirkDeviceModeScanOnly
+	QuirkDeviceModeFaxOnly
+)
+
+// String returns textual representation of QuirkDeviceMode
+func (m QuirkDeviceMode) String() string {
+	switch m {
+	case QuirkDeviceModeAuto:
+		return "auto"
+	case QuirkDeviceModePrintOnly:
+		return "print-only"
+	case QuirkDeviceModeScanOnly:
+		return "scan-only"
+	case QuirkDeviceModeFaxOnly:
+		return "fax-only"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(m))
+}
+
+// Print tells if printing is allowed in this mode
+func (m QuirkDeviceMode) Print() bool {
+	return m == QuirkDeviceModeAuto || m == QuirkDeviceModePrintOnly
+}
+
+// Scan tells if scanning is allowed in this mode
+func (m QuirkDeviceMode) Scan() bool {
+	return m == QuirkDeviceModeAuto || m == QuirkDeviceModeScanOnly
+}
+
+// Fax tells if fax is allowed in this mode
+func (m QuirkDeviceMode) Fax() bool {
+	return m == QuirkDeviceModeAuto || m == QuirkDeviceModeFaxOnly
+}
+
+// IPP tells if IPP service is needed in this mode. IPP
+// service is used for both printing and fax
+func (m QuirkDeviceMode) IPP() bool {
+	return m.Print() || m.Fax()
+}
+
+// AllowsPath tells if HTTP requests to the URL path are allowed
+// in this mode
+func (m QuirkDeviceMode) AllowsPath(path string) bool {
+	switch {
+	case httpPathIn(path, "/ipp/print"):
+		return m.Print()
+	case httpPathIn(path, "/ipp/faxout"):
+		return m.Fax()
+	case httpPathIn(path, "/eSCL"):
+		return m.Scan()
+	}
+
+	return true
+}
+
+// QuirkWebCompression defines, how to handle compressed responses
+// of the device web console
+type QuirkWebCompression int
+
+// QuirkWebCompressionPass       - pass responses as is
+// QuirkWebCompressionDecompress - decompress responses in the proxy
+// QuirkWebCompressionDisable    - don't request compression at all
+const (
+	QuirkWebCompressionPass QuirkWebCompression = iota
+	QuirkWebCompressionDecompress
+	QuirkWebCompressionDisable
+)
+
+// String returns textual representation of QuirkWebCompression
+func (c QuirkWebCompression) String() string {
+	switch c {
+	case QuirkWebCompressionPass:
+		return "pass"
+	case QuirkWebCompressionDecompress:
+		return "decompress"
+	case QuirkWebCompressionDisable:
+		return "disable"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(c))
+}
+
 // QuirkBuggyIppRsp defines, how to handle buggy IPP responses
 type QuirkBuggyIppRsp int
 
@@ -267,10 +701,150 @@ func (m QuirkBuggyIppRsp) String() string {
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// QuirkBuggyEsclRsp defines, how to handle buggy eSCL responses
+type QuirkBuggyEsclRsp int
+
+// QuirkBuggyEsclRspAllow    - ipp-usb will pass bad eSCL responses as is
+// QuirkBuggyEsclRspReject   - ipp-usb will reject bad eSCL responses
+// QuirkBuggyEsclRspSanitize - bad eSCL responses will be repaired
+const (
+	QuirkBuggyEsclRspAllow QuirkBuggyEsclRsp = iota
+	QuirkBuggyEsclRspReject
+	QuirkBuggyEsclRspSanitize
+)
+
+// String returns textual representation of QuirkBuggyEsclRsp
+func (m QuirkBuggyEsclRsp) String() string {
+	switch m {
+	case QuirkBuggyEsclRspAllow:
+		return "allow"
+	case QuirkBuggyEsclRspReject:
+		return "reject"
+	case QuirkBuggyEsclRspSanitize:
+		return "sanitize"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(m))
+}
+
+// QuirkUsbSendDelay defines delay between consecutive USB writes
+type QuirkUsbSendDelay struct {
+	Adaptive bool          // Delay sized by learned drain rate
+	Delay    time.Duration // Fixed delay, if not Adaptive
+}
+
+// String returns textual representation of QuirkUsbSendDelay
+func (d QuirkUsbSendDelay) String() string {
+	if d.Adaptive {
+		return "adaptive"
+	}
+	return d.Delay.String()
+}
+
+// QuirkZlpBackoff defines, how to wait before retrying USB
+// receive, when zero-length packet is received
+type QuirkZlpBackoff struct {
+	Mode     QuirkZlpBackoffMode // Backoff mode
+	Interval time.Duration       // Interval, for QuirkZlpBackoffFixed
+}
+
+// QuirkZlpBackoffMode represents QuirkZlpBackoff mode
+type QuirkZlpBackoffMode int
+
+// QuirkZlpBackoffExponential - exponentially growing interval
+// QuirkZlpBackoffNone        - retry immediately
+// QuirkZlpBackoffFixed       - fixed interval
+const (
+	QuirkZlpBackoffExponential QuirkZlpBackoffMode = iota
+	QuirkZlpBackoffNone
+	QuirkZlpBackoffFixed
+)
+
+// String returns textual representation of QuirkZlpBackoff
+func (b QuirkZlpBackoff) String() string {
+	switch b.Mode {
+	case QuirkZlpBackoffExponential:
+		return "exponential"
+	case QuirkZlpBackoffNone:
+		return "none"
+	case QuirkZlpBackoffFixed:
+		return "fixed:" + b.Interval.String()
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(b.Mode))
+}
+
+// QuirkInitScript represents a declarative device initialization
+// script, executed before normal initialization
+type QuirkInitScript []QuirkInitStep
+
+// QuirkInitStep represents a single step of the QuirkInitScript
+type QuirkInitStep struct {
+	Op          QuirkInitOp   // Step operation
+	Delay       time.Duration // Delay, for QuirkInitDelay
+	Path        string        // HTTP path, for QuirkInitProbe
+	Status      int           // HTTP status, for QuirkInitExpect
+	RequestType uint8         // bmRequestType, for QuirkInitControl
+	Request     uint8         // bRequest, for QuirkInitControl
+	Value       uint16        // wValue, for QuirkInitControl
+	Index       uint16        // wIndex, for QuirkInitControl
+}
+
+// QuirkInitOp represents operation of the QuirkInitStep
+type QuirkInitOp int
+
+// QuirkInitDelay     - wait for the specified time
+// QuirkInitSoftReset - soft-reset all USB interfaces
+// QuirkInitProbe     - send HTTP GET request to the device
+// QuirkInitExpect    - check HTTP status of the last probe
+// QuirkInitControl   - send control transfer without data stage
+const (
+	QuirkInitDelay QuirkInitOp = iota
+	QuirkInitSoftReset
+	QuirkInitProbe
+	QuirkInitExpect
+	QuirkInitControl
+)
+
+// String returns textual representation of QuirkInitStep
+func (step QuirkInitStep) String() string {
+	switch step.Op {
+	case QuirkInitDelay:
+		return "delay " + step.Delay.String()
+	case QuirkInitSoftReset:
+		return "soft-reset"
+	case QuirkInitProbe:
+		return "probe " + step.Path
+	case QuirkInitExpect:
+		return "expect " + strconv.Itoa(step.Status)
+	case QuirkInitControl:
+		return fmt.Sprintf("control 0x%2.2x 0x%2.2x 0x%4.4x 0x%4.4x",
+			step.RequestType, step.Request, step.Value, step.Index)
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(step.Op))
+}
+
+// QuirkRetryHTTPStatus represents a list of HTTP status codes,
+// returned by device, that should be transparently retried
+type QuirkRetryHTTPStatus []int
+
+// Contains reports whether status is in the list
+func (list QuirkRetryHTTPStatus) Contains(status int) bool {
+	for _, s := range list {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Quirks is the collection of Quirk-s.
 type Quirks struct {
 	byName      map[string]*Quirk // Quirks by name
 	HTTPHeaders map[string]string // HTTP header override
+	DNSSdTxt    map[string]string // DNS-SD TXT record override
 }
 
 // Get returns quirk by name.
@@ -283,6 +857,49 @@ func (quirks Quirks) Get(name string) *Quirk {
 	return q
 }
 
+// IsSet tells if quirk is explicitly set, rather than defaulted
+func (quirks Quirks) IsSet(name string) bool {
+	return quirks.byName[name] != nil
+}
+
+// With returns copy of the collection, where q replaces
+// the quirk of the same name. The original collection is
+// not modified, so it is safe to use concurrently
+func (quirks Quirks) With(q *Quirk) Quirks {
+	byName := make(map[string]*Quirk, len(quirks.byName)+1)
+	for name, q2 := range quirks.byName {
+		byName[name] = q2
+	}
+
+	byName[q.Name] = q
+
+	return Quirks{byName: byName, HTTPHeaders: quirks.HTTPHeaders,
+		DNSSdTxt: quirks.DNSSdTxt}
+}
+
+// QuirkOverride creates a Quirk with the specified name and value,
+// used to temporarily override quirk of the running device
+func QuirkOverride(name, value string) (*Quirk, error) {
+	parse := quirkParse[name]
+	if parse == nil {
+		return nil, fmt.Errorf("%q: unknown quirk", name)
+	}
+
+	q := &Quirk{
+		Origin:   "override",
+		Match:    "*",
+		Name:     name,
+		RawValue: value,
+	}
+
+	err := parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
 // All returns all quirks in the collection. This method is
 // intended mostly for diagnostic purposes (logging, dumping,
 // testing and so on).
@@ -299,30 +916,84 @@ func (quirks Quirks) All() []*Quirk {
 	return qq
 }
 
+// Format formats quirks as text, grouped by matching sections,
+// one line per section header, origin comment or quirk
+func (quirks Quirks) Format() []string {
+	var lines []string
+
+	prevMatch := ""
+	for _, q := range quirks.All() {
+		val := q.RawValue
+		if _, isStr := q.Parsed.(string); isStr {
+			val = strconv.Quote(val)
+		}
+
+		if q.Match != prevMatch {
+			prevMatch = q.Match
+			lines = append(lines, fmt.Sprintf("[%s]", q.Match))
+		}
+
+		lines = append(lines, fmt.Sprintf("  ; (%s)", q.Origin))
+		lines = append(lines, fmt.Sprintf("  %s = %s", q.Name, val))
+	}
+
+	return lines
+}
+
 // GetBlacklist returns effective "blacklist" parameter,
 // taking the whole set into consideration.
 func (quirks Quirks) GetBlacklist() bool {
 	return quirks.Get(QuirkNmBlacklist).Parsed.(bool)
 }
 
+// GetBuggyEsclRsp returns effective "buggy-escl-responses" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetBuggyEsclRsp() QuirkBuggyEsclRsp {
+	return quirks.Get(QuirkNmBuggyEsclRsp).Parsed.(QuirkBuggyEsclRsp)
+}
+
 // GetBuggyIppRsp returns effective "buggy-ipp-responses" parameter
 // taking the whole set into consideration.
 func (quirks Quirks) GetBuggyIppRsp() QuirkBuggyIppRsp {
 	return quirks.Get(QuirkNmBuggyIppResponses).Parsed.(QuirkBuggyIppRsp)
 }
 
+// GetDeviceMode returns effective "device-mode" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetDeviceMode() QuirkDeviceMode {
+	return quirks.Get(QuirkNmDeviceMode).Parsed.(QuirkDeviceMode)
+}
+
 // GetDisableFax returns effective "disable-fax" parameter,
 // taking the whole set into consideration.
 func (quirks Quirks) GetDisableFax() bool {
 	return quirks.Get(QuirkNmDisableFax).Parsed.(bool)
 }
 
+// GetDisablePrint returns effective "disable-print" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetDisablePrint() bool {
+	return quirks.Get(QuirkNmDisablePrint).Parsed.(bool)
+}
+
+// GetDisableScan returns effective "disable-scan" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetDisableScan() bool {
+	return quirks.Get(QuirkNmDisableScan).Parsed.(bool)
+}
+
 // GetIgnoreIppStatus returns effective "ignore-ipp-status" parameter,
 // taking the whole set into consideration.
 func (quirks Quirks) GetIgnoreIppStatus() bool {
 	return quirks.Get(QuirkNmIgnoreIppStatus).Parsed.(bool)
 }
 
+// GetIppVersionMax returns effective "ipp-version-max" parameter,
+// taking the whole set into consideration. 0 means no limit
+func (quirks Quirks) GetIppVersionMax() goipp.Version {
+	return quirks.Get(QuirkNmIppVersionMax).Parsed.(goipp.Version)
+}
+
 // GetInitDelay returns effective "init-delay" parameter
 // taking the whole set into consideration.
 func (quirks Quirks) GetInitDelay() time.Duration {
@@ -341,24 +1012,144 @@ func (quirks Quirks) GetInitReset() QuirkResetMethod {
 	return quirks.Get(QuirkNmInitReset).Parsed.(QuirkResetMethod)
 }
 
+// GetInitScript returns effective "init-script" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetInitScript() QuirkInitScript {
+	return quirks.Get(QuirkNmInitScript).Parsed.(QuirkInitScript)
+}
+
 // GetInitTimeout returns effective "init-timeout" parameter
 // taking the whole set into consideration.
 func (quirks Quirks) GetInitTimeout() time.Duration {
 	return quirks.Get(QuirkNmInitTimeout).Parsed.(time.Duration)
 }
 
+// GetLogDeviceLevel returns effective "log-device-level" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetLogDeviceLevel() LogLevel {
+	return quirks.Get(QuirkNmLogDeviceLevel).Parsed.(LogLevel)
+}
+
+// GetPrewarm returns effective "prewarm" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetPrewarm() bool {
+	return quirks.Get(QuirkNmPrewarm).Parsed.(bool)
+}
+
 // GetRequestDelay returns effective "request-delay" parameter
 // taking the whole set into consideration.
 func (quirks Quirks) GetRequestDelay() time.Duration {
 	return quirks.Get(QuirkNmRequestDelay).Parsed.(time.Duration)
 }
 
+// GetRequestSpool returns effective "request-spool" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetRequestSpool() bool {
+	return quirks.Get(QuirkNmRequestSpool).Parsed.(bool)
+}
+
+// GetRetryHTTPStatus returns effective "retry-http-status" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetRetryHTTPStatus() QuirkRetryHTTPStatus {
+	return quirks.Get(QuirkNmRetryHTTPStatus).Parsed.(QuirkRetryHTTPStatus)
+}
+
+// GetSerializeRequests returns effective "serialize-requests" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetSerializeRequests() bool {
+	return quirks.Get(QuirkNmSerializeRequests).Parsed.(bool)
+}
+
+// GetTimeoutEscl returns effective "timeout-escl" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetTimeoutEscl() time.Duration {
+	return quirks.Get(QuirkNmTimeoutEscl).Parsed.(time.Duration)
+}
+
+// GetTimeoutIpp returns effective "timeout-ipp" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetTimeoutIpp() time.Duration {
+	return quirks.Get(QuirkNmTimeoutIpp).Parsed.(time.Duration)
+}
+
+// GetTimeoutWeb returns effective "timeout-web" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetTimeoutWeb() time.Duration {
+	return quirks.Get(QuirkNmTimeoutWeb).Parsed.(time.Duration)
+}
+
+// GetUsbBandwidthLimit returns effective "usb-bandwidth-limit" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbBandwidthLimit() uint {
+	return quirks.Get(QuirkNmUsbBandwidthLimit).Parsed.(uint)
+}
+
+// GetUsbConfig returns effective "usb-config" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbConfig() uint {
+	return quirks.Get(QuirkNmUsbConfig).Parsed.(uint)
+}
+
+// GetUsbInterfaceMatch returns effective "usb-interface-match" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbInterfaceMatch() QuirkUsbIfMatch {
+	return quirks.Get(QuirkNmUsbInterfaceMatch).Parsed.(QuirkUsbIfMatch)
+}
+
 // GetUsbMaxInterfaces returns effective "usb-max-interfaces" parameter,
 // taking the whole set into consideration.
 func (quirks Quirks) GetUsbMaxInterfaces() uint {
 	return quirks.Get(QuirkNmUsbMaxInterfaces).Parsed.(uint)
 }
 
+// GetUsbReadAhead returns effective "usb-read-ahead" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbReadAhead() uint {
+	return quirks.Get(QuirkNmUsbReadAhead).Parsed.(uint)
+}
+
+// GetUsbRecvRateLimit returns effective "usb-recv-rate-limit" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbRecvRateLimit() uint {
+	return quirks.Get(QuirkNmUsbRecvRateLimit).Parsed.(uint)
+}
+
+// GetUsbSendAlign returns effective "usb-send-align" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbSendAlign() uint {
+	return quirks.Get(QuirkNmUsbSendAlign).Parsed.(uint)
+}
+
+// GetUsbSendDelay returns effective "usb-send-delay" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbSendDelay() QuirkUsbSendDelay {
+	return quirks.Get(QuirkNmUsbSendDelay).Parsed.(QuirkUsbSendDelay)
+}
+
+// GetUsbSendRateLimit returns effective "usb-send-rate-limit" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetUsbSendRateLimit() uint {
+	return quirks.Get(QuirkNmUsbSendRateLimit).Parsed.(uint)
+}
+
+// GetWebCompression returns effective "web-compression" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetWebCompression() QuirkWebCompression {
+	return quirks.Get(QuirkNmWebCompression).Parsed.(QuirkWebCompression)
+}
+
+// GetWebURLRewrite returns effective "web-url-rewrite" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetWebURLRewrite() bool {
+	return quirks.Get(QuirkNmWebURLRewrite).Parsed.(bool)
+}
+
+// GetZlpBackoff returns effective "zlp-backoff" parameter,
+// taking the whole set into consideration.
+func (quirks Quirks) GetZlpBackoff() QuirkZlpBackoff {
+	return quirks.Get(QuirkNmZlpBackoff).Parsed.(QuirkZlpBackoff)
+}
+
 // GetZlpRecvHack returns effective "zlp-send" parameter,
 // taking the whole set into consideration.
 func (quirks Quirks) GetZlpRecvHack() bool {
@@ -374,22 +1165,63 @@ func (quirks Quirks) GetZlpSend() bool {
 // QuirksSet represents collection of quirks
 type QuirksSet []*Quirks
 
+// Special keys and section name prefix of quirks files:
+//
+//	include = file-or-glob  <- reads another file(s) at this point
+//	[template:NAME]         <- named template, not matched to devices
+//	use = NAME[, NAME...]   <- applies template(s) to the section
+const (
+	QuirksKeyInclude      = "include"
+	QuirksKeyUse          = "use"
+	QuirksTemplatePrefix  = "template:"
+	quirksIncludeMaxDepth = 8
+)
+
+// quirksLoader maintains the state of QuirksSet loading
+type quirksLoader struct {
+	qset      *QuirksSet         // QuirksSet being loaded
+	templates map[string]*Quirks // Named templates
+	tmplDefs  map[string]string  // Origins of templates definitions
+	uses      []quirksUse        // Templates usage, resolved at the end
+	includes  []string           // Stack of files being read
+	loadOrder int                // Incremented in order of loading
+}
+
+// quirksUse represents templates usage by the quirks section
+type quirksUse struct {
+	quirks    *Quirks  // Section, that uses templates
+	section   string   // Section name
+	names     []string // Names of used templates
+	origin    string   // file:line of the "use" key
+	loadOrder int      // LoadOrder of the "use" key
+}
+
 // LoadQuirksSet creates new QuirksSet and loads its content from a directory
 func LoadQuirksSet(paths ...string) (QuirksSet, error) {
 	qset := QuirksSet{}
+	ld := &quirksLoader{
+		qset:      &qset,
+		templates: make(map[string]*Quirks),
+		tmplDefs:  make(map[string]string),
+	}
 
 	for _, path := range paths {
-		err := qset.readDir(path)
+		err := ld.readDir(path)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	err := ld.resolveTemplates()
+	if err != nil {
+		return nil, err
+	}
+
 	return qset, nil
 }
 
 // readDir loads all Quirks from a directory
-func (qset *QuirksSet) readDir(path string) error {
+func (ld *quirksLoader) readDir(path string) error {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -401,7 +1233,7 @@ func (qset *QuirksSet) readDir(path string) error {
 	for _, file := range files {
 		if file.Mode().IsRegular() &&
 			strings.HasSuffix(file.Name(), ".conf") {
-			err = qset.readFile(filepath.Join(path, file.Name()))
+			err = ld.readFile(filepath.Join(path, file.Name()))
 			if err != nil {
 				return err
 			}
@@ -412,7 +1244,7 @@ func (qset *QuirksSet) readDir(path string) error {
 }
 
 // readFile reads all Quirks from a file
-func (qset *QuirksSet) readFile(file string) error {
+func (ld *quirksLoader) readFile(file string) error {
 	// Open quirks file
 	ini, err := OpenIniFileWithRecType(file)
 	if err != nil {
@@ -421,9 +1253,11 @@ func (qset *QuirksSet) readFile(file string) error {
 
 	defer ini.Close()
 
+	ld.includes = append(ld.includes, file)
+	defer func() { ld.includes = ld.includes[:len(ld.includes)-1] }()
+
 	// Load all quirks
 	var quirks *Quirks
-	var loadOrder int
 
 	for err == nil {
 		var rec *IniRecord
@@ -439,16 +1273,75 @@ func (qset *QuirksSet) readFile(file string) error {
 			quirks = &Quirks{
 				byName:      make(map[string]*Quirk),
 				HTTPHeaders: make(map[string]string),
+				DNSSdTxt:    make(map[string]string),
+			}
+
+			if strings.HasPrefix(rec.Section, QuirksTemplatePrefix) {
+				name := rec.Section[len(QuirksTemplatePrefix):]
+				if found := ld.tmplDefs[name]; found != "" {
+					err = fmt.Errorf("%s: template %q already "+
+						"defined at %s", origin, name, found)
+					break
+				}
+
+				ld.templates[name] = quirks
+				ld.tmplDefs[name] = origin
+				continue
+			}
+
+			_, _, err = quirkMatchSplit(rec.Section)
+			if err != nil {
+				err = fmt.Errorf("%s: %s", origin, err)
+				break
 			}
-			qset.Add(quirks)
+
+			ld.qset.Add(quirks)
 
 			continue
-		} else if quirks == nil {
+		}
+
+		// Handle include directive. It is allowed anywhere;
+		// included files are read as separate files, so they
+		// don't affect the current section
+		if rec.Key == QuirksKeyInclude {
+			err = ld.include(file, rec.Value, origin)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if quirks == nil {
 			err = fmt.Errorf("%s: %q = %q out of any section",
 				origin, rec.Key, rec.Value)
 			break
 		}
 
+		// Handle template usage
+		if rec.Key == QuirksKeyUse {
+			if strings.HasPrefix(rec.Section, QuirksTemplatePrefix) {
+				return fmt.Errorf("%s: templates can't use "+
+					"other templates", origin)
+			}
+
+			use := quirksUse{
+				quirks:    quirks,
+				section:   rec.Section,
+				origin:    origin,
+				loadOrder: ld.loadOrder,
+			}
+
+			for _, name := range strings.Split(rec.Value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					use.names = append(use.names, name)
+				}
+			}
+
+			ld.uses = append(ld.uses, use)
+			ld.loadOrder++
+			continue
+		}
+
 		if found := quirks.byName[rec.Key]; found != nil {
 			err = fmt.Errorf("%s: %q already defined at %s",
 				origin, rec.Key, found.Origin)
@@ -460,10 +1353,10 @@ func (qset *QuirksSet) readFile(file string) error {
 			Match:     rec.Section,
 			Name:      rec.Key,
 			RawValue:  rec.Value,
-			LoadOrder: loadOrder,
+			LoadOrder: ld.loadOrder,
 		}
 
-		loadOrder++
+		ld.loadOrder++
 
 		if strings.HasPrefix(rec.Key, "http-") {
 			// Canonicalize HTTP header name
@@ -472,6 +1365,11 @@ func (qset *QuirksSet) readFile(file string) error {
 
 			hdr := http.CanonicalHeaderKey(rec.Key[5:])
 			quirks.HTTPHeaders[hdr] = q.RawValue
+		} else if strings.HasPrefix(rec.Key, "txt-") {
+			// TXT keys are case-sensitive in practice,
+			// so key is taken as is
+			q.Parsed = q.RawValue
+			quirks.DNSSdTxt[rec.Key[4:]] = q.RawValue
 		} else {
 			parse := quirkParse[rec.Key]
 			if parse == nil {
@@ -497,6 +1395,87 @@ func (qset *QuirksSet) readFile(file string) error {
 	return err
 }
 
+// include reads files, referenced by the include directive
+//
+// Relative paths are resolved against directory of the including
+// file. Glob pattern may match no files, but file, specified
+// without wildcards, must exist
+func (ld *quirksLoader) include(file, pattern, origin string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+
+	if len(ld.includes) >= quirksIncludeMaxDepth {
+		return fmt.Errorf("%s: includes nested too deeply", origin)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err == nil && len(files) == 0 &&
+		!strings.ContainsAny(pattern, "*?[") {
+		_, err = os.Stat(pattern)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: include: %s", origin, err)
+	}
+
+	for _, incl := range files {
+		for _, parent := range ld.includes {
+			if filepath.Clean(parent) == filepath.Clean(incl) {
+				return fmt.Errorf("%s: include loop: %s",
+					origin, incl)
+			}
+		}
+
+		err = ld.readFile(incl)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveTemplates applies templates to sections, that use them
+//
+// Quirks, defined by the section itself, win over quirks from
+// templates. If several templates define the same quirk, the
+// template, listed first, wins
+func (ld *quirksLoader) resolveTemplates() error {
+	for _, use := range ld.uses {
+		for _, name := range use.names {
+			tmpl := ld.templates[name]
+			if tmpl == nil {
+				return fmt.Errorf("%s: template %q not defined",
+					use.origin, name)
+			}
+
+			for key, q := range tmpl.byName {
+				if use.quirks.byName[key] != nil {
+					continue
+				}
+
+				q2 := *q
+				q2.Origin = fmt.Sprintf("%s (template %q, used at %s)",
+					q.Origin, name, use.origin)
+				q2.Match = use.section
+				q2.LoadOrder = use.loadOrder
+				use.quirks.byName[key] = &q2
+
+				switch {
+				case strings.HasPrefix(key, "http-"):
+					hdr := http.CanonicalHeaderKey(key[5:])
+					use.quirks.HTTPHeaders[hdr] = q.RawValue
+				case strings.HasPrefix(key, "txt-"):
+					use.quirks.DNSSdTxt[key[4:]] = q.RawValue
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // Add appends Quirks to QuirksSet
 func (qset *QuirksSet) Add(q *Quirks) {
 	*qset = append(*qset, q)
@@ -505,21 +1484,263 @@ func (qset *QuirksSet) Add(q *Quirks) {
 // MatchByModelName returns collection of quirks, applicable for
 // specific device, matched by model name.
 func (qset QuirksSet) MatchByModelName(model string) Quirks {
+	return qset.MatchByDevice(UsbDeviceInfo{MfgAndProduct: model})
+}
+
+// MatchByDevice returns collection of quirks, applicable for
+// specific device, matched by model name, serial number or
+// physical port path. See QuirkMatch for details.
+func (qset QuirksSet) MatchByDevice(info UsbDeviceInfo) Quirks {
 	ret := Quirks{
-		byName: make(map[string]*Quirk),
+		byName:      make(map[string]*Quirk),
+		HTTPHeaders: make(map[string]string),
+		DNSSdTxt:    make(map[string]string),
 	}
 
+	matchlens := make(map[string]int)
+
 	for _, quirks := range qset {
 		for name, q := range quirks.byName {
-			if GlobMatch(model, q.Match) >= 0 {
-				q2 := ret.byName[name]
-				if q2 != nil {
-					q = q.prioritize(q2, model)
-				}
+			matchlen := QuirkMatch(q.Match, info)
+			if matchlen < 0 {
+				continue
+			}
+
+			q2 := ret.byName[name]
+			if q2 != nil {
+				q = q.prioritize(matchlen, q2, matchlens[name])
+			}
+
+			if q != q2 {
 				ret.byName[name] = q
+				matchlens[name] = matchlen
 			}
 		}
 	}
 
+	// Collect HTTP header and TXT record overrides
+	// from the matched quirks
+	for name, q := range ret.byName {
+		switch {
+		case strings.HasPrefix(name, "http-"):
+			hdr := http.CanonicalHeaderKey(name[5:])
+			ret.HTTPHeaders[hdr] = q.RawValue
+		case strings.HasPrefix(name, "txt-"):
+			ret.DNSSdTxt[name[4:]] = q.RawValue
+		}
+	}
+
 	return ret
 }
+
+// Prefixes of quirks section names, that match devices by USB
+// serial number (i.e., [serial:XYZ123]) and by physical port path
+// (i.e., [port:1-3.2]), rather than by model name
+const (
+	QuirkMatchSerial = "serial:"
+	QuirkMatchPort   = "port:"
+)
+
+// QuirkMatchHWID is the prefix of quirks section names, that match
+// devices by USB vendor and product IDs, written as "VVVV:PPPP" in
+// lowercase hex (i.e., [hwid:03f0:*]). These sections have the same
+// priority as sections, matched by model name, but unlike them can
+// be matched before device is opened
+const QuirkMatchHWID = "hwid:"
+
+// quirkMatchPriority is added to match length of serial number
+// and port path matches, so they always win over model name matches,
+// as they select a specific unit among identical models
+const quirkMatchPriority = 0x10000
+
+// QuirkMatch matches quirks section name against the device.
+//
+// Section name is either the glob-style pattern of model name,
+// or pattern of serial number or port path, prefixed by
+// QuirkMatchSerial or QuirkMatchPort, or pattern of vendor and
+// product IDs, prefixed by QuirkMatchHWID.
+//
+// Pattern may be followed by semicolon-separated firmware version
+// conditions (i.e., [Brother MFC-L8390CDW; fw>=1.23]). Such sections
+// match only devices with known firmware version, that satisfies
+// all conditions. Each condition counts as one additional matched
+// character, so these sections win over the same pattern without
+// conditions.
+//
+// It returns a counter of matched non-wildcard characters, increased
+// by quirkMatchPriority for serial and port matches, or -1 if no match
+func QuirkMatch(pattern string, info UsbDeviceInfo) int {
+	pattern, conds, err := quirkMatchSplit(pattern)
+	if err != nil {
+		return -1
+	}
+
+	for _, cond := range conds {
+		if !cond.match(info.Firmware) {
+			return -1
+		}
+	}
+
+	matchlen := quirkMatchPattern(pattern, info)
+	if matchlen >= 0 {
+		matchlen += len(conds)
+	}
+
+	return matchlen
+}
+
+// quirkMatchPattern matches quirks section name pattern, without
+// firmware conditions, against the device. See QuirkMatch for details
+func quirkMatchPattern(pattern string, info UsbDeviceInfo) int {
+	var str string
+
+	switch {
+	case strings.HasPrefix(pattern, QuirkMatchSerial):
+		str = info.SerialNumber
+		pattern = pattern[len(QuirkMatchSerial):]
+
+	case strings.HasPrefix(pattern, QuirkMatchPort):
+		str = info.PortPath
+		pattern = pattern[len(QuirkMatchPort):]
+
+	case strings.HasPrefix(pattern, QuirkMatchHWID):
+		str = fmt.Sprintf("%4.4x:%4.4x", info.Vendor, info.Product)
+		return GlobMatch(str, pattern[len(QuirkMatchHWID):])
+
+	default:
+		// Model name from IEEE 1284 device ID is often more
+		// accurate, than USB product string
+		matchlen := GlobMatch(info.MfgAndProduct, pattern)
+		if model := info.DeviceIDModel(); model != "" {
+			if l := GlobMatch(model, pattern); l > matchlen {
+				matchlen = l
+			}
+		}
+		return matchlen
+	}
+
+	if str == "" {
+		return -1
+	}
+
+	matchlen := GlobMatch(str, pattern)
+	if matchlen >= 0 {
+		matchlen += quirkMatchPriority
+	}
+
+	return matchlen
+}
+
+// quirkFwCond represents firmware version condition of the
+// quirks section (i.e., "fw>=1.23")
+type quirkFwCond struct {
+	op      string // Comparison operator
+	version string // Version to compare with
+}
+
+// quirkFwOps lists comparison operators of firmware conditions.
+// Longer operators go first, so they take precedence at parsing
+var quirkFwOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// quirkMatchSplit splits quirks section name into the match
+// pattern and firmware version conditions
+func quirkMatchSplit(section string) (string, []quirkFwCond, error) {
+	parts := strings.Split(section, ";")
+	pattern := strings.TrimSpace(parts[0])
+
+	var conds []quirkFwCond
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "fw") {
+			return "", nil, fmt.Errorf("%q: invalid condition", part)
+		}
+
+		s := strings.TrimSpace(part[2:])
+		cond := quirkFwCond{}
+		for _, op := range quirkFwOps {
+			if strings.HasPrefix(s, op) {
+				cond.op = op
+				cond.version = strings.TrimSpace(s[len(op):])
+				break
+			}
+		}
+
+		if cond.op == "" || cond.version == "" {
+			return "", nil, fmt.Errorf("%q: invalid condition", part)
+		}
+
+		conds = append(conds, cond)
+	}
+
+	return pattern, conds, nil
+}
+
+// match matches firmware version against the condition. Unknown
+// (empty) version never matches
+func (cond quirkFwCond) match(firmware string) bool {
+	if firmware == "" {
+		return false
+	}
+
+	cmp := FirmwareVersionCompare(firmware, cond.version)
+	switch cond.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+
+	return cmp == 0
+}
+
+// FirmwareVersionCompare compares two firmware versions and
+// returns -1, 0 or 1, if v1 is less, equal or greater that v2.
+//
+// Versions are split into components at any non-alphanumeric
+// character. Numeric components are compared numerically, others
+// lexicographically, case-insensitive. Missing components are
+// considered as zeroes, so "1.2" equals "1.2.0"
+func FirmwareVersionCompare(v1, v2 string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(strings.ToLower(v), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+	}
+
+	c1, c2 := split(v1), split(v2)
+	for len(c1) < len(c2) {
+		c1 = append(c1, "0")
+	}
+	for len(c2) < len(c1) {
+		c2 = append(c2, "0")
+	}
+
+	for i := range c1 {
+		n1, err1 := strconv.ParseUint(c1[i], 10, 64)
+		n2, err2 := strconv.ParseUint(c2[i], 10, 64)
+
+		switch {
+		case err1 == nil && err2 == nil:
+			if n1 != n2 {
+				if n1 < n2 {
+					return -1
+				}
+				return 1
+			}
+
+		case c1[i] != c2[i]:
+			if c1[i] < c2[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -9,9 +9,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 // TestQuirksLookup tests lookup of various parameters
@@ -47,6 +53,17 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "testdata/quirks/default.conf:4",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmBuggyEsclRsp,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetBuggyEsclRsp()
+			},
+			match:  "*",
+			value:  QuirkBuggyEsclRspAllow,
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmBuggyIppResponses,
@@ -58,6 +75,17 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmDeviceMode,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetDeviceMode()
+			},
+			match:  "*",
+			value:  QuirkDeviceModeAuto,
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmDisableFax,
@@ -69,6 +97,28 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmDisablePrint,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetDisablePrint()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmDisableScan,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetDisableScan()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmIgnoreIppStatus,
@@ -113,6 +163,17 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmInitScript,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetInitScript()
+			},
+			match:  "*",
+			value:  QuirkInitScript(nil),
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmInitTimeout,
@@ -124,6 +185,39 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmIppVersionMax,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetIppVersionMax()
+			},
+			match:  "*",
+			value:  goipp.Version(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmLogDeviceLevel,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetLogDeviceLevel()
+			},
+			match:  "*",
+			value:  LogLevel(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmPrewarm,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetPrewarm()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmRequestDelay,
@@ -135,6 +229,105 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmRequestSpool,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetRequestSpool()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmRetryHTTPStatus,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetRetryHTTPStatus()
+			},
+			match:  "*",
+			value:  QuirkRetryHTTPStatus(nil),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmSerializeRequests,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetSerializeRequests()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmTimeoutEscl,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetTimeoutEscl()
+			},
+			match:  "*",
+			value:  time.Duration(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmTimeoutIpp,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetTimeoutIpp()
+			},
+			match:  "*",
+			value:  time.Duration(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmTimeoutWeb,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetTimeoutWeb()
+			},
+			match:  "*",
+			value:  time.Duration(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbBandwidthLimit,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbBandwidthLimit()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbConfig,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbConfig()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbInterfaceMatch,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbInterfaceMatch()
+			},
+			match:  "*",
+			value:  QuirkUsbIfMatch(nil),
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmUsbMaxInterfaces,
@@ -146,6 +339,94 @@ func TestQuirksLookup(t *testing.T) {
 			origin: "default",
 		},
 
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbReadAhead,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbReadAhead()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbRecvRateLimit,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbRecvRateLimit()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbSendAlign,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbSendAlign()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbSendDelay,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbSendDelay()
+			},
+			match:  "*",
+			value:  QuirkUsbSendDelay{},
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmUsbSendRateLimit,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetUsbSendRateLimit()
+			},
+			match:  "*",
+			value:  uint(0),
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmWebCompression,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetWebCompression()
+			},
+			match:  "*",
+			value:  QuirkWebCompressionPass,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmWebURLRewrite,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetWebURLRewrite()
+			},
+			match:  "*",
+			value:  false,
+			origin: "default",
+		},
+
+		{
+			model: "Unknown Device",
+			param: QuirkNmZlpBackoff,
+			get: func(quirks Quirks) interface{} {
+				return quirks.GetZlpBackoff()
+			},
+			match:  "*",
+			value:  QuirkZlpBackoff{Mode: QuirkZlpBackoffExponential},
+			origin: "default",
+		},
+
 		{
 			model: "Unknown Device",
 			param: QuirkNmZlpRecvHack,
@@ -237,6 +518,44 @@ func TestQuirksLookup(t *testing.T) {
 	}
 }
 
+// TestQuirksOverrides tests collecting of HTTP header and
+// DNS-SD TXT record overrides from the matched quirks
+func TestQuirksOverrides(t *testing.T) {
+	const path = "testdata/quirks"
+
+	qset, err := LoadQuirksSet(path)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
+	}
+
+	quirks := qset.MatchByModelName("HP LaserJet Pro M404")
+
+	expected := map[string]string{"Connection": ""}
+	if !reflect.DeepEqual(quirks.HTTPHeaders, expected) {
+		t.Errorf("HTTPHeaders: expected %v, present %v",
+			expected, quirks.HTTPHeaders)
+	}
+
+	expected = map[string]string{"Color": "T", "URF": ""}
+	if !reflect.DeepEqual(quirks.DNSSdTxt, expected) {
+		t.Errorf("DNSSdTxt: expected %v, present %v",
+			expected, quirks.DNSSdTxt)
+	}
+
+	quirks = qset.MatchByModelName("HP OfficeJet Pro 8730")
+
+	expected = map[string]string{"Connection": "close"}
+	if !reflect.DeepEqual(quirks.HTTPHeaders, expected) {
+		t.Errorf("HTTPHeaders: expected %v, present %v",
+			expected, quirks.HTTPHeaders)
+	}
+
+	if len(quirks.DNSSdTxt) != 0 {
+		t.Errorf("DNSSdTxt: expected empty, present %v",
+			quirks.DNSSdTxt)
+	}
+}
+
 // TestQuirksParsers tests parsers for quirks
 func TestQuirksParsers(t *testing.T) {
 	type testData struct {
@@ -266,47 +585,97 @@ func TestQuirksParsers(t *testing.T) {
 			err:    `"invalid": must be true or false`,
 		},
 
-		// parseQuirkBuggyIppRsp
+		// parseLogLevel
 		{
-			parser: (*Quirk).parseQuirkBuggyIppRsp,
-			input:  "allow",
-			value:  QuirkBuggyIppRspAllow,
+			parser: (*Quirk).parseLogLevel,
+			input:  "",
+			value:  LogLevel(0),
 		},
 
 		{
-			parser: (*Quirk).parseQuirkBuggyIppRsp,
-			input:  "reject",
-			value:  QuirkBuggyIppRspReject,
+			parser: (*Quirk).parseLogLevel,
+			input:  "error, trace-ipp",
+			value:  LogError | LogInfo | LogDebug | LogTraceIPP,
 		},
 
 		{
-			parser: (*Quirk).parseQuirkBuggyIppRsp,
-			input:  "sanitize",
-			value:  QuirkBuggyIppRspSanitize,
+			parser: (*Quirk).parseLogLevel,
+			input:  "debug,invalid",
+			err:    `"debug,invalid": invalid log level "invalid"`,
 		},
 
+		// parseQuirkIppVersion
 		{
-			parser: (*Quirk).parseQuirkBuggyIppRsp,
-			input:  "invalid",
-			err:    `"invalid": must be allow, reject or sanitize`,
+			parser: (*Quirk).parseQuirkIppVersion,
+			input:  "",
+			value:  goipp.Version(0),
 		},
 
-		// parseDuration
 		{
-			parser: (*Quirk).parseDuration,
-			input:  "0",
-			value:  time.Duration(0),
+			parser: (*Quirk).parseQuirkIppVersion,
+			input:  "1.1",
+			value:  goipp.MakeVersion(1, 1),
 		},
 
 		{
-			parser: (*Quirk).parseDuration,
-			input:  "0s",
-			value:  time.Duration(0),
+			parser: (*Quirk).parseQuirkIppVersion,
+			input:  "2.0",
+			value:  goipp.MakeVersion(2, 0),
 		},
 
 		{
-			parser: (*Quirk).parseDuration,
-			input:  "12345",
+			parser: (*Quirk).parseQuirkIppVersion,
+			input:  "1",
+			err:    `"1": invalid IPP version`,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkIppVersion,
+			input:  "0.9",
+			err:    `"0.9": invalid IPP version`,
+		},
+
+		// parseQuirkBuggyIppRsp
+		{
+			parser: (*Quirk).parseQuirkBuggyIppRsp,
+			input:  "allow",
+			value:  QuirkBuggyIppRspAllow,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkBuggyIppRsp,
+			input:  "reject",
+			value:  QuirkBuggyIppRspReject,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkBuggyIppRsp,
+			input:  "sanitize",
+			value:  QuirkBuggyIppRspSanitize,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkBuggyIppRsp,
+			input:  "invalid",
+			err:    `"invalid": must be allow, reject or sanitize`,
+		},
+
+		// parseDuration
+		{
+			parser: (*Quirk).parseDuration,
+			input:  "0",
+			value:  time.Duration(0),
+		},
+
+		{
+			parser: (*Quirk).parseDuration,
+			input:  "0s",
+			value:  time.Duration(0),
+		},
+
+		{
+			parser: (*Quirk).parseDuration,
+			input:  "12345",
 			value:  12345 * time.Millisecond,
 		},
 
@@ -367,6 +736,54 @@ func TestQuirksParsers(t *testing.T) {
 			err:    `"invalid": must be none, soft or hard`,
 		},
 
+		// parseQuirkDeviceMode
+		{
+			parser: (*Quirk).parseQuirkDeviceMode,
+			input:  "scan-only",
+			value:  QuirkDeviceModeScanOnly,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkDeviceMode,
+			input:  "invalid",
+			err: `"invalid": must be auto, print-only, scan-only ` +
+				`or fax-only`,
+		},
+
+		// parseQuirkZlpBackoff
+		{
+			parser: (*Quirk).parseQuirkZlpBackoff,
+			input:  "none",
+			value:  QuirkZlpBackoff{Mode: QuirkZlpBackoffNone},
+		},
+
+		{
+			parser: (*Quirk).parseQuirkZlpBackoff,
+			input:  "exponential",
+			value:  QuirkZlpBackoff{Mode: QuirkZlpBackoffExponential},
+		},
+
+		{
+			parser: (*Quirk).parseQuirkZlpBackoff,
+			input:  "fixed:5ms",
+			value: QuirkZlpBackoff{
+				Mode:     QuirkZlpBackoffFixed,
+				Interval: 5 * time.Millisecond,
+			},
+		},
+
+		{
+			parser: (*Quirk).parseQuirkZlpBackoff,
+			input:  "fixed:hello",
+			err:    `"hello": invalid duration`,
+		},
+
+		{
+			parser: (*Quirk).parseQuirkZlpBackoff,
+			input:  "invalid",
+			err:    `"invalid": must be none, fixed:DELAY or exponential`,
+		},
+
 		// parseUint
 		{
 			parser: (*Quirk).parseUint,
@@ -417,6 +834,273 @@ func TestQuirksParsers(t *testing.T) {
 	}
 }
 
+// TestQuirksInitScript tests parseQuirkInitScript
+func TestQuirksInitScript(t *testing.T) {
+	type testData struct {
+		input string          // Input string
+		value QuirkInitScript // Expected output value
+		err   string          // Or expected error
+	}
+
+	tests := []testData{
+		{
+			input: "",
+			value: nil,
+		},
+
+		{
+			input: "soft-reset; delay 2s; probe /ipp/print; expect 200;",
+			value: QuirkInitScript{
+				{Op: QuirkInitSoftReset},
+				{Op: QuirkInitDelay, Delay: 2 * time.Second},
+				{Op: QuirkInitProbe, Path: "/ipp/print"},
+				{Op: QuirkInitExpect, Status: 200},
+			},
+		},
+
+		{
+			input: "delay 500",
+			value: QuirkInitScript{
+				{Op: QuirkInitDelay, Delay: 500 * time.Millisecond},
+			},
+		},
+
+		{
+			input: "control 0x41 1 0x0001; delay 500ms; soft-reset;",
+			value: QuirkInitScript{
+				{
+					Op:          QuirkInitControl,
+					RequestType: 0x41,
+					Request:     1,
+					Value:       1,
+				},
+				{Op: QuirkInitDelay, Delay: 500 * time.Millisecond},
+				{Op: QuirkInitSoftReset},
+			},
+		},
+
+		{
+			input: "control 0x41 0x02 0x0000 0x0003",
+			value: QuirkInitScript{
+				{
+					Op:          QuirkInitControl,
+					RequestType: 0x41,
+					Request:     2,
+					Index:       3,
+				},
+			},
+		},
+
+		{
+			input: "control 0x41 0x100 0",
+			err:   `"0x100": invalid number`,
+		},
+
+		{
+			input: "control 0x41",
+			err:   `"control 0x41": invalid step`,
+		},
+
+		{
+			input: "delay -1s",
+			err:   `"-1s": invalid duration`,
+		},
+
+		{
+			input: "probe ipp/print",
+			err:   `"probe ipp/print": invalid step`,
+		},
+
+		{
+			input: "expect 2000",
+			err:   `"2000": invalid HTTP status`,
+		},
+
+		{
+			input: "reboot",
+			err:   `"reboot": invalid step`,
+		},
+	}
+
+	for _, test := range tests {
+		q := Quirk{
+			RawValue: test.input,
+		}
+
+		err := q.parseQuirkInitScript()
+		errstr := ""
+		if err != nil {
+			errstr = err.Error()
+		}
+
+		if errstr != test.err {
+			t.Errorf("%q: error mismatch:\n"+
+				"expected: %s\n"+
+				"present:  %s",
+				test.input, test.err, errstr)
+
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(q.Parsed, test.value) {
+			t.Errorf("%q: value mismatch:\n"+
+				"expected: %v\n"+
+				"present:  %v",
+				test.input, test.value, q.Parsed)
+		}
+	}
+}
+
+// TestQuirksRetryHTTPStatus tests parseQuirkRetryHTTPStatus
+func TestQuirksRetryHTTPStatus(t *testing.T) {
+	type testData struct {
+		input string               // Input string
+		value QuirkRetryHTTPStatus // Expected output value
+		err   string               // Or expected error
+	}
+
+	tests := []testData{
+		{
+			input: "",
+			value: nil,
+		},
+
+		{
+			input: "503, 408",
+			value: QuirkRetryHTTPStatus{503, 408},
+		},
+
+		{
+			input: "503,",
+			value: QuirkRetryHTTPStatus{503},
+		},
+
+		{
+			input: "503, busy",
+			err:   `"busy": invalid HTTP status`,
+		},
+
+		{
+			input: "99",
+			err:   `"99": invalid HTTP status`,
+		},
+	}
+
+	for _, test := range tests {
+		q := Quirk{
+			RawValue: test.input,
+		}
+
+		err := q.parseQuirkRetryHTTPStatus()
+		errstr := ""
+		if err != nil {
+			errstr = err.Error()
+		}
+
+		if errstr != test.err {
+			t.Errorf("%q: error mismatch:\n"+
+				"expected: %s\n"+
+				"present:  %s",
+				test.input, test.err, errstr)
+
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(q.Parsed, test.value) {
+			t.Errorf("%q: value mismatch:\n"+
+				"expected: %v\n"+
+				"present:  %v",
+				test.input, test.value, q.Parsed)
+		}
+	}
+
+	list := QuirkRetryHTTPStatus{503, 408}
+	if !list.Contains(408) || list.Contains(500) {
+		t.Errorf("QuirkRetryHTTPStatus.Contains() failed")
+	}
+}
+
+// TestQuirksUsbIfMatch tests usb-interface-match quirk
+func TestQuirksUsbIfMatch(t *testing.T) {
+	type testData struct {
+		input string          // Input string
+		value QuirkUsbIfMatch // Expected output value
+		err   string          // Or expected error
+	}
+
+	tests := []testData{
+		{
+			input: "",
+			value: nil,
+		},
+
+		{
+			input: "255/9/1",
+			value: QuirkUsbIfMatch{{255, 9, 1}},
+		},
+
+		{
+			input: "255/9/1, 255/9/2",
+			value: QuirkUsbIfMatch{{255, 9, 1}, {255, 9, 2}},
+		},
+
+		{
+			input: "255/9",
+			err:   `"255/9": must be CLASS/SUBCLASS/PROTO`,
+		},
+
+		{
+			input: "256/9/1",
+			err:   `"256": invalid number`,
+		},
+	}
+
+	for _, test := range tests {
+		q := Quirk{
+			RawValue: test.input,
+		}
+
+		err := q.parseQuirkUsbIfMatch()
+		errstr := ""
+		if err != nil {
+			errstr = err.Error()
+		}
+
+		if errstr != test.err {
+			t.Errorf("%q: error mismatch:\n"+
+				"expected: %s\n"+
+				"present:  %s",
+				test.input, test.err, errstr)
+
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(q.Parsed, test.value) {
+			t.Errorf("%q: value mismatch:\n"+
+				"expected: %v\n"+
+				"present:  %v",
+				test.input, test.value, q.Parsed)
+		}
+	}
+
+	// Test interface matching
+	std := UsbIfDesc{Class: 7, SubClass: 1, Proto: 4}
+	hp := UsbIfDesc{Class: 255, SubClass: 9, Proto: 1}
+	match := QuirkUsbIfMatch{{255, 9, 1}}
+
+	if !std.IsIppOverUsb(nil) {
+		t.Errorf("7/1/4 must always match")
+	}
+
+	if hp.IsIppOverUsb(nil) {
+		t.Errorf("255/9/1 must not match by default")
+	}
+
+	if !hp.IsIppOverUsb(match) {
+		t.Errorf("255/9/1 must match, if enabled by quirk")
+	}
+}
+
 // TestQuirksSetLoad tests LoadQuirksSet
 func TestQuirksSetLoad(t *testing.T) {
 	const path = "testdata/quirks"
@@ -434,3 +1118,338 @@ func TestQuirksSetLoad(t *testing.T) {
 		t.Fatalf("LoadQuirksSet(%q): %s", path, err)
 	}
 }
+
+// TestQuirksIncludeTemplates tests include directive and templates
+func TestQuirksIncludeTemplates(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(tmp)
+
+	write := func(name, content string) {
+		path := filepath.Join(tmp, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	load := func() (QuirksSet, error) {
+		return LoadQuirksSet(filepath.Join(tmp, "quirks"))
+	}
+
+	// Templates in the included file
+	write("quirks/common/slow.inc",
+		"[template:slow]\n"+
+			"  init-delay = 500\n"+
+			"  request-delay = 100\n"+
+			"  http-connection = close\n")
+	write("quirks/test.conf",
+		"include = common/*.inc\n"+
+			"[Test Slow]\n"+
+			"  use = slow\n"+
+			"  request-delay = 200\n")
+
+	qset, err := load()
+	if err != nil {
+		t.Fatalf("LoadQuirksSet: %s", err)
+	}
+
+	quirks := qset.MatchByModelName("Test Slow")
+	if v := quirks.GetInitDelay(); v != 500*time.Millisecond {
+		t.Errorf("init-delay: expected %s, present %s",
+			500*time.Millisecond, v)
+	}
+
+	if v := quirks.GetRequestDelay(); v != 200*time.Millisecond {
+		t.Errorf("request-delay: own value must win, present %s", v)
+	}
+
+	if v := quirks.HTTPHeaders["Connection"]; v != "close" {
+		t.Errorf("http-connection: expected %q, present %q", "close", v)
+	}
+
+	origin := quirks.Get(QuirkNmInitDelay).Origin
+	if !strings.Contains(origin, "slow.inc:2") ||
+		!strings.Contains(origin, `template "slow"`) ||
+		!strings.Contains(origin, "test.conf:3") {
+		t.Errorf("unexpected origin: %s", origin)
+	}
+
+	// Templates are not matched against devices
+	quirks = qset.MatchByModelName("template:slow")
+	if v := quirks.GetInitDelay(); v != 0 {
+		t.Errorf("template matched as section")
+	}
+
+	// Errors
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"[Test]\n  use = missed\n", `template "missed" not defined`},
+		{"include = missed.inc\n", "include:"},
+		{"include = test.conf\n", "include loop"},
+		{"include = common/slow.inc\ninclude = common/*.inc\n",
+			`template "slow" already defined`},
+	}
+
+	for _, test := range tests {
+		write("quirks/test.conf", test.content)
+		_, err = load()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error %q, present %v",
+				test.content, test.err, err)
+		}
+	}
+}
+
+// TestQuirksMatchByDevice tests matching quirks by serial number
+// and port path
+func TestQuirksMatchByDevice(t *testing.T) {
+	newQuirks := func(match, value string) *Quirks {
+		q := &Quirk{
+			Origin:   match,
+			Match:    match,
+			Name:     QuirkNmBlacklist,
+			RawValue: value,
+		}
+		q.parseBool()
+
+		return &Quirks{
+			byName: map[string]*Quirk{QuirkNmBlacklist: q},
+		}
+	}
+
+	qset := QuirksSet{
+		newQuirks("HP LaserJet*", "false"),
+		newQuirks("serial:VCF9192281", "true"),
+		newQuirks("port:1-3.*", "true"),
+		newQuirks("HP LaserJet MFP M28w", "false"),
+		newQuirks("hwid:04a9:*", "false"),
+		newQuirks("Brother MFC-L8390CDW; fw>=1.23; fw<1.30", "true"),
+		newQuirks("Brother MFC-L8390CDW", "false"),
+	}
+
+	type testData struct {
+		info  UsbDeviceInfo // Device info
+		match string        // Expected match
+	}
+
+	tests := []testData{
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "HP LaserJet MFP M28w",
+				SerialNumber:  "VCF9192281",
+				PortPath:      "1-3.2",
+			},
+			match: "serial:VCF9192281",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "HP LaserJet MFP M28w",
+				SerialNumber:  "VCF0000000",
+				PortPath:      "1-3.2",
+			},
+			match: "port:1-3.*",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "HP LaserJet MFP M28w",
+				SerialNumber:  "VCF0000000",
+				PortPath:      "1-4",
+			},
+			match: "HP LaserJet MFP M28w",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "HP LaserJet Pro",
+			},
+			match: "HP LaserJet*",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "Canon MF",
+			},
+			match: "*",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				Vendor:  0x04a9,
+				Product: 0x27fc,
+			},
+			match: "hwid:04a9:*",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "Brother MFC-L8390CDW",
+				Firmware:      "1.25",
+			},
+			match: "Brother MFC-L8390CDW; fw>=1.23; fw<1.30",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "Brother MFC-L8390CDW",
+				Firmware:      "1.3",
+			},
+			match: "Brother MFC-L8390CDW",
+		},
+
+		{
+			info: UsbDeviceInfo{
+				MfgAndProduct: "Brother MFC-L8390CDW",
+			},
+			match: "Brother MFC-L8390CDW",
+		},
+	}
+
+	for _, test := range tests {
+		q := qset.MatchByDevice(test.info).Get(QuirkNmBlacklist)
+		if q.Match != test.match {
+			t.Errorf("%+v: expected match %q, present %q",
+				test.info, test.match, q.Match)
+		}
+	}
+
+	// Serial and port patterns never match devices without
+	// serial number or known port path
+	if QuirkMatch("serial:*", UsbDeviceInfo{}) >= 0 {
+		t.Errorf("serial:* matches device without serial number")
+	}
+
+	if QuirkMatch("port:*", UsbDeviceInfo{}) >= 0 {
+		t.Errorf("port:* matches device without port path")
+	}
+
+	// Invalid firmware conditions are rejected
+	for _, section := range []string{"HP*; fw", "HP*; fw~1.0",
+		"HP*; fw>=", "HP*; rev>=1.0"} {
+		if _, _, err := quirkMatchSplit(section); err == nil {
+			t.Errorf("%q: error not detected", section)
+		}
+	}
+}
+
+// TestQuirkDeviceModeAllowsPath tests QuirkDeviceMode.AllowsPath
+func TestQuirkDeviceModeAllowsPath(t *testing.T) {
+	tests := []struct {
+		mode     QuirkDeviceMode
+		path     string
+		expected bool
+	}{
+		{QuirkDeviceModeAuto, "/ipp/print", true},
+		{QuirkDeviceModeAuto, "/eSCL/ScannerStatus", true},
+		{QuirkDeviceModePrintOnly, "/ipp/print", true},
+		{QuirkDeviceModePrintOnly, "/ipp/faxout", false},
+		{QuirkDeviceModePrintOnly, "/eSCL/ScannerStatus", false},
+		{QuirkDeviceModeScanOnly, "/ipp/print", false},
+		{QuirkDeviceModeScanOnly, "/eSCL/ScanJobs", true},
+		{QuirkDeviceModeFaxOnly, "/ipp/print", false},
+		{QuirkDeviceModeFaxOnly, "/ipp/faxout", true},
+		{QuirkDeviceModeFaxOnly, "/index.html", true},
+	}
+
+	for _, test := range tests {
+		allowed := test.mode.AllowsPath(test.path)
+		if allowed != test.expected {
+			t.Errorf("%s %s: expected %v, present %v",
+				test.mode, test.path, test.expected, allowed)
+		}
+	}
+}
+
+// TestFirmwareVersionCompare tests FirmwareVersionCompare
+func TestFirmwareVersionCompare(t *testing.T) {
+	type testData struct {
+		v1, v2 string
+		cmp    int
+	}
+
+	tests := []testData{
+		{"1.23", "1.23", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.9", "1.10", -1},
+		{"2.0", "1.99", 1},
+		{"1.23 (build 45)", "1.23", 1},
+		{"ZZ2311A", "zz2311a", 0},
+		{"ZZ2311A", "ZZ2312A", -1},
+		{"1.0-beta", "1.0-alpha", 1},
+	}
+
+	for _, test := range tests {
+		cmp := FirmwareVersionCompare(test.v1, test.v2)
+		if cmp != test.cmp {
+			t.Errorf("%q vs %q: expected %d, present %d",
+				test.v1, test.v2, test.cmp, cmp)
+		}
+	}
+}
+
+// TestQuirksZlpRecvHackLearned tests that zlp-recv-hack, explicitly
+// set in the quirks file, takes precedence over the automatically
+// learned behavior, persisted in the device state
+func TestQuirksZlpRecvHackLearned(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(tmp)
+
+	tests := []struct {
+		value    string // zlp-recv-hack value, "" if not set
+		learned  bool   // Behavior learned
+		expected bool   // Expected zlp-recv-hack state
+	}{
+		{"", false, false},
+		{"", true, true},
+		{"false", false, false},
+		{"false", true, false},
+		{"true", false, true},
+		{"true", true, true},
+	}
+
+	for _, test := range tests {
+		content := "[" + testUsbLoopbackInfo.MfgAndProduct + "]\n"
+		if test.value != "" {
+			content += "  zlp-recv-hack = " + test.value + "\n"
+		}
+
+		path := filepath.Join(tmp, "test.conf")
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		qset, err := LoadQuirksSet(tmp)
+		if err != nil {
+			t.Fatalf("LoadQuirksSet: %s", err)
+		}
+
+		transport := &UsbTransport{
+			quirks: qset.MatchByDevice(testUsbLoopbackInfo),
+		}
+
+		if test.learned {
+			transport.EnableZlpRecvHack()
+		}
+
+		enabled := transport.zlpRecvHackEnabled()
+		if enabled != test.expected {
+			t.Errorf("zlp-recv-hack=%q, learned=%v: "+
+				"expected %v, present %v",
+				test.value, test.learned,
+				test.expected, enabled)
+		}
+	}
+}
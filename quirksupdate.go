@@ -0,0 +1,258 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Automatic quirks update
+ *
+ * Quirks bundle is a gzip-compressed tar archive of quirks files,
+ * published at the URL, configured by the `update-url` parameter
+ * in the [quirks] section of ipp-usb.conf. The detached signature
+ * is published at the same URL with the ".sig" suffix. It is
+ * the base64-encoded ASN.1 ECDSA signature of the SHA-256 hash
+ * of the bundle.
+ *
+ * The signature is verified against the built-in public key.
+ * Downloaded quirks are installed into the PathQuirksUpdateDir
+ * directory and loaded with lower priority that quirks from
+ * the PathConfQuirksDir, so sysadmin always have a last word.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// QuirksUpdatePublicKey is the base64-encoded (PKIX, ASN.1 DER)
+// ECDSA public key, used to verify the quirks bundle signature.
+//
+// It is expected to be set at build time by the distribution
+// that publishes the quirks bundle, using something like this:
+//
+//	go build -ldflags "-X main.QuirksUpdatePublicKey=MFkw..."
+//
+// If key is not set, quirks update is not available.
+var QuirksUpdatePublicKey = ""
+
+// QuirksUpdate downloads the quirks bundle, verifies its signature
+// and installs it into the PathQuirksUpdateDir
+func QuirksUpdate() error {
+	// Check parameters
+	if Conf.QuirksUpdateURL == "" {
+		return errors.New("quirks update: update-url not configured")
+	}
+
+	if QuirksUpdatePublicKey == "" {
+		return errors.New("quirks update: public key not built in")
+	}
+
+	u, err := url.Parse(Conf.QuirksUpdateURL)
+	if err == nil && u.Scheme != "https" {
+		err = errors.New("only https is allowed")
+	}
+
+	if err != nil {
+		return fmt.Errorf("quirks update: %q: %s",
+			Conf.QuirksUpdateURL, err)
+	}
+
+	// Download bundle and signature
+	Log.Info(' ', "quirks update: downloading %s", Conf.QuirksUpdateURL)
+
+	bundle, err := quirksUpdateDownload(Conf.QuirksUpdateURL)
+	var sig []byte
+	if err == nil {
+		sig, err = quirksUpdateDownload(Conf.QuirksUpdateURL + ".sig")
+	}
+
+	if err != nil {
+		return fmt.Errorf("quirks update: %s", err)
+	}
+
+	// Verify and install
+	err = quirksBundleVerify(bundle, sig, QuirksUpdatePublicKey)
+	if err == nil {
+		err = quirksBundleInstall(bundle, PathQuirksUpdateDir)
+	}
+
+	if err != nil {
+		return fmt.Errorf("quirks update: %s", err)
+	}
+
+	Log.Info(' ', "quirks update: installed into %s", PathQuirksUpdateDir)
+
+	return nil
+}
+
+// quirksUpdateDownload downloads the file
+func quirksUpdateDownload(u string) ([]byte, error) {
+	c := &http.Client{Timeout: QuirksUpdateTimeout}
+
+	rsp, err := c.Get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: HTTP %s", u, rsp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body,
+		QuirksUpdateMaxSize+1))
+
+	if err == nil && len(data) > QuirksUpdateMaxSize {
+		err = fmt.Errorf("%s: file too large", u)
+	}
+
+	return data, err
+}
+
+// quirksBundleVerify verifies the bundle signature against
+// the base64-encoded public key
+func quirksBundleVerify(bundle, sig []byte, key string) error {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return fmt.Errorf("public key: %s", err)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("public key: %s", err)
+	}
+
+	ecpub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("public key: not an ECDSA key")
+	}
+
+	rawsig, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("signature: %s", err)
+	}
+
+	hash := sha256.Sum256(bundle)
+	if !quirksECDSAVerify(ecpub, hash[:], rawsig) {
+		return errors.New("signature: verification failed")
+	}
+
+	return nil
+}
+
+// quirksECDSAVerify verifies ASN.1-encoded ECDSA signature
+func quirksECDSAVerify(pub *ecdsa.PublicKey, hash, sig []byte) bool {
+	var rs struct {
+		R, S *big.Int
+	}
+
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil || len(rest) != 0 || rs.R == nil || rs.S == nil {
+		return false
+	}
+
+	return ecdsa.Verify(pub, hash, rs.R, rs.S)
+}
+
+// quirksBundleInstall unpacks the bundle into the temporary directory,
+// checks that all quirks files can be loaded and then replaces
+// the destination directory
+func quirksBundleInstall(bundle []byte, dir string) error {
+	tmp := dir + ".new"
+	os.RemoveAll(tmp)
+
+	err := os.MkdirAll(tmp, 0755)
+	if err == nil {
+		err = quirksBundleUnpack(bundle, tmp)
+	}
+
+	if err == nil {
+		_, err = LoadQuirksSet(tmp)
+	}
+
+	if err == nil {
+		os.RemoveAll(dir)
+		err = os.Rename(tmp, dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+
+	return err
+}
+
+// quirksBundleUnpack extracts quirks files from the bundle into
+// the directory. Only regular files with the .conf suffix are
+// extracted, and any directory structure is rejected.
+func quirksBundleUnpack(bundle []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		return fmt.Errorf("bundle: %s", err)
+	}
+
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("bundle: %s", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// Archivers often prefix names with "./", so names are
+		// cleaned first. Anything that still is not a plain file
+		// name may point outside the quirks directory
+		name := path.Clean(hdr.Name)
+		if !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+
+		if name != path.Base(name) || name == "." || name == ".." ||
+			strings.ContainsRune(name, '\\') ||
+			strings.HasPrefix(name, ".") {
+			return fmt.Errorf("bundle: %q: invalid file name",
+				hdr.Name)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name),
+				data, 0644)
+		}
+
+		if err != nil {
+			return fmt.Errorf("bundle: %s", err)
+		}
+	}
+}
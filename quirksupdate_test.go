@@ -0,0 +1,177 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for automatic quirks update
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// quirksTestBundle creates a quirks bundle from the name->content map
+func quirksTestBundle(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		tw.Write([]byte(content))
+	}
+
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+// TestQuirksBundleVerify tests quirks bundle signature verification
+func TestQuirksBundleVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	pub := base64.StdEncoding.EncodeToString(der)
+
+	bundle := quirksTestBundle(t, map[string]string{
+		"test.conf": "[Test Device]\n  blacklist = true\n",
+	})
+
+	hash := sha256.Sum256(bundle)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	rawsig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	sig := []byte(base64.StdEncoding.EncodeToString(rawsig))
+
+	// Valid signature
+	err = quirksBundleVerify(bundle, sig, pub)
+	if err != nil {
+		t.Errorf("valid signature rejected: %s", err)
+	}
+
+	// Tampered bundle
+	tampered := append([]byte{}, bundle...)
+	tampered[len(tampered)-1] ^= 1
+
+	err = quirksBundleVerify(tampered, sig, pub)
+	if err == nil {
+		t.Errorf("tampered bundle accepted")
+	}
+
+	// Garbage signature
+	err = quirksBundleVerify(bundle, []byte("garbage"), pub)
+	if err == nil {
+		t.Errorf("garbage signature accepted")
+	}
+}
+
+// TestQuirksBundleInstall tests quirks bundle installation
+func TestQuirksBundleInstall(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "quirks.d")
+
+	// Valid bundle. Names with "./" prefix are accepted
+	bundle := quirksTestBundle(t, map[string]string{
+		"test.conf":    "[Test Device]\n  blacklist = true\n",
+		"./other.conf": "[Other Device]\n  blacklist = true\n",
+		"README.txt":   "ignored",
+	})
+
+	err = quirksBundleInstall(bundle, dir)
+	if err != nil {
+		t.Fatalf("quirksBundleInstall: %s", err)
+	}
+
+	qset, err := LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("LoadQuirksSet(%q): %s", dir, err)
+	}
+
+	quirks := qset.MatchByModelName("Test Device")
+	if !quirks.GetBlacklist() {
+		t.Errorf("installed quirks not loaded")
+	}
+
+	quirks = qset.MatchByModelName("Other Device")
+	if !quirks.GetBlacklist() {
+		t.Errorf("installed quirks with ./ prefix not loaded")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "README.txt")); err == nil {
+		t.Errorf("non-quirks file installed")
+	}
+
+	// Bundles with invalid file names must be rejected, and
+	// existent quirks must remain untouched
+	for _, name := range []string{"../evil.conf", "sub/evil.conf",
+		"./../evil.conf", ".conf", "/etc/evil.conf"} {
+		bundle = quirksTestBundle(t, map[string]string{
+			name: "[*]\n  blacklist = true\n",
+		})
+
+		err = quirksBundleInstall(bundle, dir)
+		if err == nil {
+			t.Errorf("bundle with invalid file name %q accepted",
+				name)
+		}
+	}
+
+	// Bundle with syntax errors must be rejected
+	bundle = quirksTestBundle(t, map[string]string{
+		"bad.conf": "[Test Device]\n  blacklist = maybe\n",
+	})
+
+	err = quirksBundleInstall(bundle, dir)
+	if err == nil {
+		t.Errorf("bundle with invalid quirks accepted")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "test.conf")); err != nil {
+		t.Errorf("existent quirks lost: %s", err)
+	}
+}
@@ -0,0 +1,180 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Replay of captured device responses
+ *
+ * This is a developer tool. It feeds the captured byte stream,
+ * received from device (i.e., attached to the issue report), through
+ * the same RoundTrip/response wrapper/sanitizer pipeline, as used
+ * for real devices, and prints the result. It allows to quickly
+ * iterate on parser robustness fixes without having a device.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// replayIO implements usbConnIO on a top of the captured device
+// response. Data sent to the "device" is discarded
+type replayIO struct {
+	data *bytes.Reader // Captured response
+}
+
+// Send discards the outgoing data
+func (rio *replayIO) Send(ctx context.Context, data []byte) (int, error) {
+	return len(data), nil
+}
+
+// Recv returns the next portion of the captured response
+func (rio *replayIO) Recv(ctx context.Context, data []byte) (int, error) {
+	return rio.data.Read(data)
+}
+
+// SoftReset does nothing
+func (rio *replayIO) SoftReset() error {
+	return nil
+}
+
+// ClearHalt does nothing
+func (rio *replayIO) ClearHalt(in bool) error {
+	return nil
+}
+
+// MaxPacketSize returns 0, as it is unknown
+func (rio *replayIO) MaxPacketSize() int {
+	return 0
+}
+
+// Close does nothing
+func (rio *replayIO) Close() {
+}
+
+// newReplayTransport creates UsbTransport that replays the captured
+// device response. Quirks are chosen by the model name, as for the
+// real device
+func newReplayTransport(data []byte, model string) *UsbTransport {
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connReleased: make(chan struct{}, 1),
+		shutdown:     make(chan struct{}),
+		quirks:       Conf.Quirks.MatchByModelName(model),
+		stats:        &DevStats{},
+		recvAlign:    UsbRecvAlign,
+	}
+
+	transport.log.ToNowhere()
+
+	conn := &usbConn{
+		transport: transport,
+		iface:     &replayIO{bytes.NewReader(data)},
+	}
+
+	conn.reader = bufio.NewReader(conn)
+
+	transport.connList = []*usbConn{conn}
+	transport.connPool = make(chan *usbConn, 1)
+	transport.connstate = newUsbConnState(1)
+	transport.connPool <- conn
+
+	return transport
+}
+
+// Replay replays the captured device response from the file
+// and prints the result to the standard output
+func Replay(file, model string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return replay(data, model, os.Stdout, Console)
+}
+
+// replay replays the captured device response and prints the
+// result to out. Transport log goes to the cc, if not nil
+func replay(data []byte, model string, out io.Writer, cc *Logger) error {
+	transport := newReplayTransport(data, model)
+
+	if cc != nil {
+		transport.log.Cc(cc)
+	}
+
+	log := transport.log.Begin()
+	transport.dumpQuirks(log)
+	log.Commit()
+
+	// Send the dummy request. Captured response doesn't depend
+	// on it anyway.
+	rq, err := http.NewRequest("POST", "http://localhost/ipp/print",
+		http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	rq.Header.Set("Content-Type", "application/ipp")
+
+	rsp, err := transport.RoundTrip(rq)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	replayPrint(out, rsp, body, err)
+
+	return err
+}
+
+// replayPrint prints the replayed response. err is the error,
+// returned while reading the response body, if any
+func replayPrint(out io.Writer, rsp *http.Response, body []byte, err error) {
+	fmt.Fprintf(out, "HTTP/%d.%d %s\n", rsp.ProtoMajor, rsp.ProtoMinor,
+		rsp.Status)
+
+	keys := make([]string, 0, len(rsp.Header))
+	for k := range rsp.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range rsp.Header[k] {
+			fmt.Fprintf(out, "%s: %s\n", k, v)
+		}
+	}
+
+	fmt.Fprintf(out, "\n")
+
+	if err != nil {
+		fmt.Fprintf(out, "body: %d bytes received; %s\n", len(body), err)
+	}
+
+	if rsp.Header.Get("Content-Type") == "application/ipp" {
+		msg := goipp.Message{}
+		err2 := msg.DecodeBytes(body)
+		if err2 != nil {
+			fmt.Fprintf(out, "IPP decode: %s\n", err2)
+		} else {
+			msg.Print(out, false)
+		}
+	} else {
+		out.Write(body)
+	}
+}
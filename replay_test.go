@@ -0,0 +1,162 @@
+// +build !minimal
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for replay of captured device responses
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestReplayMalformed tests replay of malformed captures
+func TestReplayMalformed(t *testing.T) {
+	tests := []struct {
+		name string // Test name
+		data string // Captured response
+		err  string // Expected error, "" if none
+		out  string // Expected output fragment
+	}{
+		{
+			name: "empty",
+			data: "",
+			err:  "EOF",
+		},
+
+		{
+			name: "garbage",
+			data: "\x00\x01\x02\x03 not a HTTP response\r\n\r\n",
+			err:  "malformed HTTP",
+		},
+
+		{
+			name: "bad status",
+			data: "HTTP/1.1 abc OK\r\n\r\n",
+			err:  "malformed HTTP status code",
+		},
+
+		{
+			name: "truncated header",
+			data: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n",
+			err:  "EOF",
+		},
+
+		{
+			name: "truncated body",
+			data: "HTTP/1.1 200 OK\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Length: 100\r\n" +
+				"\r\n" +
+				"0123456789",
+			err: "unexpected EOF",
+			out: "body: 10 bytes received",
+		},
+
+		{
+			name: "bad IPP",
+			data: "HTTP/1.1 200 OK\r\n" +
+				"Content-Type: application/ipp\r\n" +
+				"Content-Length: 3\r\n" +
+				"\r\n" +
+				"\x02\x00\x00",
+			out: "IPP decode:",
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := replay([]byte(test.data), "", out, nil)
+
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: error not reported", test.name)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: expected error %q, present %q",
+				test.name, test.err, err)
+		}
+
+		if !strings.Contains(out.String(), test.out) {
+			t.Errorf("%s: expected %q in output, present:\n%s",
+				test.name, test.out, out)
+		}
+	}
+}
+
+// TestReplayLoopback tests that replay of the response, captured
+// from the virtual device, gives the same result, as the live
+// exchange with that device
+func TestReplayLoopback(t *testing.T) {
+	ipp, err := testIppPrinterAttrs().EncodeBytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Header().Set("Content-Type", "application/ipp")
+		w.Write(ipp)
+	})
+
+	newRequest := func() *http.Request {
+		rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+			http.NoBody)
+		rq.Header.Set("Content-Type", "application/ipp")
+		return rq
+	}
+
+	// Live exchange with the virtual device
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	rsp, err := transport.RoundTrip(newRequest())
+	if err != nil {
+		t.Fatalf("RoundTrip: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	live := &bytes.Buffer{}
+	replayPrint(live, rsp, body, err)
+
+	// Capture the same response, as device sends it, and replay it
+	w := &usbLoopbackResponseWriter{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+
+	rq := newRequest()
+	handler.ServeHTTP(w, rq)
+
+	replayed := &bytes.Buffer{}
+	err = replay(w.bytes(rq), testUsbLoopbackInfo.MfgAndProduct,
+		replayed, nil)
+	if err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+
+	if live.String() != replayed.String() {
+		t.Errorf("replay differs from the live exchange:\n"+
+			"live:\n%s\nreplayed:\n%s", live, replayed)
+	}
+
+	if !strings.Contains(replayed.String(), "Test Printer") {
+		t.Errorf("IPP response not decoded:\n%s", replayed)
+	}
+}
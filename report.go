@@ -0,0 +1,353 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Bug report bundle
+ *
+ * Report collects everything, usually needed to investigate the
+ * device-related problem (device log, applied quirks, USB descriptors,
+ * the last Get-Printer-Attributes response and version information)
+ * into the single .tar.gz file, suitable for attaching to bug reports.
+ * The device serial number may be optionally redacted
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ReportVersion is the program version, reported in the bug report.
+// It is normally set at build time, using
+// -ldflags "-X main.ReportVersion=..."
+var ReportVersion = "unknown"
+
+// report represents the bug report under construction
+type report struct {
+	tar     *tar.Writer // Output archive
+	dir     string      // Top-level directory within archive
+	now     time.Time   // Report creation time
+	secrets []string    // Strings to be redacted
+}
+
+// Report creates the bug report bundle for the device, specified
+// either by its ident or by its USB address, written as "BUS:DEV",
+// and writes it into the output file. If output is "", the file
+// name is generated
+//
+// If redact is true, the device serial number is replaced with
+// 'X' characters in all collected files
+func Report(name, output string, redact bool) error {
+	ident, desc, info, err := reportFindDevice(name)
+	if err != nil {
+		return err
+	}
+
+	rep := &report{
+		dir: "ipp-usb-report",
+		now: time.Now(),
+	}
+
+	if redact {
+		if info == nil {
+			return fmt.Errorf("%s: device not connected, "+
+				"serial number can't be redacted", name)
+		}
+
+		// Ident contains serial number with some characters
+		// replaced, so it goes first
+		if info.SerialNumber != "" {
+			rep.secrets = append(rep.secrets, ident,
+				info.SerialNumber,
+				strings.ToUpper(info.SerialNumber))
+		}
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("%s-%s.tar.gz", rep.dir,
+			rep.now.Format("20060102-150405"))
+	}
+
+	// Create the output file
+	file, err := os.OpenFile(output,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(file)
+	rep.tar = tar.NewWriter(gz)
+
+	// Collect everything
+	err = rep.collect(ident, desc, info)
+
+	err2 := rep.tar.Close()
+	if err == nil {
+		err = err2
+	}
+
+	err2 = gz.Close()
+	if err == nil {
+		err = err2
+	}
+
+	err2 = file.Close()
+	if err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+
+	InitLog.Info(0, "Report saved to %s", output)
+	return nil
+}
+
+// reportFindDevice finds the device by its ident or USB address.
+// Disconnected devices may be specified by ident; in this case,
+// desc and info are nil, and only saved files are collected
+func reportFindDevice(name string) (ident string,
+	desc *UsbDeviceDesc, info *UsbDeviceInfo, err error) {
+
+	addr, addrErr := probeParseAddr(name)
+
+	err = UsbInit(true)
+	if err != nil {
+		return
+	}
+
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		return
+	}
+
+	for a, d := range descs {
+		i, err2 := d.GetUsbDeviceInfo()
+		if err2 != nil {
+			continue
+		}
+
+		if i.Ident() == name || (addrErr == nil && a == addr) {
+			return i.Ident(), &d, &i, nil
+		}
+	}
+
+	// Try disconnected device
+	_, err = os.Stat(IppAttrsPath(name))
+	if addrErr != nil && (err == nil || len(LogDevFiles(name)) != 0) {
+		return name, nil, nil, nil
+	}
+
+	return "", nil, nil, fmt.Errorf("%s: device not found", name)
+}
+
+// collect collects all report files
+func (rep *report) collect(ident string,
+	desc *UsbDeviceDesc, info *UsbDeviceInfo) error {
+
+	err := rep.addLines("version.txt", rep.version())
+
+	if err == nil && desc != nil {
+		err = rep.addLines("usb.txt", reportUsb(desc, info))
+	}
+
+	if err == nil && info != nil {
+		quirks := Conf.Quirks.MatchByDevice(*info)
+		err = rep.addLines("quirks.txt", quirks.Format())
+	}
+
+	if err == nil {
+		err = rep.addAttrs(ident)
+	}
+
+	for _, path := range LogDevFiles(ident) {
+		if err == nil {
+			name := "device" + strings.TrimPrefix(filepath.Base(path),
+				ident)
+			err = rep.addFile(filepath.Join("log", name), path)
+		}
+	}
+
+	if err == nil {
+		err = rep.addFile("log/main.log", PathLogFile)
+	}
+
+	return err
+}
+
+// version returns version information and configuration summary
+func (rep *report) version() []string {
+	lines := []string{
+		fmt.Sprintf("ipp-usb:  %s", ReportVersion),
+		fmt.Sprintf("Go:       %s", runtime.Version()),
+		fmt.Sprintf("OS/arch:  %s/%s", runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("Created:  %s", rep.now.Format(time.RFC3339)),
+		"",
+		"Configuration files:",
+	}
+
+	for _, file := range ConfFiles {
+		lines = append(lines, "  "+file)
+	}
+
+	lines = append(lines, "Configuration parameters:")
+	for _, origin := range ConfOrigins {
+		s := ""
+		if origin.Overridden {
+			s = ", overridden"
+		}
+
+		lines = append(lines, fmt.Sprintf("  [%s] %s = %s (%s:%d%s)",
+			origin.Section, origin.Key, origin.Value,
+			origin.File, origin.Line, s))
+	}
+
+	return lines
+}
+
+// reportUsb formats USB device information and interface descriptors
+func reportUsb(desc *UsbDeviceDesc, info *UsbDeviceInfo) []string {
+	lines := []string{
+		fmt.Sprintf("USB address:   %s", desc.UsbAddr),
+		fmt.Sprintf("Vndr:Prod:     %4.4x:%4.4x", info.Vendor, info.Product),
+		fmt.Sprintf("Port path:     %s", info.PortPath),
+		fmt.Sprintf("Speed:         %s", info.Speed),
+		fmt.Sprintf("Manufacturer:  %s", info.Manufacturer),
+		fmt.Sprintf("Product:       %s", info.ProductName),
+		fmt.Sprintf("SerialNumber:  %s", info.SerialNumber),
+		fmt.Sprintf("BasicCaps:     %s", info.BasicCaps),
+		fmt.Sprintf("Configuration: %d", desc.Config),
+		"",
+		"USB interfaces (* - IPP over USB):",
+		"  Config Interface Alt Class SubClass Proto",
+	}
+
+	ifmatch := UsbIfMatch(info.Vendor, info.Product)
+	for _, ifdesc := range desc.IfDescs {
+		mark := ' '
+		if ifdesc.IsIppOverUsb(ifmatch) {
+			mark = '*'
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%c   %-3d     %-3d    %-3d %-3d    %-3d     %-3d", mark,
+			ifdesc.Config, ifdesc.IfNum,
+			ifdesc.Alt, ifdesc.Class, ifdesc.SubClass, ifdesc.Proto))
+	}
+
+	return lines
+}
+
+// addAttrs adds the last Get-Printer-Attributes response, both
+// in the binary form and decoded, if available
+func (rep *report) addAttrs(ident string) error {
+	data, err := ioutil.ReadFile(IppAttrsPath(ident))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	data = rep.redact(data)
+	err = rep.add("printer-attributes.ipp", data)
+	if err != nil {
+		return err
+	}
+
+	var msg goipp.Message
+	var buf bytes.Buffer
+
+	err = msg.DecodeBytesEx(data,
+		goipp.DecoderOptions{EnableWorkarounds: true})
+	if err != nil {
+		fmt.Fprintf(&buf, "IPP decode: %s\n", err)
+	} else {
+		msg.Print(&buf, false)
+	}
+
+	return rep.add("printer-attributes.txt", buf.Bytes())
+}
+
+// addFile adds the disk file to the report. Missed files are
+// silently ignored and gzip-compressed files are decompressed
+func (rep *report) addFile(name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	defer file.Close()
+
+	var in io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		in = gz
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	return rep.add(name, rep.redact(data))
+}
+
+// addLines adds text file, represented as a slice of lines
+func (rep *report) addLines(name string, lines []string) error {
+	text := strings.Join(lines, "\n") + "\n"
+	return rep.add(name, rep.redact([]byte(text)))
+}
+
+// add adds the file to the report
+func (rep *report) add(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    rep.dir + "/" + name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: rep.now,
+	}
+
+	err := rep.tar.WriteHeader(hdr)
+	if err == nil {
+		_, err = rep.tar.Write(data)
+	}
+
+	return err
+}
+
+// redact replaces all secrets in data with 'X' characters.
+// Secrets are replaced with the strings of the same length,
+// so binary data (i.e., IPP messages) remains decodable
+func (rep *report) redact(data []byte) []byte {
+	for _, secret := range rep.secrets {
+		if secret != "" {
+			data = bytes.Replace(data, []byte(secret),
+				bytes.Repeat([]byte("X"), len(secret)), -1)
+		}
+	}
+
+	return data
+}
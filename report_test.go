@@ -0,0 +1,103 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for bug report bundle
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReportRedact tests redaction of secrets
+func TestReportRedact(t *testing.T) {
+	rep := &report{
+		secrets: []string{"03f0-0853-TH12-34-HP", "TH12:34", "th12:34"},
+	}
+
+	in := "ident=03f0-0853-TH12-34-HP serial=TH12:34 sn=th12:34 other"
+	out := string(rep.redact([]byte(in)))
+	expected := "ident=XXXXXXXXXXXXXXXXXXXX serial=XXXXXXX sn=XXXXXXX other"
+
+	if out != expected {
+		t.Errorf("redact:\nexpected: %s\npresent:  %s", expected, out)
+	}
+}
+
+// TestReportAddFile tests adding files to the report archive
+func TestReportAddFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-report")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Prepare plain and gzip-compressed files
+	plain := filepath.Join(dir, "dev.log")
+	ioutil.WriteFile(plain, []byte("serial SN123\n"), 0644)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("old serial SN123\n"))
+	gz.Close()
+
+	compressed := filepath.Join(dir, "dev.log.0.gz")
+	ioutil.WriteFile(compressed, buf.Bytes(), 0644)
+
+	// Build the archive
+	var out bytes.Buffer
+	rep := &report{
+		tar:     tar.NewWriter(&out),
+		dir:     "report",
+		secrets: []string{"SN123"},
+	}
+
+	for _, err := range []error{
+		rep.addFile("log/device.log", plain),
+		rep.addFile("log/device.log.0.gz", compressed),
+		rep.addFile("log/missed.log", filepath.Join(dir, "missed")),
+	} {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	rep.tar.Close()
+
+	// Check the archive
+	expected := map[string]string{
+		"report/log/device.log":   "serial XXXXX\n",
+		"report/log/device.log.0": "old serial XXXXX\n",
+	}
+
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		data, _ := ioutil.ReadAll(tr)
+		if s, ok := expected[hdr.Name]; !ok {
+			t.Errorf("%s: unexpected file", hdr.Name)
+		} else if s != string(data) {
+			t.Errorf("%s: expected %q, present %q",
+				hdr.Name, s, data)
+		}
+
+		delete(expected, hdr.Name)
+	}
+
+	for name := range expected {
+		t.Errorf("%s: missed in archive", name)
+	}
+}
@@ -0,0 +1,117 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Legacy scanner service announcement
+ *
+ * Some legacy SANE network clients and scanner discovery tools don't
+ * know about _uscan._tcp and look for the _scanner._tcp service type
+ * instead. If enabled, eSCL scanner is additionally announced under
+ * this type, pointing to the same HTTP port, with TXT record that
+ * combines legacy keys with keys, sane-airscan expects from the eSCL
+ * announcement
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// SaneService returns the _scanner._tcp DNS-SD service for the
+// eSCL scanner, that listens on the specified port
+func SaneService(port int, src *DNSSdTxtSource) DNSSdSvcInfo {
+	svc := DNSSdSvcInfo{
+		Type: "_scanner._tcp",
+		Port: port,
+	}
+
+	svc.Txt = DNSSdTxtGenerate(svc.Type, src)
+
+	return svc
+}
+
+// init registers TXT generator for the legacy scanner service
+func init() {
+	DNSSdTxtGeneratorRegister("_scanner._tcp", saneTxtGenerate)
+}
+
+// saneTxtGenerate generates TXT record items for the legacy
+// scanner service
+//
+// eSCL capabilities are mapped as follows:
+//
+//	txtvers        - always 1
+//	ty             - eSCL MakeAndModel or USB product name
+//	mfg, mdl       - USB manufacturer and product name
+//	note           - eSCL location
+//	UUID           - eSCL UUID or derived from USB serial number
+//	adminurl       - eSCL AdminURI
+//	representation - eSCL IconURI
+//	flatbed        - T, if platen present
+//	feeder         - T, if ADF present
+//	duplex         - T, if ADF duplex supported
+//	button         - always F (scan buttons not supported)
+//	rs             - always "eSCL" (eSCL resource path)
+//	vers           - eSCL Version
+//	cs, is, pdl    - the same as in _uscan._tcp
+func saneTxtGenerate(txt *DNSSdTxtRecord, src *DNSSdTxtSource) {
+	decoder := src.Escl
+	usbinfo := src.UsbInfo
+
+	txt.Add("txtvers", "1")
+
+	if decoder.makeAndModel != "" {
+		txt.Add("ty", decoder.makeAndModel)
+	} else {
+		txt.Add("ty", usbinfo.ProductName)
+	}
+
+	txt.IfNotEmpty("mfg", usbinfo.Manufacturer)
+	txt.IfNotEmpty("mdl", usbinfo.ProductName)
+	txt.Add("note", decoder.location)
+	txt.IfNotEmpty("UUID", decoder.uuid)
+	txt.URLIfNotEmpty("adminurl", decoder.adminurl)
+	txt.URLIfNotEmpty("representation", decoder.representation)
+
+	txt.Add("flatbed", saneTxtBool(decoder.platen))
+	txt.Add("feeder", saneTxtBool(decoder.adf))
+	txt.Add("duplex", saneTxtBool(decoder.duplex))
+	txt.Add("button", "F")
+
+	txt.Add("rs", "eSCL")
+	txt.IfNotEmpty("vers", decoder.version)
+
+	list := []string{}
+	for c := range decoder.cs {
+		list = append(list, c)
+	}
+	sort.Strings(list)
+	txt.IfNotEmpty("cs", strings.Join(list, ","))
+
+	switch {
+	case decoder.platen && !decoder.adf:
+		txt.Add("is", "platen")
+	case !decoder.platen && decoder.adf:
+		txt.Add("is", "adf")
+	case decoder.platen && decoder.adf:
+		txt.Add("is", "platen,adf")
+	}
+
+	list = []string{}
+	for p := range decoder.pdl {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	txt.AddPDL("pdl", strings.Join(list, ","))
+}
+
+// saneTxtBool formats boolean value for the TXT record
+func saneTxtBool(v bool) string {
+	if v {
+		return "T"
+	}
+	return "F"
+}
@@ -0,0 +1,61 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for legacy scanner service announcement
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSaneService tests the _scanner._tcp service
+func TestSaneService(t *testing.T) {
+	decoder := newEsclCapsDecoder(&IppPrinterInfo{Location: "Office"})
+	err := decoder.decode(strings.NewReader(esclTestCaps))
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	svc := SaneService(60000, &DNSSdTxtSource{
+		UsbInfo: UsbDeviceInfo{
+			Manufacturer: "HP",
+			ProductName:  "LaserJet MFP M28w",
+		},
+		Escl: decoder,
+	})
+
+	if svc.Type != "_scanner._tcp" || svc.Port != 60000 {
+		t.Errorf("unexpected service: %s port %d", svc.Type, svc.Port)
+	}
+
+	expected := DNSSdTxtRecord{
+		{"txtvers", "1", false},
+		{"ty", "HP LaserJet MFP M28w", false},
+		{"mfg", "HP", false},
+		{"mdl", "LaserJet MFP M28w", false},
+		{"note", "Office", false},
+		{"UUID", "564e4333-4230-3838-3737-7c2a25b6a0c1", false},
+		{"adminurl", "http://localhost/#hId-pgScan", true},
+		{"flatbed", "T", false},
+		{"feeder", "T", false},
+		{"duplex", "T", false},
+		{"button", "F", false},
+		{"rs", "eSCL", false},
+		{"vers", "2.63", false},
+		{"cs", "binary,color,grayscale", false},
+		{"is", "platen,adf", false},
+		{"pdl", "application/pdf,image/jpeg,image/png", false},
+	}
+
+	if !reflect.DeepEqual(svc.Txt, expected) {
+		t.Errorf("TXT mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, svc.Txt)
+	}
+}
@@ -0,0 +1,196 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * systemd service notifications (sd_notify protocol)
+ *
+ * When running under systemd with Type=notify, ipp-usb reports its
+ * readiness, sends watchdog keep-alive pings and updates the unit
+ * status string with the list of served devices. If NOTIFY_SOCKET
+ * is not set, all notifications are silently ignored
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// sdNotifyStatus contains the last sent STATUS= string
+	sdNotifyStatus string
+
+	// sdNotifyLock protects sdNotifyStatus
+	sdNotifyLock sync.Mutex
+
+	// sdWatchdogStop, when closed, stops the watchdog goroutine
+	sdWatchdogStop chan struct{}
+
+	// sdWatchdogDone is closed when watchdog goroutine exits
+	sdWatchdogDone chan struct{}
+)
+
+// SdNotify sends state notification to systemd. State is a
+// newline-separated list of VARIABLE=VALUE assignments, as
+// defined by sd_notify(3)
+//
+// It does nothing, if not running under systemd
+func SdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	addr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SdNotifyReady notifies systemd that ipp-usb is ready
+func SdNotifyReady() {
+	sdNotifyLog(SdNotify("READY=1"))
+}
+
+// SdNotifyStopping notifies systemd that ipp-usb is stopping
+func SdNotifyStopping() {
+	sdNotifyLog(SdNotify("STOPPING=1"))
+}
+
+// SdNotifyWatchdog sends watchdog keep-alive ping to systemd
+func SdNotifyWatchdog() {
+	sdNotifyLog(SdNotify("WATCHDOG=1"))
+}
+
+// SdWatchdogStart starts the goroutine, that sends watchdog
+// keep-alive pings to systemd, as long as alive returns true
+//
+// Pings are sent from the dedicated goroutine, not from the
+// main loop, because the main loop may legitimately be blocked
+// for a long time (i.e., by device initialization). Instead,
+// the alive callback tells if the main loop makes progress.
+//
+// It does nothing, if watchdog is not enabled
+func SdWatchdogStart(alive func() bool) {
+	interval := SdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	sdWatchdogStop = make(chan struct{})
+	sdWatchdogDone = make(chan struct{})
+
+	go sdWatchdogGoroutine(interval/2, alive)
+}
+
+// SdWatchdogStop stops the watchdog goroutine, if running
+func SdWatchdogStop() {
+	if sdWatchdogStop != nil {
+		close(sdWatchdogStop)
+		<-sdWatchdogDone
+		sdWatchdogStop = nil
+	}
+}
+
+// sdWatchdogGoroutine sends watchdog keep-alive pings
+func sdWatchdogGoroutine(interval time.Duration, alive func() bool) {
+	// Catch panics to log
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	defer close(sdWatchdogDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	suspended := false
+	for {
+		select {
+		case <-sdWatchdogStop:
+			return
+		case <-ticker.C:
+		}
+
+		switch {
+		case alive():
+			SdNotifyWatchdog()
+			suspended = false
+		case !suspended:
+			Log.Error('!', "SD-NOTIFY: main loop is not responding, "+
+				"watchdog pings suspended")
+			suspended = true
+		}
+	}
+}
+
+// SdNotifyStatus updates the unit status string. Notification
+// is only sent, if status has changed
+func SdNotifyStatus(status string) {
+	sdNotifyLock.Lock()
+	changed := status != sdNotifyStatus
+	sdNotifyStatus = status
+	sdNotifyLock.Unlock()
+
+	if changed {
+		sdNotifyLog(SdNotify("STATUS=" + status))
+	}
+}
+
+// SdNotifyStatusFormat formats the unit status string from
+// the list of served device models
+func SdNotifyStatusFormat(models []string) string {
+	switch len(models) {
+	case 0:
+		return "No IPP-over-USB devices"
+	case 1:
+		return "Serving 1 device: " + models[0]
+	}
+
+	return fmt.Sprintf("Serving %d devices: %s", len(models),
+		strings.Join(models, ", "))
+}
+
+// SdWatchdogInterval returns the systemd watchdog interval or 0,
+// if watchdog is not enabled for ipp-usb
+//
+// Keep-alive pings need to be sent more often than that; the
+// half of interval is recommended by sd_watchdog_enabled(3)
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil || usec == 0 {
+		return 0
+	}
+
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotifyLog logs the notification error, if any
+func sdNotifyLog(err error) {
+	if err != nil {
+		Log.Debug('!', "SD-NOTIFY: %s", err)
+	}
+}
@@ -0,0 +1,175 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for systemd service notifications
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSdNotify tests sending notifications to systemd
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", path)
+
+	err = SdNotify("READY=1")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if s := string(buf[:n]); s != "READY=1" {
+		t.Errorf("expected %q, received %q", "READY=1", s)
+	}
+
+	// Without NOTIFY_SOCKET, notifications are ignored
+	os.Setenv("NOTIFY_SOCKET", "")
+	err = SdNotify("READY=1")
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+// TestSdWatchdog tests sending of watchdog keep-alive pings
+func TestSdWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	defer os.Setenv("WATCHDOG_USEC", os.Getenv("WATCHDOG_USEC"))
+	defer os.Setenv("WATCHDOG_PID", os.Getenv("WATCHDOG_PID"))
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "100000")
+	os.Setenv("WATCHDOG_PID", "")
+
+	var alive int32 = 1
+	SdWatchdogStart(func() bool { return atomic.LoadInt32(&alive) != 0 })
+	defer SdWatchdogStop()
+
+	// Pings are sent, while alive
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if s := string(buf[:n]); s != "WATCHDOG=1" {
+		t.Errorf("expected %q, received %q", "WATCHDOG=1", s)
+	}
+
+	// And suspended, when not. Drain pings, sent before
+	atomic.StoreInt32(&alive, 0)
+	time.Sleep(100 * time.Millisecond)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err = conn.Read(buf); err == nil {
+		t.Errorf("unexpected notification: %q", buf[:n])
+	}
+}
+
+// TestSdWatchdogInterval tests SdWatchdogInterval
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Setenv("WATCHDOG_USEC", os.Getenv("WATCHDOG_USEC"))
+	defer os.Setenv("WATCHDOG_PID", os.Getenv("WATCHDOG_PID"))
+
+	type testData struct {
+		usec, pid string        // Environment
+		interval  time.Duration // Expected interval
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	other := strconv.Itoa(os.Getpid() + 1)
+
+	tests := []testData{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", self, 30 * time.Second},
+		{"30000000", other, 0},
+		{"0", self, 0},
+		{"garbage", self, 0},
+	}
+
+	for _, test := range tests {
+		os.Setenv("WATCHDOG_USEC", test.usec)
+		os.Setenv("WATCHDOG_PID", test.pid)
+
+		interval := SdWatchdogInterval()
+		if interval != test.interval {
+			t.Errorf("USEC=%q PID=%q: expected %s, present %s",
+				test.usec, test.pid, test.interval, interval)
+		}
+	}
+}
+
+// TestSdNotifyStatusFormat tests SdNotifyStatusFormat
+func TestSdNotifyStatusFormat(t *testing.T) {
+	type testData struct {
+		models   []string // Served devices
+		expected string   // Expected status
+	}
+
+	tests := []testData{
+		{nil, "No IPP-over-USB devices"},
+		{[]string{"HP LaserJet"}, "Serving 1 device: HP LaserJet"},
+		{[]string{"HP LaserJet", "Canon MF"},
+			"Serving 2 devices: HP LaserJet, Canon MF"},
+	}
+
+	for _, test := range tests {
+		status := SdNotifyStatusFormat(test.models)
+		if status != test.expected {
+			t.Errorf("%v: expected %q, present %q",
+				test.models, test.expected, status)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Listening sockets handover via the systemd file descriptor store
+ *
+ * Listening TCP sockets are stored in the systemd file descriptor
+ * store (see FileDescriptorStoreMax= in systemd.service(5)). When
+ * ipp-usb is restarted (i.e., on package upgrade), systemd keeps
+ * these sockets open and passes them to the new instance, using
+ * the socket activation protocol (LISTEN_FDS=, see sd_listen_fds(3)).
+ *
+ * So sockets are never closed during restart: clients, connecting
+ * in the middle, are queued by kernel instead of being refused, and
+ * device keeps its TCP port
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// sdListenFdsStart is the first file descriptor, passed by systemd
+const sdListenFdsStart = 3
+
+var (
+	// sdListenFds contains inherited listening sockets, not
+	// claimed yet, indexed by name
+	sdListenFds = make(map[string]*os.File)
+
+	// sdFdStoreFrozen, if set, prevents removal of sockets from
+	// the file descriptor store, so they survive the restart
+	sdFdStoreFrozen bool
+
+	// sdSocketLock protects the variables above
+	sdSocketLock sync.Mutex
+)
+
+// SdListenFdsInit obtains sockets, passed by systemd to ipp-usb
+// on startup. It must be called once, at program initialization
+func SdListenFdsInit() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+
+	cnt, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || cnt <= 0 {
+		return
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	sdSocketLock.Lock()
+	defer sdSocketLock.Unlock()
+
+	for i := 0; i < cnt; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		if name == "" {
+			file.Close()
+			continue
+		}
+
+		Log.Debug(' ', "SD-SOCKET: inherited %q", name)
+		sdListenFds[name] = file
+	}
+}
+
+// SdInheritedListener returns inherited listener with the specified
+// name, or nil if there is no such listener
+func SdInheritedListener(name string) net.Listener {
+	sdSocketLock.Lock()
+	file := sdListenFds[name]
+	delete(sdListenFds, name)
+	sdSocketLock.Unlock()
+
+	if file == nil {
+		return nil
+	}
+
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		Log.Error('!', "SD-SOCKET: %q: %s", name, err)
+		return nil
+	}
+
+	return listener
+}
+
+// SdListenFdsRelease closes inherited sockets, not claimed yet,
+// and removes them from the systemd file descriptor store
+func SdListenFdsRelease() {
+	sdSocketLock.Lock()
+	files := sdListenFds
+	sdListenFds = make(map[string]*os.File)
+	sdSocketLock.Unlock()
+
+	for name, file := range files {
+		Log.Debug(' ', "SD-SOCKET: %q not claimed, released", name)
+		file.Close()
+		SdFdStoreRemove(name)
+	}
+}
+
+// SdFdStore saves listener into the systemd file descriptor store
+// under the specified name
+//
+// It does nothing, if not running under systemd
+func SdFdStore(name string, listener net.Listener) {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	file, err := tcp.File()
+	if err != nil {
+		sdNotifyLog(err)
+		return
+	}
+
+	defer file.Close()
+
+	err = sdNotifyWithFd("FDSTORE=1\nFDNAME="+name, int(file.Fd()))
+	sdNotifyLog(err)
+}
+
+// SdFdStoreRemove removes socket with the specified name from
+// the systemd file descriptor store, unless store is frozen
+// by SdFdStoreFreeze
+func SdFdStoreRemove(name string) {
+	sdSocketLock.Lock()
+	frozen := sdFdStoreFrozen
+	sdSocketLock.Unlock()
+
+	if !frozen {
+		sdNotifyLog(SdNotify("FDSTOREREMOVE=1\nFDNAME=" + name))
+	}
+}
+
+// SdFdStoreFreeze freezes the systemd file descriptor store, so
+// stored sockets survive the ipp-usb restart. It is called, when
+// ipp-usb is going to exit
+func SdFdStoreFreeze() {
+	sdSocketLock.Lock()
+	sdFdStoreFrozen = true
+	sdSocketLock.Unlock()
+}
+
+// SdListenerName returns name of the listening socket for
+// the TCP port
+func SdListenerName(port int) string {
+	return fmt.Sprintf("port-%d", port)
+}
+
+// SdListenerAddrName returns name of the listening socket for
+// the TCP port, bound to the particular IP address
+func SdListenerAddrName(ip net.IP, port int) string {
+	return fmt.Sprintf("addr-%s-%d", ip, port)
+}
+
+// sdNotifyWithFd sends state notification to systemd, passing
+// file descriptor with it
+//
+// Note, net.UnixConn refuses to send ancillary data over the
+// connected datagram socket, so raw socket is used here
+func sdNotifyWithFd(state string, fd int) error {
+	sock, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(sock)
+	syscall.CloseOnExec(sock)
+
+	addr := &syscall.SockaddrUnix{Name: os.Getenv("NOTIFY_SOCKET")}
+	return syscall.Sendmsg(sock, []byte(state),
+		syscall.UnixRights(fd), addr, 0)
+}
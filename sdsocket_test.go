@@ -0,0 +1,172 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for listening sockets handover
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestSdFdStore tests storing of the listening socket into the
+// systemd file descriptor store and its inheritance
+func TestSdFdStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-sdsocket")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Fake systemd notification socket
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "notify"),
+		Net: "unixgram"}
+	notify, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer notify.Close()
+
+	saved := os.Getenv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", addr.Name)
+	defer os.Setenv("NOTIFY_SOCKET", saved)
+
+	// Store the listener
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer listener.Close()
+
+	SdFdStore("port-test", listener)
+
+	buf := make([]byte, 256)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := notify.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := "FDSTORE=1\nFDNAME=port-test"
+	if string(buf[:n]) != expected {
+		t.Errorf("expected %q, present %q", expected, buf[:n])
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("SCM_RIGHTS not received: %v", err)
+	}
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("SCM_RIGHTS not received: %v", err)
+	}
+
+	// Pretend, the received socket is inherited, and
+	// make sure it accepts connections
+	sdSocketLock.Lock()
+	sdListenFds["port-test"] = os.NewFile(uintptr(fds[0]), "port-test")
+	sdSocketLock.Unlock()
+
+	inherited := SdInheritedListener("port-test")
+	if inherited == nil {
+		t.Fatalf("inherited listener not found")
+	}
+
+	defer inherited.Close()
+
+	if SdInheritedListener("port-test") != nil {
+		t.Errorf("inherited listener claimed twice")
+	}
+
+	listener.Close()
+
+	conn, err := net.Dial("tcp4", inherited.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer conn.Close()
+
+	accepted, err := inherited.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	accepted.Close()
+}
+
+// TestSdListenFdsRelease tests release of inherited sockets,
+// not claimed by devices
+func TestSdListenFdsRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-sdsocket")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Fake systemd notification socket
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "notify"),
+		Net: "unixgram"}
+	notify, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer notify.Close()
+
+	saved := os.Getenv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", addr.Name)
+	defer os.Setenv("NOTIFY_SOCKET", saved)
+
+	// Pretend, the socket is inherited
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	sdSocketLock.Lock()
+	sdListenFds["port-gone"] = file
+	sdSocketLock.Unlock()
+
+	// Release it
+	SdListenFdsRelease()
+
+	buf := make([]byte, 256)
+	n, err := notify.Read(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := "FDSTOREREMOVE=1\nFDNAME=port-gone"
+	if string(buf[:n]) != expected {
+		t.Errorf("expected %q, present %q", expected, buf[:n])
+	}
+
+	if file.Close() == nil {
+		t.Errorf("inherited socket not closed")
+	}
+
+	if SdInheritedListener("port-gone") != nil {
+		t.Errorf("released socket still can be claimed")
+	}
+}
@@ -0,0 +1,292 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Soak test for hardware validation
+ *
+ * Soak test opens the specified device, as probe does, and stresses
+ * it for the specified time with concurrent requests: repeated IPP
+ * Get-Printer-Attributes, large dummy documents sent with IPP
+ * Validate-Job and parallel eSCL ScannerCapabilities reads. Error
+ * rates and latencies of each kind of request are reported at the
+ * end. It is useful for validating quirks on a real hardware
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// soakStats contains statistics of the single kind of soak
+// test requests
+type soakStats struct {
+	name    string     // Name of requests, for report
+	lock    sync.Mutex // Access lock
+	latency Histogram  // Latencies of successful requests, microseconds
+	errors  uint64     // Count of failed requests
+	lastErr error      // The last error
+}
+
+// soakRequest performs a single soak test request
+type soakRequest func(client *http.Client) error
+
+// Soak runs the soak test against the device, specified by its
+// USB address, written as "BUS:DEV", for the specified duration.
+// Dummy documents of docSize bytes are sent with Validate-Job
+//
+// Test may be interrupted by SIGINT or SIGTERM; the report is
+// printed anyway
+func Soak(name string, duration time.Duration, docSize int64) error {
+	desc, transport, err := probeOpen(name)
+	if err != nil {
+		return err
+	}
+
+	defer transport.Close(false)
+
+	info := transport.UsbDeviceInfo()
+	quirks := transport.Quirks()
+	client := &http.Client{Transport: transport}
+	port := Conf.HTTPMinPort
+
+	// Run init script, if any, as daemon does
+	err = probeInitScript(transport, client)
+	if err != nil {
+		return err
+	}
+
+	// Choose requests to run, depending on device capabilities
+	uriIpp := fmt.Sprintf("http://localhost:%d/ipp/print", port)
+	uriEscl := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities",
+		port)
+
+	stats := []*soakStats{}
+	requests := []soakRequest{}
+
+	if info.BasicCaps&UsbIppBasicCapsPrint != 0 {
+		stats = append(stats,
+			&soakStats{name: "IPP Get-Printer-Attributes"},
+			&soakStats{name: "IPP Validate-Job"})
+
+		requests = append(requests,
+			func(c *http.Client) error {
+				log := transport.Log().Begin()
+				defer log.Commit()
+				_, _, err := ippGetPrinterAttributes(log, c,
+					quirks, uriIpp)
+				return err
+			},
+			func(c *http.Client) error {
+				return soakValidateJob(c, uriIpp, docSize)
+			})
+	}
+
+	if info.BasicCaps&UsbIppBasicCapsScan != 0 {
+		for i := 0; i < SoakEsclReaders; i++ {
+			stats = append(stats, &soakStats{
+				name: fmt.Sprintf("eSCL ScannerCapabilities #%d", i+1),
+			})
+
+			requests = append(requests,
+				func(c *http.Client) error {
+					return soakGet(c, uriEscl)
+				})
+		}
+	}
+
+	if len(requests) == 0 {
+		return errors.New("device can neither print nor scan")
+	}
+
+	// Run requests
+	InitLog.Info(0, "%s: soak test for %s started", desc.UsbAddr, duration)
+
+	resets := atomic.LoadUint64(&transport.Stats().Resets)
+
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan,
+		os.Signal(syscall.SIGINT),
+		os.Signal(syscall.SIGTERM))
+	defer signal.Stop(sigChan)
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	var done sync.WaitGroup
+	for i := range requests {
+		done.Add(1)
+		go func(rq soakRequest, st *soakStats) {
+			defer done.Done()
+			soakWorker(client, rq, st, stop)
+		}(requests[i], stats[i])
+	}
+
+	select {
+	case <-timer.C:
+	case <-sigChan:
+		InitLog.Info(0, "soak test interrupted")
+	}
+
+	close(stop)
+	done.Wait()
+
+	resets = atomic.LoadUint64(&transport.Stats().Resets) - resets
+
+	// Print report
+	report := []string{
+		"Soak test results:",
+		fmt.Sprintf("  Device:  %s %s", desc.UsbAddr, info.ProductName),
+		fmt.Sprintf("  Resets:  %d", resets),
+	}
+
+	for _, st := range stats {
+		report = append(report, st.format()...)
+	}
+
+	report = append(report, "USB transfers:")
+	for _, line := range transport.XferStats() {
+		report = append(report, "  "+line)
+	}
+
+	for _, line := range report {
+		InitLog.Info(0, "%s", line)
+	}
+
+	return nil
+}
+
+// soakWorker repeats request until stop channel is closed,
+// collecting statistics
+func soakWorker(client *http.Client, rq soakRequest, st *soakStats,
+	stop chan struct{}) {
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		start := time.Now()
+		err := rq(client)
+		latency := time.Since(start)
+
+		st.lock.Lock()
+		if err == nil {
+			st.latency.Add(uint64(latency / time.Microsecond))
+		} else {
+			st.errors++
+			st.lastErr = err
+		}
+		st.lock.Unlock()
+	}
+}
+
+// format formats soakStats for report
+func (st *soakStats) format() []string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	total := st.latency.Count() + st.errors
+	rate := 0.0
+	if total != 0 {
+		rate = 100 * float64(st.errors) / float64(total)
+	}
+
+	lines := []string{
+		st.name + ":",
+		fmt.Sprintf("  Requests: %d", total),
+		fmt.Sprintf("  Errors:   %d (%.2f%%)", st.errors, rate),
+		fmt.Sprintf("  Latency:  %s",
+			st.latency.Format(histogramFmtMicroseconds)),
+	}
+
+	if st.lastErr != nil {
+		lines = append(lines,
+			fmt.Sprintf("  Last error: %s", st.lastErr))
+	}
+
+	return lines
+}
+
+// soakValidateJob sends IPP Validate-Job request with the dummy
+// document of docSize bytes attached
+func soakValidateJob(c *http.Client, uri string, docSize int64) error {
+	msg := goipp.NewRequest(goipp.DefaultVersion, goipp.OpValidateJob, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+	msg.Operation.Add(goipp.MakeAttribute("requesting-user-name",
+		goipp.TagName, goipp.String("ipp-usb")))
+	msg.Operation.Add(goipp.MakeAttribute("document-format",
+		goipp.TagMimeType, goipp.String("application/octet-stream")))
+
+	rq, _ := msg.EncodeBytes()
+	rq = append(rq, make([]byte, docSize)...)
+
+	resp, err := c.Post(uri, goipp.ContentType, bytes.NewReader(rq))
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case err != nil:
+		return err
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	// Client errors are expected, as document is not valid,
+	// but server errors are not
+	err = msg.DecodeBytes(data)
+	if err != nil {
+		return fmt.Errorf("IPP decode: %s", err)
+	}
+
+	if status := goipp.Status(msg.Code); status >= 0x0500 {
+		return fmt.Errorf("IPP: %s", status)
+	}
+
+	return nil
+}
+
+// soakGet performs HTTP GET request and reads the response body
+func soakGet(c *http.Client, uri string) error {
+	resp, err := c.Get(uri)
+	if err != nil {
+		return err
+	}
+
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case err != nil:
+		return err
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for soak test
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestSoakValidateJob tests soakValidateJob
+func TestSoakValidateJob(t *testing.T) {
+	const docSize = 100000
+
+	var status goipp.Status
+	var received int
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var rq goipp.Message
+			body, _ := ioutil.ReadAll(r.Body)
+			rq.DecodeBytes(body)
+			received = len(body)
+
+			rsp := goipp.NewResponse(goipp.DefaultVersion,
+				status, rq.RequestID)
+			data, _ := rsp.EncodeBytes()
+			w.Header().Set("Content-Type", goipp.ContentType)
+			w.Write(data)
+		}))
+	defer srv.Close()
+
+	tests := []struct {
+		status goipp.Status
+		ok     bool
+	}{
+		{goipp.StatusOk, true},
+		{goipp.StatusErrorDocumentFormatNotSupported, true},
+		{goipp.StatusErrorInternal, false},
+		{goipp.StatusErrorServiceUnavailable, false},
+	}
+
+	for _, test := range tests {
+		status = test.status
+		err := soakValidateJob(srv.Client(), srv.URL, docSize)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result: %v", test.status, err)
+		}
+
+		if received <= docSize {
+			t.Errorf("%s: document not sent (%d bytes received)",
+				test.status, received)
+		}
+	}
+}
+
+// TestSoakStatsFormat tests soakStats.format
+func TestSoakStatsFormat(t *testing.T) {
+	st := &soakStats{name: "test"}
+
+	st.latency.Add(1000)
+	st.latency.Add(2000)
+	st.latency.Add(3000)
+	st.errors = 1
+	st.lastErr = errors.New("broken")
+
+	report := strings.Join(st.format(), "\n")
+	for _, s := range []string{"Requests: 4", "(25.00%)", "broken"} {
+		if !strings.Contains(report, s) {
+			t.Errorf("%q missed in report:\n%s", s, report)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Persistent per-device statistics
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DevStats represents a cumulative per-device statistics,
+// persisted across device reconnects and ipp-usb restarts
+//
+// Counters are updated atomically, so DevStats can be updated
+// from multiple goroutines without locking
+type DevStats struct {
+	// Note, 64-bit atomic counters must go first, for
+	// proper alignment on 32-bit platforms
+	Jobs      uint64 // Count of print and scan jobs
+	BytesSent uint64 // Total bytes sent to device
+	BytesRecv uint64 // Total bytes received from device
+	Resets    uint64 // Count of device resets
+	lastSeen  int64  // Last seen time, Unix seconds
+
+	ident   string     // Device identification
+	comment string     // Comment in the stats file
+	path    string     // Path to the disk file, "" if not persisted
+	lock    sync.Mutex // Serializes Save
+}
+
+// LoadDevStats loads DevStats from a disk file
+//
+// This function always succeeds, even in a case of file i/o errors.
+// In a worst case we start counting from zero.
+func LoadDevStats(ident, comment string) *DevStats {
+	stats := &DevStats{
+		ident:   ident,
+		comment: comment,
+		path:    filepath.Join(PathStatsDir, ident+".stats"),
+	}
+
+	ini, err := OpenIniFile(stats.path)
+	if err == nil {
+		err = stats.load(ini)
+		ini.Close()
+	}
+
+	if err != nil && err != io.EOF && !os.IsNotExist(err) {
+		Log.Error('!', "STATS LOAD: %s: %s", ident, err)
+	}
+
+	// In read-only mode, statistics is not saved
+	if Conf.StateReadOnly {
+		stats.path = ""
+	}
+
+	stats.Touch()
+
+	return stats
+}
+
+// load performs an actual work of loading the DevStats file
+func (stats *DevStats) load(ini *IniFile) error {
+	for {
+		rec, err := ini.Next()
+		if err != nil {
+			return err
+		}
+
+		if rec.Section != "stats" {
+			continue
+		}
+
+		var out *uint64
+		switch rec.Key {
+		case "jobs":
+			out = &stats.Jobs
+		case "bytes-sent":
+			out = &stats.BytesSent
+		case "bytes-recv":
+			out = &stats.BytesRecv
+		case "resets":
+			out = &stats.Resets
+		case "last-seen":
+			t, err := time.Parse(time.RFC3339, rec.Value)
+			if err != nil {
+				return rec.errBadValue("%q: invalid time", rec.Value)
+			}
+			stats.lastSeen = t.Unix()
+			continue
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseUint(rec.Value, 10, 64)
+		if err != nil {
+			return rec.errBadValue("%q: invalid number", rec.Value)
+		}
+
+		*out = v
+	}
+}
+
+// AddJob increments jobs counter
+func (stats *DevStats) AddJob() {
+	atomic.AddUint64(&stats.Jobs, 1)
+}
+
+// AddSent adds count of bytes sent to device
+func (stats *DevStats) AddSent(n int) {
+	atomic.AddUint64(&stats.BytesSent, uint64(n))
+}
+
+// AddRecv adds count of bytes received from device
+func (stats *DevStats) AddRecv(n int) {
+	atomic.AddUint64(&stats.BytesRecv, uint64(n))
+}
+
+// AddReset increments resets counter
+func (stats *DevStats) AddReset() {
+	atomic.AddUint64(&stats.Resets, 1)
+}
+
+// Touch updates device's last seen time
+func (stats *DevStats) Touch() {
+	atomic.StoreInt64(&stats.lastSeen, time.Now().Unix())
+}
+
+// LastSeen returns device's last seen time
+func (stats *DevStats) LastSeen() time.Time {
+	return time.Unix(atomic.LoadInt64(&stats.lastSeen), 0)
+}
+
+// String returns DevStats summary, for the status output
+func (stats *DevStats) String() string {
+	return fmt.Sprintf("jobs %d, sent %d, received %d, resets %d, last seen %s",
+		atomic.LoadUint64(&stats.Jobs),
+		atomic.LoadUint64(&stats.BytesSent),
+		atomic.LoadUint64(&stats.BytesRecv),
+		atomic.LoadUint64(&stats.Resets),
+		stats.LastSeen().Format(time.RFC3339))
+}
+
+// Save updates DevStats on disk
+//
+// The file is updated atomically: new content is written into the
+// temporary file, which then replaces the old one
+func (stats *DevStats) Save() {
+	if stats.path == "" {
+		return
+	}
+
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	var buf bytes.Buffer
+
+	if stats.comment != "" {
+		fmt.Fprintf(&buf, "; %s\n", stats.comment)
+	}
+
+	fmt.Fprintf(&buf, "[stats]\n")
+	fmt.Fprintf(&buf, "jobs       = %d\n", atomic.LoadUint64(&stats.Jobs))
+	fmt.Fprintf(&buf, "bytes-sent = %d\n", atomic.LoadUint64(&stats.BytesSent))
+	fmt.Fprintf(&buf, "bytes-recv = %d\n", atomic.LoadUint64(&stats.BytesRecv))
+	fmt.Fprintf(&buf, "resets     = %d\n", atomic.LoadUint64(&stats.Resets))
+	fmt.Fprintf(&buf, "last-seen  = %s\n",
+		stats.LastSeen().UTC().Format(time.RFC3339))
+
+	err := stats.save(buf.Bytes())
+	if err != nil {
+		Log.Error('!', "STATS SAVE: %s: %s", stats.ident, err)
+	}
+}
+
+// save performs an actual work of saving stats file
+func (stats *DevStats) save(data []byte) error {
+	err := os.MkdirAll(filepath.Dir(stats.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := stats.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, stats.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,63 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for persistent per-device statistics
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDevStatsSaveLoad tests DevStats save/load round trip
+func TestDevStatsSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.stats")
+	stats := &DevStats{ident: "test", comment: "Test device", path: path}
+
+	stats.AddJob()
+	stats.AddJob()
+	stats.AddSent(1000)
+	stats.AddRecv(2000)
+	stats.AddReset()
+	stats.lastSeen = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	stats.Save()
+
+	if _, err = os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("temporary file left behind")
+	}
+
+	ini, err := OpenIniFile(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	stats2 := &DevStats{}
+	err = stats2.load(ini)
+	ini.Close()
+
+	if err != io.EOF {
+		t.Fatalf("load: %s", err)
+	}
+
+	if stats2.String() != stats.String() {
+		t.Errorf("stats mismatch:\n"+
+			"expected: %s\n"+
+			"present:  %s",
+			stats, stats2)
+	}
+}
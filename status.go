@@ -16,14 +16,20 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 // statusOfDevice represents a status of the particular device
 type statusOfDevice struct {
-	desc     UsbDeviceDesc // Device descriptor
-	init     error         // Initialization error, nil if none
-	HTTPPort int           // Assigned http port for the device
+	desc     UsbDeviceDesc   // Device descriptor
+	init     error           // Initialization error, nil if none
+	HTTPPort int             // Assigned http port for the device
+	icc      string          // Matching ICC profile, "" if none
+	firmware string          // Firmware version, "" if unknown
+	scanner  string          // Scanner state, "" if unknown
+	stats    *DevStats       // Device statistics, nil if unknown
+	xfer     func() []string // USB transfers statistics, nil if unknown
 }
 
 var (
@@ -91,7 +97,7 @@ func StatusFormat() []byte {
 		buf.WriteString("\n")
 		fmt.Fprintf(buf, " Num  Device              Vndr:Prod  Port  Model\n")
 		for i, status := range devs {
-			info, _ := status.desc.GetUsbDeviceInfo()
+			info, infoErr := status.desc.GetUsbDeviceInfo()
 
 			s := "-"
 			if status.HTTPPort != 0 {
@@ -109,9 +115,54 @@ func StatusFormat() []byte {
 			}
 
 			fmt.Fprintf(buf, "      status: %s\n", s)
+
+			if infoErr == nil {
+				fmt.Fprintf(buf, "      ident: %s\n", info.Ident())
+				fmt.Fprintf(buf, "      usb-speed: %s\n", info.Speed)
+
+				wd := DevWatchdogs.Format(info.Ident())
+				if wd != "" {
+					fmt.Fprintf(buf, "      watchdog: %s\n", wd)
+				}
+			}
+
+			if status.firmware != "" {
+				fmt.Fprintf(buf, "      firmware: %s\n", status.firmware)
+			}
+
+			if status.scanner != "" {
+				fmt.Fprintf(buf, "      scanner: %s\n", status.scanner)
+			}
+
+			if status.icc != "" {
+				fmt.Fprintf(buf, "      icc-profile: %s\n", status.icc)
+			}
+
+			if status.stats != nil {
+				fmt.Fprintf(buf, "      stats: %s\n", status.stats)
+			}
+
+			if status.xfer != nil {
+				for _, line := range status.xfer() {
+					fmt.Fprintf(buf, "      xfer: %s\n", line)
+				}
+			}
+
+			for _, claim := range UsbClaimsCheck(status.desc) {
+				fmt.Fprintf(buf, "      competing: %s\n", claim)
+			}
 		}
 	}
 
+	// Format lifecycle events
+	buf.WriteString("ipp-usb events:")
+	if events := DevEvents.Format("  "); len(events) == 0 {
+		buf.WriteString(" none\n")
+	} else {
+		buf.WriteString("\n")
+		buf.Write(events)
+	}
+
 	return buf.Bytes()
 }
 
@@ -127,6 +178,123 @@ func StatusSet(addr UsbAddr, desc UsbDeviceDesc, HTTPPort int, init error) {
 	statusLock.Unlock()
 }
 
+// StatusSetICCProfile sets ICC profile, matching the already
+// known device
+func StatusSetICCProfile(addr UsbAddr, path string) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.icc = path
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetFirmware sets firmware version of the already
+// known device
+func StatusSetFirmware(addr UsbAddr, firmware string) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.firmware = firmware
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetScannerState sets scanner state of the already
+// known device
+func StatusSetScannerState(addr UsbAddr, state string) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.scanner = state
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetStats sets statistics of the already known device
+func StatusSetStats(addr UsbAddr, stats *DevStats) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.stats = stats
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetXferStats sets source of USB transfers statistics
+// of the already known device
+func StatusSetXferStats(addr UsbAddr, xfer func() []string) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.xfer = xfer
+	}
+	statusLock.Unlock()
+}
+
+// StatusFindDevice finds device in the status table by its ident
+// or by its USB address, written as "BUS:DEV" (i.e., "1:5" or "001:005")
+func StatusFindDevice(name string) (addr UsbAddr, ident string, ok bool) {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	bus, dev := -1, -1
+	if nums := strings.Split(name, ":"); len(nums) == 2 {
+		if n, err := strconv.Atoi(nums[0]); err == nil {
+			bus = n
+		}
+		if n, err := strconv.Atoi(nums[1]); err == nil {
+			dev = n
+		}
+	}
+
+	byAddr := bus >= 0 && dev >= 0
+
+	for addr, status := range statusTable {
+		info, err := status.desc.GetUsbDeviceInfo()
+		if err != nil {
+			continue
+		}
+
+		ident = info.Ident()
+		if ident == name ||
+			(byAddr && addr.Bus == bus && addr.Address == dev) {
+			return addr, ident, true
+		}
+	}
+
+	return UsbAddr{}, "", false
+}
+
+// StatusListFormat formats short list of devices, one device per line
+func StatusListFormat() []byte {
+	buf := &bytes.Buffer{}
+
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	devs := make([]*statusOfDevice, 0, len(statusTable))
+	for _, status := range statusTable {
+		devs = append(devs, status)
+	}
+
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].desc.UsbAddr.Less(devs[j].desc.UsbAddr)
+	})
+
+	for _, status := range devs {
+		ident := "-"
+		if info, err := status.desc.GetUsbDeviceInfo(); err == nil {
+			ident = info.Ident()
+		}
+
+		s := "OK"
+		if status.init != nil {
+			s = status.init.Error()
+		}
+
+		fmt.Fprintf(buf, "%d:%d %s %s\n", status.desc.Bus,
+			status.desc.Address, ident, s)
+	}
+
+	return buf.Bytes()
+}
+
 // StatusDel deletes device from the status table
 func StatusDel(addr UsbAddr) {
 	statusLock.Lock()
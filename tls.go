@@ -0,0 +1,202 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * TLS termination for the local HTTP proxy
+ *
+ * Some clients prefer or even require IPP over TLS (_ipps._tcp).
+ * When enabled, ipp-usb listens on the additional HTTPS port and
+ * advertises TLS variants of the IPP and eSCL services. Certificate
+ * is either provided by user, or self-signed certificate is generated
+ * per device and persisted across restarts
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tlsServices maps plain-text service types into their TLS variants
+var tlsServices = map[string]string{
+	"_ipp._tcp":   "_ipps._tcp",
+	"_uscan._tcp": "_uscans._tcp",
+}
+
+// TLSLoadCertificate returns TLS certificate for the device.
+//
+// If certificate and key files are configured, they are used for
+// all devices. Otherwise, self-signed per-device certificate is
+// loaded from the disk, and (re)generated, if it is missed, broken
+// or expired
+func TLSLoadCertificate(ident string) (*tls.Certificate, error) {
+	if Conf.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(Conf.TLSCertFile,
+			Conf.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+
+	certPath := filepath.Join(PathProgStateTLS, ident+".crt")
+	keyPath := filepath.Join(PathProgStateTLS, ident+".key")
+
+	// Try to load existent certificate
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && tlsCertValid(&cert, time.Now()) {
+		return &cert, nil
+	}
+
+	// Generate the new one
+	certPEM, keyPEM, err := tlsGenerateCertificate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// In read-only mode, certificate is kept in memory only
+	if Conf.StateReadOnly {
+		return &cert, nil
+	}
+
+	// Save it. Errors are not fatal here: in a worst case, the
+	// certificate will be regenerated next time
+	os.MkdirAll(PathProgStateTLS, 0700)
+	err = ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(certPath, certPEM, 0644)
+	}
+
+	if err != nil {
+		Log.Error('!', "TLS: %s", err)
+	}
+
+	return &cert, nil
+}
+
+// tlsCertValid tells if certificate is valid at the specified time
+func tlsCertValid(cert *tls.Certificate, now time.Time) bool {
+	if len(cert.Certificate) == 0 {
+		return false
+	}
+
+	x509cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+
+	return now.After(x509cert.NotBefore) && now.Before(x509cert.NotAfter)
+}
+
+// tlsGenerateCertificate generates self-signed certificate and
+// its private key, both PEM-encoded
+//
+// Certificate is issued for "localhost", loopback addresses and
+// the host name, as these are names clients use to connect to
+// the device
+func tlsGenerateCertificate(now time.Time) (certPEM, keyPEM []byte,
+	err error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ipp-usb"},
+			CommonName:   "localhost",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TLSCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if host, err := os.Hostname(); err == nil && host != "" {
+		host = strings.TrimSuffix(host, ".local")
+		template.DNSNames = append(template.DNSNames,
+			host, host+".local")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return
+}
+
+// NewTLSListener wraps net.Listener, so accepted connections
+// use TLS with the specified certificate
+func NewTLSListener(listener net.Listener,
+	cert *tls.Certificate) net.Listener {
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return tls.NewListener(listener, config)
+}
+
+// TLSAdvertise adds TLS variants of services, that have them
+// (i.e., "_ipps._tcp" for "_ipp._tcp"), listening at the specified
+// port. TXT records are copied from the original services and the
+// TLS key is set to the supported TLS version
+func TLSAdvertise(services *DNSSdServices, port int) {
+	for _, svc := range services.Clone() {
+		tlsType, found := tlsServices[svc.Type]
+		if !found {
+			continue
+		}
+
+		for i, subtype := range svc.SubTypes {
+			svc.SubTypes[i] = strings.TrimSuffix(subtype, svc.Type) +
+				tlsType
+		}
+
+		svc.Type = tlsType
+		svc.Port = port
+		svc.Txt.Set("TLS", "1.2")
+
+		services.Add(svc)
+	}
+}
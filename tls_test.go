@@ -0,0 +1,99 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for TLS termination
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// TestTLSGenerateCertificate tests generation of self-signed certificates
+func TestTLSGenerateCertificate(t *testing.T) {
+	now := time.Now()
+
+	certPEM, keyPEM, err := tlsGenerateCertificate(now)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !tlsCertValid(&cert, now) {
+		t.Errorf("certificate not valid now")
+	}
+
+	if tlsCertValid(&cert, now.Add(TLSCertLifetime+time.Hour)) {
+		t.Errorf("certificate valid after expiration")
+	}
+}
+
+// TestTLSAdvertise tests generation of TLS variants of services
+func TestTLSAdvertise(t *testing.T) {
+	var services DNSSdServices
+
+	ipp := DNSSdSvcInfo{
+		Type:     "_ipp._tcp",
+		SubTypes: []string{"_universal._sub._ipp._tcp"},
+		Port:     60000,
+	}
+	ipp.Txt.Add("ty", "Test Printer")
+	ipp.Txt.Add("TLS", "")
+
+	escl := DNSSdSvcInfo{Type: "_uscan._tcp", Port: 60000}
+	escl.Txt.Add("ty", "Test Scanner")
+
+	services.Add(ipp)
+	services.Add(escl)
+	services.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: 60000})
+
+	TLSAdvertise(&services, 60001)
+
+	if len(services) != 5 {
+		t.Fatalf("expected 5 services, present %d", len(services))
+	}
+
+	ipps, uscans := services[3], services[4]
+
+	if ipps.Type != "_ipps._tcp" || ipps.Port != 60001 {
+		t.Errorf("bad ipps service: %s:%d", ipps.Type, ipps.Port)
+	}
+
+	if len(ipps.SubTypes) != 1 ||
+		ipps.SubTypes[0] != "_universal._sub._ipps._tcp" {
+		t.Errorf("bad ipps subtypes: %v", ipps.SubTypes)
+	}
+
+	if uscans.Type != "_uscans._tcp" || uscans.Port != 60001 {
+		t.Errorf("bad uscans service: %s:%d", uscans.Type, uscans.Port)
+	}
+
+	for _, svc := range []DNSSdSvcInfo{ipps, uscans} {
+		txt := make(map[string]string)
+		for _, item := range svc.Txt {
+			txt[item.Key] = item.Value
+		}
+
+		if txt["TLS"] != "1.2" {
+			t.Errorf("%s: TLS=%q", svc.Type, txt["TLS"])
+		}
+	}
+
+	// Original services must not be affected
+	if services[0].SubTypes[0] != "_universal._sub._ipp._tcp" {
+		t.Errorf("original subtypes modified: %v", services[0].SubTypes)
+	}
+
+	if services[0].Txt[1].Value != "" {
+		t.Errorf("original TXT modified: %v", services[0].Txt)
+	}
+}
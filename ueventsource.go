@@ -0,0 +1,108 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB hotplug events from multiple sources
+ *
+ * Primary source of hotplug events is libusb. On some platforms
+ * secondary source (i.e., kernel uevents via netlink on Linux or
+ * devd events on FreeBSD) may be enabled. Both sources feed the
+ * same UsbHotPlugChan, and duplicates are suppressed here
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// usbHotPlugEvent represents a single USB hotplug event
+type usbHotPlugEvent struct {
+	addr  UsbAddr // Device address
+	added bool    // Device added (true) or removed (false)
+}
+
+// usbHotPlugRecent contains recently reported hotplug events,
+// for deduplication. usbHotPlugAdded contains addresses of devices,
+// reported as added since the last UsbHotPlugAdded call
+var (
+	usbHotPlugRecent = make(map[usbHotPlugEvent]time.Time)
+	usbHotPlugAdded  UsbAddrList
+	usbHotPlugLock   sync.Mutex
+)
+
+// UsbHotPlugNotify reports USB hotplug event, received from the
+// specified source, to the PnP manager
+//
+// The same event, reported again (usually, by another source)
+// within the UsbHotPlugDedupTime, is ignored
+func UsbHotPlugNotify(source string, addr UsbAddr, added bool) {
+	if added {
+		usbHotPlugLock.Lock()
+		usbHotPlugAdded.Add(addr)
+		usbHotPlugLock.Unlock()
+	}
+
+	if !usbHotPlugDedup(usbHotPlugEvent{addr, added}, time.Now()) {
+		Log.Debug(' ', "HOTPLUG: %s: duplicate event for %s ignored",
+			source, addr)
+		return
+	}
+
+	if added {
+		Log.Debug('+', "HOTPLUG: %s: added %s", source, addr)
+	} else {
+		Log.Debug('-', "HOTPLUG: %s: removed %s", source, addr)
+	}
+
+	UsbHotPlugRescan()
+}
+
+// UsbHotPlugRescan requests PnP manager to rescan devices
+//
+// It is used when hotplug event can't be attributed to the
+// particular device (i.e., when source has lost some events)
+func UsbHotPlugRescan() {
+	select {
+	case UsbHotPlugChan <- struct{}{}:
+	default:
+	}
+}
+
+// UsbHotPlugAdded returns addresses of devices, reported as added
+// by hotplug events since the previous call
+func UsbHotPlugAdded() UsbAddrList {
+	usbHotPlugLock.Lock()
+	defer usbHotPlugLock.Unlock()
+
+	added := usbHotPlugAdded
+	usbHotPlugAdded = nil
+	return added
+}
+
+// usbHotPlugDedup records the hotplug event and tells, if it is
+// new (i.e., was not seen within the UsbHotPlugDedupTime)
+func usbHotPlugDedup(ev usbHotPlugEvent, now time.Time) bool {
+	usbHotPlugLock.Lock()
+	defer usbHotPlugLock.Unlock()
+
+	// Purge expired events
+	for old, t := range usbHotPlugRecent {
+		if now.Sub(t) >= UsbHotPlugDedupTime {
+			delete(usbHotPlugRecent, old)
+		}
+	}
+
+	// The opposite event (i.e., removal after addition) makes
+	// the recorded one obsolete
+	delete(usbHotPlugRecent, usbHotPlugEvent{ev.addr, !ev.added})
+
+	if _, found := usbHotPlugRecent[ev]; found {
+		return false
+	}
+
+	usbHotPlugRecent[ev] = now
+	return true
+}
@@ -0,0 +1,208 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Kernel uevents source of USB hotplug events -- FreeBSD version
+ *
+ * On FreeBSD, kernel device events are delivered to userspace by the
+ * devd(8) daemon, which rebroadcasts them to clients of its seqpacket
+ * socket. Each packet contains a single event, one line of text. USB
+ * device events look like this:
+ *
+ *   !system=USB subsystem=DEVICE type=ATTACH ugen=ugen0.2 cdev=ugen0.2
+ *   vendor=0x04f9 product=0x0423 ... bus=0
+ *
+ * (actually, as a single line). The ugenB.D device name gives bus
+ * number and device address, as reported by libusb
+ */
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// UeventSourceName is the name of the kernel uevents source,
+	// for logging
+	UeventSourceName = "devd"
+
+	// UeventSourceUdev tells, if kernel uevents source must be
+	// always started in the udev mode. On FreeBSD, libusb hotplug
+	// is not reliable enough to notice removal of the last device,
+	// so devd events are always used in this mode
+	UeventSourceUdev = true
+
+	// devdSocketPath is the path to the devd(8) seqpacket socket
+	devdSocketPath = "/var/run/devd.seqpacket.pipe"
+
+	// devdMaxSize specifies the maximum size of devd event message
+	devdMaxSize = 8192
+
+	// devdReconnectInterval specifies how often reconnect to devd
+	// is attempted, if connection is lost (i.e., devd restarted)
+	devdReconnectInterval = 5 * time.Second
+)
+
+// UeventSourceStart starts listening to the kernel uevents
+//
+// Events are received by the background goroutine and passed to
+// UsbHotPlugNotify. The listener runs until ipp-usb exits
+func UeventSourceStart() error {
+	fd, err := devdConnect()
+	if err != nil {
+		return err
+	}
+
+	go devdSourceLoop(fd)
+
+	return nil
+}
+
+// devdConnect connects to the devd socket
+func devdConnect() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_UNIX,
+		syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: devdSocketPath})
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// devdSourceLoop receives events from the devd socket
+//
+// If devd restarts, connection is lost, so it is re-established
+// and devices are rescanned, as some events may be lost meanwhile
+func devdSourceLoop(fd int) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	buf := make([]byte, devdMaxSize)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EINTR || err == syscall.EAGAIN:
+			continue
+
+		case err != nil || n == 0:
+			syscall.Close(fd)
+			if err == nil {
+				err = syscall.ECONNRESET
+			}
+
+			Log.Debug(' ', "HOTPLUG: devd: %s, reconnecting", err)
+			for {
+				time.Sleep(devdReconnectInterval)
+				fd, err = devdConnect()
+				if err == nil {
+					break
+				}
+			}
+
+			UsbHotPlugRescan()
+			continue
+		}
+
+		addr, added, ok := devdParse(buf[:n])
+		if ok {
+			UsbHotPlugNotify(UeventSourceName, addr, added)
+		}
+	}
+}
+
+// devdParse parses the devd event message
+//
+// If message is the attach or detach event of USB device, its
+// address is returned and ok is true. Otherwise, ok is false
+func devdParse(msg []byte) (addr UsbAddr, added, ok bool) {
+	msg = bytes.TrimRight(msg, "\n\x00")
+	if len(msg) == 0 || msg[0] != '!' {
+		return
+	}
+
+	var system, subsystem, typ, ugen string
+
+	for _, field := range bytes.Fields(msg[1:]) {
+		i := bytes.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+
+		key, val := string(field[:i]), string(field[i+1:])
+		switch key {
+		case "system":
+			system = val
+		case "subsystem":
+			subsystem = val
+		case "type":
+			typ = val
+		case "ugen":
+			ugen = val
+		case "cdev":
+			if ugen == "" {
+				ugen = val
+			}
+		}
+	}
+
+	if system != "USB" || subsystem != "DEVICE" {
+		return
+	}
+
+	switch typ {
+	case "ATTACH":
+		added = true
+	case "DETACH":
+		added = false
+	default:
+		return
+	}
+
+	addr, ok = devdParseUgen(ugen)
+	if !ok {
+		added = false
+	}
+
+	return
+}
+
+// devdParseUgen parses the ugenB.D device name
+func devdParseUgen(s string) (addr UsbAddr, ok bool) {
+	if !strings.HasPrefix(s, "ugen") {
+		return
+	}
+
+	s = s[4:]
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return
+	}
+
+	bus, err := strconv.ParseUint(s[:i], 10, 16)
+	if err != nil {
+		return
+	}
+
+	dev, err := strconv.ParseUint(s[i+1:], 10, 16)
+	if err != nil {
+		return
+	}
+
+	return UsbAddr{Bus: int(bus), Address: int(dev)}, true
+}
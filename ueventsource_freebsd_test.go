@@ -0,0 +1,53 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for kernel uevents source -- FreeBSD version
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestDevdParse tests devdParse
+func TestDevdParse(t *testing.T) {
+	type testData struct {
+		msg   string
+		addr  UsbAddr
+		added bool
+		ok    bool
+	}
+
+	mkmsg := func(subsystem, typ, ugen string) string {
+		return "!system=USB subsystem=" + subsystem +
+			" type=" + typ + " ugen=" + ugen + " cdev=" + ugen +
+			" vendor=0x04f9 product=0x0423 devclass=0x00" +
+			" devsubclass=0x00 sernum=\"E12345\" release=0x0100" +
+			" mode=host port=2 parent=ugen0.1\n"
+	}
+
+	tests := []testData{
+		{mkmsg("DEVICE", "ATTACH", "ugen0.2"), UsbAddr{0, 2}, true, true},
+		{mkmsg("DEVICE", "DETACH", "ugen1.12"), UsbAddr{1, 12}, false, true},
+		{mkmsg("INTERFACE", "ATTACH", "ugen0.2"), UsbAddr{}, false, false},
+		{mkmsg("DEVICE", "ATTACH", "umass0"), UsbAddr{}, false, false},
+		{"+ugen0.2 at bus=0 sernum=\"\" on uhub0\n", UsbAddr{}, false, false},
+		{"!system=DEVFS subsystem=CDEV type=CREATE cdev=ugen0.2\n",
+			UsbAddr{}, false, false},
+		{"", UsbAddr{}, false, false},
+	}
+
+	for _, test := range tests {
+		addr, added, ok := devdParse([]byte(test.msg))
+		if addr != test.addr || added != test.added || ok != test.ok {
+			t.Errorf("%q:\n"+
+				"expected: %s added=%v ok=%v\n"+
+				"present:  %s added=%v ok=%v",
+				test.msg, test.addr, test.added, test.ok,
+				addr, added, ok)
+		}
+	}
+}
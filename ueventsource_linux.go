@@ -0,0 +1,176 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Kernel uevents source of USB hotplug events -- Linux version
+ *
+ * Kernel broadcasts uevents via the NETLINK_KOBJECT_UEVENT socket.
+ * Each message consists of the "ACTION@DEVPATH" header, followed by
+ * NUL-terminated KEY=VALUE pairs. Only add and remove events of USB
+ * devices (not interfaces) are of interest
+ */
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// UeventSourceName is the name of the kernel uevents source,
+	// for logging
+	UeventSourceName = "netlink"
+
+	// UeventSourceUdev tells, if kernel uevents source must be
+	// always started in the udev mode. On Linux, udev mode relies
+	// on libusb hotplug, so secondary source is optional
+	UeventSourceUdev = false
+
+	// ueventNetlinkGroup is the netlink multicast group of
+	// kernel uevents (udev rebroadcasts processed uevents
+	// into group 2 with own message format; not used here)
+	ueventNetlinkGroup = 1
+
+	// ueventMaxSize specifies the maximum size of uevent message
+	ueventMaxSize = 8192
+
+	// ueventRcvBuf specifies receive buffer size of the netlink
+	// socket. Large buffer reduces chances to lose events on
+	// bursts, which are common when USB hub is connected
+	ueventRcvBuf = 1024 * 1024
+)
+
+// UeventSourceStart starts listening to the kernel uevents
+//
+// Events are received by the background goroutine and passed to
+// UsbHotPlugNotify. The listener runs until ipp-usb exits
+func UeventSourceStart() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF,
+		ueventRcvBuf)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: ueventNetlinkGroup,
+	})
+
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go ueventSourceLoop(fd)
+
+	return nil
+}
+
+// ueventSourceLoop receives uevents from the netlink socket
+func ueventSourceLoop(fd int) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, ueventMaxSize)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN:
+			continue
+		case syscall.ENOBUFS:
+			// Events were lost, so devices must be rescanned
+			Log.Debug(' ', "HOTPLUG: netlink: events lost, rescanning")
+			UsbHotPlugRescan()
+			continue
+		default:
+			Log.Error('!', "HOTPLUG: netlink: %s", err)
+			return
+		}
+
+		// Accept only messages from the kernel, so local
+		// users will not be able to spoof uevents
+		if nl, ok := from.(*syscall.SockaddrNetlink); !ok || nl.Pid != 0 {
+			continue
+		}
+
+		addr, added, ok := ueventParse(buf[:n])
+		if ok {
+			UsbHotPlugNotify(UeventSourceName, addr, added)
+		}
+	}
+}
+
+// ueventParse parses the kernel uevent message
+//
+// If message is the add or remove event of USB device, its address
+// is returned and ok is true. Otherwise, ok is false
+func ueventParse(msg []byte) (addr UsbAddr, added, ok bool) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || bytes.IndexByte(fields[0], '@') < 0 {
+		return
+	}
+
+	var action, subsystem, devtype string
+	bus, dev := -1, -1
+
+	for _, field := range fields[1:] {
+		i := bytes.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+
+		key, val := string(field[:i]), string(field[i+1:])
+		switch key {
+		case "ACTION":
+			action = val
+		case "SUBSYSTEM":
+			subsystem = val
+		case "DEVTYPE":
+			devtype = val
+		case "BUSNUM":
+			bus = ueventParseNum(val)
+		case "DEVNUM":
+			dev = ueventParseNum(val)
+		}
+	}
+
+	if subsystem != "usb" || devtype != "usb_device" || bus < 0 || dev < 0 {
+		return
+	}
+
+	switch action {
+	case "add":
+		added = true
+	case "remove":
+		added = false
+	default:
+		return
+	}
+
+	return UsbAddr{Bus: bus, Address: dev}, added, true
+}
+
+// ueventParseNum parses BUSNUM or DEVNUM value, written as
+// zero-padded decimal number (i.e., "001"). -1 is returned
+// on error
+func ueventParseNum(s string) int {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return -1
+	}
+	return int(n)
+}
@@ -0,0 +1,58 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for kernel uevents source -- Linux version
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUeventParse tests ueventParse
+func TestUeventParse(t *testing.T) {
+	type testData struct {
+		msg   string
+		addr  UsbAddr
+		added bool
+		ok    bool
+	}
+
+	mkmsg := func(action, devtype string) string {
+		fields := []string{
+			action + "@/devices/pci0000:00/0000:00:14.0/usb1/1-2",
+			"ACTION=" + action,
+			"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb1/1-2",
+			"SUBSYSTEM=usb",
+			"DEVTYPE=" + devtype,
+			"BUSNUM=001",
+			"DEVNUM=012",
+			"SEQNUM=4242",
+		}
+		return strings.Join(fields, "\x00") + "\x00"
+	}
+
+	tests := []testData{
+		{mkmsg("add", "usb_device"), UsbAddr{1, 12}, true, true},
+		{mkmsg("remove", "usb_device"), UsbAddr{1, 12}, false, true},
+		{mkmsg("bind", "usb_device"), UsbAddr{}, false, false},
+		{mkmsg("add", "usb_interface"), UsbAddr{}, false, false},
+		{"libudev\x00ACTION=add", UsbAddr{}, false, false},
+		{"", UsbAddr{}, false, false},
+	}
+
+	for _, test := range tests {
+		addr, added, ok := ueventParse([]byte(test.msg))
+		if addr != test.addr || added != test.added || ok != test.ok {
+			t.Errorf("%q:\n"+
+				"expected: %s added=%v ok=%v\n"+
+				"present:  %s added=%v ok=%v",
+				test.msg, test.addr, test.added, test.ok,
+				addr, added, ok)
+		}
+	}
+}
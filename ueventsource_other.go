@@ -0,0 +1,36 @@
+// +build !linux,!freebsd
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Kernel uevents source of USB hotplug events -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"errors"
+)
+
+const (
+	// UeventSourceName is the name of the kernel uevents source,
+	// for logging
+	UeventSourceName = "uevents"
+
+	// UeventSourceUdev tells, if kernel uevents source must be
+	// always started in the udev mode
+	UeventSourceUdev = false
+)
+
+// UeventSourceStart starts listening to the kernel uevents
+//
+// This platform has no netlink uevents, so error is returned
+func UeventSourceStart() error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,74 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB hotplug events handling
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestUsbHotPlugDedup tests usbHotPlugDedup
+func TestUsbHotPlugDedup(t *testing.T) {
+	usbHotPlugRecent = make(map[usbHotPlugEvent]time.Time)
+	defer func() { usbHotPlugRecent = make(map[usbHotPlugEvent]time.Time) }()
+
+	now := time.Now()
+	addr := UsbAddr{1, 5}
+	add := usbHotPlugEvent{addr, true}
+	del := usbHotPlugEvent{addr, false}
+
+	steps := []struct {
+		ev  usbHotPlugEvent
+		dt  time.Duration
+		new bool
+	}{
+		{add, 0, true},                                 // libusb: added
+		{add, time.Millisecond, false},                 // netlink: same
+		{del, time.Second, true},                       // libusb: removed
+		{add, time.Second, true},                       // re-added
+		{add, time.Second + UsbHotPlugDedupTime, true}, // expired
+		{usbHotPlugEvent{UsbAddr{1, 6}, true}, 0, true},
+	}
+
+	for i, step := range steps {
+		present := usbHotPlugDedup(step.ev, now.Add(step.dt))
+		if present != step.new {
+			t.Errorf("step %d: expected %v, present %v",
+				i, step.new, present)
+		}
+	}
+}
+
+// TestUsbHotPlugAdded tests collection of added devices addresses
+func TestUsbHotPlugAdded(t *testing.T) {
+	defer func() {
+		usbHotPlugRecent = make(map[usbHotPlugEvent]time.Time)
+		UsbHotPlugAdded()
+		UsbHotPlugRescan()
+		<-UsbHotPlugChan
+	}()
+
+	UsbHotPlugAdded()
+
+	UsbHotPlugNotify("test", UsbAddr{1, 5}, true)
+	UsbHotPlugNotify("test", UsbAddr{1, 5}, true) // Duplicate
+	UsbHotPlugNotify("test", UsbAddr{1, 6}, false)
+	UsbHotPlugNotify("test", UsbAddr{1, 7}, true)
+
+	added := UsbHotPlugAdded()
+	expected := UsbAddrList{{1, 5}, {1, 7}}
+	if len(added) != len(expected) ||
+		added[0] != expected[0] || added[1] != expected[1] {
+		t.Errorf("expected %v, present %v", expected, added)
+	}
+
+	if added = UsbHotPlugAdded(); len(added) != 0 {
+		t.Errorf("expected empty list, present %v", added)
+	}
+}
@@ -0,0 +1,46 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * UID discovery for Unix domain socket connection -- Linux version
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// UnixClientUIDSupported tells if UnixClientUID supported on this platform
+func UnixClientUIDSupported() bool {
+	return true
+}
+
+// UnixClientUID obtains UID of client process that connected
+// to the Unix domain socket
+func UnixClientUID(conn *net.UnixConn) (int, error) {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = rawconn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err == nil {
+		err = credErr
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return int(cred.Uid), nil
+}
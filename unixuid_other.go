@@ -0,0 +1,34 @@
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * UID discovery for Unix domain socket connection -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+import (
+	"net"
+)
+
+// UnixClientUIDSupported tells if UnixClientUID supported on this platform
+//
+// If this function returns false, UnixClientUID should never be called
+func UnixClientUIDSupported() bool {
+	return false
+}
+
+// UnixClientUID obtains UID of client process that connected
+// to the Unix domain socket
+func UnixClientUID(conn *net.UnixConn) (int, error) {
+	// Note, UnixClientUID should never be called, if
+	// UnixClientUIDSupported returns false
+	panic("UnixClientUID not supported")
+}
@@ -0,0 +1,165 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB bandwidth scheduler
+ *
+ * When several devices share the same USB hub, a single busy device
+ * (i.e., scanning MFP) may starve the others. The bandwidth scheduler
+ * coordinates all UsbTransports:
+ *   - per-device aggregate throughput (receive plus send, all USB
+ *     interfaces together) may be capped by the usb-bandwidth-limit
+ *     quirk
+ *   - the total throughput of all devices may be capped by the
+ *     bandwidth-limit parameter of the [usb] configuration section.
+ *     This bandwidth is divided equally between the devices, active
+ *     at the moment, so idle devices don't waste it
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// UsbBandwidthActivity is the time during which device is
+// considered active since its last transfer
+const UsbBandwidthActivity = time.Second
+
+// UsbBandwidthSched is the global USB bandwidth scheduler
+var UsbBandwidthSched = &UsbBandwidthScheduler{
+	devices: make(map[*usbBandwidth]struct{}),
+}
+
+// UsbBandwidthScheduler balances USB bandwidth between devices
+type UsbBandwidthScheduler struct {
+	lock    sync.Mutex                 // Access lock
+	devices map[*usbBandwidth]struct{} // Registered devices
+}
+
+// usbBandwidth is the per-device bandwidth limiter, shared
+// between all connections of the device
+type usbBandwidth struct {
+	sched      *UsbBandwidthScheduler // Scheduler that owns us
+	cap        uint                   // Per-device cap, 0 if none
+	lock       sync.Mutex             // Protects limiter
+	limiter    *usbRateLimiter        // Rate limiter
+	lastActive time.Time              // Time of last transfer
+}
+
+// Register registers a new device with the scheduler. The cap
+// parameter is the per-device aggregate throughput limit, bytes
+// per second, 0 if none
+//
+// If device bandwidth is not limited at all, nil is returned
+func (sched *UsbBandwidthScheduler) Register(cap uint) *usbBandwidth {
+	if cap == 0 && Conf.UsbBandwidthLimit == 0 {
+		return nil
+	}
+
+	bw := &usbBandwidth{sched: sched, cap: cap}
+
+	sched.lock.Lock()
+	sched.devices[bw] = struct{}{}
+	sched.lock.Unlock()
+
+	// Actual share of bandwidth is recomputed on each transfer,
+	// so initially limiter is set to the upper bound
+	rate := uint(Conf.UsbBandwidthLimit)
+	if cap != 0 && (rate == 0 || cap < rate) {
+		rate = cap
+	}
+
+	bw.limiter = newUsbRateLimiter(rate)
+
+	return bw
+}
+
+// Unregister removes device from the scheduler. It is safe to
+// call Unregister with nil bw
+func (sched *UsbBandwidthScheduler) Unregister(bw *usbBandwidth) {
+	if bw != nil {
+		sched.lock.Lock()
+		delete(sched.devices, bw)
+		sched.lock.Unlock()
+	}
+}
+
+// share marks device as active and returns its current share
+// of bandwidth, bytes per second
+func (bw *usbBandwidth) share(now time.Time) uint {
+	sched := bw.sched
+
+	sched.lock.Lock()
+	bw.lastActive = now
+
+	rate := uint(Conf.UsbBandwidthLimit)
+	if rate != 0 {
+		// Note, device may be already unregistered, while
+		// its last transfers are still in progress
+		active := uint(1)
+		for dev := range sched.devices {
+			if dev != bw &&
+				now.Sub(dev.lastActive) < UsbBandwidthActivity {
+				active++
+			}
+		}
+
+		rate /= active
+	}
+	sched.lock.Unlock()
+
+	if bw.cap != 0 && (rate == 0 || bw.cap < rate) {
+		rate = bw.cap
+	}
+
+	return rate
+}
+
+// update updates limiter rate to the device's current share.
+// Must be called under bw.lock
+func (bw *usbBandwidth) update() {
+	bw.limiter.setRate(bw.share(time.Now()))
+}
+
+// chunk returns maximum size of a single I/O operation.
+// See usbRateLimiter.chunk for details
+func (bw *usbBandwidth) chunk(size, align int) int {
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return bw.limiter.chunk(size, align)
+}
+
+// take accounts n transferred bytes
+func (bw *usbBandwidth) take(n int) {
+	bw.lock.Lock()
+	bw.update()
+	bw.limiter.take(n)
+	bw.lock.Unlock()
+}
+
+// wait waits until device is allowed to transfer or
+// context expires
+func (bw *usbBandwidth) wait(ctx context.Context) error {
+	for {
+		bw.lock.Lock()
+		bw.update()
+		delay := bw.limiter.delay()
+		bw.lock.Unlock()
+
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
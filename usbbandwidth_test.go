@@ -0,0 +1,76 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB bandwidth scheduler
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestUsbBandwidthShare tests division of bandwidth between devices
+func TestUsbBandwidthShare(t *testing.T) {
+	saved := Conf.UsbBandwidthLimit
+	defer func() { Conf.UsbBandwidthLimit = saved }()
+
+	sched := &UsbBandwidthScheduler{
+		devices: make(map[*usbBandwidth]struct{}),
+	}
+
+	// Without limits, nothing is registered
+	Conf.UsbBandwidthLimit = 0
+	if bw := sched.Register(0); bw != nil {
+		t.Errorf("unlimited device registered")
+	}
+
+	// Per-device cap only
+	capped := sched.Register(1000000)
+	if rate := capped.share(time.Now()); rate != 1000000 {
+		t.Errorf("per-device cap: expected %d, present %d",
+			1000000, rate)
+	}
+	sched.Unregister(capped)
+
+	// Global limit, divided between active devices
+	Conf.UsbBandwidthLimit = 3000000
+	now := time.Now()
+
+	dev1 := sched.Register(0)
+	dev2 := sched.Register(1000000)
+	dev3 := sched.Register(0)
+
+	if rate := dev1.share(now); rate != 3000000 {
+		t.Errorf("single active: expected %d, present %d",
+			3000000, rate)
+	}
+
+	if rate := dev3.share(now); rate != 1500000 {
+		t.Errorf("two active: expected %d, present %d",
+			1500000, rate)
+	}
+
+	if rate := dev2.share(now); rate != 1000000 {
+		t.Errorf("capped device: expected %d, present %d",
+			1000000, rate)
+	}
+
+	// Idle devices don't count
+	later := now.Add(UsbBandwidthActivity)
+	if rate := dev1.share(later); rate != 3000000 {
+		t.Errorf("others idle: expected %d, present %d",
+			3000000, rate)
+	}
+
+	sched.Unregister(dev1)
+	sched.Unregister(dev2)
+	sched.Unregister(dev3)
+
+	if len(sched.devices) != 0 {
+		t.Errorf("%d devices remain registered", len(sched.devices))
+	}
+}
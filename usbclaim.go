@@ -0,0 +1,129 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB device claiming arbitration with other drivers
+ *
+ * Other drivers (i.e., HPLIP or vendor tools) may attempt to claim
+ * the same USB interfaces as ipp-usb does. This leads to confusing
+ * failures on both sides. Here we detect competing claims, so they
+ * can be reported, and allow administrator to temporary pause the
+ * device (release it to others) and resume it afterwards
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// UsbClaim describes a competing claim of the USB device
+type UsbClaim struct {
+	Interface int    // Interface number, -1 if whole device
+	Driver    string // Kernel driver name, "" for userspace claims
+	PID       int    // Process ID, for userspace claims
+	Command   string // Process command, for userspace claims
+}
+
+// String returns a human-readable representation of UsbClaim
+func (claim UsbClaim) String() string {
+	if claim.Driver != "" {
+		return fmt.Sprintf("interface %d: claimed by kernel driver %q",
+			claim.Interface, claim.Driver)
+	}
+
+	return fmt.Sprintf("device opened by process %d (%s)",
+		claim.PID, claim.Command)
+}
+
+// UsbClaimsCheck returns competing claims of the USB device,
+// made by other drivers. Only interfaces, used by IPP-over-USB,
+// are taken into account
+func UsbClaimsCheck(desc UsbDeviceDesc) []UsbClaim {
+	claims := []UsbClaim{}
+
+	for _, claim := range usbClaimsCheck(desc.UsbAddr) {
+		if claim.Driver != "" {
+			used := false
+			for _, ifaddr := range desc.IfAddrs {
+				used = used || ifaddr.Num == claim.Interface
+			}
+
+			if !used {
+				continue
+			}
+		}
+
+		claims = append(claims, claim)
+	}
+
+	return claims
+}
+
+var (
+	// usbClaimPaused contains idents of devices, paused by
+	// administrator
+	usbClaimPaused = make(map[string]struct{})
+
+	// usbClaimLock protects usbClaimPaused
+	usbClaimLock sync.Mutex
+
+	// UsbClaimChan receives notification when set of paused
+	// devices changes
+	UsbClaimChan = make(chan struct{}, 1)
+)
+
+// UsbClaimPause pauses the device, identified by its ident.
+// Paused device is released by ipp-usb, so other drivers can
+// claim it, until resumed.
+func UsbClaimPause(ident string) {
+	usbClaimLock.Lock()
+	usbClaimPaused[ident] = struct{}{}
+	usbClaimLock.Unlock()
+
+	usbClaimNotify()
+}
+
+// UsbClaimResume resumes the paused device. It returns false,
+// if device was not paused
+func UsbClaimResume(ident string) bool {
+	usbClaimLock.Lock()
+	_, paused := usbClaimPaused[ident]
+	delete(usbClaimPaused, ident)
+	usbClaimLock.Unlock()
+
+	if paused {
+		usbClaimNotify()
+	}
+
+	return paused
+}
+
+// UsbClaimPaused tells if device is paused
+func UsbClaimPaused(ident string) bool {
+	usbClaimLock.Lock()
+	_, paused := usbClaimPaused[ident]
+	usbClaimLock.Unlock()
+
+	return paused
+}
+
+// UsbClaimAnyPaused tells if there are some paused devices
+func UsbClaimAnyPaused() bool {
+	usbClaimLock.Lock()
+	paused := len(usbClaimPaused) != 0
+	usbClaimLock.Unlock()
+
+	return paused
+}
+
+// usbClaimNotify notifies PnP manager, that set of paused
+// devices has changed
+func usbClaimNotify() {
+	select {
+	case UsbClaimChan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,206 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of competing USB claims -- Linux version
+ *
+ * Kernel drivers, bound to the device interfaces, are found via sysfs,
+ * and userspace drivers are found by scanning /proc/PID/fd for the
+ * opened USB device node
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// usbClaimSysfsRoot is the sysfs directory with USB devices
+	usbClaimSysfsRoot = "/sys/bus/usb/devices"
+
+	// usbClaimProcRoot is the procfs mount point
+	usbClaimProcRoot = "/proc"
+)
+
+// usbClaimsCheck returns competing claims of the USB device
+func usbClaimsCheck(addr UsbAddr) []UsbClaim {
+	claims := usbClaimsKernel(addr)
+	return append(claims, usbClaimsUser(addr)...)
+}
+
+// usbClaimsKernel returns device interfaces, claimed by
+// kernel drivers
+//
+// Interfaces, claimed via usbfs (i.e., by libusb), are not
+// reported here; they are detected by usbClaimsUser
+func usbClaimsKernel(addr UsbAddr) []UsbClaim {
+	name := usbClaimSysfsDevice(addr)
+	if name == "" {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(usbClaimSysfsRoot)
+	if err != nil {
+		return nil
+	}
+
+	var claims []UsbClaim
+	for _, ent := range entries {
+		if !strings.HasPrefix(ent.Name(), name+":") {
+			continue
+		}
+
+		dir := filepath.Join(usbClaimSysfsRoot, ent.Name())
+		num, err := usbClaimReadInt(filepath.Join(dir,
+			"bInterfaceNumber"), 16)
+		if err != nil {
+			continue
+		}
+
+		driver, err := os.Readlink(filepath.Join(dir, "driver"))
+		if err != nil {
+			continue
+		}
+
+		driver = filepath.Base(driver)
+		if driver != "usbfs" {
+			claims = append(claims, UsbClaim{
+				Interface: num,
+				Driver:    driver,
+			})
+		}
+	}
+
+	return claims
+}
+
+// usbClaimsUsbfs returns device interfaces, claimed via usbfs
+//
+// Kernel reports these claims in sysfs regardless of PID namespace
+// of the claiming process, so claims, made from other containers,
+// are visible too
+func usbClaimsUsbfs(addr UsbAddr) []int {
+	name := usbClaimSysfsDevice(addr)
+	if name == "" {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(usbClaimSysfsRoot)
+	if err != nil {
+		return nil
+	}
+
+	var claimed []int
+	for _, ent := range entries {
+		if !strings.HasPrefix(ent.Name(), name+":") {
+			continue
+		}
+
+		dir := filepath.Join(usbClaimSysfsRoot, ent.Name())
+		num, err := usbClaimReadInt(filepath.Join(dir,
+			"bInterfaceNumber"), 16)
+		if err != nil {
+			continue
+		}
+
+		driver, err := os.Readlink(filepath.Join(dir, "driver"))
+		if err == nil && filepath.Base(driver) == "usbfs" {
+			claimed = append(claimed, num)
+		}
+	}
+
+	return claimed
+}
+
+// usbClaimsUser returns processes, other than ourselves, that
+// have the USB device node opened
+func usbClaimsUser(addr UsbAddr) []UsbClaim {
+	node := fmt.Sprintf("/dev/bus/usb/%.3d/%.3d", addr.Bus, addr.Address)
+	self := os.Getpid()
+
+	procs, err := ioutil.ReadDir(usbClaimProcRoot)
+	if err != nil {
+		return nil
+	}
+
+	var claims []UsbClaim
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		dir := filepath.Join(usbClaimProcRoot, proc.Name())
+
+		// Note, it will fail for processes of other users,
+		// if we are not running as root
+		fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd",
+				fd.Name()))
+			if err != nil || link != node {
+				continue
+			}
+
+			comm, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+			claims = append(claims, UsbClaim{
+				Interface: -1,
+				PID:       pid,
+				Command:   strings.TrimSpace(string(comm)),
+			})
+
+			break
+		}
+	}
+
+	return claims
+}
+
+// usbClaimSysfsDevice returns name of the device's sysfs directory
+// (i.e., "1-1.2") or "", if not found
+func usbClaimSysfsDevice(addr UsbAddr) string {
+	entries, err := ioutil.ReadDir(usbClaimSysfsRoot)
+	if err != nil {
+		return ""
+	}
+
+	for _, ent := range entries {
+		// Skip interfaces
+		if strings.Contains(ent.Name(), ":") {
+			continue
+		}
+
+		dir := filepath.Join(usbClaimSysfsRoot, ent.Name())
+		bus, err1 := usbClaimReadInt(filepath.Join(dir, "busnum"), 10)
+		dev, err2 := usbClaimReadInt(filepath.Join(dir, "devnum"), 10)
+
+		if err1 == nil && err2 == nil &&
+			bus == addr.Bus && dev == addr.Address {
+			return ent.Name()
+		}
+	}
+
+	return ""
+}
+
+// usbClaimReadInt reads integer from the sysfs file
+func usbClaimReadInt(path string, base int) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), base, 32)
+	return int(v), err
+}
@@ -0,0 +1,114 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for detection of competing USB claims -- Linux version
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestUsbClaimsCheck tests detection of competing USB claims
+func TestUsbClaimsCheck(t *testing.T) {
+	saveSysfs, saveProc := usbClaimSysfsRoot, usbClaimProcRoot
+	defer func() {
+		usbClaimSysfsRoot, usbClaimProcRoot = saveSysfs, saveProc
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	usbClaimSysfsRoot = filepath.Join(dir, "sys")
+	usbClaimProcRoot = filepath.Join(dir, "proc")
+
+	// Build fake sysfs and procfs
+	files := map[string]string{
+		"sys/1-1/busnum":               "1\n",
+		"sys/1-1/devnum":               "5\n",
+		"sys/1-1:1.0/bInterfaceNumber": "00\n",
+		"sys/1-1:1.1/bInterfaceNumber": "01\n",
+		"sys/1-1:1.2/bInterfaceNumber": "02\n",
+		"sys/1-2/busnum":               "1\n",
+		"sys/1-2/devnum":               "6\n",
+		"proc/1234/comm":               "hp-toolbox\n",
+		"proc/4321/comm":               "cat\n",
+	}
+
+	links := map[string]string{
+		"sys/1-1:1.0/driver": "../../../bus/usb/drivers/usblp",
+		"sys/1-1:1.1/driver": "../../../bus/usb/drivers/usbfs",
+		"sys/1-1:1.2/driver": "../../../bus/usb/drivers/usblp",
+		"proc/1234/fd/5":     "/dev/bus/usb/001/005",
+		"proc/4321/fd/0":     "/dev/null",
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	for name, target := range links {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = os.Symlink(target, path)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	// Check claims. Interface 2 is not IPP-over-USB and
+	// must be ignored
+	addr := UsbAddr{Bus: 1, Address: 5}
+	desc := UsbDeviceDesc{
+		UsbAddr: addr,
+		IfAddrs: UsbIfAddrList{
+			{UsbAddr: addr, Num: 0},
+			{UsbAddr: addr, Num: 1},
+		},
+	}
+
+	claims := UsbClaimsCheck(desc)
+	expected := []UsbClaim{
+		{Interface: 0, Driver: "usblp"},
+		{Interface: -1, PID: 1234, Command: "hp-toolbox"},
+	}
+
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("claims mismatch:\n"+
+			"expected: %v\n"+
+			"present:  %v", expected, claims)
+	}
+
+	// Interface 1 is claimed via usbfs
+	usbfs := usbClaimsUsbfs(addr)
+	if !reflect.DeepEqual(usbfs, []int{1}) {
+		t.Errorf("usbfs claims: expected %v, present %v",
+			[]int{1}, usbfs)
+	}
+
+	// Other device has no claims
+	desc.UsbAddr = UsbAddr{Bus: 1, Address: 6}
+	if claims = UsbClaimsCheck(desc); len(claims) != 0 {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+
+	if usbfs = usbClaimsUsbfs(desc.UsbAddr); len(usbfs) != 0 {
+		t.Errorf("unexpected usbfs claims: %v", usbfs)
+	}
+}
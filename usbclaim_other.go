@@ -0,0 +1,29 @@
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of competing USB claims -- default version
+ *
+ * If you've have added support for yet another platform, please don't
+ * forget to update build tag at the top of this file to exclude your
+ * platform
+ */
+
+package main
+
+// usbClaimsCheck returns competing claims of the USB device
+//
+// This platform has no way to detect them, so nothing is reported
+func usbClaimsCheck(addr UsbAddr) []UsbClaim {
+	return nil
+}
+
+// usbClaimsUsbfs returns device interfaces, claimed via usbfs
+//
+// This platform has no way to detect them, so nothing is reported
+func usbClaimsUsbfs(addr UsbAddr) []int {
+	return nil
+}
@@ -0,0 +1,48 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB device claiming arbitration
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// TestUsbClaimPause tests pausing and resuming of devices
+func TestUsbClaimPause(t *testing.T) {
+	const ident = "03f0-0000-SERIAL-Test-Printer"
+
+	if UsbClaimAnyPaused() || UsbClaimPaused(ident) {
+		t.Fatalf("device paused before test")
+	}
+
+	UsbClaimPause(ident)
+
+	select {
+	case <-UsbClaimChan:
+	default:
+		t.Errorf("pause: PnP manager not notified")
+	}
+
+	if !UsbClaimAnyPaused() || !UsbClaimPaused(ident) {
+		t.Errorf("device not paused")
+	}
+
+	if !UsbClaimResume(ident) {
+		t.Errorf("resume: device was not paused")
+	}
+
+	<-UsbClaimChan
+
+	if UsbClaimAnyPaused() || UsbClaimPaused(ident) {
+		t.Errorf("device still paused after resume")
+	}
+
+	if UsbClaimResume(ident) {
+		t.Errorf("resume of not paused device succeeded")
+	}
+}
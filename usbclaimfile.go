@@ -0,0 +1,123 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB device arbitration between ipp-usb instances
+ *
+ * The lock file protects from running two ipp-usb instances only
+ * within the same filesystem namespace. In containerized environments,
+ * competing instances may run in different containers and fight over
+ * the same USB device.
+ *
+ * To detect this, two methods are used:
+ *   - interfaces, already claimed via usbfs (i.e., by libusb), are
+ *     reported by kernel in sysfs, even if claiming process lives in
+ *     another PID namespace
+ *   - if claim-dir is configured and shared between containers, the
+ *     device-level advisory claim file, keyed by the USB port path,
+ *     is locked while device is in use
+ *
+ * Device, claimed by another instance, is not touched (in particular,
+ * it is not reset) and initialization is retried later, so access to
+ * the device is effectively serialized between instances
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UsbClaimAcquire checks that device is not used by another ipp-usb
+// instance and acquires the device-level claim file, if claim-dir
+// is configured
+//
+// The returned file must be released with UsbClaimRelease, when
+// device is closed. It is nil, if claim file is not used. If device
+// is used by another instance, details are written to the log and
+// ErrClaimed is returned
+func UsbClaimAcquire(log *Logger, desc UsbDeviceDesc,
+	info UsbDeviceInfo) (*os.File, error) {
+
+	var file *os.File
+
+	// Acquire the claim file
+	if Conf.ClaimDir != "" && info.PortPath != "" {
+		path := filepath.Join(Conf.ClaimDir, info.PortPath+".claim")
+
+		err := os.MkdirAll(Conf.ClaimDir, 0755)
+		if err == nil {
+			file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("claim file: %s", err)
+		}
+
+		err = FileLock(file, FileLockNoWait)
+		switch err {
+		case nil:
+			owner := fmt.Sprintf("pid=%d host=%s ident=%s\n",
+				os.Getpid(), usbClaimHostname(), info.Ident())
+			file.Truncate(0)
+			file.WriteAt([]byte(owner), 0)
+
+		case ErrLockIsBusy:
+			owner, _ := ioutil.ReadFile(path)
+			log.Error('!', "USB: %s: claimed by %s", path,
+				strings.TrimSpace(string(owner)))
+			file.Close()
+			return nil, ErrClaimed
+
+		default:
+			file.Close()
+			return nil, fmt.Errorf("claim file: %s", err)
+		}
+	}
+
+	// Check for interfaces, claimed via usbfs
+	claimed := usbClaimsUsbfs(desc.UsbAddr)
+	for _, ifaddr := range desc.IfAddrs {
+		for _, num := range claimed {
+			if ifaddr.Num != num {
+				continue
+			}
+
+			log.Error('!', "USB: interface %d: already claimed via usbfs",
+				num)
+
+			for _, claim := range UsbClaimsCheck(desc) {
+				log.Error('!', "USB: %s", claim)
+			}
+
+			UsbClaimRelease(file)
+			return nil, ErrClaimed
+		}
+	}
+
+	return file, nil
+}
+
+// UsbClaimRelease releases the claim file, acquired by UsbClaimAcquire
+func UsbClaimRelease(file *os.File) {
+	if file != nil {
+		file.Truncate(0)
+		FileUnlock(file)
+		file.Close()
+	}
+}
+
+// usbClaimHostname returns host name for the claim file. In
+// containers, it usually identifies the container
+func usbClaimHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,77 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB device arbitration between ipp-usb instances
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestUsbClaimAcquire tests the device-level claim files
+func TestUsbClaimAcquire(t *testing.T) {
+	save := Conf.ClaimDir
+	defer func() { Conf.ClaimDir = save }()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	Conf.ClaimDir = filepath.Join(dir, "claims")
+
+	desc := UsbDeviceDesc{UsbAddr: UsbAddr{Bus: 250, Address: 1}}
+	info := UsbDeviceInfo{PortPath: "250-3.2"}
+
+	// The first claim succeeds
+	claim, err := UsbClaimAcquire(NewLogger(), desc, info)
+	if err != nil || claim == nil {
+		t.Fatalf("UsbClaimAcquire: %v %v", claim, err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(Conf.ClaimDir,
+		"250-3.2.claim"))
+	if !strings.HasPrefix(string(data), "pid=") {
+		t.Errorf("claim file content: %q", data)
+	}
+
+	// The second claim of the same device fails
+	_, err = UsbClaimAcquire(NewLogger(), desc, info)
+	if err != ErrClaimed {
+		t.Errorf("second claim: expected %v, present %v",
+			ErrClaimed, err)
+	}
+
+	// Device at another port can be claimed
+	claim2, err := UsbClaimAcquire(NewLogger(), desc,
+		UsbDeviceInfo{PortPath: "250-4"})
+	if err != nil {
+		t.Errorf("another port: %s", err)
+	}
+	UsbClaimRelease(claim2)
+
+	// After release, device can be claimed again
+	UsbClaimRelease(claim)
+	claim, err = UsbClaimAcquire(NewLogger(), desc, info)
+	if err != nil {
+		t.Errorf("claim after release: %s", err)
+	}
+	UsbClaimRelease(claim)
+
+	// Without claim-dir, claim file is not used
+	Conf.ClaimDir = ""
+	claim, err = UsbClaimAcquire(NewLogger(), desc, info)
+	if err != nil || claim != nil {
+		t.Errorf("without claim-dir: %v %v", claim, err)
+	}
+}
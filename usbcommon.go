@@ -9,7 +9,9 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -134,10 +136,62 @@ func (list *UsbIfAddrList) Add(addr UsbIfAddr) {
 
 // UsbDeviceDesc represents an IPP-over-USB device descriptor
 type UsbDeviceDesc struct {
-	UsbAddr               // Device address
-	Config  int           // IPP-over-USB configuration
-	IfAddrs UsbIfAddrList // IPP-over-USB interfaces
-	IfDescs []UsbIfDesc   // Descriptors of all interfaces
+	UsbAddr                // Device address
+	PortPath string        // Physical port path, "" if unknown
+	Release  uint16        // Device release number (bcdDevice)
+	Config   int           // IPP-over-USB configuration
+	IfAddrs  UsbIfAddrList // IPP-over-USB interfaces
+	IfDescs  []UsbIfDesc   // Descriptors of all interfaces
+}
+
+// Changed tells if descriptors of the device differ from
+// the previously seen descriptors of the same device
+//
+// Devices may change their descriptors (interfaces, release
+// number) after firmware update, and the device needs to be
+// reinitialized then. Device address is not compared.
+func (desc UsbDeviceDesc) Changed(prev UsbDeviceDesc) bool {
+	if desc.Release != prev.Release || desc.Config != prev.Config ||
+		len(desc.IfAddrs) != len(prev.IfAddrs) ||
+		len(desc.IfDescs) != len(prev.IfDescs) {
+		return true
+	}
+
+	for i := range desc.IfAddrs {
+		ifaddr, ifaddr2 := desc.IfAddrs[i], prev.IfAddrs[i]
+		ifaddr.UsbAddr = ifaddr2.UsbAddr
+		if ifaddr != ifaddr2 {
+			return true
+		}
+	}
+
+	for i := range desc.IfDescs {
+		if desc.IfDescs[i] != prev.IfDescs[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeepKernelDriver tells if kernel driver must be left attached
+// to the interface of the device
+//
+// Normally, kernel driver is detached from all interfaces. If
+// Conf.UsbKeepUsblp is set, it is detached only from the IPP-over-USB
+// interfaces, so legacy printer interfaces remain bound to usblp
+func (desc UsbDeviceDesc) KeepKernelDriver(ifnum int) bool {
+	if !Conf.UsbKeepUsblp {
+		return false
+	}
+
+	for _, ifaddr := range desc.IfAddrs {
+		if ifaddr.Num == ifnum {
+			return false
+		}
+	}
+
+	return true
 }
 
 // GetUsbDeviceInfo obtains UsbDeviceInfo by UsbDeviceDesc
@@ -165,26 +219,121 @@ type UsbIfDesc struct {
 
 // IsIppOverUsb check if interface is IPP over USB
 //
-// FIXME. The matching rules must be configurable
-func (ifdesc UsbIfDesc) IsIppOverUsb() bool {
-	switch {
+// Besides the standard 7/1/4 combination of Class/SubClass/Protocol,
+// additional combinations may be enabled by the usb-interface-match
+// quirk, i.e. 255/9/1, used by some HP devices
+func (ifdesc UsbIfDesc) IsIppOverUsb(match QuirkUsbIfMatch) bool {
 	// The classical combination, 7/1/4
-	case ifdesc.Class == 7 && ifdesc.SubClass == 1 && ifdesc.Proto == 4:
+	if ifdesc.Class == 7 && ifdesc.SubClass == 1 && ifdesc.Proto == 4 {
 		return true
+	}
 
-	// Some HP devices use non-standard combination, 255/9/1
-	//
-	// This is valid at least with the following devices:
-	//   HP LaserJet MFP M426fdn
-	//   HP ColorLaserJet MFP M278-M281
-	case ifdesc.Vendor == 0x03f0 &&
-		ifdesc.Class == 255 && ifdesc.SubClass == 9 && ifdesc.Proto == 1:
-		return true
+	for _, c := range match {
+		if ifdesc.Class == c.Class && ifdesc.SubClass == c.SubClass &&
+			ifdesc.Proto == c.Proto {
+			return true
+		}
 	}
 
 	return false
 }
 
+// UsbIfMatch returns the usb-interface-match quirk of the device with
+// the specified vendor and product IDs
+//
+// As interfaces are examined before device is opened, the quirk is
+// looked up only by vendor and product IDs (i.e., [hwid:03f0:*])
+func UsbIfMatch(vendor, product uint16) QuirkUsbIfMatch {
+	info := UsbDeviceInfo{Vendor: vendor, Product: product}
+	return Conf.Quirks.MatchByDevice(info).GetUsbInterfaceMatch()
+}
+
+// UsbConfigOverride returns the usb-config quirk of the device with
+// the specified vendor and product IDs, or 0, if not set
+//
+// Like UsbIfMatch, the quirk is looked up only by vendor and product IDs
+func UsbConfigOverride(vendor, product uint16) int {
+	info := UsbDeviceInfo{Vendor: vendor, Product: product}
+	return int(Conf.Quirks.MatchByDevice(info).GetUsbConfig())
+}
+
+// UsbSelectConfig chooses USB configuration to be used, out of
+// configurations the device has
+//
+// configs lists configuration values in order of configuration
+// descriptors, ifaddrs contains IPP-over-USB interfaces per
+// configuration value. If override is not 0 and the configuration
+// with this value has IPP-over-USB interfaces, it is chosen.
+// Otherwise, configuration with the most of IPP-over-USB interfaces
+// is chosen, the first one wins on ties
+//
+// If there are no IPP-over-USB interfaces at all, -1 is returned
+func UsbSelectConfig(configs []int, ifaddrs map[int]UsbIfAddrList,
+	override int) int {
+
+	if override != 0 && len(ifaddrs[override]) != 0 {
+		return override
+	}
+
+	best := -1
+	for _, config := range configs {
+		if len(ifaddrs[config]) > 0 &&
+			(best < 0 || len(ifaddrs[config]) > len(ifaddrs[best])) {
+			best = config
+		}
+	}
+
+	return best
+}
+
+// UsbDecodeDeviceID decodes response to the printer class
+// GET_DEVICE_ID request. Response starts with 2-byte big-endian
+// length, that includes the length field itself
+func UsbDecodeDeviceID(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("GET_DEVICE_ID: response too short")
+	}
+
+	// Some devices send length in little-endian, so if big-endian
+	// length looks insane, try little-endian
+	l := int(data[0])<<8 | int(data[1])
+	if l < 2 || l > len(data) {
+		l = int(data[1])<<8 | int(data[0])
+	}
+
+	if l < 2 || l > len(data) {
+		return "", errors.New("GET_DEVICE_ID: invalid length")
+	}
+
+	return strings.TrimSpace(string(data[2:l])), nil
+}
+
+// UsbParseDeviceID parses IEEE 1284 device ID into the KEY:VALUE map
+func UsbParseDeviceID(id string) map[string]string {
+	devid := make(map[string]string)
+	for _, s := range strings.Split(id, ";") {
+		keyval := strings.SplitN(s, ":", 2)
+		if len(keyval) == 2 {
+			devid[strings.TrimSpace(keyval[0])] = keyval[1]
+		}
+	}
+
+	return devid
+}
+
+// UsbIfClass represents USB interface Class/SubClass/Protocol
+type UsbIfClass struct {
+	Class    int // Class
+	SubClass int // Subclass
+	Proto    int // Protocol
+}
+
+// String returns string representation of UsbIfClass,
+// as "CLASS/SUBCLASS/PROTO"
+func (c UsbIfClass) String() string {
+	return fmt.Sprintf("%d/%d/%d", c.Class, c.SubClass, c.Proto)
+}
+
 // UsbDeviceInfo represents USB device information
 type UsbDeviceInfo struct {
 	// Fields, directly decoded from USB
@@ -194,12 +343,77 @@ type UsbDeviceInfo struct {
 	Manufacturer string          // Manufacturer name
 	ProductName  string          // Product name
 	PortNum      int             // USB port number
+	PortPath     string          // Physical port path, i.e., "1-3.2"
+	Speed        UsbSpeed        // Negotiated USB speed
 	BasicCaps    UsbIppBasicCaps // Device basic capabilities
+	HasBasicCaps bool            // Class-specific descriptor present
+
+	// Fields, obtained from device at initialization
+	Firmware string // Firmware version, "" if unknown
+	DeviceID string // IEEE 1284 device ID, "" if unknown
 
 	// Precomputed fields
 	MfgAndProduct string // Product with Manufacturer prefix, if needed
 }
 
+// UsbSpeed represents negotiated USB link speed
+type UsbSpeed int
+
+// UsbSpeed values
+const (
+	UsbSpeedUnknown   UsbSpeed = iota // Unknown speed
+	UsbSpeedLow                       // USB 1.0, 1.5 Mbit/s
+	UsbSpeedFull                      // USB 1.1, 12 Mbit/s
+	UsbSpeedHigh                      // USB 2.0, 480 Mbit/s
+	UsbSpeedSuper                     // USB 3.0, 5 Gbit/s
+	UsbSpeedSuperPlus                 // USB 3.1, 10 Gbit/s
+)
+
+// String returns a human-readable representation of UsbSpeed
+func (speed UsbSpeed) String() string {
+	switch speed {
+	case UsbSpeedLow:
+		return "low (1.5 Mbit/s)"
+	case UsbSpeedFull:
+		return "full (12 Mbit/s)"
+	case UsbSpeedHigh:
+		return "high (480 Mbit/s)"
+	case UsbSpeedSuper:
+		return "super (5 Gbit/s)"
+	case UsbSpeedSuperPlus:
+		return "super+ (10 Gbit/s)"
+	}
+
+	return "unknown"
+}
+
+// RecvAlign returns alignment of USB receive buffers, suitable
+// for the speed. It is the max packet size of bulk endpoints:
+// 1024 bytes for USB 3.x, 512 bytes for USB 2.0 and below. If speed
+// is unknown, the safe default is returned
+func (speed UsbSpeed) RecvAlign() int {
+	switch speed {
+	case UsbSpeedLow, UsbSpeedFull, UsbSpeedHigh:
+		return 512
+	}
+
+	return UsbRecvAlign
+}
+
+// MaxBulkRead returns the maximum size of a single bulk read
+//
+// Some USB 2.0 host controllers (notably, on Raspberry Pi) don't
+// reliably handle bulk transfers larger that 16 KB, so the limit
+// is relaxed only for USB 3.x links
+func (speed UsbSpeed) MaxBulkRead() int {
+	switch speed {
+	case UsbSpeedSuper, UsbSpeedSuperPlus:
+		return UsbMaxBulkReadSuper
+	}
+
+	return UsbMaxBulkRead
+}
+
 // UsbIppBasicCaps represents device basic capabilities bits,
 // according to the IPP-USB specification, section 4.3
 type UsbIppBasicCaps int
@@ -247,6 +461,34 @@ func (info *UsbDeviceInfo) FixUp() {
 	}
 }
 
+// DeviceIDModel returns model name with manufacturer prefix, as
+// obtained from the IEEE 1284 device ID, or "", if not available
+func (info UsbDeviceInfo) DeviceIDModel() string {
+	devid := UsbParseDeviceID(info.DeviceID)
+
+	mfg := devid["MFG"]
+	if mfg == "" {
+		mfg = devid["MANUFACTURER"]
+	}
+
+	mdl := devid["MDL"]
+	if mdl == "" {
+		mdl = devid["MODEL"]
+	}
+
+	mfg = strings.TrimSpace(mfg)
+	mdl = strings.TrimSpace(mdl)
+
+	switch {
+	case mdl == "":
+		return ""
+	case strings.HasPrefix(mdl, mfg):
+		return mdl
+	}
+
+	return mfg + " " + mdl
+}
+
 // Ident returns device identification string, suitable as
 // persistent state identifier
 func (info UsbDeviceInfo) Ident() string {
@@ -273,6 +515,31 @@ func (info UsbDeviceInfo) DNSSdName() string {
 	return info.MfgAndProduct
 }
 
+// DNSSdSuffix generates stable suffix for DNS-SD name collision
+// resolution. It is derived from the tail of serial number or, if
+// serial number is not available, from physical port path.
+// "" is returned, if neither is available
+func (info UsbDeviceInfo) DNSSdSuffix() string {
+	const maxlen = 4
+
+	suffix := ""
+	for _, c := range strings.ToUpper(info.SerialNumber) {
+		if ('0' <= c && c <= '9') || ('A' <= c && c <= 'Z') {
+			suffix += string(c)
+		}
+	}
+
+	if len(suffix) > maxlen {
+		suffix = suffix[len(suffix)-maxlen:]
+	}
+
+	if suffix == "" && info.PortPath != "" {
+		suffix = "port " + info.PortPath
+	}
+
+	return suffix
+}
+
 // UUID generates device UUID in a case it is not available
 // from IPP or eSCL
 func (info UsbDeviceInfo) UUID() string {
@@ -305,3 +572,52 @@ func (info UsbDeviceInfo) UUID() string {
 func (info UsbDeviceInfo) Comment() string {
 	return info.MfgAndProduct + " serial=" + info.SerialNumber
 }
+
+// UsbPortPath formats physical port path of the device from its
+// bus number and the chain of port numbers, from the root hub down
+// to the device, i.e., "1-3.2". This is the same notation as used
+// by Linux kernel in sysfs
+func UsbPortPath(bus int, ports []int) string {
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = fmt.Sprintf("%d", port)
+	}
+
+	return fmt.Sprintf("%d-%s", bus, strings.Join(s, "."))
+}
+
+// UsbTransferWait waits for completion of the asynchronous USB transfer,
+// which is signalled via the done channel.
+//
+// If ctx expires first, transfer is canceled by calling cancel, and
+// UsbTransferWait still waits for done, which confirms that cancellation
+// is completed. So when it returns true, the completion signal is
+// consumed, transfer is not owned by the USB stack anymore and may be
+// safely resubmitted. Transfer must never be resubmitted before its
+// cancellation completes, as it would corrupt the transfer in flight
+//
+// The dead channel is closed, when USB stack is stuck and abandoned,
+// so transfer will never complete. In this case UsbTransferWait returns
+// false without further waiting, and transfer remains owned by the
+// abandoned USB stack, so it must never be resubmitted or freed
+//
+// Note, done must be buffered, as completion may be signalled
+// before UsbTransferWait starts waiting
+func UsbTransferWait(ctx context.Context, done, dead <-chan struct{},
+	cancel func()) bool {
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		cancel()
+	case <-dead:
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-dead:
+		return false
+	}
+}
@@ -9,7 +9,10 @@
 package main
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Check if two UsbAddrList are equal
@@ -107,3 +110,346 @@ func TestUsbAddrListDiff(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestUsbPortPath tests UsbPortPath
+func TestUsbPortPath(t *testing.T) {
+	type testData struct {
+		bus      int
+		ports    []int
+		expected string
+	}
+
+	tests := []testData{
+		{1, []int{3}, "1-3"},
+		{1, []int{3, 2}, "1-3.2"},
+		{2, []int{1, 4, 1}, "2-1.4.1"},
+	}
+
+	for _, test := range tests {
+		path := UsbPortPath(test.bus, test.ports)
+		if path != test.expected {
+			t.Errorf("%d %v: expected %q, present %q",
+				test.bus, test.ports, test.expected, path)
+		}
+	}
+}
+
+// TestUsbDeviceDescChanged tests UsbDeviceDesc.Changed
+func TestUsbDeviceDescChanged(t *testing.T) {
+	mkdesc := func(addr UsbAddr) UsbDeviceDesc {
+		desc := UsbDeviceDesc{
+			UsbAddr:  addr,
+			PortPath: "1-3",
+			Release:  0x0100,
+			Config:   1,
+			IfDescs: []UsbIfDesc{
+				{Config: 1, IfNum: 0, Class: 7, SubClass: 1, Proto: 2},
+				{Config: 1, IfNum: 1, Class: 7, SubClass: 1, Proto: 4},
+				{Config: 1, IfNum: 2, Class: 7, SubClass: 1, Proto: 4},
+			},
+		}
+
+		desc.IfAddrs.Add(UsbIfAddr{UsbAddr: addr, Num: 1, In: 1, Out: 2})
+		desc.IfAddrs.Add(UsbIfAddr{UsbAddr: addr, Num: 2, In: 3, Out: 4})
+		return desc
+	}
+
+	prev := mkdesc(UsbAddr{Bus: 1, Address: 5})
+
+	// Address doesn't matter
+	if mkdesc(UsbAddr{Bus: 1, Address: 6}).Changed(prev) {
+		t.Errorf("address change reported as descriptors change")
+	}
+
+	// Release number changed
+	desc := mkdesc(prev.UsbAddr)
+	desc.Release = 0x0101
+	if !desc.Changed(prev) {
+		t.Errorf("release change not detected")
+	}
+
+	// Interface added
+	desc = mkdesc(prev.UsbAddr)
+	desc.IfDescs = append(desc.IfDescs,
+		UsbIfDesc{Config: 1, IfNum: 3, Class: 7, SubClass: 1, Proto: 4})
+	desc.IfAddrs.Add(UsbIfAddr{UsbAddr: prev.UsbAddr, Num: 3, In: 5, Out: 6})
+	if !desc.Changed(prev) {
+		t.Errorf("new interface not detected")
+	}
+
+	// Endpoints changed
+	desc = mkdesc(prev.UsbAddr)
+	desc.IfAddrs[1].In = 7
+	if !desc.Changed(prev) {
+		t.Errorf("endpoints change not detected")
+	}
+}
+
+// TestUsbDeviceDescKeepKernelDriver tests UsbDeviceDesc.KeepKernelDriver
+func TestUsbDeviceDescKeepKernelDriver(t *testing.T) {
+	saveKeepUsblp := Conf.UsbKeepUsblp
+	defer func() { Conf.UsbKeepUsblp = saveKeepUsblp }()
+
+	// Interface 0 is 7/1/2, 1 and 2 are IPP-over-USB
+	desc := UsbDeviceDesc{Config: 1}
+	desc.IfAddrs.Add(UsbIfAddr{Num: 1, In: 1, Out: 2})
+	desc.IfAddrs.Add(UsbIfAddr{Num: 2, In: 3, Out: 4})
+
+	tests := []struct {
+		keepUsblp bool
+		ifnum     int
+		keep      bool
+	}{
+		{false, 0, false},
+		{false, 1, false},
+		{false, 2, false},
+		{true, 0, true},
+		{true, 1, false},
+		{true, 2, false},
+	}
+
+	for _, test := range tests {
+		Conf.UsbKeepUsblp = test.keepUsblp
+		keep := desc.KeepKernelDriver(test.ifnum)
+		if keep != test.keep {
+			t.Errorf("keep-usblp=%v, interface %d: "+
+				"expected %v, present %v",
+				test.keepUsblp, test.ifnum, test.keep, keep)
+		}
+	}
+}
+
+// TestUsbDeviceInfoDNSSdSuffix tests UsbDeviceInfo.DNSSdSuffix
+func TestUsbDeviceInfoDNSSdSuffix(t *testing.T) {
+	type testData struct {
+		serial, port string
+		expected     string
+	}
+
+	tests := []testData{
+		{"CN12ab-34cd", "1-3", "34CD"},
+		{"x1", "1-3", "X1"},
+		{"", "1-3.2", "port 1-3.2"},
+		{"--", "", ""},
+	}
+
+	for _, test := range tests {
+		info := UsbDeviceInfo{SerialNumber: test.serial,
+			PortPath: test.port}
+		suffix := info.DNSSdSuffix()
+		if suffix != test.expected {
+			t.Errorf("%q %q: expected %q, present %q",
+				test.serial, test.port, test.expected, suffix)
+		}
+	}
+}
+
+// TestUsbSpeed tests UsbSpeed-dependent parameters
+func TestUsbSpeed(t *testing.T) {
+	type testData struct {
+		speed       UsbSpeed
+		align, bulk int
+	}
+
+	tests := []testData{
+		{UsbSpeedUnknown, UsbRecvAlign, UsbMaxBulkRead},
+		{UsbSpeedFull, 512, UsbMaxBulkRead},
+		{UsbSpeedHigh, 512, UsbMaxBulkRead},
+		{UsbSpeedSuper, 1024, UsbMaxBulkReadSuper},
+		{UsbSpeedSuperPlus, 1024, UsbMaxBulkReadSuper},
+	}
+
+	for _, test := range tests {
+		align := test.speed.RecvAlign()
+		bulk := test.speed.MaxBulkRead()
+		if align != test.align || bulk != test.bulk {
+			t.Errorf("%s: expected %d/%d, present %d/%d",
+				test.speed, test.align, test.bulk, align, bulk)
+		}
+
+		if bulk%align != 0 {
+			t.Errorf("%s: max bulk read %d not aligned to %d",
+				test.speed, bulk, align)
+		}
+	}
+}
+
+// TestUsbSelectConfig tests UsbSelectConfig
+func TestUsbSelectConfig(t *testing.T) {
+	ifaddrs := map[int]UsbIfAddrList{
+		1: {{Num: 0}, {Num: 1}},
+		2: {{Num: 0}, {Num: 1}, {Num: 2}},
+		3: {{Num: 0}, {Num: 1}, {Num: 2}},
+	}
+
+	tests := []struct {
+		configs  []int
+		override int
+		expected int
+	}{
+		{[]int{1, 2, 3}, 0, 2},
+		{[]int{3, 2, 1}, 0, 3},
+		{[]int{1, 2, 3}, 1, 1},
+		{[]int{1, 2, 3}, 5, 2},
+		{[]int{1}, 0, 1},
+		{[]int{4}, 0, -1},
+		{nil, 0, -1},
+	}
+
+	for _, test := range tests {
+		config := UsbSelectConfig(test.configs, ifaddrs, test.override)
+		if config != test.expected {
+			t.Errorf("%v override=%d: expected %d, present %d",
+				test.configs, test.override, test.expected, config)
+		}
+	}
+}
+
+// TestUsbDecodeDeviceID tests UsbDecodeDeviceID
+func TestUsbDecodeDeviceID(t *testing.T) {
+	id := "MFG:HP;MDL:OfficeJet Pro 8730;CMD:PCL,PDF;"
+
+	tests := []struct {
+		data     []byte
+		expected string
+		err      bool
+	}{
+		{append([]byte{0, byte(len(id) + 2)}, id...), id, false},
+		{append([]byte{byte(len(id) + 2), 0}, id...), id, false},
+		{append([]byte{0, byte(len(id) + 2)}, id+"garbage"...), id, false},
+		{[]byte{0}, "", true},
+		{[]byte{0, 200, 'M'}, "", true},
+	}
+
+	for i, test := range tests {
+		s, err := UsbDecodeDeviceID(test.data)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%d: error not detected", i)
+		case !test.err && err != nil:
+			t.Errorf("%d: %s", i, err)
+		case s != test.expected:
+			t.Errorf("%d: expected %q, present %q", i, test.expected, s)
+		}
+	}
+}
+
+// TestUsbDeviceInfoDeviceIDModel tests UsbDeviceInfo.DeviceIDModel
+func TestUsbDeviceInfoDeviceIDModel(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"MFG:HP;MDL:OfficeJet Pro 8730;", "HP OfficeJet Pro 8730"},
+		{"MANUFACTURER:Canon;MODEL:Canon G3010 series;",
+			"Canon G3010 series"},
+		{"MFG:HP;CMD:PCL;", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		info := UsbDeviceInfo{DeviceID: test.id}
+		model := info.DeviceIDModel()
+		if model != test.expected {
+			t.Errorf("%q: expected %q, present %q",
+				test.id, test.expected, model)
+		}
+	}
+}
+
+// testUsbTransfer emulates asynchronous USB transfer. Both completion
+// and cancellation are signalled asynchronously, like libusb does
+type testUsbTransfer struct {
+	done      chan struct{} // Signalled on completion
+	timer     *time.Timer   // Completes the transfer
+	owned     int32         // Atomic, nonzero while owned by "USB stack"
+	resubmits int32         // Atomic, count of submits while owned
+}
+
+// newTestUsbTransfer creates a new testUsbTransfer
+func newTestUsbTransfer() *testUsbTransfer {
+	return &testUsbTransfer{done: make(chan struct{}, 1)}
+}
+
+// submit submits the transfer, that will complete after delay
+func (x *testUsbTransfer) submit(delay time.Duration) {
+	if !atomic.CompareAndSwapInt32(&x.owned, 0, 1) {
+		atomic.AddInt32(&x.resubmits, 1)
+		return
+	}
+
+	x.timer = time.AfterFunc(delay, x.complete)
+}
+
+// cancel cancels the transfer. Cancellation completes after a while
+func (x *testUsbTransfer) cancel() {
+	if x.timer.Stop() {
+		time.AfterFunc(5*time.Millisecond, x.complete)
+	}
+}
+
+// complete completes the transfer
+func (x *testUsbTransfer) complete() {
+	atomic.StoreInt32(&x.owned, 0)
+	x.done <- struct{}{}
+}
+
+// TestUsbTransferWait tests UsbTransferWait
+func TestUsbTransferWait(t *testing.T) {
+	x := newTestUsbTransfer()
+
+	// Transfer completes before context expiration
+	dead := make(chan struct{})
+	x.submit(time.Millisecond)
+	ok := UsbTransferWait(context.Background(), x.done, dead, x.cancel)
+
+	if !ok || atomic.LoadInt32(&x.owned) != 0 || len(x.done) != 0 {
+		t.Errorf("completion: transfer not finished")
+	}
+
+	// Context expires before transfer completion. Wait must
+	// return only after cancellation is completed
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond)
+	x.submit(time.Hour)
+	ok = UsbTransferWait(ctx, x.done, dead, x.cancel)
+	cancel()
+
+	if !ok || atomic.LoadInt32(&x.owned) != 0 || len(x.done) != 0 {
+		t.Errorf("cancellation: transfer not finished")
+	}
+
+	// Transfer is reused, racing completion and cancellation.
+	// It must never be resubmitted while in flight
+	for i := 0; i < 200; i++ {
+		timeout := time.Duration(i%5) * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(),
+			timeout)
+		x.submit(time.Duration(i%7) * time.Millisecond)
+		UsbTransferWait(ctx, x.done, dead, x.cancel)
+		cancel()
+	}
+
+	if n := atomic.LoadInt32(&x.resubmits); n != 0 {
+		t.Errorf("reuse: %d transfers resubmitted while in flight", n)
+	}
+
+	// USB stack is stuck, so neither completion nor cancellation
+	// ever happen. Wait must return when stack is abandoned
+	x = newTestUsbTransfer()
+	x.submit(time.Hour)
+	stuck := func() {}
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		time.Millisecond)
+	defer cancel()
+
+	time.AfterFunc(10*time.Millisecond, func() { close(dead) })
+	if UsbTransferWait(ctx, x.done, dead, stuck) {
+		t.Errorf("abandoned: transfer reported as finished")
+	}
+
+	if atomic.LoadInt32(&x.owned) == 0 {
+		t.Errorf("abandoned: transfer must remain owned")
+	}
+}
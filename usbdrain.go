@@ -0,0 +1,87 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Registry of background drains of abandoned responses
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// usbDrains keeps track of background goroutines, draining
+// response bodies, abandoned by clients, and collects drain
+// metrics for the status output and device log
+//
+// When clients abandon many large responses, drain goroutines
+// may pile up, each holding the USB connection. To prevent this,
+// count of concurrent drains per device is limited by the
+// max-drains configuration parameter. When limit is reached,
+// connection of the abandoned response is recycled (reset)
+// immediately, instead of draining
+//
+// There is one usbDrains per UsbTransport
+type usbDrains struct {
+	lock     sync.Mutex // Access lock
+	active   int        // Count of active drains
+	peak     int        // Peak count of active drains
+	total    uint64     // Total count of drains
+	bytes    uint64     // Total count of drained bytes
+	recycled uint64     // Connections recycled due to size/time limits
+	refused  uint64     // Connections recycled due to max-drains limit
+}
+
+// begin registers a new drain. It returns false, if count of
+// concurrent drains is exceeded; in this case drain is not
+// registered and connection must be recycled without draining
+func (drains *usbDrains) begin() bool {
+	drains.lock.Lock()
+	defer drains.lock.Unlock()
+
+	if Conf.UsbMaxDrains != 0 && drains.active >= int(Conf.UsbMaxDrains) {
+		drains.refused++
+		return false
+	}
+
+	drains.active++
+	drains.total++
+	if drains.active > drains.peak {
+		drains.peak = drains.active
+	}
+
+	return true
+}
+
+// end unregisters the drain, started by begin. n is the count
+// of drained bytes, recycled is true, if drain exceeded its
+// size or time budget and connection was recycled
+func (drains *usbDrains) end(n int64, recycled bool) {
+	drains.lock.Lock()
+	defer drains.lock.Unlock()
+
+	drains.active--
+	drains.bytes += uint64(n)
+	if recycled {
+		drains.recycled++
+	}
+}
+
+// format formats drain metrics for the status output and device
+// log. It returns "", if there were no abandoned responses yet
+func (drains *usbDrains) format() string {
+	drains.lock.Lock()
+	defer drains.lock.Unlock()
+
+	if drains.total == 0 && drains.refused == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("drains: active %d (peak %d), total %d (%d bytes), "+
+		"recycled %d over budget, %d over max-drains",
+		drains.active, drains.peak, drains.total, drains.bytes,
+		drains.recycled, drains.refused)
+}
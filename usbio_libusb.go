@@ -21,6 +21,7 @@ import (
 
 // #cgo pkg-config: libusb-1.0
 // #include <libusb.h>
+// #include <stdlib.h>
 //
 // int libusbHotplugCallback (libusb_context *ctx, libusb_device *device,
 //     libusb_hotplug_event event, void *user_data);
@@ -80,62 +81,99 @@ func (err UsbErrCode) String() string {
 	return C.GoString(C.libusb_strerror_wrapper(C.int(err)))
 }
 
+// libusbCtx represents libusb_context with its event loop
+//
+// When event loop gets stuck, context is abandoned, and the new
+// one is created. Abandoned context is destroyed, when its event
+// loop exits and all device handles, opened in this context,
+// are closed
+type libusbCtx struct {
+	beat uint64            // Atomic, incremented by the event loop
+	ptr  *C.libusb_context // The libusb_context
+	dead chan struct{}     // Closed when context is abandoned
+	refs int32             // Atomic, event loop + open handles
+}
+
 var (
-	// libusbContextPtr keeps a pointer to libusb_context.
-	// It is initialized on demand
-	libusbContextPtr *C.libusb_context
+	// libusbContextCurrent keeps a pointer to the current
+	// libusbCtx. It is initialized on demand
+	libusbContextCurrent *libusbCtx
 
-	// libusbContextLock protects libusbContextPtr initialization
-	// in multithreaded context
+	// libusbContextLock protects libusbContextCurrent
+	// initialization in multithreaded context
 	libusbContextLock sync.Mutex
 
-	// Nonzero, if libusbContextPtr initialized
+	// Nonzero, if libusbContextCurrent initialized and alive
 	libusbContextOk int32
 
-	// libusbTransferDoneMap contains a map of completion channels,
-	// associated with each active libusb_transfer.
+	// libusbHandles maps each opened libusb_device_handle
+	// into the libusbCtx, it belongs to
+	libusbHandles sync.Map
+
+	// libusbTransfers maps each allocated libusb_transfer into
+	// the libusbTransfer, that owns it.
 	//
 	// The libusbTransferCallback uses this map to indicate transfer
 	// completion
 	//
 	// This is required, because CGo is very restrictive in whatever
-	// can be saved in pointer passed to the C side.
-	libusbTransferDoneMap = make(map[*C.libusb_transfer_struct]chan struct{})
-
-	// libusbTransferDoneLock protects multithreaded access to
-	// the libusbTransferDoneMap
-	libusbTransferDoneLock sync.Mutex
+	// can be saved in pointer passed to the C side. As transfers
+	// are allocated once per interface and reused, the map is
+	// modified rarely, and sync.Map allows lookups without locking
+	libusbTransfers sync.Map
 
 	// UsbHotPlugChan receives USB hotplug event notifications
 	UsbHotPlugChan = make(chan struct{}, 1)
+
+	// UsbResetChan receives notification when libusb was
+	// reinitialized, because its event loop has died. All
+	// opened devices become unusable and must be reopened
+	UsbResetChan = make(chan struct{}, 1)
 )
 
 // UsbInit initializes low-level USB I/O
 func UsbInit(nopnp bool) error {
-	_, err := libusbContext(nopnp)
+	ctx, err := libusbContext(nopnp)
+	if err == nil {
+		ctx.unref()
+	}
 	return err
 }
 
-// libusbContext returns libusb_context. It
-// initializes context on demand.
-func libusbContext(nopnp bool) (*C.libusb_context, error) {
-	if atomic.LoadInt32(&libusbContextOk) != 0 {
-		return libusbContextPtr, nil
-	}
-
+// libusbContext returns the current libusbCtx. It initializes
+// context on demand.
+//
+// Returned context is referenced; caller must unref it when done
+func libusbContext(nopnp bool) (*libusbCtx, error) {
+	// Note, context is referenced under the lock, so it
+	// cannot be abandoned and destroyed in between
 	libusbContextLock.Lock()
 	defer libusbContextLock.Unlock()
 
+	if atomic.LoadInt32(&libusbContextOk) != 0 {
+		libusbContextCurrent.ref()
+		return libusbContextCurrent, nil
+	}
+
 	// Obtain libusb_context
-	rc := C.libusb_init(&libusbContextPtr)
+	var ptr *C.libusb_context
+	rc := C.libusb_init(&ptr)
 	if rc != 0 {
 		return nil, UsbError{"libusb_init", UsbErrCode(rc)}
 	}
 
+	ctx := &libusbCtx{
+		ptr:  ptr,
+		dead: make(chan struct{}),
+		refs: 1, // Event loop
+	}
+
+	libusbContextCurrent = ctx
+
 	// Subscribe to hotplug events
 	if !nopnp {
 		C.libusb_hotplug_register_callback(
-			libusbContextPtr, // libusb_context
+			ptr, // libusb_context
 			C.LIBUSB_HOTPLUG_EVENT_DEVICE_ARRIVED| // events mask
 				C.LIBUSB_HOTPLUG_EVENT_DEVICE_LEFT,
 			C.LIBUSB_HOTPLUG_NO_FLAGS,  // flags
@@ -149,15 +187,106 @@ func libusbContext(nopnp bool) (*C.libusb_context, error) {
 	}
 
 	// Start libusb thread (required for hotplug and asynchronous I/O)
+	// and its watchdog.
+	//
+	// If context is abandoned, but its event loop eventually
+	// recovers, the loop exits. As its goroutine is locked to
+	// the OS thread, the thread is terminated as well
 	go func() {
 		runtime.LockOSThread()
-		for {
-			C.libusb_handle_events(libusbContextPtr)
+		for !ctx.isDead() {
+			C.libusb_handle_events(ptr)
+			atomic.AddUint64(&ctx.beat, 1)
 		}
+		ctx.unref()
 	}()
 
+	go libusbWatchdog(ctx)
+
 	atomic.StoreInt32(&libusbContextOk, 1)
-	return libusbContextPtr, nil
+	ctx.ref()
+	return ctx, nil
+}
+
+// ref adds a reference to the context
+func (ctx *libusbCtx) ref() {
+	atomic.AddInt32(&ctx.refs, 1)
+}
+
+// unref drops a reference to the context. When the last
+// reference is dropped, context is destroyed.
+//
+// Note, the event loop holds a reference until context
+// is abandoned, so the current context is never destroyed
+func (ctx *libusbCtx) unref() {
+	if atomic.AddInt32(&ctx.refs, -1) == 0 {
+		C.libusb_exit(ctx.ptr)
+	}
+}
+
+// isDead returns true, if context is abandoned
+func (ctx *libusbCtx) isDead() bool {
+	select {
+	case <-ctx.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// libusbWatchdog supervises the libusb event loop
+//
+// Periodically it wakes up the event loop and checks that it
+// makes progress. If event loop is stuck, all transfers will hang
+// silently, so libusb context is abandoned (it cannot be safely
+// destroyed while some thread is stuck inside), the new context
+// is created on demand and PnP manager is notified via the
+// UsbResetChan, so it can reopen devices
+//
+// Closing ctx.dead unblocks transfers, waiting for completion
+// in the abandoned context, so devices can be closed in time
+func libusbWatchdog(ctx *libusbCtx) {
+	last := atomic.LoadUint64(&ctx.beat)
+	ticker := time.NewTicker(UsbWatchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		// Wake up event loop, so it has a chance to
+		// make progress
+		C.libusb_interrupt_event_handler(ctx.ptr)
+
+		<-ticker.C
+
+		beat := atomic.LoadUint64(&ctx.beat)
+		if beat != last {
+			last = beat
+			continue
+		}
+
+		Log.Error('!', "USB: libusb event loop stuck for %s, reinitializing",
+			UsbWatchdogInterval)
+
+		// Note, once ctx.dead is closed, the event loop may exit
+		// and devices may be closed at any time, dropping the last
+		// reference to the context, so hold our own reference
+		// while context is still in use
+		libusbContextLock.Lock()
+		atomic.StoreInt32(&libusbContextOk, 0)
+		ctx.ref()
+		close(ctx.dead)
+		libusbContextLock.Unlock()
+
+		// If event loop ever recovers, let it exit
+		C.libusb_interrupt_event_handler(ctx.ptr)
+		ctx.unref()
+
+		select {
+		case UsbResetChan <- struct{}{}:
+		default:
+		}
+
+		return
+	}
 }
 
 // Called by libusb on hotplug event
@@ -173,14 +302,11 @@ func libusbHotplugCallback(ctx *C.libusb_context, dev *C.libusb_device,
 
 	switch event {
 	case C.LIBUSB_HOTPLUG_EVENT_DEVICE_ARRIVED:
-		Log.Debug('+', "HOTPLUG: added %s", usbaddr)
+		UsbHotPlugNotify("libusb", usbaddr, true)
 	case C.LIBUSB_HOTPLUG_EVENT_DEVICE_LEFT:
-		Log.Debug('-', "HOTPLUG: removed %s", usbaddr)
-	}
-
-	select {
-	case UsbHotPlugChan <- struct{}{}:
+		UsbHotPlugNotify("libusb", usbaddr, false)
 	default:
+		UsbHotPlugRescan()
 	}
 
 	return 0
@@ -190,13 +316,15 @@ func libusbHotplugCallback(ctx *C.libusb_context, dev *C.libusb_device,
 //
 //export libusbTransferCallback
 func libusbTransferCallback(xfer *C.libusb_transfer_struct) {
-	// Obtain signaling channel
-	libusbTransferDoneLock.Lock()
-	done := libusbTransferDoneMap[xfer]
-	libusbTransferDoneLock.Unlock()
+	// Obtain the owning libusbTransfer
+	t, ok := libusbTransfers.Load(xfer)
+	if !ok {
+		return
+	}
 
-	// Indicate transfer completion by closing the channel
-	close(done)
+	// Indicate transfer completion. Channel is buffered, so it
+	// never blocks
+	t.(*libusbTransfer).done <- struct{}{}
 }
 
 // libusbTransferStatusDecode decodes libusb_transfer completion status.
@@ -250,33 +378,110 @@ func libusbTransferStatusDecode(ctx context.Context,
 	return 0, UsbError{"libusb_submit_transfer", UsbErrCode(rc)}
 }
 
-// libusbTransferAlloc allocates a libusb_transfer.
+// libusbTransfer represents a pre-allocated libusb_transfer with
+// its completion channel.
+//
+// Transfers are allocated per interface, one for each direction,
+// and reused for all I/O operations, so no allocations are needed
+// for each Send and Recv. As Send and Recv never return before
+// transfer completion (including completion of its cancellation),
+// transfer is never resubmitted while libusb still owns it
+//
+// Transfer data goes through the C-allocated bounce buffer, owned
+// by the transfer, so libusb never references Go memory.
 //
-// On success, it allocates a completion channel as well and adds
-// it into the libusbTransferDoneMap.
-func libusbTransferAlloc() (*C.libusb_transfer_struct, chan struct{}, error) {
+// If context is abandoned while transfer is in flight, transfer is
+// lost: it still may be owned by libusb, so it is never resubmitted,
+// and neither transfer nor its buffer are ever freed
+type libusbTransfer struct {
+	xfer    *C.libusb_transfer_struct // The libusb_transfer
+	ctx     *libusbCtx                // Context of the transfer
+	done    chan struct{}             // Signalled on completion
+	buf     unsafe.Pointer            // Bounce buffer, C-allocated
+	bufSize int                       // Size of the bounce buffer
+	lost    bool                      // Transfer is lost
+}
+
+// newLibusbTransfer allocates a libusb_transfer and its completion
+// channel, and adds it into the libusbTransfers map
+func newLibusbTransfer(ctx *libusbCtx) (*libusbTransfer, error) {
 	xfer := C.libusb_alloc_transfer(0)
 	if xfer == nil {
-		return nil, nil, UsbError{"libusb_alloc_transfer", UsbENomem}
+		return nil, UsbError{"libusb_alloc_transfer", UsbENomem}
 	}
 
-	doneChan := make(chan struct{})
+	t := &libusbTransfer{
+		xfer: xfer,
+		ctx:  ctx,
+		done: make(chan struct{}, 1),
+	}
 
-	libusbTransferDoneLock.Lock()
-	libusbTransferDoneMap[xfer] = doneChan
-	libusbTransferDoneLock.Unlock()
+	libusbTransfers.Store(xfer, t)
 
-	return xfer, doneChan, nil
+	return t, nil
 }
 
-// libusbTransferFree removed libusb_transfer from the libusbTransferDoneMap
-// and releases its memory.
-func libusbTransferFree(xfer *C.libusb_transfer_struct) {
-	libusbTransferDoneLock.Lock()
-	delete(libusbTransferDoneMap, xfer)
-	libusbTransferDoneLock.Unlock()
+// free removes libusb_transfer from the libusbTransfers map
+// and releases its memory. Memory of lost transfer is not
+// released, as libusb may still use it
+func (t *libusbTransfer) free() {
+	libusbTransfers.Delete(t.xfer)
+	if !t.lost {
+		C.libusb_free_transfer(t.xfer)
+		C.free(t.buf)
+	}
+}
 
-	C.libusb_free_transfer(xfer)
+// buffer returns the bounce buffer of at least size bytes,
+// growing it on demand
+//
+// Note, buffer is never reallocated while transfer is in flight,
+// as transfer is never resubmitted before its completion
+func (t *libusbTransfer) buffer(size int) (unsafe.Pointer, error) {
+	if size > t.bufSize {
+		buf := C.realloc(t.buf, C.size_t(size))
+		if buf == nil {
+			return nil, UsbError{"realloc", UsbENomem}
+		}
+
+		t.buf, t.bufSize = buf, size
+	}
+
+	return t.buf, nil
+}
+
+// bytes returns first size bytes of the bounce buffer as a slice
+func (t *libusbTransfer) bytes(size int) []byte {
+	return (*[1 << 30]byte)(t.buf)[:size:size]
+}
+
+// usable returns an error, if transfer cannot be submitted,
+// because it is lost or its context is abandoned
+func (t *libusbTransfer) usable() error {
+	if t.lost || t.ctx.isDead() {
+		return UsbError{"libusb_submit_transfer", UsbENoDev}
+	}
+	return nil
+}
+
+// wait waits for transfer completion. If context is canceled or
+// expires, transfer is canceled, and wait returns after libusb
+// finishes the transfer, so the transfer may be safely reused
+// by the next Send or Recv. See UsbTransferWait for details
+//
+// If libusb context is abandoned, wait returns immediately, and
+// transfer becomes lost
+func (t *libusbTransfer) wait(ctx context.Context) (int, error) {
+	ok := UsbTransferWait(ctx, t.done, t.ctx.dead, func() {
+		C.libusb_cancel_transfer(t.xfer)
+	})
+
+	if !ok {
+		t.lost = true
+		return 0, UsbError{"libusb_handle_events", UsbENoDev}
+	}
+
+	return libusbTransferStatusDecode(ctx, t.xfer)
 }
 
 // UsbCheckIppOverUsbDevices returns true if there are some IPP-over-USB devices
@@ -294,9 +499,11 @@ func UsbGetIppOverUsbDeviceDescs() (map[UsbAddr]UsbDeviceDesc, error) {
 		return nil, err
 	}
 
+	defer ctx.unref()
+
 	// Obtain list of devices
 	var devlist **C.libusb_device
-	cnt := C.libusb_get_device_list(ctx, &devlist)
+	cnt := C.libusb_get_device_list(ctx.ptr, &devlist)
 	if cnt < 0 {
 		return nil, UsbError{"libusb_get_device_list", UsbErrCode(cnt)}
 	}
@@ -338,17 +545,24 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 	// Decode device descriptor
 	desc.Bus = int(C.libusb_get_bus_number(dev))
 	desc.Address = int(C.libusb_get_device_address(dev))
+	desc.PortPath = libusbPortPath(dev)
+	desc.Release = uint16(cDesc.bcdDevice)
 	desc.Config = -1
 
+	ifmatch := UsbIfMatch(uint16(cDesc.idVendor), uint16(cDesc.idProduct))
+
+	// IPP-over-USB interfaces are collected for all configurations,
+	// then the best configuration is chosen
+	var configs []int
+	ifaddrs := make(map[int]UsbIfAddrList)
+
 	// Roll over configs/interfaces/alt settings/endpoins
 	for cfgNum := 0; cfgNum < int(cDesc.bNumConfigurations); cfgNum++ {
 		var conf *C.libusb_config_descriptor_struct
 		rc = C.libusb_get_config_descriptor(dev, C.uint8_t(cfgNum), &conf)
 		if rc == 0 {
-			// Make sure we use the same configuration for all interfaces
-			if desc.Config >= 0 && desc.Config != int(conf.bConfigurationValue) {
-				continue
-			}
+			cfgValue := int(conf.bConfigurationValue)
+			configs = append(configs, cfgValue)
 
 			ifcnt := conf.bNumInterfaces
 			ifaces := (*[256]C.libusb_interface_struct)(
@@ -364,7 +578,7 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 					ifdesc := UsbIfDesc{
 						Vendor:   uint16(cDesc.idVendor),
 						Product:  uint16(cDesc.idProduct),
-						Config:   int(conf.bConfigurationValue),
+						Config:   cfgValue,
 						IfNum:    int(alt.bInterfaceNumber),
 						Alt:      int(alt.bAlternateSetting),
 						Class:    int(alt.bInterfaceClass),
@@ -376,8 +590,9 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 
 					// We are only interested in IPP-over-USB
 					// interfaces, i.e., LIBUSB_CLASS_PRINTER,
-					// SubClass 1, Protocol 4
-					if ifdesc.IsIppOverUsb() {
+					// SubClass 1, Protocol 4, or enabled by
+					// the usb-interface-match quirk
+					if ifdesc.IsIppOverUsb(ifmatch) {
 						epnum := alt.bNumEndpoints
 						endpoints := (*[256]C.libusb_endpoint_descriptor_struct)(
 							unsafe.Pointer(alt.endpoint))[:epnum:epnum]
@@ -400,7 +615,6 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 
 						// Build and append UsbIfAddr
 						if in >= 0 && out >= 0 {
-							desc.Config = int(conf.bConfigurationValue)
 							addr := UsbIfAddr{
 								UsbAddr: desc.UsbAddr,
 								Num:     int(alt.bInterfaceNumber),
@@ -408,7 +622,9 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 								In:      in,
 								Out:     out,
 							}
-							desc.IfAddrs.Add(addr)
+							list := ifaddrs[cfgValue]
+							list.Add(addr)
+							ifaddrs[cfgValue] = list
 						}
 					}
 				}
@@ -418,6 +634,14 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 		}
 	}
 
+	// Choose configuration
+	override := UsbConfigOverride(uint16(cDesc.idVendor),
+		uint16(cDesc.idProduct))
+	desc.Config = UsbSelectConfig(configs, ifaddrs, override)
+	if desc.Config >= 0 {
+		desc.IfAddrs = ifaddrs[desc.Config]
+	}
+
 	return desc, nil
 }
 
@@ -425,6 +649,9 @@ func libusbBuildUsbDeviceDesc(dev *C.libusb_device) (UsbDeviceDesc, error) {
 type UsbDevHandle C.libusb_device_handle
 
 // UsbOpenDevice opens device by device descriptor
+//
+// Opened device holds a reference to the libusb context,
+// until closed
 func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 	// Obtain libusb context
 	ctx, err := libusbContext(false)
@@ -432,9 +659,16 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 		return nil, err
 	}
 
+	var devhandle *C.libusb_device_handle
+	defer func() {
+		if devhandle == nil {
+			ctx.unref()
+		}
+	}()
+
 	// Obtain list of devices
 	var devlist **C.libusb_device
-	cnt := C.libusb_get_device_list(ctx, &devlist)
+	cnt := C.libusb_get_device_list(ctx.ptr, &devlist)
 	if cnt < 0 {
 		return nil, UsbError{"libusb_get_device_list", UsbErrCode(cnt)}
 	}
@@ -450,12 +684,13 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 
 		if desc.Bus == bus && desc.Address == address {
 			// Open device
-			var devhandle *C.libusb_device_handle
 			rc := C.libusb_open(dev, &devhandle)
 			if rc < 0 {
+				devhandle = nil
 				return nil, UsbError{"libusb_open", UsbErrCode(rc)}
 			}
 
+			libusbHandles.Store(devhandle, ctx)
 			return (*UsbDevHandle)(devhandle), nil
 		}
 	}
@@ -466,13 +701,30 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 // Configure prepares the device for further work:
 //   - set proper USB configuration
 //   - detach kernel driver
+//
+// If Conf.UsbKeepUsblp is set, kernel driver is detached only from
+// the IPP-over-USB interfaces, so legacy printer interfaces (i.e.,
+// 7/1/2) remain bound to usblp. In this case configuration is not
+// set, if it is already active, because it will fail while other
+// interfaces are in use by kernel
 func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
 	// Detach kernel driver
-	err := (*UsbDevHandle)(devhandle).detachKernelDriver()
+	err := (*UsbDevHandle)(devhandle).detachKernelDriver(
+		desc.KeepKernelDriver)
 	if err != nil {
 		return err
 	}
 
+	// Check current configuration
+	if Conf.UsbKeepUsblp {
+		var config C.int
+		rc := C.libusb_get_configuration(
+			(*C.libusb_device_handle)(devhandle), &config)
+		if rc == 0 && int(config) == desc.Config {
+			return nil
+		}
+	}
+
 	// Set configuration
 	rc := C.libusb_set_configuration(
 		(*C.libusb_device_handle)(devhandle), C.int(desc.Config))
@@ -487,9 +739,144 @@ func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
 	return nil
 }
 
+// ControlTransfer sends control transfer without data stage
+// to the device
+func (devhandle *UsbDevHandle) ControlTransfer(requestType, request uint8,
+	value, index uint16) error {
+
+	if err := devhandle.usable("libusb_control_transfer"); err != nil {
+		return err
+	}
+
+	rc := C.libusb_control_transfer(
+		(*C.libusb_device_handle)(devhandle),
+		C.uint8_t(requestType), C.uint8_t(request),
+		C.uint16_t(value), C.uint16_t(index), nil, 0, 5000)
+
+	if rc < 0 {
+		return UsbError{"libusb_control_transfer", UsbErrCode(rc)}
+	}
+
+	return nil
+}
+
+// ControlRead sends control transfer with IN data stage to the
+// device and returns count of received bytes
+func (devhandle *UsbDevHandle) ControlRead(requestType, request uint8,
+	value, index uint16, data []byte) (int, error) {
+
+	if err := devhandle.usable("libusb_control_transfer"); err != nil {
+		return 0, err
+	}
+
+	rc := C.libusb_control_transfer(
+		(*C.libusb_device_handle)(devhandle),
+		C.uint8_t(requestType|C.LIBUSB_ENDPOINT_IN), C.uint8_t(request),
+		C.uint16_t(value), C.uint16_t(index),
+		(*C.uchar)(unsafe.Pointer(&data[0])), C.uint16_t(len(data)),
+		5000)
+
+	if rc < 0 {
+		return 0, UsbError{"libusb_control_transfer", UsbErrCode(rc)}
+	}
+
+	return int(rc), nil
+}
+
+// GetDeviceID obtains IEEE 1284 device ID, using the printer class
+// GET_DEVICE_ID request, sent to the interface
+//
+// Per USB printer class specification, wValue of the request is
+// the zero-based index of current configuration and wIndex contains
+// interface number and alternate setting
+func (devhandle *UsbDevHandle) GetDeviceID(ifnum, alt int) (string, error) {
+	cfgIndex, err := devhandle.currentConfigIndex()
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 1024)
+	n, err := devhandle.ControlRead(
+		C.LIBUSB_REQUEST_TYPE_CLASS|C.LIBUSB_RECIPIENT_INTERFACE,
+		0, uint16(cfgIndex), uint16(ifnum<<8|alt), buf)
+
+	if err != nil {
+		return "", err
+	}
+
+	return UsbDecodeDeviceID(buf[:n])
+}
+
+// currentConfigIndex returns zero-based index of the current
+// configuration descriptor
+func (devhandle *UsbDevHandle) currentConfigIndex() (int, error) {
+	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
+
+	var cDesc C.libusb_device_descriptor_struct
+	rc := C.libusb_get_device_descriptor(dev, &cDesc)
+	if rc < 0 {
+		return 0, UsbError{"libusb_get_device_descriptor", UsbErrCode(rc)}
+	}
+
+	var config C.int
+	rc = C.libusb_get_configuration((*C.libusb_device_handle)(devhandle), &config)
+	if rc < 0 {
+		return 0, UsbError{"libusb_get_configuration", UsbErrCode(rc)}
+	}
+
+	for cfgNum := 0; cfgNum < int(cDesc.bNumConfigurations); cfgNum++ {
+		var conf *C.libusb_config_descriptor_struct
+		rc = C.libusb_get_config_descriptor(dev, C.uint8_t(cfgNum), &conf)
+		if rc < 0 {
+			return 0, UsbError{"libusb_get_config_descriptor", UsbErrCode(rc)}
+		}
+
+		found := conf.bConfigurationValue == C.uint8_t(config)
+		C.libusb_free_config_descriptor(conf)
+
+		if found {
+			return cfgNum, nil
+		}
+	}
+
+	return 0, errors.New("libusb: unable to find current configuration in device descriptor")
+}
+
+// SoftReset performs soft reset of the interface, using
+// class-specific SOFT_RESET request. See UsbInterface.SoftReset
+// for details
+func (devhandle *UsbDevHandle) SoftReset(ifnum int) error {
+	if err := devhandle.usable("libusb_control_transfer"); err != nil {
+		return err
+	}
+
+	rc := C.libusb_control_transfer(
+		(*C.libusb_device_handle)(devhandle),
+		C.LIBUSB_REQUEST_TYPE_CLASS|
+			C.LIBUSB_ENDPOINT_OUT|
+			C.LIBUSB_RECIPIENT_OTHER,
+		2, 0, C.ushort(ifnum), nil, 0, 5000)
+
+	if rc < 0 {
+		rc = C.libusb_control_transfer(
+			(*C.libusb_device_handle)(devhandle),
+			C.LIBUSB_REQUEST_TYPE_CLASS|
+				C.LIBUSB_ENDPOINT_OUT|
+				C.LIBUSB_RECIPIENT_INTERFACE,
+			2, 0, C.ushort(ifnum), nil, 0, 5000)
+	}
+
+	if rc < 0 {
+		return UsbError{"libusb_control_transfer", UsbErrCode(rc)}
+	}
+
+	return nil
+}
+
 // detachKernelDriver detaches kernel driver from all interfaces
-// of current configuration
-func (devhandle *UsbDevHandle) detachKernelDriver() error {
+// of current configuration, except those for which keep callback,
+// if not nil, returns true
+func (devhandle *UsbDevHandle) detachKernelDriver(keep func(int) bool) error {
 	C.libusb_set_auto_detach_kernel_driver(
 		(*C.libusb_device_handle)(devhandle), 1)
 
@@ -499,6 +886,10 @@ func (devhandle *UsbDevHandle) detachKernelDriver() error {
 	}
 
 	for _, ifnum := range ifnums {
+		if keep != nil && keep(ifnum) {
+			continue
+		}
+
 		rc := C.libusb_detach_kernel_driver(
 			(*C.libusb_device_handle)(devhandle), C.int(ifnum))
 		if rc == C.LIBUSB_ERROR_NOT_FOUND {
@@ -569,13 +960,66 @@ func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
 	return ifnumbers, nil
 }
 
+// context returns libusbCtx, the device handle belongs to
+func (devhandle *UsbDevHandle) context() (*libusbCtx, error) {
+	ctx, ok := libusbHandles.Load((*C.libusb_device_handle)(devhandle))
+	if !ok {
+		return nil, errors.New("libusb: device handle is not open")
+	}
+
+	return ctx.(*libusbCtx), nil
+}
+
+// usable returns an error, if device handle is closed or its
+// context is abandoned. The fn parameter names libusb function
+// for error reporting
+func (devhandle *UsbDevHandle) usable(fn string) error {
+	ctx, err := devhandle.context()
+	if err != nil {
+		return err
+	}
+
+	if ctx.isDead() {
+		return UsbError{fn, UsbENoDev}
+	}
+
+	return nil
+}
+
 // Close a device
+//
+// If libusb context is abandoned, libusb_close may block forever
+// on the event handling lock, held by the stuck event loop, so
+// the device is closed in background
 func (devhandle *UsbDevHandle) Close() {
-	C.libusb_close((*C.libusb_device_handle)(devhandle))
+	ctx, err := devhandle.context()
+	if err != nil {
+		return
+	}
+
+	libusbHandles.Delete((*C.libusb_device_handle)(devhandle))
+
+	closeHandle := func() {
+		C.libusb_close((*C.libusb_device_handle)(devhandle))
+		ctx.unref()
+	}
+
+	if ctx.isDead() {
+		go closeHandle()
+	} else {
+		closeHandle()
+	}
 }
 
 // Reset a device
+//
+// If libusb context is abandoned, reset is skipped, as it
+// would hang, like any other control transfer
 func (devhandle *UsbDevHandle) Reset() {
+	if devhandle.usable("libusb_reset_device") != nil {
+		return
+	}
+
 	C.libusb_reset_device((*C.libusb_device_handle)(devhandle))
 }
 
@@ -586,6 +1030,13 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 	var cDesc C.libusb_device_descriptor_struct
 	var info UsbDeviceInfo
 
+	// String descriptors are read via control transfers,
+	// that hang, if context is abandoned
+	err := devhandle.usable("libusb_get_string_descriptor_ascii")
+	if err != nil {
+		return info, err
+	}
+
 	// Obtain device descriptor
 	rc := C.libusb_get_device_descriptor(dev, &cDesc)
 	if rc < 0 {
@@ -595,7 +1046,7 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 	// Decode device descriptor
 	info.Vendor = uint16(cDesc.idVendor)
 	info.Product = uint16(cDesc.idProduct)
-	info.BasicCaps = devhandle.usbIppBasicCaps()
+	info.BasicCaps, info.HasBasicCaps = devhandle.usbIppBasicCaps()
 
 	buf := make([]byte, 256)
 
@@ -622,19 +1073,37 @@ func (devhandle *UsbDevHandle) UsbDeviceInfo() (UsbDeviceInfo, error) {
 	}
 
 	info.PortNum = int(C.libusb_get_port_number(dev))
+	info.PortPath = libusbPortPath(dev)
+	info.Speed = libusbSpeed(dev)
 
 	info.FixUp()
 
 	return info, nil
 }
 
+// BasicCaps re-reads basic capabilities of the opened device.
+// Unlike UsbDeviceInfo, only the class-specific descriptor is read
+func (devhandle *UsbDevHandle) BasicCaps() (caps UsbIppBasicCaps,
+	ok bool, err error) {
+
+	err = devhandle.usable("libusb_get_descriptor")
+	if err != nil {
+		return
+	}
+
+	caps, ok = devhandle.usbIppBasicCaps()
+	return
+}
+
 // usbIppBasicCaps reads and decodes printer's
 // Class-specific Device Info Descriptor to obtain device
 // capabilities; see IPP USB specification, section 4.3 for details
 //
 // This function never fails. In a case of errors, it fall backs
-// to the reasonable default
-func (devhandle *UsbDevHandle) usbIppBasicCaps() (caps UsbIppBasicCaps) {
+// to the reasonable default, and ok is false
+func (devhandle *UsbDevHandle) usbIppBasicCaps() (caps UsbIppBasicCaps,
+	ok bool) {
+
 	// Safe default
 	caps = UsbIppBasicCapsPrint |
 		UsbIppBasicCapsScan |
@@ -671,12 +1140,20 @@ func (devhandle *UsbDevHandle) usbIppBasicCaps() (caps UsbIppBasicCaps) {
 		return
 	}
 
-	return UsbIppBasicCaps(bits)
+	return UsbIppBasicCaps(bits), true
 }
 
 // OpenUsbInterface opens an interface
+//
+// Quirks are obtained via the callback, so they can be
+// changed while interface is open
 func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr,
-	quirks Quirks) (*UsbInterface, error) {
+	quirks func() Quirks) (*UsbInterface, error) {
+
+	ctx, err := devhandle.context()
+	if err != nil {
+		return nil, err
+	}
 
 	// Claim the interface
 	rc := C.libusb_claim_interface(
@@ -702,18 +1179,87 @@ func (devhandle *UsbDevHandle) OpenUsbInterface(addr UsbIfAddr,
 		return nil, UsbError{"libusb_set_interface_alt_setting", UsbErrCode(rc)}
 	}
 
-	return &UsbInterface{
-		devhandle: devhandle,
-		addr:      addr,
-		quirks:    quirks,
-	}, nil
+	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
+
+	iface := &UsbInterface{
+		devhandle:   devhandle,
+		ctx:         ctx,
+		addr:        addr,
+		quirks:      quirks,
+		maxBulkRead: libusbSpeed(dev).MaxBulkRead(),
+	}
+
+	// Pre-allocate transfers
+	iface.sendXfer, err = newLibusbTransfer(iface.ctx)
+	if err == nil {
+		iface.recvXfer, err = newLibusbTransfer(iface.ctx)
+	}
+
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+
+	return iface, nil
+}
+
+// OpenUsbConnIO opens IPP-over-USB interface as usbConnIO
+func (devhandle *UsbDevHandle) OpenUsbConnIO(addr UsbIfAddr,
+	quirks func() Quirks) (usbConnIO, error) {
+
+	iface, err := devhandle.OpenUsbInterface(addr, quirks)
+	if err != nil {
+		return nil, err
+	}
+
+	return iface, nil
+}
+
+// libusbPortPath returns physical port path of the device,
+// or "" if it cannot be obtained
+func libusbPortPath(dev *C.libusb_device) string {
+	// Note, USB 3.0 allows up to 7 levels of hubs
+	var ports [7]C.uint8_t
+	cnt := C.libusb_get_port_numbers(dev, &ports[0], C.int(len(ports)))
+	if cnt <= 0 {
+		return ""
+	}
+
+	portnums := make([]int, cnt)
+	for i := range portnums {
+		portnums[i] = int(ports[i])
+	}
+
+	return UsbPortPath(int(C.libusb_get_bus_number(dev)), portnums)
+}
+
+// libusbSpeed returns negotiated speed of the device
+func libusbSpeed(dev *C.libusb_device) UsbSpeed {
+	switch C.libusb_get_device_speed(dev) {
+	case C.LIBUSB_SPEED_LOW:
+		return UsbSpeedLow
+	case C.LIBUSB_SPEED_FULL:
+		return UsbSpeedFull
+	case C.LIBUSB_SPEED_HIGH:
+		return UsbSpeedHigh
+	case C.LIBUSB_SPEED_SUPER:
+		return UsbSpeedSuper
+	case C.LIBUSB_SPEED_SUPER_PLUS:
+		return UsbSpeedSuperPlus
+	}
+
+	return UsbSpeedUnknown
 }
 
 // UsbInterface represents IPP-over-USB interface
 type UsbInterface struct {
-	devhandle *UsbDevHandle // Device handle
-	addr      UsbIfAddr     // Interface address
-	quirks    Quirks        // Device quirks
+	devhandle   *UsbDevHandle   // Device handle
+	ctx         *libusbCtx      // Context of the device handle
+	addr        UsbIfAddr       // Interface address
+	quirks      func() Quirks   // Device quirks
+	maxBulkRead int             // Max size of a single bulk read
+	sendXfer    *libusbTransfer // Transfer for Send
+	recvXfer    *libusbTransfer // Transfer for Recv
 }
 
 // Close the interface
@@ -722,6 +1268,14 @@ func (iface *UsbInterface) Close() {
 		(*C.libusb_device_handle)(iface.devhandle),
 		C.int(iface.addr.Num),
 	)
+
+	if iface.sendXfer != nil {
+		iface.sendXfer.free()
+	}
+
+	if iface.recvXfer != nil {
+		iface.recvXfer.free()
+	}
 }
 
 // SoftReset performs interface soft reset, using class-specific
@@ -736,27 +1290,7 @@ func (iface *UsbInterface) Close() {
 //	pipes get reset to their default states. This clears all stall conditions.
 //	See http://cholla.mmto.org/computers/linux/usb/usbprint11.
 func (iface *UsbInterface) SoftReset() error {
-	rc := C.libusb_control_transfer(
-		(*C.libusb_device_handle)(iface.devhandle),
-		C.LIBUSB_REQUEST_TYPE_CLASS|
-			C.LIBUSB_ENDPOINT_OUT|
-			C.LIBUSB_RECIPIENT_OTHER,
-		2, 0, C.ushort(iface.addr.Num), nil, 0, 5000)
-
-	if rc < 0 {
-		rc = C.libusb_control_transfer(
-			(*C.libusb_device_handle)(iface.devhandle),
-			C.LIBUSB_REQUEST_TYPE_CLASS|
-				C.LIBUSB_ENDPOINT_OUT|
-				C.LIBUSB_RECIPIENT_INTERFACE,
-			2, 0, C.ushort(iface.addr.Num), nil, 0, 5000)
-	}
-
-	if rc < 0 {
-		return UsbError{"libusb_control_transfer", UsbErrCode(rc)}
-	}
-
-	return nil
+	return iface.devhandle.SoftReset(iface.addr.Num)
 }
 
 // Send data to interface. Returns count of bytes actually transmitted
@@ -769,27 +1303,33 @@ func (iface *UsbInterface) Send(ctx context.Context,
 		return 0, ctx.Err()
 	}
 
-	// Allocate a libusb_transfer.
-	xfer, doneChan, err := libusbTransferAlloc()
+	// Lost transfer cannot be reused
+	if err := iface.sendXfer.usable(); err != nil {
+		return 0, err
+	}
+
+	// Copy data into the bounce buffer
+	buf, err := iface.sendXfer.buffer(len(data))
 	if err != nil {
-		return
+		return 0, err
 	}
 
-	defer libusbTransferFree(xfer)
+	copy(iface.sendXfer.bytes(len(data)), data)
 
 	// Setup bulk transfer
+	xfer := iface.sendXfer.xfer
 	C.libusb_fill_bulk_transfer(
 		xfer,
 		(*C.libusb_device_handle)(iface.devhandle),
 		C.uint8_t(iface.addr.Out|C.LIBUSB_ENDPOINT_OUT),
-		(*C.uchar)(unsafe.Pointer(&data[0])),
+		(*C.uchar)(buf),
 		C.int(len(data)),
 		C.libusb_transfer_cb_fn(unsafe.Pointer(C.libusbTransferCallback)),
 		nil,
 		0,
 	)
 
-	if iface.quirks.GetZlpSend() {
+	if iface.quirks().GetZlpSend() {
 		xfer.flags |= C.LIBUSB_TRANSFER_ADD_ZERO_PACKET
 	}
 
@@ -800,16 +1340,7 @@ func (iface *UsbInterface) Send(ctx context.Context,
 	}
 
 	// Wait for completion
-	select {
-	case <-ctx.Done():
-		C.libusb_cancel_transfer(xfer)
-	case <-doneChan:
-	}
-
-	<-doneChan
-	n, err = libusbTransferStatusDecode(ctx, xfer)
-
-	return
+	return iface.sendXfer.wait(ctx)
 }
 
 // Recv data from interface. Returns count of bytes actually transmitted
@@ -825,31 +1356,29 @@ func (iface *UsbInterface) Recv(ctx context.Context,
 		return 0, ctx.Err()
 	}
 
-	// Some versions of Linux kernel don't allow bulk transfers to
-	// be larger that 16kb per URB, and libusb uses some smart-ass
-	// mechanism to avoid this limitation.
-	//
-	// This mechanism seems not to work very reliable on Raspberry Pi
-	// (see #3 for details). So just limit bulk reads to 16kb
-	const MaxBulkRead = 16384
-	if len(data) > MaxBulkRead {
-		data = data[0:MaxBulkRead]
+	// Limit size of bulk reads; see UsbSpeed.MaxBulkRead
+	// for details
+	if len(data) > iface.maxBulkRead {
+		data = data[0:iface.maxBulkRead]
 	}
 
-	// Allocate a libusb_transfer.
-	xfer, doneChan, err := libusbTransferAlloc()
-	if err != nil {
-		return
+	// Lost transfer cannot be reused
+	if err := iface.recvXfer.usable(); err != nil {
+		return 0, err
 	}
 
-	defer libusbTransferFree(xfer)
+	buf, err := iface.recvXfer.buffer(len(data))
+	if err != nil {
+		return 0, err
+	}
 
 	// Setup bulk transfer
+	xfer := iface.recvXfer.xfer
 	C.libusb_fill_bulk_transfer(
 		xfer,
 		(*C.libusb_device_handle)(iface.devhandle),
 		C.uint8_t(iface.addr.In|C.LIBUSB_ENDPOINT_IN),
-		(*C.uchar)(unsafe.Pointer(&data[0])),
+		(*C.uchar)(buf),
 		C.int(len(data)),
 		C.libusb_transfer_cb_fn(unsafe.Pointer(C.libusbTransferCallback)),
 		nil,
@@ -862,19 +1391,29 @@ func (iface *UsbInterface) Recv(ctx context.Context,
 		return 0, UsbError{"libusb_submit_transfer", UsbErrCode(rc)}
 	}
 
-	C.libusb_interrupt_event_handler(libusbContextPtr)
+	C.libusb_interrupt_event_handler(iface.ctx.ptr)
 
-	// Wait for completion
-	select {
-	case <-ctx.Done():
-		C.libusb_cancel_transfer(xfer)
-	case <-doneChan:
+	// Wait for completion and copy received data
+	n, err = iface.recvXfer.wait(ctx)
+	if n > 0 {
+		copy(data, iface.recvXfer.bytes(n))
 	}
 
-	<-doneChan
-	n, err = libusbTransferStatusDecode(ctx, xfer)
+	return n, err
+}
 
-	return
+// MaxPacketSize returns max packet size of the interface's
+// input endpoint, 0 if unknown
+func (iface *UsbInterface) MaxPacketSize() int {
+	dev := C.libusb_get_device((*C.libusb_device_handle)(iface.devhandle))
+	rc := C.libusb_get_max_packet_size(dev,
+		C.uchar(iface.addr.In|C.LIBUSB_ENDPOINT_IN))
+
+	if rc < 0 {
+		return 0
+	}
+
+	return int(rc)
 }
 
 // ClearHalt clears "halted" condition of either input or output endpoint
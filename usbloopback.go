@@ -0,0 +1,384 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Virtual loopback USB device
+ *
+ * usbLoopback emulates an IPP-over-USB device in-process: HTTP
+ * requests, sent to its "interfaces", are parsed and passed to the
+ * http.Handler, and handler's responses are sent back. It allows to
+ * test the whole UsbTransport machinery (quirks, retries, timeouts,
+ * buffering) without hardware
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// usbLoopback implements usbDevIO for the virtual device
+type usbLoopback struct {
+	info       UsbDeviceInfo // Device info
+	handler    http.Handler  // Handler of requests
+	lost       chan struct{} // Closed by Abandon
+	lostOnce   sync.Once     // To close lost only once
+	lock       sync.Mutex    // Protects counters below
+	resets     int           // Count of device resets
+	softResets int           // Count of interface soft resets
+}
+
+// newUsbLoopback creates a new virtual device
+func newUsbLoopback(info UsbDeviceInfo, handler http.Handler) *usbLoopback {
+	return &usbLoopback{
+		info:    info,
+		handler: handler,
+		lost:    make(chan struct{}),
+	}
+}
+
+// newUsbLoopbackTransport creates UsbTransport on a top of the
+// virtual device with the specified number of interfaces
+func newUsbLoopbackTransport(lb *usbLoopback,
+	interfaces int) (*UsbTransport, error) {
+
+	desc := UsbDeviceDesc{Config: 1}
+	for i := 0; i < interfaces; i++ {
+		desc.IfAddrs.Add(UsbIfAddr{Num: i, In: 0x81 + i, Out: 0x01 + i})
+	}
+
+	return newUsbTransport(desc, lb, false)
+}
+
+// UsbDeviceInfo returns device info
+func (lb *usbLoopback) UsbDeviceInfo() (UsbDeviceInfo, error) {
+	return lb.info, nil
+}
+
+// BasicCaps returns basic capabilities from the device info
+func (lb *usbLoopback) BasicCaps() (UsbIppBasicCaps, bool, error) {
+	return lb.info.BasicCaps, lb.info.HasBasicCaps, nil
+}
+
+// Configure does nothing
+func (lb *usbLoopback) Configure(desc UsbDeviceDesc) error {
+	return nil
+}
+
+// ControlTransfer does nothing
+func (lb *usbLoopback) ControlTransfer(requestType, request uint8,
+	value, index uint16) error {
+	return nil
+}
+
+// GetDeviceID returns IEEE 1284 device ID of the virtual device
+func (lb *usbLoopback) GetDeviceID(ifnum, alt int) (string, error) {
+	return lb.info.DeviceID, nil
+}
+
+// SoftReset counts soft resets
+func (lb *usbLoopback) SoftReset(ifnum int) error {
+	lb.lock.Lock()
+	lb.softResets++
+	lb.lock.Unlock()
+	return nil
+}
+
+// OpenUsbConnIO opens the virtual interface
+func (lb *usbLoopback) OpenUsbConnIO(addr UsbIfAddr,
+	quirks func() Quirks) (usbConnIO, error) {
+
+	pr, pw := io.Pipe()
+	conn := &usbLoopbackConn{
+		lb:   lb,
+		rq:   pw,
+		rsp:  make(chan []byte),
+		done: make(chan struct{}),
+		recv: usbLoopbackXfer{done: make(chan struct{}, 1)},
+	}
+
+	go conn.serve(pr)
+
+	return conn, nil
+}
+
+// Reset counts device resets
+func (lb *usbLoopback) Reset() {
+	lb.lock.Lock()
+	lb.resets++
+	lb.lock.Unlock()
+}
+
+// Close does nothing
+func (lb *usbLoopback) Close() {
+}
+
+// Abandon emulates abandoning of the stuck libusb context: all
+// pending and subsequent I/O fails with UsbENoDev
+func (lb *usbLoopback) Abandon() {
+	lb.lostOnce.Do(func() { close(lb.lost) })
+}
+
+// Resets returns count of device and interface resets
+func (lb *usbLoopback) Resets() (resets, softResets int) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.resets, lb.softResets
+}
+
+// usbLoopbackConn implements usbConnIO for the virtual interface
+type usbLoopbackConn struct {
+	lb      *usbLoopback    // Owning device
+	rq      *io.PipeWriter  // Requests are written here
+	rsp     chan []byte     // Responses come from here
+	pending []byte          // Not consumed part of response
+	done    chan struct{}   // Closed by Close
+	once    sync.Once       // To close only once
+	recv    usbLoopbackXfer // Transfer for Recv
+	gen     uint32          // Atomic, incremented by soft reset
+}
+
+// usbLoopbackXfer emulates reusable asynchronous transfer of the
+// real device (see libusbTransfer): transfer runs in background,
+// and Recv waits for its completion by UsbTransferWait.
+//
+// It counts submissions of the transfer, still in flight, so tests
+// can check that transfer is never resubmitted before completion
+// of the previous one, including completion of its cancellation
+type usbLoopbackXfer struct {
+	done     chan struct{} // Signalled on completion
+	cancel   chan struct{} // Closed to cancel the transfer
+	busy     int32         // Atomic, nonzero while in flight
+	overlaps int32         // Atomic, count of submits while in flight
+}
+
+// submit starts the transfer. The xfer callback runs in background
+// and must return soon after the cancel channel is closed
+func (x *usbLoopbackXfer) submit(xfer func(cancel <-chan struct{})) {
+	if !atomic.CompareAndSwapInt32(&x.busy, 0, 1) {
+		atomic.AddInt32(&x.overlaps, 1)
+	}
+
+	x.cancel = make(chan struct{})
+	go func(cancel <-chan struct{}) {
+		xfer(cancel)
+		atomic.StoreInt32(&x.busy, 0)
+		x.done <- struct{}{}
+	}(x.cancel)
+}
+
+// wait waits for the transfer completion, canceling the
+// transfer, if ctx expires. It returns false, if dead is
+// closed before the transfer completes
+func (x *usbLoopbackXfer) wait(ctx context.Context,
+	dead <-chan struct{}) bool {
+	return UsbTransferWait(ctx, x.done, dead,
+		func() { close(x.cancel) })
+}
+
+// serve reads requests, passes them to the handler and
+// sends responses back
+func (conn *usbLoopbackConn) serve(pr *io.PipeReader) {
+	defer pr.Close()
+
+	reader := bufio.NewReader(pr)
+	for {
+		rq, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		gen := atomic.LoadUint32(&conn.gen)
+
+		// Prefetch the body, so handler can't leave it half-read
+		body, err := ioutil.ReadAll(rq.Body)
+		if err != nil {
+			return
+		}
+
+		rq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rq.ContentLength = int64(len(body))
+
+		w := &usbLoopbackResponseWriter{
+			header: make(http.Header),
+			status: http.StatusOK,
+		}
+
+		conn.lb.handler.ServeHTTP(w, rq)
+
+		// Soft reset drops responses in flight
+		if atomic.LoadUint32(&conn.gen) != gen {
+			continue
+		}
+
+		select {
+		case conn.rsp <- w.bytes(rq):
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// Send sends request data to the virtual interface
+//
+// Note, virtual device reads requests eagerly, so Send only
+// blocks while device handles the previous request
+func (conn *usbLoopbackConn) Send(ctx context.Context,
+	data []byte) (int, error) {
+
+	type sendResult struct {
+		n   int
+		err error
+	}
+
+	if err := conn.usable(); err != nil {
+		return 0, err
+	}
+
+	// Pending write is completed or aborted by Close
+	done := make(chan sendResult, 1)
+	go func() {
+		n, err := conn.rq.Write(data)
+		done <- sendResult{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-conn.lb.lost:
+		return 0, conn.usable()
+	}
+}
+
+// Recv receives response data from the virtual interface
+func (conn *usbLoopbackConn) Recv(ctx context.Context,
+	data []byte) (int, error) {
+
+	if err := conn.usable(); err != nil {
+		return 0, err
+	}
+
+	if len(conn.pending) == 0 {
+		var rsp []byte
+		var err error
+
+		conn.recv.submit(func(cancel <-chan struct{}) {
+			select {
+			case rsp = <-conn.rsp:
+			case <-cancel:
+				err = context.Canceled
+			case <-conn.done:
+				err = io.EOF
+			}
+		})
+
+		if !conn.recv.wait(ctx, conn.lb.lost) {
+			return 0, conn.usable()
+		}
+
+		switch {
+		case err == context.Canceled:
+			return 0, ctx.Err()
+		case err != nil:
+			return 0, err
+		}
+
+		conn.pending = rsp
+	}
+
+	n := copy(data, conn.pending)
+	conn.pending = conn.pending[n:]
+
+	return n, nil
+}
+
+// usable returns an error, if device is abandoned
+func (conn *usbLoopbackConn) usable() error {
+	select {
+	case <-conn.lb.lost:
+		return UsbError{"libusb_handle_events", UsbENoDev}
+	default:
+		return nil
+	}
+}
+
+// SoftReset counts interface soft resets. Response in flight
+// and not consumed part of response are dropped
+func (conn *usbLoopbackConn) SoftReset() error {
+	atomic.AddUint32(&conn.gen, 1)
+	conn.pending = nil
+	return conn.lb.SoftReset(0)
+}
+
+// ClearHalt does nothing, as virtual endpoints never halt
+func (conn *usbLoopbackConn) ClearHalt(in bool) error {
+	return nil
+}
+
+// MaxPacketSize returns the max packet size of the USB 2.0
+// bulk endpoint
+func (conn *usbLoopbackConn) MaxPacketSize() int {
+	return 512
+}
+
+// Close the virtual interface
+func (conn *usbLoopbackConn) Close() {
+	conn.once.Do(func() {
+		close(conn.done)
+		conn.rq.Close()
+	})
+}
+
+// usbLoopbackResponseWriter implements http.ResponseWriter
+// for the virtual device
+type usbLoopbackResponseWriter struct {
+	header http.Header  // Response header
+	status int          // HTTP status
+	body   bytes.Buffer // Response body
+}
+
+// Header returns response header
+func (w *usbLoopbackResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader sets HTTP status
+func (w *usbLoopbackResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Write writes response body
+func (w *usbLoopbackResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// bytes returns the whole response, serialized
+func (w *usbLoopbackResponseWriter) bytes(rq *http.Request) []byte {
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+
+	rsp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       rq,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+	}
+
+	buf := &bytes.Buffer{}
+	rsp.Write(buf)
+
+	return buf.Bytes()
+}
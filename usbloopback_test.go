@@ -0,0 +1,642 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * End-to-end tests of UsbTransport over the virtual device
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUsbLoopbackInfo is the UsbDeviceInfo of the virtual device
+var testUsbLoopbackInfo = UsbDeviceInfo{
+	Vendor:        0x1234,
+	Product:       0x5678,
+	SerialNumber:  "LOOPBACK",
+	Manufacturer:  "Virtual",
+	ProductName:   "Loopback Device",
+	MfgAndProduct: "Virtual Loopback Device",
+	BasicCaps:     UsbIppBasicCapsPrint | UsbIppBasicCapsScan,
+}
+
+// TestUsbLoopbackRoundTrip tests request/response exchange
+// over the virtual device
+func TestUsbLoopbackRoundTrip(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " +
+			string(body)))
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+
+	// Small body is prefetched, large is sent chunked. Both
+	// must reach the device intact
+	for _, body := range []string{"", "small", strings.Repeat("x", 65536)} {
+		rsp, err := client.Post("http://localhost/test", "text/plain",
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST: %s", err)
+		}
+
+		data, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		expected := "POST /test " + body
+		if err != nil || string(data) != expected {
+			t.Errorf("POST %d bytes: got %d bytes, %v",
+				len(body), len(data), err)
+		}
+	}
+
+	if transport.TimeoutExpired() {
+		t.Errorf("unexpected timeout")
+	}
+}
+
+// TestUsbLoopbackTimeout tests request timeout over the virtual device
+func TestUsbLoopbackTimeout(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		<-release
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+	defer close(release)
+
+	transport.SetTimeout(100 * time.Millisecond)
+
+	client := &http.Client{Transport: transport}
+	_, err = client.Get("http://localhost/ipp/print")
+	if err == nil {
+		t.Errorf("GET: error expected")
+	}
+
+	if !transport.TimeoutExpired() {
+		t.Errorf("TimeoutExpired() must be true")
+	}
+}
+
+// TestUsbLoopbackTimeoutRetry tests transparent retry of idempotent
+// requests after timeout and connection reset
+func TestUsbLoopbackTimeoutRetry(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+
+	// The first request hangs longer than timeout
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		lock.Lock()
+		calls++
+		first := calls == 1
+		lock.Unlock()
+
+		if first {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		w.Write([]byte("ok"))
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	transport.SetTimeout(200 * time.Millisecond)
+
+	client := &http.Client{Transport: transport}
+
+	// Idempotent request is retried
+	rsp, err := client.Get("http://localhost/ipp/print")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+
+	data, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	if string(data) != "ok" {
+		t.Errorf("GET: unexpected response %q", data)
+	}
+
+	if _, softResets := lb.Resets(); softResets != 1 {
+		t.Errorf("GET: 1 soft reset expected, present %d", softResets)
+	}
+
+	// Non-idempotent request is not retried
+	lock.Lock()
+	calls = 0
+	lock.Unlock()
+
+	_, err = client.Post("http://localhost/eSCL/ScanJobs",
+		"text/xml", strings.NewReader("<scan/>"))
+	if err == nil {
+		t.Errorf("POST: error expected")
+	}
+
+	time.Sleep(200 * time.Millisecond) // Let the handler finish
+
+	lock.Lock()
+	if calls != 1 {
+		t.Errorf("POST: 1 call expected, present %d", calls)
+	}
+	lock.Unlock()
+}
+
+// TestUsbLoopbackSerialize tests the serialize-requests quirk
+func TestUsbLoopbackSerialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-quirks")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test.conf"),
+		[]byte("[Virtual Loopback Device]\n"+
+			"  serialize-requests = true\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	qset, err := LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	saved := Conf.Quirks
+	Conf.Quirks = qset
+	defer func() { Conf.Quirks = saved }()
+
+	// Handler tracks max count of concurrent requests
+	var lock sync.Mutex
+	var active, maxActive int
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		lock.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		active--
+		lock.Unlock()
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 3)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+
+	var done sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			rsp, err := client.Get("http://localhost/test")
+			if err != nil {
+				t.Errorf("GET: %s", err)
+				return
+			}
+			ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+		}()
+	}
+
+	done.Wait()
+
+	if maxActive != 1 {
+		t.Errorf("%d concurrent requests seen, expected 1", maxActive)
+	}
+}
+
+// TestUsbLoopbackOverrideQuirk tests runtime override of quirks
+func TestUsbLoopbackOverrideQuirk(t *testing.T) {
+	lb := newUsbLoopback(testUsbLoopbackInfo, http.NotFoundHandler())
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	saved := transport.Quirks()
+
+	err = transport.OverrideQuirk(QuirkNmZlpSend, "true")
+	if err != nil {
+		t.Fatalf("OverrideQuirk: %s", err)
+	}
+
+	if !transport.Quirks().GetZlpSend() {
+		t.Errorf("%s not overridden", QuirkNmZlpSend)
+	}
+
+	if saved.GetZlpSend() {
+		t.Errorf("previous Quirks modified by override")
+	}
+
+	err = transport.OverrideQuirk(QuirkNmZlpSend, "-")
+	if err != nil {
+		t.Fatalf("OverrideQuirk: %s", err)
+	}
+
+	if transport.Quirks().GetZlpSend() {
+		t.Errorf("%s override not removed", QuirkNmZlpSend)
+	}
+
+	// Invalid overrides must be rejected
+	if transport.OverrideQuirk("no-such-quirk", "true") == nil {
+		t.Errorf("unknown quirk accepted")
+	}
+
+	if transport.OverrideQuirk(QuirkNmZlpSend, "maybe") == nil {
+		t.Errorf("invalid value accepted")
+	}
+}
+
+// TestUsbLoopbackSendAlign tests usb-send-align quirk end-to-end
+func TestUsbLoopbackSendAlign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-quirks")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test.conf"),
+		[]byte("[Virtual Loopback Device]\n"+
+			"  usb-send-align = 64\n"), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	qset, err := LoadQuirksSet(dir)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	saved := Conf.Quirks
+	Conf.Quirks = qset
+	defer func() { Conf.Quirks = saved }()
+
+	// Handler echoes request body
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+
+	for _, body := range []string{"", "hello", strings.Repeat("x", 1000)} {
+		rsp, err := client.Post("http://localhost/echo", "text/plain",
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		data, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if string(data) != body {
+			t.Errorf("body mismatch: sent %d bytes, received %d",
+				len(body), len(data))
+		}
+	}
+}
+
+// TestUsbLoopbackEsclCancel tests that abandoned scanned document
+// cancels the eSCL scan job
+func TestUsbLoopbackEsclCancel(t *testing.T) {
+	canceled := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(strings.Repeat("x", 256*1024)))
+		case "DELETE":
+			canceled <- r.URL.Path
+		}
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	transport, err := newUsbLoopbackTransport(lb, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	client := &http.Client{Transport: transport}
+	rsp, err := client.Get("http://localhost/eSCL/ScanJobs/7/NextDocument")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+
+	// Abandon the document in the middle
+	io.CopyN(ioutil.Discard, rsp.Body, 1024)
+	rsp.Body.Close()
+
+	select {
+	case path := <-canceled:
+		if path != "/eSCL/ScanJobs/7" {
+			t.Errorf("DELETE: unexpected path %q", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("scan job not canceled")
+	}
+}
+
+// testUsbConnReader reads from usbConnIO without timeout
+type testUsbConnReader struct {
+	conn usbConnIO
+}
+
+// Read reads from the testUsbConnReader
+func (r testUsbConnReader) Read(p []byte) (int, error) {
+	return r.conn.Recv(context.Background(), p)
+}
+
+// TestUsbLoopbackCancelReuse tests that the interface can be reused
+// immediately after canceled receive, and transfer is never
+// resubmitted before its cancellation completes
+func TestUsbLoopbackCancelReuse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		time.Sleep(time.Millisecond)
+		w.Write(body)
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	iface, err := lb.OpenUsbConnIO(UsbIfAddr{}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer iface.Close()
+
+	// If transfer is reused too early, responses get lost and
+	// exchange hangs, so run it in background
+	errs := make(chan error, 1)
+	go func() {
+		errs <- testUsbLoopbackCancelReuse(iface, 100)
+	}()
+
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("exchange hangs")
+	}
+
+	conn := iface.(*usbLoopbackConn)
+	if n := atomic.LoadInt32(&conn.recv.overlaps); n != 0 {
+		t.Errorf("%d transfers resubmitted while in flight", n)
+	}
+}
+
+// testUsbLoopbackCancelReuse performs count request/response exchanges
+// over the interface. Each response is first received with short
+// timeout, and then the interface is immediately reused to receive
+// the rest of response
+func testUsbLoopbackCancelReuse(iface usbConnIO, count int) error {
+	for i := 0; i < count; i++ {
+		body := strconv.Itoa(i)
+		rq := fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\n"+
+			"Content-Length: %d\r\n\r\n%s", len(body), body)
+
+		_, err := iface.Send(context.Background(), []byte(rq))
+		if err != nil {
+			return fmt.Errorf("Send: %s", err)
+		}
+
+		// Receive races with context expiration. If canceled,
+		// nothing is received
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(i%3)*time.Millisecond)
+		buf := make([]byte, 4096)
+		n, _ := iface.Recv(ctx, buf)
+		cancel()
+
+		// Reuse immediately. The whole response must come
+		reader := io.MultiReader(bytes.NewReader(buf[:n]),
+			testUsbConnReader{iface})
+		rsp, err := http.ReadResponse(bufio.NewReader(reader), nil)
+		if err != nil {
+			return fmt.Errorf("%d: %s", i, err)
+		}
+
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil || string(data) != body {
+			return fmt.Errorf("%d: expected %q, present %q, %v",
+				i, body, data, err)
+		}
+	}
+
+	return nil
+}
+
+// TestUsbLoopbackBasicCapsChanged tests detection of basic caps
+// change of the opened device
+func TestUsbLoopbackBasicCapsChanged(t *testing.T) {
+	lb := newUsbLoopback(testUsbLoopbackInfo, http.NotFoundHandler())
+	transport, err := newUsbLoopbackTransport(lb, 1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if transport.BasicCapsChanged() {
+		t.Errorf("BasicCapsChanged() must be false")
+	}
+
+	// Firmware update disabled scanning
+	lb.info.BasicCaps = UsbIppBasicCapsPrint
+	if !transport.BasicCapsChanged() {
+		t.Errorf("BasicCapsChanged() must be true")
+	}
+
+	// Closed transport is never queried
+	transport.Close(false)
+	if transport.BasicCapsChanged() {
+		t.Errorf("BasicCapsChanged() must be false after Close")
+	}
+}
+
+// TestUsbLoopbackDrainReuse tests that response, abandoned by client,
+// is either drained or the connection is recycled, so stale response
+// bytes never leak into the next response on the same connection
+func TestUsbLoopbackDrainReuse(t *testing.T) {
+	// With a single interface, transport is shared and buffers
+	// up to share-buffer-size bytes of response, so big response
+	// must be larger, to leave something for draining
+	big := strings.Repeat("x", 1024*1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/big" {
+			w.Write([]byte(big))
+		} else {
+			w.Write([]byte("ok"))
+		}
+	})
+
+	saveMaxDrainSize := Conf.UsbMaxDrainSize
+	defer func() { Conf.UsbMaxDrainSize = saveMaxDrainSize }()
+
+	tests := []struct {
+		name         string
+		maxDrainSize int64
+		recycled     bool
+	}{
+		{"drain", 0, false},
+		{"recycle", 4096, true},
+	}
+
+	for _, test := range tests {
+		Conf.UsbMaxDrainSize = test.maxDrainSize
+
+		lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+		transport, err := newUsbLoopbackTransport(lb, 1)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		client := &http.Client{Transport: transport}
+
+		// Abandon the big response after reading its head,
+		// then reuse the only connection several times
+		for i := 0; i < 3; i++ {
+			rsp, err := client.Get("http://localhost/big")
+			if err != nil {
+				t.Fatalf("%s: GET /big: %s", test.name, err)
+			}
+
+			io.CopyN(ioutil.Discard, rsp.Body, 1024)
+			rsp.Body.Close()
+
+			rsp, err = client.Get("http://localhost/small")
+			if err != nil {
+				t.Fatalf("%s: GET /small: %s", test.name, err)
+			}
+
+			data, err := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+
+			if err != nil || string(data) != "ok" {
+				t.Errorf("%s: GET /small: got %d bytes, %v",
+					test.name, len(data), err)
+			}
+		}
+
+		drains := transport.drains.format()
+		transport.Close(false)
+
+		expected := "recycled 0 over budget"
+		if test.recycled {
+			expected = "recycled 3 over budget"
+		}
+
+		if !strings.Contains(drains, "total 3 ") ||
+			!strings.Contains(drains, expected) {
+			t.Errorf("%s: unexpected drain metrics: %q",
+				test.name, drains)
+		}
+	}
+}
+
+// TestUsbLoopbackReadAfterClose tests that response body can't
+// be read after close, while it is drained in background
+func TestUsbLoopbackReadAfterClose(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1024*1024)))
+	})
+
+	lb := newUsbLoopback(testUsbLoopbackInfo, handler)
+	// Note, with 2 interfaces transport is not shared, so response
+	// body is not buffered
+	transport, err := newUsbLoopbackTransport(lb, 2)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	defer transport.Close(false)
+
+	rq, _ := http.NewRequest("GET", "http://localhost/big", nil)
+	rsp, err := transport.RoundTrip(rq)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	io.CopyN(ioutil.Discard, rsp.Body, 1024)
+	rsp.Body.Close()
+
+	_, err = rsp.Body.Read(make([]byte, 1024))
+	if err != http.ErrBodyReadAfterClose {
+		t.Errorf("expected %v, present %v",
+			http.ErrBodyReadAfterClose, err)
+	}
+}
@@ -0,0 +1,124 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB I/O rate limiter
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// usbRateLimiter implements a token bucket rate limiter for USB I/O
+//
+// Bucket capacity is 1/10 of the per-second rate, so I/O is smoothed
+// at the 100ms scale. Tokens may go negative: caller takes as many
+// tokens as it has actually transferred, and the debt is paid later
+// by waiting
+type usbRateLimiter struct {
+	rate   float64   // Rate, bytes per second
+	burst  float64   // Bucket capacity
+	tokens float64   // Currently available tokens
+	last   time.Time // Last time tokens were updated
+}
+
+// newUsbRateLimiter creates a new usbRateLimiter.
+// If rate is 0, it returns nil, which means "unlimited"
+func newUsbRateLimiter(rate uint) *usbRateLimiter {
+	if rate == 0 {
+		return nil
+	}
+
+	rl := &usbRateLimiter{last: time.Now()}
+	rl.setRate(rate)
+	rl.tokens = rl.burst
+
+	return rl
+}
+
+// setRate changes the rate of the usbRateLimiter
+func (rl *usbRateLimiter) setRate(rate uint) {
+	rl.refill()
+
+	rl.rate = float64(rate)
+	rl.burst = float64(rate) / 10
+
+	if rl.burst < 1024 {
+		rl.burst = 1024
+	}
+
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+}
+
+// chunk returns maximum size of a single I/O operation.
+// If align is positive, result is rounded down to the multiple
+// of align, but never less that align. Align needs not to be
+// a power of 2
+func (rl *usbRateLimiter) chunk(size, align int) int {
+	max := int(rl.burst)
+	if align > 0 {
+		max -= max % align
+		if max < align {
+			max = align
+		}
+	}
+
+	if size > max {
+		size = max
+	}
+
+	return size
+}
+
+// take takes n tokens from the bucket. The bucket may become
+// negative, then subsequent wait will pay the debt
+func (rl *usbRateLimiter) take(n int) {
+	rl.refill()
+	rl.tokens -= float64(n)
+}
+
+// delay returns time to wait until bucket becomes non-negative
+func (rl *usbRateLimiter) delay() time.Duration {
+	rl.refill()
+	if rl.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// wait waits until bucket becomes non-negative or context expires
+func (rl *usbRateLimiter) wait(ctx context.Context) error {
+	delay := rl.delay()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		rl.refill()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refill adds tokens, accumulated since last update
+func (rl *usbRateLimiter) refill() {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	rl.last = now
+
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+}
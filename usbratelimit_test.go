@@ -0,0 +1,99 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB I/O rate limiter
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestUsbRateLimiterChunk tests usbRateLimiter.chunk
+func TestUsbRateLimiterChunk(t *testing.T) {
+	type testData struct {
+		rate     uint // Rate, bytes per second
+		size     int  // Requested size
+		align    int  // Alignment
+		expected int  // Expected chunk size
+	}
+
+	tests := []testData{
+		// Burst is rate/10, but not less that 1024
+		{100000, 4096, 0, 4096},
+		{100000, 20000, 0, 10000},
+		{1000, 4096, 0, 1024},
+
+		// Power of 2 alignment
+		{100000, 20000, 512, 9728},
+		{100000, 20000, 4096, 8192},
+
+		// Alignment, that is not power of 2
+		{100000, 20000, 1000, 10000},
+		{100000, 20000, 3000, 9000},
+		{100000, 20000, 1023, 9207},
+
+		// Chunk is never less that alignment
+		{1000, 20000, 2000, 2000},
+
+		// Invalid alignment is ignored
+		{100000, 20000, -512, 10000},
+	}
+
+	for _, test := range tests {
+		rl := newUsbRateLimiter(test.rate)
+		chunk := rl.chunk(test.size, test.align)
+		if chunk != test.expected {
+			t.Errorf("rate=%d, chunk(%d,%d): expected %d, present %d",
+				test.rate, test.size, test.align,
+				test.expected, chunk)
+		}
+	}
+}
+
+// TestUsbRateLimiterRefill tests refill of usbRateLimiter tokens
+func TestUsbRateLimiterRefill(t *testing.T) {
+	type testData struct {
+		tokens   float64       // Tokens before refill
+		elapsed  time.Duration // Time since last refill
+		expected float64       // Expected tokens after refill
+	}
+
+	// Rate is 100000 bytes/sec, burst is 10000 bytes
+	tests := []testData{
+		{0, 10 * time.Millisecond, 1000},
+		{-5000, 10 * time.Millisecond, -4000},
+		{-5000, 50 * time.Millisecond, 0},
+		{5000, 10 * time.Millisecond, 6000},
+
+		// Bucket never overflows
+		{9500, 10 * time.Millisecond, 10000},
+		{0, time.Hour, 10000},
+	}
+
+	for _, test := range tests {
+		rl := newUsbRateLimiter(100000)
+		rl.tokens = test.tokens
+		rl.last = time.Now().Add(-test.elapsed)
+		rl.refill()
+
+		// Allow some slack for time, elapsed by the test itself
+		if rl.tokens < test.expected ||
+			rl.tokens > test.expected+1000 {
+			t.Errorf("%g tokens, %s elapsed: expected %g, present %g",
+				test.tokens, test.elapsed, test.expected, rl.tokens)
+		}
+	}
+
+	// Debt is paid by waiting
+	rl := newUsbRateLimiter(100000)
+	rl.take(10000 + 5000)
+	delay := rl.delay()
+	if delay <= 0 || delay > 50*time.Millisecond {
+		t.Errorf("delay: expected ~50ms, present %s", delay)
+	}
+}
@@ -0,0 +1,134 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB read-ahead buffering of response bodies
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// usbReadAhead reads response body from USB in a separate goroutine
+// into the bounded ring buffer, so USB transfers proceed at the device
+// speed, even if client consumes the response slowly
+//
+// Some devices stall, if data is not fetched in time (i.e., scanner
+// runs out of its internal memory while scanning a large document).
+// This is what usb-read-ahead quirk is for
+type usbReadAhead struct {
+	body    io.Reader      // Underlying body
+	buf     []byte         // Ring buffer
+	head    int            // Offset of the first buffered byte
+	count   int            // Count of buffered bytes
+	err     error          // Error from body, returned after data
+	stopped bool           // Reader goroutine is requested to stop
+	lock    sync.Mutex     // Protects all the above
+	cond    *sync.Cond     // Signaled when state changes
+	done    sync.WaitGroup // Waits for reader goroutine
+}
+
+// newUsbReadAhead creates a new usbReadAhead and starts reader goroutine
+func newUsbReadAhead(body io.Reader, size int) *usbReadAhead {
+	ra := &usbReadAhead{
+		body: body,
+		buf:  make([]byte, size),
+	}
+
+	ra.cond = sync.NewCond(&ra.lock)
+
+	ra.done.Add(1)
+	go ra.reader()
+
+	return ra
+}
+
+// reader is the reader goroutine. It fills the ring buffer, until
+// EOF, error or stop request
+//
+// Note, the free part of the ring buffer is only accessed by this
+// goroutine, so data is read directly into the buffer without
+// holding the lock
+func (ra *usbReadAhead) reader() {
+	defer ra.done.Done()
+
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	for {
+		for ra.count == len(ra.buf) && !ra.stopped {
+			ra.cond.Wait()
+		}
+
+		if ra.stopped {
+			return
+		}
+
+		// Compute contiguous free space
+		tail := (ra.head + ra.count) % len(ra.buf)
+		end := len(ra.buf)
+		if tail < ra.head {
+			end = ra.head
+		}
+
+		ra.lock.Unlock()
+		n, err := ra.body.Read(ra.buf[tail:end])
+		ra.lock.Lock()
+
+		ra.count += n
+		if err != nil {
+			ra.err = err
+		}
+
+		ra.cond.Broadcast()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read from usbReadAhead
+func (ra *usbReadAhead) Read(p []byte) (int, error) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	for ra.count == 0 && ra.err == nil && !ra.stopped {
+		ra.cond.Wait()
+	}
+
+	if ra.count == 0 {
+		if ra.err == nil {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, ra.err
+	}
+
+	end := ra.head + ra.count
+	if end > len(ra.buf) {
+		end = len(ra.buf)
+	}
+
+	n := copy(p, ra.buf[ra.head:end])
+	ra.head = (ra.head + n) % len(ra.buf)
+	ra.count -= n
+
+	ra.cond.Broadcast()
+
+	return n, nil
+}
+
+// stop stops the reader goroutine and waits until it exits.
+// The rest of the body remains unread
+func (ra *usbReadAhead) stop() {
+	ra.lock.Lock()
+	ra.stopped = true
+	ra.cond.Broadcast()
+	ra.lock.Unlock()
+
+	ra.done.Wait()
+}
@@ -0,0 +1,73 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB read-ahead buffering
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// TestUsbReadAhead tests that data passes through the read-ahead
+// ring buffer unchanged
+func TestUsbReadAhead(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, size := range []int{1, 7, 4096, 200000} {
+		// Note, iotest.OneByteReader makes consumer slow, so
+		// ring buffer wraps around many times
+		body := iotest.HalfReader(bytes.NewReader(data))
+		ra := newUsbReadAhead(body, size)
+
+		received, err := ioutil.ReadAll(iotest.OneByteReader(ra))
+		if err != nil {
+			t.Errorf("size=%d: %s", size, err)
+		}
+
+		if !bytes.Equal(received, data) {
+			t.Errorf("size=%d: data mismatch", size)
+		}
+
+		ra.stop()
+	}
+}
+
+// TestUsbReadAheadStop tests stopping of the read-ahead
+func TestUsbReadAheadStop(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	ra := newUsbReadAhead(pr, 16)
+
+	go pw.Write(make([]byte, 32))
+
+	buf := make([]byte, 8)
+	n, err := io.ReadFull(ra, buf)
+	if n != len(buf) || err != nil {
+		t.Fatalf("ReadFull: %d %v", n, err)
+	}
+
+	// Buffer is full and reader is blocked; stop must not hang
+	go pw.Write(make([]byte, 32))
+	ra.stop()
+
+	_, err = ra.Read(buf)
+	for err == nil {
+		_, err = ra.Read(buf)
+	}
+
+	if err != io.ErrClosedPipe {
+		t.Errorf("after stop: expected %v, got %v", io.ErrClosedPipe, err)
+	}
+}
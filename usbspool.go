@@ -0,0 +1,91 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Spooling of request bodies
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// usbSpool contains spooled request body. Body is kept in memory,
+// if it is small enough, or in the temporary file otherwise
+//
+// Spooled body can be read multiple times, so request can be
+// retransmitted
+type usbSpool struct {
+	mem  []byte   // In-memory body
+	file *os.File // Temporary file, nil if body is in memory
+	size int64    // Body size
+}
+
+// newUsbSpool reads exactly size bytes of body into the new usbSpool
+//
+// Bodies up to maxMem bytes are kept in memory, larger bodies are
+// spooled into the temporary file in the dir directory. The file
+// is unlinked immediately after creation, so it doesn't survive
+// the ipp-usb process
+func newUsbSpool(body io.Reader, size, maxMem int64,
+	dir string) (*usbSpool, error) {
+
+	spool := &usbSpool{size: size}
+
+	if size <= maxMem {
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		_, err := io.CopyN(buf, body, size)
+		if err != nil {
+			return nil, err
+		}
+
+		spool.mem = buf.Bytes()
+		return spool, nil
+	}
+
+	os.MkdirAll(dir, 0700)
+	file, err := ioutil.TempFile(dir, "spool-")
+	if err != nil {
+		return nil, err
+	}
+
+	os.Remove(file.Name())
+
+	_, err = io.CopyN(file, body, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	spool.file = file
+	return spool, nil
+}
+
+// Reader returns a new reader of the spooled body, starting
+// from the beginning
+func (spool *usbSpool) Reader() io.ReadCloser {
+	if spool.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(spool.file,
+			0, spool.size))
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(spool.mem))
+}
+
+// InMemory tells if body is spooled in memory
+func (spool *usbSpool) InMemory() bool {
+	return spool.file == nil
+}
+
+// Close the usbSpool and release its resources
+func (spool *usbSpool) Close() {
+	if spool.file != nil {
+		spool.file.Close()
+	}
+	spool.mem = nil
+}
@@ -0,0 +1,64 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for spooling of request bodies
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestUsbSpool tests in-memory and on-disk spooling
+func TestUsbSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-spool")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := strings.Repeat("0123456789", 100)
+
+	for _, maxMem := range []int64{int64(len(data)), 100} {
+		body := strings.NewReader(data + "extra")
+		spool, err := newUsbSpool(body, int64(len(data)), maxMem, dir)
+		if err != nil {
+			t.Fatalf("maxMem=%d: %s", maxMem, err)
+		}
+
+		inMemory := maxMem >= int64(len(data))
+		if spool.InMemory() != inMemory {
+			t.Errorf("maxMem=%d: InMemory()=%v", maxMem,
+				spool.InMemory())
+		}
+
+		// Body must be readable twice
+		for i := 0; i < 2; i++ {
+			got, err := ioutil.ReadAll(spool.Reader())
+			if err != nil || string(got) != data {
+				t.Errorf("maxMem=%d: read %d: %d bytes, %v",
+					maxMem, i, len(got), err)
+			}
+		}
+
+		spool.Close()
+	}
+
+	// Temporary files must not remain on disk
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("%d files left in spool directory", len(files))
+	}
+
+	// Short body must fail
+	_, err = newUsbSpool(strings.NewReader("short"), 100, 10, dir)
+	if err == nil {
+		t.Errorf("short body: error not returned")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,6 +21,8 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -31,15 +34,51 @@ type UsbTransport struct {
 	addr           UsbAddr       // Device address
 	info           UsbDeviceInfo // USB device info
 	log            *Logger       // Device's own logger
-	dev            *UsbDevHandle // Underlying USB device
+	dev            usbDevIO      // Underlying USB device
 	connPool       chan *usbConn // Pool of idle connections
 	connList       []*usbConn    // List of all connections
 	connReleased   chan struct{} // Signalled when connection released
+	serialize      chan struct{} // Request token, if serialize-requests
 	shutdown       chan struct{} // Closed by Shutdown()
 	connstate      *usbConnState // Connections state tracker
+	shared         bool          // Single connection shared between clients
 	quirks         Quirks        // Device quirks
+	quirksLock     sync.RWMutex  // Protects quirks
 	timeout        time.Duration // Timeout for requests (0 is none)
 	timeoutExpired uint32        // Atomic non-zero, if timeout expired
+	persistent     bool          // Not a virtual device
+	zlpRecvAuto    uint32        // Atomic non-zero, if zlp-recv-hack learned
+	zlpRecvHits    int32         // Count of ZLP+timeout events seen
+	zlpRecvLearned func()        // Called when zlp-recv-hack learned
+	recvAlign      int32         // Atomic receive buffer alignment
+	recvAlignLearn func(int)     // Called when recvAlign learned
+	sendRate       int64         // Atomic learned drain rate, bytes/sec
+	sendSamples    int32         // Atomic count of drain rate samples
+	sendRateLearn  func(int)     // Called when sendRate learned
+	icons          *Icons        // Locally cached icons, if any
+	httpPort       int           // HTTP port, for http-XXX quirks
+	bandwidth      *usbBandwidth // Bandwidth limiter, nil if none
+	stats          *DevStats     // Persistent device statistics
+	statsStop      chan struct{} // Closed to stop statistics saver
+	claim          *os.File      // Device claim file, nil if none
+	drains         usbDrains     // Background drains of abandoned responses
+	devLock        sync.Mutex    // Serializes BasicCapsChanged and Close
+	devClosed      bool          // Device is closed, under devLock
+}
+
+// usbDevIO is the low-level I/O interface of the USB device.
+// It is implemented by the UsbDevHandle for real devices, and
+// by the usbLoopback for the virtual, in-process device
+type usbDevIO interface {
+	UsbDeviceInfo() (UsbDeviceInfo, error)
+	BasicCaps() (caps UsbIppBasicCaps, ok bool, err error)
+	Configure(desc UsbDeviceDesc) error
+	ControlTransfer(requestType, request uint8, value, index uint16) error
+	GetDeviceID(ifnum, alt int) (string, error)
+	SoftReset(ifnum int) error
+	OpenUsbConnIO(addr UsbIfAddr, quirks func() Quirks) (usbConnIO, error)
+	Reset()
+	Close()
 }
 
 // NewUsbTransport creates new http.RoundTripper backed by IPP-over-USB
@@ -50,6 +89,19 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		return nil, err
 	}
 
+	return newUsbTransport(desc, dev, true)
+}
+
+// newUsbTransport creates new UsbTransport on a top of the opened
+// device. On failure, device is closed
+//
+// If persistent is false, device log and statistics are not
+// used; this is for virtual devices
+func newUsbTransport(desc UsbDeviceDesc, dev usbDevIO,
+	persistent bool) (*UsbTransport, error) {
+
+	var err error
+
 	// Create UsbTransport
 	transport := &UsbTransport{
 		addr:         desc.UsbAddr,
@@ -57,22 +109,54 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		dev:          dev,
 		connReleased: make(chan struct{}, 1),
 		shutdown:     make(chan struct{}),
+		recvAlign:    UsbRecvAlign,
+		persistent:   persistent,
 	}
 
+	// Device's logger buffers everything until device is identified.
+	// Then buffered lines go to the device log file or, if device
+	// cannot be identified, to the main log
+	//
+	// Log of virtual device goes nowhere
+	if persistent {
+		transport.log.Cc(Console)
+		if Journal.IsJournald() {
+			transport.log.Cc(Journal)
+		}
+	}
+	transport.log.Debug(' ', "%s: opening device", desc.UsbAddr)
+
 	// Obtain device info
 	transport.info, err = dev.UsbDeviceInfo()
 	if err != nil {
+		transport.logInitFailed(err)
 		dev.Close()
 		return nil, err
 	}
 
-	transport.log.Cc(Console)
-	transport.log.ToDevFile(transport.info)
-	transport.log.SetLevels(Conf.LogDevice)
+	if persistent {
+		transport.log.ToDevFile(transport.info)
+		if Conf.LogAsync {
+			transport.log.Async()
+		}
+	} else {
+		transport.log.ToNowhere()
+	}
+	transport.log.SetFormat(Conf.LogFormat)
+
+	// Adapt receive buffers alignment to the link speed
+	transport.recvAlign = int32(transport.info.Speed.RecvAlign())
 
 	// Setup quirks
-	transport.quirks = Conf.Quirks.MatchByModelName(
-		transport.info.MfgAndProduct)
+	transport.setQuirks(Conf.Quirks.MatchByDevice(transport.info))
+
+	// Load statistics
+	if persistent {
+		transport.stats = LoadDevStats(transport.info.Ident(),
+			transport.info.Comment())
+	} else {
+		transport.stats = &DevStats{}
+	}
 
 	// Write device info to the log
 	log := transport.log.Begin().
@@ -81,6 +165,8 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		Info('+', "%s: opened %s", transport.addr, transport.info.ProductName).
 		Debug(' ', "Device info:").
 		Debug(' ', "  USB Port:      %d", transport.info.PortNum).
+		Debug(' ', "  Port path:     %s", transport.info.PortPath).
+		Debug(' ', "  USB speed:     %s", transport.info.Speed).
 		Debug(' ', "  Ident:         %s", transport.info.Ident()).
 		Debug(' ', "  Manufacturer:  %s", transport.info.Manufacturer).
 		Debug(' ', "  Product:       %s", transport.info.ProductName).
@@ -95,11 +181,12 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	transport.dumpUSBparams(log)
 	log.Nl(LogDebug)
 
-	log.Debug(' ', "USB interfaces:")
+	log.Debug(' ', "USB interfaces (using config %d):", desc.Config)
 	log.Debug(' ', "  Config Interface Alt Class SubClass Proto")
+	ifmatch := UsbIfMatch(transport.info.Vendor, transport.info.Product)
 	for _, ifdesc := range desc.IfDescs {
 		prefix := byte(' ')
-		if ifdesc.IsIppOverUsb() {
+		if ifdesc.Config == desc.Config && ifdesc.IsIppOverUsb(ifmatch) {
 			prefix = '*'
 		}
 
@@ -114,15 +201,28 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	var maxconn uint
 
 	// Check for blacklisted device
-	if transport.quirks.GetBlacklist() {
+	if transport.Quirks().GetBlacklist() {
 		err = ErrBlackListed
 		goto ERROR
 	}
 
+	// Check that device is not used by another ipp-usb instance
+	// (i.e., running in another container). Note, it must be done
+	// before the device is reset
+	if persistent {
+		transport.claim, err = UsbClaimAcquire(transport.log,
+			desc, transport.info)
+		if err != nil {
+			goto ERROR
+		}
+	}
+
 	// Hard-reset the device, if needed
-	if transport.quirks.GetInitReset() == QuirkResetHard {
+	if transport.Quirks().GetInitReset() == QuirkResetHard {
 		transport.log.Debug(' ', "Doing USB HARD RESET")
 		dev.Reset()
+		transport.stats.AddReset()
+		transport.addEvent(EventReset, QuirkNmInitReset)
 	}
 
 	// Configure the device
@@ -131,15 +231,18 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		goto ERROR
 	}
 
+	// Obtain IEEE 1284 device ID
+	transport.getDeviceID(desc)
+
 	// Open connections
-	maxconn = transport.quirks.GetUsbMaxInterfaces()
+	maxconn = transport.Quirks().GetUsbMaxInterfaces()
 	if maxconn == 0 {
 		maxconn = math.MaxUint32
 	}
 
 	for i, ifaddr := range desc.IfAddrs {
 		var conn *usbConn
-		conn, err = transport.openUsbConn(i, ifaddr, transport.quirks)
+		conn, err = transport.openUsbConn(i, ifaddr, transport.Quirks())
 		if err != nil {
 			goto ERROR
 		}
@@ -159,6 +262,36 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		transport.connPool <- conn
 	}
 
+	// If requests are serialized, only one connection at a time
+	// may be allocated, regardless of count of interfaces
+	if transport.Quirks().GetSerializeRequests() &&
+		len(transport.connList) > 1 {
+		transport.serialize = make(chan struct{}, 1)
+		transport.serialize <- struct{}{}
+		transport.log.Debug(' ', "USB: requests serialized by the %q quirk",
+			QuirkNmSerializeRequests)
+	}
+
+	// If we have only a single connection (or a single request
+	// at a time), buffer small requests and responses, so clients
+	// will not hold the connection longer than needed
+	if (len(transport.connList) == 1 || transport.serialize != nil) &&
+		Conf.UsbShareBufferSize > 0 {
+		transport.shared = true
+		transport.log.Debug(' ',
+			"USB: single connection, buffering up to %d bytes "+
+				"to share it between clients",
+			Conf.UsbShareBufferSize)
+	}
+
+	// Register with the bandwidth scheduler
+	transport.bandwidth = UsbBandwidthSched.Register(
+		transport.Quirks().GetUsbBandwidthLimit())
+
+	// Start statistics saver
+	transport.statsStop = make(chan struct{})
+	go transport.statsSaver(transport.statsStop)
+
 	return transport, nil
 
 	// Error: cleanup and exit
@@ -167,28 +300,41 @@ ERROR:
 		conn.destroy()
 	}
 
+	// If interface is busy, explain who is competing with us
+	if usberr, ok := err.(UsbError); ok && usberr.Code == UsbEBusy {
+		for _, claim := range UsbClaimsCheck(desc) {
+			transport.log.Error('!', "USB: %s", claim)
+		}
+	}
+
+	transport.logInitFailed(err)
 	dev.Close()
+	UsbClaimRelease(transport.claim)
 	return nil, err
 }
 
+// logInitFailed writes initialization error into the device's log,
+// so the failure context is not split between the main and device
+// logs, and closes the log.
+//
+// If device is not identified yet, device's log is redirected into
+// the main log, with all lines buffered so far
+func (transport *UsbTransport) logInitFailed(err error) {
+	transport.log.Error('!', "%s: initialization failed: %s",
+		transport.addr, err)
+
+	if transport.log.ident == "" {
+		transport.log.ToLogger(Log)
+	}
+
+	transport.log.Close()
+}
+
 // Dump quirks to the UsbTransport's log
 func (transport *UsbTransport) dumpQuirks(log *LogMessage) {
 	log.Debug(' ', "Device quirks:")
-
-	prevMatch := ""
-	for _, q := range transport.quirks.All() {
-		val := q.RawValue
-		if _, isStr := q.Parsed.(string); isStr {
-			val = strconv.Quote(val)
-		}
-
-		if q.Match != prevMatch {
-			prevMatch = q.Match
-			log.Debug(' ', "  [%s]", q.Match)
-		}
-
-		log.Debug(' ', "    ; (%s)", q.Origin)
-		log.Debug(' ', "    %s = %s", q.Name, val)
+	for _, line := range transport.Quirks().Format() {
+		log.Debug(' ', "  %s", line)
 	}
 }
 
@@ -249,17 +395,43 @@ func (transport *UsbTransport) connInUse() int {
 // were failed due to timeout, device reset is required, because
 // at this case synchronization with device will probably be lost.
 //
-// A zero value for t means no timeout
+// A zero value for t means no timeout. In this case, per-URL
+// timeouts, configured by the timeout-ipp, timeout-escl and
+// timeout-web quirks, are in effect
 func (transport *UsbTransport) SetTimeout(t time.Duration) {
 	transport.timeout = t
 }
 
+// requestTimeout returns timeout for the request, depending on
+// its route (see httpRouteLookup). 0 means no timeout
+func (transport *UsbTransport) requestTimeout(rq *http.Request) time.Duration {
+	if transport.timeout != 0 {
+		return transport.timeout
+	}
+
+	return httpRouteLookup(rq.URL.Path).timeout(transport.Quirks())
+}
+
 // TimeoutExpired returns true if one or more of the preceding HTTP request
 // has failed due to timeout.
 func (transport *UsbTransport) TimeoutExpired() bool {
 	return atomic.LoadUint32(&transport.timeoutExpired) != 0
 }
 
+// timeoutHit marks that request has failed due to timeout
+func (transport *UsbTransport) timeoutHit() {
+	atomic.StoreUint32(&transport.timeoutExpired, 1)
+	transport.addEvent(EventTimeout, "")
+}
+
+// addEvent adds device lifecycle event to the DevEvents.
+// Events of virtual devices are ignored
+func (transport *UsbTransport) addEvent(kind EventKind, detail string) {
+	if transport.persistent {
+		DevEvents.Add(transport.addr, kind, detail)
+	}
+}
+
 // closeShutdownChan closes the transport.shutdown, which effectively
 // disables connections allocation (usbConnGet will return ErrShutdown)
 //
@@ -300,6 +472,8 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 		case <-ctx.Done():
 			transport.log.Error('-', "%s: %s: shutdown timeout expired",
 				transport.addr, transport.info.ProductName)
+			transport.connstate.dumpTrace(transport.log, -1,
+				time.Time{})
 			return ctx.Err()
 		}
 	}
@@ -307,6 +481,54 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// ConnCount returns count of USB connections (interfaces),
+// used by transport
+//
+// As idle connections are allocated in the FIFO order, ConnCount
+// sequential requests go via all connections, if there is no
+// concurrent activity
+func (transport *UsbTransport) ConnCount() int {
+	return len(transport.connList)
+}
+
+// SoftReset performs the class-specific soft reset of all
+// USB interfaces. It waits until all connections become idle
+func (transport *UsbTransport) SoftReset(ctx context.Context) error {
+	var conns []*usbConn
+	defer func() {
+		for _, conn := range conns {
+			conn.put()
+		}
+	}()
+
+	for range transport.connList {
+		conn, err := transport.usbConnGet(ctx, -1)
+		if err != nil {
+			return err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	transport.stats.AddReset()
+	for _, conn := range conns {
+		transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET", conn.index)
+		err := conn.iface.SoftReset()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ControlTransfer sends control transfer without data stage
+// to the device
+func (transport *UsbTransport) ControlTransfer(requestType, request uint8,
+	value, index uint16) error {
+	return transport.dev.ControlTransfer(requestType, request, value, index)
+}
+
 // Close the transport
 func (transport *UsbTransport) Close(reset bool) {
 	// Reset the device, if required
@@ -314,6 +536,8 @@ func (transport *UsbTransport) Close(reset bool) {
 		transport.log.Info('-', "%s: resetting %s",
 			transport.addr, transport.info.ProductName)
 		transport.dev.Reset()
+		transport.stats.AddReset()
+		transport.addEvent(EventReset, "")
 	}
 
 	// Wait until all connections become inactive
@@ -324,9 +548,378 @@ func (transport *UsbTransport) Close(reset bool) {
 		conn.destroy()
 	}
 
+	transport.devLock.Lock()
+	transport.devClosed = true
+	transport.devLock.Unlock()
+
 	transport.dev.Close()
+	UsbClaimRelease(transport.claim)
+	UsbBandwidthSched.Unregister(transport.bandwidth)
 	transport.log.Info('-', "%s: closed %s",
 		transport.addr, transport.info.ProductName)
+
+	// Save statistics
+	if transport.statsStop != nil {
+		close(transport.statsStop)
+	}
+
+	transport.stats.Touch()
+	transport.stats.Save()
+}
+
+// CloseAndRecover closes the transport, recovering the device
+// by the specified step of the reset escalation ladder
+// (see DevWatchdogs)
+//
+// Clear halt and soft reset are only possible when all connections
+// are idle; otherwise, the device is hard-reset
+func (transport *UsbTransport) CloseAndRecover(step DevResetStep) {
+	transport.log.Info('-', "%s: watchdog: %s",
+		transport.addr, step)
+
+	if step > DevResetSoft || transport.connInUse() > 0 {
+		transport.Close(true)
+		return
+	}
+
+	for _, conn := range transport.connList {
+		var err error
+
+		switch step {
+		case DevResetClearHalt:
+			transport.log.Debug(' ', "USB[%d]: doing CLEAR_HALT",
+				conn.index)
+			err = conn.iface.ClearHalt(true)
+			if err == nil {
+				err = conn.iface.ClearHalt(false)
+			}
+
+		case DevResetSoft:
+			transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET",
+				conn.index)
+			err = conn.iface.SoftReset()
+		}
+
+		if err != nil {
+			transport.log.Error('!', "USB[%d]: %s: %s",
+				conn.index, step, err)
+		}
+	}
+
+	if step == DevResetSoft {
+		transport.stats.AddReset()
+	}
+
+	transport.addEvent(EventReset, step.String())
+	transport.Close(false)
+}
+
+// Stats returns device's persistent statistics
+func (transport *UsbTransport) Stats() *DevStats {
+	return transport.stats
+}
+
+// statsSaver periodically saves device statistics, until
+// stop channel is closed
+func (transport *UsbTransport) statsSaver(stop chan struct{}) {
+	ticker := time.NewTicker(DevStatsSaveInterval)
+	defer ticker.Stop()
+
+	var xferCount uint64
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			transport.stats.Touch()
+			transport.stats.Save()
+			xferCount = transport.dumpXferStats(xferCount)
+		}
+	}
+}
+
+// XferStats returns histograms of USB transfer sizes and latencies
+// of all connections, formatted as text lines
+func (transport *UsbTransport) XferStats() []string {
+	var lines []string
+	for _, conn := range transport.connList {
+		if conn.xfer.count() == 0 {
+			continue
+		}
+
+		for _, line := range conn.xfer.format() {
+			lines = append(lines,
+				fmt.Sprintf("USB[%d] %s", conn.index, line))
+		}
+	}
+
+	if drains := transport.drains.format(); drains != "" {
+		lines = append(lines, drains)
+	}
+
+	return lines
+}
+
+// dumpXferStats writes USB transfer histograms to the device log,
+// if there were transfers since the previous dump. prevCount is the
+// count of transfers at the previous dump, the new count returned
+func (transport *UsbTransport) dumpXferStats(prevCount uint64) uint64 {
+	var count uint64
+	for _, conn := range transport.connList {
+		count += conn.xfer.count()
+	}
+
+	if count != prevCount {
+		log := transport.log.Begin()
+		log.Debug(' ', "USB transfers statistics:")
+		for _, line := range transport.XferStats() {
+			log.Debug(' ', "  %s", line)
+		}
+		log.Commit()
+	}
+
+	return count
+}
+
+// EnableZlpRecvHack enables the zlp-recv-hack behavior, regardless
+// of quirks. It is used when behavior was learned before, and this
+// knowledge is persisted
+func (transport *UsbTransport) EnableZlpRecvHack() {
+	atomic.StoreUint32(&transport.zlpRecvAuto, 1)
+}
+
+// OnZlpRecvHackLearned sets callback, called when transport
+// automatically detects that device needs the zlp-recv-hack
+func (transport *UsbTransport) OnZlpRecvHackLearned(callback func()) {
+	transport.zlpRecvLearned = callback
+}
+
+// zlpRecvHackEnabled tells if zlp-recv-hack is in effect, either
+// due to quirks or learned automatically. Explicitly set quirk
+// takes precedence over the learned behavior
+func (transport *UsbTransport) zlpRecvHackEnabled() bool {
+	quirks := transport.Quirks()
+	if quirks.IsSet(QuirkNmZlpRecvHack) {
+		return quirks.GetZlpRecvHack()
+	}
+
+	return atomic.LoadUint32(&transport.zlpRecvAuto) != 0
+}
+
+// zlpRecvHackHit is called when zero-length packet followed
+// by receive timeout is seen, while zlp-recv-hack is not in effect
+//
+// If it happens repeatedly, zlp-recv-hack is enabled automatically,
+// unless the quirk is explicitly set
+func (transport *UsbTransport) zlpRecvHackHit(conn *usbConn) {
+	if transport.Quirks().IsSet(QuirkNmZlpRecvHack) {
+		return
+	}
+
+	hits := atomic.AddInt32(&transport.zlpRecvHits, 1)
+	transport.log.Debug(' ', "USB[%d]: ZLP followed by timeout (%d of %d)",
+		conn.index, hits, UsbZlpRecvHackThreshold)
+
+	if hits != UsbZlpRecvHackThreshold {
+		return
+	}
+
+	transport.log.Info(' ', "USB[%d]: zlp-recv-hack enabled automatically",
+		conn.index)
+	transport.EnableZlpRecvHack()
+
+	if transport.zlpRecvLearned != nil {
+		transport.zlpRecvLearned()
+	}
+}
+
+// SetRecvAlign sets alignment of USB receive buffers. It is used
+// when alignment was learned before, and this knowledge is persisted
+//
+// Alignment can only be increased, relative to the default,
+// chosen by the USB link speed
+func (transport *UsbTransport) SetRecvAlign(align int) {
+	if align > int(atomic.LoadInt32(&transport.recvAlign)) &&
+		align <= UsbRecvAlignMax {
+		atomic.StoreInt32(&transport.recvAlign, int32(align))
+	}
+}
+
+// SetHTTPPort sets TCP port of the device's HTTP server. It is
+// used for the {port} placeholder in the http-XXX quirks
+func (transport *UsbTransport) SetHTTPPort(port int) {
+	transport.httpPort = port
+}
+
+// httpHeaderExpand expands placeholders in the value of HTTP
+// header, set by the http-XXX quirk:
+//
+//	{port}  - TCP port of the device's HTTP server (80, if none)
+//	{ident} - device ident
+//	{host}  - Host of the request, as received from client
+//
+// Unknown placeholders are left as is
+func (transport *UsbTransport) httpHeaderExpand(value string,
+	rq *http.Request) string {
+
+	if !strings.Contains(value, "{") {
+		return value
+	}
+
+	port := transport.httpPort
+	if port == 0 {
+		port = 80
+	}
+
+	r := strings.NewReplacer(
+		"{port}", strconv.Itoa(port),
+		"{ident}", transport.info.Ident(),
+		"{host}", rq.Host,
+	)
+
+	return r.Replace(value)
+}
+
+// SetIcons sets locally cached device icons. If set, printer-icons
+// URLs in IPP responses are replaced with the local ones
+func (transport *UsbTransport) SetIcons(icons *Icons) {
+	transport.icons = icons
+}
+
+// OnRecvAlignLearned sets callback, called when transport
+// automatically increases alignment of USB receive buffers
+func (transport *UsbTransport) OnRecvAlignLearned(callback func(int)) {
+	transport.recvAlignLearn = callback
+}
+
+// recvOverflow is called when USB receive fails with overflow.
+// It increases alignment of receive buffers and returns the new
+// alignment
+//
+// Overflow happens, when device sends more data, that fits the
+// receive buffer, which is only possible, if buffer size is not
+// the multiple of the endpoint's max packet size
+func (transport *UsbTransport) recvOverflow(conn *usbConn) int {
+	old := int(atomic.LoadInt32(&transport.recvAlign))
+	maxPacket := conn.iface.MaxPacketSize()
+
+	align := old * 2
+	for align < maxPacket {
+		align *= 2
+	}
+
+	if align > UsbRecvAlignMax {
+		align = UsbRecvAlignMax
+	}
+
+	transport.log.Info(' ',
+		"USB[%d]: overflow, max packet size %d; alignment %d->%d",
+		conn.index, maxPacket, old, align)
+
+	if align != old &&
+		atomic.CompareAndSwapInt32(&transport.recvAlign,
+			int32(old), int32(align)) &&
+		transport.recvAlignLearn != nil {
+		transport.recvAlignLearn(align)
+	}
+
+	return align
+}
+
+// SetSendRate sets device drain rate (bytes per second), used by
+// the adaptive usb-send-delay mode. It is used when rate was learned
+// before, and this knowledge is persisted
+func (transport *UsbTransport) SetSendRate(rate int) {
+	if rate <= 0 {
+		return
+	}
+
+	if rate < UsbSendRateMin {
+		rate = UsbSendRateMin
+	}
+
+	atomic.StoreInt64(&transport.sendRate, int64(rate))
+}
+
+// OnSendRateLearned sets callback, called when transport
+// automatically estimates device drain rate. Rate 0 means
+// that delays are not needed anymore
+func (transport *UsbTransport) OnSendRateLearned(callback func(int)) {
+	transport.sendRateLearn = callback
+}
+
+// sendRateUpdate is called after each USB write. In the adaptive
+// usb-send-delay mode, it estimates device drain rate, used to size
+// delays between subsequent writes
+//
+// Writes, stalled by device, decrease the rate toward the measured
+// value. Very long stalls (out of paper, paper jam, warm-up) tell
+// nothing about the drain rate and ignored. Writes, not stalled,
+// slowly increase the rate, so a single bad sample doesn't throttle
+// device forever; when rate grows high enough, delays are disabled.
+//
+// Only every UsbSendRateSamples-th stall sample is persisted, so
+// a single sample never survives restart
+func (transport *UsbTransport) sendRateUpdate(conn *usbConn, n int,
+	elapsed time.Duration) {
+
+	if !conn.sendAdapt || n < UsbSendStallMinSize ||
+		elapsed > UsbSendStallMaxTime {
+		return
+	}
+
+	old := atomic.LoadInt64(&transport.sendRate)
+	stalled := elapsed >= UsbSendStallTime
+	persist := false
+
+	var rate int64
+	switch {
+	case stalled:
+		rate = int64(n) * int64(time.Second) / int64(elapsed)
+		if rate < UsbSendRateMin {
+			rate = UsbSendRateMin
+		}
+
+		if old != 0 {
+			if rate >= old {
+				return
+			}
+			rate = (old + rate) / 2
+		}
+
+		samples := atomic.AddInt32(&transport.sendSamples, 1)
+		persist = samples%UsbSendRateSamples == 0
+
+	case old == 0:
+		return
+
+	default:
+		rate = old + old/UsbSendRateRecover
+		if rate > UsbSendRateMax {
+			rate = 0
+			persist = true
+		}
+	}
+
+	if !atomic.CompareAndSwapInt64(&transport.sendRate, old, rate) {
+		return
+	}
+
+	switch {
+	case stalled:
+		transport.log.Info(' ',
+			"USB[%d]: send of %d bytes stalled for %s, drain rate %d bytes/s",
+			conn.index, n, elapsed, rate)
+	case rate == 0:
+		transport.log.Info(' ',
+			"USB[%d]: drain rate recovered, send delays disabled",
+			conn.index)
+	}
+
+	if persist && transport.sendRateLearn != nil {
+		transport.sendRateLearn(int(rate))
+	}
 }
 
 // Log returns device's own logger
@@ -340,11 +933,156 @@ func (transport *UsbTransport) UsbDeviceInfo() UsbDeviceInfo {
 	return transport.info
 }
 
+// BasicCapsChanged re-reads basic capabilities from the device and
+// tells if they were changed since the transport was created (i.e.,
+// after firmware update). If capabilities cannot be obtained or the
+// transport is closed, it returns false
+//
+// Only the class-specific descriptor is read, and it is safe to call
+// this function from any goroutine, concurrently with Close
+func (transport *UsbTransport) BasicCapsChanged() bool {
+	transport.devLock.Lock()
+	defer transport.devLock.Unlock()
+
+	if transport.devClosed {
+		return false
+	}
+
+	caps, ok, err := transport.dev.BasicCaps()
+	if err != nil || (caps == transport.info.BasicCaps &&
+		ok == transport.info.HasBasicCaps) {
+		return false
+	}
+
+	transport.log.Info(' ', "USB: basic caps changed: %s -> %s",
+		transport.info.BasicCaps, caps)
+
+	return true
+}
+
+// setQuirks sets device's quirks and applies settings, derived
+// from quirks, that are not queried on demand (i.e., device log
+// level). It must be used whenever quirks are (re)resolved
+func (transport *UsbTransport) setQuirks(quirks Quirks) {
+	transport.quirksLock.Lock()
+	transport.quirks = quirks
+	transport.quirksLock.Unlock()
+
+	levels := Conf.LogDevice
+	if quirkLevels := quirks.GetLogDeviceLevel(); quirkLevels != 0 {
+		levels = quirkLevels
+	}
+
+	transport.log.SetLevels(levels)
+}
+
+// getDeviceID obtains IEEE 1284 device ID, using the printer class
+// GET_DEVICE_ID request, sent to the first printer class (7/1/x)
+// interface of the current configuration. As model name from device
+// ID is used for quirks matching, quirks are re-resolved
+//
+// Failure is not fatal, as device ID is mostly obtained via IPP
+func (transport *UsbTransport) getDeviceID(desc UsbDeviceDesc) {
+	for _, ifdesc := range desc.IfDescs {
+		if ifdesc.Config != desc.Config ||
+			ifdesc.Class != 7 || ifdesc.SubClass != 1 {
+			continue
+		}
+
+		id, err := transport.dev.GetDeviceID(ifdesc.IfNum, ifdesc.Alt)
+		if err != nil {
+			transport.log.Debug(' ', "GET_DEVICE_ID: %s", err)
+			return
+		}
+
+		if id == "" {
+			return
+		}
+
+		transport.info.DeviceID = id
+
+		log := transport.log.Begin()
+		defer log.Commit()
+
+		log.Debug(' ', "IEEE 1284 device ID: %s", id)
+		transport.rematchQuirks(log, "device ID")
+		return
+	}
+}
+
+// rematchQuirks re-resolves quirks after device info is updated
+// and logs the new quirks, if changed
+func (transport *UsbTransport) rematchQuirks(log *LogMessage, why string) {
+	quirks := Conf.Quirks.MatchByDevice(transport.info)
+
+	changed := false
+	for _, q := range quirks.All() {
+		if q != transport.Quirks().Get(q.Name) {
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		transport.setQuirks(quirks)
+		log.Debug(' ', "Quirks re-resolved for %s:", why)
+		transport.dumpQuirks(log)
+	}
+}
+
+// SetFirmware sets firmware version of the device, obtained at
+// initialization, and re-resolves quirks, as some of them may
+// depend on it
+//
+// Note, quirks, used only before firmware version is known
+// (i.e., init-delay or usb-max-interfaces) are not affected
+func (transport *UsbTransport) SetFirmware(firmware string) {
+	transport.info.Firmware = firmware
+
+	log := transport.log.Begin()
+	defer log.Commit()
+
+	log.Info(' ', "%s: firmware version %s", transport.addr, firmware)
+	transport.rematchQuirks(log, "firmware version")
+}
+
 // Quirks returns device's quirks
 func (transport *UsbTransport) Quirks() Quirks {
+	transport.quirksLock.RLock()
+	defer transport.quirksLock.RUnlock()
 	return transport.quirks
 }
 
+// OverrideQuirk temporarily overrides quirk of the running device.
+// If value is "-", the override is removed and quirk, resolved from
+// the quirks files, is restored
+//
+// Overrides are not persistent: they are lost, when device is
+// reinitialized. So quirks, used only at initialization (i.e.,
+// init-delay or usb-max-interfaces), and USB rate limits have
+// no effect here
+func (transport *UsbTransport) OverrideQuirk(name, value string) error {
+	q, err := QuirkOverride(name, value)
+	if value == "-" {
+		q = Conf.Quirks.MatchByDevice(transport.info).Get(name)
+		if q == nil {
+			err = fmt.Errorf("%q: unknown quirk", name)
+		} else {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	transport.setQuirks(transport.Quirks().With(q))
+	transport.log.Info(' ', "quirk %s = %q (%s), not persistent",
+		q.Name, q.RawValue, q.Origin)
+
+	return nil
+}
+
 // RoundTrip implements http.RoundTripper interface
 func (transport *UsbTransport) RoundTrip(r *http.Request) (
 	*http.Response, error) {
@@ -373,14 +1111,32 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	outreq.Header.Del("Expect")
 
 	// Apply quirks
-	for name, value := range transport.quirks.HTTPHeaders {
-		if value != "" {
+	//
+	// Note, Go's stdlib ignores Host in the request headers
+	// and uses Request.Host instead
+	for name, value := range transport.Quirks().HTTPHeaders {
+		value = transport.httpHeaderExpand(value, rq)
+		switch {
+		case name == "Host":
+			if value != "" {
+				outreq.Host = value
+			}
+		case value != "":
 			outreq.Header.Set(name, value)
-		} else {
+		default:
 			outreq.Header.Del(name)
 		}
 	}
 
+	// Downgrade IPP version, if limited by quirk
+	ippVersion := ippVersionLimit(outreq, transport.Quirks().GetIppVersionMax())
+	if ippVersion != 0 {
+		transport.log.HTTPDebug('>', session,
+			"IPP version %s downgraded to %s, because of %q",
+			ippVersion, transport.Quirks().GetIppVersionMax(),
+			QuirkNmIppVersionMax)
+	}
+
 	// Don't let Go's stdlib to add Connection: close header
 	// automatically
 	outreq.Close = false
@@ -390,17 +1146,56 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		outreq.Header["User-Agent"] = []string{"ipp-usb"}
 	}
 
+	// Count scan jobs. Print jobs are counted by the
+	// usbRequestBodyWrapper, as IPP operation is in the body
+	if outreq.Method == "POST" &&
+		strings.HasSuffix(outreq.URL.Path, "/ScanJobs") {
+		transport.stats.AddJob()
+	}
+
 	// Wrap request body
+	var ippJob *ippJobSniffer
 	if outreq.Body != nil {
-		outreq.Body = &usbRequestBodyWrapper{
+		wrap := &usbRequestBodyWrapper{
 			log:     transport.log,
 			session: session,
 			body:    outreq.Body,
 		}
+
+		if outreq.Header.Get("Content-Type") == "application/ipp" {
+			wrap.ippOp = func(op goipp.Op) {
+				if op == goipp.OpPrintJob || op == goipp.OpCreateJob {
+					transport.stats.AddJob()
+				}
+			}
+
+			ippJob = newIppJobSniffer()
+			wrap.ippJob = ippJob
+		}
+
+		outreq.Body = wrap
 	}
 
 	// Prepare to correctly handle HTTP transaction, in a case
 	// client drops request in a middle of reading body
+	//
+	// Note, only empty or prefetched request can be resent,
+	// if device responds with retryable HTTP status
+	//
+	// If connection is shared between clients, larger bodies are
+	// prefetched, so slow client will not hold the connection
+	//
+	// If request-spool quirk is set, large bodies are spooled,
+	// so they are sent with exact Content-Length and can be resent
+	var prefetched []byte
+	var spool *usbSpool
+	replayable := outreq.ContentLength == 0
+
+	prefetchLimit := int64(16384)
+	if transport.shared && Conf.UsbShareBufferSize > prefetchLimit {
+		prefetchLimit = Conf.UsbShareBufferSize
+	}
+
 	switch {
 	case outreq.ContentLength <= 0:
 		// Nothing to do
@@ -412,7 +1207,7 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 				"body is empty, sending as is")
 		}
 
-	case outreq.ContentLength < 16384:
+	case outreq.ContentLength < prefetchLimit:
 		// Body is small, prefetch it before sending to USB
 		buf := &bytes.Buffer{}
 		_, err := io.CopyN(buf, outreq.Body, outreq.ContentLength)
@@ -422,11 +1217,39 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 
 		outreq.Body.Close()
 		outreq.Body = ioutil.NopCloser(buf)
+		prefetched = buf.Bytes()
+		replayable = true
 
 		transport.log.HTTPDebug('>', session,
 			"body is small (%d bytes), prefetched before sending",
 			buf.Len())
 
+	case transport.Quirks().GetRequestSpool():
+		// Body is large, but device wants it as is. Spool it
+		var err error
+		spool, err = newUsbSpool(outreq.Body, outreq.ContentLength,
+			Conf.UsbSpoolMaxMemory, Conf.UsbSpoolDir)
+		if err != nil {
+			transport.log.HTTPError('!', session,
+				"body spooling: %s", err)
+			return nil, err
+		}
+
+		defer spool.Close()
+
+		outreq.Body.Close()
+		outreq.Body = spool.Reader()
+		replayable = true
+
+		where := "to disk"
+		if spool.InMemory() {
+			where = "in memory"
+		}
+
+		transport.log.HTTPDebug('>', session,
+			"body is large (%d bytes), spooled %s before sending",
+			outreq.ContentLength, where)
+
 	default:
 		// Force chunked encoding, so if client drops request,
 		// we still be able to correctly handle HTTP transaction
@@ -437,15 +1260,132 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		outreq.ContentLength = -1
 	}
 
+	// If usb-send-align is set, small bodies are sent chunked as
+	// well, so the end of request can be padded (see usbSendPad)
+	if transport.Quirks().GetUsbSendAlign() != 0 &&
+		outreq.ContentLength > 0 && spool == nil {
+		transport.log.HTTPDebug('>', session,
+			"body is sent chunked, because of %q",
+			QuirkNmUsbSendAlign)
+
+		outreq.ContentLength = -1
+	}
+
+	// Rewind request body before retry
+	rewind := func() {
+		if prefetched != nil {
+			outreq.Body = ioutil.NopCloser(
+				bytes.NewReader(prefetched))
+		} else if spool != nil {
+			outreq.Body = spool.Reader()
+		}
+	}
+
+	// Idempotent requests are transparently retried once, if
+	// request has timed out and connection was reset
+	retryReset := Conf.UsbTimeoutRetry && replayable &&
+		usbRequestIdempotent(outreq, prefetched)
+
+	// Send request, retrying on retryable HTTP status, if possible
+	retryStatus := transport.Quirks().GetRetryHTTPStatus()
+	delay := UsbRetryHTTPStatusDelay
+
+	for attempt := 1; ; attempt++ {
+		resp, reset, err := transport.roundTripOnce(session, rq, outreq,
+			ippVersion)
+		if reset && retryReset {
+			transport.log.HTTPDebug(' ', session,
+				"request timed out, retrying after connection reset")
+			retryReset = false
+			rewind()
+			continue
+		}
+
+		if err != nil || !replayable ||
+			attempt > UsbRetryHTTPStatusMaxRetries ||
+			!retryStatus.Contains(resp.StatusCode) {
+			if ippJob != nil && ippJob.job {
+				transport.logIppJob(ippJob, resp, err)
+			}
+			return resp, err
+		}
+
+		transport.log.HTTPDebug(' ', session,
+			"retryable status %d, retry %d of %d in %s",
+			resp.StatusCode, attempt, UsbRetryHTTPStatusMaxRetries,
+			delay)
+
+		resp.Body.Close()
+
+		select {
+		case <-time.After(delay):
+		case <-rq.Context().Done():
+			return nil, rq.Context().Err()
+		}
+
+		delay *= 2
+		rewind()
+	}
+}
+
+// usbRequestIdempotent tells if request can be safely resent to
+// device: GET and HEAD requests, except eSCL NextDocument, which
+// consumes the scanned page, and IPP requests that don't change
+// the printer state (i.e., Get-Printer-Attributes)
+//
+// body is the prefetched request body, nil if none
+func usbRequestIdempotent(rq *http.Request, body []byte) bool {
+	switch rq.Method {
+	case "GET", "HEAD":
+		return EsclScanJobOfDocument(rq) == ""
+
+	case "POST":
+		if rq.Header.Get("Content-Type") != goipp.ContentType ||
+			len(body) < 4 {
+			return false
+		}
+
+		op := goipp.Op(binary.BigEndian.Uint16(body[2:4]))
+		return ippCacheReadOnlyOps[op]
+	}
+
+	return false
+}
+
+// logIppJob writes summary of the print job into the log
+func (transport *UsbTransport) logIppJob(sniffer *ippJobSniffer,
+	resp *http.Response, err error) {
+
+	status := ""
+	if err == nil {
+		status = ippJobResponseStatus(resp)
+	}
+
+	transport.log.Info(' ', "%s", sniffer.summary(status, err))
+}
+
+// roundTripOnce performs a single attempt of HTTP transaction,
+// prepared by the RoundTripWithSession
+//
+// If ippVersion is not 0, version of IPP response is restored
+// to this value (see ipp-version-max quirk)
+//
+// If request has timed out before response was received, USB
+// connection is soft-reset (if enabled by the timeout-retry
+// configuration parameter) and reset is true
+func (transport *UsbTransport) roundTripOnce(session int,
+	rq, outreq *http.Request, ippVersion goipp.Version) (
+	resp *http.Response, reset bool, err error) {
+
 	// Log request details
 	transport.log.Begin().
 		HTTPRequest(LogTraceHTTP, '>', session, outreq).
 		Commit()
 
 	// Allocate USB connection
-	conn, err := transport.usbConnGet(rq.Context())
+	conn, err := transport.usbConnGet(rq.Context(), session)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	transport.log.HTTPDebug(' ', session, "connection %d allocated", conn.index)
@@ -461,30 +1401,49 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	// This is important that context is is set after inter-request
 	// or initial delay is already done, so we don't need to bother
 	// with adjusting the timeout.
-	rwctx := context.Background()
-	var cleanupCtx context.CancelFunc
-	if transport.timeout != 0 {
-		rwctx, cleanupCtx = context.WithTimeout(rwctx,
-			transport.timeout)
+	//
+	// The context is always cancelable, so abandoned response
+	// can be aborted, if it takes too long to drain
+	rwctx, cleanupCtx := context.WithCancel(context.Background())
+	if timeout := transport.requestTimeout(outreq); timeout != 0 {
+		var cancel context.CancelFunc
+		rwctx, cancel = context.WithTimeout(rwctx, timeout)
+		abort := cleanupCtx
+		cleanupCtx = func() {
+			cancel()
+			abort()
+		}
 	}
 
 	conn.setRWCtx(rwctx)
 
 	// Send request and receive a response
 	err = outreq.Write(conn)
-	if err != nil {
-		transport.log.HTTPError('!', session, "%s", err)
-		conn.put()
-		cleanupCtx()
-		return nil, err
+	if err == nil {
+		err = conn.flush(outreq.ContentLength <= 0)
+	}
+
+	if err == nil {
+		resp, err = http.ReadResponse(conn.reader, outreq)
 	}
 
-	resp, err := http.ReadResponse(conn.reader, outreq)
 	if err != nil {
 		transport.log.HTTPError('!', session, "%s", err)
+
+		// After timeout, synchronization with device is lost,
+		// so connection needs to be reset before reuse
+		if Conf.UsbTimeoutRetry &&
+			rwctx.Err() == context.DeadlineExceeded {
+			transport.log.HTTPDebug(' ', session,
+				"USB[%d]: timed out, resetting connection",
+				conn.index)
+			conn.softReset(true)
+			reset = true
+		}
+
 		conn.put()
 		cleanupCtx()
-		return nil, err
+		return nil, reset, err
 	}
 
 	// Wrap response body
@@ -494,14 +1453,43 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		body:       resp.Body,
 		conn:       conn,
 		cleanupCtx: cleanupCtx,
+		esclJob:    EsclScanJobOfDocument(outreq),
+	}
+
+	// Start read-ahead, if enabled by quirk
+	if size := transport.Quirks().GetUsbReadAhead(); size != 0 &&
+		resp.ContentLength != 0 {
+		transport.log.HTTPDebug(' ', session,
+			"response body: read-ahead up to %d bytes", size)
+		wrap := resp.Body.(*usbResponseBodyWrapper)
+		wrap.readAhead = newUsbReadAhead(wrap.body, int(size))
 	}
 
 	// Optionally sanitize IPP response
-	if transport.quirks.GetBuggyIppRsp() == QuirkBuggyIppRspSanitize &&
+	if transport.Quirks().GetBuggyIppRsp() == QuirkBuggyIppRspSanitize &&
 		resp.Header.Get("Content-Type") == "application/ipp" {
 		transport.sanitizeIppResponse(session, resp)
 	}
 
+	// Replace printer-icons with locally cached icons
+	if transport.icons != nil &&
+		resp.Header.Get("Content-Type") == "application/ipp" {
+		transport.rewriteIppIcons(session, rq, resp)
+	}
+
+	// Restore IPP version, if request was downgraded
+	if ippVersion != 0 &&
+		resp.Header.Get("Content-Type") == "application/ipp" {
+		transport.restoreIppVersion(session, resp, ippVersion)
+	}
+
+	// If connection is shared between clients, buffer small
+	// response, so connection will be released without waiting
+	// for client to consume the response body
+	if transport.shared {
+		transport.bufferResponse(session, resp)
+	}
+
 	// Log the response
 	if resp != nil {
 		transport.log.Begin().
@@ -510,22 +1498,39 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 			Commit()
 	}
 
-	return resp, nil
+	return resp, false, nil
 }
 
 // sanitizeIppResponse attempts to sanitize IPP response from device
+//
+// The IPP part of message is decoded directly from the response
+// body stream. Only the consumed bytes are buffered (they are needed,
+// if message will be passed as is), and their amount is limited by
+// Conf.UsbIppSanitizeMax, so pathological responses are rejected
+// early, without buffering of the whole message
 func (transport *UsbTransport) sanitizeIppResponse(session int,
 	resp *http.Response) {
 	// Try to prefetch IPP part of message
 	buf := &bytes.Buffer{}
 	buf2 := &bytes.Buffer{}
 
-	tee := io.TeeReader(resp.Body, buf)
+	lim := &ippSanitizeReader{
+		body:  resp.Body,
+		buf:   buf,
+		limit: Conf.UsbIppSanitizeMax,
+	}
+
 	msg := goipp.Message{}
-	err := msg.DecodeEx(tee, goipp.DecoderOptions{EnableWorkarounds: true})
+	err := msg.DecodeEx(lim, goipp.DecoderOptions{EnableWorkarounds: true})
 	if err != nil {
-		transport.log.HTTPDebug(' ', session,
-			"IPP sanitize: decode: %s", err)
+		if lim.exceeded {
+			transport.log.HTTPDebug(' ', session,
+				"IPP sanitize: message exceeds %d bytes",
+				lim.limit)
+		} else {
+			transport.log.HTTPDebug(' ', session,
+				"IPP sanitize: decode: %s", err)
+		}
 		goto REPLACE
 	}
 
@@ -537,6 +1542,7 @@ func (transport *UsbTransport) sanitizeIppResponse(session int,
 	}
 
 	// Re-encode the message correctly
+	buf2.Grow(buf.Len())
 	err = msg.Encode(buf2)
 	if err != nil {
 		transport.log.HTTPDebug(' ', session,
@@ -556,28 +1562,234 @@ func (transport *UsbTransport) sanitizeIppResponse(session int,
 			buf.Len(), buf2.Len())
 	}
 
+	transport.logIppSanitizeDiff(session, buf.Bytes(), buf2.Bytes())
+
 	buf = buf2
 
-	// Replace consumed part of message with re-coded or
-	// saved backup copy
-REPLACE:
-	wrap := resp.Body.(*usbResponseBodyWrapper)
-	wrap.preBody = buf
+	// Replace consumed part of message with re-coded or
+	// saved backup copy
+REPLACE:
+	wrap := resp.Body.(*usbResponseBodyWrapper)
+	wrap.preBody = buf
+}
+
+// logIppSanitizeDiff logs attribute-level difference between
+// the original IPP message and its sanitized version, so firmware
+// bugs can be reported upstream in details
+func (transport *UsbTransport) logIppSanitizeDiff(session int,
+	orig, fixed []byte) {
+
+	changes, err := ippDiffMessages(orig, fixed)
+	if err != nil {
+		transport.log.HTTPDebug(' ', session,
+			"IPP sanitize: diff: %s", err)
+		return
+	}
+
+	log := transport.log.Begin()
+	defer log.Commit()
+
+	log.HTTPDebug(' ', session, "IPP sanitize: %d attributes changed",
+		len(changes))
+
+	for _, chg := range changes {
+		log.HTTPDebug(' ', session, "  %s", chg)
+	}
+}
+
+// restoreIppVersion restores version of the IPP response, when
+// version of request was downgraded because of the ipp-version-max
+// quirk, so client sees the version it has requested
+func (transport *UsbTransport) restoreIppVersion(session int,
+	resp *http.Response, version goipp.Version) {
+
+	wrap := resp.Body.(*usbResponseBodyWrapper)
+	buf := &bytes.Buffer{}
+
+	var hdr [2]byte
+	n, _ := io.ReadFull(wrap, hdr[:])
+	if n == len(hdr) {
+		transport.log.HTTPDebug('<', session,
+			"IPP version %s restored to %s",
+			goipp.Version(binary.BigEndian.Uint16(hdr[:])), version)
+		binary.BigEndian.PutUint16(hdr[:], uint16(version))
+	}
+
+	buf.Write(hdr[:n])
+	if wrap.preBody != nil {
+		buf.ReadFrom(wrap.preBody)
+	}
+
+	wrap.preBody = buf
+}
+
+// rewriteIppIcons replaces printer-icons URLs in the IPP response
+// with URLs of the locally cached icons
+//
+// URLs are made relative to the Host of request, so client gets
+// icons from the same ipp-usb HTTP server it talks to
+func (transport *UsbTransport) rewriteIppIcons(session int,
+	rq *http.Request, resp *http.Response) {
+
+	wrap := resp.Body.(*usbResponseBodyWrapper)
+	rest := wrap.preBody
+	buf := &bytes.Buffer{}
+
+	lim := &ippSanitizeReader{
+		body:  wrap,
+		buf:   buf,
+		limit: Conf.UsbIppSanitizeMax,
+	}
+
+	scheme := "http"
+	if rq.TLS != nil {
+		scheme = "https"
+	}
+
+	msg := goipp.Message{}
+	err := msg.DecodeEx(lim, goipp.DecoderOptions{EnableWorkarounds: true})
+	if err == nil && transport.icons.RewriteIpp(&msg, scheme, rq.Host) {
+		buf2 := &bytes.Buffer{}
+		err = msg.Encode(buf2)
+		if err == nil {
+			transport.log.HTTPDebug(' ', session,
+				"printer-icons replaced with local URLs")
+
+			if resp.ContentLength != -1 {
+				resp.ContentLength += int64(buf2.Len() - buf.Len())
+				resp.Header.Set("Content-Length",
+					strconv.FormatInt(resp.ContentLength, 10))
+			}
+
+			buf = buf2
+		}
+	}
+
+	// Consumed part of message goes first, then not yet
+	// consumed part of previously inserted data, if any
+	if rest != nil {
+		buf.Write(rest.Bytes())
+	}
+
+	wrap.preBody = buf
+}
+
+// ippSanitizeReader feeds IPP decoder from the response body,
+// saving consumed bytes and limiting their amount
+type ippSanitizeReader struct {
+	body     io.Reader     // Response body
+	buf      *bytes.Buffer // Consumed bytes are saved here
+	limit    int64         // Max bytes to consume, 0 if unlimited
+	exceeded bool          // Limit exceeded
+}
+
+// Read from the ippSanitizeReader
+func (lim *ippSanitizeReader) Read(p []byte) (int, error) {
+	if lim.limit > 0 {
+		rest := lim.limit - int64(lim.buf.Len())
+		if rest <= 0 {
+			lim.exceeded = true
+			return 0, fmt.Errorf("IPP message exceeds %d bytes",
+				lim.limit)
+		}
+
+		if int64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+
+	n, err := lim.body.Read(p)
+	lim.buf.Write(p[:n])
+
+	return n, err
+}
+
+// bufferResponse reads response body into memory, up to the
+// share-buffer-size limit. If body fits into the buffer, USB connection
+// is released immediately
+func (transport *UsbTransport) bufferResponse(session int,
+	resp *http.Response) {
+
+	buf := &bytes.Buffer{}
+	_, err := io.CopyN(buf, resp.Body, Conf.UsbShareBufferSize+1)
+
+	body := &usbBufferedBody{buf: buf, err: err}
+	if err == nil {
+		// Body is too large; the rest will be read from USB
+		transport.log.HTTPDebug('<', session,
+			"response body: more than %d bytes, not buffered",
+			Conf.UsbShareBufferSize)
+		body.body = resp.Body
+	} else {
+		// Body is completely received (or failed), release
+		// connection now
+		transport.log.HTTPDebug('<', session,
+			"response body: %d bytes buffered", buf.Len())
+		resp.Body.Close()
+	}
+
+	resp.Body = body
+}
+
+// usbBufferedBody is the response body, partially or completely
+// buffered in memory
+type usbBufferedBody struct {
+	buf  *bytes.Buffer // Buffered part of the body
+	body io.ReadCloser // The rest of the body, nil if none
+	err  error         // Returned when buffer is consumed, if body is nil
+}
+
+// Read from usbBufferedBody
+func (b *usbBufferedBody) Read(p []byte) (int, error) {
+	switch {
+	case b.buf.Len() > 0:
+		return b.buf.Read(p)
+	case b.body != nil:
+		return b.body.Read(p)
+	}
+
+	return 0, b.err
+}
+
+// Close usbBufferedBody
+func (b *usbBufferedBody) Close() error {
+	if b.body != nil {
+		return b.body.Close()
+	}
+	return nil
 }
 
 // usbRequestBodyWrapper wraps http.Request.Body, adding
 // data path instrumentation
 type usbRequestBodyWrapper struct {
-	log     *Logger       // Device's logger
-	session int           // HTTP session, for logging
-	count   int           // Total count of received bytes
-	body    io.ReadCloser // Request.body
-	drained bool          // EOF or error has been seen
+	log     *Logger        // Device's logger
+	session int            // HTTP session, for logging
+	count   int            // Total count of received bytes
+	body    io.ReadCloser  // Request.body
+	drained bool           // EOF or error has been seen
+	ippHdr  [4]byte        // IPP message header (version, operation)
+	ippOp   func(goipp.Op) // Called with IPP operation, if not nil
+	ippJob  *ippJobSniffer // Print job sniffer, if not nil
 }
 
 // Read from usbRequestBodyWrapper
 func (wrap *usbRequestBodyWrapper) Read(buf []byte) (int, error) {
 	n, err := wrap.body.Read(buf)
+
+	// Catch IPP operation code from the message header
+	if wrap.ippOp != nil && wrap.count < len(wrap.ippHdr) {
+		copy(wrap.ippHdr[wrap.count:], buf[:n])
+		if wrap.count+n >= len(wrap.ippHdr) {
+			wrap.ippOp(goipp.Op(binary.BigEndian.Uint16(
+				wrap.ippHdr[2:])))
+			wrap.ippOp = nil
+		}
+	}
+
+	if wrap.ippJob != nil {
+		wrap.ippJob.feed(buf[:n])
+	}
+
 	wrap.count += n
 
 	if err != nil {
@@ -607,33 +1819,59 @@ type usbResponseBodyWrapper struct {
 	session    int                // HTTP session, for logging
 	preBody    *bytes.Buffer      // Data inserted before body, if not nil
 	body       io.ReadCloser      // Response.body
+	readAhead  *usbReadAhead      // Read-ahead buffer, nil if none
 	conn       *usbConn           // Underlying USB connection
 	count      int                // Total count of received bytes
-	drained    bool               // EOF or error has been seen
+	drained    uint32             // Atomic non-zero, if EOF or error seen
+	closed     uint32             // Atomic non-zero, if Close called
+	lock       sync.Mutex         // Serializes Read with drain
 	cleanupCtx context.CancelFunc // Cancel function for I/O Context
+	esclJob    string             // eSCL job URI, if scanned document
 }
 
 // Read from usbResponseBodyWrapper
+//
+// Body may be closed by another goroutine, while Read is in progress
+// (i.e., by the on-the-fly compressor). In this case, draining waits
+// for the pending Read to complete, and next Read fails
 func (wrap *usbResponseBodyWrapper) Read(buf []byte) (int, error) {
+	wrap.lock.Lock()
+	defer wrap.lock.Unlock()
+
+	if atomic.LoadUint32(&wrap.closed) != 0 {
+		return 0, http.ErrBodyReadAfterClose
+	}
+
 	if wrap.preBody != nil && wrap.preBody.Len() > 0 {
 		return wrap.preBody.Read(buf)
 	}
 
-	n, err := wrap.body.Read(buf)
+	n, err := wrap.read(buf)
 	wrap.count += n
 
 	if err != nil {
 		wrap.log.HTTPDebug('<', wrap.session,
 			"response body: got %d bytes; %s", wrap.count, err)
-		wrap.drained = true
+		atomic.StoreUint32(&wrap.drained, 1)
 	}
 	return n, err
 }
 
+// read reads from the response body, via the read-ahead
+// buffer, if enabled
+func (wrap *usbResponseBodyWrapper) read(buf []byte) (int, error) {
+	if wrap.readAhead != nil {
+		return wrap.readAhead.Read(buf)
+	}
+	return wrap.body.Read(buf)
+}
+
 // Close usbResponseBodyWrapper
 func (wrap *usbResponseBodyWrapper) Close() error {
+	atomic.StoreUint32(&wrap.closed, 1)
+
 	// If EOF or error seen, we can close synchronously
-	if wrap.drained {
+	if atomic.LoadUint32(&wrap.drained) != 0 {
 		wrap.cleanup()
 		return nil
 	}
@@ -648,16 +1886,112 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 			}
 		}()
 
-		io.Copy(ioutil.Discard, wrap.body)
-		wrap.cleanup()
+		wrap.lock.Lock()
+		defer wrap.lock.Unlock()
+
+		wrap.drain()
 	}()
 
 	return nil
 }
 
+// drain drains the response body, abandoned by client, and
+// then performs the final cleanup
+//
+// If abandoned response is the scanned document, the eSCL scan
+// job is canceled, so device stops sending the rest of document
+//
+// Amount of drained data is limited by the max-drain-size
+// configuration parameter, and drain time is limited by the
+// max-drain-time. If device sends more or too long, it is considered
+// runaway, and connection is soft-reset instead of further draining.
+// Count of concurrent drains is limited by the max-drains; above
+// this limit, connection is soft-reset without draining
+func (wrap *usbResponseBodyWrapper) drain() {
+	transport := wrap.conn.transport
+
+	body := io.Reader(wrap.body)
+	if wrap.readAhead != nil {
+		body = wrap.readAhead
+	}
+
+	if wrap.esclJob != "" {
+		go transport.esclCancelJob(wrap.session, wrap.esclJob)
+	}
+
+	if !transport.drains.begin() {
+		wrap.log.HTTPError('!', wrap.session,
+			"response body: %d responses already draining; "+
+				"resetting connection", Conf.UsbMaxDrains)
+		wrap.recycle(false)
+		return
+	}
+
+	// Abort I/O, if draining takes too long
+	var timer *time.Timer
+	if Conf.UsbMaxDrainTime != 0 && wrap.cleanupCtx != nil {
+		timer = time.AfterFunc(Conf.UsbMaxDrainTime, wrap.cleanupCtx)
+	}
+
+	limit := Conf.UsbMaxDrainSize
+	var n int64
+	if limit == 0 {
+		n, _ = io.Copy(ioutil.Discard, body)
+	} else {
+		n, _ = io.CopyN(ioutil.Discard, body, limit+1)
+	}
+
+	expired := timer != nil && !timer.Stop()
+
+	switch {
+	case expired:
+		wrap.log.HTTPError('!', wrap.session,
+			"response body: not drained within %s (%d bytes); "+
+				"resetting connection", Conf.UsbMaxDrainTime, n)
+
+	case limit != 0 && n > limit:
+		wrap.log.HTTPError('!', wrap.session,
+			"response body: more than %d bytes drained; "+
+				"resetting connection", limit)
+
+	default:
+		transport.drains.end(n, false)
+		wrap.cleanup()
+		return
+	}
+
+	transport.drains.end(n, true)
+	wrap.recycle(expired)
+}
+
+// recycle soft-resets connection of the abandoned response body,
+// instead of draining it, and then performs the final cleanup. If
+// halted is true, transfer was aborted in the middle, so input
+// endpoint is cleared from halt as well
+func (wrap *usbResponseBodyWrapper) recycle(halted bool) {
+	if wrap.readAhead != nil {
+		wrap.readAhead.stop()
+	}
+
+	wrap.conn.softReset(halted)
+
+	// Note, wrap.body.Close() is not called here, because it
+	// attempts to consume the rest of the body
+	wrap.conn.put()
+	if wrap.cleanupCtx != nil {
+		wrap.cleanupCtx()
+	}
+
+	wrap.log.HTTPDebug('<', wrap.session, "done with response body")
+}
+
 // cleanup performs the final cleanup of the usbResponseBodyWrapper
 // after use.
 func (wrap *usbResponseBodyWrapper) cleanup() {
+	if wrap.readAhead != nil {
+		wrap.readAhead.stop()
+	}
+
 	wrap.body.Close()
 	wrap.conn.put()
 
@@ -669,17 +2003,68 @@ func (wrap *usbResponseBodyWrapper) cleanup() {
 	wrap.log.HTTPDebug('<', wrap.session, "done with response body")
 }
 
+// esclCancelJob cancels eSCL scan job, which document was abandoned
+// by client. session is the session of the abandoned request, for
+// logging; cancel request uses its own session
+func (transport *UsbTransport) esclCancelJob(session int, job string) {
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	transport.log.HTTPDebug(' ', session, "eSCL: canceling scan job %s", job)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		UsbEsclCancelTimeout)
+	defer cancel()
+
+	rq, _ := http.NewRequest("DELETE", "http://localhost"+job, nil)
+	resp, err := transport.RoundTrip(rq.WithContext(ctx))
+	if err != nil {
+		transport.log.HTTPError('!', session,
+			"eSCL: cancel scan job: %s", err)
+		return
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// usbConnIO is the low-level I/O interface of the usbConn.
+// Normally it is implemented by the *UsbInterface
+type usbConnIO interface {
+	Send(ctx context.Context, data []byte) (int, error)
+	Recv(ctx context.Context, data []byte) (int, error)
+	SoftReset() error
+	ClearHalt(in bool) error
+	MaxPacketSize() int
+	Close()
+}
+
 // usbConn implements an USB connection
 type usbConn struct {
-	transport     *UsbTransport   // Transport that owns the connection
-	index         int             // Connection index (for logging)
-	iface         *UsbInterface   // Underlying interface
-	reader        *bufio.Reader   // For http.ReadResponse
-	rwctx         context.Context // For usbConn.Read and usbConn.Write
-	delayUntil    time.Time       // Delay till this time before next request
-	delayInterval time.Duration   // Pause between requests
-	cntRecv       int             // Total bytes received
-	cntSent       int             // Total bytes sent
+	transport  *UsbTransport   // Transport that owns the connection
+	index      int             // Connection index (for logging)
+	iface      usbConnIO       // Underlying interface
+	reader     *bufio.Reader   // For http.ReadResponse
+	rwctx      context.Context // For usbConn.Read and usbConn.Write
+	delayUntil time.Time       // Delay till this time before next request
+	cntRecv    int             // Total bytes received
+	cntSent    int             // Total bytes sent
+	lastRecv   time.Time       // Time of last non-empty receive
+	session    int             // HTTP session, -1 if none
+	allocTime  time.Time       // Time of connection allocation
+	recvLimit  *usbRateLimiter // Receive rate limiter, nil if none
+	sendLimit  *usbRateLimiter // Send rate limiter, nil if none
+	sendAlign  int             // Send alignment, 0 if none
+	sendBuf    []byte          // Not sent yet data, if sendAlign
+	sendDelay  time.Duration   // Fixed usb-send-delay, 0 if none
+	sendAdapt  bool            // Adaptive usb-send-delay
+	sendLast   int             // Size of last USB write
+	sendDone   time.Time       // Time of last USB write completion
+	xfer       usbXferStats    // Transfer sizes and latencies
 }
 
 // Open usbConn
@@ -692,21 +2077,28 @@ func (transport *UsbTransport) openUsbConn(
 
 	// Initialize connection structure
 	conn := &usbConn{
-		transport:     transport,
-		index:         index,
-		delayUntil:    time.Now().Add(quirks.GetInitDelay()),
-		delayInterval: quirks.GetRequestDelay(),
+		transport:  transport,
+		index:      index,
+		delayUntil: time.Now().Add(quirks.GetInitDelay()),
+		recvLimit:  newUsbRateLimiter(quirks.GetUsbRecvRateLimit()),
+		sendLimit:  newUsbRateLimiter(quirks.GetUsbSendRateLimit()),
+		sendAlign:  int(quirks.GetUsbSendAlign()),
+		sendDelay:  quirks.GetUsbSendDelay().Delay,
+		sendAdapt:  quirks.GetUsbSendDelay().Adaptive,
 	}
 
 	conn.reader = bufio.NewReader(conn)
 
 	// Obtain interface
 	var err error
-	conn.iface, err = dev.OpenUsbInterface(ifaddr, quirks)
+	var iface usbConnIO
+	iface, err = dev.OpenUsbConnIO(ifaddr, transport.Quirks)
 	if err != nil {
 		goto ERROR
 	}
 
+	conn.iface = iface
+
 	// Soft-reset interface, if needed
 	if quirks.GetInitReset() == QuirkResetSoft {
 		transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET", index)
@@ -743,27 +2135,63 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 	// from libusb, input buffer size must always
 	// be aligned by 1024 bytes for USB 3.0, 512 bytes
 	// for USB 2.0, so 1024 bytes alignment is safe for
-	// both
+	// both. If device still overflows, alignment is
+	// increased automatically (see recvOverflow)
 	//
-	// However if caller requests less that 1024 bytes, we
+	// However if caller requests less that alignment, we
 	// can't align here simply by shrinking the buffer,
 	// because it will result a zero-size buffer. At
 	// this case we assume caller knows what it is
 	// doing (actually bufio never behaves this way)
-	if n := len(b); n >= 1024 {
-		n &= ^1023
+	align := int(atomic.LoadInt32(&conn.transport.recvAlign))
+	if n := len(b); n >= align {
+		n &= ^(align - 1)
 		b = b[0:n]
 	}
 
+	// Apply usb-recv-rate-limit, if any
+	if conn.recvLimit != nil {
+		err := conn.recvLimit.wait(conn.rwctx)
+		if err != nil {
+			return 0, err
+		}
+
+		b = b[0:conn.recvLimit.chunk(len(b), align)]
+	}
+
+	// Apply device bandwidth limit, if any
+	bandwidth := conn.transport.bandwidth
+	if bandwidth != nil {
+		err := bandwidth.wait(conn.rwctx)
+		if err != nil {
+			return 0, err
+		}
+
+		b = b[0:bandwidth.chunk(len(b), align)]
+	}
+
+	// Overflow is retried only once
+	overflowRetry := true
+
 	// zlp-recv-hack handling
-	zlpRecvHack := conn.transport.quirks.GetZlpRecvHack()
+	zlpRecvHack := conn.transport.zlpRecvHackEnabled()
 	zlpRecv := false
 
-	// Setup deadline
-	backoff := time.Millisecond * 10
+	backoff := time.Duration(0)
 	for {
+		start := time.Now()
 		n, err := conn.iface.Recv(conn.rwctx, b)
+		conn.xfer.addRecv(n, time.Since(start))
 		conn.cntRecv += n
+		conn.transport.stats.AddRecv(n)
+
+		if conn.recvLimit != nil {
+			conn.recvLimit.take(n)
+		}
+
+		if bandwidth != nil {
+			bandwidth.take(n)
+		}
 
 		conn.transport.log.Add(LogTraceHTTP, '<',
 			"USB[%d]: read: wanted %d got %d total %d",
@@ -783,9 +2211,28 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 					return 0, io.EOF
 				}
 
-				atomic.StoreUint32(
-					&conn.transport.timeoutExpired, 1)
+				// Learn the behavior, if it repeats
+				if zlpRecv {
+					conn.transport.zlpRecvHackHit(conn)
+				}
+
+				conn.transport.timeoutHit()
+			}
+		}
+
+		// On overflow, increase alignment and retry
+		if usberr, ok := err.(UsbError); ok &&
+			usberr.Code == UsbEOverflow && overflowRetry {
+			overflowRetry = false
+			align = conn.transport.recvOverflow(conn)
+			if n := len(b); n >= align {
+				b = b[0 : n&^(align-1)]
 			}
+			continue
+		}
+
+		if n != 0 {
+			conn.lastRecv = time.Now()
 		}
 
 		if n != 0 || err != nil {
@@ -793,25 +2240,221 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 		}
 
 		zlpRecv = true
+		backoff = conn.zlpBackoff(backoff)
+
 		conn.transport.log.Debug(' ',
-			"USB[%d]: zero-size read", conn.index)
+			"USB[%d]: zero-size read, retry in %s", conn.index, backoff)
 
 		time.Sleep(backoff)
-		backoff += backoff / 4 // The same as backoff *= 1.25
-		if backoff > time.Millisecond*1000 {
-			backoff = time.Millisecond * 1000
+	}
+}
+
+// zlpBackoff computes the next delay before retrying receive,
+// after zero-length packet is received. prev is the previous
+// delay or 0 for the first retry
+//
+// While response body is actively streaming, short polling is
+// used. Otherwise, the zlp-backoff quirk is obeyed
+func (conn *usbConn) zlpBackoff(prev time.Duration) time.Duration {
+	const (
+		streamMin = time.Millisecond
+		streamMax = 5 * time.Millisecond
+		expMin    = 10 * time.Millisecond
+		expMax    = 1000 * time.Millisecond
+	)
+
+	if !conn.lastRecv.IsZero() &&
+		time.Since(conn.lastRecv) < UsbZlpStreamingWindow {
+		next := prev + streamMin
+		if next > streamMax {
+			next = streamMax
 		}
+		return next
 	}
+
+	backoff := conn.transport.Quirks().GetZlpBackoff()
+	switch backoff.Mode {
+	case QuirkZlpBackoffNone:
+		return 0
+
+	case QuirkZlpBackoffFixed:
+		return backoff.Interval
+	}
+
+	if prev < expMin {
+		return expMin
+	}
+
+	next := prev + prev/4 // The same as prev *= 1.25
+	if next > expMax {
+		next = expMax
+	}
+
+	return next
 }
 
 // Write to USB
 func (conn *usbConn) Write(b []byte) (int, error) {
+	if conn.sendAlign != 0 {
+		return conn.writeAligned(b)
+	}
+
+	return conn.send(b)
+}
+
+// writeAligned implements Write for the usb-send-align quirk
+//
+// Data is buffered and sent in multiples of alignment; the
+// remainder is sent by flush at the end of request. At least
+// 4 bytes are always kept in buffer, so flush can see the
+// terminating CRLF CRLF, needed for padding
+func (conn *usbConn) writeAligned(b []byte) (int, error) {
+	conn.sendBuf = append(conn.sendBuf, b...)
+
+	n := len(conn.sendBuf) - 4
+	if n < conn.sendAlign {
+		return len(b), nil
+	}
+
+	n -= n % conn.sendAlign
+	_, err := conn.send(conn.sendBuf[:n])
+	if err != nil {
+		conn.sendBuf = conn.sendBuf[:0]
+		return 0, err
+	}
+
+	tail := copy(conn.sendBuf, conn.sendBuf[n:])
+	conn.sendBuf = conn.sendBuf[:tail]
+
+	return len(b), nil
+}
+
+// flush sends data, buffered by writeAligned, if any. If pad is
+// true, the end of request is padded to the alignment
+func (conn *usbConn) flush(pad bool) error {
+	if len(conn.sendBuf) == 0 {
+		return nil
+	}
+
+	buf := conn.sendBuf
+	conn.sendBuf = conn.sendBuf[:0]
+
+	if pad {
+		buf = usbSendPad(buf, conn.sendAlign)
+	}
+
+	if len(buf)%conn.sendAlign != 0 {
+		conn.transport.log.Debug(' ',
+			"USB[%d]: %d bytes at the end of request not aligned",
+			conn.index, len(buf)%conn.sendAlign)
+	}
+
+	_, err := conn.send(buf)
+	return err
+}
+
+// usbSendPad pads the end of HTTP request, so its length becomes
+// a multiple of align
+//
+// Padding is inserted as a dummy header field just before the final
+// CRLF, which terminates either the request header or the trailer
+// of the chunked body. If request doesn't end this way, buf is
+// returned as is
+func usbSendPad(buf []byte, align int) []byte {
+	const name = "X-Pad: "
+	const minPad = len(name) + 2
+
+	pad := (align - len(buf)%align) % align
+	if pad == 0 || !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		return buf
+	}
+
+	for pad < minPad {
+		pad += align
+	}
+
+	out := make([]byte, 0, len(buf)+pad)
+	out = append(out, buf[:len(buf)-2]...)
+	out = append(out, name...)
+	out = append(out, strings.Repeat("x", pad-minPad)...)
+	out = append(out, "\r\n\r\n"...)
+
+	return out
+}
+
+// send sends data to USB, applying rate limits, if any
+func (conn *usbConn) send(b []byte) (int, error) {
 	conn.transport.connstate.beginWrite(conn)
 	defer conn.transport.connstate.doneWrite(conn)
 
-	// Setup deadline
+	bandwidth := conn.transport.bandwidth
+	if conn.sendLimit == nil && bandwidth == nil {
+		return conn.write(b)
+	}
+
+	// Apply usb-send-rate-limit and device bandwidth limit:
+	// split data into chunks and wait for bucket before sending
+	// each chunk
+	total := 0
+	for len(b) > 0 {
+		chunk := b
+
+		if conn.sendLimit != nil {
+			err := conn.sendLimit.wait(conn.rwctx)
+			if err != nil {
+				return total, err
+			}
+
+			chunk = chunk[0:conn.sendLimit.chunk(len(chunk), 0)]
+		}
+
+		if bandwidth != nil {
+			err := bandwidth.wait(conn.rwctx)
+			if err != nil {
+				return total, err
+			}
+
+			chunk = chunk[0:bandwidth.chunk(len(chunk), 0)]
+		}
+
+		n, err := conn.write(chunk)
+
+		if conn.sendLimit != nil {
+			conn.sendLimit.take(n)
+		}
+
+		if bandwidth != nil {
+			bandwidth.take(n)
+		}
+
+		total += n
+		b = b[n:]
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// write performs the actual write to USB
+func (conn *usbConn) write(b []byte) (int, error) {
+	err := conn.sendWait()
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
 	n, err := conn.iface.Send(conn.rwctx, b)
+	elapsed := time.Since(start)
+	conn.xfer.addSend(n, elapsed)
 	conn.cntSent += n
+	conn.sendLast = n
+	conn.sendDone = time.Now()
+
+	conn.transport.sendRateUpdate(conn, n, elapsed)
+	conn.transport.stats.AddSent(n)
 
 	conn.transport.log.Add(LogTraceHTTP, '>',
 		"USB[%d]: write: wanted %d sent %d total %d",
@@ -824,28 +2467,100 @@ func (conn *usbConn) Write(b []byte) (int, error) {
 			"USB[%d]: send: %s", conn.index, err)
 
 		if err == context.DeadlineExceeded {
-			atomic.StoreUint32(
-				&conn.transport.timeoutExpired, 1)
+			conn.transport.timeoutHit()
 		}
 	}
 
 	return n, err
 }
 
-// Allocate a connection
-func (transport *UsbTransport) usbConnGet(ctx context.Context) (*usbConn, error) {
+// sendWait implements the usb-send-delay quirk. It waits before
+// the next USB write, so device has time to drain data of the
+// previous write
+//
+// In the adaptive mode, delay is sized by the learned drain rate
+// of device. Time, passed since the previous write, is taken into
+// account
+func (conn *usbConn) sendWait() error {
+	delay := conn.sendDelay
+	if conn.sendAdapt {
+		rate := atomic.LoadInt64(&conn.transport.sendRate)
+		if rate != 0 {
+			delay = time.Duration(int64(conn.sendLast) *
+				int64(time.Second) / rate)
+		}
+	}
+
+	if delay == 0 || conn.sendDone.IsZero() {
+		return nil
+	}
+
+	wait := time.Until(conn.sendDone.Add(delay))
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-conn.rwctx.Done():
+		return conn.rwctx.Err()
+	}
+}
+
+// Allocate a connection on behalf of the HTTP session.
+// Use -1 as session, if connection is not allocated for
+// the HTTP request
+func (transport *UsbTransport) usbConnGet(ctx context.Context,
+	session int) (*usbConn, error) {
+
+	// If requests are serialized, obtain the token first
+	if transport.serialize != nil {
+		if session >= 0 && len(transport.serialize) == 0 {
+			transport.log.HTTPDebug(' ', session,
+				"serialized: waiting for previous request")
+		}
+
+		select {
+		case <-transport.shutdown:
+			return nil, ErrShutdown
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-transport.serialize:
+		}
+	}
+
+	// If all connections are busy, let it be visible in the log
+	if session >= 0 && len(transport.connPool) == 0 {
+		transport.log.HTTPDebug(' ', session,
+			"all connections busy, waiting")
+	}
+
+	var err error
+
 	select {
 	case <-transport.shutdown:
-		return nil, ErrShutdown
+		err = ErrShutdown
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		err = ctx.Err()
 	case conn := <-transport.connPool:
+		conn.session = session
+		conn.allocTime = time.Now()
 		transport.connstate.gotConn(conn)
 		transport.log.Debug(' ', "USB[%d]: connection allocated, %s",
 			conn.index, transport.connstate)
 
 		return conn, nil
 	}
+
+	if transport.serialize != nil {
+		transport.serialize <- struct{}{}
+	}
+
+	return nil, err
 }
 
 // Release the connection
@@ -853,22 +2568,53 @@ func (conn *usbConn) put() {
 	transport := conn.transport
 
 	conn.reader.Reset(conn)
-	conn.delayUntil = time.Now().Add(conn.delayInterval)
+	conn.delayUntil = time.Now().Add(transport.Quirks().GetRequestDelay())
 	conn.cntRecv = 0
 	conn.cntSent = 0
+	conn.lastRecv = time.Time{}
+	conn.sendBuf = conn.sendBuf[:0]
 
 	transport.connstate.putConn(conn)
 	transport.log.Debug(' ', "USB[%d]: connection released, %s",
 		conn.index, transport.connstate)
 
+	if conn.session >= 0 {
+		transport.connstate.dumpTrace(transport.log, conn.session,
+			conn.allocTime)
+	}
+
 	transport.connPool <- conn
 
+	if transport.serialize != nil {
+		transport.serialize <- struct{}{}
+	}
+
 	select {
 	case transport.connReleased <- struct{}{}:
 	default:
 	}
 }
 
+// softReset soft-resets the connection, so it can be reused after
+// the aborted transfer. If halted is true, input endpoint is cleared
+// from halt as well
+func (conn *usbConn) softReset(halted bool) {
+	log := conn.transport.log
+
+	conn.transport.stats.AddReset()
+	err := conn.iface.SoftReset()
+	if err != nil {
+		log.Error('!', "USB[%d]: SOFT_RESET: %s", conn.index, err)
+	}
+
+	if halted {
+		err = conn.iface.ClearHalt(true)
+		if err != nil {
+			log.Error('!', "USB[%d]: CLEAR_HALT: %s", conn.index, err)
+		}
+	}
+}
+
 // Destroy USB connection
 func (conn *usbConn) destroy() {
 	conn.transport.log.Debug(' ', "USB[%d]: closed", conn.index)
@@ -877,49 +2623,173 @@ func (conn *usbConn) destroy() {
 
 // usbConnState tracks connections state, for logging
 type usbConnState struct {
-	alloc []int32 // Per-connection "allocated" flag
-	read  []int32 // Per-connection "reading" flag
-	write []int32 // Per-connection "writing" flag
+	alloc []int32       // Per-connection "allocated" flag
+	read  []int32       // Per-connection "reading" flag
+	write []int32       // Per-connection "writing" flag
+	trace *usbConnTrace // Transitions trace, nil if disabled
+}
+
+// usbConnTrace is the ring buffer of connections state transitions
+//
+// When enabled by the conn-trace configuration parameter, it allows
+// to reconstruct interleaving of concurrent requests (i.e., print and
+// scan) when diagnosing hangs and deadlocks
+type usbConnTrace struct {
+	lock   sync.Mutex          // Access lock
+	events []usbConnTraceEvent // Recorded events (ring buffer)
+	next   int                 // Next slot to be written
+	full   bool                // Ring buffer is full, wrapped around
+}
+
+// usbConnTraceEvent represents a single connection state transition
+type usbConnTraceEvent struct {
+	when    time.Time // Event timestamp
+	index   int       // Connection index
+	session int       // HTTP session, -1 if none
+	event   string    // Event name, i.e., "alloc", "read-begin" etc
+	state   string    // Connections state after event
 }
 
 // newUsbConnState creates a new usbConnState for given
 // number of connections
 func newUsbConnState(cnt int) *usbConnState {
-	return &usbConnState{
+	state := &usbConnState{
 		alloc: make([]int32, cnt),
 		read:  make([]int32, cnt),
 		write: make([]int32, cnt),
 	}
+
+	if Conf.LogConnTrace {
+		state.trace = &usbConnTrace{
+			events: make([]usbConnTraceEvent, UsbConnTraceSize),
+		}
+	}
+
+	return state
 }
 
 // gotConn notifies usbConnState, that connection is allocated
 func (state *usbConnState) gotConn(conn *usbConn) {
 	atomic.AddInt32(&state.alloc[conn.index], 1)
+	state.tracepoint(conn, "alloc")
 }
 
 // putConn notifies usbConnState, that connection is released
 func (state *usbConnState) putConn(conn *usbConn) {
 	atomic.AddInt32(&state.alloc[conn.index], -1)
+	state.tracepoint(conn, "release")
 }
 
 // beginRead notifies usbConnState, that read is started
 func (state *usbConnState) beginRead(conn *usbConn) {
 	atomic.AddInt32(&state.read[conn.index], 1)
+	state.tracepoint(conn, "read-begin")
 }
 
 // doneRead notifies usbConnState, that read is done
 func (state *usbConnState) doneRead(conn *usbConn) {
 	atomic.AddInt32(&state.read[conn.index], -1)
+	state.tracepoint(conn, "read-end")
 }
 
 // beginWrite notifies usbConnState, that write is started
 func (state *usbConnState) beginWrite(conn *usbConn) {
 	atomic.AddInt32(&state.write[conn.index], 1)
+	state.tracepoint(conn, "write-begin")
 }
 
 // doneWrite notifies usbConnState, that write is done
 func (state *usbConnState) doneWrite(conn *usbConn) {
 	atomic.AddInt32(&state.write[conn.index], -1)
+	state.tracepoint(conn, "write-end")
+}
+
+// tracepoint records the connection state transition into
+// the trace, if enabled
+func (state *usbConnState) tracepoint(conn *usbConn, event string) {
+	trace := state.trace
+	if trace == nil {
+		return
+	}
+
+	ev := usbConnTraceEvent{
+		when:    time.Now(),
+		index:   conn.index,
+		session: conn.session,
+		event:   event,
+		state:   state.String(),
+	}
+
+	trace.lock.Lock()
+	trace.events[trace.next] = ev
+	trace.next++
+	if trace.next == len(trace.events) {
+		trace.next = 0
+		trace.full = true
+	}
+	trace.lock.Unlock()
+}
+
+// traceSince returns all recorded events, starting from
+// the specified time, in chronological order
+func (state *usbConnState) traceSince(since time.Time) []usbConnTraceEvent {
+	trace := state.trace
+	if trace == nil {
+		return nil
+	}
+
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+
+	var events []usbConnTraceEvent
+	if trace.full {
+		events = append(events, trace.events[trace.next:]...)
+	}
+	events = append(events, trace.events[:trace.next]...)
+
+	for i := range events {
+		if !events[i].when.Before(since) {
+			return events[i:]
+		}
+	}
+
+	return nil
+}
+
+// dumpTrace writes recorded connections state transitions,
+// starting from the specified time, into the log.
+//
+// Events of all connections are included, so interleaving with
+// concurrent requests can be seen. If session is not -1, trace is
+// attributed to that HTTP session
+func (state *usbConnState) dumpTrace(log *Logger, session int,
+	since time.Time) {
+
+	events := state.traceSince(since)
+	if len(events) == 0 {
+		return
+	}
+
+	msg := log.Begin()
+	defer msg.Commit()
+
+	if session >= 0 {
+		msg.HTTPDebug(' ', session, "USB connections trace:")
+	} else {
+		msg.Debug(' ', "USB connections trace:")
+	}
+
+	start := events[0].when
+	for _, ev := range events {
+		owner := "HTTP[---]"
+		if ev.session >= 0 {
+			owner = fmt.Sprintf("HTTP[%3.3d]", ev.session)
+		}
+
+		msg.Debug(' ', "  +%-10s USB[%d] %s %-11s %s",
+			ev.when.Sub(start).Round(time.Microsecond),
+			ev.index, owner, ev.event, ev.state)
+	}
 }
 
 // String returns a string, representing connections state
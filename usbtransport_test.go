@@ -0,0 +1,637 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB transport
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// TestUsbConnTrace tests USB connections state trace
+func TestUsbConnTrace(t *testing.T) {
+	save := Conf.LogConnTrace
+	Conf.LogConnTrace = true
+	defer func() { Conf.LogConnTrace = save }()
+
+	state := newUsbConnState(2)
+	conn0 := &usbConn{index: 0, session: 1}
+	conn1 := &usbConn{index: 1, session: 2}
+
+	state.gotConn(conn0)
+	state.gotConn(conn1)
+	state.beginWrite(conn0)
+
+	events := state.traceSince(time.Time{})
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	ev := events[2]
+	if ev.index != 0 || ev.session != 1 || ev.event != "write-begin" ||
+		ev.state != "2 in use: a-w a--" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	// Overflow the ring buffer
+	for i := 0; i < UsbConnTraceSize; i++ {
+		state.beginRead(conn1)
+		state.doneRead(conn1)
+	}
+
+	events = state.traceSince(time.Time{})
+	if len(events) != UsbConnTraceSize {
+		t.Fatalf("expected %d events, got %d",
+			UsbConnTraceSize, len(events))
+	}
+
+	for i := 1; i < len(events); i++ {
+		if events[i].when.Before(events[i-1].when) {
+			t.Fatalf("events are not in chronological order")
+		}
+	}
+
+	if ev := events[len(events)-1]; ev.event != "read-end" {
+		t.Errorf("last event: expected read-end, got %s", ev.event)
+	}
+
+	// Trace is not recorded, if disabled
+	Conf.LogConnTrace = false
+	state = newUsbConnState(1)
+	state.gotConn(conn0)
+	if events := state.traceSince(time.Time{}); events != nil {
+		t.Errorf("trace recorded while disabled")
+	}
+}
+
+// TestUsbTransportLogInitFailed tests that initialization failure
+// is logged together with the buffered context
+func TestUsbTransportLogInitFailed(t *testing.T) {
+	saveLog := Log
+	defer func() { Log = saveLog }()
+
+	mainBuf := &bytes.Buffer{}
+	Log = NewLogger()
+	Log.mode = loggerConsole
+	Log.out = mainBuf
+
+	addr := UsbAddr{Bus: 1, Address: 2}
+	err := errors.New("test failure")
+
+	// Failure before device is identified: device log goes
+	// to the main log
+	transport := &UsbTransport{addr: addr, log: NewLogger()}
+	transport.log.Debug(' ', "%s: opening device", addr)
+	transport.logInitFailed(err)
+
+	out := mainBuf.String()
+	if !bytes.Contains(mainBuf.Bytes(), []byte("opening device")) ||
+		!bytes.Contains(mainBuf.Bytes(), []byte("test failure")) {
+		t.Errorf("unidentified device: main log mismatch:\n%s", out)
+	}
+
+	// Failure after device is identified: everything goes
+	// to the device log
+	mainBuf.Reset()
+	devBuf := &bytes.Buffer{}
+
+	transport = &UsbTransport{addr: addr, log: NewLogger()}
+	transport.log.Debug(' ', "%s: opening device", addr)
+	transport.log.ident = "test-device"
+	transport.log.mode = loggerConsole
+	transport.log.out = devBuf
+	transport.logInitFailed(err)
+
+	out = devBuf.String()
+	if !bytes.Contains(devBuf.Bytes(), []byte("opening device")) ||
+		!bytes.Contains(devBuf.Bytes(), []byte("test failure")) {
+		t.Errorf("identified device: device log mismatch:\n%s", out)
+	}
+
+	if mainBuf.Len() != 0 {
+		t.Errorf("identified device: main log is not empty:\n%s",
+			mainBuf)
+	}
+}
+
+// TestUsbTransportBufferResponse tests buffering of responses
+// when connection is shared between clients
+func TestUsbTransportBufferResponse(t *testing.T) {
+	save := Conf.UsbShareBufferSize
+	Conf.UsbShareBufferSize = 16
+	defer func() { Conf.UsbShareBufferSize = save }()
+
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connPool:     make(chan *usbConn, 1),
+		connReleased: make(chan struct{}, 1),
+		connstate:    newUsbConnState(1),
+		shared:       true,
+	}
+
+	test := func(data string) (*http.Response, bool) {
+		conn := &usbConn{transport: transport, session: -1}
+		conn.reader = bufio.NewReader(conn)
+
+		resp := &http.Response{}
+		resp.Body = &usbResponseBodyWrapper{
+			log:  transport.log,
+			body: ioutil.NopCloser(strings.NewReader(data)),
+			conn: conn,
+		}
+
+		transport.bufferResponse(1, resp)
+
+		select {
+		case <-transport.connPool:
+			return resp, true
+		default:
+			return resp, false
+		}
+	}
+
+	// Small response: connection must be released immediately
+	resp, released := test("small")
+	if !released {
+		t.Errorf("small response: connection not released")
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if string(data) != "small" || err != nil {
+		t.Errorf("small response: got %q, %v", data, err)
+	}
+
+	// Large response: connection is held until body is consumed
+	large := strings.Repeat("0123456789", 4)
+	resp, released = test(large)
+	if released {
+		t.Errorf("large response: connection released too early")
+	}
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if string(data) != large || err != nil {
+		t.Errorf("large response: got %q, %v", data, err)
+	}
+
+	resp.Body.Close()
+	select {
+	case <-transport.connPool:
+	default:
+		t.Errorf("large response: connection not released")
+	}
+}
+
+// testUsbConnIO is the usbConnIO, that counts resets
+type testUsbConnIO struct {
+	softResets int32         // Count of SoftReset calls
+	clearHalts int32         // Count of ClearHalt calls
+	sendStall  time.Duration // Simulated duration of Send
+	recvZlps   int32         // Count of ZLPs Recv returns before timeout
+}
+
+func (iface *testUsbConnIO) Send(ctx context.Context,
+	data []byte) (int, error) {
+	time.Sleep(iface.sendStall)
+	return len(data), nil
+}
+
+func (iface *testUsbConnIO) Recv(ctx context.Context,
+	data []byte) (int, error) {
+	if atomic.AddInt32(&iface.recvZlps, -1) >= 0 {
+		return 0, nil
+	}
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (iface *testUsbConnIO) SoftReset() error {
+	atomic.AddInt32(&iface.softResets, 1)
+	return nil
+}
+
+func (iface *testUsbConnIO) ClearHalt(in bool) error {
+	atomic.AddInt32(&iface.clearHalts, 1)
+	return nil
+}
+
+func (iface *testUsbConnIO) MaxPacketSize() int { return 512 }
+func (iface *testUsbConnIO) Close()             {}
+
+// TestUsbTransportDrainTime tests that draining of the abandoned
+// response, that device doesn't finish, is limited in time
+func TestUsbTransportDrainTime(t *testing.T) {
+	save := Conf.UsbMaxDrainTime
+	Conf.UsbMaxDrainTime = 50 * time.Millisecond
+	defer func() { Conf.UsbMaxDrainTime = save }()
+
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connPool:     make(chan *usbConn, 1),
+		connReleased: make(chan struct{}, 1),
+		connstate:    newUsbConnState(1),
+		stats:        &DevStats{},
+		recvAlign:    UsbRecvAlign,
+	}
+
+	iface := &testUsbConnIO{}
+	conn := &usbConn{transport: transport, iface: iface, session: -1}
+	conn.reader = bufio.NewReader(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn.setRWCtx(ctx)
+
+	body := &usbResponseBodyWrapper{
+		log:        transport.log,
+		body:       ioutil.NopCloser(conn),
+		conn:       conn,
+		cleanupCtx: cancel,
+	}
+
+	body.Close()
+
+	select {
+	case <-transport.connPool:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not released")
+	}
+
+	if atomic.LoadInt32(&iface.softResets) != 1 ||
+		atomic.LoadInt32(&iface.clearHalts) != 1 {
+		t.Errorf("expected 1 soft reset and 1 clear halt, "+
+			"present %d and %d", iface.softResets, iface.clearHalts)
+	}
+}
+
+// TestUsbTransportMaxDrains tests that count of concurrent drains
+// is limited
+func TestUsbTransportMaxDrains(t *testing.T) {
+	save := Conf.UsbMaxDrains
+	Conf.UsbMaxDrains = 1
+	defer func() { Conf.UsbMaxDrains = save }()
+
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connPool:     make(chan *usbConn, 1),
+		connReleased: make(chan struct{}, 1),
+		connstate:    newUsbConnState(1),
+		stats:        &DevStats{},
+		recvAlign:    UsbRecvAlign,
+	}
+
+	// Simulate drain in progress
+	transport.drains.begin()
+
+	iface := &testUsbConnIO{}
+	conn := &usbConn{transport: transport, iface: iface, session: -1}
+	conn.reader = bufio.NewReader(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn.setRWCtx(ctx)
+
+	body := &usbResponseBodyWrapper{
+		log:        transport.log,
+		body:       ioutil.NopCloser(conn),
+		conn:       conn,
+		cleanupCtx: cancel,
+	}
+
+	body.Close()
+
+	// Connection must be recycled without waiting for data
+	select {
+	case <-transport.connPool:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not released")
+	}
+
+	if atomic.LoadInt32(&iface.softResets) != 1 ||
+		atomic.LoadInt32(&iface.clearHalts) != 0 {
+		t.Errorf("expected 1 soft reset and no clear halt, "+
+			"present %d and %d", iface.softResets, iface.clearHalts)
+	}
+
+	expected := "drains: active 1 (peak 1), total 1 (0 bytes), " +
+		"recycled 0 over budget, 1 over max-drains"
+	if s := transport.drains.format(); s != expected {
+		t.Errorf("metrics:\nexpected: %s\npresent:  %s", expected, s)
+	}
+}
+
+// TestUsbTransportZlpRecvHack tests automatic learning of
+// the zlp-recv-hack behavior
+func TestUsbTransportZlpRecvHack(t *testing.T) {
+	newTransport := func(quirks Quirks) *UsbTransport {
+		return &UsbTransport{
+			log:       NewLogger(),
+			connstate: newUsbConnState(1),
+			stats:     &DevStats{},
+			recvAlign: UsbRecvAlign,
+			quirks:    quirks,
+		}
+	}
+
+	// read performs a single read, where ZLP is followed by timeout
+	read := func(transport *UsbTransport) error {
+		iface := &testUsbConnIO{recvZlps: 1}
+		conn := &usbConn{transport: transport, iface: iface}
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			50*time.Millisecond)
+		defer cancel()
+		conn.setRWCtx(ctx)
+
+		_, err := conn.Read(make([]byte, 1024))
+		return err
+	}
+
+	// Behavior is learned after UsbZlpRecvHackThreshold hits
+	transport := newTransport(Quirks{})
+	learned := 0
+	transport.OnZlpRecvHackLearned(func() { learned++ })
+
+	for i := 0; i < UsbZlpRecvHackThreshold; i++ {
+		err := read(transport)
+		if err != context.DeadlineExceeded {
+			t.Errorf("hit %d: expected %v, present %v",
+				i+1, context.DeadlineExceeded, err)
+		}
+	}
+
+	if learned != 1 || !transport.zlpRecvHackEnabled() {
+		t.Fatalf("zlp-recv-hack not learned")
+	}
+
+	// Now ZLP+timeout is interpreted as EOF
+	if err := read(transport); err != io.EOF {
+		t.Errorf("learned: expected %v, present %v", io.EOF, err)
+	}
+
+	// Explicitly set quirk takes precedence over learned behavior
+	q, _ := QuirkOverride(QuirkNmZlpRecvHack, "false")
+	transport = newTransport(Quirks{}.With(q))
+	learned = 0
+	transport.OnZlpRecvHackLearned(func() { learned++ })
+	transport.EnableZlpRecvHack()
+
+	if transport.zlpRecvHackEnabled() {
+		t.Errorf("zlp-recv-hack = false: hack enabled")
+	}
+
+	for i := 0; i < UsbZlpRecvHackThreshold; i++ {
+		read(transport)
+	}
+
+	if learned != 0 {
+		t.Errorf("zlp-recv-hack = false: behavior learned")
+	}
+}
+
+// TestUsbTransportSendDelay tests the adaptive usb-send-delay mode
+func TestUsbTransportSendDelay(t *testing.T) {
+	transport := &UsbTransport{
+		log:   NewLogger(),
+		stats: &DevStats{},
+	}
+
+	iface := &testUsbConnIO{sendStall: 2 * UsbSendStallTime}
+	conn := &usbConn{transport: transport, iface: iface, sendAdapt: true}
+	conn.setRWCtx(context.Background())
+
+	// Stalled write must cause drain rate estimation
+	data := make([]byte, 8192)
+	conn.write(data)
+
+	learned := atomic.LoadInt64(&transport.sendRate)
+	if learned == 0 {
+		t.Fatalf("drain rate not learned")
+	}
+
+	// The next write must be delayed accordingly
+	iface.sendStall = 0
+	start := time.Now()
+	conn.write(data)
+	elapsed := time.Since(start)
+
+	expected := time.Duration(int64(len(data)) * int64(time.Second) /
+		int64(learned))
+	if elapsed < expected*3/4 {
+		t.Errorf("write delayed for %s, expected %s", elapsed, expected)
+	}
+}
+
+// TestUsbTransportSendRate tests estimation of device drain rate
+// in the adaptive usb-send-delay mode
+func TestUsbTransportSendRate(t *testing.T) {
+	transport := &UsbTransport{log: NewLogger()}
+
+	var learned []int
+	transport.OnSendRateLearned(func(rate int) {
+		learned = append(learned, rate)
+	})
+
+	conn := &usbConn{transport: transport, sendAdapt: true}
+	rate := func() int64 {
+		return atomic.LoadInt64(&transport.sendRate)
+	}
+
+	// Long stall (i.e., out of paper) is ignored
+	transport.sendRateUpdate(conn, 16384, 120*time.Second)
+	if rate() != 0 {
+		t.Errorf("long stall: rate %d, expected 0", rate())
+	}
+
+	// Stall sets the rate, with the lower bound
+	transport.sendRateUpdate(conn, 16384, 8*time.Second)
+	if rate() != UsbSendRateMin {
+		t.Errorf("stall: rate %d, expected %d", rate(), UsbSendRateMin)
+	}
+
+	// Rate recovers on writes, not stalled
+	transport.sendRateUpdate(conn, 16384, time.Millisecond)
+	expected := int64(UsbSendRateMin + UsbSendRateMin/UsbSendRateRecover)
+	if rate() != expected {
+		t.Errorf("recovery: rate %d, expected %d", rate(), expected)
+	}
+
+	// Single sample is not persisted
+	if len(learned) != 0 {
+		t.Errorf("single sample persisted: %v", learned)
+	}
+
+	// Subsequent stalls move rate toward the measured value,
+	// and the rate is persisted after UsbSendRateSamples
+	for i := 1; i < UsbSendRateSamples; i++ {
+		transport.sendRateUpdate(conn, 16384, 4*time.Second)
+	}
+
+	if len(learned) != 1 || int64(learned[0]) != rate() {
+		t.Errorf("rate %d, persisted %v", rate(), learned)
+	}
+
+	// Eventually rate grows high enough to disable delays
+	for i := 0; i < 10000 && rate() != 0; i++ {
+		transport.sendRateUpdate(conn, 16384, time.Millisecond)
+	}
+
+	if rate() != 0 || learned[len(learned)-1] != 0 {
+		t.Errorf("rate not recovered: %d, persisted %v", rate(), learned)
+	}
+
+	// Persisted tiny rate is raised to the lower bound
+	transport.SetSendRate(136)
+	if rate() != UsbSendRateMin {
+		t.Errorf("SetSendRate: rate %d, expected %d",
+			rate(), UsbSendRateMin)
+	}
+}
+
+// TestUsbTransportSanitizeLimit tests that IPP sanitizer doesn't
+// consume more than ipp-sanitize-max-size bytes and passes the
+// oversized message unchanged
+func TestUsbTransportSanitizeLimit(t *testing.T) {
+	save := Conf.UsbIppSanitizeMax
+	defer func() { Conf.UsbIppSanitizeMax = save }()
+
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-info",
+		goipp.TagText, goipp.String(strings.Repeat("x", 1000))))
+
+	data, _ := msg.EncodeBytes()
+	data = append(data, "document data"...)
+
+	transport := &UsbTransport{log: NewLogger()}
+
+	test := func(limit int64) (prefetched int, body string) {
+		Conf.UsbIppSanitizeMax = limit
+
+		resp := &http.Response{
+			Header:        make(http.Header),
+			ContentLength: int64(len(data)),
+		}
+		resp.Body = &usbResponseBodyWrapper{
+			log:  transport.log,
+			body: ioutil.NopCloser(bytes.NewReader(data)),
+		}
+
+		transport.sanitizeIppResponse(1, resp)
+		prefetched = resp.Body.(*usbResponseBodyWrapper).preBody.Len()
+
+		body2, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("limit %d: %s", limit, err)
+		}
+
+		return prefetched, string(body2)
+	}
+
+	prefetched, body := test(100)
+	if prefetched > 100 {
+		t.Errorf("limit 100: %d bytes prefetched", prefetched)
+	}
+
+	if body != string(data) {
+		t.Errorf("limit 100: body modified")
+	}
+
+	prefetched, body = test(0)
+	if prefetched != len(data)-len("document data") {
+		t.Errorf("no limit: %d bytes prefetched", prefetched)
+	}
+
+	if body != string(data) {
+		t.Errorf("no limit: body modified")
+	}
+}
+
+// TestUsbSendPad tests padding of requests for usb-send-align
+func TestUsbSendPad(t *testing.T) {
+	type testData struct {
+		in     string
+		align  int
+		padded bool
+	}
+
+	tests := []testData{
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 64, true},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 36, true},
+		{"GET / HTTP/1.1\r\nHost: local\r\n\r\n", 31, false},
+		{"5\r\nhello\r\n0\r\n\r\n", 512, true},
+		{"binary body", 64, false},
+	}
+
+	for _, test := range tests {
+		out := usbSendPad([]byte(test.in), test.align)
+
+		switch {
+		case !test.padded && string(out) != test.in:
+			t.Errorf("%q: unexpectedly modified", test.in)
+
+		case test.padded && len(out)%test.align != 0:
+			t.Errorf("%q: length %d not aligned to %d",
+				test.in, len(out), test.align)
+
+		case test.padded && !strings.HasPrefix(string(out),
+			test.in[:len(test.in)-2]+"X-Pad: "):
+			t.Errorf("%q: bad padding %q", test.in, out)
+
+		case test.padded && !strings.HasSuffix(string(out), "\r\n\r\n"):
+			t.Errorf("%q: bad padding %q", test.in, out)
+		}
+	}
+}
+
+// TestUsbTransportHTTPHeaderExpand tests expansion of placeholders
+// in values of the http-XXX quirks
+func TestUsbTransportHTTPHeaderExpand(t *testing.T) {
+	transport := &UsbTransport{
+		info: UsbDeviceInfo{
+			Vendor:       0x03f0,
+			Product:      0x2b17,
+			SerialNumber: "VCF9192281",
+		},
+	}
+
+	rq, _ := http.NewRequest("GET", "http://127.0.0.1:60000/", nil)
+	ident := transport.info.Ident()
+
+	tests := []struct{ in, out string }{
+		{"localhost", "localhost"},
+		{"localhost:{port}", "localhost:80"},
+		{"ipp-usb ({ident})", "ipp-usb (" + ident + ")"},
+		{"{host}", "127.0.0.1:60000"},
+		{"{unknown}", "{unknown}"},
+	}
+
+	for _, test := range tests {
+		out := transport.httpHeaderExpand(test.in, rq)
+		if out != test.out {
+			t.Errorf("%q: expected %q, present %q",
+				test.in, test.out, out)
+		}
+	}
+
+	transport.SetHTTPPort(60000)
+	out := transport.httpHeaderExpand("localhost:{port}", rq)
+	if out != "localhost:60000" {
+		t.Errorf("{port}: expected %q, present %q",
+			"localhost:60000", out)
+	}
+}